@@ -0,0 +1,303 @@
+// Package acpi generates ACPI tables and emulates the registers behind them.
+//
+// The AML encoder covers what the generated tables need rather than the
+// whole language.
+//
+// refs: https://uefi.org/specs/ACPI/6.5/20_AML_Specification.html
+package acpi
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	zeroOp       = 0x00
+	oneOp        = 0x01
+	nameOp       = 0x08
+	bytePrefix   = 0x0a
+	stringPrefix = 0x0d
+	wordPrefix   = 0x0b
+	dwordPrefix  = 0x0c
+	qwordPrefix  = 0x0e
+	scopeOp      = 0x10
+	bufferOp     = 0x11
+	packageOp    = 0x12
+	methodOp     = 0x14
+	dualNamePfx  = 0x2e
+	multiNamePfx = 0x2f
+	extOpPrefix  = 0x5b
+	rootChar     = 0x5c
+	storeOp      = 0x70
+	andOp        = 0x7b
+	notifyOp     = 0x86
+	ifOp         = 0xa0
+
+	opRegionOp = 0x80 // after extOpPrefix
+	fieldOp    = 0x81 // after extOpPrefix
+	deviceOp   = 0x82 // after extOpPrefix
+
+	// RegionSpaceSystemIO is the address space of an OperationRegion on I/O ports.
+	RegionSpaceSystemIO = 0x01
+
+	// FieldDWordAccWriteAsZeros are the field flags DWordAcc, NoLock, WriteAsZeros.
+	FieldDWordAccWriteAsZeros = 0x03 | 0x2<<5
+)
+
+// encodeLength encodes v in the PkgLength format of 1 to 4 bytes.
+func encodeLength(v int) []byte {
+	switch {
+	case v < 1<<6:
+		return []byte{byte(v)}
+	case v < 1<<12:
+		return []byte{1<<6 | byte(v&0xf), byte(v >> 4)}
+	case v < 1<<20:
+		return []byte{2<<6 | byte(v&0xf), byte(v >> 4), byte(v >> 12)}
+	default:
+		return []byte{3<<6 | byte(v&0xf), byte(v >> 4), byte(v >> 12), byte(v >> 20)}
+	}
+}
+
+// pkgLength encodes the PkgLength of a package whose contents are n bytes
+// long. Unlike the bit count of a field, it counts its own encoding.
+func pkgLength(n int) []byte {
+	for size, limit := range []int{1 << 6, 1 << 12, 1 << 20} {
+		if n+size+1 < limit {
+			return encodeLength(n + size + 1)
+		}
+	}
+
+	return encodeLength(n + 4)
+}
+
+func pkg(op []byte, contents ...[]byte) []byte {
+	body := concat(contents...)
+
+	return concat(op, pkgLength(len(body)), body)
+}
+
+func concat(parts ...[]byte) []byte {
+	b := []byte{}
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+// NameString encodes a path such as `\_SB.PCI0` or `S01`. Segments shorter
+// than four characters are padded with '_'.
+func NameString(path string) []byte {
+	b := []byte{}
+
+	if strings.HasPrefix(path, `\`) {
+		b = append(b, rootChar)
+		path = path[1:]
+	}
+
+	for strings.HasPrefix(path, "^") {
+		b = append(b, '^')
+		path = path[1:]
+	}
+
+	if path == "" {
+		return append(b, zeroOp)
+	}
+
+	segs := strings.Split(path, ".")
+
+	switch len(segs) {
+	case 1:
+	case 2:
+		b = append(b, dualNamePfx)
+	default:
+		b = append(b, multiNamePfx, byte(len(segs)))
+	}
+
+	for _, s := range segs {
+		b = append(b, (s + "___")[:4]...)
+	}
+
+	return b
+}
+
+// Integer encodes n in the smallest form.
+func Integer(n uint64) []byte {
+	switch {
+	case n == 0:
+		return []byte{zeroOp}
+	case n == 1:
+		return []byte{oneOp}
+	case n <= 0xff:
+		return []byte{bytePrefix, byte(n)}
+	case n <= 0xffff:
+		return []byte{wordPrefix, byte(n), byte(n >> 8)}
+	case n <= 0xffffffff:
+		b := []byte{dwordPrefix, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(b[1:], uint32(n))
+
+		return b
+	default:
+		b := []byte{qwordPrefix, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(b[1:], n)
+
+		return b
+	}
+}
+
+// Scope encodes Scope(name) { terms }.
+func Scope(name string, terms ...[]byte) []byte {
+	return pkg([]byte{scopeOp}, append([][]byte{NameString(name)}, terms...)...)
+}
+
+// Device encodes Device(name) { terms }.
+func Device(name string, terms ...[]byte) []byte {
+	return pkg([]byte{extOpPrefix, deviceOp}, append([][]byte{NameString(name)}, terms...)...)
+}
+
+// Name encodes Name(name, value).
+func Name(name string, value []byte) []byte {
+	return concat([]byte{nameOp}, NameString(name), value)
+}
+
+// Method encodes a not serialized Method(name, nargs) { terms }.
+func Method(name string, nargs int, terms ...[]byte) []byte {
+	return pkg([]byte{methodOp}, append([][]byte{NameString(name), {byte(nargs & 7)}}, terms...)...)
+}
+
+// OperationRegion encodes OperationRegion(name, space, offset, length).
+func OperationRegion(name string, space byte, offset, length uint64) []byte {
+	return concat([]byte{extOpPrefix, opRegionOp}, NameString(name), []byte{space}, Integer(offset), Integer(length))
+}
+
+// FieldUnit is a named field of Bits bits.
+type FieldUnit struct {
+	Name string
+	Bits int
+}
+
+// Field encodes Field(region, flags) { units }.
+func Field(region string, flags byte, units ...FieldUnit) []byte {
+	list := [][]byte{NameString(region), {flags}}
+
+	for _, u := range units {
+		list = append(list, []byte((u.Name + "___")[:4]), encodeLength(u.Bits))
+	}
+
+	return pkg([]byte{extOpPrefix, fieldOp}, list...)
+}
+
+// Store encodes Store(value, target).
+func Store(value []byte, target string) []byte {
+	return concat([]byte{storeOp}, value, NameString(target))
+}
+
+// And encodes And(a, b) without a target.
+func And(a, b []byte) []byte {
+	return concat([]byte{andOp}, a, b, []byte{zeroOp})
+}
+
+// If encodes If (predicate) { terms }.
+func If(predicate []byte, terms ...[]byte) []byte {
+	return pkg([]byte{ifOp}, append([][]byte{predicate}, terms...)...)
+}
+
+// Notify encodes Notify(object, value).
+func Notify(object string, value uint64) []byte {
+	return concat([]byte{notifyOp}, NameString(object), Integer(value))
+}
+
+// Call encodes a call of the method at path with args.
+func Call(path string, args ...[]byte) []byte {
+	return concat(append([][]byte{NameString(path)}, args...)...)
+}
+
+// Table is an ACPI description table: the 36-byte header followed by body,
+// with the length and checksum filled in.
+func Table(signature, oemTableID string, revision byte, body []byte) []byte {
+	b := make([]byte, 36, 36+len(body))
+
+	copy(b[0:4], signature)
+	binary.LittleEndian.PutUint32(b[4:], uint32(36+len(body)))
+	b[8] = revision
+	copy(b[10:16], "GOKVM ")
+	copy(b[16:24], (oemTableID + "        ")[:8])
+	binary.LittleEndian.PutUint32(b[24:], 1)
+	copy(b[28:32], "GKVM")
+	binary.LittleEndian.PutUint32(b[32:], 1)
+
+	b = append(b, body...)
+
+	sum := byte(0)
+	for _, c := range b {
+		sum += c
+	}
+
+	b[9] = -sum
+
+	return b
+}
+
+// String encodes the string s.
+func String(s string) []byte {
+	return concat([]byte{stringPrefix}, []byte(s), []byte{0})
+}
+
+// EISAID encodes an EISA ID such as PNP0A03 as the integer that _HID
+// takes, three letters of five bits each and four hex digits.
+func EISAID(id string) []byte {
+	var product uint32
+
+	for _, c := range id[3:7] {
+		product <<= 4
+
+		switch {
+		case c >= '0' && c <= '9':
+			product |= uint32(c - '0')
+		case c >= 'A' && c <= 'F':
+			product |= uint32(c - 'A' + 10)
+		}
+	}
+
+	v := uint32(id[0]-'@')<<26 | uint32(id[1]-'@')<<21 | uint32(id[2]-'@')<<16 | product
+
+	// The ID is stored big-endian.
+	return Integer(uint64(v>>24 | v>>8&0xff00 | v<<8&0xff0000 | v<<24))
+}
+
+// Package encodes Package() { elements }.
+func Package(elements ...[]byte) []byte {
+	return pkg([]byte{packageOp}, append([][]byte{{byte(len(elements))}}, elements...)...)
+}
+
+// Buffer encodes Buffer() { data }.
+func Buffer(data []byte) []byte {
+	return pkg([]byte{bufferOp}, Integer(uint64(len(data))), data)
+}
+
+// Tags of the small resource descriptors, with their lengths.
+const (
+	resourceIRQ  = 0x22
+	resourceIO   = 0x47
+	resourceEnd  = 0x79
+	ioDecode16   = 0x01
+	endChecksum0 = 0x00
+)
+
+// ResourceTemplate encodes ResourceTemplate() { descriptors }, e.g. of
+// IO and IRQNoFlags, for a _CRS.
+func ResourceTemplate(descriptors ...[]byte) []byte {
+	return Buffer(concat(append(descriptors, []byte{resourceEnd, endChecksum0})...))
+}
+
+// IO describes length ports at base, decoded on 16 bits.
+func IO(base uint16, length byte) []byte {
+	return []byte{resourceIO, ioDecode16, byte(base), byte(base >> 8), byte(base), byte(base >> 8), 1, length}
+}
+
+// IRQNoFlags describes the edge-triggered, active-high ISA interrupt irq.
+func IRQNoFlags(irq int) []byte {
+	mask := uint16(1) << irq
+
+	return []byte{resourceIRQ, byte(mask), byte(mask >> 8)}
+}
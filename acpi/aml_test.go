@@ -0,0 +1,116 @@
+package acpi_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+func TestNameString(t *testing.T) {
+	t.Parallel()
+
+	for path, expected := range map[string][]byte{
+		"S01":            []byte("S01_"),
+		`\_SB`:           []byte(`\_SB_`),
+		`\_SB.PCI0`:      append([]byte{'\\', 0x2e}, "_SB_PCI0"...),
+		`\_SB.PCI0.PCNT`: append([]byte{'\\', 0x2f, 3}, "_SB_PCI0PCNT"...),
+		"^PCIU":          []byte("^PCIU"),
+		`\`:              {'\\', 0},
+	} {
+		if actual := acpi.NameString(path); !bytes.Equal(actual, expected) {
+			t.Errorf("%s: expected: %q, actual: %q", path, expected, actual)
+		}
+	}
+}
+
+func TestInteger(t *testing.T) {
+	t.Parallel()
+
+	for n, expected := range map[uint64][]byte{
+		0:           {0x00},
+		1:           {0x01},
+		0x42:        {0x0a, 0x42},
+		0x1234:      {0x0b, 0x34, 0x12},
+		0x10000:     {0x0c, 0x00, 0x00, 0x01, 0x00},
+		0x100000000: {0x0e, 0, 0, 0, 0, 1, 0, 0, 0},
+	} {
+		if actual := acpi.Integer(n); !bytes.Equal(actual, expected) {
+			t.Errorf("%#x: expected: %#x, actual: %#x", n, expected, actual)
+		}
+	}
+}
+
+func TestMethod(t *testing.T) {
+	t.Parallel()
+
+	// Method (_EJ0, 1) { Store (0x02, B0EJ) } as compiled by iasl
+	expected := []byte{0x14, 0x0d, '_', 'E', 'J', '0', 0x01, 0x70, 0x0a, 0x02, 'B', '0', 'E', 'J'}
+	actual := acpi.Method("_EJ0", 1, acpi.Store(acpi.Integer(2), "B0EJ"))
+
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("expected: %#x, actual: %#x", expected, actual)
+	}
+}
+
+func TestPkgLength(t *testing.T) {
+	t.Parallel()
+
+	// A body of 61 bytes still fits a 1-byte PkgLength, 62 does not.
+	short := acpi.Scope("S01", bytes.Repeat([]byte{0xa3}, 57))
+	if short[1] != 62 || len(short) != 63 {
+		t.Fatalf("1-byte PkgLength: %#x, %d bytes", short[1], len(short))
+	}
+
+	long := acpi.Scope("S01", bytes.Repeat([]byte{0xa3}, 59))
+	if long[1] != 0x40|(65&0xf) || long[2] != 65>>4 || len(long) != 66 {
+		t.Fatalf("2-byte PkgLength: %#x %#x, %d bytes", long[1], long[2], len(long))
+	}
+}
+
+func TestTable(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.Table("SSDT", "TEST", 2, []byte{0x10, 0x05, '\\', '_', 'S', 'B', '_'})
+
+	if len(b) != 43 || b[4] != 43 || string(b[:4]) != "SSDT" {
+		t.Fatalf("invalid header: %#x", b[:36])
+	}
+
+	sum := byte(0)
+	for _, c := range b {
+		sum += c
+	}
+
+	if sum != 0 {
+		t.Fatalf("checksum: sum is %#x, want 0", sum)
+	}
+}
+
+func TestResourceTemplate(t *testing.T) {
+	t.Parallel()
+
+	// Name (_HID, EisaId ("PNP0501")) as compiled by iasl
+	expected := []byte{0x08, '_', 'H', 'I', 'D', 0x0c, 0x41, 0xd0, 0x05, 0x01}
+	if actual := acpi.Name("_HID", acpi.EISAID("PNP0501")); !bytes.Equal(actual, expected) {
+		t.Errorf("expected: %#x, actual: %#x", expected, actual)
+	}
+
+	// ResourceTemplate () { IO (Decode16, 0x03F8, 0x03F8, 0x01, 0x08)
+	// IRQNoFlags () {4} } as compiled by iasl
+	expected = []byte{
+		0x11, 0x10, 0x0a, 0x0d,
+		0x47, 0x01, 0xf8, 0x03, 0xf8, 0x03, 0x01, 0x08,
+		0x22, 0x10, 0x00,
+		0x79, 0x00,
+	}
+	if actual := acpi.ResourceTemplate(acpi.IO(0x3f8, 8), acpi.IRQNoFlags(4)); !bytes.Equal(actual, expected) {
+		t.Errorf("expected: %#x, actual: %#x", expected, actual)
+	}
+
+	// Package () { 0x05, Zero, "a" }
+	expected = []byte{0x12, 0x08, 0x03, 0x0a, 0x05, 0x00, 0x0d, 'a', 0x00}
+	if actual := acpi.Package(acpi.Integer(5), acpi.Integer(0), acpi.String("a")); !bytes.Equal(actual, expected) {
+		t.Errorf("expected: %#x, actual: %#x", expected, actual)
+	}
+}
@@ -0,0 +1,201 @@
+package acpi
+
+import (
+	"encoding/binary"
+)
+
+// The static tables that an arm64 guest booted by UEFI with ACPI needs on
+// top of the DSDT, as in Arm SystemReady: the MADT with the GIC, the GTDT
+// with the generic timer, and the SPCR for the console. The file name
+// keeps away from the _arm64 suffix, as the tables are built on any host.
+//
+// refs: https://uefi.org/specs/ACPI/6.5/05_ACPI_Software_Programming_Model.html
+// refs: https://learn.microsoft.com/en-us/windows-hardware/drivers/serports/serial-port-console-redirection-table
+
+// MADT entry types and lengths of ACPI 6.3.
+const (
+	madtGICC    = 0x0b
+	madtGICD    = 0x0c
+	madtGICR    = 0x0e
+	madtGICCLen = 80
+	madtGICDLen = 24
+	madtGICRLen = 16
+
+	// GICCEnabled is the flag of a usable CPU interface.
+	GICCEnabled = 1 << 0
+)
+
+// GIC versions of the GICD entry.
+const (
+	GICv2 = 2
+	GICv3 = 3
+)
+
+// GICC is the GIC CPU interface of a processor.
+type GICC struct {
+	// CPUInterface is the number of the interface, which GICv3 ignores,
+	// and UID that of the processor in the DSDT.
+	CPUInterface, UID uint32
+	Flags             uint32
+	// PerfGSIV is the interrupt of the PMU, VGICMaintGSIV that of the
+	// virtual GIC maintenance, 0 for none.
+	PerfGSIV, VGICMaintGSIV uint32
+	// Base, GICV and GICH are the physical addresses of the GICv2 CPU,
+	// virtual CPU and hypervisor interfaces, and GICR that of the
+	// redistributor of a GICv3 if not in a GICR range.
+	Base, GICV, GICH, GICR uint64
+	MPIDR                  uint64
+}
+
+// GIC is the interrupt controller of an arm64 guest.
+type GIC struct {
+	Version byte
+	// DistBase is the address of the distributor, and RedistBase and
+	// RedistLen the range of GICv3 redistributors.
+	DistBase   uint64
+	RedistBase uint64
+	RedistLen  uint32
+	CPUs       []GICC
+}
+
+// MADT returns the MADT of gic.
+func MADT(gic GIC) []byte {
+	// The local interrupt controller address and the flags are for x86.
+	body := make([]byte, 8)
+
+	for _, c := range gic.CPUs {
+		e := make([]byte, madtGICCLen)
+		e[0], e[1] = madtGICC, madtGICCLen
+		binary.LittleEndian.PutUint32(e[4:], c.CPUInterface)
+		binary.LittleEndian.PutUint32(e[8:], c.UID)
+		binary.LittleEndian.PutUint32(e[12:], c.Flags)
+		binary.LittleEndian.PutUint32(e[20:], c.PerfGSIV)
+		binary.LittleEndian.PutUint64(e[32:], c.Base)
+		binary.LittleEndian.PutUint64(e[40:], c.GICV)
+		binary.LittleEndian.PutUint64(e[48:], c.GICH)
+		binary.LittleEndian.PutUint32(e[56:], c.VGICMaintGSIV)
+		binary.LittleEndian.PutUint64(e[60:], c.GICR)
+		binary.LittleEndian.PutUint64(e[68:], c.MPIDR)
+		body = append(body, e...)
+	}
+
+	d := make([]byte, madtGICDLen)
+	d[0], d[1] = madtGICD, madtGICDLen
+	binary.LittleEndian.PutUint64(d[8:], gic.DistBase)
+	d[20] = gic.Version
+	body = append(body, d...)
+
+	if gic.Version >= GICv3 {
+		r := make([]byte, madtGICRLen)
+		r[0], r[1] = madtGICR, madtGICRLen
+		binary.LittleEndian.PutUint64(r[4:], gic.RedistBase)
+		binary.LittleEndian.PutUint32(r[12:], gic.RedistLen)
+		body = append(body, r...)
+	}
+
+	return Table("APIC", "GOKVMGIC", 5, body)
+}
+
+// Flags of a timer interrupt in the GTDT.
+const (
+	TimerEdgeTriggered = 1 << 0
+	TimerActiveLow     = 1 << 1
+	TimerAlwaysOn      = 1 << 2
+)
+
+// Timer is an interrupt of the generic timer, a PPI, with its flags.
+type Timer struct {
+	GSIV, Flags uint32
+}
+
+// GenericTimer is the generic timer of an arm64 guest, which KVM provides
+// with the PPIs of the secure and non-secure physical, virtual and
+// hypervisor timers.
+type GenericTimer struct {
+	SecureEL1, NonSecureEL1, VirtualEL1, EL2 Timer
+}
+
+// noMemoryMappedTimer is the CntControlBase and CntReadBase of a system
+// without memory-mapped counters.
+const noMemoryMappedTimer = ^uint64(0)
+
+// GTDT returns the GTDT of t, without platform timers.
+func GTDT(t GenericTimer) []byte {
+	body := make([]byte, 60)
+
+	binary.LittleEndian.PutUint64(body[0:], noMemoryMappedTimer)
+
+	for i, timer := range []Timer{t.SecureEL1, t.NonSecureEL1, t.VirtualEL1, t.EL2} {
+		binary.LittleEndian.PutUint32(body[12+8*i:], timer.GSIV)
+		binary.LittleEndian.PutUint32(body[16+8*i:], timer.Flags)
+	}
+
+	binary.LittleEndian.PutUint64(body[44:], noMemoryMappedTimer)
+	// The platform timer count and offset stay 0.
+
+	return Table("GTDT", "GOKVMTMR", 2, body)
+}
+
+// SPCR interface types, interrupt types and baud rates.
+const (
+	SPCR16550       = 0x00
+	SPCRPL011       = 0x03
+	SPCRSBSAGeneric = 0x0e
+
+	spcrInterruptGIC = 1 << 3
+
+	SPCRBaud9600   = 3
+	SPCRBaud115200 = 7
+)
+
+// Console is the serial console of a guest, an MMIO UART with a GIC
+// interrupt.
+type Console struct {
+	InterfaceType byte
+	// Base is the address of the registers, and Width their width in
+	// bits.
+	Base  uint64
+	Width byte
+	GSIV  uint32
+	Baud  byte
+}
+
+// SPCR returns the SPCR of c, for the firmware and the kernel to find the
+// console, e.g. for earlycon without a console= parameter.
+func SPCR(c Console) []byte {
+	body := make([]byte, 44)
+	body[0] = c.InterfaceType
+
+	// The registers as a generic address structure in system memory.
+	body[4], body[5], body[6], body[7] = 0, c.Width, 0, accessSize(c.Width)
+	binary.LittleEndian.PutUint64(body[8:], c.Base)
+
+	body[16] = spcrInterruptGIC
+	binary.LittleEndian.PutUint32(body[18:], c.GSIV)
+	body[22] = c.Baud
+	body[23] = 0 // no parity
+	body[24] = 1 // 1 stop bit
+	body[25] = 0 // no flow control
+	body[26] = 0 // VT100
+
+	// Not a PCI device.
+	binary.LittleEndian.PutUint16(body[28:], 0xffff)
+	binary.LittleEndian.PutUint16(body[30:], 0xffff)
+
+	return Table("SPCR", "GOKVMCON", 2, body)
+}
+
+// accessSize is the access size of a generic address structure of width
+// bits: 1 for bytes up to 4 for quad words.
+func accessSize(width byte) byte {
+	switch {
+	case width <= 8:
+		return 1
+	case width <= 16:
+		return 2
+	case width <= 32:
+		return 3
+	default:
+		return 4
+	}
+}
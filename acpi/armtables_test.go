@@ -0,0 +1,108 @@
+package acpi_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+func checksum(t *testing.T, b []byte) {
+	t.Helper()
+
+	sum := byte(0)
+	for _, c := range b {
+		sum += c
+	}
+
+	if sum != 0 || int(binary.LittleEndian.Uint32(b[4:])) != len(b) {
+		t.Fatalf("%s: checksum %#x, length %d of %d bytes", b[:4], sum, binary.LittleEndian.Uint32(b[4:]), len(b))
+	}
+}
+
+func TestMADT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.MADT(acpi.GIC{
+		Version: acpi.GICv3, DistBase: 0x8000000, RedistBase: 0x80a0000, RedistLen: 0xf60000,
+		CPUs: []acpi.GICC{
+			{UID: 0, Flags: acpi.GICCEnabled, MPIDR: 0},
+			{CPUInterface: 1, UID: 1, Flags: acpi.GICCEnabled, MPIDR: 1},
+		},
+	})
+	checksum(t, b)
+
+	// The header and 8 bytes, two GICCs, a GICD and a GICR.
+	if len(b) != 36+8+2*80+24+16 || string(b[:4]) != "APIC" {
+		t.Fatalf("invalid MADT of %d bytes", len(b))
+	}
+
+	gicc := b[44+80:]
+	if gicc[0] != 0x0b || gicc[1] != 80 || binary.LittleEndian.Uint32(gicc[8:]) != 1 ||
+		binary.LittleEndian.Uint64(gicc[68:]) != 1 {
+		t.Errorf("invalid GICC of vCPU 1: %#x", gicc[:80])
+	}
+
+	gicd := b[44+160:]
+	if gicd[0] != 0x0c || binary.LittleEndian.Uint64(gicd[8:]) != 0x8000000 || gicd[20] != acpi.GICv3 {
+		t.Errorf("invalid GICD: %#x", gicd[:24])
+	}
+
+	gicr := b[44+184:]
+	if gicr[0] != 0x0e || binary.LittleEndian.Uint64(gicr[4:]) != 0x80a0000 ||
+		binary.LittleEndian.Uint32(gicr[12:]) != 0xf60000 {
+		t.Errorf("invalid GICR: %#x", gicr)
+	}
+
+	// A GICv2 has no redistributors.
+	if b := acpi.MADT(acpi.GIC{Version: acpi.GICv2}); len(b) != 36+8+24 {
+		t.Errorf("GICv2 MADT of %d bytes", len(b))
+	}
+}
+
+func TestGTDT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.GTDT(acpi.GenericTimer{
+		SecureEL1: acpi.Timer{GSIV: 29}, NonSecureEL1: acpi.Timer{GSIV: 30},
+		VirtualEL1: acpi.Timer{GSIV: 27}, EL2: acpi.Timer{GSIV: 26, Flags: acpi.TimerActiveLow},
+	})
+	checksum(t, b)
+
+	if len(b) != 96 || string(b[:4]) != "GTDT" {
+		t.Fatalf("invalid GTDT of %d bytes", len(b))
+	}
+
+	if binary.LittleEndian.Uint32(b[36+20:]) != 30 || binary.LittleEndian.Uint32(b[36+28:]) != 27 ||
+		binary.LittleEndian.Uint32(b[36+40:]) != acpi.TimerActiveLow {
+		t.Errorf("invalid timers: %#x", b[36:])
+	}
+
+	if binary.LittleEndian.Uint64(b[36:]) != ^uint64(0) || binary.LittleEndian.Uint64(b[36+44:]) != ^uint64(0) {
+		t.Errorf("memory-mapped timer present: %#x", b[36:])
+	}
+}
+
+func TestSPCR(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.SPCR(acpi.Console{
+		InterfaceType: acpi.SPCRPL011, Base: 0x9000000, Width: 32, GSIV: 33, Baud: acpi.SPCRBaud115200,
+	})
+	checksum(t, b)
+
+	if len(b) != 80 || string(b[:4]) != "SPCR" || b[36] != acpi.SPCRPL011 {
+		t.Fatalf("invalid SPCR: %#x", b)
+	}
+
+	// The generic address structure: system memory, 32 bits wide, dword
+	// accesses.
+	if b[40] != 0 || b[41] != 32 || b[43] != 3 || binary.LittleEndian.Uint64(b[44:]) != 0x9000000 {
+		t.Errorf("invalid base address: %#x", b[40:52])
+	}
+
+	if binary.LittleEndian.Uint32(b[54:]) != 33 || b[58] != acpi.SPCRBaud115200 ||
+		binary.LittleEndian.Uint16(b[64:]) != 0xffff {
+		t.Errorf("invalid interrupt, baud rate or PCI IDs: %#x", b[36:])
+	}
+}
@@ -0,0 +1,220 @@
+package acpi
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// PCI hotplug the way QEMU does it on PIIX4, so that guests without native
+// PCIe hotplug find new devices: a bit in GPE0 raises an SCI, whose handler
+// \_GPE._E01 reads which slots came up or are to be ejected and notifies
+// the matching slot devices. A hardware-reduced platform has no GPE
+// blocks, so there the interrupt goes to a Generic Event Device whose _EVT
+// does the same.
+//
+// refs: https://www.qemu.org/docs/master/specs/acpi_pci_hotplug.html
+const (
+	GPE0Base = 0xafe0
+	GPE0Len  = 4
+
+	PCIHotplugBase = 0xae00
+	PCIHotplugLen  = 0x0c
+
+	pcihpUp    = 0x0
+	pcihpDown  = 0x4
+	pcihpEject = 0x8
+
+	// gpePCIHotplug is the GPE0 bit of PCI hotplug events.
+	gpePCIHotplug = 1 << 1
+
+	// Notify values
+	notifyDeviceCheck  = 1
+	notifyEjectRequest = 3
+
+	maxSlots = 32
+)
+
+var ErrSlot = errors.New("invalid PCI slot")
+
+// SCIInjector raises the ACPI system control interrupt.
+type SCIInjector interface {
+	InjectSCI() error
+}
+
+// HotplugSSDT returns an SSDT that describes slots of bus 0 under
+// \_SB.PCI0 as hotpluggable, with the GPE handler for PCIHotplug and a
+// Generic Event Device on the ISA interrupt irq, that of the SCI.
+func HotplugSSDT(slots []int, irq int) ([]byte, error) {
+	const pci0 = `\_SB.PCI0`
+
+	terms := [][]byte{
+		OperationRegion("PCST", RegionSpaceSystemIO, PCIHotplugBase+pcihpUp, 8),
+		Field("PCST", FieldDWordAccWriteAsZeros, FieldUnit{"PCIU", 32}, FieldUnit{"PCID", 32}),
+		OperationRegion("SEJ", RegionSpaceSystemIO, PCIHotplugBase+pcihpEject, 4),
+		Field("SEJ", FieldDWordAccWriteAsZeros, FieldUnit{"B0EJ", 32}),
+	}
+	pcnt := [][]byte{}
+
+	for _, slot := range slots {
+		if slot <= 0 || slot >= maxSlots {
+			return nil, fmt.Errorf("%w: %d", ErrSlot, slot)
+		}
+
+		name := fmt.Sprintf("S%02X", slot)
+		bit := Integer(1 << slot)
+
+		terms = append(terms, Device(name,
+			Name("_ADR", Integer(uint64(slot)<<16)),
+			Name("_SUN", Integer(uint64(slot))),
+			Method("_EJ0", 1, Store(bit, "B0EJ")),
+		))
+
+		pcnt = append(pcnt,
+			If(And(Call("PCIU"), bit), Notify(name, notifyDeviceCheck)),
+			If(And(Call("PCID"), bit), Notify(name, notifyEjectRequest)),
+		)
+	}
+
+	terms = append(terms, Method("PCNT", 0, pcnt...))
+
+	body := concat(
+		Scope(pci0, terms...),
+		Scope(`\_GPE`, Method("_E01", 0, Call(pci0+".PCNT"))),
+		Scope(`\_SB`, Device("GED0",
+			Name("_HID", String("ACPI0013")),
+			Name("_CRS", ResourceTemplate(IRQNoFlags(irq))),
+			Method("_EVT", 1, Call(pci0+".PCNT")),
+		)),
+	)
+
+	return Table("SSDT", "PCIHP", 2, body), nil
+}
+
+// Hotplug emulates GPE0 and the PCI hotplug registers of HotplugSSDT.
+// The machine adds or removes the device itself; Hotplug only tells the
+// guest and reports ejects.
+type Hotplug struct {
+	mu sync.Mutex
+
+	gpeStatus uint16
+	gpeEnable uint16
+
+	up, down uint32
+
+	sci SCIInjector
+
+	// Eject, if set, is called when the guest has ejected a slot.
+	Eject func(slot int)
+	// GED raises the SCI for events whether the guest enabled the GPE or
+	// not, for a hardware-reduced guest that takes them from the Generic
+	// Event Device of HotplugSSDT.
+	GED bool
+}
+
+func NewHotplug(sci SCIInjector) *Hotplug {
+	return &Hotplug{sci: sci}
+}
+
+// Ports returns the GPE0 and PCI hotplug ports.
+func (h *Hotplug) Ports() []uint64 {
+	ports := []uint64{}
+
+	for p := uint64(GPE0Base); p < GPE0Base+GPE0Len; p++ {
+		ports = append(ports, p)
+	}
+
+	for p := uint64(PCIHotplugBase); p < PCIHotplugBase+PCIHotplugLen; p++ {
+		ports = append(ports, p)
+	}
+
+	return ports
+}
+
+// Plug tells the guest that a device was added in slot.
+func (h *Hotplug) Plug(slot int) error {
+	return h.event(slot, &h.up)
+}
+
+// Unplug asks the guest to eject the device in slot.
+func (h *Hotplug) Unplug(slot int) error {
+	return h.event(slot, &h.down)
+}
+
+func (h *Hotplug) event(slot int, bits *uint32) error {
+	if slot <= 0 || slot >= maxSlots {
+		return fmt.Errorf("%w: %d", ErrSlot, slot)
+	}
+
+	h.mu.Lock()
+	*bits |= 1 << slot
+	h.gpeStatus |= gpePCIHotplug
+	raise := h.gpeEnable&gpePCIHotplug != 0 || h.GED
+	h.mu.Unlock()
+
+	if !raise {
+		return nil
+	}
+
+	return h.sci.InjectSCI()
+}
+
+func (h *Hotplug) In(port uint64, bytes []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var v uint32
+
+	switch {
+	case port >= GPE0Base && port < GPE0Base+GPE0Len:
+		v = uint32(h.gpeStatus) | uint32(h.gpeEnable)<<16
+		v >>= 8 * (port - GPE0Base)
+	case port == PCIHotplugBase+pcihpUp:
+		// Reading the slots that came up acknowledges them.
+		v = h.up
+		h.up = 0
+	case port == PCIHotplugBase+pcihpDown:
+		v = h.down
+	}
+
+	for i := range bytes {
+		bytes[i] = byte(v >> (8 * i))
+	}
+
+	return nil
+}
+
+func (h *Hotplug) Out(port uint64, bytes []byte) error {
+	var v uint32
+
+	for i, b := range bytes {
+		v |= uint32(b) << (8 * i)
+	}
+
+	h.mu.Lock()
+
+	var ejected uint32
+
+	switch {
+	case port >= GPE0Base && port < GPE0Base+2:
+		// Status bits are cleared by writing ones.
+		h.gpeStatus &^= uint16(v << (8 * (port - GPE0Base)))
+	case port >= GPE0Base+2 && port < GPE0Base+GPE0Len:
+		shift := 8 * (port - GPE0Base - 2)
+		mask := uint16((1<<(8*len(bytes)) - 1) << shift)
+		h.gpeEnable = h.gpeEnable&^mask | uint16(v<<shift)&mask
+	case port == PCIHotplugBase+pcihpEject:
+		ejected = v & h.down
+		h.down &^= v
+	}
+
+	h.mu.Unlock()
+
+	for slot := 0; slot < maxSlots; slot++ {
+		if ejected&(1<<slot) != 0 && h.Eject != nil {
+			h.Eject(slot)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package acpi_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+type mockSCI struct {
+	count int
+}
+
+func (m *mockSCI) InjectSCI() error {
+	m.count++
+
+	return nil
+}
+
+func TestHotplugSSDT(t *testing.T) {
+	t.Parallel()
+
+	b, err := acpi.HotplugSSDT([]int{1, 2, 0x1f}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := byte(0)
+	for _, c := range b {
+		sum += c
+	}
+
+	if sum != 0 || string(b[:4]) != "SSDT" {
+		t.Fatalf("invalid table: checksum %#x, signature %q", sum, b[:4])
+	}
+
+	for _, name := range []string{"S01_", "S02_", "S1F_", "_EJ0", "PCNT", "_E01", "B0EJ", "GED0", "ACPI0013", "_EVT"} {
+		if !bytes.Contains(b, []byte(name)) {
+			t.Errorf("%s not found", name)
+		}
+	}
+
+	if _, err := acpi.HotplugSSDT([]int{32}, 6); !errors.Is(err, acpi.ErrSlot) {
+		t.Errorf("got %v, want %v", err, acpi.ErrSlot)
+	}
+}
+
+func TestHotplug(t *testing.T) {
+	t.Parallel()
+
+	sci := &mockSCI{}
+	h := acpi.NewHotplug(sci)
+	ejected := -1
+	h.Eject = func(slot int) { ejected = slot }
+
+	// No SCI until the guest enables the GPE.
+	if err := h.Plug(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if sci.count != 0 {
+		t.Fatalf("SCI raised while the GPE is disabled")
+	}
+
+	_ = h.Out(acpi.GPE0Base+2, []byte{0x02})
+
+	if err := h.Unplug(4); err != nil {
+		t.Fatal(err)
+	}
+
+	if sci.count != 1 {
+		t.Fatalf("SCI: got %d, want 1", sci.count)
+	}
+
+	b := make([]byte, 4)
+	_ = h.In(acpi.GPE0Base, b)
+
+	if b[0] != 0x02 || b[2] != 0x02 {
+		t.Fatalf("GPE0: got %#x", b)
+	}
+
+	_ = h.Out(acpi.GPE0Base, []byte{0x02})
+	_ = h.In(acpi.GPE0Base, b[:1])
+
+	if b[0] != 0 {
+		t.Fatalf("GPE0 status after clearing: got %#x", b[0])
+	}
+
+	_ = h.In(acpi.PCIHotplugBase, b)
+
+	if b[0] != 1<<3 {
+		t.Fatalf("up: got %#x, want %#x", b, 1<<3)
+	}
+
+	_ = h.In(acpi.PCIHotplugBase, b)
+
+	if b[0] != 0 {
+		t.Fatalf("up after reading: got %#x, want 0", b)
+	}
+
+	_ = h.In(acpi.PCIHotplugBase+4, b)
+
+	if b[0] != 1<<4 {
+		t.Fatalf("down: got %#x, want %#x", b, 1<<4)
+	}
+
+	_ = h.Out(acpi.PCIHotplugBase+8, []byte{1 << 4, 0, 0, 0})
+
+	if ejected != 4 {
+		t.Fatalf("ejected: got %d, want 4", ejected)
+	}
+
+	if err := h.Plug(0); !errors.Is(err, acpi.ErrSlot) {
+		t.Fatalf("got %v, want %v", err, acpi.ErrSlot)
+	}
+}
+
+func TestHotplugGED(t *testing.T) {
+	t.Parallel()
+
+	sci := &mockSCI{}
+	h := acpi.NewHotplug(sci)
+	h.GED = true
+
+	// A hardware-reduced guest never enables the GPE.
+	if err := h.Plug(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if sci.count != 1 {
+		t.Fatalf("SCI: got %d, want 1", sci.count)
+	}
+}
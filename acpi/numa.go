@@ -0,0 +1,101 @@
+package acpi
+
+import (
+	"encoding/binary"
+)
+
+// The SRAT and SLIT tell a guest which of its processors and memory make
+// up each NUMA node, its proximity domain, and how far the nodes are from
+// each other.
+//
+// refs: https://uefi.org/specs/ACPI/6.5/05_ACPI_Software_Programming_Model.html#system-resource-affinity-table-srat
+
+// SRAT entry types and lengths, and their enabled flag.
+const (
+	sratAPIC        = 0
+	sratMemory      = 1
+	sratAPICLen     = 16
+	sratMemoryLen   = 40
+	sratEnabled     = 1 << 0
+	sratHotplug     = 1 << 1
+	slitLocal       = 10
+	slitUnreachable = 0xff
+)
+
+// MemoryAffinity is a range of guest physical memory of a node.
+type MemoryAffinity struct {
+	Base, Length uint64
+	// Hotplug marks memory that may be added later.
+	Hotplug bool
+}
+
+// Node is a NUMA node of a guest, its proximity domain being its index.
+type Node struct {
+	// APICIDs are the processors of the node.
+	APICIDs []uint8
+	Memory  []MemoryAffinity
+}
+
+// SRAT returns the SRAT of nodes.
+func SRAT(nodes []Node) []byte {
+	// The table revision, 1, and 8 reserved bytes.
+	body := make([]byte, 12)
+	body[0] = 1
+
+	for domain, n := range nodes {
+		for _, id := range n.APICIDs {
+			e := make([]byte, sratAPICLen)
+			e[0], e[1] = sratAPIC, sratAPICLen
+			e[2] = byte(domain)
+			e[3] = id
+			binary.LittleEndian.PutUint32(e[4:], sratEnabled)
+			// The upper 24 bits of the proximity domain.
+			e[9], e[10], e[11] = byte(domain>>8), byte(domain>>16), byte(domain>>24)
+			body = append(body, e...)
+		}
+
+		for _, m := range n.Memory {
+			e := make([]byte, sratMemoryLen)
+			e[0], e[1] = sratMemory, sratMemoryLen
+			binary.LittleEndian.PutUint32(e[2:], uint32(domain))
+			binary.LittleEndian.PutUint64(e[8:], m.Base)
+			binary.LittleEndian.PutUint64(e[16:], m.Length)
+
+			flags := uint32(sratEnabled)
+			if m.Hotplug {
+				flags |= sratHotplug
+			}
+
+			binary.LittleEndian.PutUint32(e[28:], flags)
+			body = append(body, e...)
+		}
+	}
+
+	return Table("SRAT", "GOKVMNUM", 3, body)
+}
+
+// SLIT returns the SLIT of the distances between nodes, where
+// distances[i][j] is from node i to node j, 10 for a node itself, and
+// missing ones are unreachable.
+func SLIT(distances [][]int) []byte {
+	n := len(distances)
+	body := make([]byte, 8, 8+n*n)
+	binary.LittleEndian.PutUint64(body, uint64(n))
+
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			d := slitUnreachable
+			if j < len(distances[i]) && distances[i][j] > 0 && distances[i][j] < slitUnreachable {
+				d = distances[i][j]
+			}
+
+			if i == j {
+				d = slitLocal
+			}
+
+			body = append(body, byte(d))
+		}
+	}
+
+	return Table("SLIT", "GOKVMNUM", 1, body)
+}
@@ -0,0 +1,51 @@
+package acpi_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+func TestSRAT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.SRAT([]acpi.Node{
+		{APICIDs: []uint8{0, 1}, Memory: []acpi.MemoryAffinity{{Base: 0, Length: 0x20000000}}},
+		{APICIDs: []uint8{2}, Memory: []acpi.MemoryAffinity{{Base: 0x20000000, Length: 0x20000000, Hotplug: true}}},
+	})
+	checksum(t, b)
+
+	// The header and 12 bytes, three processors and two ranges.
+	if len(b) != 36+12+3*16+2*40 || string(b[:4]) != "SRAT" {
+		t.Fatalf("invalid SRAT of %d bytes", len(b))
+	}
+
+	// The processor with APIC ID 2 is in proximity domain 1.
+	cpu := b[48+2*16+40:]
+	if cpu[0] != 0 || cpu[1] != 16 || cpu[2] != 1 || cpu[3] != 2 || cpu[4] != 1 {
+		t.Errorf("invalid processor affinity: %#x", cpu[:16])
+	}
+
+	mem := b[48+3*16+40:]
+	if mem[0] != 1 || binary.LittleEndian.Uint32(mem[2:]) != 1 ||
+		binary.LittleEndian.Uint64(mem[8:]) != 0x20000000 || binary.LittleEndian.Uint32(mem[28:]) != 3 {
+		t.Errorf("invalid memory affinity: %#x", mem)
+	}
+}
+
+func TestSLIT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.SLIT([][]int{{10, 21}, {}})
+	checksum(t, b)
+
+	if string(b[:4]) != "SLIT" || binary.LittleEndian.Uint64(b[36:]) != 2 {
+		t.Fatalf("invalid SLIT: %#x", b)
+	}
+
+	// The missing distance from node 1 to 0 is unreachable.
+	if got := b[44:]; got[0] != 10 || got[1] != 21 || got[2] != 0xff || got[3] != 10 {
+		t.Errorf("got distances %v", got)
+	}
+}
@@ -0,0 +1,48 @@
+package acpi
+
+import (
+	"encoding/binary"
+)
+
+// The VIOT tells a guest which PCI devices sit behind a virtio-iommu, and
+// which endpoint IDs they have on it.
+//
+// refs: https://uefi.org/specs/ACPI/6.5/05_ACPI_Software_Programming_Model.html#virtual-i-o-translation-table-viot
+
+// VIOT node types and lengths.
+const (
+	viotPCIRange     = 1
+	viotVirtioPCI    = 3
+	viotPCIRangeLen  = 24
+	viotVirtioPCILen = 16
+	viotHeaderLen    = 12
+)
+
+// VIOT returns the VIOT of the virtio-iommu at the PCI BDF iommu on
+// segment 0, which translates the DMA of the devices at the BDFs of
+// endpoints, each with its BDF as endpoint ID.
+func VIOT(iommu uint16, endpoints []uint16) []byte {
+	body := make([]byte, viotHeaderLen)
+	binary.LittleEndian.PutUint16(body[0:], uint16(len(endpoints)+1))
+	binary.LittleEndian.PutUint16(body[2:], 36+viotHeaderLen)
+
+	// The IOMMU comes first, where the ranges point to.
+	n := make([]byte, viotVirtioPCILen)
+	n[0] = viotVirtioPCI
+	binary.LittleEndian.PutUint16(n[2:], viotVirtioPCILen)
+	binary.LittleEndian.PutUint16(n[6:], iommu)
+	body = append(body, n...)
+
+	for _, bdf := range endpoints {
+		n := make([]byte, viotPCIRangeLen)
+		n[0] = viotPCIRange
+		binary.LittleEndian.PutUint16(n[2:], viotPCIRangeLen)
+		binary.LittleEndian.PutUint32(n[4:], uint32(bdf))
+		binary.LittleEndian.PutUint16(n[12:], bdf)
+		binary.LittleEndian.PutUint16(n[14:], bdf)
+		binary.LittleEndian.PutUint16(n[16:], 36+viotHeaderLen)
+		body = append(body, n...)
+	}
+
+	return Table("VIOT", "GOKVMVIO", 0, body)
+}
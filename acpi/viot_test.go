@@ -0,0 +1,35 @@
+package acpi_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+func TestVIOT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.VIOT(0x18, []uint16{0x08, 0x10})
+	checksum(t, b)
+
+	// The header and 12 bytes, the IOMMU and two ranges.
+	if len(b) != 36+12+16+2*24 || string(b[:4]) != "VIOT" {
+		t.Fatalf("invalid VIOT of %d bytes", len(b))
+	}
+
+	if n, off := binary.LittleEndian.Uint16(b[36:]), binary.LittleEndian.Uint16(b[38:]); n != 3 || off != 48 {
+		t.Fatalf("%d nodes at %d", n, off)
+	}
+
+	if iommu := b[48:]; iommu[0] != 3 || iommu[2] != 16 || binary.LittleEndian.Uint16(iommu[6:]) != 0x18 {
+		t.Errorf("invalid virtio-pci IOMMU node: %#x", iommu[:16])
+	}
+
+	r := b[48+16+24:]
+	if r[0] != 1 || r[2] != 24 || binary.LittleEndian.Uint32(r[4:]) != 0x10 ||
+		binary.LittleEndian.Uint16(r[12:]) != 0x10 || binary.LittleEndian.Uint16(r[14:]) != 0x10 ||
+		binary.LittleEndian.Uint16(r[16:]) != 48 {
+		t.Errorf("invalid PCI range node: %#x", r[:24])
+	}
+}
@@ -0,0 +1,213 @@
+package acpi
+
+import (
+	"encoding/binary"
+)
+
+// The tables that an x86 guest finds its processors, interrupt controllers
+// and power management through: the MADT with a local APIC for each vCPU
+// and the IOAPIC, and a FADT for a hardware-reduced platform, as microvm
+// and Firecracker have, with a reset register and a sleep control register
+// instead of the fixed PM blocks, and the DSDT with the \_S5 that powering
+// off needs. The RSDP and XSDT lead to them.
+//
+// refs: https://uefi.org/specs/ACPI/6.5/05_ACPI_Software_Programming_Model.html
+// refs: https://uefi.org/specs/ACPI/6.5/04_ACPI_Hardware_Specification.html#hardware-reduced-acpi
+
+// MADT entry types and lengths.
+const (
+	madtLocalAPIC       = 0
+	madtIOAPIC          = 1
+	madtOverride        = 2
+	madtLocalAPICNMI    = 4
+	madtLocalAPICLen    = 8
+	madtIOAPICLen       = 12
+	madtOverrideLen     = 10
+	madtLocalAPICNMILen = 6
+
+	madtPCATCompat   = 1 << 0
+	localAPICEnabled = 1 << 0
+	allProcessors    = 0xff
+)
+
+// FADT layout of ACPI 6.0, flags and boot architecture flags.
+const (
+	fadtLen            = 276
+	fadtDSDT           = 40
+	fadtBootArch       = 109
+	fadtFlags          = 112
+	fadtResetReg       = 116
+	fadtResetValue     = 128
+	fadtXDSDT          = 140
+	fadtSleepControl   = 244
+	fadtSleepStatus    = 256
+	fadtWBINVD         = 1 << 0
+	fadtResetRegSup    = 1 << 10
+	fadtHWReduced      = 1 << 20
+	bootArchVGAMissing = 1 << 2
+
+	gasSystemIO = 1
+)
+
+// Offsets of the table pointers, for those that patch them.
+const (
+	// FADTDSDT and FADTXDSDT are where the FADT points to the DSDT.
+	FADTDSDT  = fadtDSDT
+	FADTXDSDT = fadtXDSDT
+	// XSDTEntries is where the entries of the XSDT start.
+	XSDTEntries = 36
+	// RSDPXSDT is where the RSDP points to the XSDT.
+	RSDPXSDT = 24
+	// RSDPSize is the size of an ACPI 2.0 RSDP.
+	RSDPSize = 36
+)
+
+// SleepTypeS5 is the SLP_TYP of soft-off in the \_S5 of DSDT, which the
+// guest writes to the sleep control register to power off.
+const SleepTypeS5 = 5
+
+// Bits of the sleep control register.
+const (
+	SleepEnable    = 1 << 5
+	sleepTypeShift = 2
+	sleepTypeMask  = 7
+)
+
+// SleepType returns the SLP_TYP of a write of v to the sleep control
+// register that has SLP_EN set, and whether it has.
+func SleepType(v byte) (byte, bool) {
+	return v >> sleepTypeShift & sleepTypeMask, v&SleepEnable != 0
+}
+
+// APIC are the interrupt controllers of an x86 guest.
+type APIC struct {
+	// LocalAPICBase is the address of the local APICs, and APICIDs are
+	// their IDs, one for each processor, whose UID is its index.
+	LocalAPICBase uint32
+	APICIDs       []uint8
+	// IOAPICID and IOAPICBase are the ID and address of the IOAPIC,
+	// whose interrupts start at GSI 0.
+	IOAPICID   uint8
+	IOAPICBase uint32
+}
+
+// APICMADT returns the MADT of a, with the timer of IRQ 0 at GSI 2 as on
+// a PC, and LINT1 of every local APIC for NMIs.
+func APICMADT(a APIC) []byte {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint32(body[0:], a.LocalAPICBase)
+	binary.LittleEndian.PutUint32(body[4:], madtPCATCompat)
+
+	for uid, id := range a.APICIDs {
+		e := make([]byte, madtLocalAPICLen)
+		e[0], e[1] = madtLocalAPIC, madtLocalAPICLen
+		e[2], e[3] = byte(uid), id
+		binary.LittleEndian.PutUint32(e[4:], localAPICEnabled)
+		body = append(body, e...)
+	}
+
+	io := make([]byte, madtIOAPICLen)
+	io[0], io[1] = madtIOAPIC, madtIOAPICLen
+	io[2] = a.IOAPICID
+	binary.LittleEndian.PutUint32(io[4:], a.IOAPICBase)
+	body = append(body, io...)
+
+	iso := make([]byte, madtOverrideLen)
+	iso[0], iso[1] = madtOverride, madtOverrideLen
+	iso[3] = 0 // IRQ 0 of the ISA bus
+	binary.LittleEndian.PutUint32(iso[4:], 2)
+	body = append(body, iso...)
+
+	nmi := make([]byte, madtLocalAPICNMILen)
+	nmi[0], nmi[1] = madtLocalAPICNMI, madtLocalAPICNMILen
+	nmi[2] = allProcessors
+	nmi[5] = 1 // LINT1
+	body = append(body, nmi...)
+
+	return Table("APIC", "GOKVMAPI", 5, body)
+}
+
+// PowerManagement are the registers of a hardware-reduced platform, all
+// of them I/O ports of a byte.
+type PowerManagement struct {
+	// ResetPort resets the machine when ResetValue is written to it.
+	ResetPort  uint16
+	ResetValue byte
+	// SleepControlPort takes SLP_TYP and SLP_EN, see SleepType, and
+	// SleepStatusPort tells when the guest woke up.
+	SleepControlPort uint16
+	SleepStatusPort  uint16
+}
+
+// gas encodes a generic address structure of a byte at port.
+func gas(b []byte, port uint16) {
+	b[0], b[1], b[2], b[3] = gasSystemIO, 8, 0, accessSize(8)
+	binary.LittleEndian.PutUint64(b[4:], uint64(port))
+}
+
+// FADT returns the FADT of a hardware-reduced platform with pm, whose
+// DSDT is at dsdt.
+func FADT(dsdt uint64, pm PowerManagement) []byte {
+	body := make([]byte, fadtLen-36)
+	at := func(off int) []byte { return body[off-36:] }
+
+	if dsdt <= 0xffffffff {
+		binary.LittleEndian.PutUint32(at(fadtDSDT), uint32(dsdt))
+	}
+
+	binary.LittleEndian.PutUint64(at(fadtXDSDT), dsdt)
+	binary.LittleEndian.PutUint16(at(fadtBootArch), bootArchVGAMissing)
+	binary.LittleEndian.PutUint32(at(fadtFlags), fadtWBINVD|fadtResetRegSup|fadtHWReduced)
+
+	gas(at(fadtResetReg), pm.ResetPort)
+	at(fadtResetValue)[0] = pm.ResetValue
+	gas(at(fadtSleepControl), pm.SleepControlPort)
+	gas(at(fadtSleepStatus), pm.SleepStatusPort)
+
+	return Table("FACP", "GOKVMFAC", 6, body)
+}
+
+// DSDT returns a DSDT of terms, e.g. the devices of the machine, and the
+// \_S5 of SleepTypeS5.
+func DSDT(terms ...[]byte) []byte {
+	s5 := Name(`\_S5`, Package(Integer(SleepTypeS5), Integer(0), Integer(0), Integer(0)))
+
+	return Table("DSDT", "GOKVMDSD", 2, concat(append([][]byte{s5}, terms...)...))
+}
+
+// XSDT returns an XSDT of the tables at addrs.
+func XSDT(addrs []uint64) []byte {
+	body := make([]byte, 8*len(addrs))
+	for i, addr := range addrs {
+		binary.LittleEndian.PutUint64(body[8*i:], addr)
+	}
+
+	return Table("XSDT", "GOKVMXSD", 1, body)
+}
+
+// RSDP returns an ACPI 2.0 RSDP of the XSDT at xsdt, which the guest
+// looks for on a 16-byte boundary in 0xe0000-0xfffff without EFI.
+func RSDP(xsdt uint64) []byte {
+	b := make([]byte, RSDPSize)
+
+	copy(b, "RSD PTR ")
+	copy(b[9:15], "GOKVM ")
+	b[15] = 2 // revision
+	binary.LittleEndian.PutUint32(b[20:], RSDPSize)
+	binary.LittleEndian.PutUint64(b[RSDPXSDT:], xsdt)
+
+	// The first checksum is of the ACPI 1.0 part, the second of all.
+	b[8] = -sum(b[:20])
+	b[32] = -sum(b)
+
+	return b
+}
+
+func sum(b []byte) byte {
+	s := byte(0)
+	for _, c := range b {
+		s += c
+	}
+
+	return s
+}
@@ -0,0 +1,109 @@
+package acpi_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+func TestAPICMADT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.APICMADT(acpi.APIC{
+		LocalAPICBase: 0xfee00000, APICIDs: []uint8{0, 1}, IOAPICID: 2, IOAPICBase: 0xfec00000,
+	})
+	checksum(t, b)
+
+	// The header and 8 bytes, two local APICs, an IOAPIC, an override and
+	// a local APIC NMI.
+	if len(b) != 36+8+2*8+12+10+6 || string(b[:4]) != "APIC" ||
+		binary.LittleEndian.Uint32(b[36:]) != 0xfee00000 {
+		t.Fatalf("invalid MADT of %d bytes", len(b))
+	}
+
+	lapic := b[44+8:]
+	if lapic[0] != 0 || lapic[2] != 1 || lapic[3] != 1 || binary.LittleEndian.Uint32(lapic[4:]) != 1 {
+		t.Errorf("invalid local APIC of vCPU 1: %#x", lapic[:8])
+	}
+
+	ioapic := b[44+16:]
+	if ioapic[0] != 1 || ioapic[2] != 2 || binary.LittleEndian.Uint32(ioapic[4:]) != 0xfec00000 {
+		t.Errorf("invalid IOAPIC: %#x", ioapic[:12])
+	}
+
+	override := b[44+28:]
+	if override[0] != 2 || override[3] != 0 || binary.LittleEndian.Uint32(override[4:]) != 2 {
+		t.Errorf("invalid override: %#x", override[:10])
+	}
+}
+
+func TestFADT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.FADT(0x12345678, acpi.PowerManagement{
+		ResetPort: 0xcf9, ResetValue: 6, SleepControlPort: 0x600, SleepStatusPort: 0x601,
+	})
+	checksum(t, b)
+
+	if len(b) != 276 || string(b[:4]) != "FACP" || b[8] != 6 {
+		t.Fatalf("invalid FADT of %d bytes, revision %d", len(b), b[8])
+	}
+
+	if binary.LittleEndian.Uint32(b[acpi.FADTDSDT:]) != 0x12345678 ||
+		binary.LittleEndian.Uint64(b[acpi.FADTXDSDT:]) != 0x12345678 {
+		t.Errorf("invalid DSDT pointers: %#x", b)
+	}
+
+	// Hardware-reduced, with a reset register.
+	if flags := binary.LittleEndian.Uint32(b[112:]); flags&(1<<20) == 0 || flags&(1<<10) == 0 {
+		t.Errorf("invalid flags: %#x", flags)
+	}
+
+	if b[116] != 1 || binary.LittleEndian.Uint64(b[120:]) != 0xcf9 || b[128] != 6 {
+		t.Errorf("invalid reset register: %#x", b[116:129])
+	}
+
+	if binary.LittleEndian.Uint64(b[248:]) != 0x600 || binary.LittleEndian.Uint64(b[260:]) != 0x601 {
+		t.Errorf("invalid sleep registers: %#x", b[244:])
+	}
+
+	if typ, ok := acpi.SleepType(acpi.SleepTypeS5<<2 | acpi.SleepEnable); typ != acpi.SleepTypeS5 || !ok {
+		t.Errorf("sleep type %d, %v", typ, ok)
+	}
+}
+
+func TestRSDP(t *testing.T) {
+	t.Parallel()
+
+	dsdt := acpi.DSDT()
+	checksum(t, dsdt)
+
+	if !bytes.Contains(dsdt, []byte("_S5_")) {
+		t.Errorf("DSDT without _S5: %#x", dsdt)
+	}
+
+	xsdt := acpi.XSDT([]uint64{0xe0040, 0xe0100})
+	checksum(t, xsdt)
+
+	if len(xsdt) != acpi.XSDTEntries+16 || binary.LittleEndian.Uint64(xsdt[acpi.XSDTEntries+8:]) != 0xe0100 {
+		t.Errorf("invalid XSDT: %#x", xsdt)
+	}
+
+	b := acpi.RSDP(0xe0200)
+
+	sum := func(b []byte) byte {
+		s := byte(0)
+		for _, c := range b {
+			s += c
+		}
+
+		return s
+	}
+
+	if len(b) != acpi.RSDPSize || string(b[:8]) != "RSD PTR " || sum(b[:20]) != 0 || sum(b) != 0 ||
+		binary.LittleEndian.Uint64(b[acpi.RSDPXSDT:]) != 0xe0200 {
+		t.Errorf("invalid RSDP: %#x", b)
+	}
+}
@@ -0,0 +1,238 @@
+// Package agent runs commands in a guest through its serial console.
+//
+// The guest side of the agent is simply the shell attached to ttyS0.
+// The host types the command followed by an echo of a marker carrying $?,
+// streams everything the guest prints until the marker shows up, and
+// parses the exit code out of it. The marker is typed with an empty
+// quoted string inside, e.g. __GOKVM_""EXIT_$?__, so the line the tty
+// echoes back never looks like the marker the shell prints.
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	readyMarker     = "__GOKVM_READY__"
+	readyMarkerEcho = `__GOKVM_""READY__`
+	exitMarkerEcho  = `__GOKVM_""EXIT_`
+
+	// How often the shell is poked while waiting for it to come up.
+	readyInterval = time.Second
+
+	// shellSafe are the characters of a word that the shell takes as they
+	// are.
+	shellSafe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%"
+)
+
+var (
+	ErrTimeout = errors.New("timed out waiting for the guest")
+	ErrBusy    = errors.New("another command is running in the guest")
+
+	exitMarker = regexp.MustCompile(`__GOKVM_EXIT_([0-9]+)__`)
+)
+
+// Console is the serial console of a guest.
+type Console interface {
+	GetInputChan() chan<- byte
+	InjectSerialIRQ() error
+}
+
+type state int
+
+const (
+	stateIdle state = iota
+	stateWaitReady
+	stateRunning
+)
+
+// Agent drives the guest shell. The guest's serial output must be
+// written to the Agent, e.g. via machine.SetSerialOutput.
+type Agent struct {
+	console Console
+
+	mu     sync.Mutex
+	state  state
+	line   []byte
+	stream io.Writer
+	done   chan int
+}
+
+func New(console Console) *Agent {
+	return &Agent{
+		console: console,
+		stream:  io.Discard,
+	}
+}
+
+// Write consumes the guest's serial output.
+func (a *Agent) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, b := range p {
+		if b != '\n' {
+			a.line = append(a.line, b)
+
+			continue
+		}
+
+		a.handleLine(string(bytes.TrimRight(a.line, "\r")))
+		a.line = a.line[:0]
+	}
+
+	return len(p), nil
+}
+
+func (a *Agent) handleLine(line string) {
+	switch a.state {
+	case stateIdle:
+	case stateWaitReady:
+		if strings.Contains(line, readyMarker) {
+			a.finish(0)
+		}
+	case stateRunning:
+		// The tty echo of what we typed, and answers to readiness
+		// probes that were still queued when the shell came up.
+		if strings.Contains(line, exitMarkerEcho) ||
+			strings.Contains(line, readyMarkerEcho) ||
+			strings.Contains(line, readyMarker) {
+			return
+		}
+
+		if m := exitMarker.FindStringSubmatch(line); m != nil {
+			code, _ := strconv.Atoi(m[1])
+			a.finish(code)
+
+			return
+		}
+
+		fmt.Fprintln(a.stream, line)
+	}
+}
+
+// finish must be called with a.mu held.
+func (a *Agent) finish(code int) {
+	a.state = stateIdle
+	a.stream = io.Discard
+	a.done <- code
+}
+
+func (a *Agent) start(s state, stream io.Writer) (<-chan int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.state != stateIdle {
+		return nil, ErrBusy
+	}
+
+	a.state = s
+	a.stream = stream
+	a.done = make(chan int, 1)
+
+	return a.done, nil
+}
+
+func (a *Agent) cancel() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.state = stateIdle
+	a.stream = io.Discard
+}
+
+func (a *Agent) send(s string) error {
+	in := a.console.GetInputChan()
+
+	for i := 0; i < len(s); i++ {
+		in <- s[i]
+
+		if err := a.console.InjectSerialIRQ(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WaitReady blocks until the guest shell answers, poking it every second.
+func (a *Agent) WaitReady(timeout time.Duration) error {
+	done, err := a.start(stateWaitReady, io.Discard)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(readyInterval)
+
+	defer ticker.Stop()
+
+	for {
+		if err := a.send("echo " + readyMarkerEcho + "\n"); err != nil {
+			a.cancel()
+
+			return err
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-deadline:
+			a.cancel()
+
+			return fmt.Errorf("%w: shell did not come up in %v", ErrTimeout, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run runs cmd in the guest shell, streaming its output to w, and
+// returns its exit code. stdout and stderr are both carried over the
+// console and cannot be told apart.
+func (a *Agent) Run(cmd string, w io.Writer, timeout time.Duration) (int, error) {
+	done, err := a.start(stateRunning, w)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := a.send(cmd + "; echo " + exitMarkerEcho + "$?__\n"); err != nil {
+		a.cancel()
+
+		return 0, err
+	}
+
+	select {
+	case code := <-done:
+		return code, nil
+	case <-time.After(timeout):
+		a.cancel()
+
+		return 0, fmt.Errorf("%w: %q did not finish in %v", ErrTimeout, cmd, timeout)
+	}
+}
+
+// Quote returns the command line that runs args in the guest shell, each
+// of them a word of its own whatever characters it has.
+func Quote(args []string) string {
+	words := make([]string, len(args))
+
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, shellSafe) == "" {
+			words[i] = arg
+
+			continue
+		}
+
+		words[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,144 @@
+package agent_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/agent"
+)
+
+// mockGuest behaves like a shell on a serial console: it echoes the
+// typed line and then prints what the command would have printed.
+type mockGuest struct {
+	in    chan byte
+	agent *agent.Agent
+	ready bool
+}
+
+var (
+	echoCmd = regexp.MustCompile(`^echo (.*)$`)
+	runCmd  = regexp.MustCompile(`^(.*); echo (.*)\$\?__$`)
+)
+
+func newMockGuest(ready bool) *mockGuest {
+	g := &mockGuest{in: make(chan byte, 1024), ready: ready}
+	g.agent = agent.New(g)
+
+	go g.loop()
+
+	return g
+}
+
+func (g *mockGuest) GetInputChan() chan<- byte {
+	return g.in
+}
+
+func (g *mockGuest) InjectSerialIRQ() error {
+	return nil
+}
+
+func (g *mockGuest) print(s string) {
+	_, _ = g.agent.Write([]byte(s))
+}
+
+func (g *mockGuest) loop() {
+	line := []byte{}
+
+	for b := range g.in {
+		if b != '\n' {
+			line = append(line, b)
+
+			continue
+		}
+
+		cmd := string(line)
+		line = line[:0]
+
+		if !g.ready {
+			continue
+		}
+
+		g.print("/# " + cmd + "\r\n")
+
+		if m := runCmd.FindStringSubmatch(cmd); m != nil {
+			code := 0
+			if m[1] == "false" {
+				code = 1
+			} else {
+				g.print("output of " + m[1] + "\r\n")
+			}
+
+			g.print(fmt.Sprintf("__GOKVM_EXIT_%d__\r\n/# ", code))
+
+			continue
+		}
+
+		if m := echoCmd.FindStringSubmatch(cmd); m != nil {
+			g.print(strings.ReplaceAll(m[1], `""`, "") + "\r\n/# ")
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	g := newMockGuest(true)
+
+	if err := g.agent.WaitReady(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+
+	code, err := g.agent.Run("uname", out, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != 0 {
+		t.Errorf("exit code: got %d, want 0", code)
+	}
+
+	if out.String() != "output of uname\n" {
+		t.Errorf("output: got %q, want %q", out.String(), "output of uname\n")
+	}
+
+	code, err = g.agent.Run("false", &bytes.Buffer{}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != 1 {
+		t.Errorf("exit code: got %d, want 1", code)
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	t.Parallel()
+
+	g := newMockGuest(false)
+
+	if err := g.agent.WaitReady(100 * time.Millisecond); !errors.Is(err, agent.ErrTimeout) {
+		t.Fatalf("got %v, want %v", err, agent.ErrTimeout)
+	}
+
+	if _, err := g.agent.Run("true", &bytes.Buffer{}, 100*time.Millisecond); !errors.Is(err, agent.ErrTimeout) {
+		t.Fatalf("got %v, want %v", err, agent.ErrTimeout)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	t.Parallel()
+
+	args := []string{"sh", "-c", "echo $HOME; ls", "it's", "", "a b"}
+	expected := `sh -c 'echo $HOME; ls' 'it'\''s' '' 'a b'`
+
+	if actual := agent.Quote(args); actual != expected {
+		t.Fatalf("expected: %s, actual: %s", expected, actual)
+	}
+}
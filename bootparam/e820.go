@@ -0,0 +1,102 @@
+package bootparam
+
+import "sort"
+
+// e820Hole is the type of the ranges of E820Builder.Hole, which are left
+// out of the table.
+const e820Hole = ^uint32(0)
+
+// E820Builder builds the E820 table of a guest from ranges that may
+// overlap, e.g. guest RAM and the areas reserved within it, so that the
+// table follows the memory layout rather than having to be kept in step
+// with it by hand. Where ranges overlap, a hole beats any type and a type
+// other than E820Ram beats E820Ram; among the others, the one added last
+// wins.
+type E820Builder struct {
+	ranges []E820Entry
+}
+
+// Add adds size bytes at addr of type typ, e.g. E820Ram or E820Reserved.
+func (b *E820Builder) Add(addr, size uint64, typ uint32) {
+	if size != 0 {
+		b.ranges = append(b.ranges, E820Entry{Addr: addr, Size: size, Type: typ})
+	}
+}
+
+// Hole leaves size bytes at addr out of the table, e.g. an MMIO hole in
+// guest RAM, so that the guest neither uses them as RAM nor takes them
+// for firmware's.
+func (b *E820Builder) Hole(addr, size uint64) {
+	b.Add(addr, size, e820Hole)
+}
+
+// wins tells whether a range of type t takes precedence over one of type u
+// added before it.
+func wins(t, u uint32) bool {
+	switch {
+	case u == e820Hole:
+		return false
+	case t == e820Hole:
+		return true
+	case u != E820Ram:
+		return t != E820Ram
+	default:
+		return true
+	}
+}
+
+// Entries returns the table by address, without overlaps, and with
+// adjacent entries of a type merged.
+func (b *E820Builder) Entries() []E820Entry {
+	// The ranges are cut at every start and end of one, and each piece
+	// takes the type that wins of the ranges it is in.
+	cuts := make([]uint64, 0, 2*len(b.ranges))
+	for _, r := range b.ranges {
+		cuts = append(cuts, r.Addr, r.Addr+r.Size)
+	}
+
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i] < cuts[j] })
+
+	var entries []E820Entry
+
+	for i := 0; i+1 < len(cuts); i++ {
+		start, end := cuts[i], cuts[i+1]
+		if start == end {
+			continue
+		}
+
+		typ, found := uint32(0), false
+
+		for _, r := range b.ranges {
+			if r.Addr <= start && end <= r.Addr+r.Size && (!found || wins(r.Type, typ)) {
+				typ, found = r.Type, true
+			}
+		}
+
+		if !found || typ == e820Hole {
+			continue
+		}
+
+		if n := len(entries); n > 0 && entries[n-1].Type == typ && entries[n-1].Addr+entries[n-1].Size == start {
+			entries[n-1].Size += end - start
+
+			continue
+		}
+
+		entries = append(entries, E820Entry{Addr: start, Size: end - start, Type: typ})
+	}
+
+	return entries
+}
+
+// SetE820 replaces the E820 table of b with entries, of which it takes the
+// first E820Max.
+func (b *BootParam) SetE820(entries []E820Entry) {
+	if len(entries) > E820Max {
+		entries = entries[:E820Max]
+	}
+
+	b.E820Map = [E820Max]E820Entry{}
+	copy(b.E820Map[:], entries)
+	b.E820Entries = uint8(len(entries))
+}
@@ -0,0 +1,46 @@
+package bootparam_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+)
+
+func TestE820Builder(t *testing.T) {
+	t.Parallel()
+
+	var b bootparam.E820Builder
+
+	b.Add(0, 0x40000000, bootparam.E820Ram)
+	b.Add(bootparam.EBDAStart, bootparam.VGARAMBegin-bootparam.EBDAStart, bootparam.E820Reserved)
+	b.Hole(bootparam.VGARAMBegin, bootparam.MBBIOSBegin-bootparam.VGARAMBegin)
+	b.Add(bootparam.MBBIOSBegin, bootparam.MBBIOSEnd+1-bootparam.MBBIOSBegin, bootparam.E820Reserved)
+	// RAM added after a reserved area does not take it back.
+	b.Add(0xf8000, 0x10000, bootparam.E820Ram)
+	b.Add(0xfec00000, 0x1000, bootparam.E820Reserved)
+	b.Add(0x100000000, 0x200000, bootparam.E820Ram)
+	b.Add(0x100200000, 0x200000, bootparam.E820Ram)
+	b.Add(0, 0, bootparam.E820Reserved)
+
+	want := []bootparam.E820Entry{
+		{Addr: 0, Size: bootparam.EBDAStart, Type: bootparam.E820Ram},
+		{Addr: bootparam.EBDAStart, Size: bootparam.VGARAMBegin - bootparam.EBDAStart, Type: bootparam.E820Reserved},
+		{Addr: bootparam.MBBIOSBegin, Size: 0x10000, Type: bootparam.E820Reserved},
+		{Addr: 0x100000, Size: 0x40000000 - 0x100000, Type: bootparam.E820Ram},
+		{Addr: 0xfec00000, Size: 0x1000, Type: bootparam.E820Reserved},
+		{Addr: 0x100000000, Size: 0x400000, Type: bootparam.E820Ram},
+	}
+
+	if got := b.Entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	var p bootparam.BootParam
+
+	p.SetE820(want)
+
+	if p.E820Entries != uint8(len(want)) || p.E820Map[3] != want[3] {
+		t.Errorf("SetE820: got %d entries, %+v", p.E820Entries, p.E820Map[:p.E820Entries])
+	}
+}
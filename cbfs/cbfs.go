@@ -0,0 +1,110 @@
+// Package cbfs reads the coreboot filesystem in a coreboot ROM image.
+//
+// refs: https://github.com/coreboot/coreboot/blob/master/src/commonlib/bsd/include/commonlib/bsd/cbfs_serialized.h
+package cbfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	fileMagic = "LARCHIVE"
+
+	// Files are aligned to 64 bytes by default, but older images used 16.
+	fileAlign = 16
+
+	TypeBootblock   = 0x01
+	TypeCBFSHeader  = 0x02
+	TypeStage       = 0x10
+	TypeSELF        = 0x20
+	TypeFIT         = 0x21
+	TypeOptionROM   = 0x30
+	TypeBootsplash  = 0x40
+	TypeRaw         = 0x50
+	TypeMicrocode   = 0x53
+	TypeFSP         = 0x60
+	TypeCMOSDefault = 0xaa
+	TypeSPD         = 0xab
+	TypeCMOSLayout  = 0x1aa
+	TypeNull        = 0xffffffff
+)
+
+var (
+	ErrNoFiles   = errors.New("no CBFS files found")
+	ErrTruncated = errors.New("CBFS file is truncated")
+)
+
+// fileHeader is the big-endian header of every CBFS file, followed by its
+// NUL-terminated name and attributes; data starts at Offset.
+type fileHeader struct {
+	Magic            [8]byte
+	Len              uint32
+	Type             uint32
+	AttributesOffset uint32
+	Offset           uint32
+}
+
+// File is a file in CBFS.
+type File struct {
+	Name string
+	Type uint32
+
+	// Offset is where the data of the file starts in the ROM.
+	Offset int
+	Data   []byte
+}
+
+func (f File) String() string {
+	return fmt.Sprintf("%-40s %#-8x %8d bytes at %#x", f.Name, f.Type, len(f.Data), f.Offset)
+}
+
+// Files lists the files in a coreboot ROM, skipping empty (null) ones.
+func Files(rom []byte) ([]File, error) {
+	files := []File{}
+	hdrSize := binary.Size(fileHeader{})
+
+	for off := 0; off+hdrSize <= len(rom); {
+		if !bytes.Equal(rom[off:off+len(fileMagic)], []byte(fileMagic)) {
+			off += fileAlign
+
+			continue
+		}
+
+		hdr := fileHeader{}
+		if err := binary.Read(bytes.NewReader(rom[off:]), binary.BigEndian, &hdr); err != nil {
+			return nil, err
+		}
+
+		start := off + int(hdr.Offset)
+		end := start + int(hdr.Len)
+
+		if int(hdr.Offset) < hdrSize || end > len(rom) {
+			return nil, fmt.Errorf("%w: at %#x", ErrTruncated, off)
+		}
+
+		name := rom[off+hdrSize : start]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+
+		if hdr.Type != TypeNull {
+			files = append(files, File{
+				Name:   string(name),
+				Type:   hdr.Type,
+				Offset: start,
+				Data:   rom[start:end],
+			})
+		}
+
+		off = (end + fileAlign - 1) &^ (fileAlign - 1)
+	}
+
+	if len(files) == 0 {
+		return nil, ErrNoFiles
+	}
+
+	return files, nil
+}
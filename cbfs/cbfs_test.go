@@ -0,0 +1,66 @@
+package cbfs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/cbfs"
+)
+
+func file(name string, typ uint32, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	nameLen := (len(name) + 1 + 15) &^ 15
+
+	buf.WriteString("LARCHIVE")
+	_ = binary.Write(buf, binary.BigEndian, []uint32{uint32(len(data)), typ, 0, uint32(24 + nameLen)})
+	buf.WriteString(name)
+	buf.Write(make([]byte, nameLen-len(name)))
+	buf.Write(data)
+
+	// pad to the next 64 bytes
+	buf.Write(bytes.Repeat([]byte{0xff}, (64-buf.Len()%64)%64))
+
+	return buf.Bytes()
+}
+
+func TestFiles(t *testing.T) {
+	t.Parallel()
+
+	rom := bytes.Repeat([]byte{0xff}, 0x100)
+	rom = append(rom, file("fallback/romstage", cbfs.TypeStage, []byte("romstage"))...)
+	rom = append(rom, file("", cbfs.TypeNull, make([]byte, 0x40))...)
+	rom = append(rom, file("fallback/payload", cbfs.TypeSELF, []byte("payload!"))...)
+	rom = append(rom, bytes.Repeat([]byte{0xff}, 0x100)...)
+
+	files, err := cbfs.Files(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2: %v", len(files), files)
+	}
+
+	if files[0].Name != "fallback/romstage" || files[0].Type != cbfs.TypeStage || string(files[0].Data) != "romstage" {
+		t.Errorf("unexpected file: %v", files[0])
+	}
+
+	if files[1].Name != "fallback/payload" || files[1].Type != cbfs.TypeSELF || string(files[1].Data) != "payload!" {
+		t.Errorf("unexpected file: %v", files[1])
+	}
+}
+
+func TestFilesErrors(t *testing.T) {
+	t.Parallel()
+
+	if _, err := cbfs.Files(bytes.Repeat([]byte{0xff}, 0x1000)); !errors.Is(err, cbfs.ErrNoFiles) {
+		t.Errorf("got %v, want %v", err, cbfs.ErrNoFiles)
+	}
+
+	f := file("truncated", cbfs.TypeRaw, make([]byte, 0x100))
+	if _, err := cbfs.Files(f[:0x80]); !errors.Is(err, cbfs.ErrTruncated) {
+		t.Errorf("got %v, want %v", err, cbfs.ErrTruncated)
+	}
+}
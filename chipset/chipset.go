@@ -0,0 +1,236 @@
+// Package chipset emulates the few chipset registers that coreboot
+// mainboard code touches before it gets to anything gokvm implements, such
+// as the LPC and SPI functions of an Intel PCH, its RCBA, PMC and GPIO.
+//
+// The registers come from a profile file, so that a firmware image for a
+// new target needs a profile rather than code:
+//
+//	{
+//	  "name": "ich7",
+//	  "pci": [
+//	    {"name": "LPC", "bdf": "00:1f.0", "regs": {"0x00": "0x27b88086", "0xf0": "0xfed1c001"}}
+//	  ],
+//	  "io": [
+//	    {"name": "PMC", "base": "0x500", "size": "0x80"},
+//	    {"name": "GPIO", "base": "0x480", "size": "0x40", "regs": {"0x0c": "0xffffffff"}}
+//	  ],
+//	  "mmio": [
+//	    {"name": "RCBA", "base": "0xfed1c000", "size": "0x4000", "readonly": true}
+//	  ]
+//	}
+//
+// Numbers may be JSON numbers or strings in any base strconv understands.
+// Every register is a 32-bit little-endian value at its offset and all
+// others read as zero. Writes are kept unless the region is read-only, so
+// that firmware reads back what it programmed.
+package chipset
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// pciConfigSize is the size of a conventional PCI configuration space.
+	pciConfigSize = 0x100
+
+	// IOPorts is the number of x86 I/O ports.
+	IOPorts = 0x10000
+
+	// MaxSize bounds the size of a region, whose registers are all held
+	// in memory. The largest chipset block, such as an RCBA, is 16 KiB.
+	MaxSize = 1 << 20
+)
+
+var (
+	ErrBDF    = errors.New("invalid PCI bus:device.function")
+	ErrRegion = errors.New("invalid region")
+)
+
+// Hex is a number that is written as a JSON number or string, e.g. "0x1f".
+type Hex uint64
+
+func (h *Hex) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 0, 64)
+	if err != nil {
+		return err
+	}
+
+	*h = Hex(v)
+
+	return nil
+}
+
+func (h *Hex) UnmarshalJSON(data []byte) error {
+	s := ""
+	if err := json.Unmarshal(data, &s); err != nil {
+		return h.UnmarshalText(data)
+	}
+
+	return h.UnmarshalText([]byte(s))
+}
+
+// Region is a block of registers in PCI configuration space (by BDF), I/O
+// ports or MMIO (by Base and Size).
+type Region struct {
+	Name     string      `json:"name"`
+	BDF      string      `json:"bdf"`
+	Base     Hex         `json:"base"`
+	Size     Hex         `json:"size"`
+	ReadOnly bool        `json:"readonly"`
+	Regs     map[Hex]Hex `json:"regs"`
+}
+
+// Profile is the set of registers of a chipset.
+type Profile struct {
+	Name string   `json:"name"`
+	PCI  []Region `json:"pci"`
+	IO   []Region `json:"io"`
+	MMIO []Region `json:"mmio"`
+}
+
+// Load reads a profile from a JSON file.
+func Load(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Profile{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+// ParseBDF parses a PCI address such as "00:1f.0".
+func ParseBDF(s string) (bus, device, function uint32, err error) {
+	if _, err := fmt.Sscanf(s, "%x:%x.%x", &bus, &device, &function); err != nil {
+		return 0, 0, 0, fmt.Errorf("%w: %q", ErrBDF, s)
+	}
+
+	if bus > 0xff || device > 0x1f || function > 7 {
+		return 0, 0, 0, fmt.Errorf("%w: %q", ErrBDF, s)
+	}
+
+	return bus, device, function, nil
+}
+
+// Space holds the registers of a region. Accesses are at offsets into it.
+type Space struct {
+	mu sync.Mutex
+
+	region Region
+	data   []byte
+	log    io.Writer
+}
+
+// NewSpace returns the registers of r, with accesses logged to log unless
+// it is nil. Regions in PCI configuration space default to 256 bytes.
+func NewSpace(r Region, log io.Writer) (*Space, error) {
+	if r.Size == 0 && r.BDF != "" {
+		r.Size = pciConfigSize
+	}
+
+	if r.Size == 0 {
+		return nil, fmt.Errorf("%w: %s has no size", ErrRegion, r.Name)
+	}
+
+	if r.Size > MaxSize {
+		return nil, fmt.Errorf("%w: %s size %#x is beyond %#x", ErrRegion, r.Name, uint64(r.Size), MaxSize)
+	}
+
+	s := &Space{region: r, data: make([]byte, r.Size), log: log}
+
+	// Lower offsets first, so that a register overlapping the one before
+	// wins over its upper zero bytes.
+	offsets := make([]Hex, 0, len(r.Regs))
+	for off := range r.Regs {
+		offsets = append(offsets, off)
+	}
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	for _, off := range offsets {
+		if r.Size < 4 || off > r.Size-4 {
+			return nil, fmt.Errorf("%w: %s register %#x is beyond %#x", ErrRegion, r.Name, uint64(off), uint64(r.Size))
+		}
+
+		binary.LittleEndian.PutUint32(s.data[off:], uint32(r.Regs[off]))
+	}
+
+	return s, nil
+}
+
+// NewIOSpace is NewSpace for a region of I/O ports, which must all be
+// below IOPorts.
+func NewIOSpace(r Region, log io.Writer) (*Space, error) {
+	if r.Base >= IOPorts || r.Size > IOPorts-r.Base {
+		return nil, fmt.Errorf("%w: %s at %#x+%#x is beyond the I/O ports", ErrRegion, r.Name, uint64(r.Base), uint64(r.Size))
+	}
+
+	return NewSpace(r, log)
+}
+
+// Read handles a read of len(bytes) bytes at offset.
+func (s *Space) Read(offset uint64, bytes []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range bytes {
+		bytes[i] = 0
+
+		if off := offset + uint64(i); off < uint64(len(s.data)) {
+			bytes[i] = s.data[off]
+		}
+	}
+
+	s.logf("%s: read %#x = %#x", s.region.Name, offset, value(bytes))
+
+	return nil
+}
+
+// Write handles a write of len(bytes) bytes at offset.
+func (s *Space) Write(offset uint64, bytes []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logf("%s: write %#x = %#x", s.region.Name, offset, value(bytes))
+
+	if s.region.ReadOnly {
+		return nil
+	}
+
+	for i, b := range bytes {
+		if off := offset + uint64(i); off < uint64(len(s.data)) {
+			s.data[off] = b
+		}
+	}
+
+	return nil
+}
+
+// value is the little-endian number in bytes.
+func value(bytes []byte) uint64 {
+	v := uint64(0)
+
+	for i, b := range bytes {
+		v |= uint64(b) << (8 * i)
+	}
+
+	return v
+}
+
+func (s *Space) logf(format string, a ...interface{}) {
+	if s.log != nil {
+		fmt.Fprintf(s.log, "chipset "+format+"\r\n", a...)
+	}
+}
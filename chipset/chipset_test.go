@@ -0,0 +1,182 @@
+package chipset_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/chipset"
+)
+
+const profile = `{
+  "name": "ich7",
+  "pci": [
+    {"name": "LPC", "bdf": "00:1f.0", "regs": {"0x00": "0x27b88086", "0xf0": "0xfed1c001"}}
+  ],
+  "io": [
+    {"name": "PMC", "base": "0x500", "size": 128}
+  ],
+  "mmio": [
+    {"name": "RCBA", "base": "0xfed1c000", "size": "0x4000", "readonly": true, "regs": {"0x3410": 4}}
+  ]
+}`
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "ich7.json")
+	if err := os.WriteFile(path, []byte(profile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := chipset.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Name != "ich7" || len(p.PCI) != 1 || len(p.IO) != 1 || len(p.MMIO) != 1 {
+		t.Fatalf("unexpected profile: %+v", p)
+	}
+
+	if p.PCI[0].Regs[0xf0] != 0xfed1c001 || p.IO[0].Size != 0x80 || p.MMIO[0].Regs[0x3410] != 4 {
+		t.Fatalf("unexpected values: %+v", p)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"io": [{"base": "0xzz"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chipset.Load(path); err == nil {
+		t.Fatal("Load with an invalid number: got nil, want error")
+	}
+}
+
+func TestSpace(t *testing.T) {
+	t.Parallel()
+
+	log := &bytes.Buffer{}
+
+	s, err := chipset.NewSpace(chipset.Region{
+		Name: "LPC",
+		BDF:  "00:1f.0",
+		Regs: map[chipset.Hex]chipset.Hex{0x00: 0x27b88086, 0x40: 0x501},
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 2)
+	if err := s.Read(0x02, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, []byte{0xb8, 0x27}) {
+		t.Fatalf("device id: got %#x", b)
+	}
+
+	if err := s.Write(0x40, []byte{0x01, 0x06}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Read(0x40, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, []byte{0x01, 0x06}) {
+		t.Fatalf("written value: got %#x", b)
+	}
+
+	// Out of range reads are zero.
+	if err := s.Read(0xff, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, []byte{0, 0}) {
+		t.Fatalf("out of range: got %#x", b)
+	}
+
+	if !strings.Contains(log.String(), "chipset LPC: write 0x40 = 0x601") {
+		t.Errorf("accesses are not logged: %q", log.String())
+	}
+}
+
+func TestSpaceReadOnly(t *testing.T) {
+	t.Parallel()
+
+	s, err := chipset.NewSpace(chipset.Region{
+		Name: "RCBA", Base: 0xfed1c000, Size: 0x4000, ReadOnly: true,
+		Regs: map[chipset.Hex]chipset.Hex{0x3410: 4},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Write(0x3410, []byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 4)
+	if err := s.Read(0x3410, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if b[0] != 4 {
+		t.Fatalf("read-only register: got %#x, want 4", b)
+	}
+
+	if _, err := chipset.NewSpace(chipset.Region{Name: "GPIO"}, nil); !errors.Is(err, chipset.ErrRegion) {
+		t.Errorf("region without size: got %v, want %v", err, chipset.ErrRegion)
+	}
+
+	_, err = chipset.NewSpace(chipset.Region{Name: "GPIO", Size: 0x40, Regs: map[chipset.Hex]chipset.Hex{0x3e: 1}}, nil)
+	if !errors.Is(err, chipset.ErrRegion) {
+		t.Errorf("register beyond the region: got %v, want %v", err, chipset.ErrRegion)
+	}
+
+	for _, r := range []chipset.Region{
+		{Name: "GPIO", Size: 2, Regs: map[chipset.Hex]chipset.Hex{0: 1}},
+		{Name: "GPIO", Size: 0x40, Regs: map[chipset.Hex]chipset.Hex{1<<64 - 2: 1}},
+		{Name: "RCBA", Size: chipset.MaxSize + 1},
+		{Name: "RCBA", Size: 1<<64 - 1},
+	} {
+		if _, err := chipset.NewSpace(r, nil); !errors.Is(err, chipset.ErrRegion) {
+			t.Errorf("region of %#x: got %v, want %v", uint64(r.Size), err, chipset.ErrRegion)
+		}
+	}
+
+	if _, err := chipset.NewIOSpace(chipset.Region{Name: "PMC", Base: 0xffc0, Size: 0x40}, nil); err != nil {
+		t.Errorf("region up to the last I/O port: %v", err)
+	}
+
+	for _, r := range []chipset.Region{
+		{Name: "PMC", Base: 0xffc0, Size: 0x80},
+		{Name: "PMC", Base: 0x10000, Size: 0x10},
+		{Name: "PMC", Base: 0x500, Size: 1<<64 - 0x100},
+	} {
+		if _, err := chipset.NewIOSpace(r, nil); !errors.Is(err, chipset.ErrRegion) {
+			t.Errorf("I/O region at %#x+%#x: got %v, want %v", uint64(r.Base), uint64(r.Size), err, chipset.ErrRegion)
+		}
+	}
+}
+
+func TestParseBDF(t *testing.T) {
+	t.Parallel()
+
+	bus, device, function, err := chipset.ParseBDF("00:1f.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bus != 0 || device != 0x1f || function != 3 {
+		t.Fatalf("got %x:%x.%x, want 00:1f.3", bus, device, function)
+	}
+
+	for _, s := range []string{"", "00:20.0", "00:1f.8", "lpc"} {
+		if _, _, _, err := chipset.ParseBDF(s); !errors.Is(err, chipset.ErrBDF) {
+			t.Errorf("%q: got %v, want %v", s, err, chipset.ErrBDF)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Package consolelog writes what the guest writes to its console to a log
+// file, each line after the time since the log was opened as dmesg does,
+// so that boot phases can be timed and a boot that regressed looked into
+// after the fact:
+//
+//	[    0.000312] SeaBIOS (version 1.16.0)
+//	[    1.204551] Run /init as init process
+//
+// Once the log reaches its size, it is rotated at the end of a line to
+// PATH.1, PATH.1 to PATH.2 and so on, as is the log of the run before when
+// it is opened.
+package consolelog
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log is a console log. It is safe for concurrent use.
+type Log struct {
+	mu    sync.Mutex
+	path  string
+	size  int64
+	keep  int
+	start time.Time
+	f     *os.File
+	// n is how much was written to f, and midLine whether the last write
+	// ended in a line.
+	n       int64
+	midLine bool
+}
+
+// Open starts the log at path, which is rotated once it reaches size bytes
+// unless size is 0, keeping keep logs before it.
+func Open(path string, size int64, keep int) (*Log, error) {
+	l := &Log{path: path, size: size, keep: keep, start: time.Now()}
+
+	if err := l.rotate(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// rotate moves the logs one up, dropping the oldest, and starts a new one.
+func (l *Log) rotate() error {
+	if l.f != nil {
+		if err := l.f.Close(); err != nil {
+			return err
+		}
+	}
+
+	for i := l.keep; i > 0; i-- {
+		from := l.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", l.path, i-1)
+		}
+
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", l.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	l.f, l.n = f, 0
+
+	return nil
+}
+
+// Write logs p, with the time before each line it starts.
+func (l *Log) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	written := len(p)
+
+	for len(p) > 0 {
+		var buf []byte
+
+		if !l.midLine {
+			if l.size > 0 && l.n >= l.size {
+				if err := l.rotate(); err != nil {
+					return 0, err
+				}
+			}
+
+			buf = []byte(fmt.Sprintf("[%12.6f] ", time.Since(l.start).Seconds()))
+			l.midLine = true
+		}
+
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+			l.midLine = false
+		}
+
+		p = p[len(line):]
+
+		n, err := l.f.Write(append(buf, line...))
+		l.n += int64(n)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return written, nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
@@ -0,0 +1,51 @@
+package consolelog_test
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/consolelog"
+)
+
+func TestLog(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "console.log")
+	if err := os.WriteFile(path, []byte("last run\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := consolelog.Open(path, 40, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// A line may come in pieces, and is rotated only at its end.
+	for _, s := range []string{"Linux version", " 6.1\r\n", "Run /init\r\nlogin: ", "root\r\n", "# "} {
+		if n, err := l.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{path + ".2", `^last run\n$`},
+		{path + ".1", `^\[ +0\.\d{6}\] Linux version 6\.1\r\n\[ +0\.\d{6}\] Run /init\r\n$`},
+		{path, `^\[ +0\.\d{6}\] login: root\r\n\[ +0\.\d{6}\] # $`},
+	} {
+		b, err := os.ReadFile(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !regexp.MustCompile(tt.want).Match(b) {
+			t.Errorf("%s: got %q, want %s", filepath.Base(tt.path), b, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Package control serves commands to a running gokvm over a Unix socket,
+// e.g. to inject device faults, one per line:
+//
+//	$ socat - UNIX-CONNECT:gokvm.sock
+//	fault blk eio 3
+//	ok
+//
+// A command answers with its output, if any, followed by a line "ok", or
+// with a line "error: " and what went wrong.
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrUsage          = errors.New("usage")
+)
+
+// Handler runs a command with its arguments and returns its output.
+type Handler func(args []string) (string, error)
+
+// QueryHandler runs a command that changes nothing and returns its result,
+// which the socket shows as text, with its String method if it has one,
+// and HTTPHandler as JSON.
+type QueryHandler func(args []string) (interface{}, error)
+
+type command struct {
+	usage string
+	h     Handler
+	query QueryHandler
+}
+
+// Server runs the commands registered with Handle.
+type Server struct {
+	mu   sync.Mutex
+	cmds map[string]command
+}
+
+// New returns a server with only the help command.
+func New() *Server {
+	s := &Server{cmds: map[string]command{}}
+	s.Handle("help", "help", s.help)
+
+	return s
+}
+
+// Handle registers h as the command name, described by usage, e.g.
+// "fault blk|net [eio N|drop RATE|corrupt RATE|delay DURATION|clear]".
+func (s *Server) Handle(name, usage string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cmds[name] = command{usage: usage, h: h}
+}
+
+// HandleQuery registers h as the query command name, described by usage,
+// which HTTPHandler serves besides the socket. Names of queries start with
+// "query-" by convention.
+func (s *Server) HandleQuery(name, usage string, h QueryHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cmds[name] = command{usage: usage, query: h, h: func(args []string) (string, error) {
+		v, err := h(args)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprint(v), nil
+	}}
+}
+
+// Usage returns an ErrUsage for the command name, for handlers to return
+// on bad arguments.
+func (s *Server) Usage(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return fmt.Errorf("%w: %s", ErrUsage, s.cmds[name].usage)
+}
+
+func (s *Server) help(args []string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usages := []string{}
+	for _, c := range s.cmds {
+		usages = append(usages, c.usage)
+	}
+
+	sort.Strings(usages)
+
+	return strings.Join(usages, "\n"), nil
+}
+
+// Run runs the command line, e.g. "fault net drop 0.1".
+func (s *Server) Run(line string) (string, error) {
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return "", nil
+	}
+
+	s.mu.Lock()
+	c, ok := s.cmds[f[0]]
+	s.mu.Unlock()
+
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownCommand, f[0])
+	}
+
+	return c.h(f[1:])
+}
+
+// Serve runs the commands of each connection to l until l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer c.Close()
+
+			_ = s.ServeConn(c)
+		}()
+	}
+}
+
+// ServeConn runs the commands read from rw, one per line, and writes
+// their answers to it until it is closed.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	sc := bufio.NewScanner(rw)
+
+	for sc.Scan() {
+		out, err := s.Run(sc.Text())
+
+		switch {
+		case err != nil:
+			out = fmt.Sprintf("error: %v\n", err)
+		case out == "":
+			out = "ok\n"
+		default:
+			out = strings.TrimSuffix(out, "\n") + "\nok\n"
+		}
+
+		if _, err := io.WriteString(rw, out); err != nil {
+			return err
+		}
+	}
+
+	return sc.Err()
+}
@@ -0,0 +1,82 @@
+package control_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/control"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	s := control.New()
+	s.Handle("echo", "echo WORD", func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", s.Usage("echo")
+		}
+
+		return args[0], nil
+	})
+
+	if out, err := s.Run("  echo  hi "); err != nil || out != "hi" {
+		t.Fatalf("echo: got %q, %v", out, err)
+	}
+
+	if _, err := s.Run("echo"); !errors.Is(err, control.ErrUsage) || !strings.Contains(err.Error(), "echo WORD") {
+		t.Fatalf("echo without a word: got %v, want %v", err, control.ErrUsage)
+	}
+
+	if _, err := s.Run("reboot"); !errors.Is(err, control.ErrUnknownCommand) {
+		t.Fatalf("reboot: got %v, want %v", err, control.ErrUnknownCommand)
+	}
+
+	if out, err := s.Run("help"); err != nil || out != "echo WORD\nhelp" {
+		t.Fatalf("help: got %q, %v", out, err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := control.New()
+	s.Handle("two", "two", func(args []string) (string, error) { return "one\ntwo\n", nil })
+
+	go func() { _ = s.Serve(l) }()
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte("two\nnope\n\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(c)
+	want := []string{"one", "two", "ok", "error: unknown command: nope", "ok"}
+
+	for _, w := range want {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := strings.TrimSuffix(line, "\n"); got != w {
+			t.Fatalf("got %q, want %q", got, w)
+		}
+	}
+}
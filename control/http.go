@@ -0,0 +1,114 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HTTPHandler returns a read-only mirror of the query commands of
+// HandleQuery for web dashboards, which answers in JSON and allows
+// requests from pages of origin, "*" for any, through CORS, or only from
+// the same origin if it is "":
+//
+//	GET /                      {"commands":[{"name":"query-vcpus","usage":"query-vcpus"}]}
+//	GET /query-echo?arg=hi     {"result":{...}}
+//	GET /query-nope            {"error":"unknown command: query-nope"}
+//
+// Arguments are given in order as arg parameters. Other commands, which may
+// change the VM, are only on the socket.
+func (s *Server) HTTPHandler(origin string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if origin != "" {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		switch r.Method {
+		case http.MethodOptions:
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		case http.MethodGet:
+		default:
+			h.Set("Allow", "GET, OPTIONS")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed: " + r.Method})
+
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"commands": s.queries()})
+
+			return
+		}
+
+		v, err := s.query(name, r.URL.Query()["arg"])
+
+		switch {
+		case errors.Is(err, ErrUnknownCommand):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.Is(err, ErrUsage):
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"result": v})
+		}
+	})
+}
+
+// queryInfo describes a query command in the index of HTTPHandler.
+type queryInfo struct {
+	Name  string `json:"name"`
+	Usage string `json:"usage"`
+}
+
+func (s *Server) queries() []queryInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	qs := []queryInfo{}
+
+	for name, c := range s.cmds {
+		if c.query != nil {
+			qs = append(qs, queryInfo{Name: name, Usage: c.usage})
+		}
+	}
+
+	sort.Slice(qs, func(i, j int) bool { return qs[i].Name < qs[j].Name })
+
+	return qs
+}
+
+// query runs the query command name, and fails with ErrUnknownCommand for
+// commands that are not queries.
+func (s *Server) query(name string, args []string) (interface{}, error) {
+	s.mu.Lock()
+	c, ok := s.cmds[name]
+	s.mu.Unlock()
+
+	if !ok || c.query == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+	}
+
+	return c.query(args)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(b, '\n'))
+}
@@ -0,0 +1,85 @@
+package control_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/control"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	t.Parallel()
+
+	s := control.New()
+	s.Handle("reset", "reset", func(args []string) (string, error) { return "", nil })
+	s.HandleQuery("query-echo", "query-echo WORD", func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, s.Usage("query-echo")
+		}
+
+		return map[string]string{"word": args[0]}, nil
+	})
+
+	// The socket shows the result as text.
+	if out, err := s.Run("query-echo hi"); err != nil || out != "map[word:hi]" {
+		t.Errorf("query-echo: got %q, %v", out, err)
+	}
+
+	srv := httptest.NewServer(s.HTTPHandler("https://dash.example"))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		method, path string
+		status       int
+		want         string
+	}{
+		{http.MethodGet, "/", http.StatusOK, `{"commands":[{"name":"query-echo","usage":"query-echo WORD"}]}`},
+		{http.MethodGet, "/query-echo?arg=hi", http.StatusOK, `{"result":{"word":"hi"}}`},
+		{http.MethodGet, "/query-echo", http.StatusBadRequest, `{"error":"usage: query-echo WORD"}`},
+		// Only queries are mirrored.
+		{http.MethodGet, "/reset", http.StatusNotFound, `{"error":"unknown command: reset"}`},
+		{http.MethodPost, "/query-echo?arg=hi", http.StatusMethodNotAllowed, `{"error":"method not allowed: POST"}`},
+		{http.MethodOptions, "/query-echo", http.StatusNoContent, ``},
+	} {
+		req, err := http.NewRequest(c.method, srv.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var body json.RawMessage
+
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status || string(body) != c.want {
+			t.Errorf("%s %s: got %d %s, want %d %s", c.method, c.path, resp.StatusCode, body, c.status, c.want)
+		}
+
+		if o := resp.Header.Get("Access-Control-Allow-Origin"); o != "https://dash.example" {
+			t.Errorf("%s %s: CORS origin %q", c.method, c.path, o)
+		}
+	}
+
+	// Without an origin, browsers only let pages of the server itself
+	// read the answers.
+	same := httptest.NewServer(s.HTTPHandler(""))
+	defer same.Close()
+
+	resp, err := http.Get(same.URL + "/query-echo?arg=hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if o, ok := resp.Header["Access-Control-Allow-Origin"]; resp.StatusCode != http.StatusOK || ok {
+		t.Errorf("without an origin: got %d with CORS origin %q", resp.StatusCode, o)
+	}
+}
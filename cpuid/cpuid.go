@@ -0,0 +1,223 @@
+// Package cpuid compares the CPUID that KVM supports, that it can emulate
+// and that a machine configures for its vCPUs, so that it is clear which
+// features guests see and why:
+//
+//	$ gokvm cpuid
+//	LEAF        REG  BIT  FEATURE       SUPPORTED  EMULATED  CONFIGURED
+//	0x00000001  ecx  5    vmx           yes        no        no
+//	0x00000001  ecx  22   movbe         no         yes       no
+//	...
+package cpuid
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// Leaf is a CPUID function and, for functions with subleaves, its index.
+type Leaf struct {
+	Function uint32
+	Index    uint32
+}
+
+func (l Leaf) String() string {
+	if l.Index == 0 {
+		return fmt.Sprintf("0x%08x", l.Function)
+	}
+
+	return fmt.Sprintf("0x%08x.%d", l.Function, l.Index)
+}
+
+// Registers of a CPUID entry, in the order they are returned.
+var registers = [...]string{"eax", "ebx", "ecx", "edx"}
+
+// features names the feature flags of the registers that hold flags, by
+// leaf and register. Their bits are compared one by one, named or not,
+// and other registers as a whole.
+var features = map[Leaf]map[string]map[int]string{
+	{Function: 1}: {
+		"ecx": {
+			0: "sse3", 1: "pclmulqdq", 3: "monitor", 5: "vmx", 9: "ssse3", 12: "fma", 13: "cx16",
+			17: "pcid", 19: "sse4_1", 20: "sse4_2", 21: "x2apic", 22: "movbe", 23: "popcnt",
+			24: "tsc_deadline", 25: "aes", 26: "xsave", 28: "avx", 29: "f16c", 30: "rdrand",
+			31: "hypervisor",
+		},
+		"edx": {
+			0: "fpu", 3: "pse", 4: "tsc", 5: "msr", 6: "pae", 8: "cx8", 9: "apic", 11: "sep",
+			12: "mtrr", 13: "pge", 15: "cmov", 16: "pat", 19: "clflush", 23: "mmx", 24: "fxsr",
+			25: "sse", 26: "sse2", 28: "ht",
+		},
+	},
+	{Function: kvm.CPUIDFuncExtFeatures}: {
+		"ebx": {
+			0: "fsgsbase", 2: "sgx", 3: "bmi1", 4: "hle", 5: "avx2", 7: "smep", 8: "bmi2",
+			9: "erms", 10: "invpcid", 11: "rtm", 16: "avx512f", 18: "rdseed", 19: "adx",
+			20: "smap", 23: "clflushopt", 24: "clwb", 29: "sha_ni",
+		},
+		"ecx": {
+			1: "avx512vbmi", 2: "umip", 3: "pku", 5: "waitpkg", 8: "gfni", 9: "vaes",
+			10: "vpclmulqdq", 22: "rdpid", 25: "cldemote", 27: "movdiri", 30: "sgx_lc",
+		},
+		"edx": {
+			4: "fsrm", 10: "md_clear", 14: "serialize", 26: "spec_ctrl", 27: "intel_stibp",
+			29: "arch_capabilities", 31: "spec_ctrl_ssbd",
+		},
+	},
+	{Function: 0x80000001}: {
+		"ecx": {0: "lahf_lm", 2: "svm", 5: "abm", 6: "sse4a", 8: "3dnowprefetch"},
+		"edx": {11: "syscall", 20: "nx", 26: "pdpe1gb", 27: "rdtscp", 29: "lm"},
+	},
+}
+
+// Diff is a difference between the CPUID sets, of a feature flag or of a
+// whole register.
+type Diff struct {
+	Leaf     Leaf
+	Register string
+	// Bit is the feature flag, or -1 for a whole register; Feature is its
+	// name if known.
+	Bit     int
+	Feature string
+	// Supported, Emulated and Configured are the values in each set, 0 or
+	// 1 for a flag, and 0 where a set lacks the leaf.
+	Supported, Emulated, Configured uint32
+}
+
+// entries returns the entries of c by leaf.
+func entries(c *kvm.CPUID) map[Leaf]kvm.CPUIDEntry2 {
+	m := map[Leaf]kvm.CPUIDEntry2{}
+	if c == nil {
+		return m
+	}
+
+	for _, e := range c.Entries[:c.Nent] {
+		l := Leaf{Function: e.Function}
+		if e.Flags&kvm.CPUIDFlagSignificantIndex != 0 {
+			l.Index = e.Index
+		}
+
+		m[l] = e
+	}
+
+	return m
+}
+
+func register(e kvm.CPUIDEntry2, reg string) uint32 {
+	switch reg {
+	case "eax":
+		return e.Eax
+	case "ebx":
+		return e.Ebx
+	case "ecx":
+		return e.Ecx
+	default:
+		return e.Edx
+	}
+}
+
+// Compare returns how the supported, emulated and configured CPUID differ,
+// ordered by leaf, register and bit. Flags are reported where guests get a
+// feature other than KVM supports it: if it is emulated only, or is
+// configured but not supported or the other way round. Other registers,
+// which KVM does not emulate, are reported where the configured value is
+// not the supported one.
+func Compare(supported, emulated, configured *kvm.CPUID) []Diff {
+	s, e, c := entries(supported), entries(emulated), entries(configured)
+
+	leaves := map[Leaf]bool{}
+	for _, m := range []map[Leaf]kvm.CPUIDEntry2{s, e, c} {
+		for l := range m {
+			leaves[l] = true
+		}
+	}
+
+	var diffs []Diff
+
+	for l := range leaves {
+		for _, reg := range registers {
+			sv, ev, cv := register(s[l], reg), register(e[l], reg), register(c[l], reg)
+
+			if names, ok := features[l][reg]; ok {
+				diffs = append(diffs, flagDiffs(l, reg, names, sv, ev, cv)...)
+
+				continue
+			}
+
+			if sv != cv {
+				diffs = append(diffs, Diff{Leaf: l, Register: reg, Bit: -1, Supported: sv, Emulated: ev, Configured: cv})
+			}
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		a, b := diffs[i], diffs[j]
+
+		switch {
+		case a.Leaf != b.Leaf:
+			return a.Leaf.Function < b.Leaf.Function ||
+				(a.Leaf.Function == b.Leaf.Function && a.Leaf.Index < b.Leaf.Index)
+		case a.Register != b.Register:
+			return a.Register < b.Register
+		default:
+			return a.Bit < b.Bit
+		}
+	})
+
+	return diffs
+}
+
+func flagDiffs(l Leaf, reg string, names map[int]string, sv, ev, cv uint32) []Diff {
+	var diffs []Diff
+
+	for bit := 0; bit < 32; bit++ {
+		sb, eb, cb := sv>>bit&1, ev>>bit&1, cv>>bit&1
+		if sb == cb && (eb == 0 || sb == 1) {
+			continue
+		}
+
+		diffs = append(diffs, Diff{
+			Leaf: l, Register: reg, Bit: bit, Feature: names[bit],
+			Supported: sb, Emulated: eb, Configured: cb,
+		})
+	}
+
+	return diffs
+}
+
+// Write prints diffs as a table to w.
+func Write(w io.Writer, diffs []Diff) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "LEAF\tREG\tBIT\tFEATURE\tSUPPORTED\tEMULATED\tCONFIGURED")
+
+	for _, d := range diffs {
+		if d.Bit < 0 {
+			fmt.Fprintf(tw, "%v\t%s\t-\t-\t0x%08x\t0x%08x\t0x%08x\n",
+				d.Leaf, d.Register, d.Supported, d.Emulated, d.Configured)
+
+			continue
+		}
+
+		feature := d.Feature
+		if feature == "" {
+			feature = "-"
+		}
+
+		fmt.Fprintf(tw, "%v\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			d.Leaf, d.Register, d.Bit, feature, yes(d.Supported), yes(d.Emulated), yes(d.Configured))
+	}
+
+	return tw.Flush()
+}
+
+func yes(b uint32) string {
+	if b != 0 {
+		return "yes"
+	}
+
+	return "no"
+}
@@ -0,0 +1,69 @@
+package cpuid_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/cpuid"
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func set(entries ...kvm.CPUIDEntry2) *kvm.CPUID {
+	c := &kvm.CPUID{Nent: uint32(len(entries))}
+	copy(c.Entries[:], entries)
+
+	return c
+}
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+
+	const (
+		vmx   = 1 << 5
+		movbe = 1 << 22
+		avx2  = 1 << 5
+	)
+
+	supported := set(
+		kvm.CPUIDEntry2{Function: 1, Eax: 0x906ea, Ecx: vmx | 1},
+		kvm.CPUIDEntry2{Function: 7, Flags: kvm.CPUIDFlagSignificantIndex, Ebx: avx2},
+		kvm.CPUIDEntry2{Function: 0xa, Eax: 0x7300404},
+	)
+	emulated := set(
+		kvm.CPUIDEntry2{Function: 1, Ecx: movbe | 1},
+	)
+	configured := set(
+		kvm.CPUIDEntry2{Function: 1, Eax: 0x906ea, Ecx: 1},
+		kvm.CPUIDEntry2{Function: 7, Flags: kvm.CPUIDFlagSignificantIndex, Ebx: avx2},
+		kvm.CPUIDEntry2{Function: 0xa},
+	)
+
+	diffs := cpuid.Compare(supported, emulated, configured)
+
+	want := []cpuid.Diff{
+		{Leaf: cpuid.Leaf{Function: 1}, Register: "ecx", Bit: 5, Feature: "vmx", Supported: 1},
+		{Leaf: cpuid.Leaf{Function: 1}, Register: "ecx", Bit: 22, Feature: "movbe", Emulated: 1},
+		{Leaf: cpuid.Leaf{Function: 0xa}, Register: "eax", Bit: -1, Supported: 0x7300404},
+	}
+
+	if len(diffs) != len(want) {
+		t.Fatalf("got %+v, want %+v", diffs, want)
+	}
+
+	for i := range want {
+		if diffs[i] != want[i] {
+			t.Errorf("diff %d: got %+v, want %+v", i, diffs[i], want[i])
+		}
+	}
+
+	var b bytes.Buffer
+	if err := cpuid.Write(&b, diffs); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[2], "movbe") || !strings.Contains(lines[3], "0x07300404") {
+		t.Errorf("unexpected table:\n%s", b.String())
+	}
+}
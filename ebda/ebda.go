@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/bootparam"
 )
@@ -20,17 +19,49 @@ const (
 	// https://github.com/kvmtool/kvmtool/blob/415f92c33a227c02f6719d4594af6fad10f07abf/include/kvm/apic.h#L9
 	apicBaseAddrStep = 0x00400000
 
+	// The IOAPIC is at the address of the PC, which the in-kernel one of
+	// kvm is at, and has the version of the 82093AA it emulates.
+	ioapicPhysBase = 0xfec00000
+	ioapicVersion  = 0x11
+
+	// ISA IRQs 0-15 are wired to the IOAPIC pins of the same number, but
+	// for the timer, whose IRQ 0 is at pin 2 in place of the cascade of
+	// the 8259s.
+	isaIRQs       = 16
+	isaIRQCascade = 2
+	timerPin      = 2
+
 	mpfIntelSignature = (('_' << 24) | ('P' << 16) | ('M' << 8) | '_')
 	mpcTableSignature = (('P' << 24) | ('M' << 16) | ('C' << 8) | 'P')
 
 	// see Table 4-3. Base MP Configuration Table Entry Types in Intel MP Configuration
 	// https://pdos.csail.mit.edu/6.828/2014/readings/ia32/MPspec.pdf
 	mpEntryTypeProcessor = 0
+	mpEntryTypeBus       = 1
+	mpEntryTypeIOAPIC    = 2
+	mpEntryTypeIOIntr    = 3
+	mpEntryTypeLocalIntr = 4
 
 	// see Table 4-4. Processor Entry Fields in Intel MP Configuration
 	// https://pdos.csail.mit.edu/6.828/2014/readings/ia32/MPspec.pdf
 	cpuFlagEnabled       = 1
 	cpuFlagBootProcessor = 3
+
+	// see Table 4-7. I/O APIC Entry Fields in Intel MP Configuration
+	ioapicFlagEnabled = 1
+
+	// see Table 4-9. Interrupt Type Values, of interrupts whose polarity
+	// and trigger mode conform to their bus.
+	intrTypeINT    = 0
+	intrTypeNMI    = 1
+	intrTypeExtINT = 3
+	intrFlagBus    = 0
+
+	busIDISA         = 0
+	allLocalAPICs    = 0xff
+	localAPICLINT0   = 0
+	localAPICLINT1   = 1
+	localAPICVersion = 0x14
 )
 
 var errorVCPUNumExceed = fmt.Errorf("the number of vCPUs must be less than or equal to %d", maxVCPUs)
@@ -61,9 +92,16 @@ type (
 		_             uint8 // feature5
 	}
 
+	// MP Configuration Table, with its entries of variable types after
+	// the header.
+	mpcTable struct {
+		header  mpcHeader
+		entries []interface{}
+	}
+
 	// MP Configuration Table Header
 	// ported from https://github.com/torvalds/linux/blob/5bfc75d92/arch/x86/include/asm/mpspec_def.h#L37-L49
-	mpcTable struct {
+	mpcHeader struct {
 		signature uint32
 		length    uint16
 		spec      uint8
@@ -75,21 +113,33 @@ type (
 		oemCount  uint16
 		lapic     uint32 // Local APIC addresss must be set.
 		_         uint32 // reserved
-
-		mpcCPU [maxVCPUs]mpcCPU
 	}
 )
 
 func (e *EBDA) Bytes() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
-	if err := binary.Write(buf, binary.LittleEndian, e); err != nil {
+	if err := binary.Write(buf, binary.LittleEndian, [16 * 3]uint8{}); err != nil {
+		return []byte{}, err
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, e.mpfIntel); err != nil {
 		return []byte{}, err
 	}
 
+	table, err := e.mpcTable.bytes()
+	if err != nil {
+		return []byte{}, err
+	}
+
+	buf.Write(table)
+
 	return buf.Bytes(), nil
 }
 
+// New returns the EBDA with the MP table of a machine of nCPUs vCPUs,
+// whose APIC IDs are their indexes, and the IOAPIC, for kernels that do
+// not parse ACPI to find them.
 func New(nCPUs int) (*EBDA, error) {
 	e := &EBDA{}
 
@@ -159,30 +209,76 @@ func apicAddr(apic uint32) uint32 {
 }
 
 func newMPCTable(nCPUs int) (*mpcTable, error) {
-	m := &mpcTable{}
-	m.signature = mpcTableSignature
-	m.length = uint16(unsafe.Sizeof(mpcTable{})) // this field must contain the size of entries.
-	m.spec = 4
-	m.lapic = apicAddr(0)
-	m.oemCount = maxVCPUs // This must be the number of entries
-
 	if nCPUs > maxVCPUs {
 		return nil, errorVCPUNumExceed
 	}
 
-	var err error
+	m := &mpcTable{}
+	m.header.signature = mpcTableSignature
+	m.header.spec = 4
+	m.header.lapic = apicAddr(0)
 
 	for i := 0; i < nCPUs; i++ {
-		m.mpcCPU[i] = *newMPCCpu(i)
+		m.entries = append(m.entries, *newMPCCpu(i))
 	}
 
-	m.checkSum, err = m.calcCheckSum()
+	// The IOAPIC has the first ID after those of the vCPUs, as the MP
+	// specification has them unique.
+	ioapicID := uint8(nCPUs)
+
+	m.entries = append(m.entries,
+		mpcBus{typ: mpEntryTypeBus, busID: busIDISA, busType: [6]uint8{'I', 'S', 'A', ' ', ' ', ' '}},
+		mpcIOAPIC{
+			typ: mpEntryTypeIOAPIC, apicID: ioapicID, apicVer: ioapicVersion,
+			flags: ioapicFlagEnabled, apicAddr: ioapicPhysBase,
+		},
+	)
+
+	for irq := uint8(0); irq < isaIRQs; irq++ {
+		if irq == isaIRQCascade {
+			continue
+		}
+
+		pin := irq
+		if irq == 0 {
+			pin = timerPin
+		}
+
+		m.entries = append(m.entries, mpcIntSrc{
+			typ: mpEntryTypeIOIntr, irqType: intrTypeINT, irqFlag: intrFlagBus,
+			srcBus: busIDISA, srcBusIRQ: irq, dstAPIC: ioapicID, dstIRQ: pin,
+		})
+	}
+
+	// LINT0 of the local APICs takes the interrupts of the 8259s, LINT1
+	// NMIs.
+	m.entries = append(m.entries,
+		mpcIntSrc{
+			typ: mpEntryTypeLocalIntr, irqType: intrTypeExtINT, irqFlag: intrFlagBus,
+			srcBus: busIDISA, dstAPIC: allLocalAPICs, dstIRQ: localAPICLINT0,
+		},
+		mpcIntSrc{
+			typ: mpEntryTypeLocalIntr, irqType: intrTypeNMI, irqFlag: intrFlagBus,
+			srcBus: busIDISA, dstAPIC: allLocalAPICs, dstIRQ: localAPICLINT1,
+		},
+	)
+
+	m.header.oemCount = uint16(len(m.entries)) // This must be the number of entries
+
+	table, err := m.bytes()
 	if err != nil {
 		return m, err
 	}
 
-	m.checkSum ^= uint8(0xff)
-	m.checkSum++
+	m.header.length = uint16(len(table)) // this field must contain the size of entries.
+
+	m.header.checkSum, err = m.calcCheckSum()
+	if err != nil {
+		return m, err
+	}
+
+	m.header.checkSum ^= uint8(0xff)
+	m.header.checkSum++
 
 	return m, nil
 }
@@ -204,10 +300,16 @@ func (m *mpcTable) calcCheckSum() (uint8, error) {
 func (m *mpcTable) bytes() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
-	if err := binary.Write(buf, binary.LittleEndian, m); err != nil {
+	if err := binary.Write(buf, binary.LittleEndian, m.header); err != nil {
 		return []byte{}, err
 	}
 
+	for _, e := range m.entries {
+		if err := binary.Write(buf, binary.LittleEndian, e); err != nil {
+			return []byte{}, err
+		}
+	}
+
 	return buf.Bytes(), nil
 }
 
@@ -226,7 +328,7 @@ func newMPCCpu(i int) *mpcCPU {
 
 	m.typ = mpEntryTypeProcessor
 	m.apicID = uint8(i)
-	m.apicVer = 0x14
+	m.apicVer = localAPICVersion
 	m.cpuFlag |= cpuFlagEnabled
 
 	if i == 0 {
@@ -235,3 +337,32 @@ func newMPCCpu(i int) *mpcCPU {
 
 	return m
 }
+
+// MP Configuration Table entries of a bus, an IOAPIC and an interrupt
+// source, of an IOAPIC pin or of a local APIC LINT.
+// ported from https://github.com/torvalds/linux/blob/5bfc75d92/arch/x86/include/asm/mpspec_def.h#L75-L120
+type (
+	mpcBus struct {
+		typ     uint8
+		busID   uint8
+		busType [6]uint8
+	}
+
+	mpcIOAPIC struct {
+		typ      uint8
+		apicID   uint8
+		apicVer  uint8
+		flags    uint8
+		apicAddr uint32
+	}
+
+	mpcIntSrc struct {
+		typ       uint8
+		irqType   uint8
+		irqFlag   uint16
+		srcBus    uint8
+		srcBusIRQ uint8
+		dstAPIC   uint8
+		dstIRQ    uint8
+	}
+)
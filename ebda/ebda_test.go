@@ -1,6 +1,7 @@
 package ebda_test
 
 import (
+	"encoding/binary"
 	"testing"
 
 	"github.com/bobuhiro11/gokvm/ebda"
@@ -19,7 +20,38 @@ func TestNew(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(bytes) != 1388 {
+	// The floating pointer, then the header, 4 processors, the ISA bus,
+	// the IOAPIC, 15 ISA interrupts and 2 local interrupts.
+	if len(bytes) != 48+16+44+4*20+8+8+15*8+2*8 {
 		t.Fatalf("Invalid size: %v", len(bytes))
 	}
+
+	table := bytes[64:]
+	if string(table[:4]) != "PCMP" || int(binary.LittleEndian.Uint16(table[4:])) != len(table) ||
+		binary.LittleEndian.Uint16(table[34:]) != 4+1+1+15+2 {
+		t.Fatalf("Invalid table header: %#x", table[:44])
+	}
+
+	sum := byte(0)
+	for _, b := range table {
+		sum += b
+	}
+
+	if sum != 0 {
+		t.Fatalf("Invalid checksum: %#x", sum)
+	}
+
+	// The IOAPIC takes the ID after the vCPUs, and the timer its pin 2.
+	ioapic := table[44+4*20+8:]
+	if ioapic[0] != 2 || ioapic[1] != 4 || binary.LittleEndian.Uint32(ioapic[4:]) != 0xfec00000 {
+		t.Fatalf("Invalid IOAPIC: %#x", ioapic[:8])
+	}
+
+	if timer := ioapic[8:16]; timer[0] != 3 || timer[5] != 0 || timer[6] != 4 || timer[7] != 2 {
+		t.Fatalf("Invalid timer interrupt: %#x", timer)
+	}
+
+	if _, err := ebda.New(65); err == nil {
+		t.Fatal("65 vCPUs")
+	}
 }
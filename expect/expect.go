@@ -0,0 +1,241 @@
+// Package expect drives a guest through its serial console the way
+// expect(1) does, e.g. to answer the questions of an installer or to log
+// in for a boot test, with scripts of one command per line:
+//
+//	# Log in and check the kernel.
+//	timeout 2m
+//	expect login:
+//	sendline root
+//	expect (?m)^# $
+//	sendline uname -r
+//	expect 6\.[0-9]+
+//
+// expect waits for the guest to print a match of an RE2 regular
+// expression, send and sendline type text, the latter with a newline,
+// and both take Go escapes in a quoted string, e.g. send "\x03". timeout
+// sets how long each expect waits, 30s by default, and sleep pauses.
+package expect
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/agent"
+)
+
+// DefaultTimeout is how long an expect waits unless the script says.
+const DefaultTimeout = 30 * time.Second
+
+// maxBuffered is how much output the Expecter keeps to match against.
+const maxBuffered = 64 << 10
+
+var (
+	ErrTimeout = errors.New("timed out waiting for the guest")
+	ErrScript  = errors.New("invalid script")
+)
+
+// Expecter matches the serial output of a guest, which must be written to
+// it, e.g. via machine.SetSerialOutput, and types into its console.
+type Expecter struct {
+	console agent.Console
+
+	mu sync.Mutex
+	// buf is the output not consumed by a match yet, and more is closed
+	// and replaced when output comes in.
+	buf  []byte
+	more chan struct{}
+}
+
+func New(console agent.Console) *Expecter {
+	return &Expecter{console: console, more: make(chan struct{})}
+}
+
+// Write consumes the guest's serial output.
+func (e *Expecter) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.buf = append(e.buf, p...)
+	if len(e.buf) > maxBuffered {
+		e.buf = append(e.buf[:0], e.buf[len(e.buf)-maxBuffered:]...)
+	}
+
+	close(e.more)
+	e.more = make(chan struct{})
+
+	return len(p), nil
+}
+
+// Expect waits until the guest printed a match of re and returns it with
+// its submatches. The output up to the end of the match is consumed, so
+// that the next Expect looks at what comes after.
+func (e *Expecter) Expect(re *regexp.Regexp, timeout time.Duration) ([]string, error) {
+	deadline := time.After(timeout)
+
+	for {
+		e.mu.Lock()
+		loc := re.FindSubmatchIndex(e.buf)
+		more := e.more
+
+		if loc != nil {
+			m := make([]string, len(loc)/2)
+			for i := range m {
+				if loc[2*i] >= 0 {
+					m[i] = string(e.buf[loc[2*i]:loc[2*i+1]])
+				}
+			}
+
+			e.buf = append(e.buf[:0], e.buf[loc[1]:]...)
+			e.mu.Unlock()
+
+			return m, nil
+		}
+		e.mu.Unlock()
+
+		select {
+		case <-more:
+		case <-deadline:
+			return nil, fmt.Errorf("%w: no %q in %v", ErrTimeout, re, timeout)
+		}
+	}
+}
+
+// Send types s into the console.
+func (e *Expecter) Send(s string) error {
+	in := e.console.GetInputChan()
+
+	for i := 0; i < len(s); i++ {
+		in <- s[i]
+
+		if err := e.console.InjectSerialIRQ(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Step is a command of a script.
+type Step struct {
+	// Line is where the step is in the script, for errors.
+	Line int
+	// Op is expect, send, sendline, timeout or sleep.
+	Op string
+	// Re is the regular expression of expect, Text what send and sendline
+	// type, and Duration that of timeout and sleep.
+	Re       *regexp.Regexp
+	Text     string
+	Duration time.Duration
+}
+
+// Script is a parsed script.
+type Script []Step
+
+// Parse reads a script from r. Empty lines and lines starting with # are
+// skipped.
+func Parse(r io.Reader) (Script, error) {
+	var s Script
+
+	sc := bufio.NewScanner(r)
+
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		op, arg := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			op, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		step, err := parseStep(op, arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrScript, n, err)
+		}
+
+		step.Line = n
+		s = append(s, step)
+	}
+
+	return s, sc.Err()
+}
+
+func parseStep(op, arg string) (Step, error) {
+	step := Step{Op: op}
+
+	if strings.HasPrefix(arg, `"`) {
+		unquoted, err := strconv.Unquote(arg)
+		if err != nil {
+			return step, err
+		}
+
+		arg = unquoted
+	}
+
+	var err error
+
+	switch op {
+	case "expect":
+		step.Re, err = regexp.Compile(arg)
+	case "send", "sendline":
+		step.Text = arg
+		if op == "sendline" {
+			step.Text += "\n"
+		}
+	case "timeout", "sleep":
+		step.Duration, err = time.ParseDuration(arg)
+	default:
+		err = fmt.Errorf("unknown command %q", op)
+	}
+
+	return step, err
+}
+
+// Run runs the script s, logging each step to log if it is not nil.
+func (e *Expecter) Run(s Script, log io.Writer) error {
+	timeout := DefaultTimeout
+
+	for _, step := range s {
+		if log != nil {
+			fmt.Fprintf(log, "expect: line %d: %s\r\n", step.Line, step)
+		}
+
+		var err error
+
+		switch step.Op {
+		case "expect":
+			_, err = e.Expect(step.Re, timeout)
+		case "send", "sendline":
+			err = e.Send(step.Text)
+		case "timeout":
+			timeout = step.Duration
+		case "sleep":
+			time.Sleep(step.Duration)
+		}
+
+		if err != nil {
+			return fmt.Errorf("line %d: %w", step.Line, err)
+		}
+	}
+
+	return nil
+}
+
+func (s Step) String() string {
+	switch s.Op {
+	case "expect":
+		return fmt.Sprintf("expect %q", s.Re)
+	case "send", "sendline":
+		return fmt.Sprintf("%s %q", s.Op, s.Text)
+	default:
+		return fmt.Sprintf("%s %v", s.Op, s.Duration)
+	}
+}
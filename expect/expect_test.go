@@ -0,0 +1,110 @@
+package expect_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/expect"
+)
+
+// mockGuest behaves like a login prompt on a serial console.
+type mockGuest struct {
+	in chan byte
+	e  *expect.Expecter
+}
+
+func newMockGuest() *mockGuest {
+	g := &mockGuest{in: make(chan byte, 1024)}
+	g.e = expect.New(g)
+
+	go g.loop()
+
+	return g
+}
+
+func (g *mockGuest) GetInputChan() chan<- byte {
+	return g.in
+}
+
+func (g *mockGuest) InjectSerialIRQ() error {
+	return nil
+}
+
+func (g *mockGuest) loop() {
+	_, _ = g.e.Write([]byte("Welcome\r\nlogin: "))
+
+	line := []byte{}
+
+	for b := range g.in {
+		if b != '\n' {
+			line = append(line, b)
+
+			continue
+		}
+
+		switch string(line) {
+		case "root":
+			_, _ = g.e.Write([]byte("\r\nPassword: "))
+		case "secret":
+			_, _ = g.e.Write([]byte("\r\nLast login: never\r\n# "))
+		default:
+			_, _ = g.e.Write([]byte("\r\nLogin incorrect\r\nlogin: "))
+		}
+
+		line = line[:0]
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	s, err := expect.Parse(strings.NewReader(`
+# Log in.
+timeout 5s
+expect login:
+sendline root
+expect "Password: $"
+send "secret\n"
+expect (?m)^# $
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s) != 6 || s[4].Text != "secret\n" || s[0].Line != 3 {
+		t.Fatalf("unexpected script %v", s)
+	}
+
+	g := newMockGuest()
+
+	if err := g.e.Run(s, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpectTimeout(t *testing.T) {
+	t.Parallel()
+
+	s, err := expect.Parse(strings.NewReader("timeout 100ms\nsendline guest\nexpect Password:\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A wrong login gets no password prompt.
+	g := newMockGuest()
+
+	if err := g.e.Run(s, nil); !errors.Is(err, expect.ErrTimeout) || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("got %v, want %v on line 3", err, expect.ErrTimeout)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	t.Parallel()
+
+	for _, script := range []string{"expect (", "timeout soon", "type root", `send "\q"`} {
+		if _, err := expect.Parse(strings.NewReader(script)); !errors.Is(err, expect.ErrScript) {
+			t.Errorf("%q: got %v, want %v", script, err, expect.ErrScript)
+		}
+	}
+}
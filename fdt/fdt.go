@@ -0,0 +1,181 @@
+// Package fdt builds flattened device trees, the DTBs through which an
+// arm64 guest booted without ACPI learns about its memory, CPUs, interrupt
+// controller, timer and devices, see ARM64. A Builder writes the nodes
+// and properties of any tree.
+//
+// refs: https://github.com/devicetree-org/devicetree-specification/releases/download/v0.4/devicetree-specification-v0.4.pdf
+package fdt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The header of a DTB, of version 17 that is compatible back to 16.
+const (
+	magic           = 0xd00dfeed
+	headerSize      = 40
+	version         = 17
+	lastCompVersion = 16
+	memReserveSize  = 16
+	structAlign     = 4
+	beginNodeToken  = 0x1
+	endNodeToken    = 0x2
+	propToken       = 0x3
+	endToken        = 0x9
+)
+
+var ErrNodes = errors.New("nodes not ended as begun")
+
+// Builder writes a tree node by node, depth first: BeginNode, then the
+// properties of the node, then its children, then EndNode.
+type Builder struct {
+	structure []byte
+	strings   []byte
+	offsets   map[string]uint32
+	reserved  [][2]uint64
+	depth     int
+	err       error
+}
+
+// New returns a Builder of an empty tree, whose first node is the root,
+// named "".
+func New() *Builder {
+	return &Builder{offsets: map[string]uint32{}}
+}
+
+func (b *Builder) token(t uint32) {
+	b.structure = appendU32(b.structure, t)
+}
+
+// pad pads the structure block to a 4-byte boundary.
+func (b *Builder) pad() {
+	for len(b.structure)%structAlign != 0 {
+		b.structure = append(b.structure, 0)
+	}
+}
+
+// BeginNode begins the node name, e.g. memory@40000000, a child of the
+// node begun last.
+func (b *Builder) BeginNode(name string) {
+	b.token(beginNodeToken)
+	b.structure = append(append(b.structure, name...), 0)
+	b.pad()
+	b.depth++
+}
+
+// EndNode ends the node begun last.
+func (b *Builder) EndNode() {
+	if b.depth == 0 {
+		b.err = ErrNodes
+
+		return
+	}
+
+	b.token(endNodeToken)
+	b.depth--
+}
+
+// Property adds the property name of value to the node begun last. Names
+// are kept once in the strings block.
+func (b *Builder) Property(name string, value []byte) {
+	off, ok := b.offsets[name]
+	if !ok {
+		off = uint32(len(b.strings))
+		b.offsets[name] = off
+		b.strings = append(append(b.strings, name...), 0)
+	}
+
+	b.token(propToken)
+	b.structure = appendU32(b.structure, uint32(len(value)))
+	b.structure = appendU32(b.structure, off)
+	b.structure = append(b.structure, value...)
+	b.pad()
+}
+
+// PropertyEmpty adds a property without a value, e.g. interrupt-controller.
+func (b *Builder) PropertyEmpty(name string) {
+	b.Property(name, nil)
+}
+
+// PropertyString adds a property of the strings values, e.g. the
+// compatible strings of a device from the most specific.
+func (b *Builder) PropertyString(name string, values ...string) {
+	var v []byte
+	for _, s := range values {
+		v = append(append(v, s...), 0)
+	}
+
+	b.Property(name, v)
+}
+
+// PropertyU32 adds a property of the 32-bit cells values.
+func (b *Builder) PropertyU32(name string, values ...uint32) {
+	v := make([]byte, 0, 4*len(values))
+	for _, c := range values {
+		v = appendU32(v, c)
+	}
+
+	b.Property(name, v)
+}
+
+// PropertyU64 adds a property of values, of two cells each, e.g. the
+// address and size of reg with #address-cells and #size-cells of 2.
+func (b *Builder) PropertyU64(name string, values ...uint64) {
+	v := make([]byte, 0, 8*len(values))
+	for _, c := range values {
+		v = appendU64(v, c)
+	}
+
+	b.Property(name, v)
+}
+
+// Reserve has the guest keep away from size bytes at addr, in the memory
+// reservation block.
+func (b *Builder) Reserve(addr, size uint64) {
+	b.reserved = append(b.reserved, [2]uint64{addr, size})
+}
+
+// Bytes returns the DTB of the tree, whose nodes must all have ended.
+func (b *Builder) Bytes() ([]byte, error) {
+	if b.err != nil || b.depth != 0 {
+		return nil, fmt.Errorf("%w: %d open", ErrNodes, b.depth)
+	}
+
+	reserve := headerSize
+	reserveSize := (len(b.reserved) + 1) * memReserveSize
+	structure := reserve + reserveSize
+	structureSize := len(b.structure) + 4
+	strings := structure + structureSize
+	total := strings + len(b.strings)
+
+	dtb := make([]byte, headerSize, total)
+
+	for i, v := range []uint32{
+		magic, uint32(total), uint32(structure), uint32(strings), uint32(reserve),
+		version, lastCompVersion, 0, uint32(len(b.strings)), uint32(structureSize),
+	} {
+		binary.BigEndian.PutUint32(dtb[4*i:], v)
+	}
+
+	// The reservations end with an empty one.
+	for _, r := range append(b.reserved, [2]uint64{}) {
+		dtb = appendU64(dtb, r[0])
+		dtb = appendU64(dtb, r[1])
+	}
+
+	dtb = append(dtb, b.structure...)
+	dtb = appendU32(dtb, endToken)
+	dtb = append(dtb, b.strings...)
+
+	return dtb, nil
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendU64(b []byte, v uint64) []byte {
+	return appendU32(appendU32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,201 @@
+package fdt_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/fdt"
+)
+
+// node is a node of a DTB, with its properties by name.
+type node struct {
+	name     string
+	props    map[string][]byte
+	children []*node
+}
+
+// parse parses dtb into its tree of nodes.
+func parse(t *testing.T, dtb []byte) *node {
+	t.Helper()
+
+	be := binary.BigEndian
+	if be.Uint32(dtb) != 0xd00dfeed || int(be.Uint32(dtb[4:])) != len(dtb) || be.Uint32(dtb[20:]) != 17 {
+		t.Fatalf("header % x", dtb[:40])
+	}
+
+	structure := dtb[be.Uint32(dtb[8:]):]
+	strs := dtb[be.Uint32(dtb[12:]):]
+
+	var (
+		stack []*node
+		root  *node
+	)
+
+	for off := 0; ; {
+		token := be.Uint32(structure[off:])
+		off += 4
+
+		switch token {
+		case 1:
+			end := off + bytes.IndexByte(structure[off:], 0)
+			n := &node{name: string(structure[off:end]), props: map[string][]byte{}}
+
+			if len(stack) > 0 {
+				p := stack[len(stack)-1]
+				p.children = append(p.children, n)
+			} else {
+				root = n
+			}
+
+			stack = append(stack, n)
+			off = (end + 4) &^ 3
+		case 2:
+			stack = stack[:len(stack)-1]
+		case 3:
+			size, nameoff := be.Uint32(structure[off:]), be.Uint32(structure[off+4:])
+			name := string(strs[nameoff : int(nameoff)+bytes.IndexByte(strs[nameoff:], 0)])
+			stack[len(stack)-1].props[name] = structure[off+8 : off+8+int(size)]
+			off = (off + 8 + int(size) + 3) &^ 3
+		case 9:
+			if len(stack) != 0 {
+				t.Fatalf("%d nodes open at the end", len(stack))
+			}
+
+			return root
+		default:
+			t.Fatalf("token %#x at %#x", token, off-4)
+		}
+	}
+}
+
+func (n *node) child(t *testing.T, prefix string) *node {
+	t.Helper()
+
+	for _, c := range n.children {
+		if strings.HasPrefix(c.name, prefix) {
+			return c
+		}
+	}
+
+	t.Fatalf("%s: no child %s", n.name, prefix)
+
+	return nil
+}
+
+func TestBuilder(t *testing.T) {
+	t.Parallel()
+
+	b := fdt.New()
+	b.Reserve(0x1000, 0x2000)
+	b.BeginNode("")
+	b.PropertyU32("#address-cells", 2)
+	b.BeginNode("a@1")
+	b.PropertyString("compatible", "x,y", "z")
+	b.PropertyU32("#address-cells", 1)
+	b.EndNode()
+
+	if _, err := b.Bytes(); !errors.Is(err, fdt.ErrNodes) {
+		t.Fatalf("got %v, want %v", err, fdt.ErrNodes)
+	}
+
+	b.EndNode()
+
+	dtb, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reservation and the empty one that ends them.
+	if rsv := dtb[binary.BigEndian.Uint32(dtb[16:]):]; binary.BigEndian.Uint64(rsv) != 0x1000 ||
+		binary.BigEndian.Uint64(rsv[8:]) != 0x2000 || binary.BigEndian.Uint64(rsv[24:]) != 0 {
+		t.Fatalf("reservations % x", rsv[:32])
+	}
+
+	// #address-cells is in the strings once.
+	if got := binary.BigEndian.Uint32(dtb[32:]); got != uint32(len("#address-cells\x00compatible\x00")) {
+		t.Fatalf("strings of %d bytes", got)
+	}
+
+	a := parse(t, dtb).child(t, "a@1")
+	if got := a.props["compatible"]; string(got) != "x,y\x00z\x00" {
+		t.Fatalf("compatible %q", got)
+	}
+
+	if got := a.props["#address-cells"]; !bytes.Equal(got, []byte{0, 0, 0, 1}) {
+		t.Fatalf("#address-cells % x", got)
+	}
+
+	b = fdt.New()
+	b.EndNode()
+
+	if _, err := b.Bytes(); !errors.Is(err, fdt.ErrNodes) {
+		t.Fatalf("got %v, want %v", err, fdt.ErrNodes)
+	}
+}
+
+func TestARM64(t *testing.T) {
+	t.Parallel()
+
+	dtb, err := fdt.ARM64(fdt.ARM64Machine{
+		MemoryBase: 0x40000000, MemorySize: 1 << 30,
+		MPIDRs: []uint64{0, 1},
+		GIC: fdt.GIC{
+			Version: fdt.GICv3, DistBase: 0x8000000, DistSize: 0x10000,
+			RedistBase: 0x80a0000, RedistSize: 0xf60000,
+		},
+		VirtioMMIO:  []fdt.VirtioMMIO{{Base: 0xa000000, Size: 0x200, SPI: 16}},
+		Bootargs:    "console=hvc0",
+		InitrdStart: 0x48000000, InitrdEnd: 0x48100000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := parse(t, dtb)
+	u64 := binary.BigEndian.Uint64
+
+	chosen := root.child(t, "chosen")
+	if string(chosen.props["bootargs"]) != "console=hvc0\x00" || u64(chosen.props["linux,initrd-end"]) != 0x48100000 {
+		t.Errorf("chosen %q", chosen.props)
+	}
+
+	if reg := root.child(t, "memory@40000000").props["reg"]; u64(reg) != 0x40000000 || u64(reg[8:]) != 1<<30 {
+		t.Errorf("memory % x", reg)
+	}
+
+	cpus := root.child(t, "cpus")
+	if len(cpus.children) != 2 || u64(cpus.child(t, "cpu@1").props["reg"]) != 1 ||
+		string(cpus.children[0].props["enable-method"]) != "psci\x00" {
+		t.Errorf("cpus %+v", cpus.children)
+	}
+
+	gic := root.child(t, "intc@8000000")
+	if string(gic.props["compatible"]) != "arm,gic-v3\x00" || u64(gic.props["reg"][16:]) != 0x80a0000 ||
+		!bytes.Equal(gic.props["phandle"], root.props["interrupt-parent"]) {
+		t.Errorf("GIC %q", gic.props)
+	}
+
+	// The virtual timer is PPI 11, level-triggered.
+	if irqs := root.child(t, "timer").props["interrupts"]; len(irqs) != 4*12 ||
+		!bytes.Equal(irqs[24:36], []byte{0, 0, 0, 1, 0, 0, 0, 11, 0, 0, 0, 4}) {
+		t.Errorf("timer % x", irqs)
+	}
+
+	if irqs := root.child(t, "virtio_mmio@a000000").props["interrupts"]; !bytes.Equal(irqs,
+		[]byte{0, 0, 0, 0, 0, 0, 0, 16, 0, 0, 0, 1}) {
+		t.Errorf("virtio-mmio % x", irqs)
+	}
+
+	// On a GICv2, the PPIs of the timer go to both CPU interfaces.
+	dtb, err = fdt.ARM64(fdt.ARM64Machine{MPIDRs: []uint64{0, 1}, GIC: fdt.GIC{Version: fdt.GICv2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if irqs := parse(t, dtb).child(t, "timer").props["interrupts"]; binary.BigEndian.Uint32(irqs[8:]) != 0x304 {
+		t.Errorf("GICv2 timer % x", irqs)
+	}
+}
@@ -0,0 +1,170 @@
+package fdt
+
+import (
+	"fmt"
+)
+
+// The tree of an arm64 guest as the virt machine of QEMU has it, with
+// two cells of addresses and sizes. The file name keeps away from the
+// _arm64 suffix, as the tree is built on any host.
+//
+// refs: https://www.kernel.org/doc/Documentation/devicetree/bindings/interrupt-controller/arm,gic-v3.yaml
+// refs: https://www.kernel.org/doc/Documentation/devicetree/bindings/timer/arm,arch_timer.yaml
+const (
+	gicPhandle = 1
+
+	// The cells of an interrupt of the GIC: its type, number and flags.
+	gicSPI          = 0
+	gicPPI          = 1
+	irqEdgeRising   = 1
+	irqLevelHigh    = 4
+	gicV2CPUMaskMax = 8
+
+	// The PPIs of the secure and non-secure physical, virtual and
+	// hypervisor timers that KVM provides, as INTIDs less 16.
+	timerSecurePPI    = 13
+	timerNonSecurePPI = 14
+	timerVirtualPPI   = 11
+	timerHypPPI       = 10
+)
+
+// GIC versions.
+const (
+	GICv2 = 2
+	GICv3 = 3
+)
+
+// GIC is the interrupt controller of an arm64 guest, a GICv3 with its
+// distributor and redistributors, or a GICv2 with its distributor and CPU
+// interface.
+type GIC struct {
+	Version                byte
+	DistBase, DistSize     uint64
+	RedistBase, RedistSize uint64
+	CPUBase, CPUSize       uint64
+}
+
+// VirtioMMIO is a virtio-mmio device of the guest, whose interrupt is the
+// SPI, 0 being INTID 32.
+type VirtioMMIO struct {
+	Base, Size uint64
+	SPI        uint32
+}
+
+// ARM64Machine is what the tree of an arm64 guest describes.
+type ARM64Machine struct {
+	MemoryBase, MemorySize uint64
+	// MPIDRs are those of the vCPUs, which PSCI turns on through HVCs.
+	MPIDRs     []uint64
+	GIC        GIC
+	VirtioMMIO []VirtioMMIO
+	// Bootargs is the kernel command line, and InitrdStart and InitrdEnd
+	// the range of the initrd, none if they are equal.
+	Bootargs               string
+	InitrdStart, InitrdEnd uint64
+}
+
+// ARM64 returns the DTB of m.
+func ARM64(m ARM64Machine) ([]byte, error) {
+	b := New()
+
+	b.BeginNode("")
+	b.PropertyString("compatible", "linux,dummy-virt")
+	b.PropertyString("model", "gokvm")
+	b.PropertyU32("#address-cells", 2)
+	b.PropertyU32("#size-cells", 2)
+	b.PropertyU32("interrupt-parent", gicPhandle)
+
+	b.BeginNode("chosen")
+	b.PropertyString("bootargs", m.Bootargs)
+
+	if m.InitrdEnd > m.InitrdStart {
+		b.PropertyU64("linux,initrd-start", m.InitrdStart)
+		b.PropertyU64("linux,initrd-end", m.InitrdEnd)
+	}
+
+	b.EndNode()
+
+	b.BeginNode(fmt.Sprintf("memory@%x", m.MemoryBase))
+	b.PropertyString("device_type", "memory")
+	b.PropertyU64("reg", m.MemoryBase, m.MemorySize)
+	b.EndNode()
+
+	b.BeginNode("cpus")
+	b.PropertyU32("#address-cells", 2)
+	b.PropertyU32("#size-cells", 0)
+
+	for _, mpidr := range m.MPIDRs {
+		b.BeginNode(fmt.Sprintf("cpu@%x", mpidr))
+		b.PropertyString("device_type", "cpu")
+		b.PropertyString("compatible", "arm,arm-v8")
+		b.PropertyString("enable-method", "psci")
+		b.PropertyU64("reg", mpidr)
+		b.EndNode()
+	}
+
+	b.EndNode()
+
+	b.BeginNode("psci")
+	b.PropertyString("compatible", "arm,psci-1.0", "arm,psci-0.2")
+	b.PropertyString("method", "hvc")
+	b.EndNode()
+
+	gic(b, m.GIC)
+	timer(b, m.GIC, len(m.MPIDRs))
+
+	for _, d := range m.VirtioMMIO {
+		b.BeginNode(fmt.Sprintf("virtio_mmio@%x", d.Base))
+		b.PropertyString("compatible", "virtio,mmio")
+		b.PropertyU64("reg", d.Base, d.Size)
+		b.PropertyU32("interrupts", gicSPI, d.SPI, irqEdgeRising)
+		b.PropertyEmpty("dma-coherent")
+		b.EndNode()
+	}
+
+	b.EndNode()
+
+	return b.Bytes()
+}
+
+func gic(b *Builder, g GIC) {
+	b.BeginNode(fmt.Sprintf("intc@%x", g.DistBase))
+
+	if g.Version >= GICv3 {
+		b.PropertyString("compatible", "arm,gic-v3")
+		b.PropertyU64("reg", g.DistBase, g.DistSize, g.RedistBase, g.RedistSize)
+	} else {
+		b.PropertyString("compatible", "arm,cortex-a15-gic")
+		b.PropertyU64("reg", g.DistBase, g.DistSize, g.CPUBase, g.CPUSize)
+	}
+
+	b.PropertyU32("#interrupt-cells", 3)
+	b.PropertyEmpty("interrupt-controller")
+	b.PropertyU32("phandle", gicPhandle)
+	b.EndNode()
+}
+
+// timer adds the generic timer, whose PPIs go to every vCPU: on a GICv2,
+// the flags of a PPI say which CPU interfaces take it.
+func timer(b *Builder, g GIC, cpus int) {
+	flags := uint32(irqLevelHigh)
+
+	if g.Version < GICv3 {
+		if cpus > gicV2CPUMaskMax {
+			cpus = gicV2CPUMaskMax
+		}
+
+		flags |= (1<<cpus - 1) << 8
+	}
+
+	b.BeginNode("timer")
+	b.PropertyString("compatible", "arm,armv8-timer")
+	b.PropertyU32("interrupts",
+		gicPPI, timerSecurePPI, flags,
+		gicPPI, timerNonSecurePPI, flags,
+		gicPPI, timerVirtualPPI, flags,
+		gicPPI, timerHypPPI, flags,
+	)
+	b.PropertyEmpty("always-on")
+	b.EndNode()
+}
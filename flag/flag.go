@@ -1,29 +1,1045 @@
 package flag
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/hostcheck"
+	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/smbios"
+	"github.com/bobuhiro11/gokvm/term"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+const (
+	// SubcommandBoot boots a guest with an interactive serial console.
+	SubcommandBoot = "boot"
+
+	// SubcommandExec boots a guest, runs a command in it and exits with its exit code.
+	// It implies -ephemeral.
+	SubcommandExec = "exec"
+
+	// SubcommandSnapshot manages the snapshots in a store: list, branch
+	// FROM NAME, delete NAME or gc.
+	SubcommandSnapshot = "snapshot"
+
+	// SubcommandCPUID prints how the CPUID that vCPUs get with the boot
+	// flags differs from what KVM supports and can emulate.
+	SubcommandCPUID = "cpuid"
+
+	// SubcommandProbe prints what the host can run, see package probe.
+	SubcommandProbe = "probe"
+)
+
+var (
+	ErrNoCommand      = errors.New("exec requires a command to run in the guest")
+	ErrUnexpectedArgs = errors.New("unexpected arguments")
+	ErrPMUFilter      = errors.New("only one of -pmu-allow and -pmu-deny can be given")
+	ErrSerialPort     = errors.New("serial port must be given as name=path")
+	ErrSNP            = errors.New("-snp requires -sev")
+	ErrPCIID          = errors.New("PCI IDs must be given as device:key=hex,...")
+	ErrBusLock        = errors.New("bus lock policy must be log, kill or throttle[=N]")
+	ErrSnapshotOp     = errors.New("snapshot takes list, branch FROM NAME, delete NAME or gc")
+	ErrOutput         = errors.New("-output must be text or json")
+	ErrHugePages      = errors.New("-hugepages must be 2M or 1G")
+	ErrMemfd          = errors.New("only one of -memfd and -hugetlbfs can be given")
+	ErrNUMA           = errors.New("-numa takes host NUMA nodes, e.g. 0,1")
+	ErrCPUs           = errors.New("-cpus takes a number of CPUs or a percentage of the host's, e.g. 4 or 50%")
+	ErrOnReset        = errors.New("-on-reset must be exit[=N] or restart")
+	ErrMem            = errors.New("-mem takes a size, e.g. 512M or 2G, or a percentage of the host's memory, e.g. 25%")
+	ErrSandbox        = errors.New("-sandbox takes devices whose backends run in sandboxed helpers: blk")
+	ErrRegion         = errors.New("-region takes ram|rom|shared,gpa=N,size=N[K|M|G][,file=PATH][,readonly][,dirty-log]")
+	ErrFlashTemplate  = errors.New("-flash-template requires -flash")
+	ErrResetVector    = errors.New("-reset-vector requires -linuxboot")
+	ErrFwCfg          = errors.New("-fw-cfg takes name=path, e.g. opt/org.example/config=./config")
+	ErrUART           = errors.New("-com takes N=PATH, N=unix:PATH, N=tcp:[HOST]:PORT or N=pty with N of 2 to 4")
+	ErrConsoleListen  = errors.New("-console-listen takes unix:PATH or tcp:[HOST]:PORT")
+	ErrConsole        = errors.New("only one of -console-pty and -console-listen can be given")
+	ErrConsoleLog     = errors.New("-console-log takes PATH[,size=N[K|M|G]][,keep=N]")
+	ErrDebugExit      = errors.New("-debug-exit takes iobase=N[,iosize=1|2|4][,qemu]")
+	ErrSMBIOS         = errors.New("-smbios takes key=value,... of bios-vendor, bios-version, " +
+		"manufacturer, product, version, serial, sku, family and uuid")
 )
 
-// ParseArgs calls flag.Parse and returns strings for device, kernel, initrd, bootparams, tapIfName, disk, and nCpus.
-func ParseArgs(args []string) (string, string, string, string, string, string, int, error) {
-	kernel := flag.String("k", "./bzImage", "kernel image path")
-	initrd := flag.String("i", "./initrd", "initrd path")
-	nCpus := flag.Int("c", 1, "number of cpus")
-	tapIfName := flag.String("t", "tap", "name of tap interface")
-	disk := flag.String("d", "/dev/zero", "path of disk file (for /dev/vda)")
-	kvmPath := flag.String("D", "/dev/kvm", "path of kvm device")
+// Reset policies.
+const (
+	ResetExit    = "exit"
+	ResetRestart = "restart"
+)
+
+// PMU filter actions.
+const (
+	PMUAllow = "allow"
+	PMUDeny  = "deny"
+)
+
+// Bus lock policies.
+const (
+	BusLockLog      = "log"
+	BusLockThrottle = "throttle"
+	BusLockKill     = "kill"
+
+	// defaultBusLockRate is how many bus locks per second and vCPU a bare
+	// throttle lets through.
+	defaultBusLockRate = 1000
+)
+
+// Args are the parsed command-line arguments.
+type Args struct {
+	Subcommand string
+
+	Dev       string
+	Kernel    string
+	Initrd    string
+	Params    string
+	TapIfName string
+	Disk      string
+	NCPUs     int
+
+	// CPUOvercommit allows more vCPUs than host CPUs.
+	CPUOvercommit bool
+
+	// MemSize is the guest RAM in bytes, 0 for machine.MemSize.
+	MemSize uint64
+	// CPUShare and MemShare, if not 0, are the percentages of the host CPUs
+	// and memory that the guest gets, which Resolve turns into NCPUs and
+	// MemSize.
+	CPUShare, MemShare float64
+
+	// Uroot, if set, are arguments to the u-root builder, e.g. "core boot",
+	// to build the initrd on the fly.
+	Uroot string
+
+	// LinuxBoot is a flash image whose Linux payload is smoke-tested.
+	LinuxBoot string
+	// ResetVector boots the whole LinuxBoot image read-only from its reset
+	// vector, firmware and all, instead of its Linux payload directly.
+	ResetVector bool
+
+	// Coreboot is a coreboot ROM to boot instead of a kernel.
+	Coreboot string
+
+	// Flash is a file backing a CFI flash mapped below the firmware, e.g.
+	// a variable store. If it does not exist, it is created from
+	// FlashTemplate or from the variable store of a unified OVMF.fd.
+	Flash         string
+	FlashTemplate string
+
+	// FwCfgFiles are files that firmware reads from fw_cfg, and FwKernel
+	// a kernel that it boots, with Initrd and Params, as with -kernel of
+	// QEMU.
+	FwCfgFiles []FwCfgFile
+	FwKernel   string
+
+	// PMUAction is PMUAllow or PMUDeny to restrict the performance events
+	// the guest can program to PMUEvents or to all others.
+	PMUAction string
+	PMUEvents []uint64
+
+	// Chipset is a profile of chipset registers for firmware to find,
+	// see package chipset.
+	Chipset string
+
+	// IOMMU puts virtio-blk behind a virtio-iommu, see
+	// machine.AddIOMMU.
+	IOMMU bool
+
+	// Stubs adds SuperIO and EC stand-ins that log the accesses of firmware.
+	Stubs bool
+
+	// SEV, if set, is the AMD secure processor, e.g. /dev/sev, with which
+	// guest memory is encrypted under SEVPolicy, with SEV-SNP if SNP is set.
+	SEV       string
+	SEVPolicy uint
+	SNP       bool
+
+	// BusLock is the policy for bus locks of the guest, BusLockLog,
+	// BusLockThrottle to BusLockRate per second and vCPU, or BusLockKill.
+	BusLock     string
+	BusLockRate int
+
+	// OnReset is what to do when the guest resets, e.g. reboots:
+	// ResetExit with ResetExitCode, or ResetRestart to boot it again.
+	OnReset       string
+	ResetExitCode int
+
+	// Nested lets the guest run VMs of its own.
+	Nested bool
+
+	// SGXEPC is how many MiB of SGX enclave page cache the guest gets
+	// from SGXVEPC, the virtual EPC device.
+	SGXEPC  uint
+	SGXVEPC string
+
+	// SerialPorts are virtio-serial ports bridged to Unix sockets.
+	SerialPorts []SerialPort
+
+	// Regions are memory regions of the guest besides its RAM.
+	Regions []Region
+
+	// Sandbox are the devices whose backends run in sandboxed helper
+	// processes, see package sandbox.
+	Sandbox []string
+
+	// PCIIDs override the IDs that PCI devices report, by device name.
+	PCIIDs map[string]pci.IDs
+
+	// SMBIOS is what the SMBIOS tables of the guest tell about the machine.
+	SMBIOS smbios.Info
+	// ACPI gives the guest ACPI tables, see machine.EnableACPI.
+	ACPI bool
+	// KVMClock gives the guest the kvmclock, see machine.DisableKVMClock.
+	KVMClock bool
+	// UARTs are the serial ports COM2 to COM4 and their backends, see
+	// machine.AddUART.
+	UARTs []UART
+	// Debugcon is the file that gets what the guest writes to the debug
+	// console of Bochs, see machine.SetDebugconOutput.
+	Debugcon string
+	// DebugExit moves the exit port of the guest, unless its Size is 0,
+	// see machine.SetDebugExit.
+	DebugExit DebugExit
+
+	// Expect is a script that drives the serial console, see package
+	// expect.
+	Expect string
+
+	// ConsolePTY puts the serial console on a pseudo-terminal instead of
+	// stdin and stdout.
+	ConsolePTY bool
+	// ConsoleListen is where the serial console listens for connections
+	// instead, unix:PATH or tcp:[HOST]:PORT.
+	ConsoleListen string
+	// ConsoleLog is the log of the serial console, unless its Path is
+	// empty, see package consolelog.
+	ConsoleLog ConsoleLog
+	// ConsoleMode is how the serial console passes escape sequences and
+	// UTF-8 from the guest on to stdout.
+	ConsoleMode term.ConsoleMode
+
+	// NetProfile shapes the traffic of the NIC as on a link with its rate,
+	// latency and loss, see the control command shape.
+	NetProfile virtio.NetProfile
+
+	// Control is a Unix socket that gokvm takes commands on while the
+	// guest runs, see package control.
+	Control string
+	// ControlHTTP is an address to serve the query commands of the
+	// control API on over HTTP, for dashboards, which pages of
+	// ControlHTTPOrigin, if given, may call from elsewhere.
+	ControlHTTP       string
+	ControlHTTPOrigin string
+
+	// DebugSnapshots is the snapshot store where the guest saves
+	// snapshots with machine.DebugSnapshot.
+	DebugSnapshots string
+
+	// HugePages is the size of the huge pages that back guest RAM, 0 for
+	// normal pages, and Hugetlbfs a directory on a hugetlbfs mount to take
+	// them from instead of anonymous memory.
+	HugePages int
+	Hugetlbfs string
+	// Memfd backs guest RAM with a sealed memfd, of huge pages with
+	// HugePages, which can be shared with other processes.
+	Memfd bool
+	// Prefault faults in all of guest RAM at startup.
+	Prefault bool
+	// NUMA are the host nodes of the NUMA nodes of the guest, none for a
+	// guest without NUMA placement.
+	NUMA []int
+	// MemHotplug is how many MiB of RAM a virtio-mem device can add to the
+	// guest at runtime, see the control command resize-memory.
+	MemHotplug uint
+	// Balloon adds a virtio-balloon device, with which the control command
+	// balloon takes memory back from the guest.
+	Balloon bool
+
+	// WorkingSet is how often to scan guest RAM for the pages the guest
+	// uses, 0 for never.
+	WorkingSet time.Duration
+	// PromoteHugePages collapses the regions of guest RAM that the
+	// working set scans find hot into huge pages.
+	PromoteHugePages bool
+
+	// StartupReport prints how long each step took before the guest runs.
+	StartupReport bool
+
+	// Output is the format of the log and events of gokvm, text or json
+	// lines, see package output, which go to the fd OutputFD.
+	Output   string
+	OutputFD int
+
+	// SnapshotDir is the snapshot store of the snapshot subcommand, whose
+	// operation and its arguments are in Command.
+	SnapshotDir string
+
+	// Ephemeral runs the guest to completion and exits with its status.
+	Ephemeral bool
+	Timeout   time.Duration
+	Command   []string
+}
+
+// SerialPort is a virtio-serial port that the guest finds as
+// /dev/virtio-ports/<Name>, bridged to a Unix socket gokvm listens on at Path.
+type SerialPort struct {
+	Name string
+	Path string
+}
+
+// FwCfgFile is a file of -fw-cfg, named Name in fw_cfg and read from Path.
+type FwCfgFile struct {
+	Name string
+	Path string
+}
+
+// UART is a serial port of -com.
+type UART struct {
+	N    int
+	Path string
+}
+
+// ConsoleLog is the log of -console-log, which is rotated once it reaches
+// Size, unless it is 0, keeping Keep logs before it.
+type ConsoleLog struct {
+	Path string
+	Size uint64
+	Keep int
+}
+
+// DebugExit is the exit port of -debug-exit, as that of the isa-debug-exit
+// device of QEMU.
+type DebugExit struct {
+	Port uint16
+	Size int
+	QEMU bool
+}
+
+// Region is a memory region of -region, which main maps with
+// machine.AddMemoryRegion.
+type Region struct {
+	Kind      string
+	GPA, Size uint64
+	File      string
+	ReadOnly  bool
+	DirtyLog  bool
+}
+
+func bootFlags(name string, a *Args) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	fs.StringVar(&a.Kernel, "k", "./bzImage", "kernel image path")
+	fs.StringVar(&a.Initrd, "i", "./initrd", "initrd path")
+	fs.IntVar(&a.NCPUs, "c", 1, "number of cpus")
+	fs.Func("cpus", "number of cpus, or a percentage of the host's, e.g. 50%, rounded for its NUMA nodes", a.cpus)
+	fs.Func("mem", "guest RAM, e.g. 512M or 2G, or a percentage of the host's memory, e.g. 25% (default 1G)", a.mem)
+	fs.BoolVar(&a.CPUOvercommit, "cpu-overcommit", false, "allow more cpus than the host has")
+	fs.StringVar(&a.TapIfName, "t", "tap", "name of tap interface")
+	fs.StringVar(&a.Disk, "d", "/dev/zero", "path of disk file (for /dev/vda)")
+	fs.StringVar(&a.Dev, "D", "/dev/kvm", "path of kvm device")
+	fs.StringVar(&a.Uroot, "uroot", "", `build the initrd with u-root from these arguments, e.g. "core boot"`)
+	fs.StringVar(&a.LinuxBoot, "linuxboot", "",
+		"smoke-test the kernel and initramfs of this LinuxBoot flash image (implies -ephemeral)")
+	fs.BoolVar(&a.ResetVector, "reset-vector", false,
+		"with -linuxboot, boot the whole flash image read-only from its reset vector instead of its payload")
+	fs.StringVar(&a.Coreboot, "coreboot", "", "boot this coreboot ROM from the reset vector instead of a kernel")
+	fs.StringVar(&a.Flash, "flash", "", "file backing a CFI flash with 4KiB sectors right below the firmware")
+	fs.StringVar(&a.FlashTemplate, "flash-template", "",
+		"create the -flash file as a copy of this one, e.g. OVMF_VARS.fd, if it does not exist")
+	fs.Func("fw-cfg", "name=path of a file for the firmware to read from fw_cfg, e.g. opt/org.example/config; repeatable",
+		a.fwCfg)
+	fs.StringVar(&a.FwKernel, "fw-kernel", "",
+		"with firmware as -k, have it boot this kernel with -i and -p, handed over through fw_cfg")
+	fs.StringVar(&a.Chipset, "chipset", "", "JSON profile of the chipset registers the firmware expects, e.g. of a PCH")
+	fs.BoolVar(&a.IOMMU, "iommu", false,
+		"put virtio-blk behind a virtio-iommu that the guest maps its DMA with, described in the VIOT of -acpi")
+	fs.BoolVar(&a.Stubs, "stubs", false, "add logging SuperIO (0x2e, 0x4e) and EC (0x62, 0x66) stubs for firmware bring-up")
+	fs.BoolVar(&a.StartupReport, "startup-report", false,
+		"print to stderr where the time goes before the guest runs, against a 10ms budget")
+	fs.StringVar(&a.Output, "output", "text",
+		"format of the log and the lifecycle events of gokvm: text, or json for one JSON object per line")
+	fs.IntVar(&a.OutputFD, "output-fd", 2, "file descriptor that -output goes to, stderr by default")
+	fs.Func("pmu-allow", "comma-separated PMU events (event select | umask<<8) the guest may program; empty for none",
+		a.pmuFilter(PMUAllow))
+	fs.Func("pmu-deny", "comma-separated PMU events (event select | umask<<8) the guest may not program",
+		a.pmuFilter(PMUDeny))
+	fs.StringVar(&a.SEV, "sev", "", "encrypt guest memory with AMD SEV through this secure processor, e.g. /dev/sev")
+	fs.UintVar(&a.SEVPolicy, "sev-policy", 0, "SEV guest policy, e.g. 0x1 to disallow debugging, or 0x30000 for SNP")
+	fs.BoolVar(&a.SNP, "snp", false, "launch an SEV-SNP guest with -sev, whose RAM is private memory of a guest_memfd")
+	fs.Func("bus-lock", "what to do about bus locks of the guest: log, kill, "+
+		"or throttle[=N] to N per second and vCPU (default 1000)", a.busLock)
+	a.OnReset = ResetExit
+	fs.Func("on-reset", "what to do when the guest resets or reboots: exit[=N] with status N (default 0), "+
+		"or restart to boot it again (default exit)", a.onReset)
+	fs.BoolVar(&a.Nested, "nested", false, "let the guest run VMs of its own (needs kvm_intel or kvm_amd nested=1)")
+	fs.UintVar(&a.SGXEPC, "sgx-epc", 0, "MiB of SGX enclave page cache for the guest to run enclaves in")
+	fs.StringVar(&a.SGXVEPC, "sgx-vepc", "/dev/sgx_vepc", "virtual EPC device that -sgx-epc takes the EPC from")
+	fs.Func("serial-port", "name=path of a virtio-serial port bridged to a Unix socket gokvm listens on; repeatable",
+		a.serialPort)
+	fs.Func("region", "kind,gpa=N,size=N[K|M|G][,file=PATH][,readonly][,dirty-log] of a memory region besides RAM "+
+		"in a slot of its own, of kind ram, rom with the contents of file, or shared with file or a memfd; repeatable",
+		a.region)
+	fs.Func("sandbox", "comma-separated devices whose backends run in helper processes confined by seccomp, "+
+		"so that a bug in them cannot take over gokvm; experimental, and only blk for now", a.sandbox)
+	fs.Func("smbios", "key=value,... of the SMBIOS tables, e.g. serial=ds=nocloud or uuid=..., "+
+		"of bios-vendor, bios-version, manufacturer, product, version, serial, sku, family and uuid; repeatable",
+		a.smbios)
+	fs.BoolVar(&a.ACPI, "acpi", false,
+		"give the guest ACPI tables of its CPUs, IOAPIC and power management, for it to power off through them; "+
+			"drop noapic from -p for Linux to use them")
+	fs.BoolVar(&a.KVMClock, "kvmclock", true,
+		"give the guest the paravirtual kvmclock, which keeps its time across pauses and tells it the TSC frequency; "+
+			"-kvmclock=false leaves it the TSC and PIT")
+	fs.Func("com", "N=PATH of serial port COM2, COM3 or COM4 (ttyS1 to ttyS3), which writes to the file PATH, "+
+		"or with N=unix:PATH, N=tcp:[HOST]:PORT or N=pty bridges to a Unix socket or TCP port gokvm listens on, "+
+		"e.g. for kgdb, or to a pseudo-terminal; repeatable", a.uart)
+	fs.BoolVar(&a.ConsolePTY, "console-pty", false,
+		"put the serial console on a pseudo-terminal whose path gokvm prints, for screen or minicom to attach to, "+
+			"instead of on stdin and stdout")
+	fs.Func("console-log", "PATH[,size=N[K|M|G]][,keep=N] to log the serial console to, each line after the seconds "+
+		"since the guest started, rotated once it reaches size and when gokvm starts, "+
+		"keeping keep logs before it (default 5)", a.consoleLog)
+	fs.Func("console-listen", "unix:PATH or tcp:[HOST]:PORT to listen on for connections to the serial console, "+
+		"one at a time and each taking the place of the last, instead of stdin and stdout", a.consoleListen)
+	fs.StringVar(&a.Debugcon, "debugcon", "",
+		"file to write what the guest writes to the debug console at port 0xe9 to, e.g. the log of SeaBIOS or OVMF")
+	fs.Func("debug-exit", "iobase=N[,iosize=1|2|4][,qemu] of the port the guest writes its exit status to "+
+		"instead of 0xf4, as with -device isa-debug-exit of QEMU; qemu makes the status value<<1|1 as QEMU does",
+		a.debugExit)
+	fs.Func("pci-id", "device:key=hex,... to override the IDs of the PCI device bridge, net, blk, console, mem or balloon, "+
+		"with keys vendor, device, subsystem-vendor, subsystem, revision and class; repeatable", a.pciID)
+	fs.StringVar(&a.Expect, "expect", "",
+		"script of expect, send, sendline, timeout and sleep lines that drives the serial console, e.g. to log in")
+	fs.Func("console-mode", "passthrough to pass escape sequences of the serial console on, e.g. for TUIs, "+
+		"or sanitize to drop them and control characters, e.g. for logs (default passthrough)", a.consoleMode)
+	fs.Func("net-profile", "shape the traffic of the NIC in each direction as on a link of "+
+		"rate=N[k|m|g]bit,latency=D,jitter=D,loss=F,reorder=F, e.g. latency=50ms,loss=0.01 for a WAN", a.netProfile)
+	fs.StringVar(&a.Control, "control", "", "Unix socket to listen on for commands, e.g. to inject device faults")
+	fs.StringVar(&a.ControlHTTP, "control-http", "",
+		"address to serve the query-* control commands on over HTTP with JSON, e.g. localhost:8080")
+	fs.StringVar(&a.ControlHTTPOrigin, "control-http-origin", "",
+		"origin of other web pages allowed to call -control-http, \"*\" for any (default none)")
+	fs.StringVar(&a.DebugSnapshots, "debug-snapshots", "",
+		"snapshot store where the guest saves snapshots by writing 3 to debug port 0xf5")
+	fs.Func("hugepages", "back guest RAM with huge pages of this size, 2M or 1G, which the host must have reserved",
+		a.hugePages)
+	fs.StringVar(&a.Hugetlbfs, "hugetlbfs", "", "take the huge pages of guest RAM from a file in this hugetlbfs directory")
+	fs.BoolVar(&a.Memfd, "memfd", false, "back guest RAM with a memfd whose size is sealed, e.g. to share it")
+	fs.Func("numa", "split the guest into a NUMA node on each of these host nodes, e.g. 0,1, "+
+		"binding its RAM and pinning its vCPUs there", a.numa)
+	fs.UintVar(&a.MemHotplug, "mem-hotplug", 0,
+		"MiB of RAM, a multiple of 2, that a virtio-mem device can plug into the guest with the control command resize-memory")
+	fs.BoolVar(&a.Balloon, "balloon", false,
+		"add a virtio-balloon device, with which the control command balloon takes memory back from the guest")
+	fs.BoolVar(&a.Prefault, "prefault", false,
+		"fault in all of guest RAM at startup, for guests that must not take page faults at boot")
+	fs.DurationVar(&a.WorkingSet, "working-set", 0,
+		"scan guest RAM for hot and cold pages this often, see the control command wss (needs page_idle and root)")
+	fs.BoolVar(&a.PromoteHugePages, "promote-huge-pages", false,
+		"collapse 2MiB regions of guest RAM that -working-set finds hot into huge pages (needs Linux 6.1)")
+	fs.BoolVar(&a.Ephemeral, "ephemeral", false,
+		"exit with the status the guest writes to port 0xf4, or of the command given after the flags")
+	fs.DurationVar(&a.Timeout, "T", 5*time.Minute, "wall-clock timeout for exec and -ephemeral")
 
 	//  refs: commit 1621292e73770aabbc146e72036de5e26f901e86 in kvmtool
-	params := flag.String("p", `console=ttyS0 earlyprintk=serial noapic noacpi notsc `+
+	fs.StringVar(&a.Params, "p", `console=ttyS0 earlyprintk=serial noapic noacpi notsc `+
 		`debug apic=debug show_lapic=all mitigations=off lapic tsc_early_khz=2000 `+
 		`dyndbg="file arch/x86/kernel/smpboot.c +plf ; file drivers/net/virtio_net.c +plf" pci=realloc=off `+
 		`virtio_pci.force_legacy=1 rdinit=/init init=/init`, "kernel command-line parameters")
 
-	flag.Parse()
+	return fs
+}
+
+func (a *Args) pmuFilter(action string) func(string) error {
+	return func(s string) error {
+		a.PMUAction = action
+
+		for _, f := range strings.Split(s, ",") {
+			if f == "" {
+				continue
+			}
+
+			event, err := strconv.ParseUint(f, 0, 64)
+			if err != nil {
+				return err
+			}
+
+			a.PMUEvents = append(a.PMUEvents, event)
+		}
+
+		return nil
+	}
+}
+
+func (a *Args) numa(s string) error {
+	a.NUMA = nil
+
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%w: %q", ErrNUMA, s)
+		}
+
+		a.NUMA = append(a.NUMA, n)
+	}
+
+	return nil
+}
+
+// parsePercent parses a percentage such as "50%" from above 0 to 100.
+func parsePercent(s string) (float64, bool) {
+	if !strings.HasSuffix(s, "%") {
+		return 0, false
+	}
+
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+
+	return p, err == nil && p > 0 && p <= 100
+}
+
+func (a *Args) cpus(s string) error {
+	if strings.HasSuffix(s, "%") {
+		p, ok := parsePercent(s)
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrCPUs, s)
+		}
+
+		a.CPUShare = p
+
+		return nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return fmt.Errorf("%w: %q", ErrCPUs, s)
+	}
+
+	a.NCPUs, a.CPUShare = n, 0
+
+	return nil
+}
+
+func (a *Args) mem(s string) error {
+	if strings.HasSuffix(s, "%") {
+		p, ok := parsePercent(s)
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrMem, s)
+		}
+
+		a.MemShare = p
+
+		return nil
+	}
+
+	n, ok := parseSize(s)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrMem, s)
+	}
+
+	a.MemSize, a.MemShare = n, 0
+
+	return nil
+}
+
+// parseSize parses a non-zero size of bytes, or of K, M or G.
+func parseSize(s string) (uint64, bool) {
+	shift := 0
+
+	switch strings.TrimLeft(s, "0123456789") {
+	case "K", "k":
+		shift = 10
+	case "M", "m":
+		shift = 20
+	case "G", "g":
+		shift = 30
+	}
+
+	if shift != 0 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 || n<<shift>>shift != n {
+		return 0, false
+	}
+
+	return n << shift, true
+}
+
+// Resolve turns the shares of the host of -cpus and -mem into NCPUs and
+// MemSize for host h.
+func (a *Args) Resolve(h hostcheck.Host) {
+	if a.CPUShare != 0 {
+		a.NCPUs = h.CPUShare(a.CPUShare)
+	}
+
+	if a.MemShare != 0 {
+		a.MemSize = h.MemShare(a.MemShare)
+	}
+}
+
+func (a *Args) consoleMode(s string) error {
+	m, err := term.ParseConsoleMode(s)
+	if err != nil {
+		return err
+	}
+
+	a.ConsoleMode = m
+
+	return nil
+}
+
+func (a *Args) netProfile(s string) error {
+	p, err := virtio.ParseNetProfile(s)
+	if err != nil {
+		return err
+	}
+
+	a.NetProfile = p
+
+	return nil
+}
+
+func (a *Args) hugePages(s string) error {
+	switch strings.ToUpper(s) {
+	case "2M", "2MB", "2MIB":
+		a.HugePages = 2 << 20
+	case "1G", "1GB", "1GIB":
+		a.HugePages = 1 << 30
+	default:
+		return fmt.Errorf("%w: %q", ErrHugePages, s)
+	}
+
+	return nil
+}
+
+func (a *Args) busLock(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+
+	switch {
+	case s == BusLockLog || s == BusLockKill:
+	case kv[0] != BusLockThrottle:
+		return fmt.Errorf("%w: %q", ErrBusLock, s)
+	case len(kv) == 1:
+		a.BusLockRate = defaultBusLockRate
+	default:
+		rate, err := strconv.Atoi(kv[1])
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("%w: %q", ErrBusLock, s)
+		}
+
+		a.BusLockRate = rate
+	}
+
+	a.BusLock = kv[0]
+
+	return nil
+}
+
+func (a *Args) onReset(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+
+	switch {
+	case s == ResetRestart:
+		a.ResetExitCode = 0
+	case kv[0] != ResetExit:
+		return fmt.Errorf("%w: %q", ErrOnReset, s)
+	case len(kv) == 1:
+		a.ResetExitCode = 0
+	default:
+		code, err := strconv.Atoi(kv[1])
+		if err != nil || code < 0 || code > 255 {
+			return fmt.Errorf("%w: %q", ErrOnReset, s)
+		}
+
+		a.ResetExitCode = code
+	}
+
+	a.OnReset = kv[0]
+
+	return nil
+}
+
+func (a *Args) serialPort(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("%w: %q", ErrSerialPort, s)
+	}
+
+	a.SerialPorts = append(a.SerialPorts, SerialPort{Name: kv[0], Path: kv[1]})
+
+	return nil
+}
+
+func (a *Args) fwCfg(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("%w: %q", ErrFwCfg, s)
+	}
+
+	a.FwCfgFiles = append(a.FwCfgFiles, FwCfgFile{Name: kv[0], Path: kv[1]})
+
+	return nil
+}
+
+func (a *Args) sandbox(s string) error {
+	a.Sandbox = nil
+
+	for _, d := range strings.Split(s, ",") {
+		if d != "blk" {
+			return fmt.Errorf("%w: %q", ErrSandbox, s)
+		}
+
+		a.Sandbox = append(a.Sandbox, d)
+	}
+
+	return nil
+}
+
+func (a *Args) region(s string) error {
+	fields := strings.Split(s, ",")
+	r := Region{Kind: fields[0]}
+	gpa, size := false, false
+
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+
+		var ok bool
+
+		switch {
+		case kv[0] == "gpa" && len(kv) == 2:
+			n, err := strconv.ParseUint(kv[1], 0, 64)
+			r.GPA, ok, gpa = n, err == nil, true
+		case kv[0] == "size" && len(kv) == 2:
+			r.Size, ok = parseSize(kv[1])
+			size = true
+		case kv[0] == "file" && len(kv) == 2:
+			r.File, ok = kv[1], kv[1] != ""
+		case f == "readonly":
+			r.ReadOnly, ok = true, true
+		case f == "dirty-log":
+			r.DirtyLog, ok = true, true
+		}
+
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrRegion, s)
+		}
+	}
+
+	switch {
+	case r.Kind != "ram" && r.Kind != "rom" && r.Kind != "shared", !gpa, !size:
+		return fmt.Errorf("%w: %q", ErrRegion, s)
+	case r.Kind == "rom" && r.File == "", r.Kind == "ram" && r.File != "":
+		return fmt.Errorf("%w: %q", ErrRegion, s)
+	}
+
+	a.Regions = append(a.Regions, r)
+
+	return nil
+}
+
+func (a *Args) uart(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[1] == "" || kv[1] == "unix:" || kv[1] == "tcp:" {
+		return fmt.Errorf("%w: %q", ErrUART, s)
+	}
+
+	n, err := strconv.Atoi(kv[0])
+	if err != nil || n < 2 || n > 4 {
+		return fmt.Errorf("%w: %q", ErrUART, s)
+	}
+
+	for _, u := range a.UARTs {
+		if u.N == n {
+			return fmt.Errorf("%w: COM%d given twice", ErrUART, n)
+		}
+	}
+
+	a.UARTs = append(a.UARTs, UART{N: n, Path: kv[1]})
+
+	return nil
+}
+
+func (a *Args) consoleListen(s string) error {
+	if !strings.HasPrefix(s, "unix:") && !strings.HasPrefix(s, "tcp:") || s == "unix:" || s == "tcp:" {
+		return fmt.Errorf("%w: %q", ErrConsoleListen, s)
+	}
+
+	a.ConsoleListen = s
+
+	return nil
+}
+
+func (a *Args) consoleLog(s string) error {
+	fields := strings.Split(s, ",")
+	l := ConsoleLog{Path: fields[0], Keep: 5}
+
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+
+		var ok bool
+
+		switch {
+		case kv[0] == "size" && len(kv) == 2:
+			l.Size, ok = parseSize(kv[1])
+		case kv[0] == "keep" && len(kv) == 2:
+			n, err := strconv.Atoi(kv[1])
+			l.Keep, ok = n, err == nil && n >= 0
+		}
+
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrConsoleLog, s)
+		}
+	}
+
+	if l.Path == "" {
+		return fmt.Errorf("%w: %q", ErrConsoleLog, s)
+	}
+
+	a.ConsoleLog = l
+
+	return nil
+}
+
+func (a *Args) debugExit(s string) error {
+	d := DebugExit{Size: 1}
+	iobase := false
+
+	for _, f := range strings.Split(s, ",") {
+		kv := strings.SplitN(f, "=", 2)
+
+		var ok bool
+
+		switch {
+		case kv[0] == "iobase" && len(kv) == 2:
+			n, err := strconv.ParseUint(kv[1], 0, 16)
+			d.Port, ok, iobase = uint16(n), err == nil, true
+		case kv[0] == "iosize" && len(kv) == 2:
+			n, err := strconv.Atoi(kv[1])
+			d.Size, ok = n, err == nil && (n == 1 || n == 2 || n == 4)
+		case f == "qemu":
+			d.QEMU, ok = true, true
+		}
+
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrDebugExit, s)
+		}
+	}
+
+	if !iobase || int(d.Port)+d.Size > 0x10000 {
+		return fmt.Errorf("%w: %q", ErrDebugExit, s)
+	}
+
+	a.DebugExit = d
+
+	return nil
+}
+
+func (a *Args) smbios(s string) error {
+	for _, f := range strings.Split(s, ",") {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%w: %q", ErrSMBIOS, f)
+		}
+
+		v := kv[1]
+
+		switch kv[0] {
+		case "bios-vendor":
+			a.SMBIOS.BIOSVendor = v
+		case "bios-version":
+			a.SMBIOS.BIOSVersion = v
+		case "manufacturer":
+			a.SMBIOS.Manufacturer = v
+		case "product":
+			a.SMBIOS.Product = v
+		case "version":
+			a.SMBIOS.Version = v
+		case "serial":
+			a.SMBIOS.Serial = v
+		case "sku":
+			a.SMBIOS.SKU = v
+		case "family":
+			a.SMBIOS.Family = v
+		case "uuid":
+			u, err := smbios.ParseUUID(v)
+			if err != nil {
+				return err
+			}
+
+			a.SMBIOS.UUID = u
+		default:
+			return fmt.Errorf("%w: %q", ErrSMBIOS, f)
+		}
+	}
+
+	return nil
+}
+
+func (a *Args) pciID(s string) error {
+	dev := strings.SplitN(s, ":", 2)
+	if len(dev) != 2 || dev[0] == "" || dev[1] == "" {
+		return fmt.Errorf("%w: %q", ErrPCIID, s)
+	}
+
+	ids := a.PCIIDs[dev[0]]
+
+	for _, f := range strings.Split(dev[1], ",") {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%w: %q", ErrPCIID, f)
+		}
+
+		bits := map[string]int{
+			"vendor": 16, "device": 16, "subsystem-vendor": 16, "subsystem": 16, "revision": 8, "class": 24,
+		}[kv[0]]
+		if bits == 0 {
+			return fmt.Errorf("%w: %q", ErrPCIID, f)
+		}
+
+		v, err := strconv.ParseUint(strings.TrimPrefix(kv[1], "0x"), 16, bits)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrPCIID, err)
+		}
+
+		switch kv[0] {
+		case "vendor":
+			ids.VendorID = uint16(v)
+		case "device":
+			ids.DeviceID = uint16(v)
+		case "subsystem-vendor":
+			ids.SubsystemVendorID = uint16(v)
+		case "subsystem":
+			ids.SubsystemID = uint16(v)
+		case "revision":
+			ids.RevisionID = uint8(v)
+		case "class":
+			ids.ClassCode = uint32(v)
+		}
+	}
+
+	if a.PCIIDs == nil {
+		a.PCIIDs = map[string]pci.IDs{}
+	}
+
+	a.PCIIDs[dev[0]] = ids
+
+	return nil
+}
+
+func (a *Args) parseSnapshot(args []string) error {
+	fs := flag.NewFlagSet(SubcommandSnapshot, flag.ContinueOnError)
+	fs.StringVar(&a.SnapshotDir, "dir", "./snapshots", "snapshot store directory")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a.Command = fs.Args()
+
+	arity := map[string]int{"list": 0, "branch": 2, "delete": 1, "gc": 0}
+	if n, ok := arity[fs.Arg(0)]; !ok || fs.NArg() != n+1 {
+		return fmt.Errorf("%w: %q", ErrSnapshotOp, fs.Args())
+	}
+
+	return nil
+}
+
+// ParseArgs parses the command line, args[0] being the program name.
+// The first argument may name a subcommand; without one, boot is assumed.
+//
+//	gokvm [boot] [flags]
+//	gokvm [boot] -ephemeral [flags] [[--] command [args...]]
+//	gokvm exec [flags] [--] command [args...]
+//	gokvm snapshot [-dir dir] list|branch FROM NAME|delete NAME|gc
+//	gokvm cpuid [flags]
+//	gokvm probe [-D path]
+func ParseArgs(args []string) (*Args, error) {
+	a := &Args{Subcommand: SubcommandBoot}
+	args = args[1:]
+
+	subcommands := map[string]bool{
+		SubcommandBoot: true, SubcommandExec: true, SubcommandSnapshot: true, SubcommandCPUID: true,
+		SubcommandProbe: true,
+	}
+
+	if len(args) > 0 && subcommands[args[0]] {
+		a.Subcommand = args[0]
+		args = args[1:]
+	}
+
+	if a.Subcommand == SubcommandSnapshot {
+		if err := a.parseSnapshot(args); err != nil {
+			return nil, err
+		}
+
+		return a, nil
+	}
+
+	fs := bootFlags(a.Subcommand, a)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if set["pmu-allow"] && set["pmu-deny"] {
+		return nil, ErrPMUFilter
+	}
+
+	if a.SNP && a.SEV == "" {
+		return nil, ErrSNP
+	}
+
+	if a.FlashTemplate != "" && a.Flash == "" {
+		return nil, ErrFlashTemplate
+	}
+
+	if a.ResetVector && a.LinuxBoot == "" {
+		return nil, ErrResetVector
+	}
+
+	if a.Memfd && a.Hugetlbfs != "" {
+		return nil, ErrMemfd
+	}
+
+	if a.ConsolePTY && a.ConsoleListen != "" {
+		return nil, ErrConsole
+	}
+
+	if a.Output != "text" && a.Output != "json" {
+		return nil, fmt.Errorf("%w: %q", ErrOutput, a.Output)
+	}
+
+	if a.LinuxBoot != "" {
+		a.Ephemeral = true
+	}
+
+	switch {
+	case a.Subcommand == SubcommandExec:
+		a.Ephemeral = true
+
+		a.Command = fs.Args()
+		if len(a.Command) == 0 {
+			return nil, ErrNoCommand
+		}
+	case a.Ephemeral:
+		a.Command = fs.Args()
 
-	if err := flag.CommandLine.Parse(args[1:]); err != nil {
-		return "", "", "", "", "", "", 0, err
+		// Without a command, a LinuxBoot smoke test passes once the shell answers.
+		if a.LinuxBoot != "" && len(a.Command) == 0 {
+			a.Command = []string{"true"}
+		}
+	default:
+		if fs.NArg() != 0 {
+			return nil, fmt.Errorf("%w for %s: %q", ErrUnexpectedArgs, a.Subcommand, fs.Args())
+		}
 	}
 
-	return *kvmPath, *kernel, *initrd, *params, *tapIfName, *disk, *nCpus, nil
+	return a, nil
 }
@@ -1,9 +1,15 @@
 package flag_test
 
 import (
+	"errors"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/hostcheck"
+	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/term"
 )
 
 func TestParseArg(t *testing.T) {
@@ -21,40 +27,785 @@ func TestParseArg(t *testing.T) {
 		"tap_if_name",
 		"-c",
 		"2",
+		"-cpu-overcommit",
 		"-d",
 		"disk_path",
+		"-working-set",
+		"10s",
+		"-expect",
+		"login.expect",
+		"-debug-snapshots",
+		"/tmp/debug",
 	}
 
-	kvmPath, kernel, initrd, params, tapIfName, disk, nCpus, err := flag.ParseArgs(args)
+	a, err := flag.ParseArgs(args)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if kvmPath != "/dev/kvm" {
+	if a.Subcommand != flag.SubcommandBoot {
+		t.Error("invalid subcommand")
+	}
+
+	if a.Dev != "/dev/kvm" {
 		t.Error("invalid kvm  path")
 	}
 
-	if kernel != "kernel_path" {
+	if a.Kernel != "kernel_path" {
 		t.Error("invalid kernel image path")
 	}
 
-	if initrd != "initrd_path" {
+	if a.Initrd != "initrd_path" {
 		t.Error("invalid initrd path")
 	}
 
-	if params != "params" {
+	if a.Params != "params" {
 		t.Error("invalid kernel command-line parameters")
 	}
 
-	if tapIfName != "tap_if_name" {
+	if a.TapIfName != "tap_if_name" {
 		t.Error("invalid name of tap interface")
 	}
 
-	if disk != "disk_path" {
+	if a.Disk != "disk_path" {
 		t.Error("invalid path of disk file")
 	}
 
-	if nCpus != 2 {
+	if a.NCPUs != 2 || !a.CPUOvercommit {
 		t.Error("invalid number of vcpus")
 	}
+
+	if a.WorkingSet != 10*time.Second {
+		t.Error("invalid working set interval")
+	}
+
+	if a.Expect != "login.expect" {
+		t.Error("invalid expect script")
+	}
+
+	if a.DebugSnapshots != "/tmp/debug" {
+		t.Error("invalid debug snapshot store")
+	}
+}
+
+func TestParseArgExec(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"exec",
+		"-k",
+		"kernel_path",
+		"-T",
+		"30s",
+		"--",
+		"ls",
+		"-l",
+		"/",
+	}
+
+	a, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Subcommand != flag.SubcommandExec {
+		t.Error("invalid subcommand")
+	}
+
+	if a.Kernel != "kernel_path" {
+		t.Error("invalid kernel image path")
+	}
+
+	if !a.Ephemeral {
+		t.Error("exec must be ephemeral")
+	}
+
+	if a.Timeout != 30*time.Second {
+		t.Error("invalid timeout")
+	}
+
+	if len(a.Command) != 3 || a.Command[0] != "ls" || a.Command[2] != "/" {
+		t.Errorf("invalid command: %q", a.Command)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "exec"}); !errors.Is(err, flag.ErrNoCommand) {
+		t.Errorf("exec without command: got %v, want %v", err, flag.ErrNoCommand)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "boot", "ls"}); !errors.Is(err, flag.ErrUnexpectedArgs) {
+		t.Errorf("boot with command: got %v, want %v", err, flag.ErrUnexpectedArgs)
+	}
+}
+
+func TestParseArgEphemeral(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-ephemeral", "-T", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.Ephemeral || a.Timeout != time.Minute || len(a.Command) != 0 {
+		t.Errorf("invalid args: %+v", a)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-ephemeral", "/bin/true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a.Command) != 1 || a.Command[0] != "/bin/true" {
+		t.Errorf("invalid command: %q", a.Command)
+	}
+}
+
+func TestParseArgLinuxBoot(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-linuxboot", "flash.rom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.LinuxBoot != "flash.rom" || !a.Ephemeral {
+		t.Errorf("invalid args: %+v", a)
+	}
+
+	if len(a.Command) != 1 || a.Command[0] != "true" {
+		t.Errorf("invalid command: %q", a.Command)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-linuxboot", "flash.rom", "-reset-vector"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.ResetVector || !a.Ephemeral {
+		t.Errorf("invalid args: %+v", a)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-reset-vector"}); !errors.Is(err, flag.ErrResetVector) {
+		t.Errorf("got %v, want %v", err, flag.ErrResetVector)
+	}
+
+	a, err = flag.ParseArgs([]string{
+		"gokvm", "-coreboot", "coreboot.rom", "-flash", "vars.fd", "-stubs", "-chipset", "pch.json", "-startup-report",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Coreboot != "coreboot.rom" || a.Flash != "vars.fd" || !a.Stubs || a.Chipset != "pch.json" ||
+		!a.StartupReport || a.Ephemeral {
+		t.Errorf("invalid args: %+v", a)
+	}
+
+	a, err = flag.ParseArgs([]string{
+		"gokvm", "-k", "OVMF_CODE.fd", "-flash", "nvram.fd", "-flash-template", "OVMF_VARS.secboot.fd",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Flash != "nvram.fd" || a.FlashTemplate != "OVMF_VARS.secboot.fd" {
+		t.Errorf("invalid args: %+v", a)
+	}
+
+	a, err = flag.ParseArgs([]string{
+		"gokvm", "-k", "OVMF.fd", "-fw-kernel", "bzImage", "-fw-cfg", "opt/org.example/config=./a=b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.FwKernel != "bzImage" || len(a.FwCfgFiles) != 1 ||
+		a.FwCfgFiles[0] != (flag.FwCfgFile{Name: "opt/org.example/config", Path: "./a=b"}) {
+		t.Errorf("invalid args: %+v", a)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-fw-cfg", "opt/org.example/config"}); err == nil {
+		t.Error("-fw-cfg without a path")
+	}
+}
+
+func TestParseArgSMBIOS(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{
+		"gokvm", "-smbios", "serial=ds=nocloud;s=http://10.0.0.1:8000/,product=test",
+		"-smbios", "uuid=4c4c4544-0000-1010-8000-b2c04f4d4e31", "-acpi", "-kvmclock=false",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.SMBIOS.Serial != "ds=nocloud;s=http://10.0.0.1:8000/" || a.SMBIOS.Product != "test" ||
+		a.SMBIOS.UUID[0] != 0x44 || a.SMBIOS.UUID[15] != 0x31 {
+		t.Errorf("invalid SMBIOS: %+v", a.SMBIOS)
+	}
+
+	if !a.ACPI || a.KVMClock {
+		t.Errorf("-acpi %v, -kvmclock %v", a.ACPI, a.KVMClock)
+	}
+
+	for _, s := range []string{"asset=1", "serial", "uuid=1"} {
+		if _, err := flag.ParseArgs([]string{"gokvm", "-smbios", s}); err == nil {
+			t.Errorf("-smbios %s", s)
+		}
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-flash-template", "OVMF_VARS.fd"}); !errors.Is(err, flag.ErrFlashTemplate) {
+		t.Errorf("got %v, want %v", err, flag.ErrFlashTemplate)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-iommu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.IOMMU {
+		t.Errorf("invalid args: %+v", a)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-uroot", "core boot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Uroot != "core boot" || a.Ephemeral {
+		t.Errorf("invalid args: %+v", a)
+	}
+}
+
+func TestParseArgPMU(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-pmu-deny", "0x3c,0xc0", "-pmu-deny", "0x2e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.PMUAction != flag.PMUDeny || len(a.PMUEvents) != 3 || a.PMUEvents[1] != 0xc0 || a.PMUEvents[2] != 0x2e {
+		t.Errorf("invalid PMU filter: %s %#x", a.PMUAction, a.PMUEvents)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-pmu-allow", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.PMUAction != flag.PMUAllow || len(a.PMUEvents) != 0 {
+		t.Errorf("invalid PMU filter: %s %#x", a.PMUAction, a.PMUEvents)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-pmu-allow", "0x3c", "-pmu-deny", "0xc0"}); !errors.Is(err, flag.ErrPMUFilter) {
+		t.Errorf("got %v, want %v", err, flag.ErrPMUFilter)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-pmu-allow", "cycles"}); err == nil {
+		t.Error("invalid event: got nil, want error")
+	}
+}
+
+func TestParseArgSerialPort(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{
+		"gokvm", "-serial-port", "org.test.0=/tmp/a.sock", "-serial-port", "org.test.1=/tmp/b=c.sock",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []flag.SerialPort{{"org.test.0", "/tmp/a.sock"}, {"org.test.1", "/tmp/b=c.sock"}}
+	if len(a.SerialPorts) != 2 || a.SerialPorts[0] != expected[0] || a.SerialPorts[1] != expected[1] {
+		t.Errorf("invalid serial ports: %v", a.SerialPorts)
+	}
+
+	for _, s := range []string{"org.test.0", "=/tmp/a.sock", "org.test.0="} {
+		if _, err := flag.ParseArgs([]string{"gokvm", "-serial-port", s}); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestParseArgPCIID(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{
+		"gokvm", "-pci-id", "net:subsystem-vendor=15ad,subsystem=0x07b0", "-pci-id", "net:revision=1,class=020000",
+		"-pci-id", "blk:vendor=1af4,device=1001",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	net := pci.IDs{SubsystemVendorID: 0x15ad, SubsystemID: 0x7b0, RevisionID: 1, ClassCode: 0x020000}
+	blk := pci.IDs{VendorID: 0x1af4, DeviceID: 0x1001}
+
+	if len(a.PCIIDs) != 2 || a.PCIIDs["net"] != net || a.PCIIDs["blk"] != blk {
+		t.Errorf("invalid PCI IDs: %+v", a.PCIIDs)
+	}
+
+	for _, s := range []string{"net", ":vendor=1", "net:", "net:vendor", "net:serial=1", "net:vendor=10000", "net:class=g"} {
+		if _, err := flag.ParseArgs([]string{"gokvm", "-pci-id", s}); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestParseArgSGX(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-sgx-epc", "64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.SGXEPC != 64 || a.SGXVEPC != "/dev/sgx_vepc" {
+		t.Errorf("invalid SGX EPC: %d MiB from %q", a.SGXEPC, a.SGXVEPC)
+	}
+}
+
+func TestParseArgSEV(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-sev", "/dev/sev", "-sev-policy", "0x1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.SEV != "/dev/sev" || a.SEVPolicy != 1 || a.SNP {
+		t.Errorf("invalid SEV: %q %#x %v", a.SEV, a.SEVPolicy, a.SNP)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-sev", "/dev/sev", "-snp", "-sev-policy", "0x30000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.SNP || a.SEVPolicy != 0x30000 {
+		t.Errorf("invalid SEV-SNP: %v %#x", a.SNP, a.SEVPolicy)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-snp"}); !errors.Is(err, flag.ErrSNP) {
+		t.Errorf("got %v, want %v", err, flag.ErrSNP)
+	}
+}
+
+func TestParseArgHugePages(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-hugepages", "1G", "-hugetlbfs", "/dev/hugepages"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.HugePages != 1<<30 || a.Hugetlbfs != "/dev/hugepages" {
+		t.Errorf("invalid huge pages: %#x from %q", a.HugePages, a.Hugetlbfs)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-hugepages", "2m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.HugePages != 2<<20 {
+		t.Errorf("invalid huge pages: %#x", a.HugePages)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-hugepages", "4k"}); err == nil {
+		t.Error("-hugepages 4k: expected an error")
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-memfd", "-hugepages", "2M", "-prefault"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.Memfd || a.HugePages != 2<<20 || !a.Prefault {
+		t.Errorf("invalid memfd: %v of %#x, prefault %v", a.Memfd, a.HugePages, a.Prefault)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-numa", "0,1", "-mem-hotplug", "1024", "-balloon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.MemHotplug != 1024 || !a.Balloon {
+		t.Errorf("invalid memory hotplug: %d MiB, balloon %v", a.MemHotplug, a.Balloon)
+	}
+
+	if len(a.NUMA) != 2 || a.NUMA[0] != 0 || a.NUMA[1] != 1 {
+		t.Errorf("invalid NUMA nodes: %v", a.NUMA)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-numa", "0,x"}); err == nil {
+		t.Error("-numa 0,x: expected an error")
+	}
+
+	_, err = flag.ParseArgs([]string{"gokvm", "-memfd", "-hugetlbfs", "/dev/hugepages"})
+	if !errors.Is(err, flag.ErrMemfd) {
+		t.Errorf("got %v, want %v", err, flag.ErrMemfd)
+	}
+}
+
+func TestParseArgNetProfile(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-net-profile", "latency=50ms,loss=0.01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.NetProfile.Latency != 50*time.Millisecond || a.NetProfile.Loss != 0.01 {
+		t.Errorf("invalid network profile: %v", a.NetProfile)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-net-profile", "loss=10"}); err == nil {
+		t.Error("-net-profile loss=10: expected an error")
+	}
+}
+
+func TestParseArgSizing(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-cpus", "50%", "-mem", "25%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Resolve(hostcheck.Host{NCPUs: 8, MemTotal: 16 << 30, NUMANodes: 1, NodeCPUs: 8})
+
+	if a.NCPUs != 4 || a.MemSize != 4<<30 {
+		t.Errorf("got %d CPUs and %#x of RAM, want 4 and 4 GiB", a.NCPUs, a.MemSize)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-cpus", "3", "-mem", "512M"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.NCPUs != 3 || a.MemSize != 512<<20 {
+		t.Errorf("got %d CPUs and %#x of RAM, want 3 and 512 MiB", a.NCPUs, a.MemSize)
+	}
+
+	for _, arg := range [][]string{{"-cpus", "0"}, {"-cpus", "150%"}, {"-mem", "1T"}, {"-mem", "0%"}, {"-mem", ""}} {
+		if _, err := flag.ParseArgs(append([]string{"gokvm"}, arg...)); err == nil {
+			t.Errorf("%v: expected an error", arg)
+		}
+	}
+}
+
+func TestParseArgConsoleMode(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-console-mode", "sanitize"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.ConsoleMode != term.Sanitize {
+		t.Errorf("got console mode %v, want %v", a.ConsoleMode, term.Sanitize)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-console-mode", "raw"}); err == nil {
+		t.Error("-console-mode raw: expected an error")
+	}
+}
+
+func TestParseArgOutput(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-output", "json", "-output-fd", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Output != "json" || a.OutputFD != 3 {
+		t.Errorf("invalid output: %q to fd %d", a.Output, a.OutputFD)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Output != "text" || a.OutputFD != 2 {
+		t.Errorf("invalid default output: %q to fd %d", a.Output, a.OutputFD)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "-output", "xml"}); !errors.Is(err, flag.ErrOutput) {
+		t.Errorf("got %v, want %v", err, flag.ErrOutput)
+	}
+}
+
+func TestParseArgSnapshot(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "snapshot", "-dir", "/tmp/s", "branch", "base", "try"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Subcommand != flag.SubcommandSnapshot || a.SnapshotDir != "/tmp/s" || len(a.Command) != 3 {
+		t.Errorf("invalid snapshot args: %+v", a)
+	}
+
+	for _, args := range [][]string{{}, {"branch", "base"}, {"gc", "now"}, {"restore", "base"}} {
+		if _, err := flag.ParseArgs(append([]string{"gokvm", "snapshot"}, args...)); !errors.Is(err, flag.ErrSnapshotOp) {
+			t.Errorf("%q: got %v, want %v", args, err, flag.ErrSnapshotOp)
+		}
+	}
+}
+
+func TestParseArgCPUID(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "cpuid", "-nested"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Subcommand != flag.SubcommandCPUID || !a.Nested || a.Dev != "/dev/kvm" {
+		t.Errorf("invalid cpuid args: %+v", a)
+	}
+}
+
+func TestParseArgProbe(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "probe", "-D", "/dev/kvm2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Subcommand != flag.SubcommandProbe || a.Dev != "/dev/kvm2" {
+		t.Errorf("invalid probe args: %+v", a)
+	}
+}
+
+func TestParseArgBusLock(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		arg    string
+		policy string
+		rate   int
+	}{
+		{arg: "log", policy: flag.BusLockLog},
+		{arg: "kill", policy: flag.BusLockKill},
+		{arg: "throttle", policy: flag.BusLockThrottle, rate: 1000},
+		{arg: "throttle=10", policy: flag.BusLockThrottle, rate: 10},
+	} {
+		a, err := flag.ParseArgs([]string{"gokvm", "-bus-lock", tt.arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.BusLock != tt.policy || a.BusLockRate != tt.rate {
+			t.Errorf("%s: got %q at %d, want %q at %d", tt.arg, a.BusLock, a.BusLockRate, tt.policy, tt.rate)
+		}
+	}
+
+	for _, arg := range []string{"warn", "throttle=0", "throttle=x", "log=1"} {
+		if _, err := flag.ParseArgs([]string{"gokvm", "-bus-lock", arg}); err == nil {
+			t.Errorf("%q: expected an error", arg)
+		}
+	}
+}
+
+func TestParseArgOnReset(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		arg    string
+		policy string
+		code   int
+	}{
+		{arg: "", policy: flag.ResetExit},
+		{arg: "exit", policy: flag.ResetExit},
+		{arg: "exit=3", policy: flag.ResetExit, code: 3},
+		{arg: "restart", policy: flag.ResetRestart},
+	} {
+		args := []string{"gokvm"}
+		if tt.arg != "" {
+			args = append(args, "-on-reset", tt.arg)
+		}
+
+		a, err := flag.ParseArgs(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.OnReset != tt.policy || a.ResetExitCode != tt.code {
+			t.Errorf("%q: got %q with %d, want %q with %d", tt.arg, a.OnReset, a.ResetExitCode, tt.policy, tt.code)
+		}
+	}
+
+	for _, arg := range []string{"reboot", "exit=x", "exit=256", "restart=1"} {
+		if _, err := flag.ParseArgs([]string{"gokvm", "-on-reset", arg}); err == nil {
+			t.Errorf("%q: expected an error", arg)
+		}
+	}
+}
+
+func TestParseArgUART(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-com", "2=unix:kgdb.sock", "-com", "4=ttyS3.log", "-com", "3=pty",
+		"-console-pty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.ConsolePTY {
+		t.Errorf("-console-pty was not set")
+	}
+
+	want := []flag.UART{{N: 2, Path: "unix:kgdb.sock"}, {N: 4, Path: "ttyS3.log"}, {N: 3, Path: "pty"}}
+	if !reflect.DeepEqual(a.UARTs, want) {
+		t.Errorf("got %+v, want %+v", a.UARTs, want)
+	}
+
+	a, err = flag.ParseArgs([]string{"gokvm", "-console-listen", "tcp:127.0.0.1:4555"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.ConsoleListen != "tcp:127.0.0.1:4555" {
+		t.Errorf("got -console-listen %q", a.ConsoleListen)
+	}
+
+	_, err = flag.ParseArgs([]string{"gokvm", "-console-pty", "-console-listen", "unix:console.sock"})
+	if !errors.Is(err, flag.ErrConsole) {
+		t.Errorf("got %v, want %v", err, flag.ErrConsole)
+	}
+
+	for _, args := range [][]string{
+		{"-com", "1=console.log"}, {"-com", "5=x"}, {"-com", "2"}, {"-com", "3=unix:"},
+		{"-com", "2=a", "-com", "2=b"}, {"-com", "2=tcp:"},
+		{"-console-listen", "console.sock"}, {"-console-listen", "tcp:"},
+	} {
+		if _, err := flag.ParseArgs(append([]string{"gokvm"}, args...)); err == nil {
+			t.Errorf("%q: expected an error", args)
+		}
+	}
+}
+
+func TestParseArgConsoleLog(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		arg  string
+		want flag.ConsoleLog
+	}{
+		{"console.log", flag.ConsoleLog{Path: "console.log", Keep: 5}},
+		{"console.log,size=1M,keep=2", flag.ConsoleLog{Path: "console.log", Size: 1 << 20, Keep: 2}},
+		{"console.log,keep=0", flag.ConsoleLog{Path: "console.log"}},
+	} {
+		a, err := flag.ParseArgs([]string{"gokvm", "-console-log", tt.arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.ConsoleLog != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.arg, a.ConsoleLog, tt.want)
+		}
+	}
+
+	for _, arg := range []string{"", ",size=1M", "console.log,size=0", "console.log,keep=-1", "console.log,rotate"} {
+		if _, err := flag.ParseArgs([]string{"gokvm", "-console-log", arg}); err == nil {
+			t.Errorf("%q: expected an error", arg)
+		}
+	}
+}
+
+func TestParseArgDebugExit(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-debugcon", "firmware.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Debugcon != "firmware.log" || a.DebugExit != (flag.DebugExit{}) {
+		t.Errorf("-debugcon %q, -debug-exit %+v", a.Debugcon, a.DebugExit)
+	}
+
+	for _, tt := range []struct {
+		arg  string
+		want flag.DebugExit
+	}{
+		{arg: "iobase=0x501", want: flag.DebugExit{Port: 0x501, Size: 1}},
+		{arg: "iobase=0xf4,iosize=4,qemu", want: flag.DebugExit{Port: 0xf4, Size: 4, QEMU: true}},
+	} {
+		a, err := flag.ParseArgs([]string{"gokvm", "-debug-exit", tt.arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.DebugExit != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.arg, a.DebugExit, tt.want)
+		}
+	}
+
+	for _, arg := range []string{"iosize=2", "iobase=0x10000", "iobase=0xffff,iosize=2", "iobase=0x501,iosize=3", "iobase=1,exit"} {
+		if _, err := flag.ParseArgs([]string{"gokvm", "-debug-exit", arg}); err == nil {
+			t.Errorf("%q: expected an error", arg)
+		}
+	}
+}
+
+func TestParseArgRegion(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{
+		"gokvm",
+		"-region", "ram,gpa=0x100000000,size=1G,dirty-log",
+		"-region", "rom,gpa=0xe0000000,size=64K,file=fw.bin",
+		"-region", "shared,gpa=0xd0000000,size=2M,readonly",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []flag.Region{
+		{Kind: "ram", GPA: 0x100000000, Size: 1 << 30, DirtyLog: true},
+		{Kind: "rom", GPA: 0xe0000000, Size: 64 << 10, File: "fw.bin"},
+		{Kind: "shared", GPA: 0xd0000000, Size: 2 << 20, ReadOnly: true},
+	}
+
+	if !reflect.DeepEqual(a.Regions, want) {
+		t.Errorf("got %+v, want %+v", a.Regions, want)
+	}
+
+	for _, arg := range []string{
+		"", "ram", "ram,gpa=0x1000", "ram,size=4K", "flash,gpa=0,size=4K", "ram,gpa=x,size=4K",
+		"ram,gpa=0,size=0", "rom,gpa=0,size=4K", "ram,gpa=0,size=4K,file=f", "ram,gpa=0,size=4K,ro",
+	} {
+		if _, err := flag.ParseArgs([]string{"gokvm", "-region", arg}); err == nil {
+			t.Errorf("%q: expected an error", arg)
+		}
+	}
+}
+
+func TestParseArgSandbox(t *testing.T) {
+	t.Parallel()
+
+	a, err := flag.ParseArgs([]string{"gokvm", "-sandbox", "blk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(a.Sandbox, []string{"blk"}) {
+		t.Errorf("got %v, want [blk]", a.Sandbox)
+	}
+
+	for _, arg := range []string{"", "net", "blk,qcow2"} {
+		if _, err := flag.ParseArgs([]string{"gokvm", "-sandbox", arg}); err == nil {
+			t.Errorf("%q: expected an error", arg)
+		}
+	}
 }
@@ -0,0 +1,306 @@
+// Package flash emulates a CFI NOR flash with the Intel/Sharp command set,
+// the kind of parallel flash OVMF keeps its variable store in.
+//
+// Reads and writes come in as MMIO at offsets into the flash. Programming
+// can only clear bits, erasing sets a whole sector back to 0xff, and both
+// are written through to the backing file so that the contents persist.
+//
+// refs:
+// https://www.infineon.com/dgdl/Infineon-AN99111_Common_Flash_Interface_(CFI)_and_Command_Sets-ApplicationNotes-v05_00-EN.pdf
+// https://gitlab.com/qemu-project/qemu/-/blob/master/hw/block/pflash_cfi01.c
+package flash
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"sync"
+)
+
+const (
+	cmdProgram     = 0x10
+	cmdBlockErase  = 0x20
+	cmdProgramAlt  = 0x40
+	cmdClearStatus = 0x50
+	cmdLockSetup   = 0x60
+	cmdReadStatus  = 0x70
+	cmdReadID      = 0x90
+	cmdReadQuery   = 0x98
+	cmdConfirm     = 0xd0
+	cmdWriteBuffer = 0xe8
+	cmdReadArray   = 0xff
+
+	statusReady         = 0x80
+	statusEraseError    = 0x20
+	statusProgramError  = 0x10
+	statusSequenceError = statusEraseError | statusProgramError
+
+	manufacturerIntel = 0x89
+	deviceID          = 0x18
+
+	// The write buffer holds up to 2^writeBufferBits bytes.
+	writeBufferBits = 11
+)
+
+var ErrSize = errors.New("flash size must be a non-zero multiple of the sector size")
+
+type mode int
+
+const (
+	modeReadArray mode = iota
+	modeReadID
+	modeReadQuery
+	modeReadStatus
+	modeProgram
+	modeErase
+	modeBufferCount
+	modeBufferData
+	modeBufferConfirm
+	modeLock
+)
+
+// Flash is a CFI NOR flash backed by a file.
+type Flash struct {
+	mu sync.Mutex
+
+	file       *os.File
+	data       []byte
+	sectorSize int
+
+	mode   mode
+	status uint8
+	query  []byte
+
+	// write to buffer state
+	bufLeft int
+	buf     map[int]byte
+}
+
+// New opens a flash backed by the file at path. Its size is that of the file.
+func New(path string, sectorSize int) (*Flash, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 || sectorSize <= 0 || len(data)%sectorSize != 0 {
+		return nil, fmt.Errorf("%w: %s is %#x bytes, sector is %#x bytes", ErrSize, path, len(data), sectorSize)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Flash{
+		file:       file,
+		data:       data,
+		sectorSize: sectorSize,
+		mode:       modeReadArray,
+		status:     statusReady,
+	}
+	f.query = f.cfiQuery()
+
+	return f, nil
+}
+
+// Size returns the size of the flash in bytes.
+func (f *Flash) Size() uint64 {
+	return uint64(len(f.data))
+}
+
+// Close closes the backing file.
+func (f *Flash) Close() error {
+	return f.file.Close()
+}
+
+// cfiQuery builds the CFI query table for a x8 device with a single
+// erase block region.
+func (f *Flash) cfiQuery() []byte {
+	q := make([]byte, 0x40)
+	nSectors := len(f.data) / f.sectorSize
+
+	copy(q[0x10:], "QRY")
+	q[0x13], q[0x14] = 0x01, 0x00 // primary command set: Intel/Sharp
+	q[0x15], q[0x16] = 0x31, 0x00 // primary extended table
+	q[0x1b], q[0x1c] = 0x45, 0x55 // Vcc min/max 4.5V-5.5V
+	q[0x1f] = 0x07                // typical program time 2^7 us
+	q[0x20] = 0x07                // typical buffer write time 2^7 us
+	q[0x21] = 0x0a                // typical block erase time 2^10 ms
+	q[0x23], q[0x24], q[0x25] = 0x04, 0x04, 0x04
+	q[0x27] = uint8(bits.Len(uint(len(f.data) - 1))) // device size 2^n
+	q[0x28], q[0x29] = 0x00, 0x00                    // x8 only
+	q[0x2a], q[0x2b] = writeBufferBits, 0x00
+	q[0x2c] = 1 // one erase block region
+	q[0x2d], q[0x2e] = uint8(nSectors-1), uint8((nSectors-1)>>8)
+	q[0x2f], q[0x30] = uint8(f.sectorSize>>8), uint8(f.sectorSize>>16)
+	copy(q[0x31:], "PRI10")
+
+	return q
+}
+
+// Read handles a read of len(bytes) bytes at offset.
+func (f *Flash) Read(offset uint64, bytes []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := range bytes {
+		off := int(offset) + i
+
+		switch f.mode {
+		case modeReadArray:
+			bytes[i] = 0xff
+			if off < len(f.data) {
+				bytes[i] = f.data[off]
+			}
+		case modeReadID:
+			switch off & 0xff {
+			case 0:
+				bytes[i] = manufacturerIntel
+			case 1:
+				bytes[i] = deviceID
+			default:
+				bytes[i] = 0
+			}
+		case modeReadQuery:
+			bytes[i] = 0
+			if off < len(f.query) {
+				bytes[i] = f.query[off]
+			}
+		case modeReadStatus, modeProgram, modeErase, modeBufferCount,
+			modeBufferData, modeBufferConfirm, modeLock:
+			bytes[i] = f.status
+		}
+	}
+
+	return nil
+}
+
+// Write handles a write of len(bytes) bytes at offset: either a command
+// in its first byte or data for the pending command.
+func (f *Flash) Write(offset uint64, bytes []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	off := int(offset)
+	value := bytes[0]
+
+	switch f.mode {
+	case modeProgram:
+		f.mode = modeReadStatus
+
+		return f.program(off, bytes)
+	case modeErase:
+		f.mode = modeReadStatus
+
+		if value != cmdConfirm {
+			f.status |= statusSequenceError
+
+			return nil
+		}
+
+		return f.erase(off)
+	case modeBufferCount:
+		f.bufLeft = int(value) + 1
+		f.buf = map[int]byte{}
+		f.mode = modeBufferData
+
+		return nil
+	case modeBufferData:
+		for i, b := range bytes {
+			f.buf[off+i] = b
+		}
+
+		if f.bufLeft -= len(bytes); f.bufLeft <= 0 {
+			f.mode = modeBufferConfirm
+		}
+
+		return nil
+	case modeBufferConfirm:
+		f.mode = modeReadStatus
+
+		if value != cmdConfirm {
+			f.status |= statusSequenceError
+
+			return nil
+		}
+
+		for o, b := range f.buf {
+			if err := f.program(o, []byte{b}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case modeLock:
+		// Lock bits are not emulated; the sector stays writable.
+		f.mode = modeReadStatus
+
+		return nil
+	case modeReadArray, modeReadID, modeReadQuery, modeReadStatus:
+	}
+
+	switch value {
+	case cmdReadArray:
+		f.mode = modeReadArray
+	case cmdReadID:
+		f.mode = modeReadID
+	case cmdReadQuery:
+		f.mode = modeReadQuery
+	case cmdReadStatus:
+		f.mode = modeReadStatus
+	case cmdClearStatus:
+		f.status = statusReady
+	case cmdProgram, cmdProgramAlt:
+		f.mode = modeProgram
+	case cmdBlockErase:
+		f.mode = modeErase
+	case cmdWriteBuffer:
+		f.mode = modeBufferCount
+	case cmdLockSetup:
+		f.mode = modeLock
+	default:
+		// Unknown commands fall back to read array mode as on real parts.
+		f.mode = modeReadArray
+	}
+
+	return nil
+}
+
+// program clears bits at off and writes them through to the file.
+func (f *Flash) program(off int, bytes []byte) error {
+	if off < 0 || off+len(bytes) > len(f.data) {
+		f.status |= statusProgramError
+
+		return nil
+	}
+
+	for i, b := range bytes {
+		f.data[off+i] &= b
+	}
+
+	_, err := f.file.WriteAt(f.data[off:off+len(bytes)], int64(off))
+
+	return err
+}
+
+// erase sets the sector containing off to 0xff and writes it through to the file.
+func (f *Flash) erase(off int) error {
+	if off < 0 || off >= len(f.data) {
+		f.status |= statusEraseError
+
+		return nil
+	}
+
+	start := off - off%f.sectorSize
+	sector := f.data[start : start+f.sectorSize]
+
+	for i := range sector {
+		sector[i] = 0xff
+	}
+
+	_, err := f.file.WriteAt(sector, int64(start))
+
+	return err
+}
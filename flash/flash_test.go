@@ -0,0 +1,155 @@
+package flash_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/flash"
+)
+
+const sectorSize = 0x1000
+
+func newFlash(t *testing.T) (*flash.Flash, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "flash.img")
+	if err := os.WriteFile(path, bytes.Repeat([]byte{0xff}, 4*sectorSize), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := flash.New(path, sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { f.Close() })
+
+	return f, path
+}
+
+func read(t *testing.T, f *flash.Flash, off uint64, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if err := f.Read(off, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func write(t *testing.T, f *flash.Flash, off uint64, b ...byte) {
+	t.Helper()
+
+	if err := f.Write(off, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewSize(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "flash.img")
+	if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := flash.New(path, sectorSize); !errors.Is(err, flash.ErrSize) {
+		t.Fatalf("got %v, want %v", err, flash.ErrSize)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	t.Parallel()
+
+	f, _ := newFlash(t)
+
+	write(t, f, 0x55, 0x98)
+
+	if got := read(t, f, 0x10, 3); string(got) != "QRY" {
+		t.Errorf("CFI query: got %q, want QRY", got)
+	}
+
+	if got := read(t, f, 0x27, 1)[0]; got != 14 {
+		t.Errorf("device size: got 2^%d, want 2^14", got)
+	}
+
+	write(t, f, 0, 0x90)
+
+	if got := read(t, f, 0, 2); !bytes.Equal(got, []byte{0x89, 0x18}) {
+		t.Errorf("ID: got %#v", got)
+	}
+
+	write(t, f, 0, 0xff)
+
+	if got := read(t, f, 0, 1)[0]; got != 0xff {
+		t.Errorf("read array: got %#x, want 0xff", got)
+	}
+}
+
+func TestProgramAndErase(t *testing.T) {
+	t.Parallel()
+
+	f, path := newFlash(t)
+
+	// Programming only clears bits.
+	write(t, f, 0x1010, 0x40)
+	write(t, f, 0x1010, 0x0f)
+	write(t, f, 0x1010, 0x40)
+	write(t, f, 0x1010, 0xf5)
+
+	if got := read(t, f, 0x1010, 1)[0]; got != 0x80 {
+		t.Errorf("status: got %#x, want 0x80", got)
+	}
+
+	write(t, f, 0, 0xff)
+
+	if got := read(t, f, 0x1010, 1)[0]; got != 0x05 {
+		t.Errorf("programmed byte: got %#x, want 0x05", got)
+	}
+
+	// Write to buffer of 4 bytes.
+	write(t, f, 0x2000, 0xe8)
+	write(t, f, 0x2000, 3)
+	write(t, f, 0x2000, 'g', 'o')
+	write(t, f, 0x2002, 'k', 'v')
+	write(t, f, 0x2000, 0xd0)
+	write(t, f, 0, 0xff)
+
+	if got := read(t, f, 0x2000, 4); string(got) != "gokv" {
+		t.Errorf("buffered write: got %q, want gokv", got)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contents[0x1010] != 0x05 || string(contents[0x2000:0x2004]) != "gokv" {
+		t.Errorf("not persisted: %#x %q", contents[0x1010], contents[0x2000:0x2004])
+	}
+
+	// Erasing the sector brings back 0xff, but leaves other sectors alone.
+	write(t, f, 0x1234, 0x20)
+	write(t, f, 0x1234, 0xd0)
+	write(t, f, 0, 0xff)
+
+	if got := read(t, f, 0x1010, 1)[0]; got != 0xff {
+		t.Errorf("erased byte: got %#x, want 0xff", got)
+	}
+
+	if got := read(t, f, 0x2000, 4); string(got) != "gokv" {
+		t.Errorf("other sector: got %q, want gokv", got)
+	}
+
+	// An erase without confirmation is a sequence error.
+	write(t, f, 0x2000, 0x20)
+	write(t, f, 0x2000, 0xff)
+
+	if got := read(t, f, 0x2000, 1)[0]; got != 0xb0 {
+		t.Errorf("status: got %#x, want 0xb0", got)
+	}
+}
@@ -0,0 +1,154 @@
+package fwcfg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+// ACPI tables reach the guest as files that the firmware allocates memory
+// for, patches the pointers in and checksums, by the commands of the
+// table loader file, so that neither has to know where the other puts
+// them.
+//
+// refs: https://github.com/qemu/qemu/blob/master/hw/acpi/bios-linker-loader.c
+const (
+	fileACPITables  = "etc/acpi/tables"
+	fileACPIRSDP    = "etc/acpi/rsdp"
+	fileTableLoader = "etc/table-loader"
+
+	loaderAllocate    = 1
+	loaderAddPointer  = 2
+	loaderAddChecksum = 3
+	loaderCommandSize = 128
+
+	// Zones of an allocation: anywhere, or the F segment below 1MiB where
+	// the RSDP is looked for.
+	zoneHigh = 1
+	zoneFSeg = 2
+
+	tableHeaderSize = 36
+)
+
+var ErrACPITable = errors.New("not an ACPI table")
+
+// SetACPITables has the firmware install tables built with package acpi,
+// e.g. a DSDT, FADT and MADT, with an XSDT and RSDP pointing to them. The
+// FADT is pointed to the DSDT, which the XSDT leaves to it; no other table
+// may point to another, as their pointers are not patched.
+func (f *FwCfg) SetACPITables(tables ...[]byte) error {
+	var (
+		blob             []byte
+		loader           []byte
+		entries          []uint64
+		fadt, dsdt       = -1, -1
+		fadtOff, dsdtOff uint32
+	)
+
+	for i, t := range tables {
+		if len(t) < tableHeaderSize || binary.LittleEndian.Uint32(t[4:]) != uint32(len(t)) {
+			return fmt.Errorf("%w: table %d", ErrACPITable, i)
+		}
+
+		switch string(t[:4]) {
+		case "FACP":
+			fadt, fadtOff = i, uint32(len(blob))
+		case "DSDT":
+			dsdt, dsdtOff = i, uint32(len(blob))
+		}
+
+		// Pointers in the tables are offsets into the blob until the
+		// firmware adds its address to them.
+		if string(t[:4]) != "DSDT" {
+			entries = append(entries, uint64(len(blob)))
+		}
+
+		blob = append(blob, t...)
+	}
+
+	loader = append(loader, allocate(fileACPIRSDP, 16, zoneFSeg)...)
+	loader = append(loader, allocate(fileACPITables, 64, zoneHigh)...)
+
+	if fadt >= 0 && dsdt >= 0 {
+		binary.LittleEndian.PutUint32(blob[fadtOff+acpi.FADTDSDT:], dsdtOff)
+		binary.LittleEndian.PutUint64(blob[fadtOff+acpi.FADTXDSDT:], uint64(dsdtOff))
+
+		loader = append(loader, addPointer(fileACPITables, fileACPITables, fadtOff+acpi.FADTDSDT, 4)...)
+		loader = append(loader, addPointer(fileACPITables, fileACPITables, fadtOff+acpi.FADTXDSDT, 8)...)
+		loader = append(loader, addChecksum(fileACPITables, fadtOff+9, fadtOff, uint32(len(tables[fadt])))...)
+	}
+
+	xsdt := uint32(len(blob))
+	blob = append(blob, acpi.XSDT(entries)...)
+
+	for i := range entries {
+		loader = append(loader, addPointer(fileACPITables, fileACPITables, xsdt+acpi.XSDTEntries+8*uint32(i), 8)...)
+	}
+
+	loader = append(loader, addChecksum(fileACPITables, xsdt+9, xsdt, uint32(len(blob))-xsdt)...)
+
+	rsdp := acpi.RSDP(uint64(xsdt))
+
+	loader = append(loader, addPointer(fileACPIRSDP, fileACPITables, acpi.RSDPXSDT, 8)...)
+	loader = append(loader, addChecksum(fileACPIRSDP, 8, 0, 20)...)
+	loader = append(loader, addChecksum(fileACPIRSDP, 32, 0, acpi.RSDPSize)...)
+
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{fileACPIRSDP, rsdp},
+		{fileACPITables, blob},
+		{fileTableLoader, loader},
+	} {
+		if err := f.AddFile(file.name, file.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loaderCommand(command uint32) []byte {
+	b := make([]byte, loaderCommandSize)
+	binary.LittleEndian.PutUint32(b, command)
+
+	return b
+}
+
+// allocate has the firmware allocate memory for file, aligned to align,
+// in zone, and load the file there.
+func allocate(file string, align uint32, zone byte) []byte {
+	b := loaderCommand(loaderAllocate)
+	copy(b[4:4+fileNameSize-1], file)
+	binary.LittleEndian.PutUint32(b[4+fileNameSize:], align)
+	b[4+fileNameSize+4] = zone
+
+	return b
+}
+
+// addPointer has the firmware add the address of src to the size-byte
+// pointer at offset in dst.
+func addPointer(dst, src string, offset uint32, size byte) []byte {
+	b := loaderCommand(loaderAddPointer)
+	copy(b[4:4+fileNameSize-1], dst)
+	copy(b[4+fileNameSize:4+2*fileNameSize-1], src)
+	binary.LittleEndian.PutUint32(b[4+2*fileNameSize:], offset)
+	b[4+2*fileNameSize+4] = size
+
+	return b
+}
+
+// addChecksum has the firmware set the byte at offset in file for the
+// length bytes from start to add up to zero.
+func addChecksum(file string, offset, start, length uint32) []byte {
+	b := loaderCommand(loaderAddChecksum)
+	copy(b[4:4+fileNameSize-1], file)
+	binary.LittleEndian.PutUint32(b[4+fileNameSize:], offset)
+	binary.LittleEndian.PutUint32(b[4+fileNameSize+4:], start)
+	binary.LittleEndian.PutUint32(b[4+fileNameSize+8:], length)
+
+	return b
+}
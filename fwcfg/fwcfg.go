@@ -0,0 +1,349 @@
+// Package fwcfg emulates fw_cfg, the interface through which firmware
+// such as OVMF and SeaBIOS fetch the configuration of a QEMU machine: its
+// RAM and CPUs, the kernel to boot, ACPI tables and the boot order. Items
+// are selected by a 16-bit key at port 0x510 and read byte by byte from
+// port 0x511, or copied to guest memory with the DMA interface at 0x514.
+//
+// refs: https://www.qemu.org/docs/master/specs/fw_cfg.html
+package fwcfg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Ports.
+const (
+	PortSelector = 0x510
+	PortData     = 0x511
+	PortDMA      = 0x514
+)
+
+// Keys of the items that are not files.
+const (
+	KeySignature   = 0x00
+	KeyID          = 0x01
+	KeyRAMSize     = 0x03
+	KeyNbCPUs      = 0x05
+	KeyKernelSize  = 0x08
+	KeyInitrdSize  = 0x0b
+	KeyMaxCPUs     = 0x0f
+	KeyKernelData  = 0x11
+	KeyInitrdData  = 0x12
+	KeyCmdlineSize = 0x14
+	KeyCmdlineData = 0x15
+	KeySetupSize   = 0x17
+	KeySetupData   = 0x18
+	KeyFileDir     = 0x19
+
+	keyFileFirst = 0x20
+	keyWrite     = 0x4000
+)
+
+const (
+	fileNameSize     = 56
+	fileDirEntrySize = 64
+)
+
+// Feature bits of KeyID.
+const (
+	featureTraditional = 1 << 0
+	featureDMA         = 1 << 1
+)
+
+// Control bits of a DMA access.
+const (
+	dmaError  = 1 << 0
+	dmaRead   = 1 << 1
+	dmaSkip   = 1 << 2
+	dmaSelect = 1 << 3
+	dmaWrite  = 1 << 4
+)
+
+// dmaSignature is what the DMA port reads as, for firmware to tell that
+// the interface is there.
+const dmaSignature = "QEMU CFG"
+
+var (
+	ErrFileName   = fmt.Errorf("fw_cfg file names must have 1 to %d bytes", fileNameSize-1)
+	ErrFileExists = errors.New("fw_cfg file exists")
+)
+
+// FwCfg is the fw_cfg device of a machine.
+type FwCfg struct {
+	mu sync.Mutex
+
+	items map[uint16][]byte
+	files map[string]uint16
+
+	// mem is guest memory, for DMA.
+	mem []byte
+
+	key    uint16
+	offset uint32
+
+	dmaAddr uint64
+}
+
+// New returns a fw_cfg device with the signature and the features, the
+// traditional interface and DMA, and no files yet.
+func New() *FwCfg {
+	f := &FwCfg{
+		items: map[uint16][]byte{},
+		files: map[string]uint16{},
+	}
+
+	f.Set(KeySignature, []byte("QEMU"))
+	f.Set(KeyID, le32(featureTraditional|featureDMA))
+	f.Set(KeyFileDir, le32(0))
+
+	return f
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+
+	return b
+}
+
+func le64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+
+	return b
+}
+
+// SetMemory sets the guest memory that DMA accesses copy to, which starts
+// at guest physical address 0.
+func (f *FwCfg) SetMemory(mem []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.mem = mem
+}
+
+// Set sets the item of key to data.
+func (f *FwCfg) Set(key uint16, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.items[key] = data
+}
+
+// SetMachine sets the RAM size and number of CPUs that SeaBIOS and OVMF
+// read.
+func (f *FwCfg) SetMachine(ramSize uint64, cpus int) {
+	f.Set(KeyRAMSize, le64(ramSize))
+	f.Set(KeyNbCPUs, le16(uint16(cpus)))
+	f.Set(KeyMaxCPUs, le16(uint16(cpus)))
+}
+
+// SetKernel has the firmware boot kernel with initrd and cmdline, as with
+// -kernel of QEMU. A bzImage is split into its setup and protected-mode
+// parts, which firmware loads apart.
+func (f *FwCfg) SetKernel(kernel, initrd []byte, cmdline string) {
+	var setup []byte
+
+	if len(kernel) > 0x203 && string(kernel[0x202:0x206]) == "HdrS" {
+		sects := int(kernel[0x1f1])
+		if sects == 0 {
+			sects = 4
+		}
+
+		if n := (sects + 1) * 512; n <= len(kernel) {
+			setup, kernel = kernel[:n], kernel[n:]
+		}
+	}
+
+	f.Set(KeySetupSize, le32(uint32(len(setup))))
+	f.Set(KeySetupData, setup)
+	f.Set(KeyKernelSize, le32(uint32(len(kernel))))
+	f.Set(KeyKernelData, kernel)
+	f.Set(KeyInitrdSize, le32(uint32(len(initrd))))
+	f.Set(KeyInitrdData, initrd)
+	f.Set(KeyCmdlineSize, le32(uint32(len(cmdline)+1)))
+	f.Set(KeyCmdlineData, append([]byte(cmdline), 0))
+}
+
+// SetBootOrder sets the boot order as Open Firmware device paths, e.g.
+// /pci@i0cf8/scsi@3/disk@0,0 for the virtio-blk disk in slot 3, most
+// preferred first.
+func (f *FwCfg) SetBootOrder(paths ...string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	return f.AddFile("bootorder", []byte(strings.Join(paths, "\n")+"\x00"))
+}
+
+// AddFile adds a file named name, e.g. etc/e820 or opt/org.example/config,
+// with the contents data.
+func (f *FwCfg) AddFile(name string, data []byte) error {
+	if name == "" || len(name) >= fileNameSize {
+		return fmt.Errorf("%w: %q", ErrFileName, name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.files[name]; ok {
+		return fmt.Errorf("%w: %q", ErrFileExists, name)
+	}
+
+	key := uint16(keyFileFirst + len(f.files))
+	f.files[name] = key
+	f.items[key] = data
+
+	f.items[KeyFileDir] = f.fileDir()
+
+	return nil
+}
+
+// fileDir returns the file directory: the number of files and then, by
+// name, the size, key and name of each, all big-endian.
+func (f *FwCfg) fileDir() []byte {
+	names := make([]string, 0, len(f.files))
+	for name := range f.files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	dir := make([]byte, 4+fileDirEntrySize*len(names))
+	binary.BigEndian.PutUint32(dir, uint32(len(names)))
+
+	for i, name := range names {
+		e := dir[4+fileDirEntrySize*i:]
+		key := f.files[name]
+
+		binary.BigEndian.PutUint32(e, uint32(len(f.items[key])))
+		binary.BigEndian.PutUint16(e[4:], key)
+		copy(e[8:8+fileNameSize-1], name)
+	}
+
+	return dir
+}
+
+// Ports returns the selector, data and DMA ports.
+func (f *FwCfg) Ports() []uint64 {
+	ports := []uint64{PortSelector, PortData}
+	for p := uint64(PortDMA); p < PortDMA+8; p++ {
+		ports = append(ports, p)
+	}
+
+	return ports
+}
+
+func (f *FwCfg) selectKey(key uint16) {
+	f.key = key &^ keyWrite
+	f.offset = 0
+}
+
+// read copies the selected item from the current offset to b, with zeros
+// past its end, and moves the offset past it.
+func (f *FwCfg) read(b []byte) {
+	data := f.items[f.key]
+
+	n := 0
+	if f.offset < uint32(len(data)) {
+		n = copy(b, data[f.offset:])
+	}
+
+	for i := range b[n:] {
+		b[n+i] = 0
+	}
+
+	f.offset += uint32(len(b))
+}
+
+func (f *FwCfg) In(port uint64, bytes []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case port == PortData:
+		f.read(bytes)
+	case port >= PortDMA && port < PortDMA+8:
+		n := copy(bytes, dmaSignature[port-PortDMA:])
+		for i := range bytes[n:] {
+			bytes[n+i] = 0
+		}
+	default:
+		for i := range bytes {
+			bytes[i] = 0
+		}
+	}
+
+	return nil
+}
+
+func (f *FwCfg) Out(port uint64, bytes []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case port == PortSelector && len(bytes) >= 2:
+		f.selectKey(binary.LittleEndian.Uint16(bytes))
+	case port == PortSelector:
+		f.selectKey(uint16(bytes[0]))
+	case port == PortDMA && len(bytes) == 4:
+		// The guest writes the address big-endian, the high half first.
+		f.dmaAddr = uint64(binary.BigEndian.Uint32(bytes)) << 32
+	case port == PortDMA+4 && len(bytes) == 4:
+		f.dmaAddr |= uint64(binary.BigEndian.Uint32(bytes))
+		f.dma(f.dmaAddr)
+		f.dmaAddr = 0
+	}
+
+	// Writes to items, which QEMU takes for a few files only, are dropped.
+	return nil
+}
+
+// dma carries out the access described at addr in guest memory: a
+// big-endian control word, length and address. The control word is
+// cleared once done, or left with the error bit on failure.
+func (f *FwCfg) dma(addr uint64) {
+	if addr+16 < addr || addr+16 > uint64(len(f.mem)) {
+		return
+	}
+
+	access := f.mem[addr : addr+16]
+	control := binary.BigEndian.Uint32(access)
+	length := uint64(binary.BigEndian.Uint32(access[4:]))
+	address := binary.BigEndian.Uint64(access[8:])
+
+	if control&dmaSelect != 0 {
+		f.selectKey(uint16(control >> 16))
+	}
+
+	status := uint32(0)
+
+	switch {
+	case control&dmaRead != 0:
+		if address+length < address || address+length > uint64(len(f.mem)) {
+			status = dmaError
+
+			break
+		}
+
+		f.read(f.mem[address : address+length])
+	case control&dmaSkip != 0:
+		f.offset += uint32(length)
+	case control&dmaWrite != 0:
+		status = dmaError
+	}
+
+	binary.BigEndian.PutUint32(access, status)
+}
@@ -0,0 +1,222 @@
+package fwcfg_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+	"github.com/bobuhiro11/gokvm/fwcfg"
+)
+
+// read selects key and reads n bytes of it from the data port.
+func read(t *testing.T, f *fwcfg.FwCfg, key uint16, n int) []byte {
+	t.Helper()
+
+	sel := make([]byte, 2)
+	binary.LittleEndian.PutUint16(sel, key)
+
+	if err := f.Out(fwcfg.PortSelector, sel); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, n)
+	for i := range b {
+		if err := f.In(fwcfg.PortData, b[i:i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return b
+}
+
+// file returns the key and size of name from the file directory.
+func file(t *testing.T, f *fwcfg.FwCfg, name string) (uint16, int) {
+	t.Helper()
+
+	n := int(binary.BigEndian.Uint32(read(t, f, fwcfg.KeyFileDir, 4)))
+	dir := read(t, f, fwcfg.KeyFileDir, 4+64*n)[4:]
+
+	for i := 0; i < n; i++ {
+		e := dir[64*i : 64*(i+1)]
+		if strings.TrimRight(string(e[8:]), "\x00") == name {
+			return binary.BigEndian.Uint16(e[4:]), int(binary.BigEndian.Uint32(e))
+		}
+	}
+
+	t.Fatalf("no file %q", name)
+
+	return 0, 0
+}
+
+func TestFwCfg(t *testing.T) {
+	t.Parallel()
+
+	f := fwcfg.New()
+	f.SetMachine(1<<30, 2)
+
+	if got := string(read(t, f, fwcfg.KeySignature, 4)); got != "QEMU" {
+		t.Fatalf("signature %q", got)
+	}
+
+	if got := read(t, f, fwcfg.KeyID, 4)[0]; got != 3 {
+		t.Fatalf("features %#x", got)
+	}
+
+	if got := binary.LittleEndian.Uint16(read(t, f, fwcfg.KeyNbCPUs, 2)); got != 2 {
+		t.Fatalf("CPUs %d", got)
+	}
+
+	if got := binary.LittleEndian.Uint64(read(t, f, fwcfg.KeyRAMSize, 8)); got != 1<<30 {
+		t.Fatalf("RAM size %#x", got)
+	}
+
+	if err := f.AddFile("opt/org.example/b", []byte("bb")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.AddFile("opt/org.example/a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.AddFile("opt/org.example/a", nil); !errors.Is(err, fwcfg.ErrFileExists) {
+		t.Fatalf("got %v, want %v", err, fwcfg.ErrFileExists)
+	}
+
+	if err := f.AddFile(strings.Repeat("x", 56), nil); !errors.Is(err, fwcfg.ErrFileName) {
+		t.Fatalf("got %v, want %v", err, fwcfg.ErrFileName)
+	}
+
+	key, size := file(t, f, "opt/org.example/b")
+	if got := read(t, f, key, 4); size != 2 || !bytes.Equal(got, []byte("bb\x00\x00")) {
+		t.Fatalf("file of %d bytes: %q", size, got)
+	}
+
+	sig := make([]byte, 4)
+	if err := f.In(fwcfg.PortDMA+4, sig); err != nil || string(sig) != " CFG" {
+		t.Fatalf("DMA signature %q, %v", sig, err)
+	}
+}
+
+func TestFwCfgDMA(t *testing.T) {
+	t.Parallel()
+
+	f := fwcfg.New()
+	mem := make([]byte, 0x2000)
+	f.SetMemory(mem)
+	f.SetKernel([]byte("kernel"), []byte("initrd"), "console=ttyS0")
+
+	// dma has f carry out an access described at access in mem and
+	// returns its status.
+	dma := func(access uint64, control, length uint32, address uint64) uint32 {
+		binary.BigEndian.PutUint32(mem[access:], control)
+		binary.BigEndian.PutUint32(mem[access+4:], length)
+		binary.BigEndian.PutUint64(mem[access+8:], address)
+
+		for _, out := range []struct {
+			port  uint64
+			value uint32
+		}{{fwcfg.PortDMA, uint32(access >> 32)}, {fwcfg.PortDMA + 4, uint32(access)}} {
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, out.value)
+
+			if err := f.Out(out.port, b); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return binary.BigEndian.Uint32(mem[access:])
+	}
+
+	// Select the command line, skip 8 bytes and read the rest to 0x1800.
+	if status := dma(0x1000, fwcfg.KeyCmdlineData<<16|0x08|0x04, 8, 0); status != 0 {
+		t.Fatalf("skip: %#x", status)
+	}
+
+	if status := dma(0x1000, 0x02, 6, 0x1800); status != 0 {
+		t.Fatalf("read: %#x", status)
+	}
+
+	if got := string(mem[0x1800:0x1806]); got != "ttyS0\x00" {
+		t.Fatalf("got %q", got)
+	}
+
+	if status := dma(0x1000, 0x02, 0x1000, 0x1800); status != 1 {
+		t.Fatalf("read past the end of memory: %#x", status)
+	}
+
+	if got := binary.LittleEndian.Uint32(read(t, f, fwcfg.KeySetupSize, 4)); got != 0 {
+		t.Fatalf("setup of %d bytes", got)
+	}
+}
+
+func TestSetACPITables(t *testing.T) {
+	t.Parallel()
+
+	f := fwcfg.New()
+
+	if err := f.SetACPITables([]byte("SRAT")); !errors.Is(err, fwcfg.ErrACPITable) {
+		t.Fatalf("got %v, want %v", err, fwcfg.ErrACPITable)
+	}
+
+	srat := acpi.Table("SRAT", "GOKVMSRA", 3, make([]byte, 12))
+	slit := acpi.Table("SLIT", "GOKVMSLI", 1, make([]byte, 9))
+
+	if err := f.SetACPITables(srat, slit); err != nil {
+		t.Fatal(err)
+	}
+
+	key, size := file(t, f, "etc/acpi/tables")
+	tables := read(t, f, key, size)
+
+	xsdt := len(srat) + len(slit)
+	if !bytes.Equal(tables[:xsdt], append(srat, slit...)) || string(tables[xsdt:xsdt+4]) != "XSDT" {
+		t.Fatalf("tables %q", tables)
+	}
+
+	if got := binary.LittleEndian.Uint64(tables[xsdt+36+8:]); got != uint64(len(srat)) {
+		t.Fatalf("XSDT entry %#x", got)
+	}
+
+	key, size = file(t, f, "etc/acpi/rsdp")
+	if rsdp := read(t, f, key, size); size != 36 || string(rsdp[:8]) != "RSD PTR " ||
+		binary.LittleEndian.Uint64(rsdp[24:]) != uint64(xsdt) {
+		t.Fatalf("RSDP %q", rsdp)
+	}
+
+	// The RSDP and the tables are allocated, 2 pointers in the XSDT and 1
+	// in the RSDP patched, and 3 checksums fixed.
+	if _, size := file(t, f, "etc/table-loader"); size != 8*128 {
+		t.Fatalf("table loader of %d bytes", size)
+	}
+
+	// The FADT points to the DSDT, which the XSDT leaves out.
+	f = fwcfg.New()
+	dsdt := acpi.DSDT()
+
+	if err := f.SetACPITables(dsdt, acpi.FADT(0, acpi.PowerManagement{})); err != nil {
+		t.Fatal(err)
+	}
+
+	key, size = file(t, f, "etc/acpi/tables")
+	tables = read(t, f, key, size)
+	fadt := tables[len(dsdt):]
+
+	if binary.LittleEndian.Uint32(fadt[acpi.FADTDSDT:]) != 0 || binary.LittleEndian.Uint64(fadt[acpi.FADTXDSDT:]) != 0 {
+		t.Fatalf("FADT % x", fadt[:acpi.FADTXDSDT+8])
+	}
+
+	xsdt = len(dsdt) + 276
+	if got := binary.LittleEndian.Uint32(tables[xsdt+4:]); got != 36+8 ||
+		binary.LittleEndian.Uint64(tables[xsdt+36:]) != uint64(len(dsdt)) {
+		t.Fatalf("XSDT of %d bytes % x", got, tables[xsdt:])
+	}
+
+	// Besides the 8 commands above, less a pointer in the XSDT, 2 pointers
+	// to the DSDT patched and the checksum of the FADT fixed.
+	if _, size := file(t, f, "etc/table-loader"); size != 10*128 {
+		t.Fatalf("table loader of %d bytes", size)
+	}
+}
@@ -0,0 +1,352 @@
+// Package hostcheck verifies that the host can give a VM what it needs
+// before it is created, so that gokvm fails at once with what is missing
+// rather than in the middle of a boot, e.g. when the OOM killer strikes or
+// the tap device turns out not to be accessible.
+package hostcheck
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/numa"
+)
+
+// ErrInsufficient is what every Error is, for errors.Is.
+var ErrInsufficient = errors.New("insufficient host resources")
+
+// Error is a requirement of the VM that the host does not meet.
+type Error struct {
+	// Resource is what is short, e.g. "memory" or "tap".
+	Resource string
+	// Need and Have are amounts of the resource, in its unit, if it has
+	// one.
+	Need, Have uint64
+	// Reason tells what is wrong and, if possible, what to do about it.
+	Reason string
+}
+
+func (e *Error) Error() string {
+	if e.Need == 0 && e.Have == 0 {
+		return fmt.Sprintf("%s: %s", e.Resource, e.Reason)
+	}
+
+	return fmt.Sprintf("%s: need %d, have %d: %s", e.Resource, e.Need, e.Have, e.Reason)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrInsufficient
+}
+
+// Errors are all the requirements that the host does not meet.
+type Errors []*Error
+
+func (es Errors) Error() string {
+	s := make([]string, len(es))
+	for i, e := range es {
+		s[i] = e.Error()
+	}
+
+	return strings.Join(s, "; ")
+}
+
+func (es Errors) Is(target error) bool {
+	return target == ErrInsufficient
+}
+
+// Modes of access(2), which package syscall lacks.
+const (
+	accessRead  = 0x4
+	accessWrite = 0x2
+)
+
+// Overcommit policies of vm.overcommit_memory.
+const (
+	OvercommitGuess  = 0
+	OvercommitAlways = 1
+	OvercommitNever  = 2
+)
+
+// Requirements are what a VM needs of the host.
+type Requirements struct {
+	// MemSize is the guest RAM in bytes.
+	MemSize uint64
+	// HugePages is how many huge pages the guest RAM takes if it is
+	// backed by them, or zero.
+	HugePages uint64
+	// NCPUs is the number of vCPUs, which may exceed the host CPUs only
+	// if CPUOvercommit is set.
+	NCPUs         int
+	CPUOvercommit bool
+	// MemSlots is the number of memory slots of the VM, and IRQRoutes
+	// that of its GSIs.
+	MemSlots  int
+	IRQRoutes int
+}
+
+// Host is what the host has to offer, mostly from /proc/meminfo.
+type Host struct {
+	// MemTotal, MemAvailable and SwapFree are in bytes.
+	MemTotal     uint64
+	MemAvailable uint64
+	SwapFree     uint64
+	// CommitLimit and Committed are in bytes; they limit allocations
+	// under OvercommitNever.
+	CommitLimit uint64
+	Committed   uint64
+	Overcommit  int
+
+	HugePagesFree uint64
+	HugePageSize  uint64
+
+	NCPUs int
+	// NUMANodes are the NUMA nodes with CPUs, and NodeCPUs the CPUs of the
+	// smallest of them.
+	NUMANodes int
+	NodeCPUs  int
+
+	// KVM are the limits of KVM, if ReadKVM read them.
+	KVM *Limits
+}
+
+// Limits are what KVM allows a VM.
+type Limits struct {
+	// MaxVCPUs is KVM_CAP_MAX_VCPUS, or KVM_CAP_NR_VCPUS on kernels
+	// without it, MemSlots KVM_CAP_NR_MEMSLOTS and IRQRoutes
+	// KVM_CAP_IRQ_ROUTING, which is 0 without GSI routing.
+	MaxVCPUs  int
+	MemSlots  int
+	IRQRoutes int
+}
+
+// ReadHost reads what the host has to offer from /proc.
+func ReadHost() (Host, error) {
+	h := Host{NCPUs: runtime.NumCPU()}
+
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return h, err
+	}
+	defer f.Close()
+
+	// Lines look like "MemAvailable:   12345678 kB" or
+	// "HugePages_Free:        0".
+	fields := map[string]*uint64{
+		"MemTotal":       &h.MemTotal,
+		"MemAvailable":   &h.MemAvailable,
+		"SwapFree":       &h.SwapFree,
+		"CommitLimit":    &h.CommitLimit,
+		"Committed_AS":   &h.Committed,
+		"HugePages_Free": &h.HugePagesFree,
+		"Hugepagesize":   &h.HugePageSize,
+	}
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.Fields(sc.Text())
+		if len(line) < 2 {
+			continue
+		}
+
+		p, ok := fields[strings.TrimSuffix(line[0], ":")]
+		if !ok {
+			continue
+		}
+
+		if *p, err = strconv.ParseUint(line[1], 10, 64); err != nil {
+			return h, fmt.Errorf("/proc/meminfo: %w", err)
+		}
+
+		if len(line) > 2 && line[2] == "kB" {
+			*p <<= 10
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return h, err
+	}
+
+	b, err := os.ReadFile("/proc/sys/vm/overcommit_memory")
+	if err != nil {
+		return h, err
+	}
+
+	if h.Overcommit, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+		return h, fmt.Errorf("overcommit_memory: %w", err)
+	}
+
+	nodes, err := numa.Nodes()
+	if err != nil {
+		return h, err
+	}
+
+	for _, n := range nodes {
+		if len(n.CPUs) == 0 {
+			continue
+		}
+
+		if h.NUMANodes == 0 || len(n.CPUs) < h.NodeCPUs {
+			h.NodeCPUs = len(n.CPUs)
+		}
+
+		h.NUMANodes++
+	}
+
+	return h, nil
+}
+
+// ReadKVM reads the Limits of the KVM device at path, usually /dev/kvm,
+// into h.KVM.
+func (h *Host) ReadKVM(path string) error {
+	devKVM, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devKVM.Close()
+
+	l := &Limits{}
+
+	for _, c := range []struct {
+		cap uint32
+		v   *int
+	}{
+		{kvm.CapMaxVCPUs, &l.MaxVCPUs},
+		{kvm.CapNRMemSlots, &l.MemSlots},
+		{kvm.CapIRQRouting, &l.IRQRoutes},
+	} {
+		if *c.v, err = kvm.CheckExtension(devKVM.Fd(), c.cap); err != nil {
+			return err
+		}
+	}
+
+	if l.MaxVCPUs == 0 {
+		if l.MaxVCPUs, err = kvm.CheckExtension(devKVM.Fd(), kvm.CapNRVCPUs); err != nil {
+			return err
+		}
+	}
+
+	h.KVM = l
+
+	return nil
+}
+
+// Check returns the Errors of the requirements r that h does not meet, or
+// nil.
+func (h Host) Check(r Requirements) error {
+	var es Errors
+
+	switch {
+	case r.HugePages > 0:
+		if h.HugePagesFree < r.HugePages {
+			es = append(es, &Error{
+				Resource: "hugepages", Need: r.HugePages, Have: h.HugePagesFree,
+				Reason: fmt.Sprintf("reserve more %d-byte pages in /proc/sys/vm/nr_hugepages", h.HugePageSize),
+			})
+		}
+	case h.Overcommit == OvercommitAlways:
+	case h.Overcommit == OvercommitNever:
+		var free uint64
+		if h.CommitLimit > h.Committed {
+			free = h.CommitLimit - h.Committed
+		}
+
+		if free < r.MemSize {
+			es = append(es, &Error{
+				Resource: "memory", Need: r.MemSize, Have: free,
+				Reason: "the commit limit of vm.overcommit_memory=2 is reached",
+			})
+		}
+	default:
+		if free := h.MemAvailable + h.SwapFree; free < r.MemSize {
+			es = append(es, &Error{
+				Resource: "memory", Need: r.MemSize, Have: free,
+				Reason: "not enough available memory and swap",
+			})
+		}
+	}
+
+	if r.NCPUs > h.NCPUs && !r.CPUOvercommit {
+		es = append(es, &Error{
+			Resource: "cpus", Need: uint64(r.NCPUs), Have: uint64(h.NCPUs),
+			Reason: "more vCPUs than host CPUs without CPU overcommit",
+		})
+	}
+
+	if h.KVM != nil {
+		es = append(es, h.KVM.check(r)...)
+	}
+
+	if len(es) == 0 {
+		return nil
+	}
+
+	return es
+}
+
+// check returns the Errors of the requirements r that exceed l.
+func (l *Limits) check(r Requirements) Errors {
+	var es Errors
+
+	if r.NCPUs > l.MaxVCPUs {
+		es = append(es, &Error{
+			Resource: "kvm vcpus", Need: uint64(r.NCPUs), Have: uint64(l.MaxVCPUs),
+			Reason: "more vCPUs than KVM allows a VM, whatever the host CPUs",
+		})
+	}
+
+	if r.MemSlots > l.MemSlots {
+		es = append(es, &Error{
+			Resource: "kvm memslots", Need: uint64(r.MemSlots), Have: uint64(l.MemSlots),
+			Reason: "more memory slots than KVM allows a VM; give fewer -region",
+		})
+	}
+
+	if r.IRQRoutes > l.IRQRoutes {
+		reason := "more GSIs than KVM can route"
+		if l.IRQRoutes == 0 {
+			reason = "KVM has no GSI routing, which the in-kernel IOAPIC takes"
+		}
+
+		es = append(es, &Error{
+			Resource: "kvm irq routes", Need: uint64(r.IRQRoutes), Have: uint64(l.IRQRoutes), Reason: reason,
+		})
+	}
+
+	return es
+}
+
+// CheckTap returns an Error if the tap interface name cannot be opened:
+// if /dev/net/tun is not accessible, or if the interface has to be created
+// or belongs to someone else and the caller is not root.
+func CheckTap(name string) error {
+	if err := syscall.Access("/dev/net/tun", accessRead|accessWrite); err != nil {
+		return &Error{Resource: "tap", Reason: fmt.Sprintf("/dev/net/tun: %v", err)}
+	}
+
+	uid := os.Geteuid()
+	if uid == 0 {
+		return nil
+	}
+
+	b, err := os.ReadFile(filepath.Join("/sys/class/net", name, "owner"))
+	if err != nil {
+		return &Error{
+			Resource: "tap",
+			Reason:   fmt.Sprintf("%s does not exist and only root can create it, e.g. with ip tuntap add %s mode tap user $USER", name, name),
+		}
+	}
+
+	// The owner is -1 if anyone may open the interface.
+	if owner := strings.TrimSpace(string(b)); owner != "-1" && owner != strconv.Itoa(uid) {
+		return &Error{Resource: "tap", Reason: fmt.Sprintf("%s belongs to uid %s", name, owner)}
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package hostcheck_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/hostcheck"
+)
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	const gib = 1 << 30
+
+	for _, tt := range []struct {
+		name      string
+		h         hostcheck.Host
+		r         hostcheck.Requirements
+		resources []string
+	}{
+		{
+			name: "enough",
+			h:    hostcheck.Host{MemAvailable: 2 * gib, NCPUs: 4},
+			r:    hostcheck.Requirements{MemSize: gib, NCPUs: 4},
+		},
+		{
+			name:      "swap does not make up for memory",
+			h:         hostcheck.Host{MemAvailable: gib / 2, SwapFree: gib / 4, NCPUs: 4},
+			r:         hostcheck.Requirements{MemSize: gib, NCPUs: 1},
+			resources: []string{"memory"},
+		},
+		{
+			name: "overcommit always",
+			h:    hostcheck.Host{Overcommit: hostcheck.OvercommitAlways, NCPUs: 1},
+			r:    hostcheck.Requirements{MemSize: gib, NCPUs: 1},
+		},
+		{
+			name: "commit limit",
+			h: hostcheck.Host{
+				MemAvailable: 8 * gib, CommitLimit: 4 * gib, Committed: 3*gib + 1,
+				Overcommit: hostcheck.OvercommitNever, NCPUs: 1,
+			},
+			r:         hostcheck.Requirements{MemSize: gib, NCPUs: 1},
+			resources: []string{"memory"},
+		},
+		{
+			name:      "hugepages",
+			h:         hostcheck.Host{HugePagesFree: 511, HugePageSize: 2 << 20, NCPUs: 1},
+			r:         hostcheck.Requirements{MemSize: gib, HugePages: 512, NCPUs: 1},
+			resources: []string{"hugepages"},
+		},
+		{
+			name:      "cpus",
+			h:         hostcheck.Host{MemAvailable: 2 * gib, NCPUs: 2},
+			r:         hostcheck.Requirements{MemSize: gib, NCPUs: 3},
+			resources: []string{"cpus"},
+		},
+		{
+			name: "cpu overcommit",
+			h:    hostcheck.Host{MemAvailable: 2 * gib, NCPUs: 2},
+			r:    hostcheck.Requirements{MemSize: gib, NCPUs: 3, CPUOvercommit: true},
+		},
+		{
+			name:      "all at once",
+			h:         hostcheck.Host{NCPUs: 1},
+			r:         hostcheck.Requirements{MemSize: gib, NCPUs: 2},
+			resources: []string{"memory", "cpus"},
+		},
+		{
+			name: "within KVM limits",
+			h: hostcheck.Host{
+				MemAvailable: 2 * gib, NCPUs: 4,
+				KVM: &hostcheck.Limits{MaxVCPUs: 4, MemSlots: 2, IRQRoutes: 24},
+			},
+			r: hostcheck.Requirements{MemSize: gib, NCPUs: 4, MemSlots: 2, IRQRoutes: 24},
+		},
+		{
+			name: "KVM limits",
+			h: hostcheck.Host{
+				MemAvailable: 2 * gib, NCPUs: 4,
+				KVM: &hostcheck.Limits{MaxVCPUs: 2, MemSlots: 3},
+			},
+			r:         hostcheck.Requirements{MemSize: gib, NCPUs: 4, MemSlots: 4, IRQRoutes: 24},
+			resources: []string{"kvm vcpus", "kvm memslots", "kvm irq routes"},
+		},
+	} {
+		err := tt.h.Check(tt.r)
+
+		if len(tt.resources) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+
+			continue
+		}
+
+		if !errors.Is(err, hostcheck.ErrInsufficient) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, hostcheck.ErrInsufficient)
+
+			continue
+		}
+
+		var es hostcheck.Errors
+		if !errors.As(err, &es) || len(es) != len(tt.resources) {
+			t.Errorf("%s: got %v, want errors for %v", tt.name, err, tt.resources)
+
+			continue
+		}
+
+		for i, e := range es {
+			if e.Resource != tt.resources[i] {
+				t.Errorf("%s: got %q, want %q", tt.name, e.Resource, tt.resources[i])
+			}
+		}
+	}
+}
+
+func TestReadHost(t *testing.T) {
+	t.Parallel()
+
+	h, err := hostcheck.ReadHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.NCPUs == 0 || h.MemAvailable == 0 || h.CommitLimit == 0 {
+		t.Errorf("incomplete host: %+v", h)
+	}
+}
+
+func TestCheckTap(t *testing.T) {
+	t.Parallel()
+
+	err := hostcheck.CheckTap("gokvm-no-such-tap")
+
+	var e *hostcheck.Error
+	if err != nil && (!errors.As(err, &e) || e.Resource != "tap") {
+		t.Errorf("got %v, want a tap error or none", err)
+	}
+}
+
+func TestReadKVM(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	var h hostcheck.Host
+	if err := h.ReadKVM("/dev/kvm"); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.KVM.MaxVCPUs == 0 || h.KVM.MemSlots == 0 || h.KVM.IRQRoutes == 0 {
+		t.Errorf("incomplete limits: %+v", *h.KVM)
+	}
+
+	// One more than KVM allows of each is too many.
+	err := h.Check(hostcheck.Requirements{NCPUs: h.KVM.MaxVCPUs + 1, MemSlots: h.KVM.MemSlots + 1, CPUOvercommit: true})
+	if !errors.Is(err, hostcheck.ErrInsufficient) {
+		t.Errorf("got %v, want %v", err, hostcheck.ErrInsufficient)
+	}
+}
@@ -0,0 +1,37 @@
+package hostcheck
+
+// shareAlign is what memory shares are rounded to, a huge page, so that
+// guest RAM splits into huge pages.
+const shareAlign = 2 << 20
+
+// CPUShare returns percent of the CPUs of h, at least one, e.g. for VM
+// templates used on hosts of all sizes. A share that does not fit in one
+// NUMA node is rounded down to a multiple of the nodes, so that the vCPUs
+// split evenly across them.
+func (h Host) CPUShare(percent float64) int {
+	n := int(percent / 100 * float64(h.NCPUs))
+
+	if h.NUMANodes > 1 && n > h.NodeCPUs {
+		n -= n % h.NUMANodes
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
+
+// MemShare returns percent of the memory of h in bytes, rounded down to a
+// multiple of 2MiB for each NUMA node, so that it splits evenly across the
+// nodes in huge pages.
+func (h Host) MemShare(percent float64) uint64 {
+	align := uint64(shareAlign)
+	if h.NUMANodes > 1 {
+		align *= uint64(h.NUMANodes)
+	}
+
+	n := uint64(percent / 100 * float64(h.MemTotal))
+
+	return n - n%align
+}
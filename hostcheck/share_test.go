@@ -0,0 +1,51 @@
+package hostcheck_test
+
+import (
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/hostcheck"
+)
+
+func TestCPUShare(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		h       hostcheck.Host
+		percent float64
+		want    int
+	}{
+		{hostcheck.Host{NCPUs: 8}, 50, 4},
+		{hostcheck.Host{NCPUs: 2}, 10, 1},
+		// 37% of 48 CPUs is 17, more than a node of 12, so rounded down
+		// to 16 for 4 nodes.
+		{hostcheck.Host{NCPUs: 48, NUMANodes: 4, NodeCPUs: 12}, 37, 16},
+		// 9 fit in a node, as they are.
+		{hostcheck.Host{NCPUs: 48, NUMANodes: 4, NodeCPUs: 12}, 20, 9},
+	} {
+		if got := tt.h.CPUShare(tt.percent); got != tt.want {
+			t.Errorf("%g%% of %+v: got %d, want %d", tt.percent, tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestMemShare(t *testing.T) {
+	t.Parallel()
+
+	const mib = 1 << 20
+
+	for _, tt := range []struct {
+		h       hostcheck.Host
+		percent float64
+		want    uint64
+	}{
+		{hostcheck.Host{MemTotal: 4096 * mib}, 25, 1024 * mib},
+		{hostcheck.Host{MemTotal: 1000 * mib}, 25, 250 * mib},
+		{hostcheck.Host{MemTotal: 1001 * mib}, 25, 250 * mib},
+		// Two nodes take 2MiB each at a time.
+		{hostcheck.Host{MemTotal: 1000 * mib, NUMANodes: 2}, 25, 248 * mib},
+	} {
+		if got := tt.h.MemShare(tt.percent); got != tt.want {
+			t.Errorf("%g%% of %+v: got %d MiB, want %d MiB", tt.percent, tt.h, got/mib, tt.want/mib)
+		}
+	}
+}
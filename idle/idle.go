@@ -0,0 +1,287 @@
+// Package idle estimates the working set of a memory area, e.g. guest RAM,
+// with the idle page tracking of Linux: a scan marks the pages of the area
+// idle in /sys/kernel/mm/page_idle/bitmap, and the next scan counts as hot
+// those whose idle bit an access cleared since, and as cold the others.
+//
+// The physical pages come from /proc/self/pagemap, which hides them from
+// processes without CAP_SYS_ADMIN, and tracking needs a kernel with
+// CONFIG_IDLE_PAGE_TRACKING.
+package idle
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	pagemapPath = "/proc/self/pagemap"
+	bitmapPath  = "/sys/kernel/mm/page_idle/bitmap"
+
+	pageSize = 4096
+
+	// pagemapPresent and pagemapPFN are the present bit and the page frame
+	// number of a pagemap entry.
+	pagemapPresent = 1 << 63
+	pagemapPFN     = 1<<55 - 1
+)
+
+var (
+	// ErrNoIdleTracking indicates a kernel without idle page tracking.
+	ErrNoIdleTracking = errors.New("idle page tracking is not available")
+	// ErrNoPFN indicates a process that may not see page frame numbers.
+	ErrNoPFN = errors.New("pagemap hides page frame numbers, need CAP_SYS_ADMIN")
+)
+
+// Stats is the working set of the area at a scan.
+type Stats struct {
+	// Pages is the size of the area in pages, of which Present are
+	// backed by physical pages; of those, Hot were accessed since the
+	// scan before, Interval earlier, and Cold were not.
+	Pages, Present, Hot, Cold int
+	Interval                  time.Duration
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("pages %d present %d hot %d cold %d interval %v",
+		s.Pages, s.Present, s.Hot, s.Cold, s.Interval)
+}
+
+// Tracker scans an area for its working set.
+type Tracker struct {
+	mu sync.Mutex
+
+	mem             []byte
+	pagemap, bitmap *os.File
+
+	// hot tells by page of the area whether it was hot at the last scan.
+	hot []bool
+	// marked is when the pages were last marked idle.
+	marked time.Time
+	last   Stats
+}
+
+// NewTracker returns a tracker of mem, whose pages it marks idle for the
+// first Scan.
+func NewTracker(mem []byte) (*Tracker, error) {
+	bitmap, err := os.OpenFile(bitmapPath, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %v", ErrNoIdleTracking, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	pagemap, err := os.Open(pagemapPath)
+	if err != nil {
+		bitmap.Close()
+
+		return nil, err
+	}
+
+	t := &Tracker{
+		mem:     mem,
+		pagemap: pagemap,
+		bitmap:  bitmap,
+		hot:     make([]bool, len(mem)/pageSize),
+	}
+
+	pfns, err := t.pfns()
+	if err == nil {
+		err = t.mark(pfns)
+	}
+
+	if err != nil {
+		t.Close()
+
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Close closes the files of the tracker.
+func (t *Tracker) Close() error {
+	err := t.pagemap.Close()
+	if err2 := t.bitmap.Close(); err == nil {
+		err = err2
+	}
+
+	return err
+}
+
+// pfns returns the page frame numbers of the pages of the area, 0 for
+// those without a physical page.
+func (t *Tracker) pfns() ([]uint64, error) {
+	n := len(t.mem) / pageSize
+	buf := make([]byte, 8*n)
+
+	addr := uintptr(unsafe.Pointer(&t.mem[0]))
+	if _, err := t.pagemap.ReadAt(buf, int64(addr/pageSize*8)); err != nil {
+		return nil, fmt.Errorf("read %s: %w", pagemapPath, err)
+	}
+
+	pfns := make([]uint64, n)
+	present := false
+
+	for i := range pfns {
+		e := binary.LittleEndian.Uint64(buf[8*i:])
+		if e&pagemapPresent == 0 {
+			continue
+		}
+
+		present = true
+		pfns[i] = e & pagemapPFN
+	}
+
+	for _, pfn := range pfns {
+		if pfn != 0 {
+			return pfns, nil
+		}
+	}
+
+	if present {
+		return nil, ErrNoPFN
+	}
+
+	return pfns, nil
+}
+
+// word returns the 64-bit word of the bitmap that holds the idle bit of
+// pfn. The bitmap takes reads and writes of whole, aligned words only.
+func (t *Tracker) word(pfn uint64) (uint64, error) {
+	var b [8]byte
+	if _, err := t.bitmap.ReadAt(b[:], int64(pfn/64*8)); err != nil {
+		return 0, fmt.Errorf("read %s: %w", bitmapPath, err)
+	}
+
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+// mark marks the pages pfns idle, setting their bits word by word.
+func (t *Tracker) mark(pfns []uint64) error {
+	words := map[uint64]uint64{}
+
+	for _, pfn := range pfns {
+		if pfn != 0 {
+			words[pfn/64] |= 1 << (pfn % 64)
+		}
+	}
+
+	var b [8]byte
+
+	for w, bits := range words {
+		binary.LittleEndian.PutUint64(b[:], bits)
+
+		if _, err := t.bitmap.WriteAt(b[:], int64(w*8)); err != nil {
+			return fmt.Errorf("write %s: %w", bitmapPath, err)
+		}
+	}
+
+	t.marked = time.Now()
+
+	return nil
+}
+
+// Scan counts the pages accessed since the scan before, or since
+// NewTracker, and marks all pages idle again.
+func (t *Tracker) Scan() (Stats, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pfns, err := t.pfns()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	s := Stats{Pages: len(pfns), Interval: time.Since(t.marked)}
+	words := map[uint64]uint64{}
+
+	for i, pfn := range pfns {
+		t.hot[i] = false
+
+		if pfn == 0 {
+			continue
+		}
+
+		w, ok := words[pfn/64]
+		if !ok {
+			if w, err = t.word(pfn); err != nil {
+				return Stats{}, err
+			}
+
+			words[pfn/64] = w
+		}
+
+		s.Present++
+
+		if w&(1<<(pfn%64)) == 0 {
+			t.hot[i] = true
+			s.Hot++
+		} else {
+			s.Cold++
+		}
+	}
+
+	if err := t.mark(pfns); err != nil {
+		return Stats{}, err
+	}
+
+	t.last = s
+
+	return s, nil
+}
+
+// Last returns the stats of the last scan.
+func (t *Tracker) Last() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.last
+}
+
+// Hot tells whether page i of the area was hot at the last scan.
+func (t *Tracker) Hot(i int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.hot[i]
+}
+
+// HotPages returns how many of n pages of the area from page i were hot at
+// the last scan.
+func (t *Tracker) HotPages(i, n int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hot := 0
+
+	for _, h := range t.hot[i : i+n] {
+		if h {
+			hot++
+		}
+	}
+
+	return hot
+}
+
+// Run scans every interval until done is closed, and returns the error of
+// a scan that fails.
+func (t *Tracker) Run(interval time.Duration, done <-chan struct{}) error {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-tick.C:
+			if _, err := t.Scan(); err != nil {
+				return err
+			}
+		}
+	}
+}
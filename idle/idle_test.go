@@ -0,0 +1,57 @@
+package idle_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/idle"
+)
+
+func TestTracker(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	const pages = 64
+
+	mem, err := syscall.Mmap(-1, 0, pages*4096,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = syscall.Munmap(mem) }()
+
+	// Touch the first half only, so that the second has no physical pages.
+	for i := 0; i < pages/2; i++ {
+		mem[i*4096] = 1
+	}
+
+	tr, err := idle.NewTracker(mem)
+	if errors.Is(err, idle.ErrNoIdleTracking) || errors.Is(err, idle.ErrNoPFN) {
+		t.Skipf("Skipping test since %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tr.Close()
+
+	mem[0] = 2
+
+	s, err := tr.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Pages != pages || s.Present != pages/2 || s.Hot+s.Cold != s.Present || s.Hot < 1 || !tr.Hot(0) {
+		t.Errorf("unexpected stats %v", s)
+	}
+
+	if tr.Last() != s {
+		t.Errorf("Last: got %v, want %v", tr.Last(), s)
+	}
+}
@@ -0,0 +1,72 @@
+package kvm
+
+import "unsafe"
+
+const (
+	kvmGetClock     = 0x8030ae7c
+	kvmSetClock     = 0x4030ae7b
+	kvmKVMClockCtrl = 0xaead
+)
+
+// Features of the kvmclock in EAX of CPUIDFeatures, which KVM always has.
+const (
+	KVMFeatureClocksource       = 1 << 0
+	KVMFeatureClocksource2      = 1 << 3
+	KVMFeatureClocksourceStable = 1 << 24
+)
+
+// MSRs through which the guest points KVM to its pvclock pages, the old
+// ones of KVMFeatureClocksource and the new ones of KVMFeatureClocksource2.
+const (
+	MSRKVMWallClock     = 0x11
+	MSRKVMSystemTime    = 0x12
+	MSRKVMWallClockNew  = 0x4b564d00
+	MSRKVMSystemTimeNew = 0x4b564d01
+)
+
+// Flags of ClockData.
+const (
+	// ClockTSCStable says that the clock is the same on all vcpus.
+	ClockTSCStable = 1 << 1
+	// ClockRealtime says that Realtime is valid, and to SetClock, to add
+	// the time passed since it to Clock.
+	ClockRealtime = 1 << 2
+	// ClockHostTSC says that HostTSC is valid.
+	ClockHostTSC = 1 << 3
+)
+
+// ClockData is struct kvm_clock_data, the kvmclock of a vm in ns.
+type ClockData struct {
+	Clock    uint64
+	Flags    uint32
+	_        uint32
+	Realtime uint64
+	HostTSC  uint64
+	_        [4]uint32
+}
+
+// GetClock gets the kvmclock of a vm, which guests read through their
+// pvclock pages.
+func GetClock(vmFd uintptr) (ClockData, error) {
+	c := ClockData{}
+	_, err := ioctl(vmFd, kvmGetClock, uintptr(unsafe.Pointer(&c)))
+
+	return c, err
+}
+
+// SetClock sets the kvmclock of a vm to c.Clock, e.g. to what GetClock
+// returned before a pause, so that guests do not see the time it took.
+func SetClock(vmFd uintptr, c ClockData) error {
+	_, err := ioctl(vmFd, kvmSetClock, uintptr(unsafe.Pointer(&c)))
+
+	return err
+}
+
+// KVMClockCtrl tells the guest through the pvclock page of a vcpu that the
+// vcpu was stopped, so that it does not take the time for a soft lockup.
+// It fails with EINVAL if the guest has no pvclock page.
+func KVMClockCtrl(vcpuFd uintptr) error {
+	_, err := ioctl(vcpuFd, kvmKVMClockCtrl, 0)
+
+	return err
+}
@@ -0,0 +1,42 @@
+package kvm_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestClock(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SetClock(vmFd, kvm.ClockData{Clock: 1e12}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := kvm.GetClock(vmFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clock goes on from where it was set.
+	if c.Clock < 1e12 || c.Clock > 1e12+10e9 {
+		t.Errorf("got clock %d, want about 1e12", c.Clock)
+	}
+}
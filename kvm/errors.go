@@ -0,0 +1,145 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	// ErrCapabilityMissing indicates an ioctl or a capability that the
+	// kernel does not have: any ioctl failing with ENOTTY, or EnableCap
+	// with EINVAL.
+	ErrCapabilityMissing = errors.New("capability missing")
+
+	// ErrBadVCPU indicates a vCPU ioctl on something else than a vCPU fd,
+	// or a CreateVCPU of an ID that is taken or out of range.
+	ErrBadVCPU = errors.New("bad vCPU")
+)
+
+// ioctlName is the name of an ioctl and the fd it is for: "kvm" for
+// /dev/kvm, "vm" or "vcpu", or "" for several.
+type ioctlName struct {
+	name, fd string
+}
+
+var ioctlNames = map[uintptr]ioctlName{
+	kvmGetAPIVersion:       {"KVM_GET_API_VERSION", "kvm"},
+	kvmCreateVM:            {"KVM_CREATE_VM", "kvm"},
+	kvmGetVCPUMMapSize:     {"KVM_GET_VCPU_MMAP_SIZE", "kvm"},
+	kvmGetSupportedCPUID:   {"KVM_GET_SUPPORTED_CPUID", "kvm"},
+	kvmGetEmulatedCPUID:    {"KVM_GET_EMULATED_CPUID", "kvm"},
+	kvmCheckExtension:      {"KVM_CHECK_EXTENSION", ""},
+	kvmEnableCap:           {"KVM_ENABLE_CAP", ""},
+	kvmGetStatsFD:          {"KVM_GET_STATS_FD", ""},
+	kvmCreateVCPU:          {"KVM_CREATE_VCPU", "vm"},
+	kvmSetUserMemoryRegion: {"KVM_SET_USER_MEMORY_REGION", "vm"},
+	kvmSetUserMemRegion2:   {"KVM_SET_USER_MEMORY_REGION2", "vm"},
+	kvmSetTSSAddr:          {"KVM_SET_TSS_ADDR", "vm"},
+	kvmSetIdentityMapAddr:  {"KVM_SET_IDENTITY_MAP_ADDR", "vm"},
+	kvmCreateIRQChip:       {"KVM_CREATE_IRQCHIP", "vm"},
+	kvmCreatePIT2:          {"KVM_CREATE_PIT2", "vm"},
+	kvmIRQLine:             {"KVM_IRQ_LINE_STATUS", "vm"},
+	kvmSignalMSI:           {"KVM_SIGNAL_MSI", "vm"},
+	kvmSetMSRFilter:        {"KVM_X86_SET_MSR_FILTER", "vm"},
+	kvmSetPMUEventFilter:   {"KVM_SET_PMU_EVENT_FILTER", "vm"},
+	kvmGetDirtyLog:         {"KVM_GET_DIRTY_LOG", "vm"},
+	kvmGetClock:            {"KVM_GET_CLOCK", "vm"},
+	kvmSetClock:            {"KVM_SET_CLOCK", "vm"},
+	kvmKVMClockCtrl:        {"KVM_KVMCLOCK_CTRL", "vcpu"},
+	kvmCreateGuestMemfd:    {"KVM_CREATE_GUEST_MEMFD", "vm"},
+	kvmSetMemoryAttributes: {"KVM_SET_MEMORY_ATTRIBUTES", "vm"},
+	kvmMemoryEncryptOp:     {"KVM_MEMORY_ENCRYPT_OP", "vm"},
+	kvmMemEncryptRegRegion: {"KVM_MEMORY_ENCRYPT_REG_REGION", "vm"},
+	kvmMemEncUnregRegion:   {"KVM_MEMORY_ENCRYPT_UNREG_REGION", "vm"},
+	kvmRun:                 {"KVM_RUN", "vcpu"},
+	kvmGetRegs:             {"KVM_GET_REGS", "vcpu"},
+	kvmTranslate:           {"KVM_TRANSLATE", "vcpu"},
+	kvmSetRegs:             {"KVM_SET_REGS", "vcpu"},
+	kvmGetSregs:            {"KVM_GET_SREGS", "vcpu"},
+	kvmSetSregs:            {"KVM_SET_SREGS", "vcpu"},
+	kvmGetSregs2:           {"KVM_GET_SREGS2", "vcpu"},
+	kvmSetSregs2:           {"KVM_SET_SREGS2", "vcpu"},
+	kvmSetCPUID2:           {"KVM_SET_CPUID2", "vcpu"},
+	kvmGetMSRs:             {"KVM_GET_MSRS", "vcpu"},
+	kvmSetMSRs:             {"KVM_SET_MSRS", "vcpu"},
+	kvmGetOneReg:           {"KVM_GET_ONE_REG", "vcpu"},
+	kvmSetOneReg:           {"KVM_SET_ONE_REG", "vcpu"},
+	kvmSetSignalMask:       {"KVM_SET_SIGNAL_MASK", "vcpu"},
+	kvmGetVCPUEvents:       {"KVM_GET_VCPU_EVENTS", "vcpu"},
+	kvmSetVCPUEvents:       {"KVM_SET_VCPU_EVENTS", "vcpu"},
+	kvmGetMPState:          {"KVM_GET_MP_STATE", "vcpu"},
+	kvmSetMPState:          {"KVM_SET_MP_STATE", "vcpu"},
+	kvmGetRegList:          {"KVM_GET_REG_LIST", "vcpu"},
+	IIOW(0x9b, unsafe.Sizeof(DebugControl{})): {"KVM_SET_GUEST_DEBUG", "vcpu"},
+}
+
+// IoctlError is a failed ioctl, with what it was and what fd it was on.
+type IoctlError struct {
+	// Op is the ioctl, e.g. "KVM_SET_CPUID2", or its number if unknown.
+	Op string
+	// Fd is the fd, which Error reports as "kvm" for /dev/kvm, "vm",
+	// "vcpu N", or "fd N" for anything else.
+	Fd    uintptr
+	Errno syscall.Errno
+
+	// want is the fd the ioctl is for, see ioctlName.
+	want string
+}
+
+func newIoctlError(fd, op uintptr, errno syscall.Errno) *IoctlError {
+	n, ok := ioctlNames[op]
+	if !ok {
+		n.name = fmt.Sprintf("ioctl %#x", op)
+	}
+
+	return &IoctlError{Op: n.name, Fd: fd, Errno: errno, want: n.fd}
+}
+
+// fdRole tells what fd is by the file it refers to. It is only looked up
+// when an error is reported, as some ioctls fail all the time, such as
+// KVM_RUN with EINTR.
+func fdRole(fd uintptr) string {
+	path, err := os.Readlink("/proc/self/fd/" + strconv.FormatUint(uint64(fd), 10))
+
+	switch {
+	case err != nil:
+		return fmt.Sprintf("fd %d", fd)
+	case path == "/dev/kvm":
+		return "kvm"
+	case path == "anon_inode:kvm-vm":
+		return "vm"
+	case strings.HasPrefix(path, "anon_inode:kvm-vcpu:"):
+		return "vcpu " + strings.TrimPrefix(path, "anon_inode:kvm-vcpu:")
+	default:
+		return fmt.Sprintf("fd %d (%s)", fd, path)
+	}
+}
+
+func (e *IoctlError) Error() string {
+	return fmt.Sprintf("%s on %s: %v", e.Op, fdRole(e.Fd), e.Errno)
+}
+
+func (e *IoctlError) Unwrap() error {
+	return e.Errno
+}
+
+// Is matches ErrCapabilityMissing and ErrBadVCPU, on top of the errno.
+func (e *IoctlError) Is(target error) bool {
+	switch target {
+	case ErrCapabilityMissing:
+		return e.Errno == syscall.ENOTTY || (e.Op == "KVM_ENABLE_CAP" && e.Errno == syscall.EINVAL)
+	case ErrBadVCPU:
+		if e.Op == "KVM_CREATE_VCPU" {
+			return e.Errno == syscall.EEXIST || e.Errno == syscall.EINVAL
+		}
+
+		return e.want == "vcpu" && (e.Errno == syscall.EBADF || !strings.HasPrefix(fdRole(e.Fd), "vcpu"))
+	}
+
+	return false
+}
@@ -0,0 +1,55 @@
+package kvm_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestIoctlError(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kvm.CreateVCPU(vmFd, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = kvm.CreateVCPU(vmFd, 0)
+
+	var ioctlErr *kvm.IoctlError
+	if !errors.As(err, &ioctlErr) || ioctlErr.Op != "KVM_CREATE_VCPU" || ioctlErr.Fd != vmFd ||
+		!strings.Contains(err.Error(), "KVM_CREATE_VCPU on vm") ||
+		!errors.Is(err, syscall.EEXIST) || !errors.Is(err, kvm.ErrBadVCPU) {
+		t.Errorf("CreateVCPU of a taken ID: got %v", err)
+	}
+
+	// A vCPU ioctl on the vm.
+	_, err = kvm.GetRegs(vmFd)
+	if !errors.Is(err, kvm.ErrBadVCPU) || !strings.Contains(err.Error(), "KVM_GET_REGS on vm") {
+		t.Errorf("GetRegs on the vm: got %v", err)
+	}
+
+	err = kvm.EnableCap(vmFd, &kvm.EnableCapability{Cap: 0xffff})
+	if !errors.Is(err, kvm.ErrCapabilityMissing) || errors.Is(err, kvm.ErrBadVCPU) {
+		t.Errorf("EnableCap of an unknown capability: got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package kvm
+
+import "strconv"
+
+// exitTypeNames are the names of the exit types by value. The stringer
+// tool fails on this package, so they are kept by hand; TestExitTypeNames
+// checks them against the KVM_EXIT_* of the kernel headers.
+var exitTypeNames = [...]string{
+	EXITUNKNOWN:        "EXITUNKNOWN",
+	EXITEXCEPTION:      "EXITEXCEPTION",
+	EXITIO:             "EXITIO",
+	EXITHYPERCALL:      "EXITHYPERCALL",
+	EXITDEBUG:          "EXITDEBUG",
+	EXITHLT:            "EXITHLT",
+	EXITMMIO:           "EXITMMIO",
+	EXITIRQWINDOWOPEN:  "EXITIRQWINDOWOPEN",
+	EXITSHUTDOWN:       "EXITSHUTDOWN",
+	EXITFAILENTRY:      "EXITFAILENTRY",
+	EXITINTR:           "EXITINTR",
+	EXITSETTPR:         "EXITSETTPR",
+	EXITTPRACCESS:      "EXITTPRACCESS",
+	EXITS390SIEIC:      "EXITS390SIEIC",
+	EXITS390RESET:      "EXITS390RESET",
+	EXITDCR:            "EXITDCR",
+	EXITNMI:            "EXITNMI",
+	EXITINTERNALERROR:  "EXITINTERNALERROR",
+	EXITOSI:            "EXITOSI",
+	EXITPAPRHCALL:      "EXITPAPRHCALL",
+	EXITS390UCONTROL:   "EXITS390UCONTROL",
+	EXITWATCHDOG:       "EXITWATCHDOG",
+	EXITS390TSCH:       "EXITS390TSCH",
+	EXITEPR:            "EXITEPR",
+	EXITSYSTEMEVENT:    "EXITSYSTEMEVENT",
+	EXITS390STSI:       "EXITS390STSI",
+	EXITIOAPICEOI:      "EXITIOAPICEOI",
+	EXITHYPERV:         "EXITHYPERV",
+	EXITARMNISV:        "EXITARMNISV",
+	EXITX86RDMSR:       "EXITX86RDMSR",
+	EXITX86WRMSR:       "EXITX86WRMSR",
+	EXITDIRTYRINGFULL:  "EXITDIRTYRINGFULL",
+	EXITAPRESETHOLD:    "EXITAPRESETHOLD",
+	EXITX86BUSLOCK:     "EXITX86BUSLOCK",
+	EXITXEN:            "EXITXEN",
+	EXITRISCVSBI:       "EXITRISCVSBI",
+	EXITRISCVCSR:       "EXITRISCVCSR",
+	EXITNOTIFY:         "EXITNOTIFY",
+	EXITLOONGARCHIOCSR: "EXITLOONGARCHIOCSR",
+	EXITMEMORYFAULT:    "EXITMEMORYFAULT",
+	EXITTDX:            "EXITTDX",
+}
+
+func (i ExitType) String() string {
+	if i < ExitType(len(exitTypeNames)) && exitTypeNames[i] != "" {
+		return exitTypeNames[i]
+	}
+
+	return "ExitType(" + strconv.FormatUint(uint64(i), 10) + ")"
+}
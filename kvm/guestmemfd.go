@@ -0,0 +1,77 @@
+package kvm
+
+import (
+	"unsafe"
+)
+
+// MemGuestMemfd is the flag of a UserspaceMemoryRegion2 backed by a
+// guest_memfd for the pages that are private to the guest.
+const MemGuestMemfd = 1 << 2
+
+// MemoryAttributePrivate marks guest memory for SetMemoryAttributes as
+// private, i.e. backed by the guest_memfd of its slot instead of userspace.
+const MemoryAttributePrivate = 1 << 3
+
+// createGuestMemfd is struct kvm_create_guest_memfd.
+type createGuestMemfd struct {
+	Size  uint64
+	Flags uint64
+	_     [6]uint64
+}
+
+// UserspaceMemoryRegion2 is a UserspaceMemoryRegion that can in addition
+// take private pages from GuestMemfd at GuestMemfdOffset, with the
+// MemGuestMemfd flag.
+type UserspaceMemoryRegion2 struct {
+	Slot             uint32
+	Flags            uint32
+	GuestPhysAddr    uint64
+	MemorySize       uint64
+	UserspaceAddr    uint64
+	GuestMemfdOffset uint64
+	GuestMemfd       uint32
+	_                uint32
+	_                [14]uint64
+}
+
+// memoryAttributes is struct kvm_memory_attributes.
+type memoryAttributes struct {
+	Address    uint64
+	Size       uint64
+	Attributes uint64
+	Flags      uint64
+}
+
+// CreateGuestMemfd creates a file of size bytes of guest memory that
+// userspace cannot map, for memory regions of the vm. The VM type must
+// support it, see CapGuestMemfd.
+func CreateGuestMemfd(vmFd uintptr, size, flags uint64) (uintptr, error) {
+	gmem := createGuestMemfd{Size: size, Flags: flags}
+
+	return ioctl(vmFd, uintptr(kvmCreateGuestMemfd), uintptr(unsafe.Pointer(&gmem)))
+}
+
+// SetUserMemoryRegion2 adds a memory region to a vm like
+// SetUserMemoryRegion, and may back it with a guest_memfd.
+func SetUserMemoryRegion2(vmFd uintptr, region *UserspaceMemoryRegion2) error {
+	_, err := ioctl(vmFd, uintptr(kvmSetUserMemRegion2), uintptr(unsafe.Pointer(region)))
+
+	return err
+}
+
+// SetMemoryAttributes sets the attributes of size bytes of guest memory at
+// addr, both page aligned. With MemoryAttributePrivate the guest accesses
+// the guest_memfd of the slot there, and otherwise its userspace memory.
+func SetMemoryAttributes(vmFd uintptr, addr, size, attributes uint64) error {
+	attrs := memoryAttributes{Address: addr, Size: size, Attributes: attributes}
+	_, err := ioctl(vmFd, uintptr(kvmSetMemoryAttributes), uintptr(unsafe.Pointer(&attrs)))
+
+	return err
+}
+
+// MemoryFault interprets EXITMEMORYFAULT, by unpacking RunData.Data[0:3]:
+// the guest accessed size bytes at gpa, and flags has MemoryAttributePrivate
+// if it did so as private memory, which the attributes do not match.
+func (r *RunData) MemoryFault() (flags, gpa, size uint64) {
+	return r.Data[0], r.Data[1], r.Data[2]
+}
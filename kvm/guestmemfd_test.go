@@ -0,0 +1,125 @@
+package kvm_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestGuestMemfd(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	if size := unsafe.Sizeof(kvm.UserspaceMemoryRegion2{}); size != 160 {
+		t.Fatalf("UserspaceMemoryRegion2 size: got %d, want 160", size)
+	}
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	types, err := kvm.CheckExtension(devKVM.Fd(), kvm.CapVMTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The guest reads the fresh guest_memfd page while it is private, and
+	// what userspace wrote once it is shared. Without a VM type that has
+	// private memory, a region with a guest_memfd is only shared.
+	type testCase struct {
+		attributes uint64
+		al         uint64
+	}
+
+	vmType := uint64(kvm.VMTypeDefault)
+	tcs := []testCase{{0, 0x42}}
+
+	if types&(1<<kvm.VMTypeSWProtected) != 0 {
+		vmType = kvm.VMTypeSWProtected
+		tcs = []testCase{{kvm.MemoryAttributePrivate, 0}, {0, 0x42}}
+	}
+
+	vmFd, err := kvm.CreateVMWithType(devKVM.Fd(), vmType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := kvm.CheckExtension(vmFd, kvm.CapGuestMemfd); err != nil || ok == 0 {
+		t.Skipf("Skipping test since KVM_CAP_GUEST_MEMFD is %d, %v", ok, err)
+	}
+
+	mem, err := syscall.Mmap(-1, 0, 0x2000, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mov al, [0x1000]
+	// hlt
+	copy(mem, []byte{0xa0, 0x00, 0x10, 0xf4})
+	mem[0x1000] = 0x42
+
+	gmem, err := kvm.CreateGuestMemfd(vmFd, 0x2000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer syscall.Close(int(gmem))
+
+	if err := kvm.SetUserMemoryRegion2(vmFd, &kvm.UserspaceMemoryRegion2{
+		Slot: 0, Flags: kvm.MemGuestMemfd, GuestPhysAddr: 0, MemorySize: 0x2000,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+		GuestMemfd:    uint32(gmem),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sregs, err := kvm.GetSregs(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sregs.CS.Base, sregs.CS.Selector = 0, 0
+
+	if err := kvm.SetSregs(vcpuFd, sregs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range tcs {
+		if vmType != kvm.VMTypeDefault {
+			if err := kvm.SetMemoryAttributes(vmFd, 0x1000, 0x1000, tc.attributes); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := kvm.SetRegs(vcpuFd, kvm.Regs{RFLAGS: 0x2}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := kvm.Run(vcpuFd); err != nil {
+			t.Fatal(err)
+		}
+
+		regs, err := kvm.GetRegs(vcpuFd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if al := regs.RAX & 0xff; al != tc.al {
+			t.Errorf("attributes %#x: got %#x, want %#x", tc.attributes, al, tc.al)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package kvm
 
 import (
 	"errors"
+	"fmt"
 	"syscall"
 	"unsafe"
 )
@@ -16,53 +17,113 @@ const (
 	kvmSetSregs            = 0x4138ae84
 	kvmGetRegs             = 0x8090ae81
 	kvmSetRegs             = 0x4090ae82
+	kvmGetSregs2           = 0x8140aecc
+	kvmSetSregs2           = 0x4140aecd
 	kvmSetUserMemoryRegion = 1075883590
 	kvmSetTSSAddr          = 0xae47
 	kvmSetIdentityMapAddr  = 0x4008AE48
 	kvmCreateIRQChip       = 0xAE60
 	kvmCreatePIT2          = 0x4040AE77
 	kvmGetSupportedCPUID   = 0xC008AE05
+	kvmGetEmulatedCPUID    = 0xc008ae09
 	kvmSetCPUID2           = 0x4008AE90
 	kvmIRQLine             = 0xc008ae67
+	kvmSignalMSI           = 0x4020aea5
+	kvmEnableCap           = 0x4068aea3
+	kvmSetMSRFilter        = 0x4188aec6
+	kvmGetMSRs             = 0xc008ae88
+	kvmSetMSRs             = 0x4008ae89
+	kvmSetPMUEventFilter   = 0x4020aeb2
+	kvmGetOneReg           = 0x4010aeab
+	kvmSetOneReg           = 0x4010aeac
+	kvmGetDirtyLog         = 0x4010ae42
+	kvmCheckExtension      = 0xae03
+	kvmSetSignalMask       = 0x4004ae8b
+	kvmGetVCPUEvents       = 0x8040ae9f
+	kvmSetVCPUEvents       = 0x4040aea0
+	kvmGetMPState          = 0x8004ae98
+	kvmSetMPState          = 0x4004ae99
+	kvmGetRegList          = 0xc008aeb0
+	kvmCreateGuestMemfd    = 0xc040aed4
+	kvmSetUserMemRegion2   = 0x40a0ae49
+	kvmSetMemoryAttributes = 0x4020aed2
+	kvmMemoryEncryptOp     = 0xc008aeba
+	kvmMemEncryptRegRegion = 0x8010aebb
+	kvmMemEncUnregRegion   = 0x8010aebc
 )
 
-// ExitType is a virtual machine exit type.
+// ExitType is a virtual machine exit type, the KVM_EXIT_* of the kernel
+// without underscores.
 type ExitType uint
 
-// fails: go :    generate stringer -type=ExitType
-// This generate causes a well-documented internal error in the stringer, first reported
-// in 2015, seemingly never fixed.
-// So, instead we took this piece of the file, generated the stringer in another directory, and
-// brought it back. Yuck!
 const (
-	EXITUNKNOWN       ExitType = 0
-	EXITEXCEPTION     ExitType = 1
-	EXITIO            ExitType = 2
-	EXITHYPERCALL     ExitType = 3
-	EXITDEBUG         ExitType = 4
-	EXITHLT           ExitType = 5
-	EXITMMIO          ExitType = 6
-	EXITIRQWINDOWOPEN ExitType = 7
-	EXITSHUTDOWN      ExitType = 8
-	EXITFAILENTRY     ExitType = 9
-	EXITINTR          ExitType = 10
-	EXITSETTPR        ExitType = 11
-	EXITTPRACCESS     ExitType = 12
-	EXITS390SIEIC     ExitType = 13
-	EXITS390RESET     ExitType = 14
-	EXITDCR           ExitType = 15
-	EXITNMI           ExitType = 16
-	EXITINTERNALERROR ExitType = 17
+	EXITUNKNOWN        ExitType = 0
+	EXITEXCEPTION      ExitType = 1
+	EXITIO             ExitType = 2
+	EXITHYPERCALL      ExitType = 3
+	EXITDEBUG          ExitType = 4
+	EXITHLT            ExitType = 5
+	EXITMMIO           ExitType = 6
+	EXITIRQWINDOWOPEN  ExitType = 7
+	EXITSHUTDOWN       ExitType = 8
+	EXITFAILENTRY      ExitType = 9
+	EXITINTR           ExitType = 10
+	EXITSETTPR         ExitType = 11
+	EXITTPRACCESS      ExitType = 12
+	EXITS390SIEIC      ExitType = 13
+	EXITS390RESET      ExitType = 14
+	EXITDCR            ExitType = 15
+	EXITNMI            ExitType = 16
+	EXITINTERNALERROR  ExitType = 17
+	EXITOSI            ExitType = 18
+	EXITPAPRHCALL      ExitType = 19
+	EXITS390UCONTROL   ExitType = 20
+	EXITWATCHDOG       ExitType = 21
+	EXITS390TSCH       ExitType = 22
+	EXITEPR            ExitType = 23
+	EXITSYSTEMEVENT    ExitType = 24
+	EXITS390STSI       ExitType = 25
+	EXITIOAPICEOI      ExitType = 26
+	EXITHYPERV         ExitType = 27
+	EXITARMNISV        ExitType = 28
+	EXITX86RDMSR       ExitType = 29
+	EXITX86WRMSR       ExitType = 30
+	EXITDIRTYRINGFULL  ExitType = 31
+	EXITAPRESETHOLD    ExitType = 32
+	EXITX86BUSLOCK     ExitType = 33
+	EXITXEN            ExitType = 34
+	EXITRISCVSBI       ExitType = 35
+	EXITRISCVCSR       ExitType = 36
+	EXITNOTIFY         ExitType = 37
+	EXITLOONGARCHIOCSR ExitType = 38
+	EXITMEMORYFAULT    ExitType = 39
+	EXITTDX            ExitType = 40
 
 	EXITIOIN  = 0
 	EXITIOOUT = 1
 )
 
+// Types of EXITSYSTEMEVENT, as returned by RunData.SystemEvent.
 const (
-	numInterrupts   = 0x100
-	CPUIDFeatures   = 0x40000001
-	CPUIDSignature  = 0x40000000
-	CPUIDFuncPerMon = 0x0A
+	SystemEventShutdown = 1
+	SystemEventReset    = 2
+	SystemEventCrash    = 3
+	SystemEventWakeup   = 4
+	SystemEventSuspend  = 5
+	SystemEventSEVTerm  = 6
+)
+
+const (
+	numInterrupts        = 0x100
+	CPUIDFeatures        = 0x40000001
+	CPUIDSignature       = 0x40000000
+	CPUIDFuncPerMon      = 0x0A
+	CPUIDFuncExtFeatures = 0x07
+	CPUIDFuncSGX         = 0x12
+
+	// CPUIDFlagSignificantIndex marks a CPUIDEntry2 of a function whose
+	// Index, the subleaf in ECX, selects among several entries.
+	CPUIDFlagSignificantIndex = 1
 )
 
 var ErrUnexpectedEXITReason = errors.New("unexpected kvm exit reason")
@@ -112,6 +173,33 @@ type Sregs struct {
 	InterruptBitmap [(numInterrupts + 63) / 64]uint64
 }
 
+// Sregs2 are Sregs with the PDPTRs of PAE paging instead of the interrupt
+// bitmap, so that a vcpu using PAE can be saved and restored exactly.
+type Sregs2 struct {
+	CS       Segment
+	DS       Segment
+	ES       Segment
+	FS       Segment
+	GS       Segment
+	SS       Segment
+	TR       Segment
+	LDT      Segment
+	GDT      Descriptor
+	IDT      Descriptor
+	CR0      uint64
+	CR2      uint64
+	CR3      uint64
+	CR4      uint64
+	CR8      uint64
+	EFER     uint64
+	ApicBase uint64
+	Flags    uint64
+	PDPTRs   [4]uint64
+}
+
+// Sregs2PDPTRsValid in Sregs2.Flags means PDPTRs holds the PDPTRs in use.
+const Sregs2PDPTRsValid = 1 << 0
+
 // Segment is an x86 segment descriptor.
 type Segment struct {
 	Base     uint64
@@ -144,10 +232,108 @@ type RunData struct {
 	ExitReason                 uint32
 	ReadyForInterruptInjection uint8
 	IfFlag                     uint8
-	_                          [2]uint8
+	Flags                      uint16
 	CR8                        uint64
 	ApicBase                   uint64
 	Data                       [32]uint64
+
+	// With CapSyncRegs, KVM stores the registers selected by ValidRegs
+	// in SyncRegs at every exit, and loads those selected by DirtyRegs
+	// before it enters the guest.
+	ValidRegs uint64
+	DirtyRegs uint64
+	SyncRegs  SyncRegs
+}
+
+// SyncRegs is struct kvm_sync_regs.
+type SyncRegs struct {
+	Regs   Regs
+	Sregs  Sregs
+	Events VCPUEvents
+}
+
+// Registers for RunData.ValidRegs and DirtyRegs.
+const (
+	SyncX86Regs   = 1 << 0
+	SyncX86Sregs  = 1 << 1
+	SyncX86Events = 1 << 2
+)
+
+// VCPUEvents are the pending or injected exceptions, interrupts, NMIs and
+// SMIs of a vcpu, struct kvm_vcpu_events.
+type VCPUEvents struct {
+	Exception struct {
+		Injected     uint8
+		Nr           uint8
+		HasErrorCode uint8
+		Pending      uint8
+		ErrorCode    uint32
+	}
+	Interrupt struct {
+		Injected uint8
+		Nr       uint8
+		Soft     uint8
+		Shadow   uint8
+	}
+	NMI struct {
+		Injected uint8
+		Pending  uint8
+		Masked   uint8
+		_        uint8
+	}
+	SIPIVector uint32
+	Flags      uint32
+	SMI        struct {
+		SMM          uint8
+		Pending      uint8
+		SMMInsideNMI uint8
+		LatchedInit  uint8
+	}
+	TripleFaultPending  uint8
+	_                   [26]uint8
+	ExceptionHasPayload uint8
+	ExceptionPayload    uint64
+}
+
+// GetVCPUEvents gets the pending and injected events of a vcpu.
+func GetVCPUEvents(vcpuFd uintptr) (VCPUEvents, error) {
+	events := VCPUEvents{}
+	_, err := ioctl(vcpuFd, kvmGetVCPUEvents, uintptr(unsafe.Pointer(&events)))
+
+	return events, err
+}
+
+// SetVCPUEvents sets the pending and injected events of a vcpu. Flags
+// select which of the optional fields are valid.
+func SetVCPUEvents(vcpuFd uintptr, events VCPUEvents) error {
+	_, err := ioctl(vcpuFd, kvmSetVCPUEvents, uintptr(unsafe.Pointer(&events)))
+
+	return err
+}
+
+// MP states of a vcpu, KVM_MP_STATE_*.
+const (
+	MPStateRunnable      = 0
+	MPStateUninitialized = 1
+	MPStateInitReceived  = 2
+	MPStateHalted        = 3
+	MPStateSIPIReceived  = 4
+)
+
+// GetMPState gets the MP state of a vcpu, e.g. MPStateUninitialized for an
+// AP waiting for INIT and SIPI.
+func GetMPState(vcpuFd uintptr) (uint32, error) {
+	state := uint32(0)
+	_, err := ioctl(vcpuFd, kvmGetMPState, uintptr(unsafe.Pointer(&state)))
+
+	return state, err
+}
+
+// SetMPState sets the MP state of a vcpu.
+func SetMPState(vcpuFd uintptr, state uint32) error {
+	_, err := ioctl(vcpuFd, kvmSetMPState, uintptr(unsafe.Pointer(&state)))
+
+	return err
 }
 
 // IO interprets IO requests from a VM, by unpacking RunData.Data[0:1].
@@ -161,6 +347,75 @@ func (r *RunData) IO() (uint64, uint64, uint64, uint64, uint64) {
 	return direction, size, port, count, offset
 }
 
+// MMIO interprets MMIO requests from a VM, by unpacking RunData.Data[0:3].
+// data is backed by the run structure and holds length bytes: the guest's
+// value for a write, and where the value goes for a read.
+func (r *RunData) MMIO() (physAddr uint64, data []byte, length uint32, isWrite bool) {
+	physAddr = r.Data[0]
+	length = uint32(r.Data[2] & 0xFFFFFFFF)
+	isWrite = (r.Data[2]>>32)&0xFF != 0
+
+	if length > 8 {
+		length = 8
+	}
+
+	data = (*[8]byte)(unsafe.Pointer(&r.Data[1]))[:length]
+
+	return physAddr, data, length, isWrite
+}
+
+// SystemEvent interprets system events from a VM, by unpacking RunData.Data[0:2].
+// flags is the first word of the event data, which older kernels call flags.
+func (r *RunData) SystemEvent() (typ uint32, flags uint64) {
+	return uint32(r.Data[0] & 0xFFFFFFFF), r.Data[1]
+}
+
+// MSR interprets RDMSR and WRMSR exits from a VM, by unpacking RunData.Data[0:3].
+// data is the value the guest writes for WRMSR.
+func (r *RunData) MSR() (index uint32, data uint64, reason uint32) {
+	return uint32(r.Data[1] >> 32), r.Data[2], uint32(r.Data[1] & 0xFFFFFFFF)
+}
+
+// SetMSRResult completes an RDMSR exit with data, or makes either MSR exit
+// inject a #GP into the guest if fail is set.
+func (r *RunData) SetMSRResult(data uint64, fail bool) {
+	r.Data[0] &^= 0xFF
+	if fail {
+		r.Data[0] |= 1
+	}
+
+	r.Data[2] = data
+}
+
+// Hypercalls that exit to userspace once enabled with CapExitHypercall.
+const (
+	// HCMapGPARange asks to make args[1] pages at args[0] private if
+	// args[2] has MapGPARangeEncrypted, and shared otherwise.
+	HCMapGPARange        = 12
+	MapGPARangeEncrypted = 1 << 4
+)
+
+// Hypercall interprets hypercall exits from a VM, by unpacking
+// RunData.Data[0:7].
+func (r *RunData) Hypercall() (nr uint64, args [6]uint64) {
+	copy(args[:], r.Data[1:7])
+
+	return r.Data[0], args
+}
+
+// SetHypercallResult completes a hypercall exit with ret for the guest.
+func (r *RunData) SetHypercallResult(ret uint64) {
+	r.Data[7] = ret
+}
+
+// Flags of a UserspaceMemoryRegion: MemLogDirtyPages has KVM log the pages
+// that the guest writes, see GetDirtyLog, and MemReadonly makes guest writes
+// exit as MMIO.
+const (
+	MemLogDirtyPages = 1 << 0
+	MemReadonly      = 1 << 1
+)
+
 // UserSpaceMemoryRegion defines Memory Regions.
 type UserspaceMemoryRegion struct {
 	Slot          uint32
@@ -173,19 +428,20 @@ type UserspaceMemoryRegion struct {
 // SetMemLogDirtyPages sets region flags to log dirty pages.
 // This is useful in many situations, including migration.
 func (r *UserspaceMemoryRegion) SetMemLogDirtyPages() {
-	r.Flags |= 1 << 0
+	r.Flags |= MemLogDirtyPages
 }
 
 // SetMemReadonly marks a region as read only.
 func (r *UserspaceMemoryRegion) SetMemReadonly() {
-	r.Flags |= 1 << 1
+	r.Flags |= MemReadonly
 }
 
-// ioctl is a convenience function to call ioctl.
+// ioctl is a convenience function to call ioctl. Its errors are
+// *IoctlError.
 func ioctl(fd, op, arg uintptr) (uintptr, error) {
 	res, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, op, arg)
 	if errno != 0 {
-		return res, errno
+		return res, newIoctlError(fd, op, errno)
 	}
 
 	return res, nil
@@ -198,7 +454,24 @@ func GetAPIVersion(kvmFd uintptr) (uintptr, error) {
 
 // CreateVM creates a KVM from the KVM device fd, i.e. /dev/kvm.
 func CreateVM(kvmFd uintptr) (uintptr, error) {
-	return ioctl(kvmFd, uintptr(kvmCreateVM), uintptr(0))
+	return CreateVMWithType(kvmFd, VMTypeDefault)
+}
+
+// VM types for CreateVMWithType. CheckExtension of CapVMTypes returns a
+// bit for each supported one.
+const (
+	VMTypeDefault     = 0
+	VMTypeSWProtected = 1
+	VMTypeSEV         = 2
+	VMTypeSEVES       = 3
+	VMTypeSEVSNP      = 4
+	VMTypeTDX         = 5
+)
+
+// CreateVMWithType creates a KVM of a type other than the default, e.g.
+// one whose memory can be private to the guest.
+func CreateVMWithType(kvmFd uintptr, vmType uint64) (uintptr, error) {
+	return ioctl(kvmFd, uintptr(kvmCreateVM), uintptr(vmType))
 }
 
 // DebugControl controls guest debug.
@@ -249,6 +522,10 @@ func CreateVCPU(vmFd uintptr, vcpuID int) (uintptr, error) {
 }
 
 // Run runs a single vcpu from the vcpufd from createvcpu.
+// When KVM_RUN is interrupted, by a signal not blocked with SetSignalMask
+// or because RunData.ImmediateExit is set, Run returns nil. The exit reason
+// is then EXITINTR only if the vcpu had got as far as the guest, so callers
+// that set ImmediateExit should store EXITINTR in it before each Run.
 func Run(vcpuFd uintptr) error {
 	_, err := ioctl(vcpuFd, uintptr(kvmRun), uintptr(0))
 	if err != nil {
@@ -261,6 +538,23 @@ func Run(vcpuFd uintptr) error {
 	return err
 }
 
+// signalMask is struct kvm_signal_mask with the 64-bit sigset of x86.
+type signalMask struct {
+	Len    uint32
+	Sigset [2]uint32
+}
+
+// SetSignalMask sets the signals blocked while the vcpu is in Run, bit n-1
+// standing for signal n, in place of those of the calling thread. Signals
+// that are not blocked make Run return, which is how another thread kicks
+// a vcpu out of the guest.
+func SetSignalMask(vcpuFd uintptr, mask uint64) error {
+	m := signalMask{Len: 8, Sigset: [2]uint32{uint32(mask), uint32(mask >> 32)}}
+	_, err := ioctl(vcpuFd, kvmSetSignalMask, uintptr(unsafe.Pointer(&m)))
+
+	return err
+}
+
 // GetVCPUMmapSize returns the size of the VCPU region. This size is
 // required for interacting with the vcpu, as the struct size can change
 // over time.
@@ -283,6 +577,23 @@ func SetSregs(vcpuFd uintptr, sregs Sregs) error {
 	return err
 }
 
+// GetSregs2 gets the special registers and PDPTRs for a vcpu.
+// It needs kernel 5.16 or later.
+func GetSregs2(vcpuFd uintptr) (Sregs2, error) {
+	sregs := Sregs2{}
+	_, err := ioctl(vcpuFd, uintptr(kvmGetSregs2), uintptr(unsafe.Pointer(&sregs)))
+
+	return sregs, err
+}
+
+// SetSregs2 sets the special registers for a vcpu, and the PDPTRs if
+// Sregs2PDPTRsValid is set in its flags.
+func SetSregs2(vcpuFd uintptr, sregs Sregs2) error {
+	_, err := ioctl(vcpuFd, uintptr(kvmSetSregs2), uintptr(unsafe.Pointer(&sregs)))
+
+	return err
+}
+
 // GetRegs gets the general purpose registers for a vcpu.
 func GetRegs(vcpuFd uintptr) (Regs, error) {
 	regs := Regs{}
@@ -305,21 +616,241 @@ func SetUserMemoryRegion(vmFd uintptr, region *UserspaceMemoryRegion) error {
 	return err
 }
 
+// dirtyLog is struct kvm_dirty_log.
+type dirtyLog struct {
+	Slot   uint32
+	_      uint32
+	Bitmap uint64
+}
+
+// GetDirtyLog fills bitmap with the pages of a memory slot, one bit per
+// page, written since the last call, and clears their dirty state. The
+// slot needs SetMemLogDirtyPages and bitmap a bit for each of its pages.
+func GetDirtyLog(vmFd uintptr, slot uint32, bitmap []uint64) error {
+	log := dirtyLog{Slot: slot, Bitmap: uint64(uintptr(unsafe.Pointer(&bitmap[0])))}
+	_, err := ioctl(vmFd, uintptr(kvmGetDirtyLog), uintptr(unsafe.Pointer(&log)))
+
+	return err
+}
+
+// Default addresses for SetTSSAddr and SetIdentityMapAddr. They sit just
+// below 4GiB, which is fine as long as no memory region is placed there.
+const (
+	DefaultTSSAddr         = 0xffffd000
+	DefaultIdentityMapAddr = 0xffffc000
+)
+
 // SetTSSAddr sets the Task Segment Selector for a vm.
-func SetTSSAddr(vmFd uintptr) error {
-	_, err := ioctl(vmFd, kvmSetTSSAddr, 0xffffd000)
+// The TSS takes three pages starting at addr, which must not overlap
+// any memory region of the guest.
+func SetTSSAddr(vmFd uintptr, addr uint64) error {
+	_, err := ioctl(vmFd, kvmSetTSSAddr, uintptr(addr))
 
 	return err
 }
 
 // SetIdentityMapAddr sets the address of a 4k-sized-page for a vm.
-func SetIdentityMapAddr(vmFd uintptr) error {
-	var mapAddr uint64 = 0xffffc000
+// Like the TSS, it must not overlap any memory region of the guest.
+func SetIdentityMapAddr(vmFd uintptr, addr uint64) error {
+	mapAddr := addr
 	_, err := ioctl(vmFd, kvmSetIdentityMapAddr, uintptr(unsafe.Pointer(&mapAddr)))
 
 	return err
 }
 
+// Capabilities for CheckExtension and EnableCap.
+const (
+	CapNRVCPUs          = 9
+	CapNRMemSlots       = 10
+	CapIRQRouting       = 25
+	CapMaxVCPUs         = 66
+	CapSyncRegs         = 74
+	CapX2APICAPI        = 129
+	CapNestedState      = 157
+	CapX86UserSpaceMSR  = 188
+	CapX86BusLockExit   = 193
+	CapExitHypercall    = 201
+	CapUserMemory2      = 231
+	CapMemoryAttributes = 233
+	CapGuestMemfd       = 234
+	CapVMTypes          = 235
+)
+
+// CheckExtension returns whether the kvm, vm or vcpu fd supports a
+// capability: 0 if not, and otherwise 1 or a value particular to it.
+func CheckExtension(fd uintptr, c uint32) (int, error) {
+	res, err := ioctl(fd, kvmCheckExtension, uintptr(c))
+
+	return int(res), err
+}
+
+// Reasons for MSR exits, to enable with CapX86UserSpaceMSR.
+const (
+	MSRExitReasonInval   = 1 << 0
+	MSRExitReasonUnknown = 1 << 1
+	MSRExitReasonFilter  = 1 << 2
+)
+
+// Flags of CapX2APICAPI. X2APICAPIUse32BitIDs has interrupts carry the
+// full 32-bit x2APIC IDs, and X2APICAPIDisableBroadcastQuirk stops 0xff
+// from being a broadcast in x2APIC mode, where it is just another ID.
+const (
+	X2APICAPIUse32BitIDs           = 1 << 0
+	X2APICAPIDisableBroadcastQuirk = 1 << 1
+)
+
+// Modes of CapX86BusLockExit. With BusLockDetectionExit, a guest that
+// takes a bus lock, e.g. with a locked access across cache lines, exits
+// with EXITX86BUSLOCK after the instruction, or has RunX86BusLock set in
+// the Flags of the run structure if it exits for another reason.
+const (
+	BusLockDetectionOff  = 1 << 0
+	BusLockDetectionExit = 1 << 1
+
+	RunX86BusLock = 1 << 2
+)
+
+// EnableCapability is the argument of EnableCap, struct kvm_enable_cap.
+type EnableCapability struct {
+	Cap   uint32
+	Flags uint32
+	Args  [4]uint64
+	_     [64]uint8
+}
+
+// EnableCap enables a capability on a vm or a vcpu.
+func EnableCap(fd uintptr, c *EnableCapability) error {
+	_, err := ioctl(fd, kvmEnableCap, uintptr(unsafe.Pointer(c)))
+
+	return err
+}
+
+const (
+	// MSRFilterDefaultAllow lets MSRs outside all ranges through; MSRFilterDefaultDeny
+	// sends them to userspace.
+	MSRFilterDefaultAllow = 0
+	MSRFilterDefaultDeny  = 1
+
+	// MSRFilterRead and MSRFilterWrite select the accesses a range applies to.
+	MSRFilterRead  = 1 << 0
+	MSRFilterWrite = 1 << 1
+
+	msrFilterMaxRanges = 16
+)
+
+// MSRFilterRange covers NMSRs MSRs from Base. A set bit in the bitmap lets the
+// access through to kvm, a clear bit denies it, which exits to userspace
+// with MSRExitReasonFilter enabled.
+type MSRFilterRange struct {
+	Flags  uint32
+	NMSRs  uint32
+	Base   uint32
+	_      uint32
+	Bitmap uint64 // pointer to the bitmap
+}
+
+// MSRFilter is struct kvm_msr_filter.
+type MSRFilter struct {
+	Flags  uint32
+	_      uint32
+	Ranges [msrFilterMaxRanges]MSRFilterRange
+}
+
+// SetMSRFilter sets the MSR filter of a vm. kvm copies the bitmaps.
+func SetMSRFilter(vmFd uintptr, filter *MSRFilter) error {
+	_, err := ioctl(vmFd, kvmSetMSRFilter, uintptr(unsafe.Pointer(filter)))
+
+	return err
+}
+
+// maxMSREntries is how many MSRs GetMSRs and SetMSRs take at once.
+const maxMSREntries = 32
+
+// ErrMSRs indicates MSRs that KVM did not get or set, e.g. unknown ones.
+var ErrMSRs = errors.New("MSRs not processed")
+
+// MSREntry is struct kvm_msr_entry, an MSR and its value.
+type MSREntry struct {
+	Index uint32
+	_     uint32
+	Data  uint64
+}
+
+// msrs is struct kvm_msrs.
+type msrs struct {
+	NMSRs   uint32
+	_       uint32
+	Entries [maxMSREntries]MSREntry
+}
+
+func msrsIoctl(vcpuFd, op uintptr, entries []MSREntry) error {
+	if len(entries) > maxMSREntries {
+		return fmt.Errorf("%w: %d is more than %d at once", ErrMSRs, len(entries), maxMSREntries)
+	}
+
+	m := msrs{NMSRs: uint32(len(entries))}
+	copy(m.Entries[:], entries)
+
+	n, err := ioctl(vcpuFd, op, uintptr(unsafe.Pointer(&m)))
+	if err != nil {
+		return err
+	}
+
+	copy(entries, m.Entries[:])
+
+	if int(n) != len(entries) {
+		return fmt.Errorf("%w: stopped at %#x", ErrMSRs, entries[n].Index)
+	}
+
+	return nil
+}
+
+// GetMSRs reads the Data of the MSRs of entries from a vcpu.
+func GetMSRs(vcpuFd uintptr, entries []MSREntry) error {
+	return msrsIoctl(vcpuFd, kvmGetMSRs, entries)
+}
+
+// SetMSRs writes the MSRs of entries to a vcpu, as the host would rather
+// than the guest, e.g. bits the guest cannot set.
+func SetMSRs(vcpuFd uintptr, entries []MSREntry) error {
+	return msrsIoctl(vcpuFd, kvmSetMSRs, entries)
+}
+
+const (
+	// PMUEventAllow lets the guest program only the listed events;
+	// PMUEventDeny lets it program all but them.
+	PMUEventAllow = 0
+	PMUEventDeny  = 1
+
+	// PMUEventFlagMaskedEvents makes the events masked entries, see
+	// the KVM API documentation.
+	PMUEventFlagMaskedEvents = 1 << 0
+
+	// PMUEventFilterMaxEvents is the limit of kvm on the number of events.
+	PMUEventFilterMaxEvents = 300
+)
+
+// PMUEventFilter is struct kvm_pmu_event_filter. On Intel, an event is
+// the event select in bits 0-7 and the unit mask in bits 8-15, e.g. 0x00c0
+// for instructions retired.
+type PMUEventFilter struct {
+	Action             uint32
+	NEvents            uint32
+	FixedCounterBitmap uint32
+	Flags              uint32
+	_                  [4]uint32
+	Events             [PMUEventFilterMaxEvents]uint64
+}
+
+// SetPMUEventFilter restricts the performance events that the guest of a
+// vm can program. Fixed counters are allowed by the bits set in
+// FixedCounterBitmap with PMUEventAllow, and denied by them with PMUEventDeny.
+func SetPMUEventFilter(vmFd uintptr, filter *PMUEventFilter) error {
+	_, err := ioctl(vmFd, kvmSetPMUEventFilter, uintptr(unsafe.Pointer(filter)))
+
+	return err
+}
+
 // IRQLevel defines an IRQ as Level? Not sure.
 type IRQLevel struct {
 	IRQ   uint32
@@ -338,6 +869,39 @@ func IRQLine(vmFd uintptr, irq, level uint32) error {
 	return err
 }
 
+// MSI is a message signaled interrupt, struct kvm_msi.
+type MSI struct {
+	AddressLo uint32
+	AddressHi uint32
+	Data      uint32
+	Flags     uint32
+	DevID     uint32
+	_         [12]uint8
+}
+
+// msiAddressBase is where MSIs are written to, with the destination APIC
+// ID in bits 19:12.
+const msiAddressBase = 0xfee00000
+
+// NewMSI returns a fixed, edge-triggered MSI of vector to the APIC ID
+// dest. IDs above 0xff go in the upper bits of AddressHi, which only KVM
+// with X2APICAPIUse32BitIDs enabled takes them from.
+func NewMSI(dest uint32, vector uint8) MSI {
+	return MSI{
+		AddressLo: msiAddressBase | (dest&0xff)<<12,
+		AddressHi: dest &^ 0xff,
+		Data:      uint32(vector),
+	}
+}
+
+// SignalMSI injects an MSI and returns whether the guest took it, rather
+// than having it masked.
+func SignalMSI(vmFd uintptr, msi *MSI) (bool, error) {
+	res, err := ioctl(vmFd, kvmSignalMSI, uintptr(unsafe.Pointer(msi)))
+
+	return res > 0, err
+}
+
 // CreateIRQChip creates an IRQ device (chip) to which to attach interrupts?
 func CreateIRQChip(vmFd uintptr) error {
 	_, err := ioctl(vmFd, kvmCreateIRQChip, 0)
@@ -388,6 +952,15 @@ func GetSupportedCPUID(kvmFd uintptr, kvmCPUID *CPUID) error {
 	return err
 }
 
+// GetEmulatedCPUID gets the CPUID entries that KVM can emulate in software
+// whether or not the host has them, e.g. MOVBE or RDPID. They are not in
+// GetSupportedCPUID, as guests get them at a cost of exits.
+func GetEmulatedCPUID(kvmFd uintptr, kvmCPUID *CPUID) error {
+	_, err := ioctl(kvmFd, kvmGetEmulatedCPUID, uintptr(unsafe.Pointer(kvmCPUID)))
+
+	return err
+}
+
 // SetCPUID2 sets entries for a vCPU.
 // The progression is, hence, get the CPUID entries for a vm, then set them into
 // individual vCPUs. This seems odd, but in fact lets code tailor CPUID entries
@@ -397,34 +970,3 @@ func SetCPUID2(vcpuFd uintptr, kvmCPUID *CPUID) error {
 
 	return err
 }
-
-// This has to wait until amd64 support goes in.
-// // Translate is a struct for KVM_TRANSLATE queries.
-// type Translate struct {
-// 	// LinearAddress is input.
-// 	LinearAddress uint64
-
-// 	// This is output
-// 	PhysicalAddress uint64
-// 	Valid           uint8
-// 	Writeable       uint8
-// 	Usermode        uint8
-// 	_               [5]uint8
-// }
-
-// // GetTranslate returns the virtual to physical mapping across all vCPUs.
-// // It is incredibly helpful for debugging at startup and detecting
-// // corrupted page tables.
-// // N.B.: on x86 it appears to ignore vcpufd.
-// func GetTranslate(vcpuFd uintptr, vaddr uint64) (*Translate, error) {
-// 	var (
-// 		kvmTranslate = IIOWR(0x85, 3*8)
-// 		t            = &Translate{LinearAddress: vaddr}
-// 	)
-
-// 	if _, err := ioctl(vcpuFd, kvmTranslate, uintptr(unsafe.Pointer(t))); err != nil {
-// 		return t, err
-// 	}
-
-// 	return t, nil
-// }
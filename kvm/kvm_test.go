@@ -1,11 +1,17 @@
 package kvm_test
 
 import (
+	"bytes"
 	"errors"
 	"math"
 	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/kvm"
@@ -48,11 +54,11 @@ func TestCreateVM(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := kvm.SetTSSAddr(vmFd); err != nil {
+	if err := kvm.SetTSSAddr(vmFd, kvm.DefaultTSSAddr); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := kvm.SetIdentityMapAddr(vmFd); err != nil {
+	if err := kvm.SetIdentityMapAddr(vmFd, kvm.DefaultIdentityMapAddr); err != nil {
 		t.Fatal(err)
 	}
 
@@ -80,6 +86,35 @@ func TestCreateVM(t *testing.T) {
 	}
 }
 
+func TestSetTSSAddrAndIdentityMapAddr(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Place both pages right below 3GiB instead of the defaults.
+	if err := kvm.SetTSSAddr(vmFd, 0xbfffd000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SetIdentityMapAddr(vmFd, 0xbfffc000); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestCPUID(t *testing.T) {
 	if os.Getuid() != 0 {
 		t.Skipf("Skipping test since we are not root")
@@ -329,7 +364,29 @@ func TestAddNum(t *testing.T) {
 			kvm.EXITSETTPR,
 			kvm.EXITSHUTDOWN,
 			kvm.EXITTPRACCESS,
-			kvm.EXITUNKNOWN:
+			kvm.EXITUNKNOWN,
+			kvm.EXITAPRESETHOLD,
+			kvm.EXITARMNISV,
+			kvm.EXITDIRTYRINGFULL,
+			kvm.EXITEPR,
+			kvm.EXITHYPERV,
+			kvm.EXITIOAPICEOI,
+			kvm.EXITLOONGARCHIOCSR,
+			kvm.EXITMEMORYFAULT,
+			kvm.EXITNOTIFY,
+			kvm.EXITOSI,
+			kvm.EXITPAPRHCALL,
+			kvm.EXITRISCVCSR,
+			kvm.EXITRISCVSBI,
+			kvm.EXITS390STSI,
+			kvm.EXITS390TSCH,
+			kvm.EXITS390UCONTROL,
+			kvm.EXITSYSTEMEVENT,
+			kvm.EXITWATCHDOG,
+			kvm.EXITX86BUSLOCK,
+			kvm.EXITX86RDMSR,
+			kvm.EXITX86WRMSR,
+			kvm.EXITXEN:
 			t.Fatalf("Unexpected EXIT REASON = %s\n", kvm.ExitType(run.ExitReason).String())
 		default:
 			t.Fatalf("Unexpected EXIT REASON = %s\n", kvm.ExitType(run.ExitReason).String())
@@ -337,6 +394,248 @@ func TestAddNum(t *testing.T) {
 	}
 }
 
+func TestMMIO(t *testing.T) {
+	t.Parallel()
+
+	run := kvm.RunData{}
+	run.Data[0] = 0xd0000010
+	run.Data[1] = 0x1122334455667788
+	run.Data[2] = 1<<32 | 4
+
+	physAddr, data, length, isWrite := run.MMIO()
+	if physAddr != 0xd0000010 || length != 4 || !isWrite {
+		t.Fatalf("MMIO(): got (%#x, %d, %v)", physAddr, length, isWrite)
+	}
+
+	if !bytes.Equal(data, []byte{0x88, 0x77, 0x66, 0x55}) {
+		t.Fatalf("MMIO() data: got %#v", data)
+	}
+
+	// A read fills data in place.
+	run.Data[2] = 2
+	_, data, _, isWrite = run.MMIO()
+	copy(data, []byte{0xaa, 0xbb})
+
+	if isWrite || run.Data[1] != 0x112233445566bbaa {
+		t.Fatalf("MMIO() read: got isWrite %v, data %#x", isWrite, run.Data[1])
+	}
+}
+
+func TestSystemEvent(t *testing.T) {
+	t.Parallel()
+
+	run := kvm.RunData{}
+	run.Data[0] = 1<<32 | kvm.SystemEventCrash
+	run.Data[1] = 0x8
+
+	if typ, flags := run.SystemEvent(); typ != kvm.SystemEventCrash || flags != 0x8 {
+		t.Fatalf("SystemEvent(): got (%d, %#x), want (%d, 0x8)", typ, flags, kvm.SystemEventCrash)
+	}
+}
+
+func TestMSR(t *testing.T) {
+	t.Parallel()
+
+	run := kvm.RunData{}
+	run.Data[1] = 0x1234<<32 | kvm.MSRExitReasonFilter
+	run.Data[2] = 0x2a
+
+	if index, data, reason := run.MSR(); index != 0x1234 || data != 0x2a || reason != kvm.MSRExitReasonFilter {
+		t.Fatalf("MSR(): got (%#x, %#x, %d), want (0x1234, 0x2a, %d)", index, data, reason, kvm.MSRExitReasonFilter)
+	}
+
+	run.SetMSRResult(0x2b, true)
+
+	if run.Data[0]&0xff != 1 || run.Data[2] != 0x2b {
+		t.Fatalf("SetMSRResult: got error %d, data %#x", run.Data[0]&0xff, run.Data[2])
+	}
+}
+
+func TestSetMSRFilter(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.EnableCap(vmFd, &kvm.EnableCapability{
+		Cap:  kvm.CapX86UserSpaceMSR,
+		Args: [4]uint64{kvm.MSRExitReasonFilter},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	bitmap := [1]byte{}
+	filter := kvm.MSRFilter{Flags: kvm.MSRFilterDefaultAllow}
+	filter.Ranges[0] = kvm.MSRFilterRange{
+		Flags:  kvm.MSRFilterRead | kvm.MSRFilterWrite,
+		NMSRs:  1,
+		Base:   0x1234,
+		Bitmap: uint64(uintptr(unsafe.Pointer(&bitmap[0]))),
+	}
+
+	if err := kvm.SetMSRFilter(vmFd, &filter); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetSetMSRs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IA32_SYSENTER_EIP takes any value.
+	if err := kvm.SetMSRs(vcpuFd, []kvm.MSREntry{{Index: 0x176, Data: 0x1234}}); err != nil {
+		t.Fatal(err)
+	}
+
+	msrs := []kvm.MSREntry{{Index: 0x176}}
+	if err := kvm.GetMSRs(vcpuFd, msrs); err != nil || msrs[0].Data != 0x1234 {
+		t.Fatalf("GetMSRs: got %#x, %v, want 0x1234", msrs[0].Data, err)
+	}
+
+	if err := kvm.SetMSRs(vcpuFd, []kvm.MSREntry{{Index: 0x176}, {Index: 0x12345678}}); !errors.Is(err, kvm.ErrMSRs) {
+		t.Fatalf("SetMSRs of an unknown MSR: got %v, want %v", err, kvm.ErrMSRs)
+	}
+}
+
+func TestNewMSI(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		dest   uint32
+		vector uint8
+		want   kvm.MSI
+	}{
+		{dest: 0, vector: 0x30, want: kvm.MSI{AddressLo: 0xfee00000, Data: 0x30}},
+		{dest: 0xff, vector: 0x31, want: kvm.MSI{AddressLo: 0xfeeff000, Data: 0x31}},
+		{dest: 0x1234, vector: 0x32, want: kvm.MSI{AddressLo: 0xfee34000, AddressHi: 0x1200, Data: 0x32}},
+	} {
+		if got := kvm.NewMSI(tt.dest, tt.vector); got != tt.want {
+			t.Errorf("NewMSI(%#x, %#x): got %+v, want %+v", tt.dest, tt.vector, got, tt.want)
+		}
+	}
+}
+
+func TestSetPMUEventFilter(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := kvm.PMUEventFilter{Action: kvm.PMUEventDeny, NEvents: 2}
+	filter.Events[0] = 0x003c // unhalted core cycles
+	filter.Events[1] = 0x00c0 // instructions retired
+
+	if err := kvm.SetPMUEventFilter(vmFd, &filter); err != nil {
+		t.Fatal(err)
+	}
+
+	filter.Action = 2
+
+	if err := kvm.SetPMUEventFilter(vmFd, &filter); err == nil {
+		t.Fatal("SetPMUEventFilter with an invalid action: got nil, want error")
+	}
+}
+
+func TestSregs2(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unsafe.Sizeof(kvm.Sregs2{}) != 0x140 {
+		t.Fatalf("size of Sregs2: got %#x, want 0x140", unsafe.Sizeof(kvm.Sregs2{}))
+	}
+
+	sregs, err := kvm.GetSregs2(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PAE paging, with the PDPTRs taken from sregs rather than memory.
+	sregs.CR0 |= 0x80000001
+	sregs.CR4 |= 0x20
+	sregs.CR3 = 0x1000
+	sregs.Flags = kvm.Sregs2PDPTRsValid
+	sregs.PDPTRs = [4]uint64{0x2001, 0x3001, 0x4001, 0x5001}
+
+	if err := kvm.SetSregs2(vcpuFd, sregs); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := kvm.GetSregs2(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Flags&kvm.Sregs2PDPTRsValid == 0 || got.PDPTRs != sregs.PDPTRs {
+		t.Fatalf("PDPTRs: got %#x (flags %#x), want %#x", got.PDPTRs, got.Flags, sregs.PDPTRs)
+	}
+}
+
 func TestSetMemLogDirtyPages(t *testing.T) {
 	if os.Getuid() != 0 {
 		t.Skipf("Skipping test since we are not root")
@@ -379,6 +678,35 @@ func TestIRQLine(t *testing.T) {
 	}
 }
 
+func TestGetEmulatedCPUID(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	cpuid := kvm.CPUID{Nent: 100}
+	if err := kvm.GetEmulatedCPUID(devKVM.Fd(), &cpuid); err != nil {
+		t.Fatal(err)
+	}
+
+	// KVM emulates MOVBE on any host.
+	for _, e := range cpuid.Entries[:cpuid.Nent] {
+		if e.Function == 1 && e.Ecx&(1<<22) != 0 {
+			return
+		}
+	}
+
+	t.Errorf("no MOVBE in %+v", cpuid.Entries[:cpuid.Nent])
+}
+
 func TestIoctlStringer(t *testing.T) {
 	t.Parallel()
 
@@ -389,7 +717,11 @@ func TestIoctlStringer(t *testing.T) {
 	}{
 		{name: "First error", val: kvm.EXITUNKNOWN, want: "EXITUNKNOWN"},
 		{name: "Middle error", val: kvm.EXITIO, want: "EXITIO"},
-		{name: "Last error", val: kvm.EXITINTERNALERROR, want: "EXITINTERNALERROR"},
+		{name: "Former last error", val: kvm.EXITINTERNALERROR, want: "EXITINTERNALERROR"},
+		{name: "System event", val: kvm.EXITSYSTEMEVENT, want: "EXITSYSTEMEVENT"},
+		{name: "Bus lock", val: kvm.EXITX86BUSLOCK, want: "EXITX86BUSLOCK"},
+		{name: "Memory fault", val: kvm.EXITMEMORYFAULT, want: "EXITMEMORYFAULT"},
+		{name: "Last error", val: kvm.EXITTDX, want: "EXITTDX"},
 		{name: "Out of range error", val: kvm.ExitType(1024), want: "ExitType(1024)"},
 	} {
 		test := test
@@ -402,3 +734,415 @@ func TestIoctlStringer(t *testing.T) {
 		})
 	}
 }
+
+func TestExitTypeNames(t *testing.T) {
+	t.Parallel()
+
+	h, err := os.ReadFile("/usr/include/linux/kvm.h")
+	if err != nil {
+		t.Skipf("Skipping test since there are no kernel headers: %v", err)
+	}
+
+	// The exit reasons are numbered from KVM_EXIT_UNKNOWN on; other
+	// KVM_EXIT_* defines, e.g. KVM_EXIT_HYPERV_SYNIC, restart from 0 or 1
+	// elsewhere.
+	re := regexp.MustCompile(`(?m)^#define KVM_EXIT_(\w+)\s+(\d+)`)
+	next := -1
+
+	for _, m := range re.FindAllStringSubmatch(string(h), -1) {
+		n, _ := strconv.Atoi(m[2])
+
+		if m[1] == "UNKNOWN" {
+			next = n
+		}
+
+		if n != next {
+			continue
+		}
+
+		next++
+
+		want := "EXIT" + strings.ReplaceAll(m[1], "_", "")
+		if got := kvm.ExitType(n).String(); got != want {
+			t.Errorf("KVM_EXIT_%s: got %s, want %s", m[1], got, want)
+		}
+	}
+
+	if next < int(kvm.EXITNOTIFY) {
+		t.Errorf("found exit reasons up to %d only in kvm.h", next-1)
+	}
+}
+
+func TestGetDirtyLog(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem, err := syscall.Mmap(-1, 0, 0x2000, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mov byte [0x2000], 1
+	// hlt
+	copy(mem, []byte{0xc6, 0x06, 0x00, 0x20, 0x01, 0xf4})
+
+	region := &kvm.UserspaceMemoryRegion{
+		Slot: 0, GuestPhysAddr: 0x1000, MemorySize: 0x2000,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+	}
+	region.SetMemLogDirtyPages()
+
+	if err := kvm.SetUserMemoryRegion(vmFd, region); err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sregs, err := kvm.GetSregs(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sregs.CS.Base, sregs.CS.Selector = 0, 0
+
+	if err := kvm.SetSregs(vcpuFd, sregs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SetRegs(vcpuFd, kvm.Regs{RIP: 0x1000, RFLAGS: 0x2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.Run(vcpuFd); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem[0x1000] != 1 {
+		t.Fatalf("guest write: got %#x, want 1", mem[0x1000])
+	}
+
+	bitmap := make([]uint64, 1)
+
+	if err := kvm.GetDirtyLog(vmFd, 0, bitmap); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the second page was written
+	if bitmap[0] != 0b10 {
+		t.Errorf("dirty log: got %#b, want 0b10", bitmap[0])
+	}
+
+	if err := kvm.GetDirtyLog(vmFd, 0, bitmap); err != nil {
+		t.Fatal(err)
+	}
+
+	if bitmap[0] != 0 {
+		t.Errorf("dirty log after reading it: got %#b, want 0", bitmap[0])
+	}
+}
+
+func TestSyncRegs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// struct kvm_run puts kvm_valid_regs after a 256-byte union at 32.
+	if off := unsafe.Offsetof(kvm.RunData{}.ValidRegs); off != 288 {
+		t.Fatalf("ValidRegs offset: got %d, want 288", off)
+	}
+
+	if size := unsafe.Sizeof(kvm.VCPUEvents{}); size != 64 {
+		t.Fatalf("VCPUEvents size: got %d, want 64", size)
+	}
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regs, err := kvm.CheckExtension(vmFd, kvm.CapSyncRegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := kvm.SyncX86Regs | kvm.SyncX86Events; regs&want != want {
+		t.Skipf("Skipping test since KVM_CAP_SYNC_REGS is %#x", regs)
+	}
+
+	mem, err := syscall.Mmap(-1, 0, 0x1000, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem[0] = 0xf4 // hlt
+
+	if err := kvm.SetUserMemoryRegion(vmFd, &kvm.UserspaceMemoryRegion{
+		Slot: 0, GuestPhysAddr: 0x1000, MemorySize: 0x1000,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mmapSize, err := kvm.GetVCPUMMmapSize(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := syscall.Mmap(int(vcpuFd), 0, int(mmapSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := (*kvm.RunData)(unsafe.Pointer(&r[0]))
+
+	sregs, err := kvm.GetSregs(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sregs.CS.Base, sregs.CS.Selector = 0, 0
+
+	if err := kvm.SetSregs(vcpuFd, sregs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set the registers through the run structure only.
+	run.ValidRegs = kvm.SyncX86Regs | kvm.SyncX86Events
+	run.DirtyRegs = kvm.SyncX86Regs
+	run.SyncRegs.Regs = kvm.Regs{RIP: 0x1000, RAX: 0x1234, RFLAGS: 0x2}
+
+	if err := kvm.Run(vcpuFd); err != nil {
+		t.Fatal(err)
+	}
+
+	if exit := kvm.ExitType(run.ExitReason); exit != kvm.EXITHLT {
+		t.Fatalf("exit: got %v, want %v", exit, kvm.EXITHLT)
+	}
+
+	got, err := kvm.GetRegs(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.RAX != 0x1234 || got.RIP != 0x1001 {
+		t.Errorf("GetRegs: got RAX %#x RIP %#x, want 0x1234 and 0x1001", got.RAX, got.RIP)
+	}
+
+	if run.SyncRegs.Regs != got {
+		t.Errorf("synced regs: got %+v, want %+v", run.SyncRegs.Regs, got)
+	}
+
+	events, err := kvm.GetVCPUEvents(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if run.SyncRegs.Events != events {
+		t.Errorf("synced events: got %+v, want %+v", run.SyncRegs.Events, events)
+	}
+
+	if err := kvm.SetVCPUEvents(vcpuFd, events); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetSignalMask(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem, err := syscall.Mmap(-1, 0, 0x1000, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copy(mem, []byte{0xeb, 0xfe}) // jmp $
+
+	if err := kvm.SetUserMemoryRegion(vmFd, &kvm.UserspaceMemoryRegion{
+		Slot: 0, GuestPhysAddr: 0x1000, MemorySize: 0x1000,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mmapSize, err := kvm.GetVCPUMMmapSize(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := syscall.Mmap(int(vcpuFd), 0, int(mmapSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := (*kvm.RunData)(unsafe.Pointer(&r[0]))
+
+	sregs, err := kvm.GetSregs(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sregs.CS.Base, sregs.CS.Selector = 0, 0
+
+	if err := kvm.SetSregs(vcpuFd, sregs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SetRegs(vcpuFd, kvm.Regs{RIP: 0x1000, RFLAGS: 0x2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only SIGURG gets the vcpu out of the guest.
+	if err := kvm.SetSignalMask(vcpuFd, ^uint64(1<<(syscall.SIGURG-1))); err != nil {
+		t.Fatal(err)
+	}
+
+	tid := make(chan int)
+	done := make(chan error)
+
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		tid <- syscall.Gettid()
+		done <- kvm.Run(vcpuFd)
+	}()
+
+	kick := <-tid
+
+	for {
+		if err := syscall.Tgkill(syscall.Getpid(), kick, syscall.SIGURG); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if exit := kvm.ExitType(run.ExitReason); exit != kvm.EXITINTR {
+				t.Errorf("exit: got %v, want %v", exit, kvm.EXITINTR)
+			}
+
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestHypercall(t *testing.T) {
+	t.Parallel()
+
+	r := kvm.RunData{}
+	r.Data[0] = kvm.HCMapGPARange
+	r.Data[1], r.Data[2], r.Data[3] = 0x100000, 4, kvm.MapGPARangeEncrypted
+
+	nr, args := r.Hypercall()
+	if nr != kvm.HCMapGPARange || args[0] != 0x100000 || args[1] != 4 || args[2] != kvm.MapGPARangeEncrypted {
+		t.Fatalf("Hypercall: got %d %#x", nr, args)
+	}
+
+	r.SetHypercallResult(1)
+
+	if r.Data[7] != 1 {
+		t.Fatalf("result: got %d, want 1", r.Data[7])
+	}
+}
+
+func TestMPState(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kvm.CreateVCPU(vmFd, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// With an in-kernel LAPIC, APs wait for INIT and SIPI.
+	ap, err := kvm.CreateVCPU(vmFd, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := kvm.GetMPState(ap); err != nil || state != kvm.MPStateUninitialized {
+		t.Fatalf("GetMPState: got %d (%v), want %d", state, err, kvm.MPStateUninitialized)
+	}
+
+	if err := kvm.SetMPState(ap, kvm.MPStateRunnable); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := kvm.GetMPState(ap); err != nil || state != kvm.MPStateRunnable {
+		t.Errorf("GetMPState: got %d (%v), want %d", state, err, kvm.MPStateRunnable)
+	}
+}
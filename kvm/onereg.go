@@ -0,0 +1,171 @@
+// the architecture-neutral register interface of KVM_GET_ONE_REG and friends.
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Architectures of a RegID.
+const (
+	RegArchMask = 0xff00000000000000
+	RegGeneric  = 0x0000000000000000
+	RegPPC      = 0x1000000000000000
+	RegX86      = 0x2000000000000000
+	RegARM      = 0x4000000000000000
+	RegS390     = 0x5000000000000000
+	RegARM64    = 0x6000000000000000
+	RegMIPS     = 0x7000000000000000
+	RegRISCV    = 0x8000000000000000
+)
+
+// Sizes of a RegID.
+const (
+	RegSizeShift = 52
+	RegSizeMask  = 0x00f0000000000000
+	RegSizeU8    = 0x0000000000000000
+	RegSizeU16   = 0x0010000000000000
+	RegSizeU32   = 0x0020000000000000
+	RegSizeU64   = 0x0030000000000000
+	RegSizeU128  = 0x0040000000000000
+	RegSizeU256  = 0x0050000000000000
+	RegSizeU512  = 0x0060000000000000
+	RegSizeU1024 = 0x0070000000000000
+	RegSizeU2048 = 0x0080000000000000
+)
+
+// Types of x86 registers, in bits 32 and up of a RegID.
+const (
+	RegX86TypeMSR = 2
+	RegX86TypeKVM = 3
+
+	RegX86KVMGuestSSP = 0
+)
+
+// Core registers of arm64, by their offsets in struct kvm_regs, whose
+// index is the offset in 32-bit words.
+const (
+	RegARM64Core = 0x0010 << 16
+
+	RegARM64X0     = 0
+	RegARM64PC     = 32 * 8
+	RegARM64PState = 33 * 8
+)
+
+var ErrRegSize = errors.New("buffer does not match the register size")
+
+// RegID identifies a register for GetOneReg and SetOneReg.
+type RegID uint64
+
+// NewRegID returns the id of a register of arch with size (one of RegSizeU8...)
+// and the architecture specific index.
+func NewRegID(arch, size, index uint64) RegID {
+	return RegID(arch&RegArchMask | size&RegSizeMask | index&^(RegArchMask|RegSizeMask))
+}
+
+// X86MSR returns the id of an MSR.
+func X86MSR(index uint32) RegID {
+	return NewRegID(RegX86, RegSizeU64, RegX86TypeMSR<<32|uint64(index))
+}
+
+// X86KVMReg returns the id of a register that only KVM has, e.g. RegX86KVMGuestSSP.
+func X86KVMReg(index uint32) RegID {
+	return NewRegID(RegX86, RegSizeU64, RegX86TypeKVM<<32|uint64(index))
+}
+
+// ARM64CoreReg returns the id of the core register at offset, e.g.
+// RegARM64PC, or RegARM64X0 + 8*n for xn.
+func ARM64CoreReg(offset uint64) RegID {
+	return NewRegID(RegARM64, RegSizeU64, RegARM64Core|offset/4)
+}
+
+// Arch returns the architecture of the register.
+func (r RegID) Arch() uint64 {
+	return uint64(r) & RegArchMask
+}
+
+// Size returns the size of the register in bytes.
+func (r RegID) Size() int {
+	return 1 << ((uint64(r) & RegSizeMask) >> RegSizeShift)
+}
+
+// Index returns the architecture specific part of the id.
+func (r RegID) Index() uint64 {
+	return uint64(r) &^ (RegArchMask | RegSizeMask)
+}
+
+func (r RegID) String() string {
+	return fmt.Sprintf("%#x", uint64(r))
+}
+
+// oneReg is struct kvm_one_reg.
+type oneReg struct {
+	ID   uint64
+	Addr uint64
+}
+
+// GetOneReg reads register id of a vcpu into data, which must be as large
+// as the register.
+func GetOneReg(vcpuFd uintptr, id RegID, data []byte) error {
+	return oneRegIoctl(vcpuFd, kvmGetOneReg, id, data)
+}
+
+// SetOneReg writes data to register id of a vcpu.
+func SetOneReg(vcpuFd uintptr, id RegID, data []byte) error {
+	return oneRegIoctl(vcpuFd, kvmSetOneReg, id, data)
+}
+
+func oneRegIoctl(vcpuFd, op uintptr, id RegID, data []byte) error {
+	if len(data) != id.Size() {
+		return fmt.Errorf("%w: %d bytes for %v", ErrRegSize, len(data), id)
+	}
+
+	r := oneReg{ID: uint64(id), Addr: uint64(uintptr(unsafe.Pointer(&data[0])))}
+	_, err := ioctl(vcpuFd, op, uintptr(unsafe.Pointer(&r)))
+
+	return err
+}
+
+// GetOneRegUint64 reads a 64-bit register of a vcpu.
+func GetOneRegUint64(vcpuFd uintptr, id RegID) (uint64, error) {
+	v := uint64(0)
+	err := GetOneReg(vcpuFd, id, (*[8]byte)(unsafe.Pointer(&v))[:])
+
+	return v, err
+}
+
+// SetOneRegUint64 writes a 64-bit register of a vcpu.
+func SetOneRegUint64(vcpuFd uintptr, id RegID, v uint64) error {
+	return SetOneReg(vcpuFd, id, (*[8]byte)(unsafe.Pointer(&v))[:])
+}
+
+// GetRegList returns the ids of the registers of a vcpu that GetOneReg
+// and SetOneReg handle.
+func GetRegList(vcpuFd uintptr) ([]RegID, error) {
+	// struct kvm_reg_list is n followed by the ids. A first call with n = 0
+	// fails with E2BIG and tells how many there are.
+	list := []uint64{0}
+
+	for {
+		_, err := ioctl(vcpuFd, kvmGetRegList, uintptr(unsafe.Pointer(&list[0])))
+		if errors.Is(err, syscall.E2BIG) {
+			list = make([]uint64, 1+list[0])
+			list[0] = uint64(len(list) - 1)
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]RegID, list[0])
+		for i := range ids {
+			ids[i] = RegID(list[1+i])
+		}
+
+		return ids, nil
+	}
+}
@@ -0,0 +1,86 @@
+package kvm_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestRegID(t *testing.T) {
+	t.Parallel()
+
+	id := kvm.X86MSR(0x174)
+
+	if uint64(id) != 0x2030000200000174 {
+		t.Fatalf("X86MSR: got %v, want 0x2030000200000174", id)
+	}
+
+	if id.Arch() != kvm.RegX86 || id.Size() != 8 || id.Index() != 0x200000174 {
+		t.Fatalf("%v: arch %#x, size %d, index %#x", id, id.Arch(), id.Size(), id.Index())
+	}
+
+	// arm64 x0 is a core register of 64 bits
+	id = kvm.NewRegID(kvm.RegARM64, kvm.RegSizeU64, 0x0010_0000)
+	if uint64(id) != 0x6030000000100000 {
+		t.Fatalf("NewRegID: got %v, want 0x6030000000100000", id)
+	}
+
+	if id := kvm.ARM64CoreReg(kvm.RegARM64PC); uint64(id) != 0x6030000000100040 {
+		t.Fatalf("ARM64CoreReg: got %v, want 0x6030000000100040", id)
+	}
+
+	if kvm.NewRegID(kvm.RegRISCV, kvm.RegSizeU128, 0).Size() != 16 {
+		t.Fatal("size of a 128-bit register")
+	}
+
+	if err := kvm.GetOneReg(0, id, make([]byte, 4)); !errors.Is(err, kvm.ErrRegSize) {
+		t.Fatalf("got %v, want %v", err, kvm.ErrRegSize)
+	}
+}
+
+func TestOneReg(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IA32_SYSENTER_CS; x86 has ONE_REG access to MSRs since Linux 6.18.
+	id := kvm.X86MSR(0x174)
+
+	if err := kvm.SetOneRegUint64(vcpuFd, id, 0x10); err != nil {
+		t.Skipf("Skipping test since ONE_REG is not available for MSRs: %v", err)
+	}
+
+	v, err := kvm.GetOneRegUint64(vcpuFd, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != 0x10 {
+		t.Fatalf("IA32_SYSENTER_CS: got %#x, want 0x10", v)
+	}
+
+	if _, err := kvm.GetRegList(vcpuFd); err != nil {
+		t.Fatal(err)
+	}
+}
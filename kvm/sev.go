@@ -0,0 +1,252 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// Commands of MemoryEncryptOp for AMD SEV, enum sev_cmd_id.
+const (
+	SEVCmdInit             = 0
+	SEVCmdESInit           = 1
+	SEVCmdLaunchStart      = 2
+	SEVCmdLaunchUpdateData = 3
+	SEVCmdLaunchUpdateVMSA = 4
+	SEVCmdLaunchSecret     = 5
+	SEVCmdLaunchMeasure    = 6
+	SEVCmdLaunchFinish     = 7
+	SEVCmdGuestStatus      = 10
+	SEVCmdInit2            = 22
+
+	SNPCmdLaunchStart  = 100
+	SNPCmdLaunchUpdate = 101
+	SNPCmdLaunchFinish = 102
+)
+
+// Page types of SNPLaunchUpdate.
+const (
+	SNPPageTypeNormal     = 1
+	SNPPageTypeZero       = 3
+	SNPPageTypeUnmeasured = 4
+	SNPPageTypeSecrets    = 5
+	SNPPageTypeCPUID      = 6
+)
+
+// sevRetInvalidLen is the firmware error for a buffer that is too small,
+// along with the length it needs.
+const sevRetInvalidLen = 0x16
+
+var ErrSEV = errors.New("SEV command failed")
+
+// SEVCmd is struct kvm_sev_cmd. Data points to the parameters of ID, and
+// Error receives the code of the secure processor firmware.
+type SEVCmd struct {
+	ID    uint32
+	_     uint32
+	Data  uint64
+	Error uint32
+	SEVFd uint32
+}
+
+// sevLaunchStart is struct kvm_sev_launch_start.
+type sevLaunchStart struct {
+	Handle      uint32
+	Policy      uint32
+	DHUaddr     uint64
+	DHLen       uint32
+	_           uint32
+	SessionAddr uint64
+	SessionLen  uint32
+	_           uint32
+}
+
+// sevBuffer is struct kvm_sev_launch_update_data and, alike, struct
+// kvm_sev_launch_measure.
+type sevBuffer struct {
+	Uaddr uint64
+	Len   uint32
+	_     uint32
+}
+
+// sevInit is struct kvm_sev_init.
+type sevInit struct {
+	VMSAFeatures uint64
+	Flags        uint32
+	GHCBVersion  uint16
+	_            uint16
+	_            [8]uint32
+}
+
+// snpLaunchStart is struct kvm_sev_snp_launch_start.
+type snpLaunchStart struct {
+	Policy uint64
+	GOSVW  [16]uint8
+	Flags  uint16
+	_      [6]uint8
+	_      [4]uint64
+}
+
+// snpLaunchUpdate is struct kvm_sev_snp_launch_update.
+type snpLaunchUpdate struct {
+	GFNStart uint64
+	Uaddr    uint64
+	Len      uint64
+	Type     uint8
+	_        uint8
+	Flags    uint16
+	_        uint32
+	_        [4]uint64
+}
+
+// snpLaunchFinish is struct kvm_sev_snp_launch_finish.
+type snpLaunchFinish struct {
+	IDBlockUaddr uint64
+	IDAuthUaddr  uint64
+	IDBlockEn    uint8
+	AuthKeyEn    uint8
+	VCEKDisabled uint8
+	HostData     [32]uint8
+	_            [3]uint8
+	Flags        uint16
+	_            [4]uint64
+}
+
+// encRegion is struct kvm_enc_region.
+type encRegion struct {
+	Addr uint64
+	Size uint64
+}
+
+// MemoryEncryptOp runs a memory encryption command on a vm, e.g. of SEV
+// through the secure processor at cmd.SEVFd, usually /dev/sev.
+func MemoryEncryptOp(vmFd uintptr, cmd *SEVCmd) error {
+	_, err := ioctl(vmFd, uintptr(kvmMemoryEncryptOp), uintptr(unsafe.Pointer(cmd)))
+
+	return err
+}
+
+// MemoryEncryptRegRegion pins size bytes of userspace memory at addr, which
+// backs encrypted guest memory, for the life of the vm.
+func MemoryEncryptRegRegion(vmFd uintptr, addr, size uint64) error {
+	r := encRegion{Addr: addr, Size: size}
+	_, err := ioctl(vmFd, uintptr(kvmMemEncryptRegRegion), uintptr(unsafe.Pointer(&r)))
+
+	return err
+}
+
+// MemoryEncryptUnregRegion unpins memory of MemoryEncryptRegRegion.
+func MemoryEncryptUnregRegion(vmFd uintptr, addr, size uint64) error {
+	r := encRegion{Addr: addr, Size: size}
+	_, err := ioctl(vmFd, uintptr(kvmMemEncUnregRegion), uintptr(unsafe.Pointer(&r)))
+
+	return err
+}
+
+// sevOp runs the SEV command id with data as its parameters.
+func sevOp(vmFd, sevFd uintptr, id uint32, data unsafe.Pointer) error {
+	cmd := SEVCmd{ID: id, Data: uint64(uintptr(data)), SEVFd: uint32(sevFd)}
+
+	if err := MemoryEncryptOp(vmFd, &cmd); err != nil {
+		return fmt.Errorf("%w: command %d, firmware error %#x: %v", ErrSEV, id, cmd.Error, err)
+	}
+
+	return nil
+}
+
+// SEVInit makes a vm an SEV guest. It must come before its vcpus.
+func SEVInit(vmFd, sevFd uintptr) error {
+	return sevOp(vmFd, sevFd, SEVCmdInit, nil)
+}
+
+// SEVLaunchStart creates the encryption context of the guest, which runs
+// under policy, and returns its handle.
+func SEVLaunchStart(vmFd, sevFd uintptr, policy uint32) (uint32, error) {
+	start := sevLaunchStart{Policy: policy}
+	err := sevOp(vmFd, sevFd, SEVCmdLaunchStart, unsafe.Pointer(&start))
+
+	return start.Handle, err
+}
+
+// SEVLaunchUpdateData encrypts mem, which backs guest memory, in place
+// and adds it to the launch measurement.
+func SEVLaunchUpdateData(vmFd, sevFd uintptr, mem []byte) error {
+	update := sevBuffer{Uaddr: uint64(uintptr(unsafe.Pointer(&mem[0]))), Len: uint32(len(mem))}
+
+	return sevOp(vmFd, sevFd, SEVCmdLaunchUpdateData, unsafe.Pointer(&update))
+}
+
+// SEVLaunchMeasure returns the launch measurement, with which the guest
+// owner checks what was encrypted before trusting the guest.
+func SEVLaunchMeasure(vmFd, sevFd uintptr) ([]byte, error) {
+	// A first call without a buffer learns its length.
+	measure := sevBuffer{}
+	cmd := SEVCmd{ID: SEVCmdLaunchMeasure, Data: uint64(uintptr(unsafe.Pointer(&measure))), SEVFd: uint32(sevFd)}
+
+	if err := MemoryEncryptOp(vmFd, &cmd); err != nil && cmd.Error != sevRetInvalidLen {
+		return nil, fmt.Errorf("%w: command %d, firmware error %#x: %v", ErrSEV, cmd.ID, cmd.Error, err)
+	}
+
+	if measure.Len == 0 {
+		return nil, fmt.Errorf("%w: empty launch measurement", ErrSEV)
+	}
+
+	buf := make([]byte, measure.Len)
+	measure.Uaddr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+
+	if err := sevOp(vmFd, sevFd, SEVCmdLaunchMeasure, unsafe.Pointer(&measure)); err != nil {
+		return nil, err
+	}
+
+	return buf[:measure.Len], nil
+}
+
+// SEVLaunchFinish completes the launch, after which the guest can run.
+func SEVLaunchFinish(vmFd, sevFd uintptr) error {
+	return sevOp(vmFd, sevFd, SEVCmdLaunchFinish, nil)
+}
+
+// SEVInit2 makes a vm of VMTypeSEV, VMTypeSEVES or VMTypeSEVSNP a guest
+// of its type, with the GHCB protocol version ghcbVersion for SEV-ES and
+// SNP, or 0 for the default. It must come before its vcpus.
+func SEVInit2(vmFd, sevFd uintptr, ghcbVersion uint16) error {
+	params := sevInit{GHCBVersion: ghcbVersion}
+
+	return sevOp(vmFd, sevFd, SEVCmdInit2, unsafe.Pointer(&params))
+}
+
+// SNPLaunchStart creates the guest context of an SNP guest, which runs
+// under policy.
+func SNPLaunchStart(vmFd, sevFd uintptr, policy uint64) error {
+	start := snpLaunchStart{Policy: policy}
+
+	return sevOp(vmFd, sevFd, SNPCmdLaunchStart, unsafe.Pointer(&start))
+}
+
+// SNPLaunchUpdate copies mem into the private guest memory at gfn, which
+// must be backed by a guest_memfd and have MemoryAttributePrivate, as
+// pages of typ, validated for the guest and, but for unmeasured ones, added
+// to the launch measurement.
+func SNPLaunchUpdate(vmFd, sevFd uintptr, gfn uint64, mem []byte, typ uint8) error {
+	update := snpLaunchUpdate{
+		GFNStart: gfn, Uaddr: uint64(uintptr(unsafe.Pointer(&mem[0]))), Len: uint64(len(mem)), Type: typ,
+	}
+
+	// KVM advances the update as it goes, and stops early when
+	// interrupted.
+	for update.Len > 0 {
+		if err := sevOp(vmFd, sevFd, SNPCmdLaunchUpdate, unsafe.Pointer(&update)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SNPLaunchFinish completes the launch of an SNP guest, with hostData
+// for its attestation reports, after which it can run.
+func SNPLaunchFinish(vmFd, sevFd uintptr, hostData [32]byte) error {
+	finish := snpLaunchFinish{HostData: hostData}
+
+	return sevOp(vmFd, sevFd, SNPCmdLaunchFinish, unsafe.Pointer(&finish))
+}
@@ -0,0 +1,77 @@
+package kvm_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestSEV(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	if size := unsafe.Sizeof(kvm.SEVCmd{}); size != 24 {
+		t.Fatalf("SEVCmd size: got %d, want 24", size)
+	}
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sev, err := os.OpenFile("/dev/sev", os.O_RDWR, 0)
+	if err != nil {
+		// Without SEV, KVM rejects the command.
+		if err := kvm.SEVInit(vmFd, 0); !errors.Is(err, kvm.ErrSEV) {
+			t.Fatalf("SEVInit: got %v, want %v", err, kvm.ErrSEV)
+		}
+
+		t.Skipf("Skipping test since there is no /dev/sev: %v", err)
+	}
+
+	defer sev.Close()
+
+	if err := kvm.SEVInit(vmFd, sev.Fd()); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x1000)
+
+	if err := kvm.MemoryEncryptRegRegion(vmFd, uint64(uintptr(unsafe.Pointer(&mem[0]))), 0x1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kvm.SEVLaunchStart(vmFd, sev.Fd(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SEVLaunchUpdateData(vmFd, sev.Fd(), mem); err != nil {
+		t.Fatal(err)
+	}
+
+	// the measurement and a nonce
+	if m, err := kvm.SEVLaunchMeasure(vmFd, sev.Fd()); err != nil || len(m) != 48 {
+		t.Fatalf("SEVLaunchMeasure: got %x, %v", m, err)
+	}
+
+	if err := kvm.SEVLaunchFinish(vmFd, sev.Fd()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.MemoryEncryptUnregRegion(vmFd, uint64(uintptr(unsafe.Pointer(&mem[0]))), 0x1000); err != nil {
+		t.Fatal(err)
+	}
+}
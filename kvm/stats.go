@@ -0,0 +1,207 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// kvmGetStatsFD is KVM_GET_STATS_FD, which returns the fd that the binary
+// statistics of a vm or a vcpu are read from.
+const kvmGetStatsFD = 0xaece
+
+// Stat types in the low bits of StatsDesc.Flags.
+const (
+	StatsTypeMask       = 0xf
+	StatsTypeCumulative = 0
+	StatsTypeInstant    = 1
+	StatsTypePeak       = 2
+	StatsTypeLinearHist = 3
+	StatsTypeLogHist    = 4
+)
+
+var ErrStatsTruncated = errors.New("truncated stats")
+
+// StatsHeader is struct kvm_stats_header at the start of a stats fd.
+type StatsHeader struct {
+	Flags      uint32
+	NameSize   uint32
+	NumDesc    uint32
+	IDOffset   uint32
+	DescOffset uint32
+	DataOffset uint32
+}
+
+// StatsDesc describes one stat, struct kvm_stats_desc. Size is the number
+// of uint64 values, more than one for histograms.
+type StatsDesc struct {
+	Flags      uint32
+	Exponent   int16
+	Size       uint16
+	Offset     uint32
+	BucketSize uint32
+	Name       string
+}
+
+// statsDescHdr is the fixed part of struct kvm_stats_desc before the name.
+type statsDescHdr struct {
+	Flags      uint32
+	Exponent   int16
+	Size       uint16
+	Offset     uint32
+	BucketSize uint32
+}
+
+// Stats reads the statistics of a vm or a vcpu. The descriptors are read
+// once by NewStats; Read then only reads the values.
+type Stats struct {
+	fd     int
+	Header StatsHeader
+	ID     string
+	Descs  []StatsDesc
+}
+
+// GetStatsFD returns a stats fd for a vm or a vcpu.
+func GetStatsFD(fd uintptr) (uintptr, error) {
+	return ioctl(fd, kvmGetStatsFD, 0)
+}
+
+// NewStats opens the stats fd of a vm or a vcpu and parses its descriptors.
+func NewStats(fd uintptr) (*Stats, error) {
+	statsFd, err := GetStatsFD(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Stats{fd: int(statsFd)}
+
+	if err := s.readDescs(); err != nil {
+		s.Close()
+
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the stats fd.
+func (s *Stats) Close() error {
+	return syscall.Close(s.fd)
+}
+
+func (s *Stats) pread(size int, off int64) ([]byte, error) {
+	buf := make([]byte, size)
+
+	n, err := syscall.Pread(s.fd, buf, off)
+	if err != nil {
+		return nil, err
+	}
+
+	if n != size {
+		return nil, fmt.Errorf("%w: read %d of %d bytes at %#x", ErrStatsTruncated, n, size, off)
+	}
+
+	return buf, nil
+}
+
+func (s *Stats) readDescs() error {
+	buf, err := s.pread(binary.Size(s.Header), 0)
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &s.Header); err != nil {
+		return err
+	}
+
+	if buf, err = s.pread(int(s.Header.NameSize), int64(s.Header.IDOffset)); err != nil {
+		return err
+	}
+
+	s.ID = cString(buf)
+
+	hdrSize := binary.Size(statsDescHdr{})
+	descSize := hdrSize + int(s.Header.NameSize)
+
+	if buf, err = s.pread(descSize*int(s.Header.NumDesc), int64(s.Header.DescOffset)); err != nil {
+		return err
+	}
+
+	s.Descs = make([]StatsDesc, s.Header.NumDesc)
+
+	for i := range s.Descs {
+		d := buf[i*descSize : (i+1)*descSize]
+		hdr := statsDescHdr{}
+
+		if err := binary.Read(bytes.NewReader(d), binary.LittleEndian, &hdr); err != nil {
+			return err
+		}
+
+		s.Descs[i] = StatsDesc{
+			Flags:      hdr.Flags,
+			Exponent:   hdr.Exponent,
+			Size:       hdr.Size,
+			Offset:     hdr.Offset,
+			BucketSize: hdr.BucketSize,
+			Name:       cString(d[hdrSize:]),
+		}
+	}
+
+	return nil
+}
+
+// Read returns the current value of every stat by name, e.g. "exits" or
+// "halt_wakeup" of a vcpu and "remote_tlb_flush" of a vm. Histograms are
+// left out; their buckets start at index Offset/8 of ReadData.
+func (s *Stats) Read() (map[string]uint64, error) {
+	data, err := s.ReadData()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := map[string]uint64{}
+
+	for _, d := range s.Descs {
+		if d.Size != 1 {
+			continue
+		}
+
+		stats[d.Name] = data[d.Offset/8]
+	}
+
+	return stats, nil
+}
+
+// ReadData returns the raw data block of the stats as uint64 values.
+func (s *Stats) ReadData() ([]uint64, error) {
+	size := 0
+
+	for _, d := range s.Descs {
+		if end := int(d.Offset) + int(d.Size)*8; end > size {
+			size = end
+		}
+	}
+
+	buf, err := s.pread(size, int64(s.Header.DataOffset))
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]uint64, size/8)
+
+	for i := range data {
+		data[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+
+	return data, nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
@@ -0,0 +1,57 @@
+package kvm_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestStats(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fd, name := range map[uintptr]string{vmFd: "remote_tlb_flush", vcpuFd: "exits"} {
+		s, err := kvm.NewStats(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.Descs) == 0 || s.ID == "" {
+			t.Errorf("no stats: %+v", s)
+		}
+
+		stats, err := s.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := stats[name]; !ok {
+			t.Errorf("%s: %s not found in %v", s.ID, name, stats)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package kvm
+
+import "unsafe"
+
+const kvmTranslate = 0xc018ae85
+
+// Translation is struct kvm_translation, a guest virtual address and what
+// the page tables of a vcpu map it to.
+type Translation struct {
+	LinearAddress   uint64
+	PhysicalAddress uint64
+	Valid           uint8
+	Writeable       uint8
+	Usermode        uint8
+	_               [5]uint8
+}
+
+// Translate walks the page tables of a vcpu, as its current control
+// registers have them, for the guest virtual address vaddr. An address
+// without a mapping is not an error, but a Translation that is not Valid.
+// The vcpu must not be in Run.
+func Translate(vcpuFd uintptr, vaddr uint64) (Translation, error) {
+	t := Translation{LinearAddress: vaddr}
+	_, err := ioctl(vcpuFd, kvmTranslate, uintptr(unsafe.Pointer(&t)))
+
+	return t, err
+}
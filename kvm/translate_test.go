@@ -0,0 +1,43 @@
+package kvm_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestTranslate(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without paging, virtual addresses are physical ones.
+	tr, err := kvm.Translate(vcpuFd, 0x12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.Valid == 0 || tr.PhysicalAddress != 0x12345 {
+		t.Errorf("got %+v, want a valid translation to 0x12345", tr)
+	}
+}
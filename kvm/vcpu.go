@@ -0,0 +1,70 @@
+package kvm
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// VCPU is a vCPU of a VM with its kvm_run structure, which it owns: Close
+// unmaps Run and closes Fd, after which neither is to be used.
+type VCPU struct {
+	ID int
+	Fd uintptr
+	// Run is the kvm_run structure, shared with KVM, at the start of the
+	// mapping of the fd.
+	Run *RunData
+
+	run []byte
+}
+
+// NewVCPU creates vCPU id of the VM vmFd and maps its kvm_run structure,
+// whose size it gets from /dev/kvm, kvmFd.
+func NewVCPU(kvmFd, vmFd uintptr, id int) (*VCPU, error) {
+	size, err := GetVCPUMMmapSize(kvmFd)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := CreateVCPU(vmFd, id)
+	if err != nil {
+		return nil, err
+	}
+
+	run, err := syscall.Mmap(int(fd), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(int(fd))
+
+		return nil, err
+	}
+
+	return &VCPU{
+		ID:  id,
+		Fd:  fd,
+		Run: (*RunData)(unsafe.Pointer(&run[0])),
+		run: run,
+	}, nil
+}
+
+// Data returns size bytes at offset of the mapping of the kvm_run
+// structure, which holds more than RunData, e.g. the data of PIO exits at
+// the offset that RunData.IO returns.
+func (v *VCPU) Data(offset, size uint64) []byte {
+	return v.run[offset : offset+size]
+}
+
+// Close unmaps the kvm_run structure and closes the fd. Closing a vCPU
+// twice does nothing the second time.
+func (v *VCPU) Close() error {
+	if v.run == nil {
+		return nil
+	}
+
+	err := syscall.Munmap(v.run)
+	if err2 := syscall.Close(int(v.Fd)); err == nil {
+		err = err2
+	}
+
+	v.run, v.Run = nil, nil
+
+	return err
+}
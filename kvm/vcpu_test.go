@@ -0,0 +1,57 @@
+package kvm_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestNewVCPU(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer syscall.Close(int(vmFd))
+
+	v, err := kvm.NewVCPU(devKVM.Fd(), vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.ID != 0 || v.Run == nil {
+		t.Fatalf("got vCPU %d with run %p", v.ID, v.Run)
+	}
+
+	if _, err := kvm.NewVCPU(devKVM.Fd(), vmFd, 0); !errors.Is(err, kvm.ErrBadVCPU) {
+		t.Fatalf("NewVCPU of a taken ID: got %v, want %v", err, kvm.ErrBadVCPU)
+	}
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	if v.Run != nil {
+		t.Fatal("Run is still set after Close")
+	}
+}
@@ -0,0 +1,135 @@
+// Package linuxboot helps booting u-root and LinuxBoot payloads.
+//
+// A u-root initramfs can be built on the fly with BuildInitramfs, and
+// FindPayload pulls the Linux kernel and initramfs out of a LinuxBoot
+// flash image so that they can be smoke-tested before flashing hardware.
+package linuxboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+var (
+	ErrNoKernel    = errors.New("no bzImage found in flash image")
+	ErrNoInitramfs = errors.New("no initramfs found in flash image")
+)
+
+// BuildInitramfs runs the u-root builder to write an initramfs to out.
+// args are passed through, e.g. templates like "core boot" or -files options.
+func BuildInitramfs(uroot, out string, args ...string) error {
+	cmd := exec.Command(uroot, append([]string{"-o", out}, args...)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", uroot, err)
+	}
+
+	return nil
+}
+
+// Payload is the Linux part of a LinuxBoot flash image.
+type Payload struct {
+	Kernel    []byte
+	Initramfs []byte
+}
+
+const (
+	// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#the-real-mode-kernel-header
+	setupSectsOffset = 0x1f1
+	sysSizeOffset    = 0x1f4
+	bootFlagOffset   = 0x1fe
+	headerOffset     = 0x202
+
+	// EFI_SECTION_RAW, the section type LinuxBoot uses for the initramfs.
+	sectionTypeRaw = 0x19
+	sectionHdrSize = 4
+)
+
+var initramfsMagics = [][]byte{
+	[]byte("070701"),           // cpio newc
+	[]byte("070702"),           // cpio newc with crc
+	[]byte("\xfd7zXZ\x00"),     // xz
+	[]byte("\x28\xb5\x2f\xfd"), // zstd
+	[]byte("\x1f\x8b\x08"),     // gzip
+}
+
+// FindPayload finds an uncompressed bzImage and the initramfs following it
+// in a flash image. Payloads stored in compressed firmware volumes must
+// be extracted with a tool such as UEFITool first.
+func FindPayload(image []byte) (*Payload, error) {
+	p := &Payload{}
+
+	kernelEnd := 0
+
+	for off := 0; off+headerOffset+4 <= len(image); off++ {
+		if !bytes.Equal(image[off+headerOffset:off+headerOffset+4], []byte("HdrS")) ||
+			binary.LittleEndian.Uint16(image[off+bootFlagOffset:]) != 0xaa55 {
+			continue
+		}
+
+		setupSects := int(image[off+setupSectsOffset])
+		if setupSects == 0 {
+			setupSects = 4
+		}
+
+		kernelEnd = off + (setupSects+1)*512 +
+			int(binary.LittleEndian.Uint32(image[off+sysSizeOffset:]))*16
+		if kernelEnd > len(image) {
+			kernelEnd = len(image)
+		}
+
+		p.Kernel = image[off:kernelEnd]
+
+		break
+	}
+
+	if p.Kernel == nil {
+		return nil, ErrNoKernel
+	}
+
+	for off := kernelEnd; off < len(image); off++ {
+		for _, magic := range initramfsMagics {
+			if !bytes.HasPrefix(image[off:], magic) {
+				continue
+			}
+
+			if end, ok := rawSectionEnd(image, off); ok {
+				p.Initramfs = image[off:end]
+
+				return p, nil
+			}
+
+			// Only trust short magics at the start of a raw section.
+			if len(magic) >= 6 {
+				p.Initramfs = bytes.TrimRight(image[off:], "\xff")
+
+				return p, nil
+			}
+		}
+	}
+
+	return nil, ErrNoInitramfs
+}
+
+// rawSectionEnd returns the end of the EFI raw section whose data starts at off.
+func rawSectionEnd(image []byte, off int) (int, bool) {
+	if off < sectionHdrSize || image[off-1] != sectionTypeRaw {
+		return 0, false
+	}
+
+	hdr := image[off-sectionHdrSize:]
+	size := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+	end := off - sectionHdrSize + size
+
+	if size <= sectionHdrSize || end > len(image) {
+		return 0, false
+	}
+
+	return end, true
+}
@@ -0,0 +1,77 @@
+package linuxboot_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/linuxboot"
+)
+
+func fakeFlash() (image, kernel, initramfs []byte) {
+	kernel = make([]byte, 2*512+4*16)
+	kernel[0x1f1] = 1 // setup_sects
+	kernel[0x1f4] = 4 // syssize in 16 bytes
+	kernel[0x1fe], kernel[0x1ff] = 0x55, 0xaa
+	copy(kernel[0x202:], "HdrS")
+
+	initramfs = append([]byte("\xfd7zXZ\x00"), bytes.Repeat([]byte{0x42}, 26)...)
+	size := len(initramfs) + 4
+	section := append([]byte{byte(size), byte(size >> 8), byte(size >> 16), 0x19}, initramfs...)
+
+	image = append(image, bytes.Repeat([]byte{0xff}, 0x1000)...)
+	image = append(image, kernel...)
+	image = append(image, bytes.Repeat([]byte{0xff}, 0x10)...)
+	image = append(image, section...)
+	image = append(image, bytes.Repeat([]byte{0xff}, 0x1000)...)
+
+	return image, kernel, initramfs
+}
+
+func TestFindPayload(t *testing.T) {
+	t.Parallel()
+
+	image, kernel, initramfs := fakeFlash()
+
+	p, err := linuxboot.FindPayload(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p.Kernel, kernel) {
+		t.Errorf("kernel: got %d bytes, want %d bytes", len(p.Kernel), len(kernel))
+	}
+
+	if !bytes.Equal(p.Initramfs, initramfs) {
+		t.Errorf("initramfs: got %q, want %q", p.Initramfs, initramfs)
+	}
+}
+
+func TestFindPayloadNotFound(t *testing.T) {
+	t.Parallel()
+
+	if _, err := linuxboot.FindPayload(bytes.Repeat([]byte{0xff}, 0x2000)); !errors.Is(err, linuxboot.ErrNoKernel) {
+		t.Errorf("got %v, want %v", err, linuxboot.ErrNoKernel)
+	}
+
+	_, kernel, _ := fakeFlash()
+
+	if _, err := linuxboot.FindPayload(kernel); !errors.Is(err, linuxboot.ErrNoInitramfs) {
+		t.Errorf("got %v, want %v", err, linuxboot.ErrNoInitramfs)
+	}
+}
+
+func TestBuildInitramfs(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "initramfs.cpio")
+
+	if err := linuxboot.BuildInitramfs("true", out, "core"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := linuxboot.BuildInitramfs("false", out, "core"); err == nil {
+		t.Fatal("BuildInitramfs with a failing builder: got nil, want error")
+	}
+}
@@ -0,0 +1,143 @@
+package loader
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// An arm64 kernel Image is loaded at its text offset from a 2MiB-aligned
+// base in RAM and entered at its start, in EL1 with the MMU off and x0 at
+// the device tree, which has the command line and the initrd in /chosen,
+// see fdt.ARM64. The device tree goes on a 2MiB boundary, which keeps it
+// on the 8-byte one it needs. The file name keeps away from the _arm64
+// suffix, as the Image is loaded on any host.
+//
+// refs: https://www.kernel.org/doc/html/latest/arch/arm64/booting.html
+const (
+	arm64HeaderSize    = 64
+	arm64Magic         = 0x644d5241 // "ARM\x64"
+	arm64MagicOffset   = 0x38
+	arm64TextOffset    = 0x08
+	arm64ImageSize     = 0x10
+	arm64DefaultText   = 0x80000
+	arm64Align         = 2 << 20
+	arm64MaxDeviceTree = 2 << 20
+
+	// EL1h with the D, A, I and F exceptions masked.
+	arm64PStateBoot = 0x3c5
+)
+
+var (
+	ErrARM64Image     = errors.New("not an arm64 Image")
+	ErrARM64Unaligned = fmt.Errorf("RAM base must be aligned to %#x", arm64Align)
+	ErrDeviceTreeSize = fmt.Errorf("device tree must be up to %#x bytes and fit in guest memory", arm64MaxDeviceTree)
+)
+
+// ARM64Linux is an arm64 kernel that LoadARM64 loaded, with the guest
+// physical addresses of its parts.
+type ARM64Linux struct {
+	Entry      uint64
+	KernelSize int
+	// Initrd is where the initrd is, InitrdSize bytes, and DeviceTree
+	// where WriteDeviceTree puts the device tree.
+	Initrd     uint64
+	InitrdSize int
+	DeviceTree uint64
+}
+
+func alignARM64(v uint64) uint64 {
+	return (v + arm64Align - 1) &^ (arm64Align - 1)
+}
+
+// LoadARM64 loads the Image kernel and initrd into mem, RAM from base, the
+// initrd and then room for the device tree each on the next 2MiB boundary
+// after the part before.
+func LoadARM64(mem []byte, base uint64, kernel, initrd io.ReaderAt) (*ARM64Linux, error) {
+	if base%arm64Align != 0 {
+		return nil, fmt.Errorf("%w: %#x", ErrARM64Unaligned, base)
+	}
+
+	h := make([]byte, arm64HeaderSize)
+	if _, err := kernel.ReadAt(h, 0); err != nil || binary.LittleEndian.Uint32(h[arm64MagicOffset:]) != arm64Magic {
+		return nil, ErrARM64Image
+	}
+
+	// Kernels before 3.17 have no image size, and a text offset that is
+	// not to be trusted.
+	text, size := binary.LittleEndian.Uint64(h[arm64TextOffset:]), binary.LittleEndian.Uint64(h[arm64ImageSize:])
+	if size == 0 {
+		text = arm64DefaultText
+	}
+
+	if text >= uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: text offset %#x", ErrKernelSize, text)
+	}
+
+	n, err := readAll(kernel, mem[text:])
+	if err != nil {
+		return nil, fmt.Errorf("kernel: %w", err)
+	}
+
+	// The image size takes in the BSS, which the file does not.
+	if uint64(n) > size {
+		size = uint64(n)
+	}
+
+	l := &ARM64Linux{Entry: base + text, KernelSize: n}
+
+	off := alignARM64(text + size)
+	if off >= uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: %#x bytes at %#x", ErrKernelSize, size, base+text)
+	}
+
+	l.Initrd = base + off
+
+	l.InitrdSize, err = readAll(initrd, mem[off:])
+	if errors.Is(err, errTooLarge) {
+		return nil, fmt.Errorf("%w: more than %#x bytes at %#x", ErrInitrdSize, len(mem)-int(off), l.Initrd)
+	} else if err != nil {
+		return nil, fmt.Errorf("initrd: %w", err)
+	}
+
+	l.DeviceTree = base + alignARM64(off+uint64(l.InitrdSize))
+
+	return l, nil
+}
+
+// WriteDeviceTree writes dtb to mem, RAM from base, where the kernel
+// finds it.
+func (l *ARM64Linux) WriteDeviceTree(mem []byte, base uint64, dtb []byte) error {
+	off := l.DeviceTree - base
+	if len(dtb) > arm64MaxDeviceTree || off+uint64(len(dtb)) > uint64(len(mem)) {
+		return fmt.Errorf("%w: %#x bytes at %#x", ErrDeviceTreeSize, len(dtb), l.DeviceTree)
+	}
+
+	copy(mem[off:], dtb)
+
+	return nil
+}
+
+// SetRegs sets the registers of the vCPU of vcpuFd to start in the
+// kernel, as the boot vCPU. The others wait to be turned on through PSCI.
+func (l *ARM64Linux) SetRegs(vcpuFd uintptr) error {
+	for _, r := range []struct {
+		offset, value uint64
+	}{
+		{kvm.RegARM64X0, l.DeviceTree},
+		{kvm.RegARM64X0 + 8, 0},
+		{kvm.RegARM64X0 + 16, 0},
+		{kvm.RegARM64X0 + 24, 0},
+		{kvm.RegARM64PState, arm64PStateBoot},
+		{kvm.RegARM64PC, l.Entry},
+	} {
+		if err := kvm.SetOneRegUint64(vcpuFd, kvm.ARM64CoreReg(r.offset), r.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
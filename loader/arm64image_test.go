@@ -0,0 +1,72 @@
+package loader_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/fdt"
+	"github.com/bobuhiro11/gokvm/loader"
+)
+
+func TestLoadARM64(t *testing.T) {
+	t.Parallel()
+
+	const base = 0x40000000
+
+	// An Image of 0x1000 bytes that takes 0x300000 with its BSS, at text
+	// offset 0x80000.
+	kernel := make([]byte, 0x1000)
+	binary.LittleEndian.PutUint64(kernel[0x08:], 0x80000)
+	binary.LittleEndian.PutUint64(kernel[0x10:], 0x300000)
+	copy(kernel[0x38:], "ARM\x64")
+
+	initrd := bytes.Repeat([]byte{0x5a}, 0x80)
+	mem := make([]byte, 0x800000)
+
+	l, err := loader.LoadARM64(mem, base, bytes.NewReader(kernel), bytes.NewReader(initrd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Entry != base+0x80000 || !bytes.Equal(mem[0x80000:0x81000], kernel) {
+		t.Fatalf("kernel at %#x", l.Entry)
+	}
+
+	if l.Initrd != base+0x400000 || l.InitrdSize != 0x80 || !bytes.Equal(mem[0x400000:0x400080], initrd) {
+		t.Fatalf("initrd of %#x bytes at %#x", l.InitrdSize, l.Initrd)
+	}
+
+	dtb, err := fdt.ARM64(fdt.ARM64Machine{
+		MemoryBase: base, MemorySize: uint64(len(mem)),
+		InitrdStart: l.Initrd, InitrdEnd: l.Initrd + uint64(l.InitrdSize),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.WriteDeviceTree(mem, base, dtb); err != nil || l.DeviceTree != base+0x600000 ||
+		!bytes.Equal(mem[0x600000:0x600000+len(dtb)], dtb) {
+		t.Fatalf("device tree at %#x: %v", l.DeviceTree, err)
+	}
+
+	if err := l.WriteDeviceTree(mem, base, make([]byte, 0x200001)); !errors.Is(err, loader.ErrDeviceTreeSize) {
+		t.Fatalf("got %v, want %v", err, loader.ErrDeviceTreeSize)
+	}
+
+	for _, tt := range []struct {
+		base           uint64
+		kernel, initrd []byte
+		want           error
+	}{
+		{base, make([]byte, 0x1000), nil, loader.ErrARM64Image},
+		{base + 0x1000, kernel, nil, loader.ErrARM64Unaligned},
+		{base, kernel, make([]byte, 0x400001), loader.ErrInitrdSize},
+	} {
+		_, err := loader.LoadARM64(mem, tt.base, bytes.NewReader(tt.kernel), bytes.NewReader(tt.initrd))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("got %v, want %v", err, tt.want)
+		}
+	}
+}
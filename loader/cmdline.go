@@ -0,0 +1,173 @@
+package loader
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cmdline builds a kernel command line from what the user gives and what
+// the devices of the machine need, e.g. the virtio_mmio.device= of each
+// virtio-mmio device, so that neither has to know about the other. The
+// user's parameters take precedence: devices add theirs with Default.
+type Cmdline struct {
+	params []string
+}
+
+// ParseCmdline returns a Cmdline with the parameters of s, split at
+// spaces outside double quotes as the kernel does, so that e.g.
+// dyndbg="file a.c +p ; file b.c +p" stays one parameter.
+func ParseCmdline(s string) *Cmdline {
+	c := &Cmdline{}
+
+	start, quoted := -1, false
+
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if start >= 0 {
+				c.params = append(c.params, s[start:i])
+				start = -1
+			}
+
+			continue
+		}
+
+		if start < 0 {
+			start = i
+		}
+	}
+
+	if start >= 0 {
+		c.params = append(c.params, s[start:])
+	}
+
+	return c
+}
+
+// key returns the name of param, with - and _ the same as they are to the
+// kernel.
+func key(param string) string {
+	if i := strings.IndexByte(param, '='); i >= 0 {
+		param = param[:i]
+	}
+
+	return strings.ReplaceAll(param, "-", "_")
+}
+
+// Add adds params, as they are, at the end.
+func (c *Cmdline) Add(params ...string) {
+	for _, p := range params {
+		if p != "" {
+			c.params = append(c.params, p)
+		}
+	}
+}
+
+// Has tells whether c has a parameter named name, with a value or not.
+func (c *Cmdline) Has(name string) bool {
+	for _, p := range c.params {
+		if key(p) == key(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get returns the value of the last parameter named name, which is the one
+// the kernel takes, and whether there is one.
+func (c *Cmdline) Get(name string) (string, bool) {
+	for i := len(c.params) - 1; i >= 0; i-- {
+		if key(c.params[i]) != key(name) {
+			continue
+		}
+
+		if j := strings.IndexByte(c.params[i], '='); j >= 0 {
+			return c.params[i][j+1:], true
+		}
+
+		return "", true
+	}
+
+	return "", false
+}
+
+// Set sets name to value, replacing any parameter named name. An empty
+// value sets a flag such as noacpi.
+func (c *Cmdline) Set(name, value string) {
+	params := c.params[:0]
+
+	for _, p := range c.params {
+		if key(p) != key(name) {
+			params = append(params, p)
+		}
+	}
+
+	c.params = params
+	c.Add(param(name, value))
+}
+
+// Default sets name to value unless c has it already.
+func (c *Cmdline) Default(name, value string) {
+	if !c.Has(name) {
+		c.Add(param(name, value))
+	}
+}
+
+func param(name, value string) string {
+	if value == "" {
+		return name
+	}
+
+	return name + "=" + value
+}
+
+// Console sets the console of the kernel, e.g. ttyS0, unless c has one.
+func (c *Cmdline) Console(console string) {
+	c.Default("console", console)
+}
+
+// Root sets the root file system of the kernel, e.g. /dev/vda, unless c has
+// one.
+func (c *Cmdline) Root(root string) {
+	c.Default("root", root)
+}
+
+// AddVirtioMMIO adds a virtio-mmio device of size bytes at base with
+// interrupt irq, for the kernel to find without a device tree or ACPI.
+// Unlike the others, the parameter may be given once for each device.
+//
+// refs: https://www.kernel.org/doc/html/latest/admin-guide/kernel-parameters.html
+func (c *Cmdline) AddVirtioMMIO(base, size uint64, irq uint32) {
+	c.Add(fmt.Sprintf("virtio_mmio.device=%#x@%#x:%d", size, base, irq))
+}
+
+// String returns the command line.
+func (c *Cmdline) String() string {
+	if c == nil {
+		return ""
+	}
+
+	return strings.Join(c.params, " ")
+}
+
+// Write writes the command line to mem at addr, NUL-terminated, if it has
+// at most max bytes without the NUL, the cmdline_size of the kernel.
+func (c *Cmdline) Write(mem []byte, addr uint64, max int) error {
+	s := c.String()
+
+	if len(s) > max {
+		return fmt.Errorf("%w: %d bytes, the kernel takes %d", ErrCmdlineSize, len(s), max)
+	}
+
+	if addr+uint64(len(s))+1 > uint64(len(mem)) {
+		return fmt.Errorf("%w: command line at %#x", ErrLayout, addr)
+	}
+
+	copy(mem[addr:], s)
+	mem[addr+uint64(len(s))] = 0
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package loader_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/loader"
+)
+
+func TestParseCmdline(t *testing.T) {
+	t.Parallel()
+
+	s := ` console=ttyS0  dyndbg="file a.c +plf ; file b.c +plf"	rdinit=/init `
+
+	c := loader.ParseCmdline(s)
+	if got, want := c.String(), `console=ttyS0 dyndbg="file a.c +plf ; file b.c +plf" rdinit=/init`; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if v, ok := c.Get("dyndbg"); !ok || v != `"file a.c +plf ; file b.c +plf"` {
+		t.Fatalf("dyndbg: %q, %v", v, ok)
+	}
+}
+
+func TestCmdline(t *testing.T) {
+	t.Parallel()
+
+	c := loader.ParseCmdline("console=hvc0 noacpi virtio-pci.force_legacy=0")
+	c.Console("ttyS0")
+	c.Root("/dev/vda")
+	c.Default("virtio_pci.force_legacy", "1")
+	c.Set("noacpi", "")
+	c.Set("console", "ttyS1")
+	c.AddVirtioMMIO(0xd0000000, 0x1000, 5)
+	c.AddVirtioMMIO(0xd0001000, 0x1000, 6)
+
+	want := "virtio-pci.force_legacy=0 root=/dev/vda noacpi console=ttyS1 " +
+		"virtio_mmio.device=0x1000@0xd0000000:5 virtio_mmio.device=0x1000@0xd0001000:6"
+	if got := c.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if !c.Has("noacpi") || c.Has("acpi") {
+		t.Fatal("Has")
+	}
+
+	if v, ok := c.Get("virtio_mmio.device"); !ok || v != "0x1000@0xd0001000:6" {
+		t.Fatalf("virtio_mmio.device: %q, %v", v, ok)
+	}
+}
+
+func TestCmdlineWrite(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x20)
+	for i := range mem {
+		mem[i] = 0xff
+	}
+
+	c := loader.ParseCmdline("console=ttyS0")
+
+	if err := c.Write(mem, 0x10, 12); !errors.Is(err, loader.ErrCmdlineSize) {
+		t.Fatalf("got %v, want %v", err, loader.ErrCmdlineSize)
+	}
+
+	if err := c.Write(mem, 0x13, 13); !errors.Is(err, loader.ErrLayout) {
+		t.Fatalf("got %v, want %v", err, loader.ErrLayout)
+	}
+
+	if err := c.Write(mem, 0x12, 13); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(mem[0x12:]); got != "console=ttyS0\x00" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+package loader
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+)
+
+var ErrELF = errors.New("not a 64-bit x86 vmlinux")
+
+const (
+	elfMagic = "\x7fELF"
+
+	// commandLineSize is COMMAND_LINE_SIZE of x86, which a vmlinux has no
+	// setup header to tell.
+	commandLineSize = 2048
+)
+
+func isELF(r io.ReaderAt) bool {
+	magic := make([]byte, len(elfMagic))
+	n, _ := r.ReadAt(magic, 0)
+
+	return n == len(magic) && string(magic) == elfMagic
+}
+
+// vmlinux returns the zero page of an uncompressed vmlinux, which has no
+// setup header of its own, and a function that loads its PT_LOAD segments
+// at their physical addresses. It sets the entry of linux: the PVH entry
+// if the kernel has one, and the physical address of startup_64, with the
+// GDT and page tables it needs, otherwise.
+//
+// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#id1
+func vmlinux(mem []byte, l Layout, kernel io.ReaderAt, linux *Linux) (*bootparam.BootParam, func() (int, error), error) {
+	f, err := elf.NewFile(kernel)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrELF, err)
+	}
+
+	if f.Class != elf.ELFCLASS64 || f.Machine != elf.EM_X86_64 {
+		return nil, nil, fmt.Errorf("%w: %v %v", ErrELF, f.Class, f.Machine)
+	}
+
+	var (
+		progs      []*elf.Prog
+		start, end = ^uint64(0), uint64(0)
+		entry      = f.Entry
+	)
+
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Memsz == 0 {
+			continue
+		}
+
+		if p.Filesz > p.Memsz {
+			return nil, nil, fmt.Errorf("%w: segment at %#x larger in the file than in memory", ErrELF, p.Paddr)
+		}
+
+		if p.Paddr < l.Kernel || p.Paddr+p.Memsz > l.Initrd {
+			return nil, nil, fmt.Errorf("%w: segment at %#x-%#x outside %#x-%#x",
+				ErrKernelSize, p.Paddr, p.Paddr+p.Memsz, l.Kernel, l.Initrd)
+		}
+
+		// The entry of a vmlinux is a physical address, but one that is
+		// virtual is taken by the segment it is in.
+		if p.Vaddr != p.Paddr && p.Vaddr <= f.Entry && f.Entry < p.Vaddr+p.Memsz {
+			entry = p.Paddr + f.Entry - p.Vaddr
+		}
+
+		if p.Paddr < start {
+			start = p.Paddr
+		}
+
+		if p.Paddr+p.Memsz > end {
+			end = p.Paddr + p.Memsz
+		}
+
+		progs = append(progs, p)
+	}
+
+	if entry < start || entry >= end {
+		return nil, nil, fmt.Errorf("%w: entry %#x outside the segments", ErrELF, f.Entry)
+	}
+
+	linux.Entry, linux.Long = entry, true
+
+	// A kernel that has a PVH entry is started there, where it needs
+	// neither a zero page nor page tables.
+	if pvh, ok, err := pvhEntry(f); err != nil {
+		return nil, nil, err
+	} else if ok {
+		if pvh < start || pvh >= end {
+			return nil, nil, fmt.Errorf("%w: PVH entry %#x outside the segments", ErrELF, pvh)
+		}
+
+		linux.Entry, linux.Long, linux.PVH = pvh, false, true
+	}
+
+	if linux.Long && (l.PageTables == 0 || l.PageTables+PageTablesSize > l.Kernel) {
+		return nil, nil, fmt.Errorf("%w: page tables at %#x", ErrLayout, l.PageTables)
+	}
+
+	params := &bootparam.BootParam{}
+	params.Hdr.BootFlag = 0xAA55
+	params.Hdr.Header = bootparam.MagicSignature
+	params.Hdr.KernelAlignment = 0x1000000
+	params.Hdr.InitrdAddrMax = 0x7FFFFFFF
+	params.Hdr.CmdlineSize = commandLineSize
+
+	return params, func() (int, error) {
+		if linux.Long {
+			if err := WritePageTables(mem, l.PageTables); err != nil {
+				return 0, err
+			}
+		}
+
+		for _, p := range progs {
+			seg := mem[p.Paddr : p.Paddr+p.Memsz]
+			if _, err := p.ReadAt(seg[:p.Filesz], 0); err != nil && !errors.Is(err, io.EOF) {
+				return 0, err
+			}
+
+			// After a reset, the bss is not as zero as fresh guest RAM.
+			for i := range seg[p.Filesz:] {
+				seg[p.Filesz+uint64(i)] = 0
+			}
+		}
+
+		return int(end - start), nil
+	}, nil
+}
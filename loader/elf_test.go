@@ -0,0 +1,161 @@
+package loader_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/loader"
+)
+
+// vmlinux returns an ELF of class and machine with a PT_LOAD segment of
+// payload and bss zeroes at paddr, linked at vaddr, and entry its entry,
+// and a PT_NOTE segment of notes if there are any.
+func vmlinux(t *testing.T, class elf.Class, machine elf.Machine, paddr, vaddr, entry uint64,
+	payload []byte, bss uint64, notes ...byte,
+) []byte {
+	t.Helper()
+
+	const phoff = 64
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     entry,
+		Phoff:     phoff,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     1,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(class)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	prog := elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R | elf.PF_X),
+		Off:    0x1000,
+		Vaddr:  vaddr,
+		Paddr:  paddr,
+		Filesz: uint64(len(payload)),
+		Memsz:  uint64(len(payload)) + bss,
+		Align:  0x1000,
+	}
+
+	note := elf.Prog64{
+		Type:   uint32(elf.PT_NOTE),
+		Off:    0x1000 + uint64(len(payload)),
+		Filesz: uint64(len(notes)),
+		Align:  4,
+	}
+
+	progs := []interface{}{hdr, prog}
+	if len(notes) > 0 {
+		hdr.Phnum = 2
+		progs = []interface{}{hdr, prog, note}
+	}
+
+	buf := &bytes.Buffer{}
+	for _, v := range progs {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	img := make([]byte, 0x1000)
+	copy(img, buf.Bytes())
+
+	return append(append(img, payload...), notes...)
+}
+
+func TestLoadVmlinux(t *testing.T) {
+	t.Parallel()
+
+	mem := bytes.Repeat([]byte{0xff}, 0x30000)
+	payload := bytes.Repeat([]byte{0x90}, 0x100)
+	img := vmlinux(t, elf.ELFCLASS64, elf.EM_X86_64, 0x11000, 0xffffffff81011000, 0xffffffff81011010, payload, 0x80)
+
+	linux, err := loader.Load(mem, layout, loader.Image{
+		Kernel:  bytes.NewReader(img),
+		Initrd:  bytes.NewReader([]byte("initrd")),
+		Cmdline: loader.ParseCmdline("console=ttyS0"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(mem[0x11000:0x11180], append(payload, make([]byte, 0x80)...)) || mem[0x11180] != 0xff {
+		t.Fatal("segment not loaded at its physical address with its bss zeroed")
+	}
+
+	if !linux.Long || linux.Entry != 0x11010 || linux.KernelSize != 0x180 {
+		t.Fatalf("entry %#x, long %v, size %#x", linux.Entry, linux.Long, linux.KernelSize)
+	}
+
+	if string(mem[layout.Cmdline:layout.Cmdline+14]) != "console=ttyS0\x00" ||
+		binary.LittleEndian.Uint32(mem[layout.BootParams+0x202:]) != 0x53726448 {
+		t.Fatal("command line or zero page not written")
+	}
+
+	// The page directory maps 3GiB + 2MiB to itself.
+	pd := mem[layout.PageTables+3*0x1000:]
+	if pde := binary.LittleEndian.Uint64(pd[(3<<9+1)*8:]); pde != 3<<30|2<<20|0x83 {
+		t.Fatalf("PDE %#x", pde)
+	}
+
+	regs := kvm.Regs{}
+	linux.SetRegs(&regs)
+
+	if regs.RIP != 0x11010 || regs.RSI != layout.BootParams {
+		t.Fatalf("RIP %#x, RSI %#x", regs.RIP, regs.RSI)
+	}
+
+	sregs := kvm.Sregs{}
+	linux.SetSregs(&sregs)
+
+	if sregs.CS.L != 1 || sregs.CS.Selector != 0x10 || sregs.DS.Selector != 0x18 ||
+		sregs.CR3 != layout.PageTables+0x1000 || sregs.EFER&(1<<10) == 0 || sregs.CR0&(1<<31) == 0 {
+		t.Fatalf("sregs %+v", sregs)
+	}
+}
+
+func TestLoadVmlinuxErrors(t *testing.T) {
+	t.Parallel()
+
+	noPageTables := layout
+	noPageTables.PageTables = 0
+
+	for _, tt := range []struct {
+		name   string
+		layout loader.Layout
+		img    []byte
+		err    error
+	}{
+		{"32-bit", layout, vmlinux(t, elf.ELFCLASS32, elf.EM_X86_64, 0x11000, 0x11000, 0x11000, nil, 0x10), loader.ErrELF},
+		{"arm64", layout, vmlinux(t, elf.ELFCLASS64, elf.EM_AARCH64, 0x11000, 0x11000, 0x11000, nil, 0x10), loader.ErrELF},
+		{"segment", layout, vmlinux(t, elf.ELFCLASS64, elf.EM_X86_64, 0x1f000, 0x1f000, 0x1f000, nil, 0x2000),
+			loader.ErrKernelSize},
+		{"entry", layout, vmlinux(t, elf.ELFCLASS64, elf.EM_X86_64, 0x11000, 0x11000, 0x12000, nil, 0x10), loader.ErrELF},
+		{"page tables", noPageTables, vmlinux(t, elf.ELFCLASS64, elf.EM_X86_64, 0x11000, 0x11000, 0x11000, nil, 0x10),
+			loader.ErrLayout},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := loader.Load(make([]byte, 0x30000), tt.layout, loader.Image{
+				Kernel: bytes.NewReader(tt.img),
+				Initrd: bytes.NewReader(nil),
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
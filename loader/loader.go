@@ -0,0 +1,262 @@
+// Package loader loads a Linux kernel into guest memory: the kernel, the
+// initrd and the kernel command line where a Layout says, and the zero
+// page, the boot_params of the kernel, that tells the kernel where to find
+// them. A bzImage is started by the 32-bit boot protocol, in its
+// decompressor, and an uncompressed vmlinux ELF by the 64-bit one, at its
+// entry in long mode, which skips decompression, or by the PVH boot
+// protocol of Xen if it has a PVH entry. The vCPUs then start in
+// the kernel with the registers of Linux.SetRegs and Linux.SetSregs.
+//
+// refs: https://www.kernel.org/doc/html/latest/x86/boot.html
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/startup"
+)
+
+var (
+	ErrKernelSize  = errors.New("kernel does not fit below the initrd")
+	ErrInitrdSize  = errors.New("initrd does not fit in guest memory")
+	ErrCmdlineSize = errors.New("kernel command line too long")
+	ErrLayout      = errors.New("layout outside guest memory")
+)
+
+// Layout is where Load puts the parts of the kernel in guest physical
+// memory, all of which must be below 4GiB. The zero page and the command
+// line must be out of the way of the kernel, and a bzImage must be loaded
+// at 1MiB, where one that is not relocatable expects to be. A vmlinux goes
+// where its program headers say, which must be from Kernel up to Initrd.
+type Layout struct {
+	BootParams, Cmdline, Kernel, Initrd uint64
+	// PageTables is where the GDT and the page tables of the 64-bit boot
+	// protocol go, PageTablesSize bytes. Only a vmlinux needs them.
+	PageTables uint64
+}
+
+// Image is what Load loads.
+type Image struct {
+	Kernel, Initrd io.ReaderAt
+	Cmdline        *Cmdline
+	// E820 is the memory map of the guest.
+	E820 []bootparam.E820Entry
+	// Timer, if set, records the time it takes to read the initrd, which
+	// is read while the kernel is.
+	Timer *startup.Timer
+}
+
+// Linux is a kernel that Load loaded.
+type Linux struct {
+	// Params is the zero page as Load wrote it, nil for PVH.
+	Params     *bootparam.BootParam
+	Layout     Layout
+	KernelSize int
+	InitrdSize int
+	// Entry is where the vCPUs start, in long mode if Long is set, or
+	// by the PVH boot protocol if PVH is.
+	Entry uint64
+	Long  bool
+	PVH   bool
+}
+
+// Load loads img into mem, guest memory from guest physical address 0, as
+// l says.
+func Load(mem []byte, l Layout, img Image) (*Linux, error) {
+	for _, a := range []uint64{l.BootParams, l.Cmdline, l.Kernel, l.Initrd} {
+		if a >= uint64(len(mem)) {
+			return nil, fmt.Errorf("%w: %#x of %#x bytes", ErrLayout, a, len(mem))
+		}
+	}
+
+	var (
+		linux      = &Linux{Layout: l, Entry: l.Kernel}
+		loadKernel func() (int, error)
+		err        error
+	)
+
+	if isELF(img.Kernel) {
+		linux.Params, loadKernel, err = vmlinux(mem, l, img.Kernel, linux)
+	} else {
+		linux.Params, loadKernel, err = bzImage(mem, l, img.Kernel)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	params := linux.Params
+
+	// Protocol 2.06+ tells how long the command line may be, without the
+	// NUL.
+	if err := img.Cmdline.Write(mem, l.Cmdline, int(params.Hdr.CmdlineSize)); err != nil {
+		return nil, err
+	}
+
+	// The initrd is read while the kernel is loaded, as the two do not
+	// overlap.
+	type readResult struct {
+		n   int
+		err error
+	}
+
+	initrdRead := make(chan readResult, 1)
+
+	go func(start time.Time) {
+		n, err := readAll(img.Initrd, mem[l.Initrd:])
+		if img.Timer != nil {
+			img.Timer.Since("read initrd", start)
+		}
+
+		initrdRead <- readResult{n, err}
+	}(time.Now())
+
+	kernelSize, kernelErr := loadKernel()
+
+	r := <-initrdRead
+
+	switch {
+	case errors.Is(kernelErr, errTooLarge):
+		return nil, fmt.Errorf("%w: more than %#x bytes", ErrKernelSize, l.Initrd-l.Kernel)
+	case kernelErr != nil:
+		return nil, fmt.Errorf("kernel: %w", kernelErr)
+	case errors.Is(r.err, errTooLarge):
+		return nil, fmt.Errorf("%w: more than %#x bytes at %#x", ErrInitrdSize, len(mem)-int(l.Initrd), l.Initrd)
+	case r.err != nil:
+		return nil, fmt.Errorf("initrd: %w", r.err)
+	}
+
+	// Protocol 2.10+ tells how much memory the kernel takes from where it
+	// is loaded as it decompresses itself, which must not reach the
+	// initrd.
+	if uint64(params.Hdr.InitSize) > l.Initrd-l.Kernel {
+		return nil, fmt.Errorf("%w: %#x bytes to decompress into, %#x below the initrd",
+			ErrKernelSize, params.Hdr.InitSize, l.Initrd-l.Kernel)
+	}
+
+	if r.n > 0 && l.Initrd+uint64(r.n)-1 > uint64(params.Hdr.InitrdAddrMax) {
+		return nil, fmt.Errorf("%w: the kernel takes an initrd below %#x", ErrInitrdSize, params.Hdr.InitrdAddrMax)
+	}
+
+	linux.KernelSize, linux.InitrdSize = kernelSize, r.n
+
+	if linux.PVH {
+		// The kernel gets its hvm_start_info where others get the zero
+		// page.
+		linux.Params = nil
+
+		if err := writeStartInfo(mem, l, r.n, img.E820); err != nil {
+			return nil, err
+		}
+
+		return linux, nil
+	}
+
+	params.SetE820(img.E820)
+
+	params.Hdr.VidMode = 0xFFFF                                                                  // Proto ALL
+	params.Hdr.TypeOfLoader = 0xFF                                                               // Proto 2.00+
+	params.Hdr.RamdiskImage = uint32(l.Initrd)                                                   // Proto 2.00+
+	params.Hdr.RamdiskSize = uint32(r.n)                                                         // Proto 2.00+
+	params.Hdr.LoadFlags |= bootparam.CanUseHeap | bootparam.LoadedHigh | bootparam.KeepSegments // Proto 2.00+
+	params.Hdr.HeapEndPtr = 0xFE00                                                               // Proto 2.01+
+	params.Hdr.ExtLoaderVer = 0                                                                  // Proto 2.02+
+	params.Hdr.CmdlinePtr = uint32(l.Cmdline)                                                    // Proto 2.06+
+
+	b, err := params.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.BootParams+uint64(len(b)) > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: zero page at %#x", ErrLayout, l.BootParams)
+	}
+
+	copy(mem[l.BootParams:], b)
+
+	return linux, nil
+}
+
+// bzImage returns the zero page of the bzImage kernel, with its setup
+// header, and a function that loads its protected-mode kernel.
+func bzImage(mem []byte, l Layout, kernel io.ReaderAt) (*bootparam.BootParam, func() (int, error), error) {
+	// In 64-bit boot protocol, the first step in loading a Linux kernel
+	// should be to setup the boot parameters, traditionally known as the
+	// zero page, with the setup header of the kernel image.
+	params, err := bootparam.New(kernel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The 32-bit (non-real-mode) kernel starts at offset (setup_sects+1)*512
+	// in the kernel file; if setup_sects is 0, the real value is 4.
+	//
+	// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#loading-the-rest-of-the-kernel
+	setupSects := int(params.Hdr.SetupSects)
+	if setupSects == 0 {
+		setupSects = 4
+	}
+
+	return params, func() (int, error) {
+		return readAll(io.NewSectionReader(kernel, int64(setupSects+1)*512, 1<<62), mem[l.Kernel:l.Initrd])
+	}, nil
+}
+
+// errTooLarge is what readAll returns for more than fits in its buffer.
+var errTooLarge = errors.New("too large")
+
+// readAll reads all of r into buf from its start, which takes all of it.
+func readAll(r io.ReaderAt, buf []byte) (int, error) {
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return n, err
+	}
+
+	if n == len(buf) {
+		if m, _ := r.ReadAt(make([]byte, 1), int64(n)); m != 0 {
+			return n, errTooLarge
+		}
+	}
+
+	return n, nil
+}
+
+// SetRegs sets the general purpose registers with which a vCPU starts
+// in the kernel: at its entry point, with RSI at the zero page, or RBX at
+// the hvm_start_info for PVH.
+func (l *Linux) SetRegs(regs *kvm.Regs) {
+	regs.RFLAGS = 2
+	regs.RIP = l.Entry
+
+	if l.PVH {
+		regs.RBX = l.Layout.BootParams
+
+		return
+	}
+
+	regs.RSI = l.Layout.BootParams
+}
+
+// SetSregs sets the special registers with which a vCPU starts in the
+// kernel: in protected mode with flat 4GiB segments and paging off, as
+// both the 32-bit and the PVH boot protocol have it, or, for a vmlinux
+// without PVH, in long mode with the GDT and page tables of Load.
+func (l *Linux) SetSregs(sregs *kvm.Sregs) {
+	if l.Long {
+		SetLongMode(sregs, l.Layout.PageTables)
+
+		return
+	}
+
+	for _, s := range []*kvm.Segment{&sregs.CS, &sregs.DS, &sregs.FS, &sregs.GS, &sregs.ES, &sregs.SS} {
+		s.Base, s.Limit, s.G = 0, 0xFFFFFFFF, 1
+	}
+
+	sregs.CS.DB, sregs.SS.DB = 1, 1
+	sregs.CR0 |= 1 // protected mode
+}
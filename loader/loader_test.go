@@ -0,0 +1,173 @@
+package loader_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/loader"
+	"github.com/bobuhiro11/gokvm/startup"
+)
+
+var layout = loader.Layout{
+	BootParams: 0x1000,
+	Cmdline:    0x4000,
+	Kernel:     0x10000,
+	Initrd:     0x20000,
+	PageTables: 0x8000,
+}
+
+// bzImage returns a bzImage of protocol 2.15 with a setup of setupSects
+// sectors and payload as its protected-mode kernel.
+func bzImage(t *testing.T, setupSects uint8, payload []byte) []byte {
+	t.Helper()
+
+	hdr := bootparam.SetupHeader{
+		SetupSects:    setupSects,
+		Header:        bootparam.MagicSignature,
+		Version:       0x020f,
+		InitrdAddrMax: 0x7fffffff,
+		CmdlineSize:   32,
+		InitSize:      0x8000,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	real := int(setupSects)
+	if real == 0 {
+		real = 4
+	}
+
+	img := make([]byte, (real+1)*512)
+	copy(img[0x1f1:], buf.Bytes())
+
+	return append(img, payload...)
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	for _, setupSects := range []uint8{0, 2} {
+		mem := make([]byte, 0x30000)
+		kernel := bytes.Repeat([]byte{0xf4}, 0x100)
+		initrd := bytes.Repeat([]byte{0x5a}, 0x80)
+		e820 := []bootparam.E820Entry{{Addr: 0, Size: uint64(len(mem)), Type: bootparam.E820Ram}}
+		timer := startup.Start()
+
+		linux, err := loader.Load(mem, layout, loader.Image{
+			Kernel:  bytes.NewReader(bzImage(t, setupSects, kernel)),
+			Initrd:  bytes.NewReader(initrd),
+			Cmdline: loader.ParseCmdline("console=ttyS0"),
+			E820:    e820,
+			Timer:   timer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(mem[layout.Kernel:layout.Kernel+0x101], append(kernel, 0)) {
+			t.Fatalf("setup_sects %d: kernel not loaded at %#x", setupSects, layout.Kernel)
+		}
+
+		if !bytes.Equal(mem[layout.Initrd:layout.Initrd+0x80], initrd) {
+			t.Fatalf("initrd not loaded at %#x", layout.Initrd)
+		}
+
+		if got := string(mem[layout.Cmdline : layout.Cmdline+14]); got != "console=ttyS0\x00" {
+			t.Fatalf("command line %q", got)
+		}
+
+		if linux.KernelSize != len(kernel) || linux.InitrdSize != len(initrd) {
+			t.Fatalf("sizes %d, %d", linux.KernelSize, linux.InitrdSize)
+		}
+
+		zp := &bootparam.BootParam{}
+		if err := binary.Read(bytes.NewReader(mem[layout.BootParams:]), binary.LittleEndian, zp); err != nil {
+			t.Fatal(err)
+		}
+
+		if zp.Hdr.RamdiskImage != uint32(layout.Initrd) || zp.Hdr.RamdiskSize != uint32(len(initrd)) ||
+			zp.Hdr.CmdlinePtr != uint32(layout.Cmdline) || zp.Hdr.TypeOfLoader != 0xff {
+			t.Fatalf("zero page header %+v", zp.Hdr)
+		}
+
+		if zp.E820Entries != 1 || zp.E820Map[0] != e820[0] {
+			t.Fatalf("zero page E820 %d: %+v", zp.E820Entries, zp.E820Map[0])
+		}
+
+		if len(timer.Phases()) != 1 || timer.Phases()[0].Name != "read initrd" {
+			t.Fatalf("phases %+v", timer.Phases())
+		}
+
+		regs := kvm.Regs{}
+		linux.SetRegs(&regs)
+
+		if regs.RIP != layout.Kernel || regs.RSI != layout.BootParams {
+			t.Fatalf("RIP %#x, RSI %#x", regs.RIP, regs.RSI)
+		}
+
+		sregs := kvm.Sregs{}
+		linux.SetSregs(&sregs)
+
+		if sregs.CR0&1 == 0 || sregs.CS.DB != 1 || sregs.DS.Limit != 0xffffffff {
+			t.Fatalf("sregs %+v", sregs)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name    string
+		mem     int
+		layout  loader.Layout
+		kernel  int
+		initrd  int
+		cmdline string
+		err     error
+	}{
+		{"cmdline", 0x30000, layout, 0x100, 0x80, "console=ttyS0 root=/dev/vda rw quiet", loader.ErrCmdlineSize},
+		{"kernel", 0x30000, layout, 0x10001, 0x80, "", loader.ErrKernelSize},
+		{"init size", 0x30000, loader.Layout{BootParams: 0x1000, Cmdline: 0x4000, Kernel: 0x10000, Initrd: 0x14000},
+			0x100, 0x80, "", loader.ErrKernelSize},
+		{"initrd", 0x30000, layout, 0x100, 0x10001, "", loader.ErrInitrdSize},
+		{"layout", 0x10000, layout, 0x100, 0x80, "", loader.ErrLayout},
+	} {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := loader.Load(make([]byte, tt.mem), tt.layout, loader.Image{
+				Kernel:  bytes.NewReader(bzImage(t, 1, make([]byte, tt.kernel))),
+				Initrd:  bytes.NewReader(make([]byte, tt.initrd)),
+				Cmdline: loader.ParseCmdline(tt.cmdline),
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadNotBzImage(t *testing.T) {
+	t.Parallel()
+
+	img := bzImage(t, 1, nil)
+	img[0x202] = 0
+
+	_, err := loader.Load(make([]byte, 0x30000), layout, loader.Image{
+		Kernel: bytes.NewReader(img),
+		Initrd: bytes.NewReader(nil),
+	})
+	if !errors.Is(err, bootparam.ErrorSignatureNotMatch) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,92 @@
+package loader
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// PageTablesSize is the size of the GDT and page tables that
+// WritePageTables writes: a page of GDT, and a PML4, a PDPT and four page
+// directories that map the first 4GiB to themselves with 2MiB pages.
+const PageTablesSize = 7 * pageSize
+
+const (
+	pageSize = 0x1000
+
+	// The 64-bit boot protocol wants __BOOT_CS and __BOOT_DS, the third
+	// and fourth entries of the GDT.
+	bootCS = 2 * 8
+	bootDS = 3 * 8
+
+	gdtCode = 0x00af9b000000ffff // 64-bit, present, execute/read
+	gdtData = 0x00cf93000000ffff // 32-bit, present, read/write
+
+	ptePresent  = 1 << 0
+	pteWritable = 1 << 1
+	pteHuge     = 1 << 7
+
+	cr0PE   = 1 << 0
+	cr0PG   = 1 << 31
+	cr4PAE  = 1 << 5
+	eferLME = 1 << 8
+	eferLMA = 1 << 10
+)
+
+// WritePageTables writes a GDT and page tables that map the first 4GiB to
+// themselves at the guest physical address base of mem, guest memory from
+// guest physical address 0, for SetLongMode to use. They take
+// PageTablesSize bytes.
+func WritePageTables(mem []byte, base uint64) error {
+	if base%pageSize != 0 || base+PageTablesSize > uint64(len(mem)) {
+		return fmt.Errorf("%w: page tables at %#x", ErrLayout, base)
+	}
+
+	b := mem[base : base+PageTablesSize]
+	for i := range b {
+		b[i] = 0
+	}
+
+	le := binary.LittleEndian
+
+	le.PutUint64(b[bootCS:], gdtCode)
+	le.PutUint64(b[bootDS:], gdtData)
+
+	pml4, pdpt, pd := b[pageSize:], b[2*pageSize:], b[3*pageSize:]
+
+	le.PutUint64(pml4, base+2*pageSize|ptePresent|pteWritable)
+
+	for i := uint64(0); i < 4; i++ {
+		le.PutUint64(pdpt[i*8:], base+(3+i)*pageSize|ptePresent|pteWritable)
+	}
+
+	for i := uint64(0); i < 4*512; i++ {
+		le.PutUint64(pd[i*8:], i<<21|ptePresent|pteWritable|pteHuge)
+	}
+
+	return nil
+}
+
+// SetLongMode sets sregs for a vCPU to run in long mode with the GDT and
+// page tables that WritePageTables wrote at base: paging and PAE on,
+// CR3 at the PML4, and flat 64-bit code and data segments, which are
+// __BOOT_CS and __BOOT_DS of the 64-bit boot protocol. A guest entered
+// this way needs no trampoline from real mode.
+func SetLongMode(sregs *kvm.Sregs, base uint64) {
+	code := kvm.Segment{
+		Limit: 0xFFFFFFFF, Selector: bootCS, Typ: 0xB, Present: 1, S: 1, L: 1, G: 1,
+	}
+	data := kvm.Segment{
+		Limit: 0xFFFFFFFF, Selector: bootDS, Typ: 0x3, Present: 1, DB: 1, S: 1, G: 1,
+	}
+
+	sregs.CS = code
+	sregs.DS, sregs.ES, sregs.FS, sregs.GS, sregs.SS = data, data, data, data, data
+
+	sregs.GDT = kvm.Descriptor{Base: base, Limit: 4*8 - 1}
+	sregs.CR3 = base + pageSize
+	sregs.CR4 |= cr4PAE
+	sregs.CR0 |= cr0PE | cr0PG
+	sregs.EFER |= eferLME | eferLMA
+}
@@ -0,0 +1,49 @@
+package loader_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/loader"
+)
+
+func TestWritePageTables(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+
+	for _, base := range []uint64{0x8800, 0xa000} {
+		if err := loader.WritePageTables(mem, base); !errors.Is(err, loader.ErrLayout) {
+			t.Fatalf("%#x: got %v, want %v", base, err, loader.ErrLayout)
+		}
+	}
+
+	if err := loader.WritePageTables(mem, 0x9000); err != nil {
+		t.Fatal(err)
+	}
+
+	le := binary.LittleEndian
+
+	if pml4e := le.Uint64(mem[0xa000:]); pml4e != 0xb003 {
+		t.Fatalf("PML4E %#x", pml4e)
+	}
+
+	if pdpte := le.Uint64(mem[0xb000+3*8:]); pdpte != 0xf003 {
+		t.Fatalf("PDPTE %#x", pdpte)
+	}
+
+	// The last 2MiB page below 4GiB.
+	if pde := le.Uint64(mem[0xf000+511*8:]); pde != 0xffe00083 {
+		t.Fatalf("PDE %#x", pde)
+	}
+
+	sregs := kvm.Sregs{CR0: 0x10, CR4: 0x200}
+	loader.SetLongMode(&sregs, 0x9000)
+
+	if sregs.CR3 != 0xa000 || sregs.GDT.Base != 0x9000 || sregs.CR0 != 0x80000011 || sregs.CR4 != 0x220 ||
+		sregs.EFER != 0x500 || sregs.CS.L != 1 || sregs.CS.DB != 0 || sregs.SS.Selector != 0x18 {
+		t.Fatalf("sregs %+v", sregs)
+	}
+}
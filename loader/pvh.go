@@ -0,0 +1,152 @@
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+)
+
+// PVH boots a kernel the way Xen starts its PVH guests, without firmware:
+// in 32-bit protected mode with paging off at the entry of the
+// XEN_ELFNOTE_PHYS32_ENTRY note, with EBX at an hvm_start_info that points
+// to the command line, the initrd as a module and the memory map.
+//
+// refs: https://xenbits.xen.org/docs/unstable/misc/pvh.html
+// refs: xen/include/public/arch-x86/hvm/start_info.h
+const (
+	xenElfnotePhys32Entry = 18
+	hvmStartMagic         = 0x336ec578
+
+	// The start info, the module list and the memory map, each at its
+	// offset from Layout.BootParams.
+	startInfoSize   = 56
+	modlistOffset   = 0x40
+	modlistSize     = 32
+	memmapOffset    = 0x80
+	memmapEntrySize = 24
+)
+
+type hvmStartInfo struct {
+	Magic         uint32
+	Version       uint32
+	Flags         uint32
+	NrModules     uint32
+	ModlistPaddr  uint64
+	CmdlinePaddr  uint64
+	RSDPPaddr     uint64
+	MemmapPaddr   uint64
+	MemmapEntries uint32
+	_             uint32
+}
+
+type hvmModlistEntry struct {
+	Paddr        uint64
+	Size         uint64
+	CmdlinePaddr uint64
+	_            uint64
+}
+
+type hvmMemmapEntry struct {
+	Addr uint64
+	Size uint64
+	// Type is that of E820.
+	Type uint32
+	_    uint32
+}
+
+// pvhEntry returns the PVH entry of f, if its notes have one.
+func pvhEntry(f *elf.File) (uint64, bool, error) {
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_NOTE {
+			continue
+		}
+
+		notes := make([]byte, p.Filesz)
+		if n, err := p.ReadAt(notes, 0); n < len(notes) {
+			return 0, false, fmt.Errorf("%w: notes: %v", ErrELF, err)
+		}
+
+		for len(notes) >= 12 {
+			namesz := uint64(f.ByteOrder.Uint32(notes))
+			descsz := uint64(f.ByteOrder.Uint32(notes[4:]))
+			typ := f.ByteOrder.Uint32(notes[8:])
+
+			name := 12 + (namesz+3)&^3
+			next := name + (descsz+3)&^3
+
+			if next > uint64(len(notes)) {
+				return 0, false, fmt.Errorf("%w: truncated note", ErrELF)
+			}
+
+			desc := notes[name : name+descsz]
+
+			if typ == xenElfnotePhys32Entry && bytes.Equal(notes[12:12+namesz], []byte("Xen\x00")) {
+				switch descsz {
+				case 4:
+					return uint64(f.ByteOrder.Uint32(desc)), true, nil
+				case 8:
+					return f.ByteOrder.Uint64(desc), true, nil
+				default:
+					return 0, false, fmt.Errorf("%w: PVH entry of %d bytes", ErrELF, descsz)
+				}
+			}
+
+			notes = notes[next:]
+		}
+	}
+
+	return 0, false, nil
+}
+
+// writeStartInfo writes the hvm_start_info of a PVH kernel, with the
+// initrd of initrdSize bytes as its module and e820 as its memory map, at
+// l.BootParams.
+func writeStartInfo(mem []byte, l Layout, initrdSize int, e820 []bootparam.E820Entry) error {
+	if len(e820) > bootparam.E820Max {
+		e820 = e820[:bootparam.E820Max]
+	}
+
+	size := uint64(memmapOffset + len(e820)*memmapEntrySize)
+	if l.BootParams+size > uint64(len(mem)) {
+		return fmt.Errorf("%w: start info at %#x", ErrLayout, l.BootParams)
+	}
+
+	info := hvmStartInfo{
+		Magic:         hvmStartMagic,
+		Version:       1,
+		CmdlinePaddr:  l.Cmdline,
+		MemmapPaddr:   l.BootParams + memmapOffset,
+		MemmapEntries: uint32(len(e820)),
+	}
+
+	b := mem[l.BootParams : l.BootParams+size]
+	for i := range b {
+		b[i] = 0
+	}
+
+	if initrdSize > 0 {
+		info.NrModules = 1
+		info.ModlistPaddr = l.BootParams + modlistOffset
+
+		put(b[modlistOffset:modlistOffset+modlistSize], hvmModlistEntry{Paddr: l.Initrd, Size: uint64(initrdSize)})
+	}
+
+	put(b[:startInfoSize], info)
+
+	for i, e := range e820 {
+		off := memmapOffset + i*memmapEntrySize
+		put(b[off:off+memmapEntrySize], hvmMemmapEntry{Addr: e.Addr, Size: e.Size, Type: e.Type})
+	}
+
+	return nil
+}
+
+// put writes v, of a fixed size that b has, to b.
+func put(b []byte, v interface{}) {
+	buf := &bytes.Buffer{}
+	_ = binary.Write(buf, binary.LittleEndian, v)
+	copy(b, buf.Bytes())
+}
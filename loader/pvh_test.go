@@ -0,0 +1,98 @@
+package loader_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/loader"
+)
+
+// pvhNote returns a Xen note of type XEN_ELFNOTE_PHYS32_ENTRY with entry
+// as a desc of size bytes.
+func pvhNote(entry uint64, size int) []byte {
+	b := make([]byte, 16+size)
+	binary.LittleEndian.PutUint32(b, 4)
+	binary.LittleEndian.PutUint32(b[4:], uint32(size))
+	binary.LittleEndian.PutUint32(b[8:], 18)
+	copy(b[12:], "Xen\x00")
+
+	if size == 4 {
+		binary.LittleEndian.PutUint32(b[16:], uint32(entry))
+	} else {
+		binary.LittleEndian.PutUint64(b[16:], entry)
+	}
+
+	return b
+}
+
+func TestLoadPVH(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{4, 8} {
+		mem := make([]byte, 0x30000)
+		e820 := []bootparam.E820Entry{
+			{Addr: 0, Size: 0x9fc00, Type: bootparam.E820Ram},
+			{Addr: 0xf0000, Size: 0x10000, Type: bootparam.E820Reserved},
+		}
+
+		// A note before the one of PVH is skipped.
+		other := pvhNote(0, 4)
+		other[8] = 1
+
+		notes := append(other, pvhNote(0x11040, size)...)
+		img := vmlinux(t, elf.ELFCLASS64, elf.EM_X86_64, 0x11000, 0xffffffff81011000, 0x11000,
+			make([]byte, 0x100), 0, notes...)
+
+		linux, err := loader.Load(mem, loader.Layout{
+			BootParams: 0x1000, Cmdline: 0x4000, Kernel: 0x10000, Initrd: 0x20000,
+		}, loader.Image{
+			Kernel:  bytes.NewReader(img),
+			Initrd:  bytes.NewReader([]byte("initrd")),
+			Cmdline: loader.ParseCmdline("console=ttyS0"),
+			E820:    e820,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !linux.PVH || linux.Long || linux.Entry != 0x11040 || linux.Params != nil {
+			t.Fatalf("PVH %v, long %v, entry %#x", linux.PVH, linux.Long, linux.Entry)
+		}
+
+		le := binary.LittleEndian
+		info := mem[0x1000:]
+
+		if le.Uint32(info) != 0x336ec578 || le.Uint32(info[4:]) != 1 || le.Uint32(info[12:]) != 1 ||
+			le.Uint64(info[24:]) != 0x4000 || le.Uint32(info[48:]) != 2 {
+			t.Fatalf("start info % x", info[:56])
+		}
+
+		mod := mem[le.Uint64(info[16:]):]
+		if le.Uint64(mod) != 0x20000 || le.Uint64(mod[8:]) != 6 {
+			t.Fatalf("module % x", mod[:32])
+		}
+
+		memmap := mem[le.Uint64(info[40:]):]
+		if le.Uint64(memmap[24:]) != 0xf0000 || le.Uint64(memmap[32:]) != 0x10000 || le.Uint32(memmap[40:]) != 2 {
+			t.Fatalf("memory map % x", memmap[:48])
+		}
+
+		regs := kvm.Regs{}
+		linux.SetRegs(&regs)
+
+		if regs.RIP != 0x11040 || regs.RBX != 0x1000 {
+			t.Fatalf("RIP %#x, RBX %#x", regs.RIP, regs.RBX)
+		}
+
+		sregs := kvm.Sregs{}
+		linux.SetSregs(&sregs)
+
+		if sregs.CR0 != 1 || sregs.EFER != 0 || sregs.CS.DB != 1 || sregs.CS.L != 0 {
+			t.Fatalf("sregs %+v", sregs)
+		}
+	}
+}
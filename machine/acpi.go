@@ -0,0 +1,157 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+// The ACPI tables of a kernel booted directly are where a guest without EFI
+// looks for the RSDP: on a 16-byte boundary in the E segment, which is not
+// RAM to it. The tables follow it, the XSDT last.
+const (
+	acpiRSDPAddr   = legacyBIOSStart
+	acpiTablesAddr = acpiRSDPAddr + 0x40
+	acpiTableAlign = 0x10
+
+	// The sleep control and status registers of the hardware-reduced
+	// platform. The reset register is 0xcf9, whose handler resets the
+	// machine on the value of the FADT.
+	acpiSleepControlPort = 0x600
+	acpiSleepStatusPort  = 0x601
+	acpiResetValue       = 0x06
+)
+
+// ErrorPowerOff indicates the guest entered S5 through the sleep control
+// register of the FADT, i.e. powered off.
+var ErrorPowerOff = errors.New("guest power off")
+
+// EnableACPI has LoadLinux give the guest ACPI tables, a MADT, FADT, DSDT
+// and the SSDT of PCI hotplug, SRAT and SLIT with SetNUMA, and a VIOT with
+// AddIOMMU, and AddFwCfg hand them to firmware, for it to find its
+// processors, power off without the MP table and the exit port, and eject
+// devices for UnplugPCIDevice. It must be called before either.
+func (m *Machine) EnableACPI() {
+	m.acpi = true
+	m.hotplug = acpi.NewHotplug(m)
+	m.hotplug.GED = true
+	m.hotplug.Eject = m.ejectPCIDevice
+}
+
+// acpiTables returns the DSDT, then the tables that the XSDT points to,
+// with the FADT pointing to the DSDT at dsdt.
+func (m *Machine) acpiTables(dsdt uint64) [][]byte {
+	ids := make([]uint8, len(m.vcpus))
+	for i := range ids {
+		// The APIC ID of a vCPU is its index.
+		ids[i] = uint8(i)
+	}
+
+	devices := [][]byte{
+		acpi.Device("PCI0",
+			acpi.Name("_HID", acpi.EISAID("PNP0A03")),
+			acpi.Name("_ADR", acpi.Integer(0)),
+			acpi.Name("_UID", acpi.Integer(0)),
+		),
+		acpi.Device("KBD",
+			acpi.Name("_HID", acpi.EISAID("PNP0303")),
+			acpi.Name("_CRS", acpi.ResourceTemplate(
+				acpi.IO(kbdDataPort, 1),
+				acpi.IO(kbdCommandPort, 1),
+				acpi.IRQNoFlags(kbdIRQ),
+			)),
+		),
+		acpi.Device("RTC",
+			acpi.Name("_HID", acpi.EISAID("PNP0B00")),
+			acpi.Name("_CRS", acpi.ResourceTemplate(
+				acpi.IO(cmosIndexPort, 2),
+				acpi.IRQNoFlags(rtcIRQ),
+			)),
+		),
+	}
+
+	// COM1 and those of AddUART.
+	for i, p := range comPorts {
+		if i > 0 && m.uarts[i] == nil {
+			continue
+		}
+
+		devices = append(devices, acpi.Device(fmt.Sprintf("COM%d", i+1),
+			acpi.Name("_HID", acpi.EISAID("PNP0501")),
+			acpi.Name("_UID", acpi.Integer(uint64(i+1))),
+			acpi.Name("_CRS", acpi.ResourceTemplate(
+				acpi.IO(uint16(p.addr), 8),
+				acpi.IRQNoFlags(int(p.irq)),
+			)),
+		))
+	}
+
+	tables := [][]byte{
+		acpi.DSDT(acpi.Scope(`\_SB`, devices...)),
+		acpi.FADT(dsdt, acpi.PowerManagement{
+			ResetPort:        0xcf9,
+			ResetValue:       acpiResetValue,
+			SleepControlPort: acpiSleepControlPort,
+			SleepStatusPort:  acpiSleepStatusPort,
+		}),
+		acpi.APICMADT(acpi.APIC{
+			LocalAPICBase: lapicAddr,
+			APICIDs:       ids,
+			IOAPICBase:    ioapicAddr,
+		}),
+	}
+
+	if srat, slit := m.NUMATables(); srat != nil {
+		tables = append(tables, srat, slit)
+	}
+
+	tables = append(tables, hotplugSSDT())
+
+	if m.iommu != nil {
+		tables = append(tables, acpi.VIOT(uint16(m.pciBDF("iommu")), m.iommuEndpoints()))
+	}
+
+	return tables
+}
+
+// writeACPI writes the RSDP and the tables of EnableACPI to guest RAM, for
+// a kernel booted directly.
+func (m *Machine) writeACPI() {
+	addr := uint64(acpiTablesAddr)
+	tables := m.acpiTables(addr)
+
+	var xsdt []uint64
+
+	for i, t := range tables {
+		// The DSDT is pointed to by the FADT alone.
+		if i > 0 {
+			xsdt = append(xsdt, addr)
+		}
+
+		copy(m.mem[addr:], t)
+		addr = (addr + uint64(len(t)) + acpiTableAlign - 1) &^ (acpiTableAlign - 1)
+	}
+
+	copy(m.mem[addr:], acpi.XSDT(xsdt))
+	copy(m.mem[acpiRSDPAddr:], acpi.RSDP(addr))
+}
+
+// acpiSleepIn reads the sleep registers, which tell nothing: the guest
+// never wakes up.
+func acpiSleepIn(port uint64, bytes []byte) error {
+	for i := range bytes {
+		bytes[i] = 0
+	}
+
+	return nil
+}
+
+// acpiSleepOut powers the machine off when the guest enters S5.
+func acpiSleepOut(port uint64, bytes []byte) error {
+	if typ, ok := acpi.SleepType(bytes[0]); ok && typ == acpi.SleepTypeS5 {
+		return ErrorPowerOff
+	}
+
+	return nil
+}
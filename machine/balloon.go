@@ -0,0 +1,87 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/virtio"
+	"github.com/bobuhiro11/gokvm/worker"
+)
+
+const virtioBalloonIRQ = 12
+
+// ErrorNoBalloon indicates a balloon request of a machine without AddBalloon.
+var ErrorNoBalloon = errors.New("no virtio-balloon device")
+
+// ErrorBalloonSize indicates a balloon larger than guest RAM.
+var ErrorBalloonSize = errors.New("balloon larger than guest RAM")
+
+// Balloon is the state of the virtio-balloon device of AddBalloon.
+type Balloon struct {
+	// Target is the size SetBalloon asked for, and Actual that the guest
+	// has in the balloon.
+	Target, Actual uint64
+	// Reclaimed is the memory the host freed for the balloon so far.
+	Reclaimed uint64
+}
+
+func (b Balloon) String() string {
+	return fmt.Sprintf("%d MiB in the balloon of %d MiB, %d MiB reclaimed",
+		b.Actual>>20, b.Target>>20, b.Reclaimed>>20)
+}
+
+// AddBalloon gives the guest a virtio-balloon device, with which
+// SetBalloon takes memory back from it. As with AddIODevice, the kernel or
+// ROM must be loaded first.
+func (m *Machine) AddBalloon() {
+	v := virtio.NewBalloon(virtioBalloonIRQ, m, m.mem)
+	v.Runner = m.workerQueue(worker.Background)
+	m.balloon = v
+
+	go v.IOThreadEntry()
+
+	m.addPCIDevice("balloon", v)
+	m.OnShutdown(ShutdownQuiesce, "balloon", v.Close)
+	start, end := v.GetIORange()
+	m.registerIOPortHandler(start, end, v.IOInHandler, v.IOOutHandler)
+}
+
+// SetBalloon asks the guest to give up size bytes of its RAM to the
+// balloon, whose memory the host frees, or to take them back if the
+// balloon is larger. The guest does so in its own time; Balloon tells how
+// far it got.
+func (m *Machine) SetBalloon(size uint64) error {
+	if m.balloon == nil {
+		return ErrorNoBalloon
+	}
+
+	if size > uint64(len(m.mem)) {
+		return fmt.Errorf("%w: %#x of %#x", ErrorBalloonSize, size, len(m.mem))
+	}
+
+	return m.balloon.SetTarget(uint32(size / virtio.BalloonPageSize))
+}
+
+// Balloon returns the state of the virtio-balloon device.
+func (m *Machine) Balloon() (Balloon, error) {
+	if m.balloon == nil {
+		return Balloon{}, ErrorNoBalloon
+	}
+
+	target, actual, reclaimed := m.balloon.Pages()
+
+	return Balloon{
+		Target:    uint64(target) * virtio.BalloonPageSize,
+		Actual:    uint64(actual) * virtio.BalloonPageSize,
+		Reclaimed: reclaimed * virtio.BalloonPageSize,
+	}, nil
+}
+
+func (m *Machine) InjectVirtioBalloonIRQ() error {
+	if err := kvm.IRQLine(m.vmFd, virtioBalloonIRQ, 0); err != nil {
+		return err
+	}
+
+	return kvm.IRQLine(m.vmFd, virtioBalloonIRQ, 1)
+}
@@ -0,0 +1,42 @@
+package machine
+
+import "errors"
+
+// The legacy BIOS area, where a PC aliases the end of its firmware below
+// 1MiB for the real-mode code of a BIOS: the far jump at the reset vector
+// goes to the F segment.
+const (
+	legacyBIOSStart = 0xe0000
+	legacyBIOSEnd   = 0x100000
+)
+
+// ErrorNoROM indicates a call that needs the ROM of LoadROM before it.
+var ErrorNoROM = errors.New("no ROM loaded")
+
+// ShadowBIOS copies the last 128KiB of the ROM of LoadROM, or all of a
+// smaller one, to guest RAM right below 1MiB, for a legacy BIOS such as
+// SeaBIOS: its reset vector jumps there, and it keeps its data there once
+// it has made the area writable RAM through the PAM registers of the
+// chipset, which it finds to be RAM already. It is what QEMU calls
+// shadowing, done before the BIOS runs rather than by it, so that legacy
+// bootloaders, e.g. GRUB for BIOS or DOS, run unmodified. Reset copies it
+// again, as a PC maps the ROM back on reset.
+func (m *Machine) ShadowBIOS() error {
+	if m.rom == nil {
+		return ErrorNoROM
+	}
+
+	m.shadowBIOS = true
+	m.copyBIOS()
+
+	return nil
+}
+
+func (m *Machine) copyBIOS() {
+	bios := m.rom
+	if len(bios) > legacyBIOSEnd-legacyBIOSStart {
+		bios = bios[len(bios)-(legacyBIOSEnd-legacyBIOSStart):]
+	}
+
+	copy(m.mem[legacyBIOSEnd-len(bios):legacyBIOSEnd], bios)
+}
@@ -0,0 +1,149 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/output"
+)
+
+// BusLockPolicy is what the machine does about a guest taking bus locks,
+// e.g. split locks across cache lines, which stall memory for the whole
+// host.
+type BusLockPolicy int
+
+const (
+	// BusLockLog logs bus locks, the first and then at every power of two
+	// of them per vCPU.
+	BusLockLog BusLockPolicy = iota
+	// BusLockThrottle holds back a vCPU that takes bus locks faster than
+	// a rate.
+	BusLockThrottle
+	// BusLockKill stops the vCPU with ErrorBusLock.
+	BusLockKill
+)
+
+// ErrorNoBusLockExit indicates a bus lock policy for a machine whose vCPUs
+// do not exit on bus locks.
+var ErrorNoBusLockExit = errors.New("bus lock exits are not available")
+
+// ErrorBusLock indicates a bus lock of the guest under BusLockKill.
+var ErrorBusLock = errors.New("guest took a bus lock")
+
+// busLocks is what the machine knows of the bus locks of the guest.
+type busLocks struct {
+	mu sync.Mutex
+
+	// enabled tells whether KVM exits on bus locks, which takes effect at
+	// the creation of vCPUs only.
+	enabled bool
+
+	policy BusLockPolicy
+	// interval is the least time between bus locks of a vCPU under
+	// BusLockThrottle.
+	interval time.Duration
+
+	// count and next are by vCPU: how many bus locks it took, and when it
+	// may take the next without being held back.
+	count []uint64
+	next  []time.Time
+}
+
+// enableBusLockExit has the vCPUs exit on bus locks, if KVM can, so that
+// SetBusLockPolicy can act on them. It must come before the vCPUs are
+// created.
+func (m *Machine) enableBusLockExit(nCpus int) error {
+	modes, err := kvm.CheckExtension(m.vmFd, kvm.CapX86BusLockExit)
+	if err != nil || modes&kvm.BusLockDetectionExit == 0 {
+		return nil
+	}
+
+	if err := kvm.EnableCap(m.vmFd, &kvm.EnableCapability{
+		Cap:  kvm.CapX86BusLockExit,
+		Args: [4]uint64{kvm.BusLockDetectionExit},
+	}); err != nil {
+		return fmt.Errorf("enable bus lock exits: %w", err)
+	}
+
+	m.busLocks.enabled = true
+	m.busLocks.count = make([]uint64, nCpus)
+	m.busLocks.next = make([]time.Time, nCpus)
+
+	return nil
+}
+
+// SetBusLockPolicy sets what to do about bus locks of the guest, BusLockLog
+// by default. rate is how many bus locks per second and vCPU
+// BusLockThrottle lets through.
+func (m *Machine) SetBusLockPolicy(policy BusLockPolicy, rate int) error {
+	m.busLocks.mu.Lock()
+	defer m.busLocks.mu.Unlock()
+
+	if !m.busLocks.enabled {
+		return ErrorNoBusLockExit
+	}
+
+	m.busLocks.policy = policy
+	m.busLocks.interval = 0
+
+	if rate > 0 {
+		m.busLocks.interval = time.Second / time.Duration(rate)
+	}
+
+	return nil
+}
+
+// BusLocks returns how many bus locks vCPU i took so far.
+func (m *Machine) BusLocks(i int) uint64 {
+	m.busLocks.mu.Lock()
+	defer m.busLocks.mu.Unlock()
+
+	if !m.busLocks.enabled {
+		return 0
+	}
+
+	return m.busLocks.count[i]
+}
+
+// busLock acts on a bus lock that vCPU i took, according to the policy.
+func (m *Machine) busLock(i int) error {
+	b := &m.busLocks
+
+	b.mu.Lock()
+	b.count[i]++
+	n := b.count[i]
+	policy := b.policy
+
+	var wait time.Duration
+
+	if policy == BusLockThrottle {
+		now := time.Now()
+		if b.next[i].After(now) {
+			wait = b.next[i].Sub(now)
+		} else {
+			b.next[i] = now
+		}
+
+		b.next[i] = b.next[i].Add(b.interval)
+	}
+	b.mu.Unlock()
+
+	switch policy {
+	case BusLockKill:
+		return fmt.Errorf("%w: vCPU %d", ErrorBusLock, i)
+	case BusLockThrottle:
+		if wait > 0 {
+			m.vcpuStates.set(i, VCPUInExit, "bus lock throttle")
+			time.Sleep(wait)
+		}
+	case BusLockLog:
+		if n&(n-1) == 0 {
+			m.out.Event("bus_lock", output.Fields{"cpu": i, "count": n}, "vCPU %d: bus lock, %d so far", i, n)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,416 @@
+package machine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/vtimer"
+)
+
+// CMOS registers of the memory size, as QEMU sets them for its BIOS, which
+// SeaBIOS reads when there is no fw_cfg to tell it.
+//
+// refs: https://gitlab.com/qemu-project/qemu/-/blob/master/hw/i386/pc.c
+const (
+	cmosIndexPort = 0x70
+	cmosDataPort  = 0x71
+
+	cmosRegA         = 0x0a
+	cmosRegB         = 0x0b
+	cmosRegC         = 0x0c
+	cmosRegD         = 0x0d
+	cmosBaseMem      = 0x15 // KiB below 1MiB, 640
+	cmosExtMem       = 0x17 // KiB from 1MiB, up to 63MiB
+	cmosExtMem2      = 0x30 // the same again
+	cmosHighMem      = 0x34 // 64KiB from 16MiB up to 4GiB
+	cmosAbove4G      = 0x5b // 64KiB above 4GiB, 3 bytes
+	cmosCPUs         = 0x5f // vCPUs - 1
+	cmosRegisterMask = 0x7f
+)
+
+// The clock of the MC146818, in BCD unless rtcDM, and its interrupts on
+// rtcIRQ: periodic at the rate of register A, on the update of the time
+// every second, and on the alarm of the three alarm registers, each of
+// which matches any value from rtcDontCare.
+//
+// refs: https://www.nxp.com/docs/en/data-sheet/MC146818.pdf
+const (
+	rtcIRQ = 8
+
+	cmosSeconds      = 0x00
+	cmosSecondsAlarm = 0x01
+	cmosMinutes      = 0x02
+	cmosMinutesAlarm = 0x03
+	cmosHours        = 0x04
+	cmosHoursAlarm   = 0x05
+	cmosWeekday      = 0x06
+	cmosDay          = 0x07
+	cmosMonth        = 0x08
+	cmosYear         = 0x09
+	cmosCentury      = 0x32 // as the FADT of QEMU has it
+
+	rtcUIP      = 0x80 // register A: update in progress, never
+	rtcRateMask = 0x0f
+	rtcSET      = 0x80 // register B: the guest is setting the time
+	rtcPIE      = 0x40
+	rtcAIE      = 0x20
+	rtcUIE      = 0x10
+	rtcDM       = 0x04 // binary rather than BCD
+	rtc24H      = 0x02
+	rtcIRQF     = 0x80 // register C: any of the flags below that is enabled
+	rtcPF       = 0x40
+	rtcAF       = 0x20
+	rtcUF       = 0x10
+	rtcFlags    = rtcPF | rtcAF | rtcUF
+	rtcDontCare = 0xc0
+	rtcPM       = 0x80 // of the hours in 12-hour mode
+)
+
+// cmos is the MC146818 RTC with its CMOS memory, which has the memory size
+// for firmware. Its clock is the wall clock of the host in UTC until the
+// guest sets it, and keeps the difference across resets; its timers run on
+// the virtual clock of the machine.
+type cmos struct {
+	mu    sync.Mutex
+	index byte
+	regs  [128]byte
+
+	clock  *vtimer.Clock
+	irq    func(level uint32)
+	offset time.Duration
+	level  bool
+
+	periodic, update *vtimer.Timer
+	period           time.Duration
+}
+
+// newCMOS returns a CMOS for memSize bytes of RAM from 0 and cpus vCPUs,
+// whose timers run on clock and which raises and lowers its interrupt
+// with irq.
+func newCMOS(memSize uint64, cpus int, clock *vtimer.Clock, irq func(level uint32)) *cmos {
+	c := &cmos{clock: clock, irq: irq}
+
+	c.regs[cmosRegA] = 0x26 // 32.768kHz time base, 1024Hz periodic rate
+	c.regs[cmosRegB] = 0x02 // 24-hour mode
+	c.regs[cmosRegD] = 0x80 // valid RAM and time
+	c.latch()
+
+	c.set16(cmosBaseMem, 640)
+
+	below4G, above4G := memSize, uint64(0)
+	if memSize > 1<<32 {
+		below4G, above4G = 1<<32, memSize-1<<32
+	}
+
+	ext := (below4G - 1<<20) >> 10
+	if below4G < 1<<20 {
+		ext = 0
+	}
+
+	if ext > 0xfc00 {
+		ext = 0xfc00
+	}
+
+	c.set16(cmosExtMem, uint16(ext))
+	c.set16(cmosExtMem2, uint16(ext))
+
+	if below4G > 16<<20 {
+		high := (below4G - 16<<20) >> 16
+		if high > 0xffff {
+			high = 0xffff
+		}
+
+		c.set16(cmosHighMem, uint16(high))
+	}
+
+	above4G >>= 16
+	c.regs[cmosAbove4G] = byte(above4G)
+	c.regs[cmosAbove4G+1] = byte(above4G >> 8)
+	c.regs[cmosAbove4G+2] = byte(above4G >> 16)
+
+	if cpus > 0 {
+		c.regs[cmosCPUs] = byte(cpus - 1)
+	}
+
+	return c
+}
+
+func (c *cmos) set16(reg int, v uint16) {
+	c.regs[reg] = byte(v)
+	c.regs[reg+1] = byte(v >> 8)
+}
+
+// reset disables the interrupts and clears their flags, as the RESET pin
+// does; the time and memory stay.
+func (c *cmos) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.regs[cmosRegB] &^= rtcPIE | rtcAIE | rtcUIE
+	c.regs[cmosRegC] = 0
+	c.lower()
+	c.schedule()
+}
+
+func (c *cmos) In(port uint64, bytes []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range bytes {
+		bytes[i] = 0
+	}
+
+	if port != cmosDataPort {
+		return nil
+	}
+
+	switch c.index {
+	case cmosSeconds, cmosMinutes, cmosHours, cmosWeekday, cmosDay, cmosMonth, cmosYear, cmosCentury:
+		c.latch()
+	case cmosRegC:
+		// Reading the flags clears them, and the interrupt with them.
+		bytes[0] = c.regs[cmosRegC]
+		c.regs[cmosRegC] = 0
+		c.lower()
+
+		return nil
+	}
+
+	bytes[0] = c.regs[c.index]
+
+	return nil
+}
+
+func (c *cmos) Out(port uint64, bytes []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if port == cmosIndexPort {
+		// Bit 7 masks NMIs, which there are none of to mask.
+		c.index = bytes[0] & cmosRegisterMask
+
+		return nil
+	}
+
+	v := bytes[0]
+
+	switch c.index {
+	case cmosSeconds, cmosMinutes, cmosHours, cmosWeekday, cmosDay, cmosMonth, cmosYear, cmosCentury:
+		c.latch()
+		c.regs[c.index] = v
+
+		if c.regs[cmosRegB]&rtcSET == 0 {
+			c.set()
+		}
+	case cmosRegA:
+		c.regs[cmosRegA] = v &^ rtcUIP
+		c.schedule()
+	case cmosRegB:
+		old := c.regs[cmosRegB]
+		if v&rtcSET != 0 {
+			// The registers hold the time from when the guest
+			// began to set it, and update-ended interrupts stop.
+			c.latch()
+			v &^= rtcUIE
+		}
+
+		c.regs[cmosRegB] = v
+
+		if old&rtcSET != 0 && v&rtcSET == 0 {
+			c.set()
+		}
+
+		c.schedule()
+		c.raise()
+	case cmosRegC, cmosRegD:
+		// Read-only.
+	default:
+		c.regs[c.index] = v
+	}
+
+	return nil
+}
+
+// now returns the time of the clock.
+func (c *cmos) now() time.Time {
+	return time.Now().Add(c.offset).UTC()
+}
+
+func (c *cmos) encode(v int) byte {
+	if c.regs[cmosRegB]&rtcDM != 0 {
+		return byte(v)
+	}
+
+	return byte(v/10<<4 | v%10)
+}
+
+func (c *cmos) decode(b byte) int {
+	if c.regs[cmosRegB]&rtcDM != 0 {
+		return int(b)
+	}
+
+	return int(b>>4)*10 + int(b&0xf)
+}
+
+func (c *cmos) encodeHours(h int) byte {
+	if c.regs[cmosRegB]&rtc24H != 0 {
+		return c.encode(h)
+	}
+
+	b := c.encode((h+11)%12 + 1)
+	if h >= 12 {
+		b |= rtcPM
+	}
+
+	return b
+}
+
+func (c *cmos) decodeHours(b byte) int {
+	if c.regs[cmosRegB]&rtc24H != 0 {
+		return c.decode(b)
+	}
+
+	h := c.decode(b&^rtcPM) % 12
+	if b&rtcPM != 0 {
+		h += 12
+	}
+
+	return h
+}
+
+// latch puts the time of the clock in its registers, unless the guest is
+// setting it.
+func (c *cmos) latch() {
+	if c.regs[cmosRegB]&rtcSET != 0 {
+		return
+	}
+
+	t := c.now()
+	c.regs[cmosSeconds] = c.encode(t.Second())
+	c.regs[cmosMinutes] = c.encode(t.Minute())
+	c.regs[cmosHours] = c.encodeHours(t.Hour())
+	c.regs[cmosWeekday] = c.encode(int(t.Weekday()) + 1)
+	c.regs[cmosDay] = c.encode(t.Day())
+	c.regs[cmosMonth] = c.encode(int(t.Month()))
+	c.regs[cmosYear] = c.encode(t.Year() % 100)
+	c.regs[cmosCentury] = c.encode(t.Year() / 100)
+}
+
+// set sets the clock to the time in its registers.
+func (c *cmos) set() {
+	t := time.Date(
+		c.decode(c.regs[cmosCentury])*100+c.decode(c.regs[cmosYear]),
+		time.Month(c.decode(c.regs[cmosMonth])), c.decode(c.regs[cmosDay]),
+		c.decodeHours(c.regs[cmosHours]), c.decode(c.regs[cmosMinutes]), c.decode(c.regs[cmosSeconds]),
+		0, time.UTC)
+	c.offset = time.Until(t)
+	c.schedule()
+}
+
+// rtcPeriod returns the period of the periodic interrupt at rate, of
+// register A, which is 1 to 15.
+func rtcPeriod(rate byte) time.Duration {
+	// Rates 1 and 2 are those of 8 and 9 with a 32.768kHz time base.
+	if rate <= 2 {
+		rate += 7
+	}
+
+	return time.Second * time.Duration(1<<(rate-1)) / 32768
+}
+
+// schedule arms the timers of the enabled interrupts and stops the others.
+func (c *cmos) schedule() {
+	period := time.Duration(0)
+	if rate := c.regs[cmosRegA] & rtcRateMask; c.regs[cmosRegB]&rtcPIE != 0 && rate != 0 {
+		period = rtcPeriod(rate)
+	}
+
+	switch {
+	case period == c.period:
+	case period == 0:
+		c.periodic.Stop()
+	case c.periodic == nil:
+		c.periodic = c.clock.NewTimer("rtc-periodic", period, period, c.periodicTick)
+	default:
+		c.periodic.Reset(period, period)
+	}
+
+	c.period = period
+
+	if c.regs[cmosRegB]&(rtcAIE|rtcUIE) == 0 || c.regs[cmosRegB]&rtcSET != 0 {
+		if c.update != nil {
+			c.update.Stop()
+		}
+
+		return
+	}
+
+	// The time updates at the start of each second of the clock.
+	next := time.Second - time.Duration(c.now().Nanosecond())
+	if c.update == nil {
+		c.update = c.clock.NewTimer("rtc-update", next, 0, c.updateTick)
+	} else {
+		c.update.Reset(next, 0)
+	}
+}
+
+func (c *cmos) periodicTick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.regs[cmosRegC] |= rtcPF
+	c.raise()
+}
+
+func (c *cmos) updateTick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.regs[cmosRegB]&rtcSET != 0 {
+		return
+	}
+
+	c.latch()
+	c.regs[cmosRegC] |= rtcUF
+
+	alarm := true
+
+	for _, r := range [][2]byte{
+		{cmosSecondsAlarm, cmosSeconds},
+		{cmosMinutesAlarm, cmosMinutes},
+		{cmosHoursAlarm, cmosHours},
+	} {
+		if a := c.regs[r[0]]; a&rtcDontCare != rtcDontCare && a != c.regs[r[1]] {
+			alarm = false
+		}
+	}
+
+	if alarm {
+		c.regs[cmosRegC] |= rtcAF
+	}
+
+	c.raise()
+	c.schedule()
+}
+
+// raise raises the interrupt if a flag is set whose interrupt is enabled,
+// which have the same bits in registers C and B.
+func (c *cmos) raise() {
+	if c.regs[cmosRegC]&c.regs[cmosRegB]&rtcFlags == 0 {
+		return
+	}
+
+	c.regs[cmosRegC] |= rtcIRQF
+
+	if !c.level {
+		c.level = true
+		c.irq(1)
+	}
+}
+
+func (c *cmos) lower() {
+	if c.level {
+		c.level = false
+		c.irq(0)
+	}
+}
@@ -0,0 +1,43 @@
+package machine
+
+import (
+	"io"
+
+	"github.com/bobuhiro11/gokvm/output"
+)
+
+// DebugconPort is the debug console of Bochs, to which firmware such as
+// SeaBIOS and the DEBUG builds of OVMF write their log a byte at a time,
+// from before any UART is set up. Reading it returns DebugconPort, which
+// tells them it is there.
+const DebugconPort = 0xe9
+
+// SetDebugconOutput has the machine write what the guest writes to
+// DebugconPort to w, where it is otherwise dropped.
+func (m *Machine) SetDebugconOutput(w io.Writer) {
+	m.debugcon = w
+}
+
+func (m *Machine) debugconIn(port uint64, bytes []byte) error {
+	for i := range bytes {
+		bytes[i] = 0
+	}
+
+	bytes[0] = DebugconPort
+
+	return nil
+}
+
+// debugconOut writes to the output of SetDebugconOutput, which, failing,
+// does not stop the guest.
+func (m *Machine) debugconOut(port uint64, bytes []byte) error {
+	if m.debugcon == nil {
+		return nil
+	}
+
+	if _, err := m.debugcon.Write(bytes); err != nil {
+		m.out.Event("debugcon_error", output.Fields{"error": err}, "debugcon: %v", err)
+	}
+
+	return nil
+}
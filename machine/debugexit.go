@@ -0,0 +1,69 @@
+package machine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrorDebugExit indicates a DebugExit that SetDebugExit cannot set.
+var ErrorDebugExit = errors.New("debug exit must be 1, 2 or 4 ports below 0x10000")
+
+// DebugExit is the port through which a guest ends the run with a status,
+// as with the isa-debug-exit device of QEMU, by default the byte at
+// ExitPort whose value is the status.
+type DebugExit struct {
+	Port uint16
+	// Size is how many ports from Port take the status, 1, 2 or 4.
+	Size int
+	// QEMU makes the status value<<1 | 1 for a write of value, as QEMU
+	// does, for test kernels written against it, which then never exit
+	// with 0 through it.
+	QEMU bool
+}
+
+// SetDebugExit moves the exit port of the guest to d, e.g. to
+// {Port: 0x501, Size: 2, QEMU: true} for a kernel that QEMU runs with
+// "-device isa-debug-exit,iobase=0x501,iosize=2". It must not overlap a
+// port of another device, and is in effect from the next LoadLinux or
+// LoadROM.
+func (m *Machine) SetDebugExit(d DebugExit) error {
+	if d.Size != 1 && d.Size != 2 && d.Size != 4 || int(d.Port)+d.Size > 0x10000 {
+		return fmt.Errorf("%w: %d at %#x", ErrorDebugExit, d.Size, d.Port)
+	}
+
+	m.debugExit = d
+
+	return nil
+}
+
+// debugExitPorts returns the ports of the debug exit.
+func (m *Machine) debugExitPorts() (uint64, uint64) {
+	if m.debugExit.Size == 0 {
+		return ExitPort, ExitPort + 1
+	}
+
+	return uint64(m.debugExit.Port), uint64(m.debugExit.Port) + uint64(m.debugExit.Size)
+}
+
+// debugExitOut handles a write to the debug exit, of which it takes the
+// bytes up to its last port as the value.
+func (m *Machine) debugExitOut(port uint64, bytes []byte) error {
+	var b [4]byte
+
+	_, end := m.debugExitPorts()
+	if n := end - port; uint64(len(bytes)) > n {
+		bytes = bytes[:n]
+	}
+
+	copy(b[:], bytes)
+
+	status := int(binary.LittleEndian.Uint32(b[:]))
+	if m.debugExit.QEMU {
+		status = status<<1 | 1
+	}
+
+	m.exitCode = status
+
+	return fmt.Errorf("exit status %d: %w", m.exitCode, ErrorGuestExit)
+}
@@ -0,0 +1,140 @@
+package machine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/output"
+	"github.com/bobuhiro11/gokvm/snapshot"
+)
+
+// DebugPort takes debug commands of the guest, so that test code in it
+// can coordinate with the VMM without an agent or a network: the low byte
+// of a write is the command, and the other bytes of a 16- or 32-bit write
+// its argument, e.g. for a trace point:
+//
+//	mov eax, 42 << 8 | DebugTrace
+//	out DebugPort, eax
+const DebugPort = 0xf5
+
+// Debug commands.
+const (
+	// DebugDumpRegs reports the registers of all vCPUs, which are paused
+	// meanwhile, as a debug_regs event each.
+	DebugDumpRegs = 1
+	// DebugTrace reports a debug_trace event with the argument as mark.
+	DebugTrace = 2
+	// DebugSnapshot saves a snapshot named debug-<argument> in the store
+	// of SetDebugSnapshots, with the vCPUs paused.
+	DebugSnapshot = 3
+)
+
+// SetDebugSnapshots has DebugSnapshot save snapshots in s.
+func (m *Machine) SetDebugSnapshots(s *snapshot.Store) {
+	m.debugSnapshots = s
+}
+
+// debugOut handles a write to DebugPort. Commands that pause the vCPUs run
+// on a goroutine of their own, as the vCPU that writes is one of them, so
+// that they happen shortly after the write rather than before it returns.
+func (m *Machine) debugOut(port uint64, bytes []byte) error {
+	var b [4]byte
+
+	copy(b[:], bytes)
+
+	v := binary.LittleEndian.Uint32(b[:])
+	cmd, arg := v&0xff, v>>8
+	cpu := m.currentVCPU()
+
+	switch cmd {
+	case DebugDumpRegs:
+		go m.whilePaused(m.dumpRegs)
+	case DebugTrace:
+		m.out.Event("debug_trace", output.Fields{"cpu": cpu, "mark": arg}, "vCPU %d: trace point %d", cpu, arg)
+	case DebugSnapshot:
+		go m.whilePaused(func() { m.debugSnapshot(arg) })
+	default:
+		m.out.Event("debug_error", output.Fields{"cpu": cpu, "command": cmd},
+			"vCPU %d: unknown debug command %d", cpu, cmd)
+	}
+
+	return nil
+}
+
+// currentVCPU returns the index of the vCPU of the calling thread, or -1.
+func (m *Machine) currentVCPU() int {
+	tid := syscall.Gettid()
+
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	for i, t := range m.vcpuTids {
+		if t == tid {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// whilePaused runs f with the vCPUs paused, one debug command at a time.
+func (m *Machine) whilePaused(f func()) {
+	m.debugMu.Lock()
+	defer m.debugMu.Unlock()
+
+	m.Pause()
+	defer m.Resume()
+
+	f()
+}
+
+func (m *Machine) dumpRegs() {
+	for i := range m.vcpus {
+		regs, err := m.Regs(i)
+		if err != nil {
+			m.out.Event("debug_error", output.Fields{"cpu": i, "error": err}, "vCPU %d: %v", i, err)
+
+			continue
+		}
+
+		sregs, err := m.Sregs(i)
+		if err != nil {
+			m.out.Event("debug_error", output.Fields{"cpu": i, "error": err}, "vCPU %d: %v", i, err)
+
+			continue
+		}
+
+		m.out.Event("debug_regs", output.Fields{
+			"cpu": i,
+			"rax": regs.RAX, "rbx": regs.RBX, "rcx": regs.RCX, "rdx": regs.RDX,
+			"rsi": regs.RSI, "rdi": regs.RDI, "rsp": regs.RSP, "rbp": regs.RBP,
+			"r8": regs.R8, "r9": regs.R9, "r10": regs.R10, "r11": regs.R11,
+			"r12": regs.R12, "r13": regs.R13, "r14": regs.R14, "r15": regs.R15,
+			"rip": regs.RIP, "rflags": regs.RFLAGS,
+			"cs": sregs.CS.Selector, "cr0": sregs.CR0, "cr2": sregs.CR2, "cr3": sregs.CR3,
+			"cr4": sregs.CR4, "efer": sregs.EFER,
+		}, "vCPU %d: rip %#x rsp %#x rflags %#x cs %#x cr0 %#x cr3 %#x cr4 %#x efer %#x "+
+			"rax %#x rbx %#x rcx %#x rdx %#x rsi %#x rdi %#x rbp %#x",
+			i, regs.RIP, regs.RSP, regs.RFLAGS, sregs.CS.Selector, sregs.CR0, sregs.CR3, sregs.CR4, sregs.EFER,
+			regs.RAX, regs.RBX, regs.RCX, regs.RDX, regs.RSI, regs.RDI, regs.RBP)
+	}
+}
+
+func (m *Machine) debugSnapshot(arg uint32) {
+	name := fmt.Sprintf("debug-%d", arg)
+
+	if m.debugSnapshots == nil {
+		m.out.Event("debug_error", output.Fields{"snapshot": name}, "snapshot %s: no snapshot store", name)
+
+		return
+	}
+
+	if err := m.SaveSnapshot(m.debugSnapshots, name); err != nil {
+		m.out.Event("debug_error", output.Fields{"snapshot": name, "error": err}, "snapshot %s: %v", name, err)
+
+		return
+	}
+
+	m.out.Event("debug_snapshot", output.Fields{"snapshot": name}, "saved snapshot %s", name)
+}
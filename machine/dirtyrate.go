@@ -0,0 +1,133 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// ErrorDirtyRateWindow indicates a window of MeasureDirtyRate that is not
+// positive.
+var ErrorDirtyRateWindow = errors.New("dirty rate window must be positive")
+
+// DirtyRate is how fast the guest writes to its RAM, which tells whether a
+// live migration over a link would converge: only if the link moves more
+// than BytesPerSecond.
+type DirtyRate struct {
+	Window time.Duration
+	// Pages are the pages of guest RAM written during Window.
+	Pages          int
+	PagesPerSecond float64
+	// VCPUs are the shares of the vCPUs in the rate.
+	VCPUs []VCPUDirtyRate
+}
+
+// VCPUDirtyRate is the dirty rate of a vCPU. KVM logs dirty pages by slot
+// rather than by vCPU, so the rate is estimated from the share of the vCPU
+// in the page faults KVM fixed meanwhile, most of which are writes to the
+// pages that dirty logging protects. Hosts that log with PML instead take
+// no such faults, and the rate is unknown.
+type VCPUDirtyRate struct {
+	CPU            int
+	Faults         uint64
+	PagesPerSecond float64
+	Known          bool
+}
+
+// BytesPerSecond returns the rate in bytes.
+func (r DirtyRate) BytesPerSecond() float64 {
+	return r.PagesPerSecond * pageSize
+}
+
+func (r DirtyRate) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d pages dirtied in %v: %.1f pages/s, %.2f MiB/s",
+		r.Pages, r.Window, r.PagesPerSecond, r.BytesPerSecond()/(1<<20))
+
+	for _, v := range r.VCPUs {
+		if v.Known {
+			fmt.Fprintf(&b, "\nvCPU %d: %.1f pages/s (estimated from %d faults)", v.CPU, v.PagesPerSecond, v.Faults)
+		} else {
+			fmt.Fprintf(&b, "\nvCPU %d: unknown", v.CPU)
+		}
+	}
+
+	return b.String()
+}
+
+// vcpuWriteFaults are the stats of the page faults a vCPU takes on
+// writes to pages that dirty logging protects: fixed without the MMU lock
+// if possible, or else with it.
+var vcpuWriteFaults = []string{"pf_fast", "pf_fixed"}
+
+// MeasureDirtyRate logs the pages the guest writes for window while it
+// runs, and returns the rate, e.g. to predict whether a live migration
+// would converge before starting one. It waits for SaveMemoryLive, which
+// also logs dirty pages, and vice versa.
+func (m *Machine) MeasureDirtyRate(window time.Duration) (DirtyRate, error) {
+	if window <= 0 {
+		return DirtyRate{}, fmt.Errorf("%w: %v", ErrorDirtyRateWindow, window)
+	}
+
+	m.dirtyLogMu.Lock()
+	defer m.dirtyLogMu.Unlock()
+
+	if err := m.setDirtyLog(true); err != nil {
+		return DirtyRate{}, err
+	}
+
+	defer func() { _ = m.setDirtyLog(false) }()
+
+	faults := func() []uint64 {
+		n := make([]uint64, len(m.vcpus))
+
+		for i := range m.vcpus {
+			if s, err := m.VCPUStats(i); err == nil {
+				for _, name := range vcpuWriteFaults {
+					n[i] += s[name]
+				}
+			}
+		}
+
+		return n
+	}
+
+	before := faults()
+	start := time.Now()
+
+	time.Sleep(window)
+
+	bitmap := make([]uint64, len(m.mem)/pageSize/64)
+	if err := m.getDirtyLog(bitmap); err != nil {
+		return DirtyRate{}, err
+	}
+
+	r := DirtyRate{Window: time.Since(start)}
+
+	for _, w := range bitmap {
+		r.Pages += bits.OnesCount64(w)
+	}
+
+	r.PagesPerSecond = float64(r.Pages) / r.Window.Seconds()
+
+	after := faults()
+	total := uint64(0)
+
+	for i := range after {
+		total += after[i] - before[i]
+	}
+
+	for i := range after {
+		v := VCPUDirtyRate{CPU: i, Faults: after[i] - before[i], Known: total > 0}
+		if v.Known {
+			v.PagesPerSecond = r.PagesPerSecond * float64(v.Faults) / float64(total)
+		}
+
+		r.VCPUs = append(r.VCPUs, v)
+	}
+
+	return r, nil
+}
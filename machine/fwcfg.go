@@ -0,0 +1,69 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/fwcfg"
+)
+
+// AddFwCfg adds f at the fw_cfg ports, with the RAM size, number of vCPUs,
+// E820 table, SMBIOS tables, boot order and, with EnableACPI, ACPI tables
+// of the machine, for firmware such as OVMF and SeaBIOS to find them the way they do on QEMU. The boot order is the
+// virtio-blk disk first, then the virtio-net NIC. As with AddIODevice, the
+// kernel or ROM must be loaded first.
+func (m *Machine) AddFwCfg(f *fwcfg.FwCfg) error {
+	if err := m.waitMemory(); err != nil {
+		return err
+	}
+
+	f.SetMemory(m.mem)
+	f.SetMachine(uint64(len(m.mem)), len(m.vcpus))
+
+	e820 := &bytes.Buffer{}
+	if err := binary.Write(e820, binary.LittleEndian, m.e820()); err != nil {
+		return err
+	}
+
+	if err := f.AddFile("etc/e820", e820.Bytes()); err != nil {
+		return err
+	}
+
+	// Firmware puts the SMBIOS tables where it likes and fixes the address
+	// of the entry point up.
+	t := m.smbiosTables()
+
+	if err := f.AddFile("etc/smbios/smbios-tables", t.Data); err != nil {
+		return err
+	}
+
+	if err := f.AddFile("etc/smbios/smbios-anchor", t.EntryPoint(0)); err != nil {
+		return err
+	}
+
+	var order []string
+
+	if slot, ok := m.pciSlots["blk"]; ok {
+		order = append(order, fmt.Sprintf("/pci@i0cf8/scsi@%x/disk@0,0", slot))
+	}
+
+	if slot, ok := m.pciSlots["net"]; ok {
+		order = append(order, fmt.Sprintf("/pci@i0cf8/ethernet@%x/ethernet-phy@0", slot))
+	}
+
+	if err := f.SetBootOrder(order...); err != nil {
+		return err
+	}
+
+	// Firmware places the tables and points them to each other itself.
+	if m.acpi {
+		if err := f.SetACPITables(m.acpiTables(0)...); err != nil {
+			return err
+		}
+	}
+
+	m.AddIODevice(f)
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/output"
+)
+
+// sciIRQ is the interrupt of the Generic Event Device that takes the PCI
+// hotplug events of a hardware-reduced platform, which has no SCI of its
+// own.
+const sciIRQ = 6
+
+var (
+	// ErrorNoHotplug indicates a plug or unplug on a machine without the
+	// ACPI tables of EnableACPI, which tell the guest how to find and
+	// eject devices.
+	ErrorNoHotplug = errors.New("no ACPI PCI hotplug")
+	// ErrorPCIDevicePlugged indicates a plug of a PCI device that the
+	// guest has not ejected.
+	ErrorPCIDevicePlugged = errors.New("PCI device is plugged")
+)
+
+// hotplugSSDT returns the SSDT that makes all slots of bus 0 but that of
+// the bridge hotpluggable.
+func hotplugSSDT() []byte {
+	slots := []int{}
+	for slot := 1; slot < 32; slot++ {
+		slots = append(slots, slot)
+	}
+
+	ssdt, err := acpi.HotplugSSDT(slots, sciIRQ)
+	if err != nil {
+		// The slots are those of bus 0, which are all valid.
+		panic(err)
+	}
+
+	return ssdt
+}
+
+// PlugPCIDevice puts the PCI device name, which the guest ejected, back on
+// the PCI bus in its slot, with its I/O ports, and raises the interrupt of
+// the Generic Event Device for the guest to find it.
+func (m *Machine) PlugPCIDevice(name string) error {
+	if m.hotplug == nil {
+		return ErrorNoHotplug
+	}
+
+	slot, ok := m.pciSlots[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrorNoPCIDevice, name)
+	}
+
+	m.ejectedMu.Lock()
+	d, ok := m.ejected[slot]
+	delete(m.ejected, slot)
+	m.ejectedMu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrorPCIDevicePlugged, name)
+	}
+
+	start, end := d.GetIORange()
+	m.registerIOPortHandler(start, end, d.IOInHandler, d.IOOutHandler)
+	m.pci.Devices[slot] = d
+
+	m.out.Event("pci_plug", output.Fields{"slot": slot}, "PCI device in slot %d plugged", slot)
+
+	return m.hotplug.Plug(slot)
+}
+
+// UnplugPCIDevice asks the guest to eject the PCI device name, e.g. net
+// or blk, which leaves the PCI bus once the guest has let it go. The guest
+// does so in its own time, through the ACPI tables of EnableACPI.
+func (m *Machine) UnplugPCIDevice(name string) error {
+	if m.hotplug == nil {
+		return ErrorNoHotplug
+	}
+
+	slot, ok := m.pciSlots[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrorNoPCIDevice, name)
+	}
+
+	return m.hotplug.Unplug(slot)
+}
+
+// ejectPCIDevice takes the device in slot off the PCI bus, with its I/O
+// ports, once the guest ejected it. The device itself is kept for
+// PlugPCIDevice, and shut down with the machine.
+func (m *Machine) ejectPCIDevice(slot int) {
+	if slot >= len(m.pci.Devices) || m.pci.Devices[slot] == nil {
+		return
+	}
+
+	d := m.pci.Devices[slot]
+	start, end := d.GetIORange()
+	m.registerIOPortHandler(start, end, unexpectedIOPort, unexpectedIOPort)
+	m.pci.Devices[slot] = nil
+
+	m.ejectedMu.Lock()
+	m.ejected[slot] = d
+	m.ejectedMu.Unlock()
+
+	m.out.Event("pci_eject", output.Fields{"slot": slot}, "PCI device in slot %d ejected", slot)
+}
+
+// InjectSCI raises the interrupt of the Generic Event Device.
+func (m *Machine) InjectSCI() error {
+	if err := kvm.IRQLine(m.vmFd, sciIRQ, 0); err != nil {
+		return err
+	}
+
+	return kvm.IRQLine(m.vmFd, sciIRQ, 1)
+}
@@ -0,0 +1,133 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/idle"
+)
+
+const (
+	// madvCollapse is MADV_COLLAPSE of Linux 6.1, which has the kernel
+	// back a range with transparent huge pages at once, whatever the
+	// THP settings of the host.
+	madvCollapse = 25
+
+	hugePageSize = 2 << 20
+
+	// hotRegionPages is how many pages of a huge page region must be hot
+	// for it to be promoted.
+	hotRegionPages = hugePageSize / pageSize / 2
+)
+
+// ErrorNoCollapse indicates a host kernel without MADV_COLLAPSE.
+var ErrorNoCollapse = errors.New("MADV_COLLAPSE is not available")
+
+// ErrorHugeTLB indicates promotion of guest RAM that is in hugetlb pages
+// already, see NewWithRAM.
+var ErrorHugeTLB = errors.New("guest RAM is in hugetlb pages already")
+
+// HugePageStats is how the promotion of hot guest RAM to huge pages went.
+type HugePageStats struct {
+	// Hot is how many 2MiB regions were hot at the last scan, Huge how
+	// many of them are promoted, Collapsed how many promotions succeeded
+	// and Failed how many did not, e.g. for lack of free huge pages.
+	Hot, Huge, Collapsed, Failed int
+	// Err is why promotion stopped, if it did.
+	Err error
+}
+
+func (s HugePageStats) String() string {
+	str := fmt.Sprintf("hot %d huge %d collapsed %d failed %d", s.Hot, s.Huge, s.Collapsed, s.Failed)
+	if s.Err != nil {
+		str += fmt.Sprintf(" stopped: %v", s.Err)
+	}
+
+	return str
+}
+
+// hugePages promotes hot regions of guest RAM to huge pages.
+type hugePages struct {
+	mu    sync.Mutex
+	stats HugePageStats
+	// huge tells by region offset which regions are promoted.
+	huge map[int]bool
+}
+
+// PromoteHugePages has the working set scans of TrackWorkingSet collapse
+// the 2MiB regions of guest RAM the guest mostly uses into transparent huge
+// pages, for fewer TLB misses without changing the THP settings of the
+// host. Regions are aligned by their host address, so that an unaligned
+// start of guest RAM loses a region at each end.
+func (m *Machine) PromoteHugePages() error {
+	if m.workingSet == nil {
+		return ErrorNoWorkingSet
+	}
+
+	if m.ramBacking.Hugetlb() {
+		return fmt.Errorf("%w: %v", ErrorHugeTLB, m.ramBacking)
+	}
+
+	m.workingSet.hugePages = &hugePages{huge: map[int]bool{}}
+
+	return nil
+}
+
+// HugePages returns how the promotion of PromoteHugePages went so far.
+func (m *Machine) HugePages() (HugePageStats, error) {
+	if m.workingSet == nil || m.workingSet.hugePages == nil {
+		return HugePageStats{}, ErrorNoWorkingSet
+	}
+
+	h := m.workingSet.hugePages
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.stats, nil
+}
+
+// promote collapses the regions of mem that were hot at the last scan of t
+// and are not yet promoted.
+func (h *hugePages) promote(mem []byte, t *idle.Tracker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stats.Err != nil {
+		return
+	}
+
+	start := int(-uintptr(unsafe.Pointer(&mem[0])) % hugePageSize)
+	h.stats.Hot = 0
+
+	for off := start; off+hugePageSize <= len(mem); off += hugePageSize {
+		if t.HotPages(off/pageSize, hugePageSize/pageSize) < hotRegionPages {
+			continue
+		}
+
+		h.stats.Hot++
+
+		if h.huge[off] {
+			continue
+		}
+
+		err := syscall.Madvise(mem[off:off+hugePageSize], madvCollapse)
+
+		switch {
+		case err == nil:
+			h.huge[off] = true
+			h.stats.Collapsed++
+		case errors.Is(err, syscall.EINVAL):
+			h.stats.Err = ErrorNoCollapse
+
+			return
+		default:
+			h.stats.Failed++
+		}
+	}
+
+	h.stats.Huge = len(h.huge)
+}
@@ -0,0 +1,76 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// ErrorHypercallNotForwarded indicates a hypercall that KVM does not let
+// exit to userspace, but handles itself or fails with -KVM_ENOSYS.
+var ErrorHypercallNotForwarded = errors.New("KVM does not forward the hypercall")
+
+// HypercallHandler handles a hypercall of the guest, a VMCALL or VMMCALL
+// with its number in RAX, whose arguments KVM passes in args. It returns
+// the result for the guest in RAX, or an error that stops the vCPU.
+type HypercallHandler func(args [6]uint64) (uint64, error)
+
+// RegisterHypercallHandler has the hypercall nr of the guest handled by h,
+// e.g. for a channel between host and guest for logging, metrics or test
+// control. KVM forwards only some hypercalls, which it reports with
+// KVM_CAP_EXIT_HYPERCALL; others fail with ErrorHypercallNotForwarded.
+func (m *Machine) RegisterHypercallHandler(nr uint64, h HypercallHandler) error {
+	forwarded, err := kvm.CheckExtension(m.vmFd, kvm.CapExitHypercall)
+	if err != nil {
+		return err
+	}
+
+	if nr >= 64 || uint64(forwarded)&(1<<nr) == 0 {
+		return fmt.Errorf("%w: %d, only %#x", ErrorHypercallNotForwarded, nr, forwarded)
+	}
+
+	if m.hypercalls == nil {
+		m.hypercalls = map[uint64]HypercallHandler{}
+	}
+
+	m.hypercalls[nr] = h
+
+	var enabled uint64
+	for nr := range m.hypercalls {
+		enabled |= 1 << nr
+	}
+
+	if err := kvm.EnableCap(m.vmFd, &kvm.EnableCapability{
+		Cap: kvm.CapExitHypercall, Args: [4]uint64{enabled},
+	}); err != nil {
+		return fmt.Errorf("enable hypercall exits: %w", err)
+	}
+
+	return nil
+}
+
+// handleHypercall runs the handler of the hypercall of an exit.
+func (m *Machine) handleHypercall(run *kvm.RunData) error {
+	nr, args := run.Hypercall()
+
+	h, ok := m.hypercalls[nr]
+	if !ok {
+		return fmt.Errorf("%w: hypercall %d", kvm.ErrUnexpectedEXITReason, nr)
+	}
+
+	ret, err := h(args)
+	if err != nil {
+		return fmt.Errorf("hypercall %d: %w", nr, err)
+	}
+
+	run.SetHypercallResult(ret)
+
+	return nil
+}
+
+// mapGPARange handles kvm.HCMapGPARange of an SNP guest, which converts
+// memory between private and shared.
+func (m *Machine) mapGPARange(args [6]uint64) (uint64, error) {
+	return 0, m.convertMemory(args[0], args[1]*pageSize, args[2]&kvm.MapGPARangeEncrypted != 0)
+}
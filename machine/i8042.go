@@ -0,0 +1,320 @@
+package machine
+
+import (
+	"sync"
+)
+
+// The i8042 keyboard controller with an AT keyboard behind it, which is
+// how a PC without USB gets keyboard input and, through the output port,
+// the oldest way to reset. It has no mouse on its aux port.
+//
+// refs: https://wiki.osdev.org/%228042%22_PS/2_Controller
+// refs: https://gitlab.com/qemu-project/qemu/-/blob/master/hw/input/pckbd.c
+// refs: https://git.kernel.org/pub/scm/linux/kernel/git/will/kvmtool.git/tree/hw/i8042.c
+const (
+	kbdDataPort    = 0x60
+	kbdCommandPort = 0x64
+	kbdIRQ         = 1
+
+	// Status register.
+	kbdStatusOBF     = 0x01 // output buffer full
+	kbdStatusSYS     = 0x04 // passed self-test
+	kbdStatusCommand = 0x08 // the last write was a command
+	kbdStatusUnlock  = 0x10 // keyboard not inhibited
+
+	// Command byte, of the controller RAM at 0.
+	kbdModeInt       = 0x01 // IRQ 1 on keyboard data
+	kbdModeSYS       = 0x04
+	kbdModeDisable   = 0x10 // keyboard clock off
+	kbdModeAuxOff    = 0x20
+	kbdModeTranslate = 0x40 // to scan code set 1
+	kbdModeDefault   = kbdModeInt | kbdModeSYS | kbdModeAuxOff | kbdModeTranslate
+
+	// Output port, whose bit 0 held low resets the CPU.
+	kbdOutReset   = 0x01
+	kbdOutA20     = 0x02
+	kbdOutDefault = kbdOutReset | kbdOutA20
+
+	// Controller commands.
+	kbdReadMode       = 0x20
+	kbdWriteMode      = 0x60
+	kbdDisableAux     = 0xa7
+	kbdEnableAux      = 0xa8
+	kbdTestAux        = 0xa9
+	kbdSelfTest       = 0xaa
+	kbdTestKbd        = 0xab
+	kbdDisableKbd     = 0xad
+	kbdEnableKbd      = 0xae
+	kbdReadInput      = 0xc0
+	kbdReadOutput     = 0xd0
+	kbdWriteOutput    = 0xd1
+	kbdWriteKbdBuffer = 0xd2
+	kbdWriteAux       = 0xd4
+	kbdPulseMask      = 0xf0 // 0xf0-0xff pulse the output port lines of bits 0-3 that are clear
+
+	// Replies of the controller.
+	kbdSelfTestOK = 0x55
+	kbdTestOK     = 0x00
+	kbdTestFail   = 0xff
+
+	// Keyboard commands and replies.
+	kbdCmdSetLEDs    = 0xed
+	kbdCmdEcho       = 0xee
+	kbdCmdScanSet    = 0xf0
+	kbdCmdIdentify   = 0xf2
+	kbdCmdTypematic  = 0xf3
+	kbdCmdEnable     = 0xf4
+	kbdCmdDisable    = 0xf5
+	kbdCmdDefaults   = 0xf6
+	kbdCmdReset      = 0xff
+	kbdAck           = 0xfa
+	kbdResend        = 0xfe
+	kbdSelfTestPass  = 0xaa
+	kbdID            = 0xab
+	kbdIDMF2         = 0x83
+	kbdIDTranslated  = 0x41
+	kbdScanSet2      = 0x02
+	kbdScanSet2Trans = 0x41
+)
+
+// i8042 is the keyboard controller. Its output buffer queues bytes for the
+// guest, which takes them one at a time, with IRQ 1 raised while there are
+// some unless the command byte turns it off.
+type i8042 struct {
+	mu      sync.Mutex
+	irq     func(level uint32)
+	level   bool
+	mode    byte
+	outPort byte
+	status  byte
+	queue   []byte
+	last    byte
+	// command is the controller command that waits for its data on
+	// kbdDataPort, and kbdCommand the keyboard command that does.
+	command    byte
+	kbdCommand byte
+	scanning   bool
+}
+
+// newI8042 returns a keyboard controller that raises and lowers its
+// interrupt with irq.
+func newI8042(irq func(level uint32)) *i8042 {
+	k := &i8042{irq: irq}
+	k.reset()
+
+	return k
+}
+
+// reset puts the controller and the keyboard in their state at power on,
+// with no keys queued.
+func (k *i8042) reset() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.mode = kbdModeDefault
+	k.outPort = kbdOutDefault
+	k.status = kbdStatusUnlock
+	k.queue = nil
+	k.command, k.kbdCommand = 0, 0
+	k.scanning = true
+	k.update()
+}
+
+// keys queues the scan codes of key presses and releases, in set 1, which
+// the guest gets while the keyboard scans and its clock is on.
+func (k *i8042) keys(codes []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.scanning || k.mode&kbdModeDisable != 0 {
+		return
+	}
+
+	k.queue = append(k.queue, codes...)
+	k.update()
+}
+
+// update sets the interrupt to whether there is a byte for the guest.
+func (k *i8042) update() {
+	want := len(k.queue) > 0 && k.mode&kbdModeInt != 0
+
+	switch {
+	case want && !k.level:
+		k.irq(1)
+	case !want && k.level:
+		k.irq(0)
+	}
+
+	k.level = want
+}
+
+func (k *i8042) push(b ...byte) {
+	k.queue = append(k.queue, b...)
+}
+
+func (k *i8042) In(port uint64, bytes []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for i := range bytes {
+		bytes[i] = 0
+	}
+
+	// Linux polls the status until the output buffer is empty, and on
+	// and on with a status that never says so.
+	if port == kbdCommandPort {
+		bytes[0] = k.status
+		if k.mode&kbdModeSYS != 0 {
+			bytes[0] |= kbdStatusSYS
+		}
+
+		if len(k.queue) > 0 {
+			bytes[0] |= kbdStatusOBF
+		}
+
+		return nil
+	}
+
+	// Reading the buffer when empty gets the byte read last.
+	if len(k.queue) > 0 {
+		k.last = k.queue[0]
+		k.queue = k.queue[1:]
+	}
+
+	bytes[0] = k.last
+
+	// The next byte raises the interrupt anew.
+	if k.level {
+		k.irq(0)
+		k.level = false
+	}
+
+	k.update()
+
+	return nil
+}
+
+func (k *i8042) Out(port uint64, bytes []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	defer k.update()
+
+	if port == kbdCommandPort {
+		k.status |= kbdStatusCommand
+
+		return k.controllerCommand(bytes[0])
+	}
+
+	k.status &^= kbdStatusCommand
+
+	return k.data(bytes[0])
+}
+
+func (k *i8042) controllerCommand(cmd byte) error {
+	k.command = 0
+
+	switch cmd {
+	case kbdReadMode:
+		k.push(k.mode)
+	case kbdWriteMode, kbdWriteOutput, kbdWriteKbdBuffer, kbdWriteAux:
+		k.command = cmd
+	case kbdDisableAux:
+		k.mode |= kbdModeAuxOff
+	case kbdEnableAux:
+		k.mode &^= kbdModeAuxOff
+	case kbdTestAux:
+		k.push(kbdTestFail)
+	case kbdSelfTest:
+		k.push(kbdSelfTestOK)
+	case kbdTestKbd:
+		k.push(kbdTestOK)
+	case kbdDisableKbd:
+		k.mode |= kbdModeDisable
+	case kbdEnableKbd:
+		k.mode &^= kbdModeDisable
+	case kbdReadInput:
+		k.push(0)
+	case kbdReadOutput:
+		k.push(k.outPort)
+	default:
+		// Command 0xfe pulses the reset line, the oldest way to reset
+		// a PC, which Linux tries with reboot=k.
+		if cmd&kbdPulseMask == kbdPulseMask && cmd&kbdOutReset == 0 {
+			return ErrorKeyboardReset
+		}
+	}
+
+	return nil
+}
+
+func (k *i8042) data(v byte) error {
+	cmd := k.command
+	k.command = 0
+
+	switch cmd {
+	case kbdWriteMode:
+		k.mode = v
+	case kbdWriteOutput:
+		k.outPort = v
+		if v&kbdOutReset == 0 {
+			return ErrorKeyboardReset
+		}
+	case kbdWriteKbdBuffer:
+		k.push(v)
+	case kbdWriteAux:
+		// No mouse to take it.
+	default:
+		k.keyboardCommand(v)
+	}
+
+	return nil
+}
+
+// keyboardCommand runs a command for the keyboard, or takes the data of
+// the one before.
+func (k *i8042) keyboardCommand(v byte) {
+	if cmd := k.kbdCommand; cmd != 0 {
+		k.kbdCommand = 0
+		k.push(kbdAck)
+
+		// Scan code set 0 asks which set is in use.
+		if cmd == kbdCmdScanSet && v == 0 {
+			if k.mode&kbdModeTranslate != 0 {
+				k.push(kbdScanSet2Trans)
+			} else {
+				k.push(kbdScanSet2)
+			}
+		}
+
+		return
+	}
+
+	switch v {
+	case kbdCmdSetLEDs, kbdCmdScanSet, kbdCmdTypematic:
+		k.kbdCommand = v
+		k.push(kbdAck)
+	case kbdCmdEcho:
+		k.push(kbdCmdEcho)
+	case kbdCmdIdentify:
+		if k.mode&kbdModeTranslate != 0 {
+			k.push(kbdAck, kbdID, kbdIDTranslated)
+		} else {
+			k.push(kbdAck, kbdID, kbdIDMF2)
+		}
+	case kbdCmdEnable:
+		k.scanning = true
+		k.push(kbdAck)
+	case kbdCmdDisable:
+		k.scanning = false
+		k.push(kbdAck)
+	case kbdCmdDefaults:
+		k.push(kbdAck)
+	case kbdCmdReset:
+		k.scanning = true
+		k.queue = nil
+		k.push(kbdAck, kbdSelfTestPass)
+	default:
+		k.push(kbdResend)
+	}
+}
@@ -0,0 +1,55 @@
+package machine
+
+import (
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+const virtioIOMMUIRQ = 7
+
+// AddIOMMU gives the guest a virtio-iommu device, through which the DMA
+// of virtio-blk goes: once the guest attaches it to a domain, it only
+// reaches the memory mapped for it. virtio-net only has the legacy
+// transport, whose drivers do not use an IOMMU, so it is not behind it.
+// The VIOT of EnableACPI tells the guest which devices are behind it, so
+// the kernel must be loaded after.
+func (m *Machine) AddIOMMU() {
+	v := virtio.NewIOMMU(virtioIOMMUIRQ, m, m.mem)
+	v.Listener = &m.iommuDirty
+	m.iommu = v
+
+	go v.IOThreadEntry()
+
+	m.addPCIDevice("iommu", v)
+	m.OnShutdown(ShutdownQuiesce, "iommu", v.Close)
+	start, end := v.GetIORange()
+	m.registerIOPortHandler(start, end, v.IOInHandler, v.IOOutHandler)
+
+	if m.blk != nil {
+		m.blk.DMA, m.blk.Endpoint = v, m.pciBDF("blk")
+	}
+}
+
+// pciBDF returns the BDF of the PCI device name, which the IOMMU takes as
+// its endpoint ID.
+func (m *Machine) pciBDF(name string) uint32 {
+	return pci.BDF(0, uint32(m.pciSlots[name]), 0)
+}
+
+// iommuEndpoints returns the BDFs of the devices behind the IOMMU.
+func (m *Machine) iommuEndpoints() []uint16 {
+	if _, ok := m.pciSlots["blk"]; !ok {
+		return []uint16{}
+	}
+
+	return []uint16{uint16(m.pciBDF("blk"))}
+}
+
+func (m *Machine) InjectVirtioIOMMUIRQ() error {
+	if err := kvm.IRQLine(m.vmFd, virtioIOMMUIRQ, 0); err != nil {
+		return err
+	}
+
+	return kvm.IRQLine(m.vmFd, virtioIOMMUIRQ, 1)
+}
@@ -0,0 +1,129 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorUnknownKey indicates a key that the keyboard does not have.
+var ErrorUnknownKey = errors.New("unknown key")
+
+// Scan codes of set 1, which the keyboard controller translates to by
+// default, for the names of keys that sendkey of QEMU takes. Keys with
+// kbdExtended come after a 0xe0 prefix, and a release is the press with
+// kbdRelease.
+const (
+	kbdExtended = 0xe000
+	kbdPrefix   = 0xe0
+	kbdRelease  = 0x80
+)
+
+var keyCodes = map[string]uint16{
+	"esc": 0x01, "1": 0x02, "2": 0x03, "3": 0x04, "4": 0x05, "5": 0x06, "6": 0x07, "7": 0x08, "8": 0x09,
+	"9": 0x0a, "0": 0x0b, "minus": 0x0c, "equal": 0x0d, "backspace": 0x0e, "tab": 0x0f,
+	"q": 0x10, "w": 0x11, "e": 0x12, "r": 0x13, "t": 0x14, "y": 0x15, "u": 0x16, "i": 0x17, "o": 0x18,
+	"p": 0x19, "bracket_left": 0x1a, "bracket_right": 0x1b, "ret": 0x1c, "ctrl": 0x1d,
+	"a": 0x1e, "s": 0x1f, "d": 0x20, "f": 0x21, "g": 0x22, "h": 0x23, "j": 0x24, "k": 0x25, "l": 0x26,
+	"semicolon": 0x27, "apostrophe": 0x28, "grave_accent": 0x29, "shift": 0x2a, "backslash": 0x2b,
+	"z": 0x2c, "x": 0x2d, "c": 0x2e, "v": 0x2f, "b": 0x30, "n": 0x31, "m": 0x32,
+	"comma": 0x33, "dot": 0x34, "slash": 0x35, "shift_r": 0x36, "asterisk": 0x37, "alt": 0x38,
+	"spc": 0x39, "caps_lock": 0x3a, "f1": 0x3b, "f2": 0x3c, "f3": 0x3d, "f4": 0x3e, "f5": 0x3f,
+	"f6": 0x40, "f7": 0x41, "f8": 0x42, "f9": 0x43, "f10": 0x44, "num_lock": 0x45, "scroll_lock": 0x46,
+	"f11": 0x57, "f12": 0x58,
+	"ctrl_r": kbdExtended | 0x1d, "alt_r": kbdExtended | 0x38, "home": kbdExtended | 0x47,
+	"up": kbdExtended | 0x48, "pgup": kbdExtended | 0x49, "left": kbdExtended | 0x4b,
+	"right": kbdExtended | 0x4d, "end": kbdExtended | 0x4f, "down": kbdExtended | 0x50,
+	"pgdn": kbdExtended | 0x51, "insert": kbdExtended | 0x52, "delete": kbdExtended | 0x53,
+}
+
+// textKeys are the keys that type the characters that are not a key name
+// of their own, and shiftKeys those that take shift, by their key without.
+var (
+	textKeys = map[rune]string{
+		' ': "spc", '\n': "ret", '\t': "tab", '-': "minus", '=': "equal", '[': "bracket_left",
+		']': "bracket_right", ';': "semicolon", '\'': "apostrophe", '`': "grave_accent",
+		'\\': "backslash", ',': "comma", '.': "dot", '/': "slash",
+	}
+	shiftKeys = map[rune]rune{
+		'!': '1', '@': '2', '#': '3', '$': '4', '%': '5', '^': '6', '&': '7', '*': '8', '(': '9',
+		')': '0', '_': '-', '+': '=', '{': '[', '}': ']', ':': ';', '"': '\'', '~': '`', '|': '\\',
+		'<': ',', '>': '.', '?': '/',
+	}
+)
+
+func appendKey(codes []byte, key uint16, release bool) []byte {
+	if key&kbdExtended != 0 {
+		codes = append(codes, kbdPrefix)
+	}
+
+	if release {
+		return append(codes, byte(key)|kbdRelease)
+	}
+
+	return append(codes, byte(key))
+}
+
+// appendCombo appends the presses of keys in order and then their
+// releases in reverse.
+func appendCombo(codes []byte, keys []uint16) []byte {
+	for _, k := range keys {
+		codes = appendKey(codes, k, false)
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		codes = appendKey(codes, keys[i], true)
+	}
+
+	return codes
+}
+
+// SendKey presses the keys of combo together and releases them, e.g.
+// "ctrl-alt-delete" or "shift-a", with the key names of sendkey of QEMU.
+func (m *Machine) SendKey(combo string) error {
+	var keys []uint16
+
+	for _, name := range strings.Split(combo, "-") {
+		k, ok := keyCodes[name]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrorUnknownKey, name)
+		}
+
+		keys = append(keys, k)
+	}
+
+	m.kbd.keys(appendCombo(nil, keys))
+
+	return nil
+}
+
+// TypeText types s, of the characters of a US keyboard, on the keyboard.
+func (m *Machine) TypeText(s string) error {
+	var codes []byte
+
+	for _, r := range s {
+		var keys []uint16
+
+		if k, ok := shiftKeys[r]; ok {
+			keys, r = append(keys, keyCodes["shift"]), k
+		} else if r >= 'A' && r <= 'Z' {
+			keys, r = append(keys, keyCodes["shift"]), r-'A'+'a'
+		}
+
+		name, ok := textKeys[r]
+		if !ok {
+			name = string(r)
+		}
+
+		k, ok := keyCodes[name]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrorUnknownKey, r)
+		}
+
+		codes = appendCombo(codes, append(keys, k))
+	}
+
+	m.kbd.keys(codes)
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// kvmclockFeatures are the features of CPUID function kvm.CPUIDFeatures
+// that let the guest use the kvmclock as its clocksource, which also tells
+// it the TSC frequency instead of having it calibrate the TSC at boot.
+const kvmclockFeatures = kvm.KVMFeatureClocksource | kvm.KVMFeatureClocksource2 |
+	kvm.KVMFeatureClocksourceStable
+
+// kvmclockMSRs point KVM to the pvclock pages of the guest, which it
+// keeps updating until they are cleared.
+var kvmclockMSRs = []uint32{kvm.MSRKVMSystemTime, kvm.MSRKVMSystemTimeNew}
+
+// showKVMClock sets the kvmclock features in entry, which the vCPUs get
+// unless DisableKVMClock.
+func showKVMClock(entry *kvm.CPUIDEntry2) {
+	if entry.Function == kvm.CPUIDFeatures {
+		entry.Eax |= kvmclockFeatures
+	}
+}
+
+// DisableKVMClock hides the kvmclock from the guest, which then keeps time
+// with the TSC or the PIT as on hardware, e.g. to test them. It must come
+// before the vCPUs run.
+func (m *Machine) DisableKVMClock() error {
+	for i := range m.supportedCPUID.Entries[:m.supportedCPUID.Nent] {
+		if e := &m.supportedCPUID.Entries[i]; e.Function == kvm.CPUIDFeatures {
+			e.Eax &^= kvmclockFeatures
+		}
+	}
+
+	for i := range m.vcpus {
+		if err := m.setCPUID(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetKVMClock sets the kvmclock of the guest to ns, e.g. to move it past
+// the time a snapshot was saved. Set while the machine is paused, it is
+// where the clock stands when Resume lets the vCPUs continue.
+func (m *Machine) SetKVMClock(ns uint64) error {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	if m.kvmClockSaved {
+		m.kvmClock.Clock = ns
+
+		return nil
+	}
+
+	return kvm.SetClock(m.vmFd, kvm.ClockData{Clock: ns})
+}
+
+// stopKVMClock tells the guest that its vCPUs were stopped, so that its
+// watchdogs do not count the pause against it. vCPUs of a guest that does
+// not use the kvmclock are skipped.
+func (m *Machine) stopKVMClock() error {
+	for _, v := range m.vcpus {
+		if err := kvm.KVMClockCtrl(v.Fd); err != nil && !errors.Is(err, syscall.EINVAL) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resetKVMClock has KVM stop updating the pvclock pages of the kernel that
+// ran before a reset, which would corrupt the memory of the next one.
+func (m *Machine) resetKVMClock() error {
+	msrs := make([]kvm.MSREntry, len(kvmclockMSRs))
+	for i, index := range kvmclockMSRs {
+		msrs[i].Index = index
+	}
+
+	for i, v := range m.vcpus {
+		if err := kvm.SetMSRs(v.Fd, msrs); err != nil {
+			return fmt.Errorf("vCPU %d: kvmclock: %w", i, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ShutdownPhase is when a shutdown hook of OnShutdown runs as Close tears
+// the machine down, once the vCPUs are stopped. The phases run in order,
+// and the hooks of a phase in the reverse order they were added, so that
+// what was set up last goes first. Guest RAM is unmapped after them all.
+type ShutdownPhase int
+
+const (
+	// ShutdownQuiesce hooks stop devices and listeners from serving the
+	// guest, once they are done with the requests in flight.
+	ShutdownQuiesce ShutdownPhase = iota
+	// ShutdownFlush hooks write what devices hold back to their backends,
+	// e.g. the host cache of a disk image to storage.
+	ShutdownFlush
+	// ShutdownRelease hooks release the backends, e.g. taps and disk
+	// images.
+	ShutdownRelease
+
+	shutdownPhases
+)
+
+// shutdownHook is a hook of OnShutdown.
+type shutdownHook struct {
+	phase ShutdownPhase
+	name  string
+	f     func() error
+}
+
+// OnShutdown has Close call f, named name in its errors, in phase.
+func (m *Machine) OnShutdown(phase ShutdownPhase, name string, f func() error) {
+	m.shutdownHooks = append(m.shutdownHooks, shutdownHook{phase: phase, name: name, f: f})
+}
+
+// quiesce returns a hook of OnShutdown for a device that quiesces without
+// failing.
+func quiesce(f func()) func() error {
+	return func() error {
+		f()
+
+		return nil
+	}
+}
+
+// runShutdownHooks runs the hooks of OnShutdown, phase by phase, all of
+// them even if some fail, and returns their errors.
+func (m *Machine) runShutdownHooks() []error {
+	var errs []error
+
+	for phase := ShutdownQuiesce; phase < shutdownPhases; phase++ {
+		for i := len(m.shutdownHooks) - 1; i >= 0; i-- {
+			h := m.shutdownHooks[i]
+			if h.phase != phase {
+				continue
+			}
+
+			if err := h.f(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// Run runs all vCPUs until one of them stops, e.g. with ErrorGuestExit or
+// ErrorGuestReset, then stops the others and returns why the first did.
+// After Shutdown it returns nil. The kernel or ROM must be loaded.
+func (m *Machine) Run() error {
+	errs := make(chan error, len(m.vcpus))
+
+	m.running.Add(len(m.vcpus))
+
+	for i := range m.vcpus {
+		go func(i int) {
+			defer m.running.Done()
+
+			errs <- m.RunInfiniteLoop(i)
+		}(i)
+	}
+
+	var first error
+
+	for range m.vcpus {
+		err := <-errs
+		if errors.Is(err, ErrorStopped) || first != nil {
+			continue
+		}
+
+		first = err
+		m.Stop()
+	}
+
+	return first
+}
+
+// Shutdown stops the vCPUs and waits for them to return from Run or
+// RunInfiniteLoop.
+func (m *Machine) Shutdown() {
+	m.Stop()
+	m.running.Wait()
+
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	for {
+		running := false
+
+		for _, tid := range m.vcpuTids {
+			if tid != 0 {
+				running = true
+			}
+		}
+
+		if !running {
+			return
+		}
+
+		m.runCond.Wait()
+	}
+}
+
+// Close shuts the machine down and releases what it holds: its devices,
+// guest RAM, the vCPUs, the VM and /dev/kvm. It returns the first error of
+// closing any of them, and the machine is not to be used afterwards.
+func (m *Machine) Close() error {
+	var errs []error
+
+	if m.runCond != nil {
+		m.Shutdown()
+	}
+
+	if m.memErr != nil {
+		_ = m.waitMemory()
+	}
+
+	if m.workingSet != nil {
+		<-m.workingSet.stopped
+	}
+
+	m.clock.Close()
+
+	// Devices stop touching guest RAM before it goes away.
+	errs = append(errs, m.runShutdownHooks()...)
+
+	for _, b := range append([][]byte{m.rom, m.mem, m.memDeviceRegion}, m.epc...) {
+		if b != nil {
+			errs = append(errs, syscall.Munmap(b))
+		}
+	}
+
+	for _, r := range m.regions {
+		errs = append(errs, syscall.Munmap(r.mem))
+	}
+
+	for i, v := range m.vcpus {
+		if m.vcpuStats[i] != nil {
+			errs = append(errs, m.vcpuStats[i].Close())
+		}
+
+		if v != nil {
+			errs = append(errs, v.Close())
+		}
+	}
+
+	if m.vmFd != 0 {
+		errs = append(errs, syscall.Close(int(m.vmFd)))
+	}
+
+	for _, f := range []*os.File{m.ramFile, m.gmem, m.sev, m.devKVM} {
+		if f != nil {
+			errs = append(errs, f.Close())
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package machine
+
+import (
+	"github.com/bobuhiro11/gokvm/loader"
+)
+
+// EnterLongMode sets vCPU cpu up to start at rip in long mode, with the
+// first 4GiB of guest physical memory mapped to itself by page tables at
+// pageTablesAddr, where LoadLinux puts those of a vmlinux. It is for
+// guests, e.g. test payloads, that are loaded into guest RAM by hand and
+// would otherwise need a trampoline from real mode. Like LoadLinux, it
+// sets up the I/O ports of the machine, so devices of AddIODevice come
+// after it.
+func (m *Machine) EnterLongMode(cpu int, rip uint64) error {
+	if err := m.waitMemory(); err != nil {
+		return err
+	}
+
+	if err := loader.WritePageTables(m.mem, pageTablesAddr); err != nil {
+		return err
+	}
+
+	sregs, err := m.Sregs(cpu)
+	if err != nil {
+		return err
+	}
+
+	loader.SetLongMode(&sregs, pageTablesAddr)
+
+	if err := m.SetSregs(cpu, sregs); err != nil {
+		return err
+	}
+
+	regs, err := m.Regs(cpu)
+	if err != nil {
+		return err
+	}
+
+	regs.RFLAGS = 2
+	regs.RIP = rip
+
+	if err := m.SetRegs(cpu, regs); err != nil {
+		return err
+	}
+
+	m.initIOPortHandlers()
+
+	return nil
+}
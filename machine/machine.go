@@ -4,24 +4,42 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/acpi"
 	"github.com/bobuhiro11/gokvm/bootparam"
-	"github.com/bobuhiro11/gokvm/ebda"
+	"github.com/bobuhiro11/gokvm/chipset"
+	"github.com/bobuhiro11/gokvm/flash"
 	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/loader"
+	"github.com/bobuhiro11/gokvm/memslot"
+	"github.com/bobuhiro11/gokvm/output"
 	"github.com/bobuhiro11/gokvm/pci"
 	"github.com/bobuhiro11/gokvm/serial"
+	"github.com/bobuhiro11/gokvm/smbios"
+	"github.com/bobuhiro11/gokvm/snapshot"
+	"github.com/bobuhiro11/gokvm/startup"
 	"github.com/bobuhiro11/gokvm/tap"
 	"github.com/bobuhiro11/gokvm/virtio"
+	"github.com/bobuhiro11/gokvm/vtimer"
+	"github.com/bobuhiro11/gokvm/worker"
 )
 
 // InitialRegState GuestPhysAddr                      Binary files [+ offsets in the file]
 //
 //                 0x00000000    +------------------+
 //                               |                  |
+//                 0x00009000    +------------------+
+//                               |  GDT and page    |
+//                               |  tables (vmlinux)|
+//                               +------------------+
 // RSI -->         0x00010000    +------------------+ bzImage [+ 0]
 //                               |                  |
 //                               |  boot param      |
@@ -35,6 +53,7 @@ import (
 //                               +------------------+
 //                               |                  |
 // RIP -->         0x00100000    +------------------+ bzImage [+ 512 x (setup_sects in boot param header + 1)]
+//                                                    or vmlinux PT_LOAD segments at their p_paddr
 //                               |                  |
 //                               |   64bit kernel   |
 //                               |                  |
@@ -48,51 +67,340 @@ import (
 //                               |                  |
 //                 0x40000000    +------------------+
 const (
-	memSize       = 1 << 30
-	bootParamAddr = 0x10000
-	cmdlineAddr   = 0x20000
-	kernelAddr    = 0x100000
-	initrdAddr    = 0xf000000
+	// MemSize is the RAM of a guest, unless NewWithRAM is given another
+	// size from MinMemSize, where the initrd fits, to MaxMemSize, below
+	// the firmware and the identity map, in steps of MemSizeAlign.
+	MemSize      = memSize
+	MinMemSize   = 256 << 20
+	MaxMemSize   = 3 << 30
+	MemSizeAlign = hugePageSize
+
+	// GSIs are the interrupt lines of a guest, the pins of the in-kernel
+	// IOAPIC, which KVM routes.
+	GSIs = 24
+
+	memSize        = 1 << 30
+	pageTablesAddr = 0x9000
+	bootParamAddr  = 0x10000
+	cmdlineAddr    = 0x20000
+	kernelAddr     = 0x100000
+	initrdAddr     = 0xf000000
+
+	// A guest writes its exit status to ExitPort to end an ephemeral run,
+	// e.g. "io outb 0xf4 $?" in a u-root initramfs.
+	ExitPort = 0xf4
+
+	// The identity map and TSS pages sit right below a firmware ROM of up
+	// to maxROMSize, as in QEMU, instead of kvm's defaults near 4GiB.
+	identityMapAddr = 0xfeffc000
+	tssAddr         = 0xfeffd000
+
+	// The in-kernel IOAPIC and LAPICs are at the addresses of the PC.
+	ioapicAddr = 0xfec00000
+	lapicAddr  = 0xfee00000
+
+	// A firmware ROM is mapped read-only so that it ends at 4GiB,
+	// where the reset vector is.
+	romEnd     = 1 << 32
+	maxROMSize = 16 << 20
+	pageSize   = 0x1000
 
 	serialIRQ    = 4
 	virtioNetIRQ = 9
 	virtioBlkIRQ = 10
+
+	virtioConsoleIRQ = 11
+
+	// deviceWorkers is how many goroutines run the work of the virtio
+	// devices, which takes turns by worker class.
+	deviceWorkers = 2
+)
+
+// ErrorWriteToCF9 indicates a reset through cf9, the standard x86 reset
+// port. It is an ErrorGuestReset.
+var ErrorWriteToCF9 = fmt.Errorf("%w: power cycle via 0xcf9", ErrorGuestReset)
+
+// ErrorTripleFault indicates a triple fault, which resets x86 machines.
+// It is an ErrorGuestReset.
+var ErrorTripleFault = fmt.Errorf("%w: triple fault", ErrorGuestReset)
+
+// ErrorKeyboardReset indicates a reset through the pulse of the reset line
+// of the keyboard controller. It is an ErrorGuestReset.
+var ErrorKeyboardReset = fmt.Errorf("%w: keyboard controller reset", ErrorGuestReset)
+
+// ErrorMemSize indicates a size of guest RAM NewWithRAM cannot map.
+var ErrorMemSize = fmt.Errorf("guest RAM must be a multiple of %#x from %#x to %#x", MemSizeAlign, MinMemSize, MaxMemSize)
+
+// ErrorNoSEV indicates an SEV launch of a machine not created by NewSEV.
+var ErrorNoSEV = errors.New("not an SEV guest")
+
+// ErrorNoPCIDevice indicates PCI IDs for a device the machine does not have.
+var ErrorNoPCIDevice = errors.New("no such PCI device")
+
+// ErrorNoSNP indicates an SNP launch of a machine not created by NewSNP.
+var ErrorNoSNP = errors.New("not an SEV-SNP guest")
+
+// ErrorROMSize indicates a firmware ROM that cannot be mapped below 4GiB.
+var ErrorROMSize = fmt.Errorf("ROM size must be a multiple of %#x up to %#x", pageSize, maxROMSize)
+
+// ErrorTooManyMSRHandlers indicates that the MSR filter has no room for another MSR.
+var ErrorTooManyMSRHandlers = errors.New("too many MSR handlers")
+
+// ErrorTooManyPMUEvents indicates that a PMU event filter exceeds the limit of kvm.
+var ErrorTooManyPMUEvents = errors.New("too many PMU events")
+
+var (
+	// ErrorGuestReset indicates the guest asked for a reset, through a
+	// system event or any of the errors that wrap it. Reset restarts it.
+	ErrorGuestReset = errors.New("guest reset")
+
+	// ErrorGuestCrash indicates the guest reported a crash through a system event.
+	ErrorGuestCrash = errors.New("guest crash")
+
+	// ErrorStopped indicates the vCPU was stopped with Stop.
+	ErrorStopped = errors.New("vCPU stopped")
 )
 
-// ErrorWriteToCF9 indicates a write to cf9, the standard x86 reset port.
-var ErrorWriteToCF9 = fmt.Errorf("power cycle via 0xcf9")
+// ErrorGuestExit indicates a write to ExitPort, or the port of SetDebugExit.
+// The status is available from ExitCode.
+var ErrorGuestExit = fmt.Errorf("guest exit via %#x", ExitPort)
 
 type Machine struct {
+	devKVM         *os.File
 	kvmFd, vmFd    uintptr
-	vcpuFds        []uintptr
+	vcpus          []*kvm.VCPU
 	mem            []byte
-	runs           []*kvm.RunData
 	pci            *pci.PCI
+	pciSlots       map[string]int
+	faults         map[string]*virtio.Faults
+	workers        *worker.Pool
 	serial         *serial.Serial
+	net            *virtio.Net
+	blk            *virtio.Blk
+	console        *virtio.Console
+	rom            []byte
+	shadowBIOS     bool
+	acpi           bool
+	hotplug        *acpi.Hotplug
+	smbios         smbios.Info
+	exitCode       int
+	cmos           *cmos
+	uarts          [len(comPorts)]*serial.Serial
+	kbd            *i8042
+	debugcon       io.Writer
+	debugExit      DebugExit
+	firmwareBase   uint64
 	ioportHandlers [0x10000][2]func(port uint64, bytes []byte) error
+	mmioHandlers   []mmioHandler
+	msrMu          sync.Mutex // guards msrHandlers, which vCPUs read
+	msrHandlers    map[uint32]msrHandler
+	msrDeny        [1]byte // the cleared bitmap of each handled MSR
+	hypercalls     map[uint64]HypercallHandler
+
+	// vCPU threads in RunInfiniteLoop, which Kick gets out of KVM_RUN.
+	runMu    sync.Mutex
+	runCond  *sync.Cond
+	vcpuTids []int
+	kicked   []uint32
+	pausing  bool
+	stopping bool
+	nPaused  int
+	// kvmClock is the kvmclock of the guest when Pause stopped the vCPUs,
+	// which Resume sets it back to.
+	kvmClock      kvm.ClockData
+	kvmClockSaved bool
+	// running are the vCPUs of Run, which may not have got as far as
+	// vcpuTids yet.
+	running sync.WaitGroup
+
+	startup *startup.Timer
+
+	// clock runs the timers of devices, and stands still while the vCPUs
+	// are paused.
+	clock *vtimer.Clock
+
+	// vcpuStates are for QueryVCPUs, which reads vcpuStats, opened
+	// before the vCPUs run as that cannot be done while they do.
+	vcpuStates *vcpuStates
+	vcpuStats  []*kvm.Stats
+
+	// memErr receives the result of registering guest RAM with KVM, which
+	// waitMemory keeps in memSetupErr.
+	memErr      chan error
+	memOnce     sync.Once
+	memSetupErr error
+
+	supportedCPUID *kvm.CPUID
+
+	// snapshot is the snapshot last saved or restored, see SaveSnapshot.
+	snapshot string
+
+	// sev is the secure processor of an SEV guest, see NewSEV, and gmem
+	// the private memory of an SNP one, see NewSNP.
+	sev  *os.File
+	gmem *os.File
+
+	// epc are the EPC sections of the guest, see AddEPC.
+	epc [][]byte
+
+	// regions are those of AddMemoryRegion.
+	regions []region
+
+	// x2apicAPI tells whether KVM takes 32-bit APIC IDs in MSIs.
+	x2apicAPI bool
+
+	busLocks busLocks
+
+	// linux is the kernel of LoadLinux, which Reset loads again, and
+	// resetStates the state of the vCPUs as created.
+	linux       *linuxImage
+	resetStates []resetState
+
+	// workingSet is set by TrackWorkingSet.
+	workingSet *workingSet
+
+	// shutdownHooks tear the devices and listeners down in Close.
+	shutdownHooks []shutdownHook
+
+	// out is where the machine reports events, see SetEventOutput.
+	out *output.Output
+
+	// debugMu serializes the debug commands of DebugPort that pause the
+	// vCPUs, and debugSnapshots is where DebugSnapshot saves snapshots.
+	debugMu        sync.Mutex
+	debugSnapshots *snapshot.Store
+
+	// slots are the memory slots of the VM, and ramSlot that of guest RAM,
+	// which is made of ramBacking, and of ramFile if that has a file.
+	slots      *memslot.Manager
+	ramSlot    uint32
+	ramBacking memslot.Backing
+	ramFile    *os.File
+
+	// prefaultTime is how long prefaulting guest RAM took.
+	prefaultTime time.Duration
+
+	// numa are the NUMA nodes of the guest, see SetNUMA.
+	numa []NUMANode
+
+	// memDevice is the virtio-mem device of AddMemoryDevice, whose
+	// region is memDeviceRegion.
+	memDevice       *virtio.Memory
+	memDeviceRegion []byte
+
+	// balloon is the virtio-balloon device of AddBalloon.
+	balloon *virtio.Balloon
+	// iommu is the virtio-iommu device of AddIOMMU, and iommuDirty what
+	// it maps for devices to write.
+	iommu      *virtio.IOMMU
+	iommuDirty virtio.IOMMUDirty
+
+	// ejected are the PCI devices the guest ejected, by slot, which
+	// PlugPCIDevice puts back. ejectedMu guards it.
+	ejected   map[int]pci.Device
+	ejectedMu sync.Mutex
+
+	// dirtyLogMu serializes the users of dirty logging, SaveMemoryLive
+	// and MeasureDirtyRate.
+	dirtyLogMu sync.Mutex
+
+	// syncRegs are the registers KVM can pass in the run structure of a
+	// vCPU, see Regs. regsSynced tells for which vCPUs it has put the
+	// general purpose ones there yet.
+	syncRegs   uint64
+	regsSynced []bool
+}
+
+// msrHandler emulates an MSR in userspace.
+type msrHandler struct {
+	rdmsr func(index uint32) (uint64, error)
+	wrmsr func(index uint32, value uint64) error
+}
+
+// mmioHandler handles MMIO exits for guest physical addresses in [start, end).
+type mmioHandler struct {
+	start, end uint64
+	in, out    func(addr uint64, bytes []byte) error
 }
 
 func New(kvmPath string, nCpus int, tapIfName string, diskPath string) (*Machine, error) {
-	m := &Machine{}
+	return create(kvmPath, nCpus, tapIfName, diskPath, "", kvm.VMTypeDefault, memslot.Backing{}, memSize)
+}
+
+// NewSEV is New for a guest whose memory the AMD secure processor at
+// sevPath, usually /dev/sev, encrypts, see LaunchSEV. Without sevPath it
+// is New.
+func NewSEV(kvmPath string, nCpus int, tapIfName, diskPath, sevPath string) (*Machine, error) {
+	return create(kvmPath, nCpus, tapIfName, diskPath, sevPath, kvm.VMTypeDefault, memslot.Backing{}, memSize)
+}
+
+// NewSNP is NewSEV for an SEV-SNP guest, whose RAM is private memory of a
+// guest_memfd that it converts to shared and back as it needs, see
+// LaunchSNP.
+func NewSNP(kvmPath string, nCpus int, tapIfName, diskPath, sevPath string) (*Machine, error) {
+	return create(kvmPath, nCpus, tapIfName, diskPath, sevPath, kvm.VMTypeSEVSNP, memslot.Backing{}, memSize)
+}
+
+// NewWithRAM is NewSEV, or NewSNP if snp is set, with size bytes of guest
+// RAM, MemSize if 0, backed by ram, e.g. 2MiB or 1GiB huge pages for
+// fewer EPT misses of guests that touch a lot of memory.
+func NewWithRAM(kvmPath string, nCpus int, tapIfName, diskPath, sevPath string, snp bool,
+	ram memslot.Backing, size uint64) (*Machine, error) {
+	vmType := uint64(kvm.VMTypeDefault)
+	if snp {
+		vmType = kvm.VMTypeSEVSNP
+	}
+
+	if size == 0 {
+		size = memSize
+	}
+
+	return create(kvmPath, nCpus, tapIfName, diskPath, sevPath, vmType, ram, size)
+}
+
+func create(kvmPath string, nCpus int, tapIfName, diskPath, sevPath string, vmType uint64,
+	ram memslot.Backing, size uint64) (*Machine, error) {
+	m := &Machine{firmwareBase: romEnd, startup: startup.Start(), clock: vtimer.New(), ramBacking: ram}
+	m.out, _ = output.New(os.Stderr, output.Text)
+
+	if size < MinMemSize || size > MaxMemSize || size%MemSizeAlign != 0 {
+		return m, fmt.Errorf("%w: %#x", ErrorMemSize, size)
+	}
 
 	devKVM, err := os.OpenFile(kvmPath, os.O_RDWR, 0o644)
 	if err != nil {
 		return m, err
 	}
 
+	m.devKVM = devKVM
 	m.kvmFd = devKVM.Fd()
-	m.vcpuFds = make([]uintptr, nCpus)
-	m.runs = make([]*kvm.RunData, nCpus)
-
-	if m.vmFd, err = kvm.CreateVM(m.kvmFd); err != nil {
+	m.vcpus = make([]*kvm.VCPU, nCpus)
+	m.vcpuTids = make([]int, nCpus)
+	m.kicked = make([]uint32, nCpus)
+	m.runCond = sync.NewCond(&m.runMu)
+	m.vcpuStates = newVCPUStates(nCpus)
+	m.vcpuStats = make([]*kvm.Stats, nCpus)
+
+	if m.vmFd, err = kvm.CreateVMWithType(m.kvmFd, vmType); err != nil {
 		return m, fmt.Errorf("CreateVM: %w", err)
 	}
 
-	if err := kvm.SetTSSAddr(m.vmFd); err != nil {
+	if m.slots, err = memslot.New(m.vmFd); err != nil {
+		return m, err
+	}
+
+	// SEV has to be set up before the vCPUs are created.
+	if sevPath != "" {
+		if err := m.initSEV(sevPath, vmType, size); err != nil {
+			return m, err
+		}
+	}
+
+	if err := kvm.SetTSSAddr(m.vmFd, tssAddr); err != nil {
 		return m, err
 	}
 
-	if err := kvm.SetIdentityMapAddr(m.vmFd); err != nil {
+	if err := kvm.SetIdentityMapAddr(m.vmFd, identityMapAddr); err != nil {
 		return m, err
 	}
 
@@ -100,18 +408,23 @@ func New(kvmPath string, nCpus int, tapIfName string, diskPath string) (*Machine
 		return m, err
 	}
 
-	if err := kvm.CreatePIT2(m.vmFd); err != nil {
+	if err := m.enableX2APICAPI(); err != nil {
 		return m, err
 	}
 
-	mmapSize, err := kvm.GetVCPUMMmapSize(m.kvmFd)
-	if err != nil {
+	if err := m.enableBusLockExit(nCpus); err != nil {
+		return m, err
+	}
+
+	if err := kvm.CreatePIT2(m.vmFd); err != nil {
 		return m, err
 	}
 
+	m.startup.Mark("create VM")
+
 	for i := 0; i < nCpus; i++ {
-		// Create vCPU
-		m.vcpuFds[i], err = kvm.CreateVCPU(m.vmFd, i)
+		// Create vCPU with its kvm_run structure
+		m.vcpus[i], err = kvm.NewVCPU(m.kvmFd, m.vmFd, i)
 		if err != nil {
 			return m, err
 		}
@@ -121,42 +434,101 @@ func New(kvmPath string, nCpus int, tapIfName string, diskPath string) (*Machine
 			return m, err
 		}
 
-		// init kvm_run structure
-		r, err := syscall.Mmap(int(m.vcpuFds[i]), 0, int(mmapSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-		if err != nil {
-			return m, err
+		// Kernels without binary stats leave QueryVCPUs unaware of halts.
+		if s, err := kvm.NewStats(m.vcpus[i].Fd); err == nil {
+			m.vcpuStats[i] = s
 		}
 
-		m.runs[i] = (*kvm.RunData)(unsafe.Pointer(&r[0]))
+		// Other signals are left to other threads rather than return from
+		// KVM_RUN for nothing.
+		if err := kvm.SetSignalMask(m.vcpus[i].Fd, ^uint64(1<<(kickSignal-1))); err != nil {
+			return m, err
+		}
 	}
 
-	m.mem, err = syscall.Mmap(-1, 0, memSize,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
-	if err != nil {
+	if err := m.saveResetState(); err != nil {
 		return m, err
 	}
 
-	err = kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
-		Slot: 0, Flags: 0, GuestPhysAddr: 0, MemorySize: 1 << 30,
-		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&m.mem[0]))),
-	})
-	if err != nil {
-		return m, err
+	m.regsSynced = make([]bool, nCpus)
+
+	if regs, err := kvm.CheckExtension(m.vmFd, kvm.CapSyncRegs); err == nil && regs&kvm.SyncX86Regs != 0 {
+		m.syncRegs = uint64(regs)
+
+		for _, v := range m.vcpus {
+			v.Run.ValidRegs = kvm.SyncX86Regs
+		}
 	}
 
-	e, err := ebda.New(nCpus)
+	m.startup.Mark("create vCPUs")
+
+	// Prefaulting takes long, so it is left to the goroutine below.
+	mapped := ram
+	mapped.Prefault = false
+
+	m.mem, m.ramFile, err = memslot.MapFile(int(size), mapped)
 	if err != nil {
+		return m, fmt.Errorf("guest RAM: %w", err)
+	}
+
+	// Registering the memory takes KVM milliseconds, which is most of New,
+	// so it goes on while the devices are created and the kernel or ROM is
+	// loaded, which wait for it.
+	m.memErr = make(chan error, 1)
+
+	go func(start time.Time) {
+		if m.ramBacking.Prefault {
+			err := memslot.Prefault(m.mem)
+			m.prefaultTime = time.Since(start)
+			m.startup.Since("prefault memory", start)
+
+			if err != nil {
+				m.memErr <- fmt.Errorf("guest RAM: %w", err)
+
+				return
+			}
+
+			start = time.Now()
+		}
+
+		ram := memslot.Region{Mem: m.mem}
+
+		// Guest RAM backed by m.gmem takes the pages there where it is
+		// private.
+		if m.gmem != nil {
+			ram.Flags, ram.GuestMemfd = kvm.MemGuestMemfd, m.gmem.Fd()
+		}
+
+		ram, err := m.slots.Add(ram)
+		m.ramSlot = ram.Slot
+		m.memErr <- err
+
+		m.startup.Since("register memory", start)
+	}(time.Now())
+
+	m.startup.Mark("map memory")
+
+	if err := m.writeEBDA(); err != nil {
 		return m, err
 	}
 
-	bytes, err := e.Bytes()
-	if err != nil {
+	m.writeSMBIOS()
+
+	if m.serial, err = serial.New(uartIRQ{m, serialIRQ}); err != nil {
 		return m, err
 	}
 
-	copy(m.mem[bootparam.EBDAStart:], bytes)
+	m.kbd = newI8042(m.kbdIRQ)
+
+	m.pci = pci.New()
+	m.pciSlots = map[string]int{}
+	m.ejected = map[int]pci.Device{}
+	m.faults = map[string]*virtio.Faults{}
+	m.addPCIDevice("bridge", pci.NewBridge()) // 00:00.0 for PCI bridge
 
-	m.pci = pci.New(pci.NewBridge()) // 00:00.0 for PCI bridge
+	// Devices quiesce before the pool, which runs their last jobs.
+	m.workers = worker.New(deviceWorkers)
+	m.OnShutdown(ShutdownQuiesce, "workers", m.workers.Close)
 
 	if len(tapIfName) > 0 {
 		t, err := tap.New(tapIfName)
@@ -165,10 +537,18 @@ func New(kvmPath string, nCpus int, tapIfName string, diskPath string) (*Machine
 		}
 
 		v := virtio.NewNet(virtioNetIRQ, m, t, m.mem)
+		v.RxRunner = m.workerQueue(worker.NetRX)
+		v.TxRunner = m.workerQueue(worker.Blk)
+
 		go v.TxThreadEntry()
 		go v.RxThreadEntry()
 		// 00:01.0 for Virtio net
-		m.pci.Devices = append(m.pci.Devices, v)
+		m.addPCIDevice("net", v)
+		// The tap closes once the queues drained.
+		m.OnShutdown(ShutdownQuiesce, "net", quiesce(v.Quiesce))
+		m.OnShutdown(ShutdownRelease, "net", v.Close)
+		m.faults["net"] = v.Faults
+		m.net = v
 	}
 
 	if len(diskPath) > 0 {
@@ -177,290 +557,1395 @@ func New(kvmPath string, nCpus int, tapIfName string, diskPath string) (*Machine
 			return nil, err
 		}
 
+		v.Runner = m.workerQueue(worker.Blk)
+		m.blk = v
+
 		go v.IOThreadEntry()
 		// 00:02.0 for Virtio blk
-		m.pci.Devices = append(m.pci.Devices, v)
+		m.addPCIDevice("blk", v)
+		m.OnShutdown(ShutdownQuiesce, "blk", quiesce(v.Quiesce))
+		m.OnShutdown(ShutdownFlush, "blk", v.Flush)
+		m.OnShutdown(ShutdownRelease, "blk", v.Close)
+		m.faults["blk"] = v.Faults
 	}
 
+	m.startup.Mark("create devices")
+
 	return m, nil
 }
 
-// RunData returns the kvm.RunData for the VM.
-func (m *Machine) RunData() []*kvm.RunData {
-	return m.runs
+// workerQueue returns a queue of class for the thread of a device, which
+// waits for each of its jobs to run.
+func (m *Machine) workerQueue(class worker.Class) *worker.Queue {
+	q, _ := m.workers.Queue(class, 1)
+
+	return q
 }
 
-func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
-	// Load initrd
-	initrdSize, err := initrd.ReadAt(m.mem[initrdAddr:], 0)
-	if err != nil && initrdSize == 0 && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("initrd: (%v, %w)", initrdSize, err)
+// addPCIDevice puts d in the next slot of bus 0, where OverridePCIIDs
+// finds it by name.
+func (m *Machine) addPCIDevice(name string, d pci.Device) {
+	m.pciSlots[name] = len(m.pci.Devices)
+	m.pci.Devices = append(m.pci.Devices, d)
+}
+
+// OverridePCIIDs makes the PCI device name, one of bridge, net, blk,
+// console, mem and balloon, report ids instead of its own, so that a guest driver that
+// only binds to particular hardware takes it. The guest must not have
+// enumerated PCI yet.
+func (m *Machine) OverridePCIIDs(name string, ids pci.IDs) error {
+	slot, ok := m.pciSlots[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrorNoPCIDevice, name)
 	}
 
-	// Load kernel command-line parameters
-	copy(m.mem[cmdlineAddr:], params)
-	m.mem[cmdlineAddr+len(params)] = 0 // for null terminated string
+	m.pci.Devices[slot] = pci.Override(m.pci.Devices[slot], ids)
 
-	// Load Boot Param
-	bootParam, err := bootparam.New(kernel)
-	if err != nil {
-		return err
+	return nil
+}
+
+// Faults returns what the device name, net or blk, injects into the
+// guest on purpose.
+func (m *Machine) Faults(name string) (*virtio.Faults, error) {
+	f, ok := m.faults[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrorNoPCIDevice, name)
 	}
 
-	// refs https://github.com/kvmtool/kvmtool/blob/0e1882a49f81cb15d328ef83a78849c0ea26eecc/x86/bios.c#L66-L86
-	bootParam.AddE820Entry(
-		bootparam.RealModeIvtBegin,
-		bootparam.EBDAStart-bootparam.RealModeIvtBegin,
-		bootparam.E820Ram,
-	)
-	bootParam.AddE820Entry(
-		bootparam.EBDAStart,
-		bootparam.VGARAMBegin-bootparam.EBDAStart,
-		bootparam.E820Reserved,
-	)
-	bootParam.AddE820Entry(
-		bootparam.MBBIOSBegin,
-		bootparam.MBBIOSEnd-bootparam.MBBIOSBegin,
-		bootparam.E820Reserved,
-	)
-	bootParam.AddE820Entry(
-		kernelAddr,
-		memSize-kernelAddr,
-		bootparam.E820Ram,
-	)
+	return f, nil
+}
 
-	bootParam.Hdr.VidMode = 0xFFFF                                                                  // Proto ALL
-	bootParam.Hdr.TypeOfLoader = 0xFF                                                               // Proto 2.00+
-	bootParam.Hdr.RamdiskImage = initrdAddr                                                         // Proto 2.00+
-	bootParam.Hdr.RamdiskSize = uint32(initrdSize)                                                  // Proto 2.00+
-	bootParam.Hdr.LoadFlags |= bootparam.CanUseHeap | bootparam.LoadedHigh | bootparam.KeepSegments // Proto 2.00+
-	bootParam.Hdr.HeapEndPtr = 0xFE00                                                               // Proto 2.01+
-	bootParam.Hdr.ExtLoaderVer = 0                                                                  // Proto 2.02+
-	bootParam.Hdr.CmdlinePtr = cmdlineAddr                                                          // Proto 2.06+
-	bootParam.Hdr.CmdlineSize = uint32(len(params) + 1)                                             // Proto 2.06+
-
-	bytes, err := bootParam.Bytes()
-	if err != nil {
-		return err
+// ShapeNet has the traffic of the NIC behave as on a link of profile p,
+// e.g. a WAN with latency and loss, in each direction.
+func (m *Machine) ShapeNet(p virtio.NetProfile) error {
+	if m.net == nil {
+		return fmt.Errorf("%w: net", ErrorNoPCIDevice)
 	}
 
-	copy(m.mem[bootParamAddr:], bytes)
+	m.net.Shape(p)
 
-	// Load kernel
-	// copy to g.mem with offest setupsz
-	//
-	// The 32-bit (non-real-mode) kernel starts at offset (setup_sects+1)*512 in
-	// the kernel file (again, if setup_sects == 0 the real value is 4.) It should
-	// be loaded at address 0x10000 for Image/zImage kernels and 0x100000 for bzImage kernels.
-	//
-	// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#loading-the-rest-of-the-kernel
-	offset := int(bootParam.Hdr.SetupSects+1) * 512
+	return nil
+}
 
-	kernSize, err := kernel.ReadAt(m.mem[kernelAddr:], int64(offset))
-	if err != nil && kernSize == 0 && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("kernel: (%v, %w)", kernSize, err)
+// NetProfile returns the profile of ShapeNet.
+func (m *Machine) NetProfile() (virtio.NetProfile, error) {
+	if m.net == nil {
+		return virtio.NetProfile{}, fmt.Errorf("%w: net", ErrorNoPCIDevice)
 	}
 
-	for i := range m.vcpuFds {
-		if err = m.initRegs(i); err != nil {
-			return err
-		}
+	return m.net.Profile(), nil
+}
 
-		if err = m.initSregs(i); err != nil {
-			return err
-		}
+// initSEV makes the VM an SEV guest, or an SNP one with a guest_memfd for
+// its private memory of size bytes.
+func (m *Machine) initSEV(sevPath string, vmType, size uint64) error {
+	var err error
+
+	if m.sev, err = os.OpenFile(sevPath, os.O_RDWR, 0); err != nil {
+		return err
+	}
+
+	if vmType == kvm.VMTypeDefault {
+		return kvm.SEVInit(m.vmFd, m.sev.Fd())
 	}
 
-	if m.serial, err = serial.New(m); err != nil {
+	if err := kvm.SEVInit2(m.vmFd, m.sev.Fd(), 0); err != nil {
 		return err
 	}
 
-	m.initIOPortHandlers()
+	gmem, err := kvm.CreateGuestMemfd(m.vmFd, size, 0)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	m.gmem = os.NewFile(gmem, "guest_memfd")
+
+	// The guest asks to convert memory between private and shared with
+	// a hypercall.
+	return m.RegisterHypercallHandler(kvm.HCMapGPARange, m.mapGPARange)
 }
 
-func (m *Machine) GetInputChan() chan<- byte {
-	return m.serial.GetInputChan()
+// convertMemory makes size bytes of guest memory at gpa private or shared,
+// as an SNP guest asks to.
+func (m *Machine) convertMemory(gpa, size uint64, private bool) error {
+	attributes := uint64(0)
+	if private {
+		attributes = kvm.MemoryAttributePrivate
+	}
+
+	return kvm.SetMemoryAttributes(m.vmFd, gpa, size, attributes)
 }
 
-func (m *Machine) initRegs(i int) error {
-	regs, err := kvm.GetRegs(m.vcpuFds[i])
-	if err != nil {
-		return err
+// waitMemory waits until guest RAM is registered with KVM, see New.
+func (m *Machine) waitMemory() error {
+	m.memOnce.Do(func() { m.memSetupErr = <-m.memErr })
+
+	return m.memSetupErr
+}
+
+// PrefaultTime returns how long prefaulting guest RAM backed with
+// memslot.Backing.Prefault took, waiting for it to finish, or 0 without it.
+func (m *Machine) PrefaultTime() (time.Duration, error) {
+	if err := m.waitMemory(); err != nil {
+		return 0, err
 	}
 
-	regs.RFLAGS = 2
-	regs.RIP = kernelAddr
-	regs.RSI = bootParamAddr
+	return m.prefaultTime, nil
+}
+
+// StartupPhases returns how long the steps of New and of loading the
+// kernel or ROM took.
+func (m *Machine) StartupPhases() []startup.Phase {
+	return m.startup.Phases()
+}
 
-	if err := kvm.SetRegs(m.vcpuFds[i], regs); err != nil {
-		return err
+// RunData returns the kvm.RunData for the VM.
+func (m *Machine) RunData() []*kvm.RunData {
+	runs := make([]*kvm.RunData, len(m.vcpus))
+	for i, v := range m.vcpus {
+		runs[i] = v.Run
 	}
 
-	return nil
+	return runs
+}
+
+// VMStats returns the binary statistics of the VM by name.
+func (m *Machine) VMStats() (map[string]uint64, error) {
+	return readStats(m.vmFd)
 }
 
-func (m *Machine) initSregs(i int) error {
-	sregs, err := kvm.GetSregs(m.vcpuFds[i])
+// VCPUStats returns the binary statistics of vCPU cpu by name.
+func (m *Machine) VCPUStats(cpu int) (map[string]uint64, error) {
+	return readStats(m.vcpus[cpu].Fd)
+}
+
+func readStats(fd uintptr) (map[string]uint64, error) {
+	s, err := kvm.NewStats(fd)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// set all segment flat
-	sregs.CS.Base, sregs.CS.Limit, sregs.CS.G = 0, 0xFFFFFFFF, 1
-	sregs.DS.Base, sregs.DS.Limit, sregs.DS.G = 0, 0xFFFFFFFF, 1
-	sregs.FS.Base, sregs.FS.Limit, sregs.FS.G = 0, 0xFFFFFFFF, 1
-	sregs.GS.Base, sregs.GS.Limit, sregs.GS.G = 0, 0xFFFFFFFF, 1
-	sregs.ES.Base, sregs.ES.Limit, sregs.ES.G = 0, 0xFFFFFFFF, 1
-	sregs.SS.Base, sregs.SS.Limit, sregs.SS.G = 0, 0xFFFFFFFF, 1
+	defer s.Close()
 
-	sregs.CS.DB, sregs.SS.DB = 1, 1
-	sregs.CR0 |= 1 // protected mode
+	return s.Read()
+}
 
-	if err := kvm.SetSregs(m.vcpuFds[i], sregs); err != nil {
-		return err
-	}
+// SaveMemory writes guest RAM to w as a sparse snapshot image, sharing the
+// data of identical pages if dedup is set. The vCPUs must not be running.
+func (m *Machine) SaveMemory(w io.Writer, dedup bool) (snapshot.Stats, error) {
+	return snapshot.WriteMemory(w, m.mem, dedup)
+}
 
-	return nil
+// RAMFile returns the file of guest RAM, e.g. to hand it to a vhost-user
+// backend, or nil if RAM is anonymous memory. It is a memfd with its size
+// sealed if RAM is backed by memslot.Backing.Memfd.
+func (m *Machine) RAMFile() *os.File {
+	return m.ramFile
 }
 
-func (m *Machine) initCPUID(i int) error {
-	cpuid := kvm.CPUID{}
-	cpuid.Nent = 100
+// SaveMemoryFile writes guest RAM as it is to f at its offset, a flat
+// image rather than the sparse one of SaveMemory. RAM in a file is copied
+// by the kernel with copy_file_range, without passing through gokvm. The
+// vCPUs must not be running.
+func (m *Machine) SaveMemoryFile(f *os.File) error {
+	if m.ramFile == nil {
+		_, err := f.Write(m.mem)
 
-	if err := kvm.GetSupportedCPUID(m.kvmFd, &cpuid); err != nil {
 		return err
 	}
 
-	// https://www.kernel.org/doc/html/latest/virt/kvm/cpuid.html
-	for i := 0; i < int(cpuid.Nent); i++ {
-		if cpuid.Entries[i].Function == kvm.CPUIDFuncPerMon {
-			cpuid.Entries[i].Eax = 0 // disable
-		} else if cpuid.Entries[i].Function == kvm.CPUIDSignature {
-			cpuid.Entries[i].Eax = kvm.CPUIDFeatures
-			cpuid.Entries[i].Ebx = 0x4b4d564b // KVMK
-			cpuid.Entries[i].Ecx = 0x564b4d56 // VMKV
-			cpuid.Entries[i].Edx = 0x4d       // M
-		}
-	}
+	return memslot.CopyFile(f, m.ramFile, int64(len(m.mem)))
+}
 
-	if err := kvm.SetCPUID2(m.vcpuFds[i], &cpuid); err != nil {
-		return err
+// Bounds of SaveMemoryLive: it copies the pages written during the last
+// copy again at most liveRounds times, or until no more than liveDirtyPages
+// are left, before it pauses the vCPUs for the last copy.
+const (
+	liveRounds     = 8
+	liveDirtyPages = 256
+)
+
+// SaveMemoryLive writes the same image as SaveMemory while the vCPUs keep
+// running. It copies RAM with dirty logging on and then the pages written
+// meanwhile, until few are left; only the copy of those pauses the vCPUs.
+// The image, RAM as it was at that pause, is written after they resume.
+//
+// Dirty logging only tracks writes by the guest, so data the virtio devices
+// write to RAM while the copy is made may be missing, unless they are
+// behind the IOMMU of AddIOMMU: what it maps for them to write is copied
+// every round.
+func (m *Machine) SaveMemoryLive(w io.Writer, dedup bool) (snapshot.Stats, error) {
+	m.dirtyLogMu.Lock()
+	defer m.dirtyLogMu.Unlock()
+
+	if err := m.setDirtyLog(true); err != nil {
+		return snapshot.Stats{}, err
 	}
 
-	return nil
-}
+	defer func() { _ = m.setDirtyLog(false) }()
 
-func (m *Machine) RunInfiniteLoop(i int) error {
-	// https://www.kernel.org/doc/Documentation/virtual/kvm/api.txt
-	// - vcpu ioctls: These query and set attributes that control the operation
-	//   of a single virtual cpu.
-	//
-	//   vcpu ioctls should be issued from the same thread that was used to create
-	//   the vcpu, except for asynchronous vcpu ioctl that are marked as such in
-	//   the documentation.  Otherwise, the first ioctl after switching threads
-	//   could see a performance impact.
-	//
-	// - device ioctls: These query and set attributes that control the operation
-	//   of a single device.
-	//
-	//   device ioctls must be issued from the same process (address space) that
-	//   was used to create the VM.
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+	mem, err := syscall.Mmap(-1, 0, len(m.mem),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return snapshot.Stats{}, err
+	}
 
-	for {
-		isContinue, err := m.RunOnce(i)
-		if err != nil {
-			return err
+	defer func() { _ = syscall.Munmap(mem) }()
+
+	// Pages of the copy that are never written read as zero.
+	for p := 0; p < len(m.mem); p += pageSize {
+		if page := m.mem[p : p+pageSize]; !snapshot.IsZero(page) {
+			copy(mem[p:], page)
 		}
+	}
 
-		if !isContinue {
-			return nil
+	bitmap := make([]uint64, len(m.mem)/pageSize/64)
+
+	for round, dirty := 0, len(m.mem)/pageSize; round < liveRounds && dirty > liveDirtyPages; round++ {
+		if dirty, err = m.copyDirtyPages(mem, bitmap); err != nil {
+			return snapshot.Stats{}, err
 		}
 	}
-}
 
-func (m *Machine) RunOnce(i int) (bool, error) {
-	err := kvm.Run(m.vcpuFds[i])
+	m.Pause()
+	_, err = m.copyDirtyPages(mem, bitmap)
+	m.Resume()
 
-	exit := kvm.ExitType(m.runs[i].ExitReason)
+	if err != nil {
+		return snapshot.Stats{}, err
+	}
 
-	switch exit {
-	case kvm.EXITHLT:
-		fmt.Println("KVM_EXIT_HLT")
+	return snapshot.WriteMemory(w, mem, dedup)
+}
 
-		return false, err
-	case kvm.EXITIO:
-		direction, size, port, count, offset := m.runs[i].IO()
-		f := m.ioportHandlers[port][direction]
-		bytes := (*(*[100]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(m.runs[i])) + uintptr(offset))))[0:size]
+// copyDirtyPages copies the pages of guest RAM written since the last call
+// to mem and returns how many there were.
+func (m *Machine) copyDirtyPages(mem []byte, bitmap []uint64) (int, error) {
+	if err := m.getDirtyLog(bitmap); err != nil {
+		return 0, err
+	}
 
-		for i := 0; i < int(count); i++ {
-			if err := f(port, bytes); err != nil {
-				return false, err
+	m.iommuDirty.Mark(bitmap)
+
+	n := 0
+
+	for i, bits := range bitmap {
+		for b := 0; bits != 0; b, bits = b+1, bits>>1 {
+			if bits&1 == 0 {
+				continue
 			}
-		}
 
-		return true, err
-	case kvm.EXITUNKNOWN:
-		return true, err
-	case kvm.EXITINTR:
-		// When a signal is sent to the thread hosting the VM it will result in EINTR
-		// refs https://gist.github.com/mcastelino/df7e65ade874f6890f618dc51778d83a
-		return true, nil
-	case kvm.EXITDCR,
-		kvm.EXITDEBUG,
-		kvm.EXITEXCEPTION,
-		kvm.EXITFAILENTRY,
-		kvm.EXITHYPERCALL,
-		kvm.EXITINTERNALERROR,
-		kvm.EXITIRQWINDOWOPEN,
-		kvm.EXITMMIO,
-		kvm.EXITNMI,
-		kvm.EXITS390RESET,
-		kvm.EXITS390SIEIC,
-		kvm.EXITSETTPR,
-		kvm.EXITSHUTDOWN,
-		kvm.EXITTPRACCESS:
-		if err != nil {
-			return false, err
+			p := (i*64 + b) * pageSize
+			copy(mem[p:p+pageSize], m.mem[p:p+pageSize])
+			n++
 		}
+	}
 
-		return false, fmt.Errorf("%w: %s", kvm.ErrUnexpectedEXITReason, exit.String())
-	default:
-		if err != nil {
-			return false, err
-		}
+	return n, nil
+}
 
-		return false, fmt.Errorf("%w: %s", kvm.ErrUnexpectedEXITReason, exit.String())
-	}
+// getDirtyLog fills bitmap with the pages of guest RAM written since the
+// last call, or since dirty logging was turned on.
+func (m *Machine) getDirtyLog(bitmap []uint64) error {
+	return kvm.GetDirtyLog(m.vmFd, m.ramSlot, bitmap)
 }
 
-func (m *Machine) registerIOPortHandler(
-	start, end uint64,
-	inHandler, outHandler func(port uint64, bytes []byte) error,
-) {
-	for i := start; i < end; i++ {
-		m.ioportHandlers[i][kvm.EXITIOIN] = inHandler
-		m.ioportHandlers[i][kvm.EXITIOOUT] = outHandler
+func (m *Machine) setDirtyLog(on bool) error {
+	if err := m.waitMemory(); err != nil {
+		return err
+	}
+
+	flags := uint32(0)
+	if on {
+		flags = kvm.MemLogDirtyPages
 	}
+
+	return m.slots.SetFlags(m.ramSlot, flags)
 }
 
-func (m *Machine) initIOPortHandlers() {
-	funcNone := func(port uint64, bytes []byte) error {
-		return nil
+// MemoryRegions returns the memory slots of the guest by address: RAM, and
+// the ROM and EPC sections if any.
+func (m *Machine) MemoryRegions() []memslot.Region {
+	return m.slots.Regions()
+}
+
+// LoadMemory replaces guest RAM with an image written by SaveMemory.
+func (m *Machine) LoadMemory(r io.Reader) error {
+	return snapshot.ReadMemory(r, m.mem)
+}
+
+// snapshotClock is the key of the virtual clock in the state of a snapshot.
+const snapshotClock = "clock"
+
+// Clock returns the virtual clock on which devices set their timers.
+func (m *Machine) Clock() *vtimer.Clock {
+	return m.clock
+}
+
+// SaveSnapshot stores guest RAM and the virtual clock in s as the snapshot
+// name, a child of the one last saved or restored. The vCPUs must not be
+// running.
+func (m *Machine) SaveSnapshot(s *snapshot.Store, name string) error {
+	if err := s.Save(name, m.snapshot, m.mem); err != nil {
+		return err
 	}
 
-	funcError := func(port uint64, bytes []byte) error {
-		return fmt.Errorf("%w: unexpected io port 0x%x", kvm.ErrUnexpectedEXITReason, port)
+	if err := s.SetState(name, snapshotClock, m.clock.State()); err != nil {
+		return err
 	}
 
-	// 0xCF9 port can get three values for three types of reset:
-	//
-	// Writing 4 to 0xCF9:(INIT) Will INIT the CPU. Meaning it will jump
-	// to the initial location of booting but it will keep many CPU
+	m.snapshot = name
+
+	return nil
+}
+
+// RestoreSnapshot replaces guest RAM and the virtual clock with the
+// snapshot name of s, which becomes the parent of the next SaveSnapshot.
+func (m *Machine) RestoreSnapshot(s *snapshot.Store, name string) error {
+	if err := s.Restore(name, m.mem); err != nil {
+		return err
+	}
+
+	clock := vtimer.State{}
+
+	if ok, err := s.GetState(name, snapshotClock, &clock); err != nil {
+		return err
+	} else if ok {
+		m.clock.Restore(clock)
+	}
+
+	m.snapshot = name
+
+	return nil
+}
+
+// LoadLinux loads a bzImage or vmlinux kernel and initrd with the kernel
+// command line params. A vmlinux is entered at its 64-bit entry point,
+// past the decompressor of a bzImage. Reset loads them again, so kernel
+// and initrd must stay readable.
+func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
+	defer m.startup.Since("load Linux", time.Now())
+
+	if err := m.loadLinux(kernel, initrd, params); err != nil {
+		return err
+	}
+
+	m.linux = &linuxImage{kernel: kernel, initrd: initrd, params: params}
+	m.initIOPortHandlers()
+
+	return m.waitMemory()
+}
+
+// e820 returns the E820 table of the guest, from its memory slots and the
+// areas reserved for the BIOS, the APICs, and the identity map and TSS of
+// KVM. The region of the virtio-mem device is left out, as the guest plugs
+// its memory through the device.
+//
+// refs https://github.com/kvmtool/kvmtool/blob/0e1882a49f81cb15d328ef83a78849c0ea26eecc/x86/bios.c#L66-L86
+func (m *Machine) e820() []bootparam.E820Entry {
+	var b bootparam.E820Builder
+
+	regions := map[uint32]region{}
+	for _, r := range m.regions {
+		regions[r.slot] = r
+	}
+
+	for _, s := range m.slots.Regions() {
+		r, isRegion := regions[s.Slot]
+
+		switch {
+		case s.Slot == m.ramSlot:
+			b.Add(s.GPA, uint64(len(s.Mem)), bootparam.E820Ram)
+		case m.memDeviceRegion != nil && s.GPA == memDeviceBase:
+		case isRegion && r.Kind == RegionRAM && !r.ReadOnly:
+			b.Add(s.GPA, uint64(len(s.Mem)), bootparam.E820Ram)
+		default:
+			// Firmware ROM, SGX EPC and other regions.
+			b.Add(s.GPA, uint64(len(s.Mem)), bootparam.E820Reserved)
+		}
+	}
+
+	b.Add(bootparam.EBDAStart, bootparam.VGARAMBegin-bootparam.EBDAStart, bootparam.E820Reserved)
+	b.Hole(bootparam.VGARAMBegin, bootparam.MBBIOSBegin-bootparam.VGARAMBegin)
+	b.Add(bootparam.MBBIOSBegin, bootparam.MBBIOSEnd+1-bootparam.MBBIOSBegin, bootparam.E820Reserved)
+	b.Add(ioapicAddr, pageSize, bootparam.E820Reserved)
+	b.Add(lapicAddr, pageSize, bootparam.E820Reserved)
+	b.Add(identityMapAddr, tssAddr+3*pageSize-identityMapAddr, bootparam.E820Reserved)
+
+	return b.Entries()
+}
+
+// cmdline returns the kernel command line params with what the devices
+// of m need added, unless params sets it.
+func (m *Machine) cmdline(params string) *loader.Cmdline {
+	c := loader.ParseCmdline(params)
+
+	// The virtio PCI devices only have the legacy interface, which the
+	// driver would not fall back to for transitional device IDs.
+	if m.net != nil || m.blk != nil {
+		c.Default("virtio_pci.force_legacy", "1")
+	}
+
+	return c
+}
+
+// loadLinux copies the kernel, initrd and boot parameters to guest RAM,
+// and points the vCPUs at the kernel.
+func (m *Machine) loadLinux(kernel, initrd io.ReaderAt, params string) error {
+	linux, err := loader.Load(m.mem, loader.Layout{
+		BootParams: bootParamAddr,
+		Cmdline:    cmdlineAddr,
+		Kernel:     kernelAddr,
+		Initrd:     initrdAddr,
+		PageTables: pageTablesAddr,
+	}, loader.Image{
+		Kernel:  kernel,
+		Initrd:  initrd,
+		Cmdline: m.cmdline(params),
+		E820:    m.e820(),
+		Timer:   m.startup,
+	})
+	if err != nil {
+		return err
+	}
+
+	if m.acpi {
+		m.writeACPI()
+	}
+
+	for i := range m.vcpus {
+		regs, err := m.Regs(i)
+		if err != nil {
+			return err
+		}
+
+		linux.SetRegs(&regs)
+
+		if err := m.SetRegs(i, regs); err != nil {
+			return err
+		}
+
+		sregs, err := m.Sregs(i)
+		if err != nil {
+			return err
+		}
+
+		linux.SetSregs(&sregs)
+
+		if err := m.SetSregs(i, sregs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadROM maps a firmware image, e.g. a coreboot ROM, read-only so that
+// it ends at 4GiB, and leaves the vCPUs in their reset state so that they
+// start at the reset vector at 4GiB - 16. POST codes written to port 0x80
+// are logged to stderr.
+func (m *Machine) LoadROM(rom []byte) error {
+	if len(rom) == 0 || len(rom)%pageSize != 0 || len(rom) > maxROMSize {
+		return fmt.Errorf("%w: %#x bytes", ErrorROMSize, len(rom))
+	}
+
+	defer m.startup.Since("load ROM", time.Now())
+
+	if err := m.waitMemory(); err != nil {
+		return err
+	}
+
+	mem, err := syscall.Mmap(-1, 0, len(rom),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return err
+	}
+
+	copy(mem, rom)
+	m.rom = mem
+
+	romStart := m.firmwareBase - uint64(len(rom))
+	if _, err := m.slots.Add(memslot.Region{GPA: romStart, Mem: mem, Flags: kvm.MemReadonly}); err != nil {
+		return fmt.Errorf("ROM: %w", err)
+	}
+
+	m.firmwareBase = romStart
+
+	m.initIOPortHandlers()
+
+	// Writes to the read-only ROM exit to userspace. Drop them as a flash
+	// chip does without its command sequence.
+	m.registerMMIOHandler(romStart, romStart+uint64(len(rom)),
+		func(addr uint64, bytes []byte) error { return nil },
+		func(addr uint64, bytes []byte) error { return nil },
+	)
+
+	m.registerIOPortHandler(0x80, 0x81,
+		func(port uint64, bytes []byte) error { return nil },
+		func(port uint64, bytes []byte) error {
+			m.out.Event("post_code", output.Fields{"code": bytes[0]}, "POST code: %#02x", bytes[0])
+
+			return nil
+		},
+	)
+
+	return nil
+}
+
+// LaunchSEV encrypts guest RAM and the ROM, with what was loaded into them,
+// for the guest to run under policy, and returns the launch measurement of
+// the contents for the guest owner to check. It must come after loading
+// the kernel or ROM and before running the vCPUs.
+func (m *Machine) LaunchSEV(policy uint32) ([]byte, error) {
+	if m.sev == nil {
+		return nil, ErrorNoSEV
+	}
+
+	if err := m.waitMemory(); err != nil {
+		return nil, err
+	}
+
+	regions := [][]byte{m.mem}
+	if m.rom != nil {
+		regions = append(regions, m.rom)
+	}
+
+	for _, r := range regions {
+		if err := kvm.MemoryEncryptRegRegion(m.vmFd, uint64(uintptr(unsafe.Pointer(&r[0]))), uint64(len(r))); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := kvm.SEVLaunchStart(m.vmFd, m.sev.Fd(), policy); err != nil {
+		return nil, err
+	}
+
+	for _, r := range regions {
+		if err := kvm.SEVLaunchUpdateData(m.vmFd, m.sev.Fd(), r); err != nil {
+			return nil, err
+		}
+	}
+
+	measurement, err := kvm.SEVLaunchMeasure(m.vmFd, m.sev.Fd())
+	if err != nil {
+		return nil, err
+	}
+
+	return measurement, kvm.SEVLaunchFinish(m.vmFd, m.sev.Fd())
+}
+
+// LaunchSNP makes guest RAM private and copies what was loaded into it,
+// i.e. the non-zero pages, into the guest context, measured and validated,
+// for the guest to run under policy; it validates the others itself. The
+// guest reports the measurement in its attestation reports. It must come
+// after loading the kernel and before running the vCPUs.
+func (m *Machine) LaunchSNP(policy uint64) error {
+	if m.gmem == nil {
+		return ErrorNoSNP
+	}
+
+	if err := m.waitMemory(); err != nil {
+		return err
+	}
+
+	if err := m.convertMemory(0, uint64(len(m.mem)), true); err != nil {
+		return err
+	}
+
+	if err := kvm.SNPLaunchStart(m.vmFd, m.sev.Fd(), policy); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(m.mem); {
+		if snapshot.IsZero(m.mem[start : start+pageSize]) {
+			start += pageSize
+
+			continue
+		}
+
+		end := start + pageSize
+		for end < len(m.mem) && !snapshot.IsZero(m.mem[end:end+pageSize]) {
+			end += pageSize
+		}
+
+		if err := kvm.SNPLaunchUpdate(m.vmFd, m.sev.Fd(), uint64(start/pageSize),
+			m.mem[start:end], kvm.SNPPageTypeNormal); err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	return kvm.SNPLaunchFinish(m.vmFd, m.sev.Fd(), [32]byte{})
+}
+
+// AddFlash maps a flash device right below the firmware mapped so far,
+// e.g. a variable store below the ROM from LoadROM, which must therefore
+// be loaded first. Both share the maxROMSize window below 4GiB.
+func (m *Machine) AddFlash(f *flash.Flash) error {
+	base := m.firmwareBase - f.Size()
+	if f.Size() > maxROMSize || f.Size()%pageSize != 0 || base < romEnd-maxROMSize {
+		return fmt.Errorf("%w: flash of %#x bytes", ErrorROMSize, f.Size())
+	}
+
+	m.firmwareBase = base
+	m.registerMMIOHandler(base, base+f.Size(),
+		func(addr uint64, bytes []byte) error { return f.Read(addr-base, bytes) },
+		func(addr uint64, bytes []byte) error { return f.Write(addr-base, bytes) },
+	)
+
+	return nil
+}
+
+// ExitCode returns the status the guest last wrote to ExitPort, or the port
+// of SetDebugExit.
+func (m *Machine) ExitCode() int {
+	return m.exitCode
+}
+
+func (m *Machine) GetInputChan() chan<- byte {
+	return m.serial.GetInputChan()
+}
+
+// SetSerialOutput redirects what the guest writes to the serial console.
+func (m *Machine) SetSerialOutput(w io.Writer) {
+	m.serial.SetOutput(w)
+}
+
+// SetEventOutput has the machine report its events, e.g. POST codes and
+// halts, to o instead of as text on stderr.
+func (m *Machine) SetEventOutput(o *output.Output) {
+	m.out = o
+}
+
+// Regs returns the general purpose registers of vCPU i. Where KVM supports
+// KVM_CAP_SYNC_REGS, they are read from the run structure, where KVM puts
+// them at every exit, rather than with an ioctl, so that exit handlers
+// that need them do not add a round-trip to the kernel to every exit.
+// The special registers are only passed to KVM that way, see Sregs, as
+// storing them costs KVM more on every exit than the few handlers that
+// read them save.
+func (m *Machine) Regs(i int) (kvm.Regs, error) {
+	if m.syncRegs&kvm.SyncX86Regs != 0 && m.regsSynced[i] {
+		return m.vcpus[i].Run.SyncRegs.Regs, nil
+	}
+
+	return kvm.GetRegs(m.vcpus[i].Fd)
+}
+
+// SetRegs sets the general purpose registers of vCPU i. With
+// KVM_CAP_SYNC_REGS, KVM loads them when the vCPU next enters the guest.
+func (m *Machine) SetRegs(i int, regs kvm.Regs) error {
+	if m.syncRegs&kvm.SyncX86Regs == 0 {
+		return kvm.SetRegs(m.vcpus[i].Fd, regs)
+	}
+
+	m.vcpus[i].Run.SyncRegs.Regs = regs
+	m.vcpus[i].Run.DirtyRegs |= kvm.SyncX86Regs
+	m.regsSynced[i] = true
+
+	return nil
+}
+
+// Sregs returns the special registers of vCPU i, those passed to SetSregs
+// if the vCPU has not run since.
+func (m *Machine) Sregs(i int) (kvm.Sregs, error) {
+	if m.vcpus[i].Run.DirtyRegs&kvm.SyncX86Sregs != 0 {
+		return m.vcpus[i].Run.SyncRegs.Sregs, nil
+	}
+
+	return kvm.GetSregs(m.vcpus[i].Fd)
+}
+
+// SetSregs sets the special registers of vCPU i. Like SetRegs, it leaves
+// them in the run structure for KVM to load on the next entry if it can.
+func (m *Machine) SetSregs(i int, sregs kvm.Sregs) error {
+	if m.syncRegs&kvm.SyncX86Sregs == 0 {
+		return kvm.SetSregs(m.vcpus[i].Fd, sregs)
+	}
+
+	m.vcpus[i].Run.SyncRegs.Sregs = sregs
+	m.vcpus[i].Run.DirtyRegs |= kvm.SyncX86Sregs
+
+	return nil
+}
+
+func (m *Machine) initCPUID(i int) error {
+	// The CPUID is built for the first vCPU only; setCPUID adds the
+	// topology of each.
+	if m.supportedCPUID == nil {
+		cpuid := &kvm.CPUID{}
+		cpuid.Nent = 100
+
+		if err := kvm.GetSupportedCPUID(m.kvmFd, cpuid); err != nil {
+			return err
+		}
+
+		// https://www.kernel.org/doc/html/latest/virt/kvm/cpuid.html
+		for j := 0; j < int(cpuid.Nent); j++ {
+			if cpuid.Entries[j].Function == kvm.CPUIDFuncPerMon {
+				cpuid.Entries[j].Eax = 0 // disable
+			} else if cpuid.Entries[j].Function == kvm.CPUIDSignature {
+				cpuid.Entries[j].Eax = kvm.CPUIDFeatures
+				cpuid.Entries[j].Ebx = 0x4b4d564b // KVMK
+				cpuid.Entries[j].Ecx = 0x564b4d56 // VMKV
+				cpuid.Entries[j].Edx = 0x4d       // M
+			}
+
+			hideNested(&cpuid.Entries[j])
+			showKVMClock(&cpuid.Entries[j])
+		}
+
+		m.supportedCPUID = cpuid
+	}
+
+	return m.setCPUID(i)
+}
+
+// CPUID returns a copy of the CPUID entries that the vCPUs get.
+func (m *Machine) CPUID() *kvm.CPUID {
+	c := *m.supportedCPUID
+
+	return &c
+}
+
+func (m *Machine) RunInfiniteLoop(i int) error {
+	// https://www.kernel.org/doc/Documentation/virtual/kvm/api.txt
+	// - vcpu ioctls: These query and set attributes that control the operation
+	//   of a single virtual cpu.
+	//
+	//   vcpu ioctls should be issued from the same thread that was used to create
+	//   the vcpu, except for asynchronous vcpu ioctl that are marked as such in
+	//   the documentation.  Otherwise, the first ioctl after switching threads
+	//   could see a performance impact.
+	//
+	// - device ioctls: These query and set attributes that control the operation
+	//   of a single device.
+	//
+	//   device ioctls must be issued from the same process (address space) that
+	//   was used to create the VM.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	unpin, err := m.pinVCPU(i)
+	if err != nil {
+		return fmt.Errorf("vCPU %d: %w", i, err)
+	}
+
+	// The thread goes back to running anything when unlocked.
+	defer func() { _ = unpin() }()
+
+	m.runMu.Lock()
+	m.vcpuTids[i] = syscall.Gettid()
+	m.runMu.Unlock()
+
+	defer func() {
+		m.runMu.Lock()
+		m.vcpuTids[i] = 0
+		m.runCond.Broadcast()
+		m.runMu.Unlock()
+	}()
+
+	for {
+		if atomic.SwapUint32(&m.kicked[i], 0) != 0 {
+			m.vcpus[i].Run.ImmediateExit = 0
+		}
+
+		if err := m.waitToRun(i); err != nil {
+			m.vcpuStates.stop(i, err.Error())
+
+			return err
+		}
+
+		isContinue, err := m.RunOnce(i)
+		if err != nil {
+			m.vcpuStates.stop(i, err.Error())
+
+			return err
+		}
+
+		if !isContinue {
+			m.vcpuStates.stop(i, "")
+
+			return nil
+		}
+	}
+}
+
+// kickSignal is the signal that gets a vCPU out of KVM_RUN, the only one
+// that does, see New. The Go runtime uses SIGURG to preempt goroutines, so
+// it needs no handler and is otherwise ignored.
+const kickSignal = syscall.SIGURG
+
+// Kick makes vCPU i, if it is in RunInfiniteLoop, return from KVM_RUN, even
+// if it is in the guest or halted, and go round its loop, e.g. to see that
+// it is to pause.
+func (m *Machine) Kick(i int) {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	m.kick(i)
+}
+
+func (m *Machine) kick(i int) {
+	tid := m.vcpuTids[i]
+	if tid == 0 {
+		return
+	}
+
+	// immediate_exit stops a vCPU about to enter KVM_RUN and the signal one
+	// already in it. The loop clears immediate_exit once it sees kicked.
+	m.vcpus[i].Run.ImmediateExit = 1
+	atomic.StoreUint32(&m.kicked[i], 1)
+	_ = syscall.Tgkill(syscall.Getpid(), tid, kickSignal)
+}
+
+// Pause stops the vCPUs in RunInfiniteLoop, the virtual clock and the
+// kvmclock of the guest, which it tells through its pvclock pages, and
+// returns once none of them is in the guest, e.g. for a consistent
+// snapshot or to freeze the guest for an operator. Resume lets them
+// continue. Pausing a paused machine does nothing more.
+func (m *Machine) Pause() {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	paused := m.pausing
+	m.pausing = true
+
+	if !paused {
+		m.clock.Pause()
+	}
+
+	running := 0
+
+	for i, tid := range m.vcpuTids {
+		if tid == 0 {
+			continue
+		}
+
+		running++
+
+		m.kick(i)
+	}
+
+	for m.nPaused < running {
+		m.runCond.Wait()
+
+		running = 0
+
+		for _, tid := range m.vcpuTids {
+			if tid != 0 {
+				running++
+			}
+		}
+	}
+
+	if paused {
+		return
+	}
+
+	// Saved once the vCPUs are out of the guest, so that it reads no time
+	// past this.
+	c, err := kvm.GetClock(m.vmFd)
+	if err != nil {
+		m.out.Event("kvmclock_error", output.Fields{"error": err}, "pause: %v", err)
+
+		return
+	}
+
+	m.kvmClock, m.kvmClockSaved = c, true
+
+	if err := m.stopKVMClock(); err != nil {
+		m.out.Event("kvmclock_error", output.Fields{"error": err}, "pause: %v", err)
+	}
+}
+
+// Resume restarts the vCPUs stopped by Pause, with the kvmclock of the
+// guest set back to where it stood, so that the guest does not see the
+// time it was paused, as with its virtual clock. Resuming a machine that
+// is not paused does nothing.
+func (m *Machine) Resume() {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	if !m.pausing {
+		return
+	}
+
+	if m.kvmClockSaved {
+		// Only the clock is set: the TSC stability KVM reports in the
+		// flags is not for SetClock to take.
+		if err := kvm.SetClock(m.vmFd, kvm.ClockData{Clock: m.kvmClock.Clock}); err != nil {
+			m.out.Event("kvmclock_error", output.Fields{"error": err}, "resume: %v", err)
+		}
+
+		m.kvmClockSaved = false
+	}
+
+	m.pausing = false
+	m.clock.Resume()
+	m.runCond.Broadcast()
+}
+
+// KVMClock returns the kvmclock of the guest in ns.
+func (m *Machine) KVMClock() (uint64, error) {
+	c, err := kvm.GetClock(m.vmFd)
+
+	return c.Clock, err
+}
+
+// Paused tells whether the vCPUs are paused, or being paused, by Pause.
+func (m *Machine) Paused() bool {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	return m.pausing
+}
+
+// Stop makes the vCPUs in RunInfiniteLoop, and those that call it later,
+// return ErrorStopped, e.g. to shut the machine down. It does not wait for
+// them.
+func (m *Machine) Stop() {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	if m.workingSet != nil && !m.stopping {
+		close(m.workingSet.done)
+	}
+
+	m.stopping = true
+
+	for i := range m.vcpuTids {
+		m.kick(i)
+	}
+
+	m.runCond.Broadcast()
+}
+
+// waitToRun returns once vCPU i may enter the guest, or ErrorStopped.
+func (m *Machine) waitToRun(i int) error {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	if m.pausing && !m.stopping {
+		m.vcpuStates.set(i, VCPUPaused, "")
+		m.nPaused++
+		m.runCond.Broadcast()
+
+		for m.pausing && !m.stopping {
+			m.runCond.Wait()
+		}
+
+		m.nPaused--
+	}
+
+	if m.stopping {
+		return ErrorStopped
+	}
+
+	return nil
+}
+
+func (m *Machine) RunOnce(i int) (bool, error) {
+	// A KVM_RUN cut short by immediate_exit leaves the exit reason of the
+	// previous exit, which must not be handled twice.
+	m.vcpus[i].Run.ExitReason = uint32(kvm.EXITINTR)
+
+	m.vcpuStates.set(i, VCPURunning, "")
+
+	err := kvm.Run(m.vcpus[i].Fd)
+	if err == nil && m.syncRegs&kvm.SyncX86Regs != 0 {
+		m.regsSynced[i] = true
+	}
+
+	exit := kvm.ExitType(m.vcpus[i].Run.ExitReason)
+	m.vcpuStates.exit(i, exit)
+
+	// A bus lock comes with an exit of its own or along with another.
+	if exit == kvm.EXITX86BUSLOCK || m.vcpus[i].Run.Flags&kvm.RunX86BusLock != 0 {
+		if err := m.busLock(i); err != nil {
+			return false, err
+		}
+	}
+
+	switch exit {
+	case kvm.EXITHLT:
+		m.out.Event("vcpu_halt", output.Fields{"cpu": i}, "KVM_EXIT_HLT")
+		m.vcpuStates.set(i, VCPUHalted, "")
+
+		return false, err
+	case kvm.EXITIO:
+		direction, size, port, count, offset := m.vcpus[i].Run.IO()
+		f := m.ioportHandlers[port][direction]
+
+		m.vcpuStates.set(i, VCPUBlockedOnDevice, fmt.Sprintf("port %#x", port))
+
+		// A string instruction, e.g. rep insb as firmware reads fw_cfg
+		// with, moves count values, one after the other in the run data.
+		for j := uint64(0); j < count; j++ {
+			if err := f(port, m.vcpus[i].Data(offset+j*size, size)); err != nil {
+				return false, err
+			}
+		}
+
+		return true, err
+	case kvm.EXITMMIO:
+		physAddr, data, _, isWrite := m.vcpus[i].Run.MMIO()
+
+		for _, h := range m.mmioHandlers {
+			if physAddr < h.start || physAddr >= h.end {
+				continue
+			}
+
+			f := h.in
+			if isWrite {
+				f = h.out
+			}
+
+			m.vcpuStates.set(i, VCPUBlockedOnDevice, fmt.Sprintf("MMIO at %#x", physAddr))
+
+			if err := f(physAddr, data); err != nil {
+				return false, err
+			}
+
+			return true, err
+		}
+
+		return false, fmt.Errorf("%w: unexpected mmio at %#x", kvm.ErrUnexpectedEXITReason, physAddr)
+	case kvm.EXITX86RDMSR, kvm.EXITX86WRMSR:
+		m.handleMSR(m.vcpus[i].Run, exit == kvm.EXITX86WRMSR)
+
+		return true, err
+	case kvm.EXITUNKNOWN, kvm.EXITX86BUSLOCK:
+		return true, err
+	case kvm.EXITSYSTEMEVENT:
+		typ, flags := m.vcpus[i].Run.SystemEvent()
+
+		switch typ {
+		case kvm.SystemEventShutdown:
+			return false, err
+		case kvm.SystemEventReset:
+			return false, ErrorGuestReset
+		case kvm.SystemEventCrash:
+			return false, fmt.Errorf("%w: flags %#x", ErrorGuestCrash, flags)
+		default:
+			return false, fmt.Errorf("%w: system event %d", kvm.ErrUnexpectedEXITReason, typ)
+		}
+	case kvm.EXITMEMORYFAULT:
+		// KVM_RUN fails with EFAULT for an access to memory that is not
+		// private or shared as the guest expects, which is fine once
+		// converted.
+		if m.gmem == nil {
+			return false, fmt.Errorf("%w: %s: %v", kvm.ErrUnexpectedEXITReason, exit.String(), err)
+		}
+
+		flags, gpa, size := m.vcpus[i].Run.MemoryFault()
+
+		return true, m.convertMemory(gpa, size, flags&kvm.MemoryAttributePrivate != 0)
+	case kvm.EXITHYPERCALL:
+		if err := m.handleHypercall(m.vcpus[i].Run); err != nil {
+			return false, err
+		}
+
+		return true, err
+	case kvm.EXITSHUTDOWN:
+		return false, ErrorTripleFault
+	case kvm.EXITINTR:
+		// When a signal is sent to the thread hosting the VM it will result in EINTR
+		// refs https://gist.github.com/mcastelino/df7e65ade874f6890f618dc51778d83a
+		return true, nil
+	case kvm.EXITDCR,
+		kvm.EXITDEBUG,
+		kvm.EXITEXCEPTION,
+		kvm.EXITFAILENTRY,
+		kvm.EXITINTERNALERROR,
+		kvm.EXITIRQWINDOWOPEN,
+		kvm.EXITNMI,
+		kvm.EXITS390RESET,
+		kvm.EXITS390SIEIC,
+		kvm.EXITSETTPR,
+		kvm.EXITTPRACCESS,
+		kvm.EXITAPRESETHOLD,
+		kvm.EXITARMNISV,
+		kvm.EXITDIRTYRINGFULL,
+		kvm.EXITEPR,
+		kvm.EXITHYPERV,
+		kvm.EXITIOAPICEOI,
+		kvm.EXITLOONGARCHIOCSR,
+		kvm.EXITNOTIFY,
+		kvm.EXITOSI,
+		kvm.EXITPAPRHCALL,
+		kvm.EXITRISCVCSR,
+		kvm.EXITRISCVSBI,
+		kvm.EXITS390STSI,
+		kvm.EXITS390TSCH,
+		kvm.EXITS390UCONTROL,
+		kvm.EXITWATCHDOG,
+		kvm.EXITTDX,
+		kvm.EXITXEN:
+		if err != nil {
+			return false, err
+		}
+
+		return false, fmt.Errorf("%w: %s", kvm.ErrUnexpectedEXITReason, exit.String())
+	default:
+		if err != nil {
+			return false, err
+		}
+
+		return false, fmt.Errorf("%w: %s", kvm.ErrUnexpectedEXITReason, exit.String())
+	}
+}
+
+// AddChipset adds the registers of a chipset profile in PCI configuration
+// space, I/O ports and MMIO, with accesses logged to log unless it is nil.
+// As with AddIODevice, the kernel or ROM must be loaded first.
+func (m *Machine) AddChipset(p *chipset.Profile, log io.Writer) error {
+	for _, r := range p.PCI {
+		bus, device, function, err := chipset.ParseBDF(r.BDF)
+		if err != nil {
+			return err
+		}
+
+		s, err := chipset.NewSpace(r, log)
+		if err != nil {
+			return err
+		}
+
+		m.pci.ConfigSpaces[pci.BDF(bus, device, function)] = s
+	}
+
+	for _, r := range p.IO {
+		s, err := chipset.NewIOSpace(r, log)
+		if err != nil {
+			return err
+		}
+
+		base := uint64(r.Base)
+		m.registerIOPortHandler(base, base+uint64(r.Size),
+			func(port uint64, bytes []byte) error { return s.Read(port-base, bytes) },
+			func(port uint64, bytes []byte) error { return s.Write(port-base, bytes) },
+		)
+	}
+
+	for _, r := range p.MMIO {
+		s, err := chipset.NewSpace(r, log)
+		if err != nil {
+			return err
+		}
+
+		base := uint64(r.Base)
+		m.registerMMIOHandler(base, base+uint64(r.Size),
+			func(addr uint64, bytes []byte) error { return s.Read(addr-base, bytes) },
+			func(addr uint64, bytes []byte) error { return s.Write(addr-base, bytes) },
+		)
+	}
+
+	return nil
+}
+
+// IODevice is a device on a fixed set of I/O ports, such as the stand-ins
+// of package stub.
+type IODevice interface {
+	Ports() []uint64
+	In(port uint64, bytes []byte) error
+	Out(port uint64, bytes []byte) error
+}
+
+// AddIODevice routes the ports of d to it. The kernel or ROM must be
+// loaded first, as that resets the I/O port handlers.
+func (m *Machine) AddIODevice(d IODevice) {
+	for _, port := range d.Ports() {
+		m.registerIOPortHandler(port, port+1, d.In, d.Out)
+	}
+}
+
+// AddSerialPort adds a virtio-serial port named name, which the guest finds
+// as /dev/virtio-ports/<name>, bridged to the Unix socket path that gokvm
+// listens on for one connection at a time. The first port adds the
+// virtio-serial PCI device. As with AddIODevice, the kernel or ROM must be
+// loaded first.
+func (m *Machine) AddSerialPort(name, path string) error {
+	if m.console == nil {
+		m.console = virtio.NewConsole(virtioConsoleIRQ, m, m.mem)
+		m.console.Runner = m.workerQueue(worker.Console)
+		go m.console.IOThreadEntry()
+
+		m.addPCIDevice("console", m.console)
+		m.OnShutdown(ShutdownQuiesce, "console", m.console.Close)
+		start, end := m.console.GetIORange()
+		m.registerIOPortHandler(start, end, m.console.IOInHandler, m.console.IOOutHandler)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	id, err := m.console.AddPort(name)
+	if err != nil {
+		l.Close()
+
+		return err
+	}
+
+	m.OnShutdown(ShutdownQuiesce, "serial port "+name, l.Close)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				m.out.Event("serial_port_error", output.Fields{"port": name, "error": err}, "serial port %s: %v", name, err)
+
+				return
+			}
+
+			if err := m.console.Connect(id, c); err != nil {
+				m.out.Event("serial_port_error", output.Fields{"port": name, "error": err}, "serial port %s: %v", name, err)
+			}
+
+			c.Close()
+		}
+	}()
+
+	return nil
+}
+
+func (m *Machine) registerIOPortHandler(
+	start, end uint64,
+	inHandler, outHandler func(port uint64, bytes []byte) error,
+) {
+	for i := start; i < end; i++ {
+		m.ioportHandlers[i][kvm.EXITIOIN] = inHandler
+		m.ioportHandlers[i][kvm.EXITIOOUT] = outHandler
+	}
+}
+
+func (m *Machine) registerMMIOHandler(
+	start, end uint64,
+	inHandler, outHandler func(addr uint64, bytes []byte) error,
+) {
+	m.mmioHandlers = append(m.mmioHandlers, mmioHandler{
+		start: start, end: end,
+		in: inHandler, out: outHandler,
+	})
+}
+
+// RegisterMSRHandler emulates the MSR index in userspace: rdmsr returns the
+// value for RDMSR and wrmsr takes the value of WRMSR. A nil function or a
+// non-nil error injects a #GP into the guest. Up to 16 MSRs can be handled.
+// It may be called while the vCPUs run.
+func (m *Machine) RegisterMSRHandler(
+	index uint32,
+	rdmsr func(index uint32) (uint64, error),
+	wrmsr func(index uint32, value uint64) error,
+) error {
+	m.msrMu.Lock()
+	defer m.msrMu.Unlock()
+
+	if m.msrHandlers == nil {
+		if err := kvm.EnableCap(m.vmFd, &kvm.EnableCapability{
+			Cap:  kvm.CapX86UserSpaceMSR,
+			Args: [4]uint64{kvm.MSRExitReasonFilter},
+		}); err != nil {
+			return fmt.Errorf("enable userspace MSR: %w", err)
+		}
+
+		m.msrHandlers = map[uint32]msrHandler{}
+	}
+
+	if _, ok := m.msrHandlers[index]; !ok && len(m.msrHandlers) == len(kvm.MSRFilter{}.Ranges) {
+		return fmt.Errorf("%w: %#x", ErrorTooManyMSRHandlers, index)
+	}
+
+	m.msrHandlers[index] = msrHandler{rdmsr: rdmsr, wrmsr: wrmsr}
+
+	// Every handled MSR gets a range of its own with a cleared bit, so that
+	// kvm denies it and exits to userspace. All others are allowed.
+	// The bitmap is in the Machine rather than on the stack, which may move
+	// before kvm reads it through the uintptr.
+	filter := kvm.MSRFilter{Flags: kvm.MSRFilterDefaultAllow}
+	i := 0
+
+	for index := range m.msrHandlers {
+		filter.Ranges[i] = kvm.MSRFilterRange{
+			Flags:  kvm.MSRFilterRead | kvm.MSRFilterWrite,
+			NMSRs:  1,
+			Base:   index,
+			Bitmap: uint64(uintptr(unsafe.Pointer(&m.msrDeny[0]))),
+		}
+		i++
+	}
+
+	return kvm.SetMSRFilter(m.vmFd, &filter)
+}
+
+// SetPMUEventFilter restricts the performance events the guest can program
+// to events with kvm.PMUEventAllow, or to all others with kvm.PMUEventDeny.
+// The fixed counters stay the guest's either way, so an empty allow list
+// leaves it only them.
+func (m *Machine) SetPMUEventFilter(action uint32, events []uint64) error {
+	filter := kvm.PMUEventFilter{Action: action, NEvents: uint32(len(events))}
+
+	// KVM denies the fixed counters that an allow list does not set.
+	if action == kvm.PMUEventAllow {
+		filter.FixedCounterBitmap = ^uint32(0)
+	}
+
+	if len(events) > len(filter.Events) {
+		return fmt.Errorf("%w: %d", ErrorTooManyPMUEvents, len(events))
+	}
+
+	copy(filter.Events[:], events)
+
+	return kvm.SetPMUEventFilter(m.vmFd, &filter)
+}
+
+func (m *Machine) handleMSR(run *kvm.RunData, isWrite bool) {
+	index, data, _ := run.MSR()
+
+	m.msrMu.Lock()
+	h := m.msrHandlers[index]
+	m.msrMu.Unlock()
+
+	if isWrite {
+		if h.wrmsr == nil || h.wrmsr(index, data) != nil {
+			run.SetMSRResult(0, true)
+
+			return
+		}
+
+		run.SetMSRResult(data, false)
+
+		return
+	}
+
+	if h.rdmsr == nil {
+		run.SetMSRResult(0, true)
+
+		return
+	}
+
+	value, err := h.rdmsr(index)
+	run.SetMSRResult(value, err != nil)
+}
+
+// unexpectedIOPort handles the I/O ports without a device.
+func unexpectedIOPort(port uint64, bytes []byte) error {
+	return fmt.Errorf("%w: unexpected io port 0x%x", kvm.ErrUnexpectedEXITReason, port)
+}
+
+func (m *Machine) initIOPortHandlers() {
+	funcNone := func(port uint64, bytes []byte) error {
+		return nil
+	}
+
+	funcError := unexpectedIOPort
+
+	// 0xCF9 port can get three values for three types of reset:
+	//
+	// Writing 4 to 0xCF9:(INIT) Will INIT the CPU. Meaning it will jump
+	// to the initial location of booting but it will keep many CPU
 	// elements untouched. Most internal tables, chaches etc will remain
 	// unchanged by the Init call (but may change during it).
 	//
@@ -469,36 +1954,28 @@ func (m *Machine) initIOPortHandlers() {
 	//
 	// Writing 0xE to 0xCF9:(RESTART) Will power cycle the mother board
 	// with everything that comes with it.
-	// For now, we will exit without regard to the value. Should we wish
-	// to have more sophisticated cf9 handling, we will need to modify
-	// gokvm a bit more.
+	// All of them reset the machine alike. Values without bit 2, e.g. 2,
+	// only select the type of the next reset.
 	funcOutbCF9 := func(port uint64, bytes []byte) error {
-		if len(bytes) == 1 && bytes[0] == 0xe {
-			return fmt.Errorf("write 0xe to cf9: %w", ErrorWriteToCF9)
+		if bytes[0]&0x4 == 0 {
+			return nil
 		}
 
-		return fmt.Errorf("write %#x to cf9: %w", bytes, ErrorWriteToCF9)
+		return fmt.Errorf("write %#x to cf9: %w", bytes[0], ErrorWriteToCF9)
 	}
 
-	// In ubuntu 20.04 on wsl2, the output to IO port 0x64 continued
-	// infinitely. To deal with this issue, refer to kvmtool and
-	// configure the input to the Status Register of the PS2 controller.
-	//
-	// refs:
-	// https://github.com/kvmtool/kvmtool/blob/0e1882a49f81cb15d328ef83a78849c0ea26eecc/hw/i8042.c#L312
-	// https://git.kernel.org/pub/scm/linux/kernel/git/will/kvmtool.git/tree/hw/i8042.c#n312
-	// https://wiki.osdev.org/%228042%22_PS/2_Controller
-	funcInbPS2 := func(port uint64, bytes []byte) error {
-		bytes[0] = 0x20
-
-		return nil
+	// The RTC keeps its time across a reset.
+	if m.cmos == nil {
+		m.cmos = newCMOS(uint64(len(m.mem)), len(m.vcpus), m.clock, m.rtcIRQ)
+	} else {
+		m.cmos.reset()
 	}
 
 	m.registerIOPortHandler(0, 0x10000, funcError, funcError)    // default handler
 	m.registerIOPortHandler(0xcf9, 0xcfa, funcNone, funcOutbCF9) // CF9
 	m.registerIOPortHandler(0x3c0, 0x3db, funcNone, funcNone)    // VGA
 	m.registerIOPortHandler(0x3b4, 0x3b6, funcNone, funcNone)    // VGA
-	m.registerIOPortHandler(0x70, 0x72, funcNone, funcNone)      // CMOS clock
+	m.registerIOPortHandler(0x70, 0x72, m.cmos.In, m.cmos.Out)   // CMOS clock and memory size
 	m.registerIOPortHandler(0x80, 0xa0, funcNone, funcNone)      // DMA Page Registers (Commonly 74L612 Chip)
 	m.registerIOPortHandler(0x2f8, 0x300, funcNone, funcNone)    // Serial port 2
 	m.registerIOPortHandler(0x3e8, 0x3f0, funcNone, funcNone)    // Serial port 3
@@ -506,11 +1983,21 @@ func (m *Machine) initIOPortHandlers() {
 	m.registerIOPortHandler(0xcfe, 0xcff, funcNone, funcNone)    // unknown
 	m.registerIOPortHandler(0xcfa, 0xcfc, funcNone, funcNone)    // unknown
 	m.registerIOPortHandler(0xc000, 0xd000, funcNone, funcNone)  // PCI Configuration Space Access Mechanism #2
-	m.registerIOPortHandler(0x60, 0x70, funcInbPS2, funcNone)    // PS/2 Keyboard (Always 8042 Chip)
+	m.registerIOPortHandler(0x60, 0x70, funcNone, funcNone)      // PS/2 Keyboard (Always 8042 Chip)
 	m.registerIOPortHandler(0xed, 0xee, funcNone, funcNone)      // 0xed is the new standard delay port.
 
+	exitStart, exitEnd := m.debugExitPorts()
+	m.registerIOPortHandler(exitStart, exitEnd, funcNone, m.debugExitOut)
+	m.registerIOPortHandler(DebugPort, DebugPort+1, funcNone, m.debugOut)
+	m.registerIOPortHandler(DebugconPort, DebugconPort+1, m.debugconIn, m.debugconOut)
+	m.kbd.reset()
+	m.registerIOPortHandler(kbdDataPort, kbdDataPort+1, m.kbd.In, m.kbd.Out)
+	m.registerIOPortHandler(kbdCommandPort, kbdCommandPort+1, m.kbd.In, m.kbd.Out)
+	m.registerIOPortHandler(acpiSleepControlPort, acpiSleepStatusPort+1, acpiSleepIn, acpiSleepOut)
+
 	// Serial port 1
 	m.registerIOPortHandler(serial.COM1Addr, serial.COM1Addr+8, m.serial.In, m.serial.Out)
+	m.registerUARTs()
 
 	// PCI configuration
 	//
@@ -520,8 +2007,16 @@ func (m *Machine) initIOPortHandlers() {
 	m.registerIOPortHandler(0xcf8, 0xcf9, m.pci.PciConfAddrIn, m.pci.PciConfAddrOut)
 	m.registerIOPortHandler(0xcfc, 0xd00, m.pci.PciConfDataIn, m.pci.PciConfDataOut)
 
-	// PCI devices
+	if m.hotplug != nil {
+		m.AddIODevice(m.hotplug)
+	}
+
+	// PCI devices, but those the guest ejected
 	for i, device := range m.pci.Devices {
+		if device == nil {
+			continue
+		}
+
 		start, end := device.GetIORange()
 		m.registerIOPortHandler(
 			start, end,
@@ -530,24 +2025,44 @@ func (m *Machine) initIOPortHandlers() {
 	}
 }
 
+// rtcIRQ sets the level of the interrupt of the RTC.
+func (m *Machine) rtcIRQ(level uint32) {
+	if err := kvm.IRQLine(m.vmFd, rtcIRQ, level); err != nil {
+		m.out.Event("rtc_error", output.Fields{"error": err}, "RTC interrupt: %v", err)
+	}
+}
+
+// kbdIRQ sets the level of the interrupt of the keyboard controller.
+func (m *Machine) kbdIRQ(level uint32) {
+	if err := kvm.IRQLine(m.vmFd, kbdIRQ, level); err != nil {
+		m.out.Event("kbd_error", output.Fields{"error": err}, "keyboard interrupt: %v", err)
+	}
+}
+
+// InjectSerialIRQ tells the UART that bytes were sent to the channel of
+// GetInputChan, for it to interrupt the guest if it asked to.
 func (m *Machine) InjectSerialIRQ() error {
-	if err := kvm.IRQLine(m.vmFd, serialIRQ, 0); err != nil {
+	return m.serial.Receive()
+}
+
+func (m *Machine) InjectVirtioNetIRQ() error {
+	if err := kvm.IRQLine(m.vmFd, virtioNetIRQ, 0); err != nil {
 		return err
 	}
 
-	if err := kvm.IRQLine(m.vmFd, serialIRQ, 1); err != nil {
+	if err := kvm.IRQLine(m.vmFd, virtioNetIRQ, 1); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (m *Machine) InjectVirtioNetIRQ() error {
-	if err := kvm.IRQLine(m.vmFd, virtioNetIRQ, 0); err != nil {
+func (m *Machine) InjectVirtioConsoleIRQ() error {
+	if err := kvm.IRQLine(m.vmFd, virtioConsoleIRQ, 0); err != nil {
 		return err
 	}
 
-	if err := kvm.IRQLine(m.vmFd, virtioNetIRQ, 1); err != nil {
+	if err := kvm.IRQLine(m.vmFd, virtioConsoleIRQ, 1); err != nil {
 		return err
 	}
 
@@ -1,14 +1,44 @@
 package machine_test
 
 import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/bobuhiro11/gokvm/flash"
+	"github.com/bobuhiro11/gokvm/fwcfg"
+	"github.com/bobuhiro11/gokvm/idle"
+	"github.com/bobuhiro11/gokvm/kvm"
 	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/memslot"
+	"github.com/bobuhiro11/gokvm/numa"
+	"github.com/bobuhiro11/gokvm/output"
+	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/sandbox"
+	"github.com/bobuhiro11/gokvm/snapshot"
+	"github.com/bobuhiro11/gokvm/stub"
+	"github.com/bobuhiro11/gokvm/virtio"
 )
 
+func TestMain(m *testing.M) {
+	// The sandbox helpers of SandboxBlk are the test binary.
+	sandbox.RunHelper()
+
+	os.Exit(m.Run())
+}
+
 func TestNewAndLoadLinux(t *testing.T) { // nolint:paralleltest
 	if os.Getuid() != 0 {
 		t.Skipf("Skipping test since we are not root")
@@ -80,3 +110,2827 @@ func TestNewAndLoadLinux(t *testing.T) { // nolint:paralleltest
 		t.Fatal(string(output))
 	}
 }
+
+func TestLoadROM(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadROM(make([]byte, 100)); !errors.Is(err, machine.ErrorROMSize) {
+		t.Fatalf("LoadROM with odd size: got %v, want %v", err, machine.ErrorROMSize)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode:
+	//   cs mov byte [0xf000], 1 ; write to the read-only ROM
+	//   mov al, 0x42
+	//   out 0x80, al            ; POST code
+	//   mov al, 7
+	//   out 0xf4, al            ; exit
+	//
+	// hlt would not return with the in-kernel irqchip.
+	copy(rom[0xff0:], []byte{
+		0x2e, 0xc6, 0x06, 0x00, 0xf0, 0x01, 0xb0, 0x42, 0xe6, 0x80, 0xb0, 0x07, 0xe6, 0xf4,
+	})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.ExitCode() != 7 {
+		t.Fatalf("ExitCode: got %d, want 7", m.ExitCode())
+	}
+}
+
+func TestRegisterMSRHandler(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const index = 0x1234
+
+	value := uint64(0)
+
+	if err := m.RegisterMSRHandler(index,
+		func(uint32) (uint64, error) { return value + 1, nil },
+		func(_ uint32, v uint64) error { value = v; return nil },
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the start of the ROM, in real mode:
+	//   mov ecx, 0x1234
+	//   mov eax, 0x2a
+	//   xor edx, edx
+	//   wrmsr
+	//   rdmsr
+	//   out 0xf4, al    ; exit
+	copy(rom, []byte{
+		0x66, 0xb9, 0x34, 0x12, 0x00, 0x00, 0x66, 0xb8, 0x2a, 0x00, 0x00, 0x00,
+		0x66, 0x31, 0xd2, 0x0f, 0x30, 0x0f, 0x32, 0xe6, 0xf4,
+	})
+
+	// At the reset vector: jmp 0xf000
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xf0})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if value != 0x2a {
+		t.Errorf("wrmsr: got %#x, want 0x2a", value)
+	}
+
+	if m.ExitCode() != 0x2b {
+		t.Errorf("ExitCode: got %#x, want 0x2b", m.ExitCode())
+	}
+}
+
+func TestAddIODevice(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, write 0x43 to 0x20 in the EC RAM:
+	//   mov al, 0x81
+	//   out 0x66, al
+	//   mov al, 0x20
+	//   out 0x62, al
+	//   mov al, 0x43
+	//   out 0x62, al
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{
+		0xb0, 0x81, 0xe6, 0x66, 0xb0, 0x20, 0xe6, 0x62, 0xb0, 0x43, 0xe6, 0x62, 0xe6, 0xf4,
+	})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	ec := stub.NewEC(nil)
+	m.AddIODevice(ec)
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if v := ec.Get(0x20); v != 0x43 {
+		t.Fatalf("EC RAM: got %#x, want 0x43", v)
+	}
+}
+
+func TestStats(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, write to the delay port three
+	// times:
+	//   out 0xed, al
+	//   out 0xed, al
+	//   out 0xed, al
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{0xe6, 0xed, 0xe6, 0xed, 0xe6, 0xed, 0xe6, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	stats, err := m.VCPUStats(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three outs to the delay port and one to the exit port
+	if stats["exits"] < 4 {
+		t.Errorf("exits: got %d, want at least 4", stats["exits"])
+	}
+
+	if _, err := m.VMStats(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddSerialPort(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, exit with max_nr_ports of the
+	// virtio-serial device:
+	//   mov dx, 0x6518
+	//   in al, dx
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{0xba, 0x18, 0x65, 0xec, 0xe6, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "port.sock")
+	if err := m.AddSerialPort("org.test.0", path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddSerialPort("org.test.1", path); err == nil {
+		t.Fatal("AddSerialPort: got nil for a socket in use, want error")
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.ExitCode() != virtio.ConsoleMaxPorts {
+		t.Fatalf("ExitCode: got %d, want %d", m.ExitCode(), virtio.ConsoleMaxPorts)
+	}
+}
+
+func TestIOMMU(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	disk, err := os.CreateTemp(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disk.Close()
+
+	m, err := machine.New("/dev/kvm", 1, "", disk.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.OverridePCIIDs("iommu", pci.IDs{}); !errors.Is(err, machine.ErrorNoPCIDevice) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorNoPCIDevice)
+	}
+
+	m.AddIOMMU()
+
+	if err := m.OverridePCIIDs("iommu", pci.IDs{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverridePCIIDs(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, exit with the low byte of the
+	// subsystem ID of 00:00.0:
+	//   mov eax, 0x8000002c
+	//   mov dx, 0xcf8
+	//   out dx, eax
+	//   mov dl, 0xfe
+	//   in al, dx
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{
+		0x66, 0xb8, 0x2c, 0x00, 0x00, 0x80, 0xba, 0xf8, 0x0c, 0x66, 0xef, 0xb2, 0xfe, 0xec, 0xe6, 0xf4,
+	})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.OverridePCIIDs("console", pci.IDs{SubsystemID: 0x42}); !errors.Is(err, machine.ErrorNoPCIDevice) {
+		t.Fatalf("OverridePCIIDs: got %v, want %v", err, machine.ErrorNoPCIDevice)
+	}
+
+	if err := m.OverridePCIIDs("bridge", pci.IDs{SubsystemID: 0x42}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.ExitCode() != 0x42 {
+		t.Fatalf("ExitCode: got %#x, want 0x42", m.ExitCode())
+	}
+}
+
+func TestUnplugPCIDevice(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	disk := filepath.Join(t.TempDir(), "disk")
+	if err := os.WriteFile(disk, make([]byte, 0x1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.UnplugPCIDevice("blk"); !errors.Is(err, machine.ErrorNoHotplug) {
+		t.Fatalf("UnplugPCIDevice without ACPI: got %v, want %v", err, machine.ErrorNoHotplug)
+	}
+
+	m.EnableACPI()
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, eject slot 1, that of blk, and
+	// read its first I/O port, which is gone:
+	//   mov ax, 0x2
+	//   mov dx, 0xae08
+	//   out dx, ax
+	//   mov dx, 0x6300
+	//   in al, dx
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{
+		0xb8, 0x02, 0x00, 0xba, 0x08, 0xae, 0xef, 0xba, 0x00, 0x63, 0xec, 0xe6, 0xf4,
+	})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.UnplugPCIDevice("net"); !errors.Is(err, machine.ErrorNoPCIDevice) {
+		t.Fatalf("UnplugPCIDevice: got %v, want %v", err, machine.ErrorNoPCIDevice)
+	}
+
+	if err := m.UnplugPCIDevice("blk"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, kvm.ErrUnexpectedEXITReason) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, kvm.ErrUnexpectedEXITReason)
+	}
+}
+
+func TestPlugPCIDevice(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	disk := filepath.Join(t.TempDir(), "disk")
+	if err := os.WriteFile(disk, make([]byte, 0x1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.PlugPCIDevice("blk"); !errors.Is(err, machine.ErrorNoHotplug) {
+		t.Fatalf("PlugPCIDevice without ACPI: got %v, want %v", err, machine.ErrorNoHotplug)
+	}
+
+	m.EnableACPI()
+
+	rom := make([]byte, 0x1000)
+
+	// At the start of the ROM, in real mode, eject slot 1, that of blk,
+	// wait for it to come up again and read its first I/O port:
+	//   mov ax, 0x2
+	//   mov dx, 0xae08
+	//   out dx, ax
+	//   mov dx, 0xae00
+	// wait:
+	//   in ax, dx
+	//   test al, 0x2
+	//   jz wait
+	//   mov dx, 0x6300
+	//   in al, dx
+	//   mov al, 0x42
+	//   out 0xf4, al ; exit
+	copy(rom, []byte{
+		0xb8, 0x02, 0x00, 0xba, 0x08, 0xae, 0xef, 0xba, 0x00, 0xae,
+		0xed, 0xa8, 0x02, 0x74, 0xfb,
+		0xba, 0x00, 0x63, 0xec, 0xb0, 0x42, 0xe6, 0xf4,
+	})
+
+	// At the reset vector: jmp 0xf000
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xf0})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.PlugPCIDevice("blk"); !errors.Is(err, machine.ErrorPCIDevicePlugged) {
+		t.Fatalf("PlugPCIDevice before the eject: got %v, want %v", err, machine.ErrorPCIDevicePlugged)
+	}
+
+	if err := m.UnplugPCIDevice("blk"); err != nil {
+		t.Fatal(err)
+	}
+
+	plugged := make(chan error, 1)
+
+	go func() {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			if err := m.PlugPCIDevice("blk"); !errors.Is(err, machine.ErrorPCIDevicePlugged) {
+				plugged <- err
+
+				return
+			}
+		}
+
+		plugged <- machine.ErrorPCIDevicePlugged
+	}()
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if err := <-plugged; err != nil {
+		t.Fatalf("PlugPCIDevice: %v", err)
+	}
+
+	if m.ExitCode() != 0x42 {
+		t.Fatalf("ExitCode: got %#x, want 0x42", m.ExitCode())
+	}
+}
+
+func TestAddEPC(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddEPC("/dev/sgx_vepc", 0x1800); !errors.Is(err, machine.ErrorEPCSize) {
+		t.Fatalf("AddEPC: got %v, want %v", err, machine.ErrorEPCSize)
+	}
+
+	if _, err := os.Stat("/dev/sgx_vepc"); err != nil {
+		if err := m.AddEPC("/dev/sgx_vepc", 1<<20); err == nil {
+			t.Fatal("AddEPC: got nil without /dev/sgx_vepc")
+		}
+
+		t.Skipf("Skipping test since there is no /dev/sgx_vepc: %v", err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, exit with the upper half of the
+	// base of the first EPC section:
+	//   mov ax, 0x12
+	//   mov cl, 2
+	//   cpuid
+	//   mov al, bl
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{0xb8, 0x12, 0x00, 0xb1, 0x02, 0x0f, 0xa2, 0x88, 0xd8, 0xe6, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddEPC("/dev/sgx_vepc", 1<<20); errors.Is(err, machine.ErrorNoSGX) {
+		t.Skipf("Skipping test since %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.ExitCode() != 1 {
+		t.Fatalf("ExitCode: got %d, want 1 for an EPC at 4GiB", m.ExitCode())
+	}
+}
+
+func TestEnableNested(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, exit with VMX of CPUID function 1:
+	//   mov ax, 1
+	//   cpuid
+	//   mov al, cl
+	//   and al, 0x20
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{0xb8, 0x01, 0x00, 0x0f, 0xa2, 0x88, 0xc8, 0x24, 0x20, 0xe6, 0xf4})
+
+	for _, nested := range []bool{false, true} {
+		m, err := machine.New("/dev/kvm", 1, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.LoadROM(rom); err != nil {
+			t.Fatal(err)
+		}
+
+		if nested {
+			if err := m.EnableNested(); errors.Is(err, machine.ErrorNoNested) {
+				t.Skipf("Skipping test since %v", err)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+			t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+		}
+
+		// VMX is hidden unless enabled. An AMD host, which has SVM
+		// instead, exits with 0 either way.
+		if !nested && m.ExitCode() != 0 {
+			t.Fatalf("VMX without EnableNested: got %#x, want 0", m.ExitCode())
+		}
+	}
+}
+
+func TestLaunchSEV(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.LaunchSEV(0); !errors.Is(err, machine.ErrorNoSEV) {
+		t.Fatalf("LaunchSEV: got %v, want %v", err, machine.ErrorNoSEV)
+	}
+
+	if _, err := os.Stat("/dev/sev"); err != nil {
+		t.Skipf("Skipping test since there is no /dev/sev: %v", err)
+	}
+
+	m, err = machine.NewSEV("/dev/kvm", 1, "", "", "/dev/sev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadROM(make([]byte, 0x1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if measurement, err := m.LaunchSEV(0); err != nil || len(measurement) != 48 {
+		t.Fatalf("LaunchSEV: got %x, %v", measurement, err)
+	}
+}
+
+func TestLaunchSNP(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.NewSEV("/dev/kvm", 1, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LaunchSNP(0x30000); !errors.Is(err, machine.ErrorNoSNP) {
+		t.Fatalf("LaunchSNP: got %v, want %v", err, machine.ErrorNoSNP)
+	}
+
+	if _, err := os.Stat("/dev/sev"); err != nil {
+		t.Skipf("Skipping test since there is no /dev/sev: %v", err)
+	}
+
+	m, err = machine.NewSNP("/dev/kvm", 1, "", "", "/dev/sev")
+	if err != nil {
+		t.Skipf("Skipping test since SEV-SNP is not available: %v", err)
+	}
+
+	// RAM has the EBDA to copy into the guest context.
+	if err := m.LaunchSNP(0x30000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddFlash(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode:
+	//   cs mov byte [0xe055], 0x98 ; CFI query to the flash at 0xffffe000
+	//   cs mov al, [0xe010]        ; 'Q'
+	//   out 0xf4, al               ; exit
+	copy(rom[0xff0:], []byte{
+		0x2e, 0xc6, 0x06, 0x55, 0xe0, 0x98, 0x2e, 0xa0, 0x10, 0xe0, 0xe6, 0xf4,
+	})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "flash.img")
+	if err := os.WriteFile(path, make([]byte, 0x1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := flash.New(path, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddFlash(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.ExitCode() != 'Q' {
+		t.Fatalf("ExitCode: got %#x, want 'Q'", m.ExitCode())
+	}
+}
+
+// gate is an I/O port that reads as 0 until it is opened.
+type gate struct {
+	reads, open int32
+}
+
+func (g *gate) Ports() []uint64 {
+	return []uint64{0x50}
+}
+
+func (g *gate) In(port uint64, bytes []byte) error {
+	atomic.AddInt32(&g.reads, 1)
+	bytes[0] = byte(atomic.LoadInt32(&g.open))
+
+	return nil
+}
+
+func (g *gate) Out(port uint64, bytes []byte) error {
+	return nil
+}
+
+func TestSaveMemoryLive(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the start of the ROM, in real mode, count in two pages until the
+	// gate opens:
+	//   loop:
+	//   inc dword [0x5000]
+	//   mov eax, [0x5000]
+	//   mov [0x6000], eax
+	//   in al, 0x50
+	//   test al, al
+	//   jz loop
+	//   out 0xf4, al ; exit
+	copy(rom, []byte{
+		0x66, 0xff, 0x06, 0x00, 0x50, 0x66, 0xa1, 0x00, 0x50, 0x66, 0xa3, 0x00, 0x60,
+		0xe4, 0x50, 0x84, 0xc0, 0x74, 0xed, 0xe6, 0xf4,
+	})
+
+	// At the reset vector: jmp 0xf000
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xf0})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &gate{}
+	m.AddIODevice(g)
+
+	errc := make(chan error)
+
+	go func() { errc <- m.RunInfiniteLoop(0) }()
+
+	for atomic.LoadInt32(&g.reads) < 1000 {
+		time.Sleep(time.Millisecond)
+	}
+
+	buf := bytes.Buffer{}
+
+	if _, err := m.SaveMemoryLive(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+
+	reads := atomic.LoadInt32(&g.reads)
+	atomic.StoreInt32(&g.open, 1)
+
+	if err := <-errc; !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if reads < 1000 {
+		t.Fatalf("gate reads: got %d, want at least 1000", reads)
+	}
+
+	mem := make([]byte, 1<<30)
+	if err := snapshot.ReadMemory(&buf, mem); err != nil {
+		t.Fatal(err)
+	}
+
+	// The vCPU may have been stopped between the two writes, but not
+	// while the copy was made.
+	a, b := binary.LittleEndian.Uint32(mem[0x5000:]), binary.LittleEndian.Uint32(mem[0x6000:])
+	if a == 0 || (b != a && b != a-1) {
+		t.Errorf("counters: got %d and %d, want them equal or one apart", a, b)
+	}
+}
+
+func TestRegs(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode:
+	//   mov ax, 0x1234
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{0xb8, 0x34, 0x12, 0xe6, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	regs, err := m.Regs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if regs.RAX&0xffff != 0x1234 {
+		t.Errorf("RAX: got %#x, want 0x1234", regs.RAX)
+	}
+
+	regs.RAX = 0x5678
+
+	if err := m.SetRegs(0, regs); err != nil {
+		t.Fatal(err)
+	}
+
+	if regs, err = m.Regs(0); err != nil || regs.RAX != 0x5678 {
+		t.Errorf("Regs after SetRegs: got RAX %#x (%v), want 0x5678", regs.RAX, err)
+	}
+
+	sregs, err := m.Sregs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sregs.CS.Base != 0xffff0000 {
+		t.Errorf("CS base: got %#x, want 0xffff0000", sregs.CS.Base)
+	}
+
+	sregs.DS.Base = 0x1000
+
+	if err := m.SetSregs(0, sregs); err != nil {
+		t.Fatal(err)
+	}
+
+	if sregs, err = m.Sregs(0); err != nil || sregs.DS.Base != 0x1000 {
+		t.Errorf("Sregs after SetSregs: got DS base %#x (%v), want 0x1000", sregs.DS.Base, err)
+	}
+}
+
+func TestPause(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, a loop that never exits:
+	//   jmp $
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{0xeb, 0xfe, 0xe6, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error)
+
+	go func() { errc <- m.RunInfiniteLoop(0) }()
+
+	// Let the vCPU enter the guest, only a kick gets it out.
+	time.Sleep(10 * time.Millisecond)
+	m.Pause()
+
+	regs, err := m.Regs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if regs.RIP != 0xfff0 {
+		t.Fatalf("RIP: got %#x, want 0xfff0", regs.RIP)
+	}
+
+	// Skip the loop.
+	regs.RIP += 2
+
+	if err := m.SetRegs(0, regs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The virtual clock of devices stands still while paused.
+	before := m.Clock().Now()
+	time.Sleep(10 * time.Millisecond)
+
+	if now := m.Clock().Now(); now != before {
+		t.Fatalf("virtual clock moved while paused: %v to %v", before, now)
+	}
+
+	// So does the kvmclock of the guest, once resumed: a second Pause does
+	// not save it anew.
+	kvmBefore, err := m.KVMClock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Pause()
+
+	if !m.Paused() {
+		t.Fatal("not paused")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	m.Resume()
+
+	if m.Paused() {
+		t.Fatal("still paused")
+	}
+
+	// It went back to where it stood at the first Pause, before kvmBefore.
+	if kvmNow, err := m.KVMClock(); err != nil || time.Duration(kvmNow-kvmBefore) >= 100*time.Millisecond {
+		t.Errorf("kvmclock moved %v while paused (%v)", time.Duration(kvmNow-kvmBefore), err)
+	}
+
+	// Resuming again does nothing.
+	m.Resume()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, machine.ErrorGuestExit) {
+			t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("vCPU did not leave the loop")
+	}
+}
+
+// latch is an I/O port whose reads block until it is released.
+type latch chan struct{}
+
+func (l latch) Ports() []uint64 {
+	return []uint64{0x51}
+}
+
+func (l latch) In(port uint64, bytes []byte) error {
+	<-l
+
+	return nil
+}
+
+func (l latch) Out(port uint64, bytes []byte) error {
+	return nil
+}
+
+// waitVCPUState polls QueryVCPUs until vCPU 0 is in state.
+func waitVCPUState(t *testing.T, m *machine.Machine, state machine.VCPUState) machine.VCPUInfo {
+	t.Helper()
+
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(time.Millisecond) {
+		if v := m.QueryVCPUs()[0]; v.State == state {
+			return v
+		}
+	}
+
+	t.Fatalf("vCPU 0 is %v, want %v", m.QueryVCPUs()[0], state)
+
+	return machine.VCPUInfo{}
+}
+
+func TestQueryVCPUs(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, wait for the latch and halt in
+	// KVM, as no interrupt comes:
+	//   in al, 0x51
+	//   hlt
+	copy(rom[0xff0:], []byte{0xe4, 0x51, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	l := make(latch)
+	m.AddIODevice(l)
+
+	if v := m.QueryVCPUs()[0]; v.State != machine.VCPUCreated {
+		t.Fatalf("before running: got %v", v)
+	}
+
+	errc := make(chan error)
+
+	go func() { errc <- m.RunInfiniteLoop(0) }()
+
+	if v := waitVCPUState(t, m, machine.VCPUBlockedOnDevice); v.Exit != kvm.EXITIO || v.Detail != "port 0x51" {
+		t.Fatalf("blocked: got %v", v)
+	}
+
+	close(l)
+	waitVCPUState(t, m, machine.VCPUHalted)
+
+	m.Pause()
+	waitVCPUState(t, m, machine.VCPUPaused)
+
+	m.Stop()
+
+	if err := <-errc; !errors.Is(err, machine.ErrorStopped) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorStopped)
+	}
+
+	if v := m.QueryVCPUs()[0]; v.State != machine.VCPUStopped {
+		t.Fatalf("after Stop: got %v", v)
+	}
+}
+
+func TestStop(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector: jmp $
+	copy(rom[0xff0:], []byte{0xeb, 0xfe})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error)
+
+	go func() { errc <- m.RunInfiniteLoop(0) }()
+
+	time.Sleep(10 * time.Millisecond)
+	m.Stop()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, machine.ErrorStopped) {
+			t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorStopped)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("vCPU did not stop")
+	}
+
+	// It stays stopped.
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorStopped) {
+		t.Fatalf("RunInfiniteLoop after Stop: got %v, want %v", err, machine.ErrorStopped)
+	}
+}
+
+func TestSignalMSI(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The APIC is software-disabled until the guest sets it up, so the MSI
+	// is not taken, but it reaches a vCPU.
+	if _, err := m.SignalMSI(0, 0x30); err != nil {
+		t.Fatal(err)
+	}
+
+	// An x2APIC ID takes the x2APIC API of KVM.
+	if _, err := m.SignalMSI(0x100, 0x30); err != nil && !errors.Is(err, machine.ErrorNoX2APICAPI) {
+		t.Fatal(err)
+	}
+}
+
+func TestBusLockPolicy(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, in real mode, take a split lock and exit:
+	//   lock inc dword [0x3e] ; across the cache line at 0x40
+	//   out 0xf4, al          ; exit
+	copy(rom[0xff0:], []byte{0xf0, 0x66, 0xff, 0x06, 0x3e, 0x00, 0xe6, 0xf4})
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetBusLockPolicy(machine.BusLockKill, 0); errors.Is(err, machine.ErrorNoBusLockExit) {
+		t.Skipf("Skipping test since %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorBusLock) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorBusLock)
+	}
+
+	if n := m.BusLocks(0); n != 1 {
+		t.Errorf("BusLocks: got %d, want 1", n)
+	}
+}
+
+func TestRegisterHypercallHandler(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := func(args [6]uint64) (uint64, error) {
+		return 0, nil
+	}
+
+	// KVM handles KVM_HC_VAPIC_POLL_IRQ itself.
+	if err := m.RegisterHypercallHandler(1, h); !errors.Is(err, machine.ErrorHypercallNotForwarded) {
+		t.Errorf("hypercall 1: got %v, want %v", err, machine.ErrorHypercallNotForwarded)
+	}
+
+	if err := m.RegisterHypercallHandler(64, h); !errors.Is(err, machine.ErrorHypercallNotForwarded) {
+		t.Errorf("hypercall 64: got %v, want %v", err, machine.ErrorHypercallNotForwarded)
+	}
+
+	if err := m.RegisterHypercallHandler(kvm.HCMapGPARange, h); err != nil {
+		t.Errorf("hypercall %d: %v", kvm.HCMapGPARange, err)
+	}
+}
+
+func TestWorkingSet(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.WorkingSet(); !errors.Is(err, machine.ErrorNoWorkingSet) {
+		t.Errorf("WorkingSet: got %v, want %v", err, machine.ErrorNoWorkingSet)
+	}
+
+	if err := m.PromoteHugePages(); !errors.Is(err, machine.ErrorNoWorkingSet) {
+		t.Errorf("PromoteHugePages: got %v, want %v", err, machine.ErrorNoWorkingSet)
+	}
+
+	if err := m.TrackWorkingSet(time.Millisecond); errors.Is(err, idle.ErrNoIdleTracking) {
+		t.Skipf("Skipping test since %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Stop()
+
+	if err := m.PromoteHugePages(); err != nil {
+		t.Fatal(err)
+	}
+
+	var s idle.Stats
+
+	for deadline := time.Now().Add(time.Second); s.Pages == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+
+		if s, err = m.WorkingSet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.Pages != machine.MemSize/4096 {
+		t.Errorf("WorkingSet: got %v", s)
+	}
+
+	if _, err := m.HugePages(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewWithRAM(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.NewWithRAM("/dev/kvm", 1, "", "", "", false, memslot.Backing{HugePageSize: memslot.HugePage2M}, 0)
+	if errors.Is(err, memslot.ErrNoHugePages) {
+		t.Skipf("Skipping test: %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector:
+	//   mov byte [0x1000], 0x5a
+	//   mov al, [0x1000]
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{0xc6, 0x06, 0x00, 0x10, 0x5a, 0xa0, 0x00, 0x10, 0xe6, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) || m.ExitCode() != 0x5a {
+		t.Fatalf("got %v with status %#x, want %v with 0x5a", err, m.ExitCode(), machine.ErrorGuestExit)
+	}
+
+	if ram := m.MemoryRegions()[0]; ram.GPA != 0 || ram.Mem[0x1000] != 0x5a {
+		t.Errorf("guest RAM %v does not hold what the guest wrote", ram)
+	}
+}
+
+func TestRAMFile(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.NewWithRAM("/dev/kvm", 1, "", "", "", false, memslot.Backing{Memfd: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector:
+	//   mov byte [0x1000], 0x5a
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{0xc6, 0x06, 0x00, 0x10, 0x5a, 0xe6, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.RAMFile() == nil {
+		t.Fatal("no file of memfd-backed RAM")
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "ram")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if err := m.SaveMemoryFile(f); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, 0x1000); err != nil || b[0] != 0x5a {
+		t.Errorf("got %#x (%v) at 0x1000 of the image, want 0x5a", b, err)
+	}
+}
+
+func TestPrefault(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.NewWithRAM("/dev/kvm", 1, "", "", "", false, memslot.Backing{Prefault: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	d, err := m.PrefaultTime()
+	if err != nil || d <= 0 {
+		t.Fatalf("got prefault time %v, error %v", d, err)
+	}
+
+	found := false
+
+	for _, p := range m.StartupPhases() {
+		found = found || p.Name == "prefault memory"
+	}
+
+	if !found {
+		t.Errorf("no prefault phase in %v", m.StartupPhases())
+	}
+}
+
+func TestSetNUMA(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 2, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	// Any host has node 0, for two guest nodes.
+	if err := m.SetNUMA([]int{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := m.NUMA()
+	if len(nodes) != 2 || nodes[1].Base != machine.MemSize/2 || nodes[1].Base+nodes[1].Size != machine.MemSize ||
+		len(nodes[0].VCPUs) != 1 || nodes[1].VCPUs[0] != 1 || nodes[0].Distances[1] != 10 {
+		t.Fatalf("invalid NUMA nodes: %+v", nodes)
+	}
+
+	srat, slit := m.NUMATables()
+	if string(srat[:4]) != "SRAT" || string(slit[:4]) != "SLIT" {
+		t.Errorf("invalid NUMA tables %q and %q", srat[:4], slit[:4])
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, out 0xf4, al.
+	copy(rom[0xff0:], []byte{0xe6, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	// vCPU 0 runs pinned to the CPUs of node 0.
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if err := m.SetNUMA([]int{1 << 20}); !errors.Is(err, numa.ErrNoNode) {
+		t.Errorf("got %v, want %v", err, numa.ErrNoNode)
+	}
+}
+
+func TestMeasureDirtyRate(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if _, err := m.MeasureDirtyRate(0); !errors.Is(err, machine.ErrorDirtyRateWindow) {
+		t.Errorf("got %v, want %v", err, machine.ErrorDirtyRateWindow)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// The loop of TestSaveMemoryLive, which writes two pages until the gate
+	// opens.
+	copy(rom, []byte{
+		0x66, 0xff, 0x06, 0x00, 0x50, 0x66, 0xa1, 0x00, 0x50, 0x66, 0xa3, 0x00, 0x60,
+		0xe4, 0x50, 0x84, 0xc0, 0x74, 0xed, 0xe6, 0xf4,
+	})
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xf0})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &gate{}
+	m.AddIODevice(g)
+
+	errc := make(chan error)
+
+	go func() { errc <- m.RunInfiniteLoop(0) }()
+
+	for atomic.LoadInt32(&g.reads) < 1000 {
+		time.Sleep(time.Millisecond)
+	}
+
+	r, err := m.MeasureDirtyRate(100 * time.Millisecond)
+
+	atomic.StoreInt32(&g.open, 1)
+
+	if err := <-errc; !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log(r)
+
+	if r.Pages < 2 || r.PagesPerSecond <= 0 || len(r.VCPUs) != 1 {
+		t.Errorf("got %+v, want at least the 2 pages of the loop", r)
+	}
+}
+
+func TestDebugPort(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	r, w := io.Pipe()
+	defer r.Close()
+
+	o, err := output.New(w, output.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.SetEventOutput(o)
+
+	s, err := snapshot.OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.SetDebugSnapshots(s)
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector:
+	//   mov ax, 42 << 8 | 2
+	//   out 0xf5, ax ; trace point 42
+	//   mov al, 1
+	//   out 0xf5, al ; dump registers
+	//   mov al, 3
+	//   out 0xf5, al ; snapshot debug-0
+	//   jmp $
+	copy(rom[0xff0:], []byte{0xb8, 0x02, 0x2a, 0xe7, 0xf5, 0xb0, 0x01, 0xe6, 0xf5, 0xb0, 0x03, 0xe6, 0xf5, 0xeb, 0xfe})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+
+	go func() { errc <- m.RunInfiniteLoop(0) }()
+
+	events := map[string]map[string]interface{}{}
+
+	for sc := bufio.NewScanner(r); len(events) < 3 && sc.Scan(); {
+		var e map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		if name, _ := e["event"].(string); strings.HasPrefix(name, "debug_") {
+			events[name] = e
+		}
+	}
+
+	// Events of the vCPU after these go nowhere.
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+
+	m.Stop()
+
+	if err := <-errc; !errors.Is(err, machine.ErrorStopped) {
+		t.Errorf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorStopped)
+	}
+
+	if e := events["debug_trace"]; e == nil || e["mark"] != 42.0 || e["cpu"] != 0.0 {
+		t.Errorf("got trace event %v, want mark 42 of vCPU 0", e)
+	}
+
+	if e := events["debug_regs"]; e == nil || e["cs"] != float64(0xf000) {
+		t.Errorf("got registers %v, want cs 0xf000", e)
+	}
+
+	if e := events["debug_snapshot"]; e == nil || e["snapshot"] != "debug-0" {
+		t.Errorf("got snapshot event %v, want debug-0", e)
+	}
+
+	if _, err := s.Get("debug-0"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunAndClose(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 2, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector of the BSP; the AP waits for a SIPI meanwhile:
+	//   mov al, 7
+	//   out 0xf4, al ; exit
+	copy(rom[0xff0:], []byte{0xb0, 0x07, 0xe6, 0xf4})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Run(); !errors.Is(err, machine.ErrorGuestExit) || m.ExitCode() != 7 {
+		t.Fatalf("Run: got %v with status %d, want %v with 7", err, m.ExitCode(), machine.ErrorGuestExit)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A guest that runs until shut down, with a disk.
+	if m, err = machine.New("/dev/kvm", 1, "", "/dev/zero"); err != nil {
+		t.Fatal(err)
+	}
+
+	// At the reset vector: jmp $
+	copy(rom[0xff0:], []byte{0xeb, 0xfe})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error)
+
+	go func() { errc <- m.Run() }()
+
+	time.Sleep(10 * time.Millisecond)
+	m.Shutdown()
+
+	if err := <-errc; err != nil {
+		t.Fatalf("Run after Shutdown: got %v, want nil", err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTopologyCPUID(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 4, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := make([]byte, 0x1000)
+
+	// At the start of the ROM, in real mode, exit with the number of
+	// cores in the core level of the topology leaf:
+	//   mov eax, 0xb
+	//   mov ecx, 1
+	//   cpuid
+	//   mov al, bl
+	//   out 0xf4, al ; exit
+	copy(rom, []byte{
+		0x66, 0xb8, 0x0b, 0x00, 0x00, 0x00, 0x66, 0xb9, 0x01, 0x00, 0x00, 0x00,
+		0x0f, 0xa2, 0x88, 0xd8, 0xe6, 0xf4,
+	})
+
+	// At the reset vector: jmp 0xf000
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xf0})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.ExitCode() != 4 {
+		t.Errorf("cores in CPUID 0xb: got %d, want 4", m.ExitCode())
+	}
+}
+
+func TestMemoryDevice(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if err := m.ResizeMemory(2 << 20); !errors.Is(err, machine.ErrorNoMemoryDevice) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorNoMemoryDevice)
+	}
+
+	if err := m.AddMemoryDevice(3 << 20); !errors.Is(err, virtio.ErrMemorySize) {
+		t.Fatalf("got %v, want %v", err, virtio.ErrMemorySize)
+	}
+
+	if err := m.AddMemoryDevice(64 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := m.MemoryDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+
+	for _, r := range m.MemoryRegions() {
+		if r.GPA == d.Base && uint64(len(r.Mem)) == d.Size {
+			found = true
+		}
+	}
+
+	if !found || d.Size != 64<<20 {
+		t.Fatalf("no memory slot for %v in %v", d, m.MemoryRegions())
+	}
+
+	if err := m.ResizeMemory(16 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, _ := m.MemoryDevice(); d.Requested != 16<<20 || d.Plugged != 0 {
+		t.Fatalf("got %v, want 16 MiB requested and none plugged", d)
+	}
+}
+
+func TestBalloon(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if err := m.SetBalloon(1 << 20); !errors.Is(err, machine.ErrorNoBalloon) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorNoBalloon)
+	}
+
+	m.AddBalloon()
+
+	if err := m.SetBalloon(machine.MemSize + 1); !errors.Is(err, machine.ErrorBalloonSize) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorBalloonSize)
+	}
+
+	if err := m.SetBalloon(16 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := m.Balloon(); err != nil || b.Target != 16<<20 || b.Actual != 0 {
+		t.Fatalf("got %v, %v, want a target of 16 MiB and an empty balloon", b, err)
+	}
+}
+
+func TestNewWithRAMSize(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	for _, size := range []uint64{machine.MinMemSize - machine.MemSizeAlign, machine.MemSize + 1, machine.MaxMemSize + machine.MemSizeAlign} {
+		if _, err := machine.NewWithRAM("/dev/kvm", 1, "", "", "", false, memslot.Backing{}, size); !errors.Is(err, machine.ErrorMemSize) {
+			t.Errorf("%#x: got %v, want %v", size, err, machine.ErrorMemSize)
+		}
+	}
+
+	m, err := machine.NewWithRAM("/dev/kvm", 1, "", "", "", false, memslot.Backing{}, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+}
+
+func TestReset(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	rom := make([]byte, 0x1000)
+
+	// At the reset vector, a jump to 0xff00:
+	//   jmp 0xff00
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+	// Where the first boot resets through 0xcf9, and the second exits:
+	//   inc byte [0x1000]
+	//   cmp byte [0x1000], 2
+	//   je exit
+	//   mov dx, 0xcf9
+	//   mov al, 6
+	//   out dx, al
+	// exit:
+	//   out 0xf4, al
+	copy(rom[0xf00:], []byte{
+		0xfe, 0x06, 0x00, 0x10,
+		0x80, 0x3e, 0x00, 0x10, 0x02,
+		0x74, 0x06,
+		0xba, 0xf9, 0x0c,
+		0xb0, 0x06,
+		0xee,
+		0xe6, 0xf4,
+	})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorWriteToCF9) || !errors.Is(err, machine.ErrorGuestReset) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorWriteToCF9)
+	}
+
+	if err := m.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("after reset: got %v, want %v", err, machine.ErrorGuestExit)
+	}
+}
+
+func TestOnShutdown(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+
+	hook := func(name string, err error) func() error {
+		return func() error {
+			order = append(order, name)
+
+			return err
+		}
+	}
+
+	errRelease := errors.New("release failed")
+
+	m.OnShutdown(machine.ShutdownRelease, "release", hook("release", errRelease))
+	m.OnShutdown(machine.ShutdownFlush, "flush", hook("flush", nil))
+	m.OnShutdown(machine.ShutdownQuiesce, "quiesce 1", hook("quiesce 1", nil))
+	m.OnShutdown(machine.ShutdownQuiesce, "quiesce 2", hook("quiesce 2", nil))
+
+	if err := m.Close(); !errors.Is(err, errRelease) {
+		t.Errorf("got %v, want %v", err, errRelease)
+	}
+
+	// Hooks of a phase run last in, first out.
+	want := []string{"quiesce 2", "quiesce 1", "flush", "release"}
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", order, want)
+	}
+}
+
+func TestAddMemoryRegion(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	dir := t.TempDir()
+	fw := filepath.Join(dir, "fw.bin")
+	shared := filepath.Join(dir, "shared")
+
+	if err := os.WriteFile(fw, []byte{0x5a, 0xa5}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []machine.MemoryRegion{
+		{Kind: machine.RegionRAM, GPA: 0x100000000, Size: 0x200000, DirtyLog: true},
+		{Kind: machine.RegionROM, GPA: 0xe0000000, Size: 0x10000, File: fw},
+		{Kind: machine.RegionShared, GPA: 0xd0000000, Size: 0x2000, File: shared},
+		{Kind: machine.RegionShared, GPA: 0xd0100000, Size: 0x1000},
+	} {
+		if err := m.AddMemoryRegion(r); err != nil {
+			t.Fatalf("%v: %v", r, err)
+		}
+	}
+
+	found := map[uint64]memslot.Region{}
+	for _, r := range m.MemoryRegions() {
+		found[r.GPA] = r
+	}
+
+	if r := found[0xe0000000]; r.Flags&kvm.MemReadonly == 0 || r.Mem[0] != 0x5a || r.Mem[1] != 0xa5 {
+		t.Errorf("ROM region %v", r)
+	}
+
+	if r := found[0x100000000]; r.Flags&kvm.MemLogDirtyPages == 0 {
+		t.Errorf("RAM region %v without dirty logging", r)
+	}
+
+	if fi, err := os.Stat(shared); err != nil || fi.Size() != 0x2000 {
+		t.Errorf("shared file: %v, %v", fi, err)
+	}
+
+	if dirty, err := m.DirtyPages(0x100000000); err != nil || len(dirty) != 8 {
+		t.Errorf("DirtyPages: %v, %v", dirty, err)
+	}
+
+	if _, err := m.DirtyPages(0xe0000000); !errors.Is(err, machine.ErrorMemoryRegion) {
+		t.Errorf("DirtyPages of the ROM: got %v, want %v", err, machine.ErrorMemoryRegion)
+	}
+
+	for _, r := range []machine.MemoryRegion{
+		{Kind: machine.RegionRAM, GPA: 0xfee00000, Size: 0x1000},
+		{Kind: machine.RegionRAM, GPA: 0x1000, Size: 0x800},
+		{Kind: machine.RegionROM, GPA: 0xc0000000, Size: 0x1000},
+		{Kind: "flash", GPA: 0xc0000000, Size: 0x1000},
+	} {
+		if err := m.AddMemoryRegion(r); !errors.Is(err, machine.ErrorMemoryRegion) {
+			t.Errorf("%v: got %v, want %v", r, err, machine.ErrorMemoryRegion)
+		}
+	}
+
+	// Overlapping guest RAM.
+	if err := m.AddMemoryRegion(machine.MemoryRegion{Kind: machine.RegionRAM, GPA: 0x100000, Size: 0x1000}); err == nil {
+		t.Error("region in guest RAM: expected an error")
+	}
+}
+
+func TestReadWriteVirtual(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	// Without paging, virtual addresses are physical ones.
+	b := make([]byte, 4)
+	if err := m.ReadVirtual(0, 0x1234, b); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := m.MemoryRegions()[0].Mem
+
+	// 32-bit page tables with a page directory at 0x2000 and a page table
+	// at 0x3000 that map virtual page 0 to 0x10000 and page 1 to 0x5000,
+	// below it, and leave page 2 unmapped.
+	const present, writable = 1, 2
+
+	binary.LittleEndian.PutUint32(mem[0x2000:], 0x3000|present|writable)
+	binary.LittleEndian.PutUint32(mem[0x3000:], 0x10000|present|writable)
+	binary.LittleEndian.PutUint32(mem[0x3004:], 0x5000|present)
+
+	sregs, err := m.Sregs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sregs.CR3 = 0x2000
+	sregs.CR0 |= 1<<31 | 1 // paging and protected mode
+	sregs.CR4 = 0
+
+	if err := m.SetSregs(0, sregs); err != nil {
+		t.Fatal(err)
+	}
+
+	if gpa, err := m.Translate(0, 0x1234); err != nil || gpa != 0x5234 {
+		t.Errorf("Translate(0x1234): got %#x, %v, want 0x5234", gpa, err)
+	}
+
+	// Across the page boundary, which is not one in guest physical memory.
+	if err := m.WriteVirtual(0, 0xffe, []byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(mem[0x10ffe:0x11000]) != "ab" || string(mem[0x5000:0x5002]) != "cd" {
+		t.Errorf("got %q and %q, want \"ab\" and \"cd\"", mem[0x10ffe:0x11000], mem[0x5000:0x5002])
+	}
+
+	if err := m.ReadVirtual(0, 0xffe, b); err != nil || string(b) != "abcd" {
+		t.Errorf("ReadVirtual: got %q, %v, want \"abcd\"", b, err)
+	}
+
+	if s, err := m.ReadVirtualString(0, 0xffe, 0x100); err != nil || s != "abcd" {
+		t.Errorf("ReadVirtualString: got %q, %v, want \"abcd\"", s, err)
+	}
+
+	// The string must not be read into the unmapped page 2 past its NUL.
+	copy(mem[0x5ffe:], "x\x00")
+
+	if s, err := m.ReadVirtualString(0, 0x1ffe, 0x100); err != nil || s != "x" {
+		t.Errorf("ReadVirtualString at the end of the mapping: got %q, %v, want \"x\"", s, err)
+	}
+
+	if err := m.ReadVirtual(0, 0x1ffe, b); !errors.Is(err, machine.ErrorNotMapped) {
+		t.Errorf("ReadVirtual into page 2: got %v, want %v", err, machine.ErrorNotMapped)
+	}
+
+	// Nothing is written when part of the range is not mapped.
+	if err := m.WriteVirtual(0, 0x1ffe, []byte("zzzz")); !errors.Is(err, machine.ErrorNotMapped) {
+		t.Errorf("WriteVirtual into page 2: got %v, want %v", err, machine.ErrorNotMapped)
+	}
+
+	if string(mem[0x5ffe:0x6000]) != "x\x00" {
+		t.Errorf("got %q after a failed write, want \"x\\x00\"", mem[0x5ffe:0x6000])
+	}
+}
+
+func TestSandboxBlk(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SandboxBlk(); !errors.Is(err, machine.ErrorNoBlk) {
+		t.Errorf("without a disk: got %v, want %v", err, machine.ErrorNoBlk)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(disk, make([]byte, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err = machine.New("/dev/kvm", 1, "", disk); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SandboxBlk(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SandboxBlk(); !errors.Is(err, sandbox.ErrBackend) {
+		t.Errorf("sandboxed twice: got %v, want %v", err, sandbox.ErrBackend)
+	}
+
+	// The disk is flushed and the helper ended.
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// vmlinux returns a vmlinux of one segment of code at 16MiB, linked at
+// __START_KERNEL_map, with notes if there are any.
+func vmlinux(t *testing.T, code, notes []byte) []byte {
+	t.Helper()
+
+	hdr := elf.Header64{
+		Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_X86_64), Version: uint32(elf.EV_CURRENT),
+		Entry: 0x1000000, Phoff: 64, Ehsize: 64, Phentsize: 56, Phnum: 2,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS], hdr.Ident[elf.EI_DATA], hdr.Ident[elf.EI_VERSION] =
+		byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)
+
+	progs := []elf.Prog64{{
+		Type: uint32(elf.PT_LOAD), Off: 0x1000, Vaddr: 0xffffffff81000000, Paddr: 0x1000000,
+		Filesz: uint64(len(code)), Memsz: uint64(len(code)), Align: 0x1000,
+	}, {
+		Type: uint32(elf.PT_NOTE), Off: 0x1000 + uint64(len(code)), Filesz: uint64(len(notes)), Align: 4,
+	}}
+
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, progs); err != nil {
+		t.Fatal(err)
+	}
+
+	img := make([]byte, 0x1000)
+	copy(img, buf.Bytes())
+
+	return append(append(img, code...), notes...)
+}
+
+func TestLoadVmlinux(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	// The entry only gets the 42 it writes to the exit port in 64-bit mode:
+	//   mov rax, 1 << 32
+	//   shr rax, 32
+	//   add al, 41
+	//   out 0xf4, al
+	long := []byte{
+		0x48, 0xb8, 0, 0, 0, 0, 1, 0, 0, 0,
+		0x48, 0xc1, 0xe8, 0x20,
+		0x04, 0x29,
+		0xe6, 0xf4,
+		0xf4,
+	}
+
+	// The PVH entry, 0x20 on, writes 42 if EBX points to the magic of
+	// hvm_start_info, and 1 otherwise:
+	//   cmp dword [ebx], 0x336ec578
+	//   mov al, 42
+	//   je  out
+	//   mov al, 1
+	// out:
+	//   out 0xf4, al
+	pvh := make([]byte, 0x20)
+	pvh = append(pvh, 0x81, 0x3b, 0x78, 0xc5, 0x6e, 0x33, 0xb0, 0x2a, 0x74, 0x02, 0xb0, 0x01, 0xe6, 0xf4, 0xf4)
+
+	note := make([]byte, 20)
+	binary.LittleEndian.PutUint32(note, 4)
+	binary.LittleEndian.PutUint32(note[4:], 4)
+	binary.LittleEndian.PutUint32(note[8:], 18) // XEN_ELFNOTE_PHYS32_ENTRY
+	copy(note[12:], "Xen\x00")
+	binary.LittleEndian.PutUint32(note[16:], 0x1000020)
+
+	for _, tt := range []struct {
+		name        string
+		code, notes []byte
+	}{
+		{"64-bit entry", long, nil},
+		{"PVH", pvh, note},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := machine.New("/dev/kvm", 1, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer m.Close()
+
+			img := vmlinux(t, tt.code, tt.notes)
+			if err := m.LoadLinux(bytes.NewReader(img), bytes.NewReader(nil), "console=ttyS0"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+				t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+			}
+
+			if m.ExitCode() != 42 {
+				t.Fatalf("got exit status %d, want 42", m.ExitCode())
+			}
+		})
+	}
+}
+
+func TestEnterLongMode(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if err := m.EnterLongMode(0, 0x100000); err != nil {
+		t.Fatal(err)
+	}
+
+	// At 1MiB, code that only gets the 42 it writes to the exit port in
+	// 64-bit mode, with the stack right below it:
+	//   mov rax, 1 << 32
+	//   shr rax, 32
+	//   push 41
+	//   add al, [rsp]
+	//   out 0xf4, al
+	code := []byte{
+		0x48, 0xb8, 0, 0, 0, 0, 1, 0, 0, 0,
+		0x48, 0xc1, 0xe8, 0x20,
+		0x6a, 0x29,
+		0x02, 0x04, 0x24,
+		0xe6, 0xf4,
+		0xf4,
+	}
+
+	if err := m.WriteVirtual(0, 0x100000, code); err != nil {
+		t.Fatal(err)
+	}
+
+	regs, err := m.Regs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regs.RSP = 0x100000
+
+	if err := m.SetRegs(0, regs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.ExitCode() != 42 {
+		t.Fatalf("got exit status %d, want 42", m.ExitCode())
+	}
+
+	sregs, err := m.Sregs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sregs.EFER&(1<<10) == 0 || sregs.CS.L != 1 {
+		t.Fatalf("not in long mode: EFER %#x, CS.L %d", sregs.EFER, sregs.CS.L)
+	}
+}
+
+func TestShadowBIOS(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if err := m.ShadowBIOS(); !errors.Is(err, machine.ErrorNoROM) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorNoROM)
+	}
+
+	// A 256KiB BIOS whose reset vector jumps to F000:E05B, as SeaBIOS
+	// does, where it writes 41 to its data in the F segment and the 42
+	// it reads back plus one to the exit port:
+	//   mov ax, 0xf000
+	//   mov ds, ax
+	//   mov byte [0xe100], 41
+	//   mov al, [0xe100]
+	//   inc al
+	//   out 0xf4, al
+	rom := make([]byte, 0x40000)
+	copy(rom[0x3e05b:], []byte{
+		0xb8, 0x00, 0xf0,
+		0x8e, 0xd8,
+		0xc6, 0x06, 0x00, 0xe1, 0x29,
+		0xa0, 0x00, 0xe1,
+		0xfe, 0xc0,
+		0xe6, 0xf4,
+		0xf4,
+	})
+	copy(rom[0x3fff0:], []byte{0xea, 0x5b, 0xe0, 0x00, 0xf0})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.ShadowBIOS(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.ExitCode() != 42 {
+		t.Fatalf("got exit status %d, want 42", m.ExitCode())
+	}
+}
+
+func TestAddFwCfg(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	// The reset vector jumps to code that reads the signature of fw_cfg
+	// with rep insb, as firmware does, and the number of CPUs, and writes
+	// 42 to the exit port if they are "QEMU" and 1:
+	//   mov dx, 0x510
+	//   xor ax, ax
+	//   out dx, ax
+	//   inc dx
+	//   mov di, 0x500
+	//   mov cx, 4
+	//   rep insb
+	//   mov al, [0x503]
+	//   sub al, 'U' - 42
+	//   mov bl, al
+	//   mov dx, 0x510
+	//   mov ax, 5
+	//   out dx, ax
+	//   inc dx
+	//   in al, dx
+	//   add al, bl
+	//   dec al
+	//   out 0xf4, al
+	rom := make([]byte, 0x1000)
+	copy(rom[0xf00:], []byte{
+		0xba, 0x10, 0x05,
+		0x31, 0xc0,
+		0xef,
+		0x42,
+		0xbf, 0x00, 0x05,
+		0xb9, 0x04, 0x00,
+		0xf3, 0x6c,
+		0xa0, 0x03, 0x05,
+		0x2c, 0x2b,
+		0x88, 0xc3,
+		0xba, 0x10, 0x05,
+		0xb8, 0x05, 0x00,
+		0xef,
+		0x42,
+		0xec,
+		0x00, 0xd8,
+		0xfe, 0xc8,
+		0xe6, 0xf4,
+		0xf4,
+	})
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddFwCfg(fwcfg.New()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if m.ExitCode() != 42 {
+		t.Fatalf("got exit status %d, want 42", m.ExitCode())
+	}
+}
+
+func TestEnableACPI(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	// The kernel finds the RSDP where it looks without EFI:
+	//   mov rax, [0xe0000]
+	//   mov rbx, "RSD PTR "
+	//   cmp rax, rbx
+	//   mov al, 42
+	//   je  out
+	//   mov al, 1
+	// out:
+	//   out 0xf4, al
+	kernel := []byte{
+		0x48, 0x8b, 0x04, 0x25, 0x00, 0x00, 0x0e, 0x00,
+		0x48, 0xbb, 'R', 'S', 'D', ' ', 'P', 'T', 'R', ' ',
+		0x48, 0x39, 0xd8,
+		0xb0, 0x2a, 0x74, 0x02, 0xb0, 0x01,
+		0xe6, 0xf4,
+		0xf4,
+	}
+
+	// The reset vector jumps to code that enters S5 as Linux does to
+	// power off, with SLP_TYP of the \_S5 of the DSDT and SLP_EN:
+	//   mov dx, 0x600
+	//   mov al, 0x34
+	//   out dx, al
+	//   hlt
+	rom := make([]byte, 0x1000)
+	copy(rom[0xf00:], []byte{0xba, 0x00, 0x06, 0xb0, 0x34, 0xee, 0xf4})
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+	for _, tt := range []struct {
+		name string
+		load func(m *machine.Machine) error
+		want error
+	}{
+		{"kernel", func(m *machine.Machine) error {
+			return m.LoadLinux(bytes.NewReader(vmlinux(t, kernel, nil)), bytes.NewReader(nil), "console=ttyS0")
+		}, machine.ErrorGuestExit},
+		{"firmware", func(m *machine.Machine) error {
+			if err := m.LoadROM(rom); err != nil {
+				return err
+			}
+
+			return m.AddFwCfg(fwcfg.New())
+		}, machine.ErrorPowerOff},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := machine.New("/dev/kvm", 2, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer m.Close()
+
+			m.EnableACPI()
+
+			if err := tt.load(m); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := m.RunInfiniteLoop(0); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+
+			if tt.want == machine.ErrorGuestExit && m.ExitCode() != 42 {
+				t.Fatalf("got exit status %d, want 42", m.ExitCode())
+			}
+		})
+	}
+}
+
+func TestKVMClock(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	features := func(m *machine.Machine) uint32 {
+		c := m.CPUID()
+		for _, e := range c.Entries[:c.Nent] {
+			if e.Function == kvm.CPUIDFeatures {
+				return e.Eax
+			}
+		}
+
+		return 0
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	const clocksource = kvm.KVMFeatureClocksource | kvm.KVMFeatureClocksource2 | kvm.KVMFeatureClocksourceStable
+	if got := features(m); got&clocksource != clocksource {
+		t.Fatalf("kvmclock features %#x", got)
+	}
+
+	rom := make([]byte, 0x1000)
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+	// The first boot points KVM to a pvclock page at 0x2000 and resets
+	// through 0xcf9; the second exits with 42 plus what is left of it:
+	//   inc byte [0x1000]
+	//   cmp byte [0x1000], 2
+	//   je second
+	//   mov ecx, 0x4b564d01
+	//   mov eax, 0x2001
+	//   xor edx, edx
+	//   wrmsr
+	//   mov dx, 0xcf9
+	//   mov al, 6
+	//   out dx, al
+	// second:
+	//   mov ecx, 0x4b564d01
+	//   rdmsr
+	//   add al, 42
+	//   out 0xf4, al
+	copy(rom[0xf00:], []byte{
+		0xfe, 0x06, 0x00, 0x10,
+		0x80, 0x3e, 0x00, 0x10, 0x02,
+		0x74, 0x17,
+		0x66, 0xb9, 0x01, 0x4d, 0x56, 0x4b,
+		0x66, 0xb8, 0x01, 0x20, 0x00, 0x00,
+		0x66, 0x31, 0xd2,
+		0x0f, 0x30,
+		0xba, 0xf9, 0x0c,
+		0xb0, 0x06,
+		0xee,
+		0x66, 0xb9, 0x01, 0x4d, 0x56, 0x4b,
+		0x0f, 0x32,
+		0x04, 0x2a,
+		0xe6, 0xf4,
+	})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorWriteToCF9) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorWriteToCF9)
+	}
+
+	if err := m.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) || m.ExitCode() != 42 {
+		t.Fatalf("after reset: got %v, exit status %d, want 42", err, m.ExitCode())
+	}
+
+	if err := m.SetKVMClock(1 << 40); err != nil {
+		t.Fatal(err)
+	}
+
+	if ns, err := m.KVMClock(); err != nil || ns < 1<<40 {
+		t.Fatalf("kvmclock at %d: %v", ns, err)
+	}
+
+	m2, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m2.Close()
+
+	if err := m2.DisableKVMClock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := features(m2); got&clocksource != 0 {
+		t.Fatalf("kvmclock features %#x after DisableKVMClock", got)
+	}
+}
+
+func TestSetDebugExit(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	for _, d := range []machine.DebugExit{{Port: 0x501, Size: 3}, {Port: 0xffff, Size: 2}} {
+		if err := m.SetDebugExit(d); !errors.Is(err, machine.ErrorDebugExit) {
+			t.Errorf("%+v: got %v, want %v", d, err, machine.ErrorDebugExit)
+		}
+	}
+
+	if err := m.SetDebugExit(machine.DebugExit{Port: 0x501, Size: 2, QEMU: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// mov dx, 0x501; mov ax, 21; out dx, ax
+	rom := make([]byte, 0x1000)
+	copy(rom[0xf00:], []byte{0xba, 0x01, 0x05, 0xb8, 0x15, 0x00, 0xef})
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) || m.ExitCode() != 21<<1|1 {
+		t.Fatalf("got %v, exit status %d, want %d", err, m.ExitCode(), 21<<1|1)
+	}
+}
+
+func TestRTC(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	year := time.Now().UTC().Year() % 100
+
+	for _, tt := range []struct {
+		name string
+		code []byte
+		want int
+	}{
+		// Read the year, in BCD:
+		//   mov al, 9; out 0x70, al; in al, 0x71; out 0xf4, al
+		{"time", []byte{0xb0, 0x09, 0xe6, 0x70, 0xe4, 0x71, 0xe6, 0xf4}, year/10<<4 | year%10},
+		// Set the year to 99 under SET of register B, then read it.
+		{"set", []byte{
+			0xb0, 0x0b, 0xe6, 0x70, 0xb0, 0x82, 0xe6, 0x71,
+			0xb0, 0x09, 0xe6, 0x70, 0xb0, 0x99, 0xe6, 0x71,
+			0xb0, 0x0b, 0xe6, 0x70, 0xb0, 0x02, 0xe6, 0x71,
+			0xb0, 0x09, 0xe6, 0x70, 0xe4, 0x71, 0xe6, 0xf4,
+		}, 0x99},
+		// Enable the periodic interrupt at 1024Hz, rate 6 of register A
+		// with PIE of register B, and with the interrupts of the vCPU
+		// off poll register C until it flags one:
+		// loop:
+		//   mov al, 0xc; out 0x70, al; in al, 0x71
+		//   test al, 0x40; jz loop
+		//   out 0xf4, al
+		{"periodic", []byte{
+			0xb0, 0x0a, 0xe6, 0x70, 0xb0, 0x26, 0xe6, 0x71,
+			0xb0, 0x0b, 0xe6, 0x70, 0xb0, 0x42, 0xe6, 0x71,
+			0xb0, 0x0c, 0xe6, 0x70, 0xe4, 0x71, 0xa8, 0x40, 0x74, 0xf6,
+			0xe6, 0xf4,
+		}, 0xc0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := machine.New("/dev/kvm", 1, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer m.Close()
+
+			rom := make([]byte, 0x1000)
+			copy(rom[0xf00:], tt.code)
+			copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+			if err := m.LoadROM(rom); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) || m.ExitCode() != tt.want {
+				t.Fatalf("got %v, exit status %#x, want %#x", err, m.ExitCode(), tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyboard(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	for _, tt := range []struct {
+		name string
+		code []byte
+		key  string
+		want error
+		exit int
+	}{
+		// in al, 0x60; out 0xf4, al
+		{"key", []byte{0xe4, 0x60, 0xe6, 0xf4}, "a", machine.ErrorGuestExit, 0x1e},
+		// The self-test of the controller:
+		//   mov al, 0xaa; out 0x64, al; in al, 0x60; out 0xf4, al
+		{"self-test", []byte{0xb0, 0xaa, 0xe6, 0x64, 0xe4, 0x60, 0xe6, 0xf4}, "", machine.ErrorGuestExit, 0x55},
+		// Reset through the output port, as with "reboot=k":
+		//   mov al, 0xd1; out 0x64, al; mov al, 0; out 0x60, al
+		{"reset", []byte{0xb0, 0xd1, 0xe6, 0x64, 0xb0, 0x00, 0xe6, 0x60, 0xf4}, "", machine.ErrorKeyboardReset, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := machine.New("/dev/kvm", 1, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer m.Close()
+
+			rom := make([]byte, 0x1000)
+			copy(rom[0xf00:], tt.code)
+			copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+			if err := m.LoadROM(rom); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.key != "" {
+				if err := m.SendKey(tt.key); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := m.RunInfiniteLoop(0); !errors.Is(err, tt.want) || m.ExitCode() != tt.exit {
+				t.Fatalf("got %v, exit status %#x, want %v, %#x", err, m.ExitCode(), tt.want, tt.exit)
+			}
+		})
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if err := m.SendKey("ctrl-alt-delete"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.TypeText("Hello, world!\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, err := range []error{m.SendKey("ctrl-foo"), m.TypeText("é")} {
+		if !errors.Is(err, machine.ErrorUnknownKey) {
+			t.Errorf("got %v, want %v", err, machine.ErrorUnknownKey)
+		}
+	}
+}
+
+func TestSetDebugconOutput(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	var out bytes.Buffer
+
+	m.SetDebugconOutput(&out)
+
+	// Write "ok" if the port reads as 0xe9, as SeaBIOS checks:
+	//   in al, 0xe9; cmp al, 0xe9; jne end
+	//   mov al, 'o'; out 0xe9, al; mov al, 'k'; out 0xe9, al
+	// end:
+	//   out 0xf4, al
+	rom := make([]byte, 0x1000)
+	copy(rom[0xf00:], []byte{
+		0xe4, 0xe9, 0x3c, 0xe9, 0x75, 0x08,
+		0xb0, 'o', 0xe6, 0xe9, 0xb0, 'k', 0xe6, 0xe9,
+		0xe6, 0xf4,
+	})
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	if out.String() != "ok" {
+		t.Fatalf("got %q, want %q", out.String(), "ok")
+	}
+}
+
+func TestAddUART(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	path := filepath.Join(t.TempDir(), "ttyS1.log")
+	if err := m.AddUART(2, path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{1, 2, 5} {
+		if err := m.AddUART(n, path); !errors.Is(err, machine.ErrorUART) {
+			t.Errorf("COM%d: got %v, want %v", n, err, machine.ErrorUART)
+		}
+	}
+
+	// Write "ok" to COM2:
+	//   mov dx, 0x2f8; mov al, 'o'; out dx, al; mov al, 'k'; out dx, al
+	//   out 0xf4, al
+	rom := make([]byte, 0x1000)
+	copy(rom[0xf00:], []byte{
+		0xba, 0xf8, 0x02, 0xb0, 'o', 0xee, 0xb0, 'k', 0xee,
+		0xe6, 0xf4,
+	})
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "ok" {
+		t.Fatalf("got %q, want %q", b, "ok")
+	}
+}
+
+func TestAddUARTPTY(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	var events bytes.Buffer
+
+	o, err := output.New(&events, output.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.SetEventOutput(o)
+
+	if err := m.AddUART(3, "pty"); err != nil {
+		t.Fatal(err)
+	}
+
+	var e struct {
+		Event, Port, Path string
+	}
+
+	if err := json.Unmarshal(events.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Event != "pty" || e.Port != "COM3" {
+		t.Fatalf("got %+v, want the pty of COM3", e)
+	}
+
+	pts, err := os.Open(e.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pts.Close()
+
+	// Write "ok" to COM3:
+	//   mov dx, 0x3e8; mov al, 'o'; out dx, al; mov al, 'k'; out dx, al
+	//   out 0xf4, al
+	rom := make([]byte, 0x1000)
+	copy(rom[0xf00:], []byte{
+		0xba, 0xe8, 0x03, 0xb0, 'o', 0xee, 0xb0, 'k', 0xee,
+		0xe6, 0xf4,
+	})
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(pts, b); err != nil || string(b) != "ok" {
+		t.Fatalf("got %q, %v, want %q", b, err, "ok")
+	}
+}
+
+func TestAddUARTListen(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	var events bytes.Buffer
+
+	o, err := output.New(&events, output.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.SetEventOutput(o)
+
+	if err := m.AddUART(2, "tcp:127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var e struct {
+		Event, Port, Addr string
+	}
+
+	if err := json.Unmarshal(events.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Event != "listen" || e.Port != "COM2" {
+		t.Fatalf("got %+v, want the listener of COM2", e)
+	}
+
+	c, err := net.Dial("tcp", e.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if _, err := c.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Echo the next byte of COM2 plus one:
+	//   mov dx, 0x2fd
+	// wait:
+	//   in al, dx; test al, 1; jz wait
+	//   mov dx, 0x2f8; in al, dx; inc al; out dx, al
+	//   out 0xf4, al
+	rom := make([]byte, 0x1000)
+	copy(rom[0xf00:], []byte{
+		0xba, 0xfd, 0x02,
+		0xec, 0xa8, 0x01, 0x74, 0xfb,
+		0xba, 0xf8, 0x02, 0xec, 0xfe, 0xc0, 0xee,
+		0xe6, 0xf4,
+	})
+	copy(rom[0xff0:], []byte{0xe9, 0x0d, 0xff})
+
+	if err := m.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestExit) {
+		t.Fatalf("got %v, want %v", err, machine.ErrorGuestExit)
+	}
+
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "b" {
+		t.Fatalf("got %q, %v, want %q", b, err, "b")
+	}
+}
@@ -0,0 +1,110 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/memslot"
+	"github.com/bobuhiro11/gokvm/virtio"
+	"github.com/bobuhiro11/gokvm/worker"
+)
+
+const (
+	// memDeviceBase is where the region of the virtio-mem device is,
+	// far above RAM, firmware and EPC, and memDeviceBlock the size of the
+	// blocks it is plugged in, that of a huge page as in QEMU.
+	memDeviceBase  = 1 << 36
+	memDeviceBlock = hugePageSize
+
+	virtioMemIRQ = 5
+)
+
+// ErrorNoMemoryDevice indicates a resize of a machine without AddMemoryDevice.
+var ErrorNoMemoryDevice = errors.New("no virtio-mem device")
+
+// MemoryDevice is the state of the virtio-mem device of AddMemoryDevice.
+type MemoryDevice struct {
+	Base, Size uint64
+	// Plugged are the bytes the guest has, and Requested those
+	// ResizeMemory asked it to have.
+	Plugged, Requested uint64
+}
+
+func (d MemoryDevice) String() string {
+	return fmt.Sprintf("%d MiB of %d MiB plugged at %#x, %d MiB requested",
+		d.Plugged>>20, d.Size>>20, d.Base, d.Requested>>20)
+}
+
+// AddMemoryDevice gives the guest a virtio-mem device with a region of
+// size bytes, a multiple of 2MiB, for ResizeMemory to grow and shrink its
+// RAM within. The host memory of the region is only taken as the guest
+// plugs it. As with AddIODevice, the kernel or ROM must be loaded first.
+func (m *Machine) AddMemoryDevice(size uint64) error {
+	if size == 0 || size%memDeviceBlock != 0 {
+		return fmt.Errorf("%w: %#x, want a multiple of %#x", virtio.ErrMemorySize, size, memDeviceBlock)
+	}
+
+	region, err := syscall.Mmap(-1, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_NORESERVE)
+	if err != nil {
+		return fmt.Errorf("virtio-mem: %w", err)
+	}
+
+	v, err := virtio.NewMemory(virtioMemIRQ, m, m.mem, region, memDeviceBase, memDeviceBlock)
+	if err != nil {
+		_ = syscall.Munmap(region)
+
+		return err
+	}
+
+	if _, err := m.slots.Add(memslot.Region{GPA: memDeviceBase, Mem: region}); err != nil {
+		_ = syscall.Munmap(region)
+
+		return fmt.Errorf("virtio-mem: %w", err)
+	}
+
+	m.memDevice, m.memDeviceRegion = v, region
+
+	v.Runner = m.workerQueue(worker.Background)
+	go v.IOThreadEntry()
+
+	m.addPCIDevice("mem", v)
+	m.OnShutdown(ShutdownQuiesce, "mem", v.Close)
+	start, end := v.GetIORange()
+	m.registerIOPortHandler(start, end, v.IOInHandler, v.IOOutHandler)
+
+	return nil
+}
+
+// ResizeMemory asks the guest to plug or unplug the blocks of the
+// virtio-mem device until it has size bytes of them, on top of its RAM.
+// The guest does so in its own time; MemoryDevice tells how far it got.
+func (m *Machine) ResizeMemory(size uint64) error {
+	if m.memDevice == nil {
+		return ErrorNoMemoryDevice
+	}
+
+	return m.memDevice.Resize(size)
+}
+
+// MemoryDevice returns the state of the virtio-mem device.
+func (m *Machine) MemoryDevice() (MemoryDevice, error) {
+	if m.memDevice == nil {
+		return MemoryDevice{}, ErrorNoMemoryDevice
+	}
+
+	d := MemoryDevice{Base: memDeviceBase, Size: uint64(len(m.memDeviceRegion))}
+	d.Plugged, d.Requested = m.memDevice.Size()
+
+	return d, nil
+}
+
+func (m *Machine) InjectVirtioMemIRQ() error {
+	if err := kvm.IRQLine(m.vmFd, virtioMemIRQ, 0); err != nil {
+		return err
+	}
+
+	return kvm.IRQLine(m.vmFd, virtioMemIRQ, 1)
+}
@@ -0,0 +1,115 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+const (
+	cpuidFuncExtFeatures = 0x80000001
+
+	// VMX in ECX of CPUID function 1, and SVM in ECX of cpuidFuncExtFeatures.
+	cpuidVMX = 1 << 5
+	cpuidSVM = 1 << 2
+
+	// IA32_FEATURE_CONTROL, which firmware sets up to allow VMXON and locks.
+	msrFeatureControl           = 0x3a
+	featureControlLocked        = 1 << 0
+	featureControlVMXOutsideSMX = 1 << 2
+)
+
+// ErrorNoNested indicates that KVM does not let guests run VMs.
+var ErrorNoNested = errors.New("nested virtualization is not available")
+
+// hideNested clears VMX and SVM from entry, which the vCPUs only get with
+// EnableNested.
+func hideNested(entry *kvm.CPUIDEntry2) {
+	switch entry.Function {
+	case 1:
+		entry.Ecx &^= cpuidVMX
+	case cpuidFuncExtFeatures:
+		entry.Ecx &^= cpuidSVM
+	}
+}
+
+// EnableNested lets the guest run VMs of its own, e.g. KVM inside gokvm.
+// KVM offers VMX or SVM to guests if kvm_intel or kvm_amd was loaded with
+// nested=1; EnableNested puts it in the CPUID of the vCPUs and, for VMX,
+// enables VMXON in IA32_FEATURE_CONTROL and locks it, as firmware does,
+// so that guests booted without firmware can use it. It must come before
+// the vCPUs run.
+func (m *Machine) EnableNested() error {
+	supported := &kvm.CPUID{Nent: uint32(len(m.supportedCPUID.Entries))}
+	if err := kvm.GetSupportedCPUID(m.kvmFd, supported); err != nil {
+		return err
+	}
+
+	fn, bit := uint32(0), uint32(0)
+
+	for _, e := range supported.Entries[:supported.Nent] {
+		switch {
+		case e.Function == 1 && e.Ecx&cpuidVMX != 0:
+			fn, bit = 1, cpuidVMX
+		case e.Function == cpuidFuncExtFeatures && e.Ecx&cpuidSVM != 0:
+			fn, bit = cpuidFuncExtFeatures, cpuidSVM
+		}
+	}
+
+	if bit == 0 {
+		return fmt.Errorf("%w: %s", ErrorNoNested, nestedParams())
+	}
+
+	for i := range m.supportedCPUID.Entries[:m.supportedCPUID.Nent] {
+		if e := &m.supportedCPUID.Entries[i]; e.Function == fn {
+			e.Ecx |= bit
+		}
+	}
+
+	for i := range m.vcpus {
+		if err := m.setCPUID(i); err != nil {
+			return err
+		}
+
+		if bit != cpuidVMX {
+			continue
+		}
+
+		msrs := []kvm.MSREntry{{Index: msrFeatureControl}}
+		if err := kvm.GetMSRs(m.vcpus[i].Fd, msrs); err != nil {
+			return fmt.Errorf("IA32_FEATURE_CONTROL: %w", err)
+		}
+
+		msrs[0].Data |= featureControlLocked | featureControlVMXOutsideSMX
+
+		if err := kvm.SetMSRs(m.vcpus[i].Fd, msrs); err != nil {
+			return fmt.Errorf("IA32_FEATURE_CONTROL: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// nestedParams tells how the nested parameter of the KVM modules is set,
+// e.g. "kvm_intel nested=N", for an ErrorNoNested.
+func nestedParams() string {
+	params := []string{}
+
+	for _, mod := range []string{"kvm_intel", "kvm_amd"} {
+		b, err := os.ReadFile("/sys/module/" + mod + "/parameters/nested")
+		if err != nil {
+			continue
+		}
+
+		params = append(params, mod+" nested="+strings.TrimSpace(string(b)))
+	}
+
+	if len(params) == 0 {
+		return "no VMX or SVM for guests"
+	}
+
+	return strings.Join(params, ", ")
+}
@@ -0,0 +1,146 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+	"github.com/bobuhiro11/gokvm/numa"
+)
+
+// ErrorNUMANodes indicates more guest NUMA nodes than 2MiB pieces of RAM.
+var ErrorNUMANodes = errors.New("too many NUMA nodes for guest RAM")
+
+// NUMANode is a NUMA node of the guest and where it is on the host.
+type NUMANode struct {
+	HostNode int
+	// VCPUs are the indexes of its vCPUs, which run on HostCPUs.
+	VCPUs    []int
+	HostCPUs []int
+	// Base and Size are the range of guest RAM it has, whose pages come
+	// from HostNode.
+	Base, Size uint64
+	// Distances are from this node to each node of the guest, those of
+	// their host nodes.
+	Distances []int
+}
+
+// SetNUMA splits the guest into a NUMA node for each of hostNodes, which
+// it is placed on: guest RAM in as many ranges, bound to the host node of
+// their guest node, and the vCPUs in as many groups, pinned to the CPUs of
+// theirs when they run. It must be called before the vCPUs run.
+func (m *Machine) SetNUMA(hostNodes []int) error {
+	if len(hostNodes) == 0 {
+		return nil
+	}
+
+	// Ranges are in huge pages, so as not to split those of the host.
+	chunk := uint64(len(m.mem)) / uint64(len(hostNodes)) &^ (hugePageSize - 1)
+	if chunk == 0 {
+		return fmt.Errorf("%w: %d", ErrorNUMANodes, len(hostNodes))
+	}
+
+	host, err := numa.Nodes()
+	if err != nil {
+		return err
+	}
+
+	nodes := make([]NUMANode, len(hostNodes))
+
+	for i, id := range hostNodes {
+		h, err := numa.Find(host, id)
+		if err != nil {
+			return err
+		}
+
+		n := &nodes[i]
+		n.HostNode, n.HostCPUs = id, h.CPUs
+		n.Base, n.Size = uint64(i)*chunk, chunk
+
+		if i == len(hostNodes)-1 {
+			n.Size = uint64(len(m.mem)) - n.Base
+		}
+
+		for _, other := range hostNodes {
+			n.Distances = append(n.Distances, distance(host, h, other))
+		}
+	}
+
+	for cpu := range m.vcpus {
+		n := &nodes[cpu*len(nodes)/len(m.vcpus)]
+		if len(n.HostCPUs) == 0 {
+			return fmt.Errorf("vCPU %d on host node %d: %w", cpu, n.HostNode, numa.ErrNoCPUs)
+		}
+
+		n.VCPUs = append(n.VCPUs, cpu)
+	}
+
+	for _, n := range nodes {
+		if err := numa.Bind(m.mem[n.Base:n.Base+n.Size], n.HostNode); err != nil {
+			return err
+		}
+	}
+
+	m.numa = nodes
+
+	return nil
+}
+
+// distance returns the distance from host node h to node id, 10 for h
+// itself.
+func distance(host []numa.Node, h numa.Node, id int) int {
+	if id == h.ID {
+		return 10
+	}
+
+	// The distances of a node are by the order of the nodes.
+	for i, n := range host {
+		if n.ID == id && i < len(h.Distances) {
+			return h.Distances[i]
+		}
+	}
+
+	return 0
+}
+
+// NUMA returns the NUMA nodes of SetNUMA, none without.
+func (m *Machine) NUMA() []NUMANode {
+	return m.numa
+}
+
+// NUMATables returns the SRAT and SLIT that describe the NUMA nodes of
+// SetNUMA to the guest, or nil without them.
+func (m *Machine) NUMATables() (srat, slit []byte) {
+	if len(m.numa) == 0 {
+		return nil, nil
+	}
+
+	nodes := make([]acpi.Node, len(m.numa))
+	distances := make([][]int, len(m.numa))
+
+	for i, n := range m.numa {
+		for _, cpu := range n.VCPUs {
+			// The APIC ID of a vCPU is its index.
+			nodes[i].APICIDs = append(nodes[i].APICIDs, uint8(cpu))
+		}
+
+		nodes[i].Memory = []acpi.MemoryAffinity{{Base: n.Base, Length: n.Size}}
+		distances[i] = n.Distances
+	}
+
+	return acpi.SRAT(nodes), acpi.SLIT(distances)
+}
+
+// pinVCPU pins the calling thread, that of vCPU i, to the host CPUs of its
+// NUMA node if SetNUMA placed it, and returns what restores its CPUs.
+func (m *Machine) pinVCPU(i int) (func() error, error) {
+	for _, n := range m.numa {
+		for _, cpu := range n.VCPUs {
+			if cpu == i {
+				return numa.Pin(n.HostCPUs)
+			}
+		}
+	}
+
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,213 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/memslot"
+)
+
+// Kinds of MemoryRegion.
+const (
+	// RegionRAM is zeroed memory of its own.
+	RegionRAM = "ram"
+	// RegionROM holds the contents of a file, which the guest cannot
+	// change.
+	RegionROM = "rom"
+	// RegionShared is a file mapped shared, or a memfd without one, so
+	// that other processes see what the guest writes, and the other way
+	// round.
+	RegionShared = "shared"
+)
+
+// reservedStart and reservedEnd are what regions must keep clear of below
+// 4GiB: the IOAPIC, the LAPIC, and the identity map and TSS of KVM.
+const (
+	reservedStart = ioapicAddr
+	reservedEnd   = tssAddr + 3*pageSize
+)
+
+// ErrorMemoryRegion indicates a MemoryRegion that AddMemoryRegion cannot
+// map.
+var ErrorMemoryRegion = errors.New("invalid memory region")
+
+// MemoryRegion is a memory region of the guest besides its RAM, e.g. for
+// firmware with an unusual memory map.
+type MemoryRegion struct {
+	// Kind is RegionRAM, RegionROM or RegionShared.
+	Kind      string
+	GPA, Size uint64
+	// File is the contents of a RegionROM, and the backing of a
+	// RegionShared, created or grown to Size if need be.
+	File string
+	// ReadOnly drops the writes of the guest, as to a RegionROM always.
+	ReadOnly bool
+	// DirtyLog has KVM log the pages the guest writes, see DirtyPages.
+	DirtyLog bool
+}
+
+func (r MemoryRegion) String() string {
+	s := fmt.Sprintf("%s [%#x-%#x)", r.Kind, r.GPA, r.GPA+r.Size)
+	if r.File != "" {
+		s += " of " + r.File
+	}
+
+	if r.ReadOnly {
+		s += " read-only"
+	}
+
+	if r.DirtyLog {
+		s += " dirty-logged"
+	}
+
+	return s
+}
+
+// region is a MemoryRegion that AddMemoryRegion mapped.
+type region struct {
+	MemoryRegion
+	slot uint32
+	mem  []byte
+}
+
+func (r MemoryRegion) check() error {
+	switch {
+	case r.Kind != RegionRAM && r.Kind != RegionROM && r.Kind != RegionShared:
+		return fmt.Errorf("%w: kind %q", ErrorMemoryRegion, r.Kind)
+	case r.Size == 0 || r.Size%pageSize != 0 || r.GPA%pageSize != 0:
+		return fmt.Errorf("%w: %v is not a non-empty multiple of %#x", ErrorMemoryRegion, r, pageSize)
+	case r.GPA+r.Size < r.GPA:
+		return fmt.Errorf("%w: %v wraps around", ErrorMemoryRegion, r)
+	case r.GPA < reservedEnd && reservedStart < r.GPA+r.Size:
+		return fmt.Errorf("%w: %v overlaps the APICs at [%#x-%#x)", ErrorMemoryRegion, r, reservedStart, reservedEnd)
+	case r.Kind == RegionROM && r.File == "":
+		return fmt.Errorf("%w: %v without a file", ErrorMemoryRegion, r)
+	case r.Kind == RegionRAM && r.File != "":
+		return fmt.Errorf("%w: %v with a file", ErrorMemoryRegion, r)
+	}
+
+	return nil
+}
+
+// mapRegion maps the memory of r.
+func (m *Machine) mapRegion(r MemoryRegion) ([]byte, error) {
+	switch r.Kind {
+	case RegionROM:
+		rom, err := os.ReadFile(r.File)
+		if err != nil {
+			return nil, err
+		}
+
+		if uint64(len(rom)) > r.Size {
+			return nil, fmt.Errorf("%w: %s of %#x bytes does not fit in %v", ErrorMemoryRegion, r.File, len(rom), r)
+		}
+
+		mem, err := memslot.Map(int(r.Size), memslot.Backing{})
+		if err != nil {
+			return nil, err
+		}
+
+		copy(mem, rom)
+
+		return mem, nil
+	case RegionShared:
+		if r.File == "" {
+			return memslot.Map(int(r.Size), memslot.Backing{Memfd: true})
+		}
+
+		f, err := os.OpenFile(r.File, os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if fi, err := f.Stat(); err != nil {
+			return nil, err
+		} else if uint64(fi.Size()) < r.Size {
+			if err := f.Truncate(int64(r.Size)); err != nil {
+				return nil, err
+			}
+		}
+
+		// The mapping keeps the pages of the file.
+		return syscall.Mmap(int(f.Fd()), 0, int(r.Size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	default:
+		return memslot.Map(int(r.Size), memslot.Backing{})
+	}
+}
+
+// AddMemoryRegion maps r into the guest in a memory slot of its own. It
+// must not overlap guest RAM, other regions, the ROM of LoadROM or the
+// APICs. Regions added before LoadLinux are in the E820 map, as RAM if
+// they are writable RAM and reserved otherwise.
+func (m *Machine) AddMemoryRegion(r MemoryRegion) error {
+	if err := r.check(); err != nil {
+		return err
+	}
+
+	if r.Kind == RegionROM {
+		r.ReadOnly = true
+	}
+
+	if err := m.waitMemory(); err != nil {
+		return err
+	}
+
+	mem, err := m.mapRegion(r)
+	if err != nil {
+		return fmt.Errorf("%v: %w", r, err)
+	}
+
+	flags := uint32(0)
+	if r.ReadOnly {
+		flags |= kvm.MemReadonly
+	}
+
+	if r.DirtyLog {
+		flags |= kvm.MemLogDirtyPages
+	}
+
+	s, err := m.slots.Add(memslot.Region{GPA: r.GPA, Mem: mem, Flags: flags})
+	if err != nil {
+		_ = syscall.Munmap(mem)
+
+		return fmt.Errorf("%v: %w", r, err)
+	}
+
+	m.regions = append(m.regions, region{MemoryRegion: r, slot: s.Slot, mem: mem})
+
+	// Writes to read-only memory exit to userspace, where they are
+	// dropped as by a ROM.
+	if r.ReadOnly {
+		m.registerMMIOHandler(r.GPA, r.GPA+r.Size,
+			func(addr uint64, bytes []byte) error { return nil },
+			func(addr uint64, bytes []byte) error { return nil },
+		)
+	}
+
+	return nil
+}
+
+// DirtyPages returns a bitmap of the pages of the region with DirtyLog at
+// gpa that the guest wrote since the last call, bit i of word i/64 for
+// page i.
+func (m *Machine) DirtyPages(gpa uint64) ([]uint64, error) {
+	for _, r := range m.regions {
+		if r.GPA != gpa {
+			continue
+		}
+
+		if !r.DirtyLog {
+			return nil, fmt.Errorf("%w: %v is not dirty-logged", ErrorMemoryRegion, r.MemoryRegion)
+		}
+
+		bitmap := make([]uint64, (r.Size/pageSize+63)/64)
+
+		return bitmap, kvm.GetDirtyLog(m.vmFd, r.slot, bitmap)
+	}
+
+	return nil, fmt.Errorf("%w: none at %#x", ErrorMemoryRegion, gpa)
+}
@@ -0,0 +1,157 @@
+package machine
+
+import (
+	"errors"
+	"io"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/ebda"
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// ErrorResetSEV indicates a Reset of an SEV guest, whose memory the host
+// cannot load the kernel into again.
+var ErrorResetSEV = errors.New("cannot reset an SEV guest")
+
+// linuxImage is what LoadLinux loaded.
+type linuxImage struct {
+	kernel, initrd io.ReaderAt
+	params         string
+}
+
+// resetState is the state of a vCPU as KVM created it, that of a reset.
+type resetState struct {
+	regs   kvm.Regs
+	sregs  kvm.Sregs
+	events kvm.VCPUEvents
+	mp     uint32
+}
+
+// saveResetState saves the state of the vCPUs as created, before anything
+// sets up their registers. SEV guests, which Reset refuses, have none.
+func (m *Machine) saveResetState() error {
+	if m.sev != nil {
+		return nil
+	}
+
+	m.resetStates = make([]resetState, len(m.vcpus))
+
+	for i, v := range m.vcpus {
+		s := &m.resetStates[i]
+
+		var err error
+
+		if s.regs, err = kvm.GetRegs(v.Fd); err != nil {
+			return err
+		}
+
+		if s.sregs, err = kvm.GetSregs(v.Fd); err != nil {
+			return err
+		}
+
+		if s.events, err = kvm.GetVCPUEvents(v.Fd); err != nil {
+			return err
+		}
+
+		if s.mp, err = kvm.GetMPState(v.Fd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeEBDA writes the EBDA, with the MP table of the vCPUs and IOAPIC.
+func (m *Machine) writeEBDA() error {
+	e, err := ebda.New(len(m.vcpus))
+	if err != nil {
+		return err
+	}
+
+	bytes, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+
+	copy(m.mem[bootparam.EBDAStart:], bytes)
+
+	return nil
+}
+
+// Reset resets the machine after the guest asked for it, e.g. with
+// ErrorGuestReset, as a reboot does: it stops the vCPUs and puts them
+// back in the state they were created in, with the APs waiting for INIT
+// and SIPI again, and loads the kernel of LoadLinux again, or leaves the
+// vCPUs at the reset vector of the ROM of LoadROM. Devices reset as the
+// guest drivers set them up again. Guest RAM is kept, as on a warm reset.
+// The vCPUs then start anew with Run or RunInfiniteLoop. TrackWorkingSet
+// ends with the reset.
+func (m *Machine) Reset() error {
+	if m.sev != nil {
+		return ErrorResetSEV
+	}
+
+	m.Shutdown()
+
+	if m.workingSet != nil {
+		<-m.workingSet.stopped
+		m.workingSet = nil
+	}
+
+	for i, v := range m.vcpus {
+		s := m.resetStates[i]
+
+		// What KVM synced at the last exit is of the old state.
+		m.regsSynced[i] = false
+		v.Run.DirtyRegs = 0
+
+		if err := kvm.SetRegs(v.Fd, s.regs); err != nil {
+			return err
+		}
+
+		if err := kvm.SetSregs(v.Fd, s.sregs); err != nil {
+			return err
+		}
+
+		if err := kvm.SetVCPUEvents(v.Fd, s.events); err != nil {
+			return err
+		}
+
+		if err := kvm.SetMPState(v.Fd, s.mp); err != nil {
+			return err
+		}
+	}
+
+	if err := m.resetKVMClock(); err != nil {
+		return err
+	}
+
+	if err := m.writeEBDA(); err != nil {
+		return err
+	}
+
+	m.writeSMBIOS()
+
+	if m.shadowBIOS {
+		m.copyBIOS()
+	}
+
+	if m.linux != nil {
+		if err := m.loadLinux(m.linux.kernel, m.linux.initrd, m.linux.params); err != nil {
+			return err
+		}
+	}
+
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	if m.pausing {
+		m.pausing, m.kvmClockSaved = false, false
+		m.clock.Resume()
+	}
+
+	m.stopping = false
+	m.exitCode = 0
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bobuhiro11/gokvm/output"
+	"github.com/bobuhiro11/gokvm/sandbox"
+)
+
+// ErrorNoBlk indicates a request for the virtio-blk device of a machine
+// without a disk.
+var ErrorNoBlk = errors.New("no virtio-blk device")
+
+// SandboxBlk moves the disk of the virtio-blk device into a helper process
+// of package sandbox, which gokvm passes its requests to, so that only the
+// helper touches the image. It must be called before the guest runs.
+func (m *Machine) SandboxBlk() error {
+	if m.blk == nil {
+		return ErrorNoBlk
+	}
+
+	f, ok := m.blk.Backend().(*os.File)
+	if !ok {
+		return fmt.Errorf("%w: disk already sandboxed", sandbox.ErrBackend)
+	}
+
+	d, err := sandbox.StartDisk(f)
+	if err != nil {
+		return err
+	}
+
+	m.blk.SetBackend(d)
+	m.out.Event("sandbox", output.Fields{"device": "blk", "pid": d.Pid()},
+		"virtio-blk disk served by sandbox helper %d", d.Pid())
+
+	return nil
+}
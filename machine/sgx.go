@@ -0,0 +1,112 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/memslot"
+)
+
+// EPC sections are mapped one after another from epcBase, above 4GiB and
+// so clear of RAM and firmware.
+const (
+	epcBase = 1 << 32
+
+	// cpuidSGXEPCSection is the subleaf of CPUIDFuncSGX for the first EPC
+	// section, and cpuidSGXValid the type of such a subleaf and property
+	// of its section, which has confidentiality and integrity protection.
+	cpuidSGXEPCSection = 2
+	cpuidSGXValid      = 1
+
+	// SGX in EBX of CPUIDFuncExtFeatures and SGX1 in EAX of subleaf 0 of
+	// CPUIDFuncSGX.
+	cpuidSGX  = 1 << 2
+	cpuidSGX1 = 1 << 0
+)
+
+// ErrorNoSGX indicates an EPC for a guest that KVM cannot give SGX.
+var ErrorNoSGX = errors.New("SGX is not available to guests")
+
+// ErrorEPCSize indicates an EPC section that is not a multiple of pages.
+var ErrorEPCSize = fmt.Errorf("EPC size must be a non-zero multiple of %#x", pageSize)
+
+// AddEPC gives the guest an EPC section of size bytes, enclave page cache
+// that the virtual EPC device at path, usually /dev/sgx_vepc, takes from
+// the host, so that it can run SGX enclaves. The guest finds it in CPUID,
+// as each section of real hardware. It must come before the vCPUs run.
+func (m *Machine) AddEPC(path string, size uint64) error {
+	if size == 0 || size%pageSize != 0 {
+		return fmt.Errorf("%w: %#x", ErrorEPCSize, size)
+	}
+
+	if !m.hasSGX() {
+		return ErrorNoSGX
+	}
+
+	if int(m.supportedCPUID.Nent) == len(m.supportedCPUID.Entries) {
+		return fmt.Errorf("%w: no room in CPUID for another EPC section", ErrorNoSGX)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The mapping keeps the EPC of the device, which the file is not
+	// needed for.
+	epc, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap %s: %w", path, err)
+	}
+
+	base := uint64(epcBase)
+	for _, s := range m.epc {
+		base += uint64(len(s))
+	}
+
+	if _, err := m.slots.Add(memslot.Region{GPA: base, Mem: epc}); err != nil {
+		_ = syscall.Munmap(epc)
+
+		return fmt.Errorf("EPC: %w", err)
+	}
+
+	m.supportedCPUID.Entries[m.supportedCPUID.Nent] = kvm.CPUIDEntry2{
+		Function: kvm.CPUIDFuncSGX,
+		Index:    uint32(cpuidSGXEPCSection + len(m.epc)),
+		Flags:    kvm.CPUIDFlagSignificantIndex,
+		Eax:      uint32(base) | cpuidSGXValid,
+		Ebx:      uint32(base >> 32),
+		Ecx:      uint32(size) | cpuidSGXValid,
+		Edx:      uint32(size >> 32),
+	}
+	m.supportedCPUID.Nent++
+	m.epc = append(m.epc, epc)
+
+	for i := range m.vcpus {
+		if err := m.setCPUID(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasSGX tells whether the CPUID of the vCPUs, as KVM supports it, has SGX.
+func (m *Machine) hasSGX() bool {
+	sgx, sgx1 := false, false
+
+	for _, e := range m.supportedCPUID.Entries[:m.supportedCPUID.Nent] {
+		switch {
+		case e.Function == kvm.CPUIDFuncExtFeatures && e.Index == 0:
+			sgx = e.Ebx&cpuidSGX != 0
+		case e.Function == kvm.CPUIDFuncSGX && e.Index == 0:
+			sgx1 = e.Eax&cpuidSGX1 != 0
+		}
+	}
+
+	return sgx && sgx1
+}
@@ -0,0 +1,35 @@
+package machine
+
+import (
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/smbios"
+)
+
+// The SMBIOS entry point is where a guest without EFI looks for it: on a
+// 16-byte boundary at the start of the F segment, which E820 reserves.
+// The tables follow it.
+const (
+	smbiosEntryAddr = bootparam.MBBIOSBegin
+	smbiosTableAddr = smbiosEntryAddr + 0x20
+)
+
+// SetSMBIOS sets what the SMBIOS tables of the guest tell about the
+// machine, e.g. its serial number and UUID, instead of the defaults.
+func (m *Machine) SetSMBIOS(info smbios.Info) {
+	m.smbios = info
+	m.writeSMBIOS()
+}
+
+func (m *Machine) smbiosTables() *smbios.Tables {
+	return smbios.New(m.smbios, len(m.vcpus), uint64(len(m.mem)))
+}
+
+// writeSMBIOS writes the SMBIOS entry point and tables to guest RAM, for a
+// kernel booted directly. Firmware gets them through fw_cfg instead, see
+// AddFwCfg.
+func (m *Machine) writeSMBIOS() {
+	t := m.smbiosTables()
+
+	copy(m.mem[smbiosEntryAddr:], t.EntryPoint(smbiosTableAddr))
+	copy(m.mem[smbiosTableAddr:], t.Data)
+}
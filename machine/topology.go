@@ -0,0 +1,115 @@
+package machine
+
+import (
+	"math/bits"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// CPUID functions that describe the topology of the vCPUs, which are
+// cores of one package with one thread each, with the vCPU index as APIC
+// ID, as KVM gives them.
+const (
+	cpuidFuncCacheParams = 0x4
+	cpuidFuncTopology    = 0xb
+	cpuidFuncTopologyV2  = 0x1f
+	cpuidFuncAddrSizes   = 0x80000008
+	cpuidFuncAMDTopology = 0x8000001e
+
+	// cpuidHTT in EDX of CPUID function 1 tells that EBX has the number of
+	// logical processors of the package.
+	cpuidHTT = 1 << 28
+
+	// Level types of cpuidFuncTopology.
+	topologyLevelSMT  = 1
+	topologyLevelCore = 2
+)
+
+// setCPUID sets the CPUID of vCPU i, the CPUID of the machine with the
+// topology filled in.
+func (m *Machine) setCPUID(i int) error {
+	return kvm.SetCPUID2(m.vcpus[i].Fd, topologyCPUID(m.supportedCPUID, i, len(m.vcpus)))
+}
+
+// topologyCPUID returns a copy of c for vCPU i of n, with its APIC ID and
+// the number of cores in the leaves that tell the topology, so that guests
+// find all vCPUs and where each one is.
+func topologyCPUID(c *kvm.CPUID, i, n int) *kvm.CPUID {
+	t := *c
+	id := uint32(i)
+
+	// coreBits are the bits of the APIC ID that number the cores.
+	coreBits := uint32(bits.Len(uint(n - 1)))
+
+	// KVM may only have subleaf 0 of the topology leaves, which are
+	// rebuilt.
+	topology := map[uint32]bool{}
+	entries := t.Entries[:0]
+
+	for _, e := range t.Entries[:t.Nent] {
+		if e.Function == cpuidFuncTopology || e.Function == cpuidFuncTopologyV2 {
+			topology[e.Function] = true
+
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	for _, fn := range []uint32{cpuidFuncTopology, cpuidFuncTopologyV2} {
+		if !topology[fn] || len(entries)+3 > len(t.Entries) {
+			continue
+		}
+
+		entries = append(entries,
+			kvm.CPUIDEntry2{Function: fn, Index: 0, Flags: kvm.CPUIDFlagSignificantIndex,
+				Ebx: 1, Ecx: topologyLevelSMT << 8, Edx: id},
+			kvm.CPUIDEntry2{Function: fn, Index: 1, Flags: kvm.CPUIDFlagSignificantIndex,
+				Eax: coreBits, Ebx: uint32(n), Ecx: 1 | topologyLevelCore<<8, Edx: id},
+			kvm.CPUIDEntry2{Function: fn, Index: 2, Flags: kvm.CPUIDFlagSignificantIndex,
+				Ecx: 2, Edx: id},
+		)
+	}
+
+	t.Nent = uint32(len(entries))
+
+	for j := range t.Entries[:t.Nent] {
+		e := &t.Entries[j]
+
+		switch e.Function {
+		case 1:
+			e.Ebx = e.Ebx&0xffff | id<<24 | min32(1<<coreBits, 0xff)<<16
+			if n > 1 {
+				e.Edx |= cpuidHTT
+			}
+		case cpuidFuncCacheParams:
+			if e.Eax&0x1f == 0 {
+				continue
+			}
+
+			// Caches up to L2 are per core, L3 shared by all of them.
+			sharing := uint32(0)
+			if e.Eax>>5&0x7 >= 3 {
+				sharing = 1<<coreBits - 1
+			}
+
+			e.Eax = e.Eax&0x3fff | min32(sharing, 0xfff)<<14 | min32(1<<coreBits-1, 0x3f)<<26
+		case cpuidFuncAddrSizes:
+			e.Ecx = e.Ecx&^0xf0ff | coreBits<<12 | uint32(n-1)&0xff
+		case cpuidFuncAMDTopology:
+			e.Eax = id
+			e.Ebx = e.Ebx&^0xffff | id&0xff
+			e.Ecx &^= 0xff
+		}
+	}
+
+	return &t
+}
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,157 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/output"
+	"github.com/bobuhiro11/gokvm/serial"
+	"github.com/bobuhiro11/gokvm/term"
+)
+
+// ErrorUART indicates a serial port AddUART cannot add.
+var ErrorUART = errors.New("serial port must be one of COM2 to COM4, added once")
+
+// comPorts are the I/O ports and IRQs of COM1 to COM4, where Linux finds
+// them as ttyS0 to ttyS3. COM1 is the serial console.
+var comPorts = [...]struct {
+	addr uint64
+	irq  uint32
+}{
+	{serial.COM1Addr, serialIRQ},
+	{serial.COM2Addr, 3},
+	{serial.COM3Addr, serialIRQ},
+	{serial.COM4Addr, 3},
+}
+
+// uartIRQ raises the edge-triggered interrupt of a UART, which the UARTs
+// on it share as on ISA.
+type uartIRQ struct {
+	m   *Machine
+	irq uint32
+}
+
+func (u uartIRQ) InjectSerialIRQ() error {
+	if err := kvm.IRQLine(u.m.vmFd, u.irq, 0); err != nil {
+		return err
+	}
+
+	return kvm.IRQLine(u.m.vmFd, u.irq, 1)
+}
+
+// AddUART adds COMn, 2 to 4, e.g. for kgdb or a log of its own apart from
+// the console. Its backend is path, a file it writes to, or with a unix:
+// or tcp: prefix a Unix socket or TCP port that gokvm listens on for one
+// connection at a time, which it writes to and takes the input of, or
+// "pty" for a pseudo-terminal. The socket or pseudo-terminal is reported
+// as a listen or pty event.
+func (m *Machine) AddUART(n int, path string) error {
+	if n < 2 || n > len(comPorts) || m.uarts[n-1] != nil {
+		return fmt.Errorf("%w: COM%d", ErrorUART, n)
+	}
+
+	p := comPorts[n-1]
+
+	u, err := serial.NewAt(p.addr, uartIRQ{m, p.irq})
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("COM%d", n)
+
+	switch {
+	case strings.HasPrefix(path, "unix:") || strings.HasPrefix(path, "tcp:"):
+		var l *serial.Listener
+
+		if l, err = serial.Listen(path); err == nil {
+			m.out.Event("listen", output.Fields{"port": name, "addr": l.Addr().String()},
+				"%s: listening on %s", name, l.Addr())
+			m.bridgeUART(name, u, l)
+		}
+	case path == "pty":
+		var p *term.PTY
+
+		if p, err = term.OpenPTY(); err == nil {
+			m.out.Event("pty", output.Fields{"port": name, "path": p.Path}, "%s: char device redirected to %s", name, p.Path)
+			m.bridgeUART(name, u, p)
+		}
+	default:
+		err = m.writeUART(u, path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	m.uarts[n-1] = u
+	m.registerUARTs()
+
+	return nil
+}
+
+func (m *Machine) writeUART(u *serial.Serial, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	u.SetOutput(f)
+	m.OnShutdown(ShutdownQuiesce, "uart "+path, f.Close)
+
+	return nil
+}
+
+// bridgeUART passes bytes both ways between u and rw, a backend that
+// programs connect to and go away from while the guest runs, until it is
+// closed on shutdown.
+func (m *Machine) bridgeUART(name string, u *serial.Serial, rw io.ReadWriteCloser) {
+	u.SetOutput(rw)
+	m.OnShutdown(ShutdownQuiesce, "uart "+name, rw.Close)
+
+	go func() {
+		err := m.readUART(u, rw)
+		if err != nil && !errors.Is(err, os.ErrClosed) && !errors.Is(err, net.ErrClosed) {
+			m.out.Event("uart_error", output.Fields{"port": name, "error": err}, "%s: %v", name, err)
+		}
+	}()
+}
+
+// readUART sends what comes from r to the guest through u, until r ends.
+func (m *Machine) readUART(u *serial.Serial, r io.Reader) error {
+	buf := make([]byte, 256)
+	in := u.GetInputChan()
+
+	for {
+		n, err := r.Read(buf)
+
+		for _, b := range buf[:n] {
+			in <- b
+		}
+
+		if n > 0 {
+			if err := u.Receive(); err != nil {
+				return err
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// registerUARTs has the UARTs that AddUART added take their I/O ports.
+func (m *Machine) registerUARTs() {
+	for i, u := range m.uarts {
+		if u != nil {
+			m.registerIOPortHandler(comPorts[i].addr, comPorts[i].addr+8, u.In, u.Out)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package machine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// ErrorNotMapped indicates a guest virtual address that the page tables of
+// the vCPU do not map, or that maps to no memory slot.
+var ErrorNotMapped = errors.New("guest virtual address not mapped")
+
+// ErrorReadOnlyMemory indicates a write by virtual address to read-only
+// memory, e.g. the ROM of LoadROM.
+var ErrorReadOnlyMemory = errors.New("guest memory is read-only")
+
+// Translate returns the guest physical address that gva maps to in the
+// page tables of vCPU cpu. Like ReadVirtual and WriteVirtual, it must be
+// called with the vCPUs paused, or from an exit handler of vCPU cpu, as
+// KVM does not walk the page tables of a vCPU in KVM_RUN.
+func (m *Machine) Translate(cpu int, gva uint64) (uint64, error) {
+	// Special registers that SetSregs left for KVM to load on the next
+	// entry are loaded now, as KVM walks the page tables of those it has.
+	if run := m.vcpus[cpu].Run; run.DirtyRegs&kvm.SyncX86Sregs != 0 {
+		if err := kvm.SetSregs(m.vcpus[cpu].Fd, run.SyncRegs.Sregs); err != nil {
+			return 0, err
+		}
+
+		run.DirtyRegs &^= kvm.SyncX86Sregs
+	}
+
+	t, err := kvm.Translate(m.vcpus[cpu].Fd, gva)
+	if err != nil {
+		return 0, err
+	}
+
+	if t.Valid == 0 {
+		return 0, fmt.Errorf("%w: %#x on vCPU %d", ErrorNotMapped, gva, cpu)
+	}
+
+	return t.PhysicalAddress, nil
+}
+
+// virtual calls f with the memory of each page that b spans from gva, as
+// vCPU cpu maps it, and the part of b for it. Pages need not be next to
+// each other in guest physical memory, or even in the same memory slot.
+func (m *Machine) virtual(cpu int, gva uint64, b []byte, write bool, f func(mem, b []byte)) error {
+	if err := m.waitMemory(); err != nil {
+		return err
+	}
+
+	for len(b) > 0 {
+		n := pageSize - int(gva%pageSize)
+		if n > len(b) {
+			n = len(b)
+		}
+
+		gpa, err := m.Translate(cpu, gva)
+		if err != nil {
+			return err
+		}
+
+		r, ok := m.slots.Find(gpa)
+		if !ok || gpa+uint64(n) > r.End() {
+			return fmt.Errorf("%w: %#x at %#x on vCPU %d", ErrorNotMapped, gva, gpa, cpu)
+		}
+
+		if write && r.Flags&kvm.MemReadonly != 0 {
+			return fmt.Errorf("%w: %#x at %#x on vCPU %d", ErrorReadOnlyMemory, gva, gpa, cpu)
+		}
+
+		f(r.Mem[gpa-r.GPA:gpa-r.GPA+uint64(n)], b[:n])
+
+		gva += uint64(n)
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// ReadVirtual reads len(b) bytes of guest memory from the guest virtual
+// address gva of vCPU cpu, e.g. the stack at its RSP, page by page.
+func (m *Machine) ReadVirtual(cpu int, gva uint64, b []byte) error {
+	return m.virtual(cpu, gva, b, false, func(mem, b []byte) { copy(b, mem) })
+}
+
+// WriteVirtual writes b to guest memory at the guest virtual address gva
+// of vCPU cpu, whether or not the page tables let the guest write there,
+// as a debugger sets breakpoints in code. Nothing is written if a page of
+// b is not mapped or read-only.
+func (m *Machine) WriteVirtual(cpu int, gva uint64, b []byte) error {
+	if err := m.virtual(cpu, gva, b, true, func(mem, b []byte) {}); err != nil {
+		return err
+	}
+
+	return m.virtual(cpu, gva, b, true, func(mem, b []byte) { copy(mem, b) })
+}
+
+// ReadVirtualString reads the NUL-terminated string at the guest virtual
+// address gva of vCPU cpu, of at most limit bytes, without reading past the
+// page of the NUL, which may be the last mapped one.
+func (m *Machine) ReadVirtualString(cpu int, gva uint64, limit int) (string, error) {
+	s := []byte{}
+
+	for len(s) < limit {
+		n := pageSize - int(gva%pageSize)
+		if n > limit-len(s) {
+			n = limit - len(s)
+		}
+
+		b := make([]byte, n)
+		if err := m.ReadVirtual(cpu, gva, b); err != nil {
+			return "", err
+		}
+
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			return string(append(s, b[:i]...)), nil
+		}
+
+		s = append(s, b...)
+		gva += uint64(n)
+	}
+
+	return string(s), nil
+}
@@ -0,0 +1,167 @@
+package machine
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// VCPUState is where a vCPU is in RunInfiniteLoop.
+type VCPUState int
+
+const (
+	// VCPUCreated has not run yet.
+	VCPUCreated VCPUState = iota
+	// VCPURunning is in KVM_RUN, in the guest.
+	VCPURunning
+	// VCPUHalted waits for an interrupt after HLT, in KVM_RUN with the
+	// in-kernel irqchip, or has left RunInfiniteLoop because of HLT.
+	VCPUHalted
+	// VCPUInExit handles an exit in gokvm.
+	VCPUInExit
+	// VCPUBlockedOnDevice waits for a device to handle its I/O or MMIO.
+	VCPUBlockedOnDevice
+	// VCPUPaused waits for Resume.
+	VCPUPaused
+	// VCPUStopped has left RunInfiniteLoop.
+	VCPUStopped
+)
+
+func (s VCPUState) String() string {
+	switch s {
+	case VCPUCreated:
+		return "created"
+	case VCPURunning:
+		return "running"
+	case VCPUHalted:
+		return "halted"
+	case VCPUInExit:
+		return "in-exit"
+	case VCPUBlockedOnDevice:
+		return "blocked-on-device"
+	case VCPUPaused:
+		return "paused"
+	case VCPUStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("VCPUState(%d)", int(s))
+	}
+}
+
+// VCPUInfo is the state of a vCPU, as QueryVCPUs returns it.
+type VCPUInfo struct {
+	Index int
+	State VCPUState
+	// Since is when the vCPU entered State.
+	Since time.Time
+	// Exit is the reason of the last exit, and Detail tells more about
+	// the state, e.g. the port a device has yet to handle.
+	Exit   kvm.ExitType
+	Detail string
+}
+
+func (v VCPUInfo) String() string {
+	s := fmt.Sprintf("vCPU %d: %s for %v, last exit %s", v.Index, v.State,
+		time.Since(v.Since).Round(time.Millisecond), v.Exit)
+
+	if v.Detail != "" {
+		s += ", " + v.Detail
+	}
+
+	return s
+}
+
+// vcpuStates records the state of each vCPU as it goes round
+// RunInfiniteLoop.
+type vcpuStates struct {
+	mu    sync.Mutex
+	infos []VCPUInfo
+}
+
+func newVCPUStates(n int) *vcpuStates {
+	s := &vcpuStates{infos: make([]VCPUInfo, n)}
+	now := time.Now()
+
+	for i := range s.infos {
+		s.infos[i] = VCPUInfo{Index: i, State: VCPUCreated, Since: now}
+	}
+
+	return s
+}
+
+// set moves vCPU i to state. Staying in a state keeps its Since.
+func (s *vcpuStates) set(i int, state VCPUState, detail string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.infos[i].State != state {
+		s.infos[i].State = state
+		s.infos[i].Since = time.Now()
+	}
+
+	s.infos[i].Detail = detail
+}
+
+// stop records that vCPU i left RunInfiniteLoop, which it did because of
+// HLT if it is halted.
+func (s *vcpuStates) stop(i int, detail string) {
+	s.mu.Lock()
+	state := s.infos[i].State
+	s.mu.Unlock()
+
+	if state != VCPUHalted {
+		s.set(i, VCPUStopped, detail)
+	}
+}
+
+// exit records the exit vCPU i is about to handle.
+func (s *vcpuStates) exit(i int, exit kvm.ExitType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.infos[i].State = VCPUInExit
+	s.infos[i].Since = time.Now()
+	s.infos[i].Exit = exit
+	s.infos[i].Detail = ""
+}
+
+func (s *vcpuStates) get() []VCPUInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]VCPUInfo{}, s.infos...)
+}
+
+// QueryVCPUs returns the state of every vCPU, e.g. to tell which one a
+// hung guest is stuck on. It does not disturb them.
+func (m *Machine) QueryVCPUs() []VCPUInfo {
+	infos := m.vcpuStates.get()
+
+	// A vCPU that halts with the in-kernel irqchip stays in KVM_RUN.
+	// The blocking stat of KVM tells it apart.
+	for i := range infos {
+		if infos[i].State != VCPURunning || m.vcpuStats[i] == nil {
+			continue
+		}
+
+		if stats, err := m.vcpuStats[i].Read(); err == nil && stats["blocking"] != 0 {
+			infos[i].State = VCPUHalted
+		}
+	}
+
+	return infos
+}
+
+// WriteVCPUs writes the state of every vCPU, one per line.
+func (m *Machine) WriteVCPUs(w io.Writer) error {
+	for _, v := range m.QueryVCPUs() {
+		if _, err := fmt.Fprintf(w, "%v\r\n", v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/idle"
+	"github.com/bobuhiro11/gokvm/output"
+)
+
+// ErrorNoWorkingSet indicates working set stats of a machine that does not
+// track them, see TrackWorkingSet.
+var ErrorNoWorkingSet = errors.New("working set is not tracked")
+
+// workingSet tracks which pages of guest RAM the guest uses.
+type workingSet struct {
+	tracker *idle.Tracker
+	// done is closed by Stop, and stopped once the scans stopped.
+	done, stopped chan struct{}
+
+	// hugePages promotes hot regions to huge pages after each scan, if
+	// set by PromoteHugePages.
+	hugePages *hugePages
+}
+
+// TrackWorkingSet scans guest RAM for pages the guest accessed every
+// interval, for WorkingSet. It needs idle page tracking of the host and
+// CAP_SYS_ADMIN.
+func (m *Machine) TrackWorkingSet(interval time.Duration) error {
+	if m.workingSet != nil {
+		return nil
+	}
+
+	t, err := idle.NewTracker(m.mem)
+	if err != nil {
+		return fmt.Errorf("track working set: %w", err)
+	}
+
+	m.workingSet = &workingSet{tracker: t, done: make(chan struct{}), stopped: make(chan struct{})}
+
+	go func() {
+		defer close(m.workingSet.stopped)
+		defer t.Close()
+
+		if err := m.scanWorkingSet(interval); err != nil {
+			m.out.Event("working_set_error", output.Fields{"error": err}, "working set: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// scanWorkingSet scans guest RAM every interval until Stop.
+func (m *Machine) scanWorkingSet(interval time.Duration) error {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-m.workingSet.done:
+			return nil
+		case <-tick.C:
+			if _, err := m.workingSet.tracker.Scan(); err != nil {
+				return err
+			}
+
+			if h := m.workingSet.hugePages; h != nil {
+				h.promote(m.mem, m.workingSet.tracker)
+			}
+		}
+	}
+}
+
+// WorkingSet returns the hot and cold pages of guest RAM at the last scan
+// of TrackWorkingSet.
+func (m *Machine) WorkingSet() (idle.Stats, error) {
+	if m.workingSet == nil {
+		return idle.Stats{}, ErrorNoWorkingSet
+	}
+
+	return m.workingSet.tracker.Last(), nil
+}
@@ -0,0 +1,49 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// x2apicAPIFlags are the flags of kvm.CapX2APICAPI that the machine needs
+// for interrupts to reach APIC IDs above 0xff.
+const x2apicAPIFlags = kvm.X2APICAPIUse32BitIDs | kvm.X2APICAPIDisableBroadcastQuirk
+
+// ErrorNoX2APICAPI indicates an interrupt to an APIC ID above 0xff, which
+// KVM without the x2APIC API cannot deliver.
+var ErrorNoX2APICAPI = errors.New("x2APIC API is not available")
+
+// enableX2APICAPI has KVM take 32-bit APIC IDs in MSIs, as guests in
+// x2APIC mode with more than 255 vCPUs or x2APIC-only topologies need.
+// Kernels without it leave the machine to 8-bit IDs.
+func (m *Machine) enableX2APICAPI() error {
+	flags, err := kvm.CheckExtension(m.vmFd, kvm.CapX2APICAPI)
+	if err != nil || flags&x2apicAPIFlags != x2apicAPIFlags {
+		return nil
+	}
+
+	if err := kvm.EnableCap(m.vmFd, &kvm.EnableCapability{
+		Cap:  kvm.CapX2APICAPI,
+		Args: [4]uint64{x2apicAPIFlags},
+	}); err != nil {
+		return fmt.Errorf("enable x2APIC API: %w", err)
+	}
+
+	m.x2apicAPI = true
+
+	return nil
+}
+
+// SignalMSI sends an MSI of vector to the vCPU with the APIC ID dest and
+// returns whether the guest took it, rather than having it masked.
+func (m *Machine) SignalMSI(dest uint32, vector uint8) (bool, error) {
+	if dest > 0xff && !m.x2apicAPI {
+		return false, fmt.Errorf("%w: APIC ID %#x", ErrorNoX2APICAPI, dest)
+	}
+
+	msi := kvm.NewMSI(dest, vector)
+
+	return kvm.SignalMSI(m.vmFd, &msi)
+}
@@ -2,71 +2,1283 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/bobuhiro11/gokvm/agent"
+	"github.com/bobuhiro11/gokvm/cbfs"
+	"github.com/bobuhiro11/gokvm/chipset"
+	"github.com/bobuhiro11/gokvm/consolelog"
+	"github.com/bobuhiro11/gokvm/control"
+	"github.com/bobuhiro11/gokvm/cpuid"
+	"github.com/bobuhiro11/gokvm/expect"
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/flash"
+	"github.com/bobuhiro11/gokvm/fwcfg"
+	"github.com/bobuhiro11/gokvm/hostcheck"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/linuxboot"
 	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/memslot"
+	"github.com/bobuhiro11/gokvm/output"
+	"github.com/bobuhiro11/gokvm/payload"
+	"github.com/bobuhiro11/gokvm/probe"
+	"github.com/bobuhiro11/gokvm/sandbox"
+	"github.com/bobuhiro11/gokvm/serial"
+	"github.com/bobuhiro11/gokvm/snapshot"
+	"github.com/bobuhiro11/gokvm/startup"
+	"github.com/bobuhiro11/gokvm/stub"
 	"github.com/bobuhiro11/gokvm/term"
+	"github.com/bobuhiro11/gokvm/virtio"
 )
 
+// out is where gokvm reports its log and the lifecycle events of the
+// guest, see -output.
+var out, _ = output.New(os.Stderr, output.Text)
+
 func main() {
-	kvmPath, kernelPath, initrdPath, params, tapIfName, diskPath, nCpus, err := flag.ParseArgs(os.Args)
+	// A sandboxed device backend is gokvm executed again, and never gets
+	// further.
+	sandbox.RunHelper()
+
+	t := startup.Start()
+
+	args, err := flag.ParseArgs(os.Args)
+	if err != nil {
+		log.Fatalf("ParseArgs: %v", err)
+	}
+
+	setOutput(args)
+	t.Mark("parse flags")
+
+	switch {
+	case args.Subcommand == flag.SubcommandSnapshot:
+		manageSnapshots(args)
+	case args.Subcommand == flag.SubcommandCPUID:
+		showCPUID(args)
+	case args.Subcommand == flag.SubcommandProbe:
+		r, err := probe.Probe(args.Dev)
+		if err != nil {
+			log.Fatalf("probe: %v", err)
+		}
+
+		if err := r.Write(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case args.Ephemeral:
+		code := ephemeral(args, t)
+		out.Event("exit", output.Fields{"status": code}, "")
+		os.Exit(code)
+	default:
+		boot(args, t)
+	}
+}
+
+// setOutput has the log and events go to the fd of -output-fd in the
+// format of -output.
+func setOutput(args *flag.Args) {
+	w := os.Stderr
+
+	if args.OutputFD != int(os.Stderr.Fd()) {
+		w = os.NewFile(uintptr(args.OutputFD), "output")
+		if _, err := w.Stat(); err != nil {
+			log.Fatalf("-output-fd: %v", err)
+		}
+	}
+
+	o, err := output.New(w, args.Output)
+	if err != nil {
+		log.Fatalf("-output: %v", err)
+	}
+
+	// JSON lines carry their own time.
+	if o.IsJSON() {
+		log.SetFlags(0)
+	}
+
+	log.SetOutput(o)
+	out = o
+}
+
+// manageSnapshots runs the operation of the snapshot subcommand.
+func manageSnapshots(args *flag.Args) {
+	s, err := snapshot.OpenStore(args.SnapshotDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args.Command[0] {
+	case "list":
+		err = s.WriteTree(os.Stdout)
+	case "branch":
+		err = s.Branch(args.Command[1], args.Command[2])
+	case "delete":
+		err = s.Delete(args.Command[1])
+	case "gc":
+		var n int
+
+		n, err = s.GC()
+		fmt.Printf("removed %d shards\n", n)
+	}
+
+	if err != nil {
+		log.Fatalf("snapshot %s: %v", args.Command[0], err)
+	}
+}
+
+// showCPUID prints how the CPUID of the vCPUs of a machine set up with
+// the flags that affect it differs from what KVM supports and emulates.
+func showCPUID(args *flag.Args) {
+	m, err := machine.New(args.Dev, 1, "", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if args.Nested {
+		if err := m.EnableNested(); err != nil {
+			log.Fatalf("-nested: %v", err)
+		}
+	}
+
+	if args.SGXEPC != 0 {
+		if err := m.AddEPC(args.SGXVEPC, uint64(args.SGXEPC)<<20); err != nil {
+			log.Fatalf("-sgx-epc: %v", err)
+		}
+	}
+
+	devKVM, err := os.OpenFile(args.Dev, os.O_RDWR, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer devKVM.Close()
+
+	supported, emulated := &kvm.CPUID{Nent: 100}, &kvm.CPUID{Nent: 100}
+
+	if err := kvm.GetSupportedCPUID(devKVM.Fd(), supported); err != nil {
+		log.Fatalf("KVM_GET_SUPPORTED_CPUID: %v", err)
+	}
+
+	if err := kvm.GetEmulatedCPUID(devKVM.Fd(), emulated); err != nil {
+		log.Fatalf("KVM_GET_EMULATED_CPUID: %v", err)
+	}
+
+	if err := cpuid.Write(os.Stdout, cpuid.Compare(supported, emulated, m.CPUID())); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// images returns the kernel and initrd to boot: the payload of a
+// LinuxBoot flash image, or the kernel file with either the initrd file
+// or one freshly built by u-root.
+func images(args *flag.Args) (io.ReaderAt, io.ReaderAt) {
+	if args.LinuxBoot != "" {
+		rom, err := os.ReadFile(args.LinuxBoot)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		p, err := linuxboot.FindPayload(rom)
+		if err != nil {
+			log.Fatalf("%s: %v", args.LinuxBoot, err)
+		}
+
+		return bytes.NewReader(p.Kernel), bytes.NewReader(p.Initramfs)
+	}
+
+	kern, err := os.Open(args.Kernel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	initrdPath := args.Initrd
+
+	if args.Uroot != "" {
+		f, err := os.CreateTemp("", "gokvm-initramfs-*.cpio")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		f.Close()
+
+		// It is opened below, so it can be unlinked on return.
+		defer os.Remove(f.Name())
+
+		if err := linuxboot.BuildInitramfs("u-root", f.Name(), strings.Fields(args.Uroot)...); err != nil {
+			log.Fatal(err)
+		}
+
+		initrdPath = f.Name()
+	}
+
+	initrd, err := os.Open(initrdPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return kern, initrd
+}
+
+// fwCfg returns the fw_cfg device with the files of -fw-cfg and the kernel
+// of -fw-kernel, for AddFwCfg to add what the machine knows to.
+func fwCfg(args *flag.Args) *fwcfg.FwCfg {
+	f := fwcfg.New()
+
+	for _, file := range args.FwCfgFiles {
+		data, err := os.ReadFile(file.Path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := f.AddFile(file.Name, data); err != nil {
+			log.Fatalf("-fw-cfg: %v", err)
+		}
+	}
+
+	if args.FwKernel != "" {
+		kernel, err := os.ReadFile(args.FwKernel)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		initrd, err := os.ReadFile(args.Initrd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		f.SetKernel(kernel, initrd, args.Params)
+	}
+
+	return f
+}
+
+// flashSectorSize is the erase sector size of -flash, as OVMF expects.
+const flashSectorSize = 0x1000
+
+// memSize is the guest RAM of args.
+func memSize(args *flag.Args) uint64 {
+	if args.MemSize == 0 {
+		return machine.MemSize
+	}
+
+	return args.MemSize
+}
+
+// memSlots returns how many memory slots the machine for args takes: one
+// for RAM, one for the ROM of firmware, should the kernel turn out to be
+// one, and those of the devices and regions that have their own.
+func memSlots(args *flag.Args) int {
+	n := 2 + len(args.Regions)
+
+	if args.MemHotplug != 0 {
+		n++
+	}
+
+	if args.SGXEPC != 0 {
+		n++
+	}
+
+	return n
+}
+
+// checkHost verifies that the host has what the machine for args needs,
+// so that a shortage shows before the machine is created rather than
+// half-way through the boot. Shares of the host given to -cpus and -mem
+// are resolved into args here.
+func checkHost(args *flag.Args) error {
+	h, err := hostcheck.ReadHost()
+	if err != nil {
+		return err
+	}
+
+	if err := h.ReadKVM(args.Dev); err != nil {
+		return err
+	}
+
+	if args.CPUShare != 0 || args.MemShare != 0 {
+		args.Resolve(h)
+
+		// A share of the host's memory is kept to what the machine can map.
+		if args.MemShare != 0 && args.MemSize < machine.MinMemSize {
+			args.MemSize = machine.MinMemSize
+		} else if args.MemShare != 0 && args.MemSize > machine.MaxMemSize {
+			args.MemSize = machine.MaxMemSize
+		}
+
+		out.Event("sizing", output.Fields{"cpus": args.NCPUs, "bytes": memSize(args), "numa_nodes": h.NUMANodes},
+			"sized the guest to %d CPUs and %d MiB of RAM of the host's %d CPUs and %d MiB",
+			args.NCPUs, memSize(args)>>20, h.NCPUs, h.MemTotal>>20)
+	}
+
+	if err := h.Check(hostcheck.Requirements{
+		MemSize:       memSize(args),
+		NCPUs:         args.NCPUs,
+		CPUOvercommit: args.CPUOvercommit,
+		MemSlots:      memSlots(args),
+		IRQRoutes:     machine.GSIs,
+	}); err != nil {
+		return err
+	}
+
+	if args.TapIfName != "" {
+		return hostcheck.CheckTap(args.TapIfName)
+	}
+
+	return nil
+}
+
+// newMachine sets up the machine for args, with the time each step takes
+// recorded in t.
+func newMachine(args *flag.Args, t *startup.Timer) *machine.Machine {
+	if err := checkHost(args); err != nil {
+		log.Fatalf("host check: %v", err)
+	}
+
+	t.Mark("check host")
+
+	ram := memslot.Backing{
+		HugePageSize: args.HugePages, Hugetlbfs: args.Hugetlbfs, Memfd: args.Memfd,
+		Prefault: args.Prefault,
+	}
+
+	m, err := machine.NewWithRAM(args.Dev, args.NCPUs, args.TapIfName, args.Disk, args.SEV, args.SNP, ram, memSize(args))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	m.SetEventOutput(out)
+	t.Mark("machine.New")
+
+	if args.IOMMU {
+		m.AddIOMMU()
+	}
+
+	for _, d := range args.Sandbox {
+		if d == "blk" {
+			if err := m.SandboxBlk(); err != nil {
+				log.Fatalf("-sandbox: %v", err)
+			}
+		}
+	}
+
+	if err := m.SetNUMA(args.NUMA); err != nil {
+		log.Fatalf("-numa: %v", err)
+	}
+
+	m.SetSMBIOS(args.SMBIOS)
+
+	if args.ACPI {
+		m.EnableACPI()
+	}
+
+	for _, u := range args.UARTs {
+		if err := m.AddUART(u.N, u.Path); err != nil {
+			log.Fatalf("-com: %v", err)
+		}
+	}
+
+	if args.Debugcon != "" {
+		f, err := os.Create(args.Debugcon)
+		if err != nil {
+			log.Fatalf("-debugcon: %v", err)
+		}
+
+		m.SetDebugconOutput(f)
+	}
+
+	if d := args.DebugExit; d.Size != 0 {
+		if err := m.SetDebugExit(machine.DebugExit{Port: d.Port, Size: d.Size, QEMU: d.QEMU}); err != nil {
+			log.Fatalf("-debug-exit: %v", err)
+		}
+	}
+
+	if !args.KVMClock {
+		if err := m.DisableKVMClock(); err != nil {
+			log.Fatalf("-kvmclock: %v", err)
+		}
+	}
+
+	for i, n := range m.NUMA() {
+		out.Event("numa", output.Fields{
+			"node": i, "host_node": n.HostNode, "vcpus": n.VCPUs, "host_cpus": n.HostCPUs,
+			"base": n.Base, "size": n.Size,
+		}, "NUMA node %d: RAM %#x-%#x and vCPUs %v on host node %d, CPUs %v",
+			i, n.Base, n.Base+n.Size, n.VCPUs, n.HostNode, n.HostCPUs)
+	}
+
+	for _, r := range args.Regions {
+		region := machine.MemoryRegion{
+			Kind: r.Kind, GPA: r.GPA, Size: r.Size, File: r.File, ReadOnly: r.ReadOnly, DirtyLog: r.DirtyLog,
+		}
+
+		if err := m.AddMemoryRegion(region); err != nil {
+			log.Fatalf("-region: %v", err)
+		}
+
+		out.Event("region", output.Fields{
+			"kind": r.Kind, "gpa": r.GPA, "size": r.Size, "file": r.File,
+		}, "memory region %v", region)
+	}
+
+	var vars []byte
+
+	info := payload.Info{Kind: payload.BzImage}
+	if args.Coreboot == "" && args.LinuxBoot == "" {
+		info = detect(args.Kernel)
+	}
+
+	switch {
+	case args.Coreboot != "":
+		loadFirmware(m, args.Coreboot, payload.Coreboot, false)
+		t.Mark("load coreboot")
+	case args.ResetVector:
+		// The firmware of the image runs its payload as it would on the
+		// board, which takes longer but tests the handoff too.
+		if info := detect(args.LinuxBoot); info.Kind.Firmware() {
+			loadFirmware(m, args.LinuxBoot, info.Kind, false)
+		} else {
+			log.Fatalf("%s: %v has no reset vector", args.LinuxBoot, info)
+		}
+
+		t.Mark("load firmware")
+	case info.Kind.Firmware():
+		vars = loadFirmware(m, args.Kernel, info.Kind, args.Flash != "")
+		t.Mark("load firmware")
+	default:
+		kern, initrd := images(args)
+
+		if err := m.LoadLinux(kern, initrd, info.Defaults().Params(args.Params)); err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		t.Mark("load kernel")
+	}
+
+	if args.Flash != "" {
+		if err := createFlash(args.Flash, args.FlashTemplate, vars); err != nil {
+			log.Fatal(err)
+		}
+
+		f, err := flash.New(args.Flash, flashSectorSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := m.AddFlash(f); err != nil {
+			log.Fatalf("%s: %v", args.Flash, err)
+		}
+	}
+
+	switch {
+	case args.Coreboot != "" || args.ResetVector || info.Kind.Firmware():
+		if err := m.AddFwCfg(fwCfg(args)); err != nil {
+			log.Fatalf("fw_cfg: %v", err)
+		}
+	case args.FwKernel != "" || len(args.FwCfgFiles) > 0:
+		log.Fatal("-fw-kernel and -fw-cfg are for firmware, not a kernel given with -k")
+	}
+
+	if args.PMUAction != "" {
+		action := uint32(kvm.PMUEventAllow)
+		if args.PMUAction == flag.PMUDeny {
+			action = kvm.PMUEventDeny
+		}
+
+		if err := m.SetPMUEventFilter(action, args.PMUEvents); err != nil {
+			log.Fatalf("PMU event filter: %v", err)
+		}
+	}
+
+	if args.Chipset != "" {
+		p, err := chipset.Load(args.Chipset)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := m.AddChipset(p, os.Stderr); err != nil {
+			log.Fatalf("%s: %v", args.Chipset, err)
+		}
+	}
+
+	if args.Stubs {
+		m.AddIODevice(stub.NewSuperIO(stub.ITE, 0x2e, 0x8728, os.Stderr))     // IT8728F
+		m.AddIODevice(stub.NewSuperIO(stub.Nuvoton, 0x4e, 0xc562, os.Stderr)) // NCT6779D
+		m.AddIODevice(stub.NewEC(os.Stderr))
+	}
+
+	if args.MemHotplug != 0 {
+		if err := m.AddMemoryDevice(uint64(args.MemHotplug) << 20); err != nil {
+			log.Fatalf("-mem-hotplug: %v", err)
+		}
+	}
+
+	if args.Balloon {
+		m.AddBalloon()
+	}
+
+	for _, p := range args.SerialPorts {
+		if err := m.AddSerialPort(p.Name, p.Path); err != nil {
+			log.Fatalf("serial port %s: %v", p.Name, err)
+		}
+	}
+
+	if args.BusLock != "" {
+		policy := map[string]machine.BusLockPolicy{
+			flag.BusLockLog:      machine.BusLockLog,
+			flag.BusLockThrottle: machine.BusLockThrottle,
+			flag.BusLockKill:     machine.BusLockKill,
+		}[args.BusLock]
+
+		if err := m.SetBusLockPolicy(policy, args.BusLockRate); err != nil {
+			log.Fatalf("-bus-lock: %v", err)
+		}
+	}
+
+	if args.Nested {
+		if err := m.EnableNested(); err != nil {
+			log.Fatalf("-nested: %v", err)
+		}
+	}
+
+	if args.SGXEPC != 0 {
+		if err := m.AddEPC(args.SGXVEPC, uint64(args.SGXEPC)<<20); err != nil {
+			log.Fatalf("-sgx-epc: %v", err)
+		}
+	}
+
+	if args.NetProfile != (virtio.NetProfile{}) {
+		if err := m.ShapeNet(args.NetProfile); err != nil {
+			log.Fatalf("-net-profile: %v", err)
+		}
+	}
+
+	for name, ids := range args.PCIIDs {
+		if err := m.OverridePCIIDs(name, ids); err != nil {
+			log.Fatalf("-pci-id: %v", err)
+		}
+	}
+
+	t.Mark("add devices")
+
+	if args.Prefault {
+		d, err := m.PrefaultTime()
+		if err != nil {
+			log.Fatalf("-prefault: %v", err)
+		}
+
+		out.Event("prefault", output.Fields{"bytes": memSize(args), "duration_ns": d.Nanoseconds()},
+			"prefaulted %d MiB of guest RAM in %v", memSize(args)>>20, d)
+	}
+
+	switch {
+	case args.SEV != "" && args.SNP:
+		if err := m.LaunchSNP(uint64(args.SEVPolicy)); err != nil {
+			log.Fatalf("SEV-SNP launch: %v", err)
+		}
+
+		t.Mark("launch SEV-SNP")
+	case args.SEV != "":
+		measurement, err := m.LaunchSEV(uint32(args.SEVPolicy))
+		if err != nil {
+			log.Fatalf("SEV launch: %v", err)
+		}
+
+		out.Event("sev_measurement", output.Fields{"measurement": fmt.Sprintf("%x", measurement)},
+			"SEV launch measurement: %x", measurement)
+		t.Mark("launch SEV")
+	}
+
+	if args.WorkingSet > 0 {
+		if err := m.TrackWorkingSet(args.WorkingSet); err != nil {
+			log.Fatalf("-working-set: %v", err)
+		}
+	}
+
+	if args.PromoteHugePages {
+		if err := m.PromoteHugePages(); err != nil {
+			log.Fatalf("-promote-huge-pages: %v", err)
+		}
+	}
+
+	if args.Control != "" || args.ControlHTTP != "" {
+		serveControl(m, args)
+	}
+
+	if args.DebugSnapshots != "" {
+		s, err := snapshot.OpenStore(args.DebugSnapshots)
+		if err != nil {
+			log.Fatalf("-debug-snapshots: %v", err)
+		}
+
+		m.SetDebugSnapshots(s)
+	}
+
+	if args.StartupReport {
+		reportStartup(append(t.Phases(), m.StartupPhases()...))
+	}
+
+	return m
+}
+
+// reportStartup reports where the time went before the guest runs, as
+// the text of startup.Report, or as a startup_phase event per phase and a
+// startup event with the total.
+func reportStartup(phases []startup.Phase) {
+	if !out.IsJSON() {
+		if err := startup.Report(out, startup.Budget, phases); err != nil {
+			log.Printf("startup report: %v", err)
+		}
+
+		return
+	}
+
+	phases = append([]startup.Phase{}, phases...)
+	sort.SliceStable(phases, func(i, j int) bool { return phases[i].Start.Before(phases[j].Start) })
+
+	for _, p := range phases {
+		out.Event("startup_phase", output.Fields{
+			"phase":       p.Name,
+			"offset_ns":   p.Start.Sub(phases[0].Start).Nanoseconds(),
+			"duration_ns": p.Duration.Nanoseconds(),
+		}, "")
+	}
+
+	total := startup.Total(phases)
+	out.Event("startup", output.Fields{
+		"total_ns":  total.Nanoseconds(),
+		"budget_ns": startup.Budget.Nanoseconds(),
+		"within":    total <= startup.Budget,
+	}, "")
+}
+
+const faultUsage = "fault blk|net [eio N|drop RATE|corrupt RATE|delay DURATION|clear]"
+
+// newControl returns the commands of package control for m, which -control,
+// -control-http and the monitor of the console take.
+func newControl(m *machine.Machine) *control.Server {
+	s := control.New()
+	s.Handle("fault", faultUsage, func(args []string) (string, error) {
+		return fault(m, s, args)
+	})
+	s.Handle("shape", "shape [PROFILE|clear]", func(args []string) (string, error) {
+		if len(args) > 1 {
+			return "", s.Usage("shape")
+		}
+
+		if len(args) == 1 {
+			p := virtio.NetProfile{}
+
+			if args[0] != "clear" {
+				var err error
+				if p, err = virtio.ParseNetProfile(args[0]); err != nil {
+					return "", err
+				}
+			}
+
+			if err := m.ShapeNet(p); err != nil {
+				return "", err
+			}
+		}
+
+		p, err := m.NetProfile()
+		if err != nil {
+			return "", err
+		}
+
+		return p.String(), nil
+	})
+	s.Handle("wss", "wss", func(args []string) (string, error) {
+		if len(args) != 0 {
+			return "", s.Usage("wss")
+		}
+
+		st, err := m.WorkingSet()
+		if err != nil {
+			return "", err
+		}
+
+		if h, err := m.HugePages(); err == nil {
+			return fmt.Sprintf("%v\nhuge pages: %v", st, h), nil
+		}
+
+		return st.String(), nil
+	})
+	s.Handle("resize-memory", "resize-memory MIB", func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", s.Usage("resize-memory")
+		}
+
+		mib, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return "", s.Usage("resize-memory")
+		}
+
+		if err := m.ResizeMemory(mib << 20); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("requested %d MiB", mib), nil
+	})
+	s.Handle("balloon", "balloon MIB", func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", s.Usage("balloon")
+		}
+
+		mib, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return "", s.Usage("balloon")
+		}
+
+		if err := m.SetBalloon(mib << 20); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("requested a balloon of %d MiB", mib), nil
+	})
+	s.Handle("pause", "pause", func(args []string) (string, error) {
+		if len(args) != 0 {
+			return "", s.Usage("pause")
+		}
+
+		m.Pause()
+
+		return "paused", nil
+	})
+	s.Handle("resume", "resume", func(args []string) (string, error) {
+		if len(args) != 0 {
+			return "", s.Usage("resume")
+		}
+
+		m.Resume()
+
+		return "resumed", nil
+	})
+	s.Handle("unplug", "unplug DEVICE", func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", s.Usage("unplug")
+		}
+
+		if err := m.UnplugPCIDevice(args[0]); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("requested the eject of %s", args[0]), nil
+	})
+	s.Handle("plug", "plug DEVICE", func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", s.Usage("plug")
+		}
+
+		if err := m.PlugPCIDevice(args[0]); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("plugged %s", args[0]), nil
+	})
+	s.Handle("sendkey", "sendkey KEY[-KEY...]", func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", s.Usage("sendkey")
+		}
+
+		return "", m.SendKey(args[0])
+	})
+	s.Handle("type", "type TEXT", func(args []string) (string, error) {
+		if len(args) == 0 {
+			return "", s.Usage("type")
+		}
+
+		return "", m.TypeText(strings.Join(args, " ") + "\n")
+	})
+	s.HandleQuery("query-balloon", "query-balloon", func(args []string) (interface{}, error) {
+		if len(args) != 0 {
+			return nil, s.Usage("query-balloon")
+		}
+
+		return m.Balloon()
+	})
+	s.HandleQuery("query-memory", "query-memory", func(args []string) (interface{}, error) {
+		if len(args) != 0 {
+			return nil, s.Usage("query-memory")
+		}
+
+		return m.MemoryDevice()
+	})
+	s.HandleQuery("query-vcpus", "query-vcpus", func(args []string) (interface{}, error) {
+		if len(args) != 0 {
+			return nil, s.Usage("query-vcpus")
+		}
+
+		return vcpuStates(m.QueryVCPUs()), nil
+	})
+	// Measuring the dirty rate logs dirty pages for a while, so it is not a
+	// query that -control-http may run.
+	s.Handle("query-dirty-rate", "query-dirty-rate [DURATION]", func(args []string) (string, error) {
+		window := time.Second
+
+		switch len(args) {
+		case 0:
+		case 1:
+			d, err := time.ParseDuration(args[0])
+			if err != nil {
+				return "", s.Usage("query-dirty-rate")
+			}
+
+			window = d
+		default:
+			return "", s.Usage("query-dirty-rate")
+		}
+
+		rate, err := m.MeasureDirtyRate(window)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprint(rate), nil
+	})
+
+	return s
+}
+
+// serveControl takes the commands of package control on the Unix socket
+// of -control, and serves the queries among them over the HTTP of
+// -control-http.
+func serveControl(m *machine.Machine, args *flag.Args) {
+	s := newControl(m)
+
+	if args.Control != "" {
+		l, err := net.Listen("unix", args.Control)
+		if err != nil {
+			log.Fatalf("-control: %v", err)
+		}
+
+		go func() { _ = s.Serve(l) }()
+	}
+
+	if args.ControlHTTP != "" {
+		l, err := net.Listen("tcp", args.ControlHTTP)
+		if err != nil {
+			log.Fatalf("-control-http: %v", err)
+		}
+
+		srv := &http.Server{Handler: s.HTTPHandler(args.ControlHTTPOrigin), ReadHeaderTimeout: 10 * time.Second}
+
+		go func() { _ = srv.Serve(l) }()
+	}
+}
+
+// vcpuStates are the states of the vCPUs for the query-vcpus command, as
+// the lines of Machine.WriteVCPUs, or in JSON with the fields of the
+// vcpu_state events.
+type vcpuStates []machine.VCPUInfo
+
+func (vs vcpuStates) String() string {
+	lines := make([]string, len(vs))
+	for i, v := range vs {
+		lines[i] = v.String()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (vs vcpuStates) MarshalJSON() ([]byte, error) {
+	states := make([]output.Fields, len(vs))
+	for i, v := range vs {
+		states[i] = vcpuFields(v)
+	}
+
+	return json.Marshal(states)
+}
+
+// fault shows or changes the faults a device injects: EIO for the next N
+// requests of blk, a rate of net frames to drop or corrupt, or a delay of
+// the completions of either.
+func fault(m *machine.Machine, s *control.Server, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", s.Usage("fault")
+	}
+
+	f, err := m.Faults(args[0])
 	if err != nil {
-		log.Fatalf("ParseArgs: %v", err)
+		return "", err
+	}
+
+	if len(args) == 1 {
+		return f.String(), nil
 	}
 
-	m, err := machine.New(kvmPath, nCpus, tapIfName, diskPath)
+	op := args[1]
+	valid := map[string]bool{"eio": args[0] == "blk", "drop": args[0] == "net", "corrupt": args[0] == "net"}
+
+	switch {
+	case op == "clear" && len(args) == 2:
+		f.Clear()
+	case len(args) != 3:
+		return "", s.Usage("fault")
+	case op == "delay":
+		d, err := time.ParseDuration(args[2])
+		if err != nil {
+			return "", err
+		}
+
+		f.SetDelay(d)
+	case op == "eio" && valid[op]:
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return "", s.Usage("fault")
+		}
+
+		f.FailNext(n)
+	case (op == "drop" || op == "corrupt") && valid[op]:
+		rate, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return "", s.Usage("fault")
+		}
+
+		if op == "drop" {
+			f.SetDropRate(rate)
+		} else {
+			f.SetCorruptRate(rate)
+		}
+	default:
+		return "", s.Usage("fault")
+	}
+
+	return f.String(), nil
+}
+
+// detect tells what the payload at path is, so that firmware given as the
+// kernel boots from the reset vector, and refuses kernels gokvm cannot
+// load.
+func detect(path string) payload.Info {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatalf("%v", err)
+		log.Fatal(err)
 	}
+	defer f.Close()
 
-	kern, err := os.Open(kernelPath)
+	fi, err := f.Stat()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	initrd, err := os.Open(initrdPath)
+	info, err := payload.Detect(f, fi.Size())
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+
+	switch {
+	case info.Kind == payload.ELF && info.Class != 64, info.Kind == payload.Multiboot, info.Kind == payload.Multiboot2:
+		log.Fatalf("%s: %v kernels cannot be booted, only bzImage, 64-bit vmlinux and firmware", path, info)
+	case info.Kind == payload.Unknown:
+		// Left to LoadLinux to complain about.
+		return payload.Info{Kind: payload.BzImage}
+	}
+
+	out.Event("payload", output.Fields{"path": path, "kind": info.String()}, "payload: %v", info)
+
+	return info
+}
+
+// loadFirmware maps a firmware ROM of kind for the vCPUs to start from its
+// reset vector, listing its CBFS first if it is coreboot, and shadowing it
+// below 1MiB if it is SeaBIOS. With splitVars, the variable store that a
+// unified OVMF.fd starts with is left out and returned, for -flash to take
+// its place right below the rest.
+func loadFirmware(m *machine.Machine, path string, kind payload.Kind, splitVars bool) []byte {
+	rom, err := os.ReadFile(path)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := m.LoadLinux(kern, initrd, params); err != nil {
-		log.Fatalf("%v", err)
+	var vars []byte
+
+	if n, ok := payload.VarStoreSize(rom); ok && splitVars && n < len(rom) {
+		vars, rom = rom[:n], rom[n:]
+
+		out.Event("varstore", output.Fields{"path": path, "size": n},
+			"%s: variable store of %#x bytes goes to -flash", path, n)
+	}
+
+	if kind == payload.Coreboot {
+		files, err := cbfs.Files(rom)
+		if err != nil {
+			log.Printf("%s: %v", path, err)
+		}
+
+		for _, f := range files {
+			out.Event("cbfs_file", output.Fields{"file": f.String()}, "CBFS: %v", f)
+		}
+	}
+
+	if err := m.LoadROM(rom); err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+
+	if kind == payload.SeaBIOS {
+		if err := m.ShadowBIOS(); err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	return vars
+}
+
+// createFlash creates the file of -flash if it does not exist or is
+// empty, e.g. the NVRAM of a guest on its first boot, as a copy of
+// template, e.g. OVMF_VARS.fd or one with Secure Boot keys enrolled, or
+// else of vars, the variable store of a unified OVMF.fd. The template
+// itself is never written to.
+func createFlash(path, template string, vars []byte) error {
+	if fi, err := os.Stat(path); err == nil && fi.Size() > 0 {
+		return nil
 	}
 
+	if template != "" {
+		b, err := os.ReadFile(template)
+		if err != nil {
+			return err
+		}
+
+		vars = b
+	}
+
+	if vars == nil {
+		return nil
+	}
+
+	return os.WriteFile(path, vars, 0o644)
+}
+
+// runCPUs starts one goroutine per vCPU and returns a channel that
+// receives the result of each one and is closed once all have exited.
+// Status goes to -output, stderr by default, so that stdout only carries
+// what the guest prints.
+func runCPUs(m *machine.Machine, nCpus int) <-chan error {
 	var wg sync.WaitGroup
 
+	errs := make(chan error, nCpus)
+
+	// kill -USR1 shows where each vCPU is, e.g. when the guest hangs.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+
+	go func() {
+		for range sig {
+			reportVCPUs(m)
+		}
+	}()
+
 	for i := 0; i < nCpus; i++ {
-		fmt.Printf("Start CPU %d of %d\r\n", i, nCpus)
+		out.Event("vcpu_start", output.Fields{"cpu": i, "ncpus": nCpus}, "Start CPU %d of %d", i, nCpus)
 		wg.Add(1)
 
 		go func(cpuId int) {
-			if err = m.RunInfiniteLoop(cpuId); err != nil {
-				fmt.Printf("%v\n\r", err)
+			err := m.RunInfiniteLoop(cpuId)
+			if err != nil {
+				out.Event("vcpu_error", output.Fields{"cpu": cpuId, "error": err}, "%v", err)
 			}
 
+			errs <- err
 			wg.Done()
-			fmt.Printf("CPU %d exits\n\r", cpuId)
+			out.Event("vcpu_exit", output.Fields{"cpu": cpuId}, "CPU %d exits", cpuId)
 		}(i)
 	}
 
-	if !term.IsTerminal() {
-		fmt.Fprintln(os.Stderr, "this is not terminal and does not accept input")
-		select {}
+	go func() {
+		wg.Wait()
+		signal.Stop(sig)
+		close(sig)
+		close(errs)
+	}()
+
+	return errs
+}
+
+// reportVCPUs reports the state of every vCPU, as the lines of
+// Machine.WriteVCPUs or as a vcpu_state event each.
+func reportVCPUs(m *machine.Machine) {
+	if !out.IsJSON() {
+		_ = m.WriteVCPUs(out)
+
+		return
+	}
+
+	for _, v := range m.QueryVCPUs() {
+		out.Event("vcpu_state", vcpuFields(v), "%v", v)
+	}
+}
+
+// vcpuFields are the fields of the state of a vCPU in JSON.
+func vcpuFields(v machine.VCPUInfo) output.Fields {
+	return output.Fields{
+		"cpu":       v.Index,
+		"state":     v.State.String(),
+		"since":     v.Since.UTC().Format(time.RFC3339Nano),
+		"last_exit": v.Exit.String(),
+		"detail":    v.Detail,
+	}
+}
+
+func boot(args *flag.Args, t *startup.Timer) {
+	m := newMachine(args, t)
+	held := &holdWriter{w: consoleOutput(m, args)}
+	console := term.NewConsoleWriter(teeConsoleLog(held, args), args.ConsoleMode)
+	m.SetSerialOutput(console)
+
+	if args.Expect != "" {
+		expectErr := runExpect(m, args.Expect, console)
+
+		go func() {
+			if err := <-expectErr; err != nil {
+				log.Printf("-expect: %v\r", err)
+			}
+		}()
+	}
+
+	errs := runCPUs(m, args.NCPUs)
+	restoreMode := func() {}
+
+	switch {
+	case args.ConsolePTY || args.ConsoleListen != "":
+		// The pseudo-terminal or socket takes the input.
+	case term.IsTerminal():
+		restoreMode = readConsole(m, held)
+	default:
+		out.Event("no_terminal", nil, "this is not terminal and does not accept input")
+	}
+
+	defer restoreMode()
+
+	out.Event("wait", nil, "Waiting for CPUs to exit")
+
+	for waitReset(m, errs) {
+		if args.OnReset != flag.ResetRestart {
+			restoreMode()
+			out.Event("exit", output.Fields{"status": args.ResetExitCode}, "guest reset")
+			os.Exit(args.ResetExitCode)
+		}
+
+		errs = restart(m, args.NCPUs)
+	}
+
+	out.Event("vcpus_done", nil, "All cpus done")
+	out.Event("exit", output.Fields{"status": 0}, "")
+}
+
+// consoleOutput returns where the serial console of m writes to, stdout or
+// with -console-pty or -console-listen a pseudo-terminal or socket, whose
+// input it passes on to the serial console.
+func consoleOutput(m *machine.Machine, args *flag.Args) io.Writer {
+	var rw io.ReadWriter
+
+	switch {
+	case args.ConsolePTY:
+		p, err := term.OpenPTY()
+		if err != nil {
+			log.Fatalf("-console-pty: %v", err)
+		}
+
+		out.Event("pty", output.Fields{"port": "COM1", "path": p.Path}, "COM1: char device redirected to %s", p.Path)
+
+		rw = p
+	case args.ConsoleListen != "":
+		l, err := serial.Listen(args.ConsoleListen)
+		if err != nil {
+			log.Fatalf("-console-listen: %v", err)
+		}
+
+		out.Event("listen", output.Fields{"port": "COM1", "addr": l.Addr().String()}, "COM1: listening on %s", l.Addr())
+
+		rw = l
+	default:
+		return os.Stdout
+	}
+
+	go func() {
+		buf := make([]byte, 256)
+
+		for {
+			n, err := rw.Read(buf)
+			for _, b := range buf[:n] {
+				m.GetInputChan() <- b
+			}
+
+			if n > 0 {
+				if err := m.InjectSerialIRQ(); err != nil {
+					log.Printf("InjectSerialIRQ: %v", err)
+				}
+			}
+
+			if err != nil {
+				log.Printf("console: %v", err)
+
+				return
+			}
+		}
+	}()
+
+	return rw
+}
+
+// teeConsoleLog returns w, which the serial console writes to, and with
+// -console-log the log that it also writes to.
+func teeConsoleLog(w io.Writer, args *flag.Args) io.Writer {
+	c := args.ConsoleLog
+	if c.Path == "" {
+		return w
+	}
+
+	l, err := consolelog.Open(c.Path, int64(c.Size), c.Keep)
+	if err != nil {
+		log.Fatalf("-console-log: %v", err)
 	}
 
+	// The log comes last, so that the console goes on if it fails.
+	return io.MultiWriter(w, l)
+}
+
+// readConsole puts the terminal in raw mode and passes every key typed on
+// to the serial console of m, but for the escape sequences of term.Escaper:
+// Ctrl-a x exits, and Ctrl-a c switches to the monitor, which holds what
+// the guest writes to console while it runs the commands of -control typed
+// on the terminal. It returns what restores the terminal, which a SIGTERM
+// or SIGHUP also does before gokvm exits.
+func readConsole(m *machine.Machine, console *holdWriter) func() {
 	restoreMode, err := term.SetRawMode()
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
 
-	defer restoreMode()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		s := <-sig
+
+		restoreMode()
+		out.Event("exit", output.Fields{"status": 128 + int(s.(syscall.Signal))}, "%v", s)
+		os.Exit(128 + int(s.(syscall.Signal)))
+	}()
 
-	var before byte = 0
+	var (
+		esc       term.Escaper
+		inMonitor bool
+	)
 
+	mon := &monitor{s: newControl(m), w: os.Stdout}
 	in := bufio.NewReader(os.Stdin)
 
 	go func() {
@@ -77,24 +1289,292 @@ func main() {
 
 				break
 			}
-			m.GetInputChan() <- b
+
+			keys, action := esc.Key(b)
+
+			switch action {
+			case term.EscapeQuit:
+				restoreMode()
+				out.Event("exit", output.Fields{"status": 0}, "")
+				os.Exit(0)
+			case term.EscapeHelp:
+				_, _ = io.WriteString(os.Stdout, "\r\n"+term.EscapeUsage)
+			case term.EscapeMonitor:
+				inMonitor = !inMonitor
+				if inMonitor {
+					console.hold(true)
+					mon.start()
+				} else {
+					_, _ = io.WriteString(os.Stdout, "\r\n")
+					console.hold(false)
+				}
+			}
+
+			if inMonitor {
+				for _, k := range keys {
+					mon.key(k)
+				}
+
+				continue
+			}
+
+			for _, k := range keys {
+				m.GetInputChan() <- k
+			}
 
 			if len(m.GetInputChan()) > 0 {
 				if err := m.InjectSerialIRQ(); err != nil {
 					log.Printf("InjectSerialIRQ: %v", err)
 				}
 			}
+		}
+	}()
 
-			if before == 0x1 && b == 'x' {
-				restoreMode()
-				os.Exit(0)
-			}
+	return restoreMode
+}
+
+// maxHeld is how much of what the guest writes to the console a holdWriter
+// keeps while the monitor has the terminal, past which it drops the rest.
+const maxHeld = 1 << 20
+
+// holdWriter passes what the guest writes to the console on, but holds it
+// while the monitor has the terminal, until the console has it back.
+type holdWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	holding bool
+	held    []byte
+}
+
+func (h *holdWriter) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.holding {
+		return h.w.Write(p)
+	}
+
+	n := len(p)
+	if room := maxHeld - len(h.held); room < n {
+		p = p[:room]
+	}
+
+	h.held = append(h.held, p...)
+
+	return n, nil
+}
+
+// hold holds what the guest writes, or writes what it held and stops.
+func (h *holdWriter) hold(on bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.holding = on
+	if !on && len(h.held) > 0 {
+		_, _ = h.w.Write(h.held)
+		h.held = nil
+	}
+}
+
+// monitorPrompt is the prompt of the monitor.
+const monitorPrompt = "(gokvm) "
+
+// monitor edits the lines typed on a terminal in raw mode, and runs each as
+// a command of package control, e.g. "query-vcpus" or "pause".
+type monitor struct {
+	s    *control.Server
+	w    io.Writer
+	line []byte
+}
+
+// start prompts for a command.
+func (mon *monitor) start() {
+	mon.line = nil
+	_, _ = io.WriteString(mon.w, "\r\n"+monitorPrompt)
+}
+
+// key takes the next key typed.
+func (mon *monitor) key(b byte) {
+	switch {
+	case b == '\r' || b == '\n':
+		_, _ = io.WriteString(mon.w, "\r\n")
 
-			before = b
+		res, err := mon.s.Run(string(mon.line))
+		if err != nil {
+			res = fmt.Sprintf("error: %v", err)
 		}
-	}()
 
-	fmt.Printf("Waiting for CPUs to exit\r\n")
-	wg.Wait()
-	fmt.Printf("All cpus done\n\r")
+		if res = strings.TrimSuffix(res, "\n"); res != "" {
+			_, _ = io.WriteString(mon.w, strings.ReplaceAll(res, "\n", "\r\n")+"\r\n")
+		}
+
+		mon.line = nil
+		_, _ = io.WriteString(mon.w, monitorPrompt)
+	case b == 0x7f || b == '\b':
+		if len(mon.line) > 0 {
+			mon.line = mon.line[:len(mon.line)-1]
+			_, _ = io.WriteString(mon.w, "\b \b")
+		}
+	case b == 0x03:
+		// Ctrl-c drops the line.
+		_, _ = io.WriteString(mon.w, "^C")
+		mon.start()
+	case b >= 0x20 && b < 0x7f:
+		mon.line = append(mon.line, b)
+		_, _ = mon.w.Write([]byte{b})
+	}
+}
+
+// waitReset waits for the vCPUs of errs to return, and tells whether the
+// guest reset. A reset or power off stops the other vCPUs, as it does on
+// hardware.
+func waitReset(m *machine.Machine, errs <-chan error) bool {
+	reset, off := false, false
+
+	for err := range errs {
+		switch {
+		case errors.Is(err, machine.ErrorGuestReset) && !reset && !off:
+			reset = true
+
+			m.Stop()
+		case errors.Is(err, machine.ErrorPowerOff) && !reset && !off:
+			off = true
+
+			m.Stop()
+		}
+	}
+
+	return reset
+}
+
+// restart resets m after the guest reset, as -on-reset restart asks, and
+// runs its vCPUs again.
+func restart(m *machine.Machine, nCpus int) <-chan error {
+	if err := m.Reset(); err != nil {
+		log.Fatalf("reset: %v", err)
+	}
+
+	out.Event("reset", nil, "the guest reset, restarting it")
+
+	return runCPUs(m, nCpus)
+}
+
+// runExpect runs the expect script at path on the serial console of m,
+// whose output goes to out as well, and returns where its result goes.
+func runExpect(m *machine.Machine, path string, out io.Writer) <-chan error {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("-expect: %v", err)
+	}
+	defer f.Close()
+
+	s, err := expect.Parse(f)
+	if err != nil {
+		log.Fatalf("-expect: %v", err)
+	}
+
+	e := expect.New(m)
+	m.SetSerialOutput(io.MultiWriter(out, e))
+
+	errc := make(chan error, 1)
+
+	go func() { errc <- e.Run(s, out) }()
+
+	return errc
+}
+
+// Exit codes of an ephemeral run that does not come from the guest.
+const (
+	exitFailure = 1
+	exitTimeout = 124 // as timeout(1)
+)
+
+// ephemeral boots the guest and returns the exit status it reports,
+// either by writing to machine.ExitPort (or that of -debug-exit) or, when args.Command is given,
+// as the status of that command run in the guest shell. The whole run is
+// bounded by args.Timeout.
+func ephemeral(args *flag.Args, t *startup.Timer) int {
+	deadline := time.Now().Add(args.Timeout)
+	m := newMachine(args, t)
+	console := term.NewConsoleWriter(teeConsoleLog(consoleOutput(m, args), args), args.ConsoleMode)
+	m.SetSerialOutput(console)
+	done := make(chan int, 1)
+
+	var (
+		a         *agent.Agent
+		expectErr <-chan error
+	)
+
+	if len(args.Command) > 0 {
+		// Only the command's output is of interest.
+		a = agent.New(m)
+		m.SetSerialOutput(a)
+	}
+
+	if args.Expect != "" {
+		var out io.Writer = console
+		if a != nil {
+			out = a
+		}
+
+		expectErr = runExpect(m, args.Expect, out)
+	}
+
+	errs := runCPUs(m, args.NCPUs)
+
+	if a != nil {
+		go func() {
+			if err := a.WaitReady(time.Until(deadline)); err != nil {
+				log.Printf("%v", err)
+
+				return
+			}
+
+			code, err := a.Run(agent.Quote(args.Command), os.Stdout, time.Until(deadline))
+			if err != nil {
+				log.Printf("%v", err)
+
+				return
+			}
+
+			done <- code
+		}()
+	}
+
+	timeout := time.After(time.Until(deadline))
+
+	for {
+		select {
+		case code := <-done:
+			return code
+		case err := <-expectErr:
+			if err != nil {
+				log.Printf("-expect: %v", err)
+
+				return exitFailure
+			}
+
+			expectErr = nil
+		case err, ok := <-errs:
+			switch {
+			case !ok:
+				// All vCPUs halted without reporting a status.
+				return 0
+			case errors.Is(err, machine.ErrorGuestExit):
+				return m.ExitCode()
+			case errors.Is(err, machine.ErrorPowerOff):
+				return 0
+			case errors.Is(err, machine.ErrorGuestReset) && args.OnReset == flag.ResetRestart:
+				errs = restart(m, args.NCPUs)
+			case errors.Is(err, machine.ErrorGuestReset):
+				return args.ResetExitCode
+			case err != nil:
+				return exitFailure
+			}
+		case <-timeout:
+			log.Printf("guest did not finish in %v", args.Timeout)
+
+			return exitTimeout
+		}
+	}
 }
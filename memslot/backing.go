@@ -0,0 +1,334 @@
+package memslot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Huge page sizes of x86.
+const (
+	HugePage2M = 2 << 20
+	HugePage1G = 1 << 30
+)
+
+const (
+	// mapHugeShift is MAP_HUGE_SHIFT, where the log2 of the huge page size
+	// goes in the flags of a MAP_HUGETLB mmap.
+	mapHugeShift = 26
+
+	hugetlbfsMagic = 0x958458f6
+
+	// memfd_create(2) and copy_file_range(2), which package syscall lacks,
+	// and the flags and seals of a memfd.
+	sysMemfdCreate    = 319
+	sysCopyFileRange  = 326
+	mfdCloexec        = 0x1
+	mfdAllowSealing   = 0x2
+	mfdHugetlb        = 0x4
+	fAddSeals         = 1033
+	fSealSeal         = 0x1
+	fSealShrink       = 0x2
+	fSealGrow         = 0x4
+	copyFileRangeStep = 1 << 30
+
+	// madvPopulateWrite is MADV_POPULATE_WRITE of Linux 5.14, which faults
+	// in a range for writing at once.
+	madvPopulateWrite = 23
+)
+
+var (
+	ErrHugePageSize = errors.New("huge pages must be 2MiB or 1GiB")
+	// ErrNoHugePages indicates a host without enough free huge pages of
+	// the size, which root reserves in
+	// /sys/kernel/mm/hugepages/hugepages-<size>kB/nr_hugepages.
+	ErrNoHugePages = errors.New("not enough free huge pages")
+	ErrNoHugetlbfs = errors.New("not a hugetlbfs mount")
+	ErrMemfd       = errors.New("memfd and hugetlbfs backings exclude each other")
+)
+
+// Backing is what the memory of a region is made of: normal pages by
+// default, or huge pages of hugetlb, which the host reserves up front and
+// never swaps, and which take fewer TLB and EPT entries than normal pages
+// or even transparent huge pages, which the host may split.
+type Backing struct {
+	// HugePageSize is HugePage2M or HugePage1G, or 0 for normal pages or
+	// the page size of the mount of Hugetlbfs.
+	HugePageSize int
+	// Hugetlbfs, if set, is a directory on a hugetlbfs mount to take the
+	// huge pages from, e.g. to account them to a mount limited with
+	// size=; otherwise they come from an anonymous MAP_HUGETLB mapping.
+	Hugetlbfs string
+	// Memfd backs the memory with a memfd, of huge pages if HugePageSize
+	// is set, whose size is sealed, so that it can be handed to other
+	// processes, e.g. vhost-user backends, that map it without fear of it
+	// shrinking under them, and copied to files with copy_file_range.
+	Memfd bool
+	// Prefault faults in all the memory when it is mapped, see Prefault.
+	Prefault bool
+}
+
+// Hugetlb tells whether the pages of b are hugetlb ones, which are never
+// split or collapsed.
+func (b Backing) Hugetlb() bool {
+	return b.HugePageSize != 0 || b.Hugetlbfs != ""
+}
+
+func (b Backing) String() string {
+	switch {
+	case b.Hugetlbfs != "":
+		return "hugetlbfs " + b.Hugetlbfs
+	case b.Memfd && b.HugePageSize != 0:
+		return fmt.Sprintf("memfd of %d MiB huge pages", b.HugePageSize>>20)
+	case b.Memfd:
+		return "memfd"
+	case b.HugePageSize != 0:
+		return fmt.Sprintf("%d MiB huge pages", b.HugePageSize>>20)
+	default:
+		return "normal pages"
+	}
+}
+
+// Map maps size bytes of zeroed memory backed by b, shared so that it can
+// be given to KVM and devices.
+func Map(size int, b Backing) ([]byte, error) {
+	mem, f, err := MapFile(size, b)
+	if f != nil {
+		// The mapping keeps the pages of the file.
+		_ = f.Close()
+	}
+
+	return mem, err
+}
+
+// MapFile is Map that also returns the file of the memory if b has one, a
+// memfd of b.Memfd or the unlinked file of b.Hugetlbfs, or nil for
+// anonymous memory. The file is the caller's to close.
+func MapFile(size int, b Backing) ([]byte, *os.File, error) {
+	if b.HugePageSize != 0 && b.HugePageSize != HugePage2M && b.HugePageSize != HugePage1G {
+		return nil, nil, fmt.Errorf("%w: %#x", ErrHugePageSize, b.HugePageSize)
+	}
+
+	switch {
+	case b.Memfd && b.Hugetlbfs != "":
+		return nil, nil, fmt.Errorf("%w: %s", ErrMemfd, b.Hugetlbfs)
+	case b.Memfd:
+		return mapMemfd(size, b)
+	case b.Hugetlbfs != "":
+		return mapHugetlbfs(size, b)
+	}
+
+	mem, err := mapAnonymous(size, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mem, nil, prefault(mem, nil, b)
+}
+
+// Prefault faults in all pages of mem for writing, so that the guest does
+// not take a storm of page faults, each an EPT violation and a host fault,
+// when it first touches its memory, e.g. at boot. The contents stay as
+// they are. Kernels before 5.14 have it done page by page.
+func Prefault(mem []byte) error {
+	err := syscall.Madvise(mem, madvPopulateWrite)
+	if !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+
+	for off := 0; off < len(mem); off += pageSize {
+		// An atomic add of 0 writes without changing anything, and is not
+		// optimized away.
+		atomic.AddUint32((*uint32)(unsafe.Pointer(&mem[off])), 0)
+	}
+
+	return nil
+}
+
+// prefault prefaults mem if b.Prefault is set, and unmaps it and closes f
+// on failure.
+func prefault(mem []byte, f *os.File, b Backing) error {
+	if !b.Prefault {
+		return nil
+	}
+
+	err := Prefault(mem)
+	if err == nil {
+		return nil
+	}
+
+	_ = syscall.Munmap(mem)
+
+	if f != nil {
+		_ = f.Close()
+	}
+
+	if errors.Is(err, syscall.ENOMEM) && b.Hugetlb() {
+		return fmt.Errorf("prefault: %w: %d MiB of %v", ErrNoHugePages, len(mem)>>20, b)
+	}
+
+	return fmt.Errorf("prefault: %w", err)
+}
+
+// mapAnonymous maps anonymous memory, of MAP_HUGETLB pages if
+// b.HugePageSize is set.
+func mapAnonymous(size int, b Backing) ([]byte, error) {
+	flags := syscall.MAP_SHARED | syscall.MAP_ANONYMOUS
+
+	if b.HugePageSize != 0 {
+		if size%b.HugePageSize != 0 {
+			return nil, fmt.Errorf("%w: %#x bytes are not a multiple of %#x", ErrAlignment, size, b.HugePageSize)
+		}
+
+		flags |= syscall.MAP_HUGETLB | log2(b.HugePageSize)<<mapHugeShift
+	}
+
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, flags)
+	if errors.Is(err, syscall.ENOMEM) && b.HugePageSize != 0 {
+		return nil, fmt.Errorf("%w: %d MiB of %v", ErrNoHugePages, size>>20, b)
+	}
+
+	return mem, err
+}
+
+// mapHugetlbfs maps a file of size bytes created and unlinked in
+// b.Hugetlbfs, whose mount must have huge pages of b.HugePageSize if that
+// is set.
+func mapHugetlbfs(size int, b Backing) ([]byte, *os.File, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(b.Hugetlbfs, &st); err != nil {
+		return nil, nil, err
+	}
+
+	if st.Type != hugetlbfsMagic {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNoHugetlbfs, b.Hugetlbfs)
+	}
+
+	pageSize := int(st.Bsize)
+	if b.HugePageSize != 0 && b.HugePageSize != pageSize {
+		return nil, nil, fmt.Errorf("%w: %s has %d KiB pages", ErrHugePageSize, b.Hugetlbfs, pageSize>>10)
+	}
+
+	if size%pageSize != 0 {
+		return nil, nil, fmt.Errorf("%w: %#x bytes are not a multiple of %#x", ErrAlignment, size, pageSize)
+	}
+
+	f, err := os.CreateTemp(b.Hugetlbfs, "gokvm-mem-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer os.Remove(f.Name())
+
+	return mapShared(f, size, b)
+}
+
+// mapMemfd maps a memfd of size bytes whose size is sealed.
+func mapMemfd(size int, b Backing) ([]byte, *os.File, error) {
+	flags := mfdCloexec | mfdAllowSealing
+
+	if b.HugePageSize != 0 {
+		if size%b.HugePageSize != 0 {
+			return nil, nil, fmt.Errorf("%w: %#x bytes are not a multiple of %#x", ErrAlignment, size, b.HugePageSize)
+		}
+
+		flags |= mfdHugetlb | log2(b.HugePageSize)<<mapHugeShift
+	}
+
+	name := []byte("gokvm-mem\x00")
+
+	fd, _, errno := syscall.Syscall(sysMemfdCreate, uintptr(unsafe.Pointer(&name[0])), uintptr(flags), 0)
+	if errno != 0 {
+		return nil, nil, fmt.Errorf("memfd_create: %w", errno)
+	}
+
+	f := os.NewFile(fd, "memfd:gokvm-mem")
+
+	mem, _, err := mapShared(f, size, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Whoever the memfd is handed to can rely on its size, so that a
+	// mapping of it never faults with SIGBUS.
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, fAddSeals, fSealShrink|fSealGrow|fSealSeal); errno != 0 {
+		_ = syscall.Munmap(mem)
+		_ = f.Close()
+
+		return nil, nil, fmt.Errorf("seal memfd: %w", errno)
+	}
+
+	return mem, f, nil
+}
+
+// mapShared sizes f and maps it, closing it on failure.
+func mapShared(f *os.File, size int, b Backing) ([]byte, *os.File, error) {
+	if err := f.Truncate(int64(size)); err != nil {
+		_ = f.Close()
+
+		return nil, nil, err
+	}
+
+	mem, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		_ = f.Close()
+
+		if errors.Is(err, syscall.ENOMEM) && b.Hugetlb() {
+			return nil, nil, fmt.Errorf("%w: %d MiB of %v", ErrNoHugePages, size>>20, b)
+		}
+
+		return nil, nil, err
+	}
+
+	if err := prefault(mem, f, b); err != nil {
+		return nil, nil, err
+	}
+
+	return mem, f, nil
+}
+
+// CopyFile copies size bytes of src from its start to dst at its offset,
+// e.g. the memory of a MapFile to a snapshot, within the kernel with
+// copy_file_range where the file systems allow it, and by reading and
+// writing otherwise.
+func CopyFile(dst, src *os.File, size int64) error {
+	var off int64
+
+	for off < size {
+		n := size - off
+		if n > copyFileRangeStep {
+			n = copyFileRangeStep
+		}
+
+		r, _, errno := syscall.Syscall6(sysCopyFileRange, src.Fd(), uintptr(unsafe.Pointer(&off)),
+			dst.Fd(), 0, uintptr(n), 0)
+
+		switch {
+		case errno == syscall.EXDEV || errno == syscall.EINVAL || errno == syscall.ENOSYS ||
+			errno == syscall.EOPNOTSUPP:
+			// Other file systems, or kernels before 5.3 for memfds.
+			_, err := io.Copy(dst, io.NewSectionReader(src, off, size-off))
+
+			return err
+		case errno != 0:
+			return fmt.Errorf("copy_file_range: %w", errno)
+		case r == 0:
+			return fmt.Errorf("copy_file_range: %w at %#x of %#x", io.ErrUnexpectedEOF, off, size)
+		}
+	}
+
+	return nil
+}
+
+func log2(n int) int {
+	l := 0
+	for ; n > 1; n >>= 1 {
+		l++
+	}
+
+	return l
+}
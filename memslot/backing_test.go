@@ -0,0 +1,122 @@
+package memslot_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/memslot"
+)
+
+func TestMap(t *testing.T) {
+	t.Parallel()
+
+	mem, err := memslot.Map(0x10000, memslot.Backing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem[0xffff] = 1
+	_ = syscall.Munmap(mem)
+
+	for _, c := range []struct {
+		size int
+		b    memslot.Backing
+		want error
+	}{
+		{1 << 20, memslot.Backing{HugePageSize: memslot.HugePage2M}, memslot.ErrAlignment},
+		{4 << 20, memslot.Backing{HugePageSize: 4 << 20}, memslot.ErrHugePageSize},
+		{4 << 20, memslot.Backing{Hugetlbfs: t.TempDir()}, memslot.ErrNoHugetlbfs},
+	} {
+		if _, err := memslot.Map(c.size, c.b); !errors.Is(err, c.want) {
+			t.Errorf("Map(%#x, %v): got %v, want %v", c.size, c.b, err, c.want)
+		}
+	}
+
+	// Most hosts have no huge pages reserved.
+	mem, err = memslot.Map(memslot.HugePage2M, memslot.Backing{HugePageSize: memslot.HugePage2M})
+	if errors.Is(err, memslot.ErrNoHugePages) {
+		t.Skipf("Skipping huge pages: %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	mem[memslot.HugePage2M-1] = 1
+	_ = syscall.Munmap(mem)
+}
+
+func TestMapFile(t *testing.T) {
+	t.Parallel()
+
+	mem, f, err := memslot.MapFile(0x10000, memslot.Backing{Memfd: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	defer func() { _ = syscall.Munmap(mem) }()
+
+	copy(mem[0x8000:], "gokvm")
+
+	// The size is sealed.
+	if err := f.Truncate(0x1000); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("truncating the memfd: got %v, want %v", err, syscall.EPERM)
+	}
+
+	dst, err := os.CreateTemp(t.TempDir(), "mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dst.Close()
+
+	if err := memslot.CopyFile(dst, f, int64(len(mem))); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, mem) {
+		t.Errorf("copy of %d bytes differs from the memory", len(b))
+	}
+
+	// Anonymous memory has no file.
+	anon, file, err := memslot.MapFile(0x1000, memslot.Backing{})
+	if err != nil || file != nil {
+		t.Errorf("anonymous memory: got file %v, error %v", file, err)
+	}
+
+	_ = syscall.Munmap(anon)
+
+	_, _, err = memslot.MapFile(0x1000, memslot.Backing{Memfd: true, Hugetlbfs: t.TempDir()})
+	if !errors.Is(err, memslot.ErrMemfd) {
+		t.Errorf("got %v, want %v", err, memslot.ErrMemfd)
+	}
+}
+
+func TestPrefault(t *testing.T) {
+	t.Parallel()
+
+	mem, err := memslot.Map(0x100000, memslot.Backing{Prefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = syscall.Munmap(mem) }()
+
+	// Prefaulting memory in use keeps what is in it.
+	copy(mem[0x5000:], "gokvm")
+
+	if err := memslot.Prefault(mem); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(mem[0x5000:0x5005]) != "gokvm" {
+		t.Errorf("got %q after Prefault, want %q", mem[0x5000:0x5005], "gokvm")
+	}
+}
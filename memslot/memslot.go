@@ -0,0 +1,268 @@
+// Package memslot manages the memory slots of a VM: it hands out slot
+// numbers, keeps the guest physical ranges of the slots apart, and knows
+// what is where, e.g. for snapshots, so that callers need not assign slots
+// by hand.
+package memslot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+const pageSize = 0x1000
+
+// defaultSlots is how many slots KVM has when it does not report
+// KVM_CAP_NR_MEMSLOTS, KVM_MEMORY_SLOTS of old kernels.
+const defaultSlots = 32
+
+var (
+	ErrOverlap   = errors.New("memory region overlaps another")
+	ErrNoSlot    = errors.New("no free memory slot")
+	ErrNoRegion  = errors.New("no such memory slot")
+	ErrAlignment = fmt.Errorf("memory region is not a non-empty multiple of %#x", pageSize)
+)
+
+// Region is a memory slot: Mem mapped into the guest at GPA.
+type Region struct {
+	Slot uint32
+	GPA  uint64
+	Mem  []byte
+	// Flags are kvm.MemLogDirtyPages, kvm.MemReadonly and
+	// kvm.MemGuestMemfd, with which the private pages of the region come
+	// from GuestMemfd at GuestMemfdOffset.
+	Flags            uint32
+	GuestMemfd       uintptr
+	GuestMemfdOffset uint64
+}
+
+// End returns the guest physical address after the region.
+func (r Region) End() uint64 {
+	return r.GPA + uint64(len(r.Mem))
+}
+
+func (r Region) String() string {
+	return fmt.Sprintf("slot %d [%#x-%#x) flags %#x", r.Slot, r.GPA, r.End(), r.Flags)
+}
+
+// Manager manages the memory slots of a VM.
+type Manager struct {
+	vmFd uintptr
+	// slots is how many slots KVM has, and regions the used ones by
+	// number.
+	slots int
+
+	mu      sync.Mutex
+	regions map[uint32]*Region
+}
+
+// New returns the manager of the slots of the VM vmFd, none of which may be
+// in use yet.
+func New(vmFd uintptr) (*Manager, error) {
+	slots, err := kvm.CheckExtension(vmFd, kvm.CapNRMemSlots)
+	if err != nil {
+		return nil, err
+	}
+
+	if slots <= 0 {
+		slots = defaultSlots
+	}
+
+	return &Manager{vmFd: vmFd, slots: slots, regions: map[uint32]*Region{}}, nil
+}
+
+// Add maps r.Mem into the guest at r.GPA in the lowest free slot, and
+// returns the region with its slot.
+func (m *Manager) Add(r Region) (Region, error) {
+	if err := checkAlignment(r); err != nil {
+		return r, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkOverlap(r, nil); err != nil {
+		return r, err
+	}
+
+	slot, err := m.freeSlot()
+	if err != nil {
+		return r, err
+	}
+
+	r.Slot = slot
+	if err := m.set(&r); err != nil {
+		return r, fmt.Errorf("%v: %w", r, err)
+	}
+
+	m.regions[slot] = &r
+
+	return r, nil
+}
+
+// Remove unmaps the region of slot from the guest, and frees the slot. The
+// memory of the region is the caller's to unmap.
+func (m *Manager) Remove(slot uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.regions[slot]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrNoRegion, slot)
+	}
+
+	// A slot of size 0 deletes it.
+	if err := m.set(&Region{Slot: slot, GPA: r.GPA, Flags: r.Flags}); err != nil {
+		return fmt.Errorf("remove %v: %w", r, err)
+	}
+
+	delete(m.regions, slot)
+
+	return nil
+}
+
+// Resize replaces the memory of slot with mem at the same address, e.g. a
+// larger mapping of the same file. KVM does not change the size of a slot,
+// so it is deleted and added again, and the guest must not run meanwhile.
+func (m *Manager) Resize(slot uint32, mem []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.regions[slot]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrNoRegion, slot)
+	}
+
+	r := *old
+	r.Mem = mem
+
+	if err := checkAlignment(r); err != nil {
+		return err
+	}
+
+	if err := m.checkOverlap(r, old); err != nil {
+		return err
+	}
+
+	if err := m.set(&Region{Slot: slot, GPA: old.GPA, Flags: old.Flags}); err != nil {
+		return fmt.Errorf("resize %v: %w", old, err)
+	}
+
+	if err := m.set(&r); err != nil {
+		// Put the old region back rather than leave a hole in the guest.
+		if err2 := m.set(old); err2 != nil {
+			delete(m.regions, slot)
+		}
+
+		return fmt.Errorf("resize %v: %w", old, err)
+	}
+
+	m.regions[slot] = &r
+
+	return nil
+}
+
+// SetFlags changes the flags of slot, e.g. to start or stop dirty logging.
+// KVM does not take changes of kvm.MemReadonly or kvm.MemGuestMemfd.
+func (m *Manager) SetFlags(slot uint32, flags uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.regions[slot]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrNoRegion, slot)
+	}
+
+	r := *old
+	r.Flags = flags
+
+	if err := m.set(&r); err != nil {
+		return fmt.Errorf("%v: %w", r, err)
+	}
+
+	m.regions[slot] = &r
+
+	return nil
+}
+
+// Find returns the region that holds gpa.
+func (m *Manager) Find(gpa uint64) (Region, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range m.regions {
+		if r.GPA <= gpa && gpa < r.End() {
+			return *r, true
+		}
+	}
+
+	return Region{}, false
+}
+
+// Regions returns the regions by address.
+func (m *Manager) Regions() []Region {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	regions := make([]Region, 0, len(m.regions))
+	for _, r := range m.regions {
+		regions = append(regions, *r)
+	}
+
+	sort.Slice(regions, func(i, j int) bool { return regions[i].GPA < regions[j].GPA })
+
+	return regions
+}
+
+func checkAlignment(r Region) error {
+	if len(r.Mem) == 0 || len(r.Mem)%pageSize != 0 || r.GPA%pageSize != 0 {
+		return fmt.Errorf("%w: %#x bytes at %#x", ErrAlignment, len(r.Mem), r.GPA)
+	}
+
+	return nil
+}
+
+// checkOverlap fails if r overlaps a region other than self.
+func (m *Manager) checkOverlap(r Region, self *Region) error {
+	for _, o := range m.regions {
+		if o != self && r.GPA < o.End() && o.GPA < r.End() {
+			return fmt.Errorf("%w: [%#x-%#x) and %v", ErrOverlap, r.GPA, r.End(), o)
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) freeSlot() (uint32, error) {
+	for slot := uint32(0); int(slot) < m.slots; slot++ {
+		if _, ok := m.regions[slot]; !ok {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: all %d in use", ErrNoSlot, m.slots)
+}
+
+// set has KVM map r, or delete its slot if it has no memory.
+func (m *Manager) set(r *Region) error {
+	var addr uint64
+	if len(r.Mem) > 0 {
+		addr = uint64(uintptr(unsafe.Pointer(&r.Mem[0])))
+	}
+
+	if r.Flags&kvm.MemGuestMemfd != 0 {
+		return kvm.SetUserMemoryRegion2(m.vmFd, &kvm.UserspaceMemoryRegion2{
+			Slot: r.Slot, Flags: r.Flags, GuestPhysAddr: r.GPA, MemorySize: uint64(len(r.Mem)),
+			UserspaceAddr: addr, GuestMemfd: uint32(r.GuestMemfd), GuestMemfdOffset: r.GuestMemfdOffset,
+		})
+	}
+
+	return kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
+		Slot: r.Slot, Flags: r.Flags, GuestPhysAddr: r.GPA, MemorySize: uint64(len(r.Mem)),
+		UserspaceAddr: addr,
+	})
+}
@@ -0,0 +1,124 @@
+package memslot_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/memslot"
+)
+
+func mmap(t *testing.T, size int) []byte {
+	t.Helper()
+
+	mem, err := syscall.Mmap(-1, 0, size,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = syscall.Munmap(mem) })
+
+	return mem
+}
+
+func TestManager(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer syscall.Close(int(vmFd))
+
+	m, err := memslot.New(vmFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low, err := m.Add(memslot.Region{GPA: 0x100000, Mem: mmap(t, 0x10000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	high, err := m.Add(memslot.Region{GPA: 0x200000, Mem: mmap(t, 0x1000), Flags: kvm.MemReadonly})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if low.Slot != 0 || high.Slot != 1 {
+		t.Fatalf("got slots %d and %d, want 0 and 1", low.Slot, high.Slot)
+	}
+
+	for _, r := range []memslot.Region{
+		{GPA: 0x10f000, Mem: mmap(t, 0x2000)},
+		{GPA: 0xff000, Mem: mmap(t, 0x2000)},
+		{GPA: 0x1ff000, Mem: mmap(t, 0x10000)},
+	} {
+		if _, err := m.Add(r); !errors.Is(err, memslot.ErrOverlap) {
+			t.Errorf("Add(%v): got %v, want %v", r, err, memslot.ErrOverlap)
+		}
+	}
+
+	if _, err := m.Add(memslot.Region{GPA: 0x800, Mem: mmap(t, 0x1000)}); !errors.Is(err, memslot.ErrAlignment) {
+		t.Errorf("Add of an unaligned region: got %v, want %v", err, memslot.ErrAlignment)
+	}
+
+	// Growing into the region above overlaps, shrinking does not.
+	if err := m.Resize(low.Slot, mmap(t, 0x200000)); !errors.Is(err, memslot.ErrOverlap) {
+		t.Errorf("Resize: got %v, want %v", err, memslot.ErrOverlap)
+	}
+
+	if err := m.Resize(low.Slot, mmap(t, 0x2000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetFlags(low.Slot, kvm.MemLogDirtyPages); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, ok := m.Find(0x101fff); !ok || r.Slot != low.Slot || r.Flags != kvm.MemLogDirtyPages {
+		t.Errorf("Find(0x101fff): got %v, %v", r, ok)
+	}
+
+	if _, ok := m.Find(0x102000); ok {
+		t.Error("Find(0x102000) found a region past the end of the resized one")
+	}
+
+	if err := m.Remove(low.Slot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Remove(low.Slot); !errors.Is(err, memslot.ErrNoRegion) {
+		t.Errorf("second Remove: got %v, want %v", err, memslot.ErrNoRegion)
+	}
+
+	// The freed slot is taken again, below the one in use.
+	r, err := m.Add(memslot.Region{GPA: 0x300000, Mem: mmap(t, 0x1000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Slot != low.Slot {
+		t.Errorf("got slot %d, want the freed %d", r.Slot, low.Slot)
+	}
+
+	regions := m.Regions()
+	if len(regions) != 2 || regions[0].GPA != 0x200000 || regions[1].GPA != 0x300000 {
+		t.Errorf("got regions %v, want them at 0x200000 and 0x300000", regions)
+	}
+}
@@ -0,0 +1,225 @@
+// Package numa places memory and threads on the NUMA nodes of the host, so
+// that the RAM of a guest and the vCPUs that use it share a node rather
+// than pay for remote accesses.
+package numa
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// nodeDir is where the host describes its nodes.
+const nodeDir = "/sys/devices/system/node"
+
+const (
+	// mbind(2), which package syscall lacks, with the MPOL_BIND policy and
+	// MPOL_MF_MOVE to move pages already faulted in.
+	sysMbind   = 237
+	mpolBind   = 2
+	mpolMFMove = 1 << 1
+
+	// maxNodes is the number of bits of the node masks of mbind, and
+	// maxCPUs that of the CPU masks of sched_setaffinity.
+	maxNodes = 1024
+	maxCPUs  = 1024
+)
+
+var (
+	ErrNoNode    = errors.New("no such NUMA node")
+	ErrNoCPUs    = errors.New("NUMA node has no CPUs")
+	ErrCPUList   = errors.New("invalid CPU list")
+	ErrAlignment = errors.New("memory to bind is not page aligned")
+)
+
+// Node is a NUMA node of the host.
+type Node struct {
+	ID   int
+	CPUs []int
+	// Distances are from this node to each node by ID, 10 for itself.
+	Distances []int
+}
+
+// Nodes returns the online nodes of the host by ID, a single node 0 with
+// all CPUs on hosts without NUMA support.
+func Nodes() ([]Node, error) {
+	dirs, err := filepath.Glob(filepath.Join(nodeDir, "node[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []Node{}
+
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+
+		n, err := readNode(dir, id)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	if len(nodes) == 0 {
+		cpus := []int{}
+		for i := 0; i < runtime.NumCPU(); i++ {
+			cpus = append(cpus, i)
+		}
+
+		return []Node{{ID: 0, CPUs: cpus, Distances: []int{10}}}, nil
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+
+	return nodes, nil
+}
+
+// Find returns node id of nodes.
+func Find(nodes []Node, id int) (Node, error) {
+	for _, n := range nodes {
+		if n.ID == id {
+			return n, nil
+		}
+	}
+
+	return Node{}, fmt.Errorf("%w: %d", ErrNoNode, id)
+}
+
+func readNode(dir string, id int) (Node, error) {
+	n := Node{ID: id}
+
+	b, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+	if err != nil {
+		return n, err
+	}
+
+	if n.CPUs, err = ParseCPUList(strings.TrimSpace(string(b))); err != nil {
+		return n, err
+	}
+
+	b, err = os.ReadFile(filepath.Join(dir, "distance"))
+	if err != nil {
+		return n, err
+	}
+
+	for _, f := range strings.Fields(string(b)) {
+		d, err := strconv.Atoi(f)
+		if err != nil {
+			return n, fmt.Errorf("node %d distance %q: %w", id, f, err)
+		}
+
+		n.Distances = append(n.Distances, d)
+	}
+
+	return n, nil
+}
+
+// ParseCPUList parses a list of CPUs such as "0-3,8,10-11", as in sysfs and
+// taskset, into the CPUs in order.
+func ParseCPUList(s string) ([]int, error) {
+	cpus := []int{}
+
+	if s == "" {
+		return cpus, nil
+	}
+
+	for _, r := range strings.Split(s, ",") {
+		lo, hi := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+
+		first, err1 := strconv.Atoi(lo)
+		last, err2 := strconv.Atoi(hi)
+
+		if err1 != nil || err2 != nil || first < 0 || last < first {
+			return nil, fmt.Errorf("%w: %q", ErrCPUList, s)
+		}
+
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+
+	return cpus, nil
+}
+
+// Bind has the pages of mem come from node, and moves those already there.
+func Bind(mem []byte, node int) error {
+	if len(mem) == 0 || uintptr(unsafe.Pointer(&mem[0]))%uintptr(os.Getpagesize()) != 0 {
+		return ErrAlignment
+	}
+
+	if node < 0 || node >= maxNodes {
+		return fmt.Errorf("%w: %d", ErrNoNode, node)
+	}
+
+	var mask [maxNodes / 64]uint64
+
+	mask[node/64] = 1 << (node % 64)
+
+	_, _, errno := syscall.Syscall6(sysMbind, uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)),
+		mpolBind, uintptr(unsafe.Pointer(&mask[0])), maxNodes+1, mpolMFMove)
+	if errno != 0 {
+		return fmt.Errorf("mbind to node %d: %w", node, errno)
+	}
+
+	return nil
+}
+
+// Pin has the calling thread, which must be locked to its goroutine, run
+// only on cpus. The returned function restores the CPUs it ran on before,
+// e.g. before the thread is unlocked.
+func Pin(cpus []int) (func() error, error) {
+	if len(cpus) == 0 {
+		return nil, ErrNoCPUs
+	}
+
+	var set, old cpuSet
+
+	for _, c := range cpus {
+		if c < 0 || c >= maxCPUs {
+			return nil, fmt.Errorf("%w: CPU %d", ErrCPUList, c)
+		}
+
+		set[c/64] |= 1 << (c % 64)
+	}
+
+	if err := affinity(syscall.SYS_SCHED_GETAFFINITY, &old); err != nil {
+		return nil, err
+	}
+
+	if err := affinity(syscall.SYS_SCHED_SETAFFINITY, &set); err != nil {
+		return nil, err
+	}
+
+	return func() error { return affinity(syscall.SYS_SCHED_SETAFFINITY, &old) }, nil
+}
+
+// cpuSet is a cpu_set_t of maxCPUs.
+type cpuSet [maxCPUs / 64]uint64
+
+// affinity gets or sets the CPUs the calling thread runs on.
+func affinity(trap uintptr, set *cpuSet) error {
+	_, _, errno := syscall.RawSyscall(trap, 0, unsafe.Sizeof(*set), uintptr(unsafe.Pointer(set)))
+	if errno == 0 {
+		return nil
+	}
+
+	if trap == syscall.SYS_SCHED_GETAFFINITY {
+		return fmt.Errorf("sched_getaffinity: %w", errno)
+	}
+
+	return fmt.Errorf("sched_setaffinity: %w", errno)
+}
@@ -0,0 +1,83 @@
+package numa_test
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/numa"
+)
+
+func TestParseCPUList(t *testing.T) {
+	t.Parallel()
+
+	cpus, err := numa.ParseCPUList("0-3,8,10-11")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{0, 1, 2, 3, 8, 10, 11}; !reflect.DeepEqual(cpus, want) {
+		t.Errorf("got %v, want %v", cpus, want)
+	}
+
+	for _, s := range []string{"1-", "3-1", "a", "0,,1"} {
+		if _, err := numa.ParseCPUList(s); !errors.Is(err, numa.ErrCPUList) {
+			t.Errorf("%q: got %v, want %v", s, err, numa.ErrCPUList)
+		}
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	t.Parallel()
+
+	nodes, err := numa.Nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every host has a node 0, the only one without NUMA.
+	n, err := numa.Find(nodes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := numa.Find(nodes, 1<<20); !errors.Is(err, numa.ErrNoNode) {
+		t.Errorf("got %v, want %v", err, numa.ErrNoNode)
+	}
+
+	mem, err := syscall.Mmap(-1, 0, 0x10000, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = syscall.Munmap(mem) }()
+
+	mem[0] = 1
+
+	if err := numa.Bind(mem, n.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := numa.Bind(mem[1:], n.ID); !errors.Is(err, numa.ErrAlignment) {
+		t.Errorf("got %v, want %v", err, numa.ErrAlignment)
+	}
+
+	if len(n.CPUs) == 0 {
+		t.Skipf("Skipping pinning: node 0 has no CPUs")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	unpin, err := numa.Pin(n.CPUs[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unpin(); err != nil {
+		t.Fatal(err)
+	}
+}
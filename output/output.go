@@ -0,0 +1,115 @@
+// Package output reports what the VMM does, its log and the events of the
+// lifecycle of a guest, either as text for people or as JSON lines for log
+// pipelines and test frameworks:
+//
+//	{"cpu":0,"event":"vcpu_start","msg":"Start CPU 0 of 1","ncpus":1,"time":"2024-05-01T10:00:00.000000001Z"}
+//	{"event":"log","msg":"-expect: line 3: timed out waiting for the guest","time":"..."}
+//	{"event":"exit","msg":"","status":0,"time":"..."}
+//
+// Each line has the time, the name of the event and its message, and
+// fields that depend on the event.
+package output
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of an Output.
+const (
+	Text = "text"
+	JSON = "json"
+)
+
+// ErrFormat indicates a format other than Text and JSON.
+var ErrFormat = errors.New("output format must be text or json")
+
+// Fields are the fields of an event besides time, event and msg.
+type Fields map[string]interface{}
+
+// Output writes events in a format.
+type Output struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+// New returns an Output that writes events to w in format.
+func New(w io.Writer, format string) (*Output, error) {
+	switch format {
+	case Text:
+		return &Output{w: w}, nil
+	case JSON:
+		return &Output{w: w, json: true}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrFormat, format)
+	}
+}
+
+// IsJSON tells whether o writes JSON lines, e.g. to leave out text meant
+// for people.
+func (o *Output) IsJSON() bool {
+	return o.json
+}
+
+// Event reports the event name with fields and a message made of format
+// and args. As text, only the message is written, on a line of its own, and
+// events without one are left out.
+func (o *Output) Event(name string, fields Fields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.json {
+		if msg != "" {
+			fmt.Fprintf(o.w, "%s\r\n", msg)
+		}
+
+		return
+	}
+
+	e := make(map[string]interface{}, len(fields)+3)
+
+	for k, v := range fields {
+		// Errors are structs or pointers that JSON makes little of.
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+
+		e[k] = v
+	}
+
+	e["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	e["event"] = name
+	e["msg"] = msg
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"event": name, "msg": msg, "error": err.Error()})
+	}
+
+	_, _ = o.w.Write(append(b, '\n'))
+}
+
+// Write writes p, e.g. a line of package log, as it is in text, and as a
+// log event per line in JSON.
+func (o *Output) Write(p []byte) (int, error) {
+	if !o.json {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		return o.w.Write(p)
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\r\n"), "\n") {
+		o.Event("log", nil, "%s", strings.TrimRight(line, "\r"))
+	}
+
+	return len(p), nil
+}
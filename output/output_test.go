@@ -0,0 +1,85 @@
+package output_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/output"
+)
+
+func TestText(t *testing.T) {
+	t.Parallel()
+
+	var b bytes.Buffer
+
+	o, err := output.New(&b, output.Text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o.Event("vcpu_start", output.Fields{"cpu": 0}, "Start CPU %d of %d", 0, 1)
+	o.Event("exit", output.Fields{"status": 0}, "")
+	fmt.Fprintf(o, "expect: line 1\r\n")
+
+	if want := "Start CPU 0 of 1\r\nexpect: line 1\r\n"; b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	t.Parallel()
+
+	var b bytes.Buffer
+
+	o, err := output.New(&b, output.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !o.IsJSON() {
+		t.Fatal("IsJSON is false")
+	}
+
+	o.Event("vcpu_error", output.Fields{"cpu": 1, "error": errors.New("boom")}, "vCPU %d failed", 1)
+
+	l := log.New(o, "", 0)
+	l.Printf("first\nsecond")
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3: %q", len(lines), b.String())
+	}
+
+	var e map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e["event"] != "vcpu_error" || e["msg"] != "vCPU 1 failed" || e["cpu"] != 1.0 || e["error"] != "boom" || e["time"] == "" {
+		t.Errorf("got event %v", e)
+	}
+
+	for i, msg := range []string{"first", "second"} {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i+1]), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		if e["event"] != "log" || e["msg"] != msg {
+			t.Errorf("got log event %v, want message %q", e, msg)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	t.Parallel()
+
+	if _, err := output.New(&bytes.Buffer{}, "xml"); !errors.Is(err, output.ErrFormat) {
+		t.Errorf("got %v, want %v", err, output.ErrFormat)
+	}
+}
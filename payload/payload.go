@@ -0,0 +1,300 @@
+// Package payload tells what an image given to boot is, e.g. a bzImage or
+// a firmware ROM, and what the machine should default to for it, so that
+// booting different kinds of payloads takes fewer flags.
+package payload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/cbfs"
+)
+
+// Kind is a kind of payload.
+type Kind int
+
+const (
+	Unknown Kind = iota
+	// BzImage is a Linux kernel with the x86 boot protocol.
+	BzImage
+	// ELF is an ELF executable, e.g. an uncompressed vmlinux.
+	ELF
+	// Multiboot and Multiboot2 are kernels with a header of the
+	// Multiboot specification of that version.
+	Multiboot
+	Multiboot2
+	// Coreboot, SeaBIOS and OVMF are firmware ROMs, which run from the
+	// reset vector.
+	Coreboot
+	SeaBIOS
+	OVMF
+)
+
+func (k Kind) String() string {
+	switch k {
+	case BzImage:
+		return "bzImage"
+	case ELF:
+		return "ELF"
+	case Multiboot:
+		return "Multiboot"
+	case Multiboot2:
+		return "Multiboot2"
+	case Coreboot:
+		return "coreboot"
+	case SeaBIOS:
+		return "SeaBIOS"
+	case OVMF:
+		return "OVMF"
+	default:
+		return "unknown"
+	}
+}
+
+// Firmware tells whether k runs from the reset vector rather than being
+// loaded into RAM.
+func (k Kind) Firmware() bool {
+	return k == Coreboot || k == SeaBIOS || k == OVMF
+}
+
+const (
+	// The setup header of a bzImage, see Documentation/x86/boot.rst.
+	bzImageMagicOff   = 0x202
+	bzImageMagic      = "HdrS"
+	bzImageVersionOff = 0x206
+	bzImageKernelVer  = 0x20e
+	setupHeaderBase   = 0x200
+
+	elfMagic    = "\x7fELF"
+	elfClassOff = 4
+
+	// Multiboot headers are within the first multibootSearch bytes,
+	// aligned to 4, and those of Multiboot2 within the first
+	// multiboot2Search, aligned to 8.
+	multibootMagic   = 0x1badb002
+	multibootSearch  = 8192
+	multiboot2Magic  = 0xe85250d6
+	multiboot2Search = 32768
+
+	// An EFI firmware volume has its signature at this offset, and OVMF
+	// starts with one.
+	fvSignatureOff = 0x28
+	fvSignature    = "_FVH"
+	fvGUIDOff      = 0x10
+	fvLengthOff    = 0x20
+
+	// nvDataFVGUID is EFI_SYSTEM_NV_DATA_FV_GUID, the file system of the
+	// firmware volume of the UEFI variable store,
+	// fff12b8d-7696-4c8b-a985-2747075b4f50.
+	nvDataFVGUID = "\x8d\x2b\xf1\xff\x96\x76\x8b\x4c\xa9\x85\x27\x47\x07\x5b\x4f\x50"
+
+	// varStoreAlign is what a variable store is a multiple of, the sector
+	// size of the flash it is kept in.
+	varStoreAlign = 0x1000
+
+	seaBIOSSignature = "SeaBIOS"
+
+	// maxFirmwareSize is the largest firmware looked into as a whole.
+	maxFirmwareSize = 16 << 20
+)
+
+var ErrEmpty = errors.New("empty payload")
+
+// Info is what Detect finds out about a payload.
+type Info struct {
+	Kind Kind
+	// Version is the kernel version of a bzImage that has one.
+	Version string
+	// Protocol is the boot protocol version of a bzImage, e.g. 0x20f.
+	Protocol uint16
+	// Class is 32 or 64 for an ELF executable.
+	Class int
+}
+
+func (i Info) String() string {
+	switch {
+	case i.Kind == BzImage && i.Version != "":
+		return fmt.Sprintf("%v, Linux %s, boot protocol %d.%02d", i.Kind, i.Version, i.Protocol>>8, i.Protocol&0xff)
+	case i.Kind == BzImage:
+		return fmt.Sprintf("%v, boot protocol %d.%02d", i.Kind, i.Protocol>>8, i.Protocol&0xff)
+	case i.Kind == ELF:
+		return fmt.Sprintf("%d-bit %v", i.Class, i.Kind)
+	default:
+		return i.Kind.String()
+	}
+}
+
+// Detect reads the size bytes of r to tell what kind of payload they are.
+// Kernel formats are told by their headers, and firmware by what it
+// contains, so firmware is only recognized up to a size of 16MiB.
+func Detect(r io.ReaderAt, size int64) (Info, error) {
+	if size == 0 {
+		return Info{}, ErrEmpty
+	}
+
+	head := make([]byte, multiboot2Search)
+	n, err := r.ReadAt(head, 0)
+
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Info{}, err
+	}
+
+	head = head[:n]
+
+	switch {
+	case len(head) > bzImageKernelVer+2 && string(head[bzImageMagicOff:bzImageMagicOff+4]) == bzImageMagic:
+		return bzImage(r, head)
+	case hasMultiboot2(head):
+		return Info{Kind: Multiboot2}, nil
+	case hasMultiboot(head):
+		return Info{Kind: Multiboot}, nil
+	case len(head) > elfClassOff && string(head[:4]) == elfMagic:
+		return Info{Kind: ELF, Class: 32 * int(head[elfClassOff])}, nil
+	case size > maxFirmwareSize:
+		return Info{}, nil
+	}
+
+	rom := make([]byte, size)
+	if _, err := r.ReadAt(rom, 0); err != nil && !errors.Is(err, io.EOF) {
+		return Info{}, err
+	}
+
+	if len(rom) > fvSignatureOff+4 && string(rom[fvSignatureOff:fvSignatureOff+4]) == fvSignature {
+		return Info{Kind: OVMF}, nil
+	}
+
+	// coreboot comes before SeaBIOS, which may be its payload.
+	if _, err := cbfs.Files(rom); err == nil {
+		return Info{Kind: Coreboot}, nil
+	}
+
+	if bytes.Contains(rom, []byte(seaBIOSSignature)) {
+		return Info{Kind: SeaBIOS}, nil
+	}
+
+	return Info{}, nil
+}
+
+// bzImage reads the setup header of a bzImage, of which head is the start.
+func bzImage(r io.ReaderAt, head []byte) (Info, error) {
+	info := Info{Kind: BzImage, Protocol: binary.LittleEndian.Uint16(head[bzImageVersionOff:])}
+
+	// The kernel version string is NUL-terminated, e.g.
+	// "6.1.0 (user@host) #1 SMP ...".
+	if p := binary.LittleEndian.Uint16(head[bzImageKernelVer:]); p != 0 {
+		s := make([]byte, 256)
+		n, err := r.ReadAt(s, int64(p)+setupHeaderBase)
+
+		if err != nil && !errors.Is(err, io.EOF) {
+			return info, err
+		}
+
+		s = s[:n]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+
+		if f := strings.Fields(string(s)); len(f) > 0 {
+			info.Version = f[0]
+		}
+	}
+
+	return info, nil
+}
+
+// VarStoreSize returns the size of the UEFI variable store that rom starts
+// with, if it does: OVMF_VARS.fd is one, and the unified OVMF.fd has one
+// in front of OVMF_CODE.fd, which must go to writable flash for the guest
+// to keep variables, e.g. the keys of Secure Boot.
+func VarStoreSize(rom []byte) (int, bool) {
+	if len(rom) < fvSignatureOff+4 || string(rom[fvSignatureOff:fvSignatureOff+4]) != fvSignature ||
+		string(rom[fvGUIDOff:fvGUIDOff+16]) != nvDataFVGUID {
+		return 0, false
+	}
+
+	n := binary.LittleEndian.Uint64(rom[fvLengthOff:])
+	if n == 0 || n > uint64(len(rom)) || n%varStoreAlign != 0 {
+		return 0, false
+	}
+
+	return int(n), true
+}
+
+func hasMultiboot(head []byte) bool {
+	for off := 0; off+12 <= len(head) && off < multibootSearch; off += 4 {
+		magic := binary.LittleEndian.Uint32(head[off:])
+		flags := binary.LittleEndian.Uint32(head[off+4:])
+		sum := binary.LittleEndian.Uint32(head[off+8:])
+
+		if magic == multibootMagic && magic+flags+sum == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasMultiboot2(head []byte) bool {
+	for off := 0; off+16 <= len(head) && off < multiboot2Search; off += 8 {
+		magic := binary.LittleEndian.Uint32(head[off:])
+		arch := binary.LittleEndian.Uint32(head[off+4:])
+		length := binary.LittleEndian.Uint32(head[off+8:])
+		sum := binary.LittleEndian.Uint32(head[off+12:])
+
+		if magic == multiboot2Magic && magic+arch+length+sum == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Defaults are the machine settings that suit a payload.
+type Defaults struct {
+	// Console is the console= of the kernel command line, empty for
+	// firmware, which writes to the serial port as it is.
+	Console string
+	// ACPI tells whether the payload should use ACPI. gokvm has no ACPI
+	// tables for Linux to find, so it is off for kernels, while firmware
+	// builds its own.
+	ACPI bool
+}
+
+// Defaults returns the machine settings that suit the payload.
+func (i Info) Defaults() Defaults {
+	if i.Kind.Firmware() {
+		return Defaults{ACPI: true}
+	}
+
+	return Defaults{Console: "ttyS0"}
+}
+
+// Params returns the kernel command line params with the console and
+// ACPI setting of d added, unless params sets them already.
+func (d Defaults) Params(params string) string {
+	has := func(prefix string) bool {
+		for _, f := range strings.Fields(params) {
+			if strings.HasPrefix(f, prefix) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var add []string
+
+	if d.Console != "" && !has("console=") {
+		add = append(add, "console="+d.Console)
+	}
+
+	if !d.ACPI && !has("noacpi") && !has("acpi=") {
+		add = append(add, "noacpi")
+	}
+
+	return strings.TrimSpace(strings.Join(append(add, params), " "))
+}
@@ -0,0 +1,143 @@
+package payload_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/payload"
+)
+
+func bzImage(version string) []byte {
+	img := make([]byte, 0x1000)
+	copy(img[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(img[0x206:], 0x20f)
+
+	if version != "" {
+		// kernel_version is relative to the setup header at 0x200.
+		binary.LittleEndian.PutUint16(img[0x20e:], 0x600)
+		copy(img[0x800:], version+"\x00")
+	}
+
+	return img
+}
+
+func multiboot(off int, words ...uint32) []byte {
+	img := make([]byte, 0x2000)
+
+	sum := uint32(0)
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(img[off+4*i:], w)
+		sum += w
+	}
+
+	binary.LittleEndian.PutUint32(img[off+4*len(words):], -sum)
+
+	return img
+}
+
+func TestDetect(t *testing.T) {
+	t.Parallel()
+
+	elf64 := append([]byte("\x7fELF\x02\x01\x01"), make([]byte, 0x100)...)
+
+	ovmf := make([]byte, 0x10000)
+	copy(ovmf[0x28:], "_FVH")
+
+	seabios := bytes.Repeat([]byte{0xff}, 0x10000)
+	copy(seabios[0x8000:], "SeaBIOS (version rel-1.16.0)")
+
+	coreboot := bytes.Repeat([]byte{0xff}, 0x100)
+	coreboot = append(coreboot, "LARCHIVE"...)
+	coreboot = append(coreboot, 0, 0, 0, 8, 0, 0, 0, 0x50, 0, 0, 0, 0, 0, 0, 0, 0x28)
+	coreboot = append(coreboot, "config\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"...)
+	coreboot = append(coreboot, "SeaBIOS!"...)
+	coreboot = append(coreboot, bytes.Repeat([]byte{0xff}, 0x100)...)
+
+	for _, tt := range []struct {
+		name string
+		img  []byte
+		want string
+	}{
+		{"bzImage", bzImage("6.1.0 (user@host) #1 SMP"), "bzImage, Linux 6.1.0, boot protocol 2.15"},
+		{"bzImage without version", bzImage(""), "bzImage, boot protocol 2.15"},
+		{"ELF", elf64, "64-bit ELF"},
+		{"Multiboot", multiboot(0x40, 0x1badb002, 0x3), "Multiboot"},
+		{"Multiboot2", multiboot(0x48, 0xe85250d6, 0, 0x18), "Multiboot2"},
+		{"bad Multiboot checksum", append(multiboot(0x40, 0x1badb002, 0x3)[:0x48], 1), "unknown"},
+		{"OVMF", ovmf, "OVMF"},
+		{"SeaBIOS", seabios, "SeaBIOS"},
+		{"coreboot with SeaBIOS", coreboot, "coreboot"},
+		{"unknown", bytes.Repeat([]byte{0xff}, 0x1000), "unknown"},
+	} {
+		info, err := payload.Detect(bytes.NewReader(tt.img), int64(len(tt.img)))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+
+			continue
+		}
+
+		if got := info.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := payload.Detect(bytes.NewReader(nil), 0); !errors.Is(err, payload.ErrEmpty) {
+		t.Errorf("empty: got %v, want %v", err, payload.ErrEmpty)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	t.Parallel()
+
+	kernel := payload.Info{Kind: payload.BzImage}.Defaults()
+
+	for _, tt := range []struct {
+		params, want string
+	}{
+		{"root=/dev/vda", "console=ttyS0 noacpi root=/dev/vda"},
+		{"console=hvc0 acpi=force", "console=hvc0 acpi=force"},
+		{"", "console=ttyS0 noacpi"},
+	} {
+		if got := kernel.Params(tt.params); got != tt.want {
+			t.Errorf("Params(%q): got %q, want %q", tt.params, got, tt.want)
+		}
+	}
+
+	if d := (payload.Info{Kind: payload.OVMF}).Defaults(); d.Console != "" || !d.ACPI {
+		t.Errorf("firmware defaults: got %+v", d)
+	}
+}
+
+func TestVarStoreSize(t *testing.T) {
+	t.Parallel()
+
+	fv := func(guid string, length uint64, size int) []byte {
+		b := make([]byte, size)
+		copy(b[0x10:], guid)
+		binary.LittleEndian.PutUint64(b[0x20:], length)
+		copy(b[0x28:], "_FVH")
+
+		return b
+	}
+
+	nv := "\x8d\x2b\xf1\xff\x96\x76\x8b\x4c\xa9\x85\x27\x47\x07\x5b\x4f\x50"
+
+	for _, tt := range []struct {
+		name string
+		rom  []byte
+		size int
+		ok   bool
+	}{
+		{"OVMF_VARS.fd", fv(nv, 0x84000, 0x84000), 0x84000, true},
+		{"OVMF.fd", fv(nv, 0x84000, 0x400000), 0x84000, true},
+		{"OVMF_CODE.fd", fv("\x78\xe5\x8c\x8c\x3d\x8a\x1c\x4f\x99\x35\x89\x61\x85\xc3\x2d\xd3", 0x10000, 0x10000), 0, false},
+		{"unaligned", fv(nv, 0x84010, 0x400000), 0, false},
+		{"truncated", fv(nv, 0x84000, 0x20000), 0, false},
+	} {
+		if size, ok := payload.VarStoreSize(tt.rom); size != tt.size || ok != tt.ok {
+			t.Errorf("%s: got %#x, %v, want %#x, %v", tt.name, size, ok, tt.size, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package pci
+
+// IDs are the identity a device reports in its DeviceHeader, which drivers
+// match on. Fields that are zero leave those of the device as they are.
+type IDs struct {
+	VendorID          uint16
+	DeviceID          uint16
+	SubsystemVendorID uint16
+	SubsystemID       uint16
+	RevisionID        uint8
+	// ClassCode is base class<<16 | subclass<<8 | programming interface,
+	// e.g. 0x020000 for an Ethernet controller.
+	ClassCode uint32
+}
+
+// Apply returns h with the IDs that are set.
+func (ids IDs) Apply(h DeviceHeader) DeviceHeader {
+	if ids.VendorID != 0 {
+		h.VendorID = ids.VendorID
+	}
+
+	if ids.DeviceID != 0 {
+		h.DeviceID = ids.DeviceID
+	}
+
+	if ids.SubsystemVendorID != 0 {
+		h.SubsystemVendorID = ids.SubsystemVendorID
+	}
+
+	if ids.SubsystemID != 0 {
+		h.SubsystemID = ids.SubsystemID
+	}
+
+	if ids.RevisionID != 0 {
+		h.RevisionID = ids.RevisionID
+	}
+
+	if ids.ClassCode != 0 {
+		h.ClassCode = [3]uint8{uint8(ids.ClassCode), uint8(ids.ClassCode >> 8), uint8(ids.ClassCode >> 16)}
+	}
+
+	return h
+}
+
+// overridden is a Device that reports other IDs.
+type overridden struct {
+	Device
+	ids IDs
+}
+
+func (o overridden) GetDeviceHeader() DeviceHeader {
+	return o.ids.Apply(o.Device.GetDeviceHeader())
+}
+
+// Capabilities returns those of the device, if it has any.
+func (o overridden) Capabilities() []byte {
+	if c, ok := o.Device.(CapabilityLister); ok {
+		return c.Capabilities()
+	}
+
+	return nil
+}
+
+// Override returns d reporting ids instead of its own, e.g. for a guest
+// whose driver only binds to the IDs of particular hardware.
+func Override(d Device, ids IDs) Device {
+	return overridden{Device: d, ids: ids}
+}
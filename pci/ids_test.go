@@ -0,0 +1,43 @@
+package pci_test
+
+import (
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+func TestOverride(t *testing.T) {
+	t.Parallel()
+
+	br := pci.Override(pci.NewBridge(), pci.IDs{
+		SubsystemVendorID: 0x15ad,
+		SubsystemID:       0x1976,
+		RevisionID:        2,
+		ClassCode:         0x060400,
+	})
+	p := pci.New(br)
+
+	// Read the revision and class code, at offset 0x8, of 00:00.0.
+	_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(uint32(0x80000008)))
+
+	bytes := make([]byte, 4)
+	_ = p.PciConfDataIn(0xCFC, bytes)
+
+	if expected, actual := uint64(0x06040002), pci.BytesToNum(bytes); actual != expected {
+		t.Fatalf("class code and revision: expected: %#x, actual: %#x", expected, actual)
+	}
+
+	// The subsystem IDs are at offset 0x2c.
+	_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(uint32(0x8000002c)))
+	_ = p.PciConfDataIn(0xCFC, bytes)
+
+	if expected, actual := uint64(0x197615ad), pci.BytesToNum(bytes); actual != expected {
+		t.Fatalf("subsystem IDs: expected: %#x, actual: %#x", expected, actual)
+	}
+
+	// The IDs not overridden stay.
+	h := br.GetDeviceHeader()
+	if h.VendorID != 0x8086 || h.DeviceID != 0x6000 {
+		t.Fatalf("expected: 8086:6000, actual: %04x:%04x", h.VendorID, h.DeviceID)
+	}
+}
@@ -28,6 +28,11 @@ func (a address) getBusNumber() uint32 {
 	return (uint32(a) >> 16) & 0xff
 }
 
+// bdf is the bus, device and function of the address as by BDF.
+func (a address) bdf() uint32 {
+	return (uint32(a) >> 8) & 0xffff
+}
+
 func (a address) isEnable() bool {
 	return ((uint32(a) >> 31) | 0x1) == 0x1
 }
@@ -43,28 +48,51 @@ type Device interface {
 	GetIORange() (start, end uint64)
 }
 
+// CapabilityLister is a Device with a capability list, e.g. the vendor
+// capabilities of the modern virtio transport. Its DeviceHeader has
+// StatusCapabilityList in Status and CapabilitiesPointer set.
+type CapabilityLister interface {
+	// Capabilities returns the configuration space from the end of the
+	// DeviceHeader on, which has the capability list.
+	Capabilities() []byte
+}
+
+const (
+	// StatusCapabilityList is the bit of DeviceHeader.Status of a device
+	// with a capability list.
+	StatusCapabilityList = 1 << 4
+
+	// configSpaceSize is that of a function without extended
+	// configuration space.
+	configSpaceSize = 0x100
+)
+
 type DeviceHeader struct {
-	VendorID      uint16
-	DeviceID      uint16
-	Command       uint16
-	_             uint16   // status
-	_             uint8    // revisonID
-	_             [3]uint8 // classCode
-	_             uint8    // cacheLineSize
-	_             uint8    // latencyTimer
-	HeaderType    uint8
-	_             uint8 // bist
-	BAR           [6]uint32
-	_             uint32 // cardbusCISPointer
-	_             uint16 // subsystemVendorID
-	SubsystemID   uint16
-	_             uint32   // expansionROMBaseAddress
-	_             uint8    // capabilitiesPointer
-	_             [7]uint8 // reserved
-	InterruptLine uint8
-	InterruptPin  uint8
-	_             uint8 // minGnt
-	_             uint8 // maxLat
+	VendorID   uint16
+	DeviceID   uint16
+	Command    uint16
+	Status     uint16
+	RevisionID uint8
+	// ClassCode is the programming interface, subclass and base class,
+	// in this order.
+	ClassCode         [3]uint8
+	_                 uint8 // cacheLineSize
+	_                 uint8 // latencyTimer
+	HeaderType        uint8
+	_                 uint8 // bist
+	BAR               [6]uint32
+	_                 uint32 // cardbusCISPointer
+	SubsystemVendorID uint16
+	SubsystemID       uint16
+	_                 uint32 // expansionROMBaseAddress
+	// CapabilitiesPointer is the offset of the first capability, see
+	// CapabilityLister.
+	CapabilitiesPointer uint8
+	_                   [7]uint8 // reserved
+	InterruptLine       uint8
+	InterruptPin        uint8
+	_                   uint8 // minGnt
+	_                   uint8 // maxLat
 }
 
 func (h DeviceHeader) Bytes() ([]byte, error) {
@@ -77,14 +105,29 @@ func (h DeviceHeader) Bytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// ConfigSpace is the raw configuration space of a function that is not a
+// Device, e.g. chipset registers that firmware reads and writes.
+type ConfigSpace interface {
+	Read(offset uint64, bytes []byte) error
+	Write(offset uint64, bytes []byte) error
+}
+
+// BDF returns the key of a function in PCI.ConfigSpaces.
+func BDF(bus, device, function uint32) uint32 {
+	return bus<<8 | device<<3 | function
+}
+
 type PCI struct {
 	addr        address
 	isBAR0Probe bool
 	Devices     []Device
+
+	// ConfigSpaces take precedence over Devices, by BDF.
+	ConfigSpaces map[uint32]ConfigSpace
 }
 
 func New(devices ...Device) *PCI {
-	return &PCI{Devices: devices}
+	return &PCI{Devices: devices, ConfigSpaces: map[uint32]ConfigSpace{}}
 }
 
 func (p *PCI) PciConfDataIn(port uint64, values []byte) error {
@@ -97,6 +140,10 @@ func (p *PCI) PciConfDataIn(port uint64, values []byte) error {
 		return nil
 	}
 
+	if c, ok := p.ConfigSpaces[p.addr.bdf()]; ok {
+		return c.Read(uint64(offset), values)
+	}
+
 	if p.addr.getBusNumber() != 0 {
 		return nil
 	}
@@ -107,7 +154,7 @@ func (p *PCI) PciConfDataIn(port uint64, values []byte) error {
 
 	slot := int(p.addr.getDeviceNumber())
 
-	if slot >= len(p.Devices) {
+	if slot >= len(p.Devices) || p.Devices[slot] == nil {
 		return nil
 	}
 
@@ -126,6 +173,13 @@ func (p *PCI) PciConfDataIn(port uint64, values []byte) error {
 		return err
 	}
 
+	if c, ok := p.Devices[slot].(CapabilityLister); ok {
+		b = append(b, c.Capabilities()...)
+	}
+
+	// The rest of the configuration space reads as zeros.
+	b = append(b, make([]byte, configSpaceSize)...)
+
 	l := len(values)
 	copy(values[:l], b[offset:offset+l])
 
@@ -139,6 +193,10 @@ func (p *PCI) PciConfDataOut(port uint64, values []byte) error {
 		return nil
 	}
 
+	if c, ok := p.ConfigSpaces[p.addr.bdf()]; ok {
+		return c.Write(uint64(offset), values)
+	}
+
 	if p.addr.getBusNumber() != 0 {
 		return nil
 	}
@@ -149,7 +207,7 @@ func (p *PCI) PciConfDataOut(port uint64, values []byte) error {
 
 	slot := int(p.addr.getDeviceNumber())
 
-	if slot >= len(p.Devices) {
+	if slot >= len(p.Devices) || p.Devices[slot] == nil {
 		return nil
 	}
 
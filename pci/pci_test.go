@@ -127,3 +127,72 @@ func TestBytes(t *testing.T) {
 		t.Fatalf("invalid vendor id")
 	}
 }
+
+type configSpace [0x100]byte
+
+func (c *configSpace) Read(offset uint64, bytes []byte) error {
+	copy(bytes, c[offset:])
+
+	return nil
+}
+
+func (c *configSpace) Write(offset uint64, bytes []byte) error {
+	copy(c[offset:], bytes)
+
+	return nil
+}
+
+func TestConfigSpaces(t *testing.T) {
+	t.Parallel()
+
+	c := &configSpace{}
+	p := pci.New(pci.NewBridge())
+	p.ConfigSpaces[pci.BDF(0, 0x1f, 0)] = c
+
+	// 00:1f.0, offset 0x40
+	_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(uint32(0x8000f840)))
+	_ = p.PciConfDataOut(0xCFC, pci.NumToBytes(uint32(0x501)))
+
+	if c[0x40] != 0x01 || c[0x41] != 0x05 {
+		t.Fatalf("write did not reach the config space: %#x", c[0x40:0x44])
+	}
+
+	bytes := make([]byte, 4)
+	_ = p.PciConfDataIn(0xCFC, bytes)
+
+	if actual := pci.BytesToNum(bytes); actual != 0x501 {
+		t.Fatalf("expected: 0x501, actual: 0x%x", actual)
+	}
+}
+
+// capable is a bridge with a capability list.
+type capable struct {
+	pci.Device
+}
+
+func (c capable) Capabilities() []byte {
+	return []byte{0x09, 0x00, 0x04, 0x01}
+}
+
+func TestCapabilities(t *testing.T) {
+	t.Parallel()
+
+	p := pci.New(pci.Override(capable{pci.NewBridge()}, pci.IDs{RevisionID: 1}))
+	bytes := make([]byte, 4)
+
+	// The capabilities follow the header at 0x40, through Override too.
+	_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(uint32(0x80000040)))
+	_ = p.PciConfDataIn(0xCFC, bytes)
+
+	if actual := pci.BytesToNum(bytes); actual != 0x01040009 {
+		t.Fatalf("expected: 0x01040009, actual: 0x%x", actual)
+	}
+
+	// The rest of the configuration space reads as zeros.
+	_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(uint32(0x800000fc)))
+	_ = p.PciConfDataIn(0xCFC, bytes)
+
+	if actual := pci.BytesToNum(bytes); actual != 0 {
+		t.Fatalf("expected: 0, actual: 0x%x", actual)
+	}
+}
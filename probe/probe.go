@@ -0,0 +1,299 @@
+// Package probe reports what the host can run: the limits of KVM, whether
+// it is ready for confidential guests with SEV, TDX or SGX, and the largest
+// guest it can take:
+//
+//	$ gokvm probe
+//	KVM API version      12
+//	max vCPUs            1024 (recommended 8)
+//	memory slots         32764
+//	VM types             default sw_protected sev sev_es snp
+//	SEV                  ready, 509 ASIDs, SEV-ES with 0 ASIDs, SNP
+//	TDX                  not available
+//	SGX                  not available
+//	largest guest        8 vCPUs (1024 with -cpu-overcommit), 30720 MiB
+package probe
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bobuhiro11/gokvm/hostcheck"
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// Report is what the host can run.
+type Report struct {
+	APIVersion int
+	// MaxVCPUs is how many vCPUs a VM may have, RecommendedVCPUs how many
+	// KVM handles well, and MemSlots how many memory regions a VM may
+	// have.
+	MaxVCPUs, RecommendedVCPUs, MemSlots int
+	// VMTypes has bit n set for each kvm.VMType* n that KVM supports.
+	VMTypes uint64
+
+	SEV SEV
+	TDX TDX
+	SGX SGX
+
+	// HostCPUs and MemAvailable bound the largest guest, together with
+	// MaxVCPUs.
+	HostCPUs     int
+	MemAvailable uint64
+}
+
+// SEV is whether kvm_amd runs SEV guests. ASIDs, of which there are as
+// many as guests can run at once, are -1 if unknown.
+type SEV struct {
+	Enabled, ES, SNP bool
+	ASIDs, ESASIDs   int
+}
+
+// TDX is whether kvm_intel runs TDX guests, which takes the TDX module
+// loaded by the firmware.
+type TDX struct {
+	Enabled bool
+}
+
+// SGX is whether guests can run enclaves: KVM exposes SGX, the virtual EPC
+// device is there, and the host has EPCSize bytes of EPC.
+type SGX struct {
+	Supported, VEPC bool
+	EPCSize         uint64
+}
+
+const sys = "/sys"
+
+// Probe reports on the host of the KVM device kvmPath, usually /dev/kvm.
+func Probe(kvmPath string) (*Report, error) {
+	devKVM, err := os.OpenFile(kvmPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer devKVM.Close()
+
+	fd := devKVM.Fd()
+	r := &Report{}
+
+	v, err := kvm.GetAPIVersion(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	r.APIVersion = int(v)
+
+	for _, c := range []struct {
+		cap uint32
+		v   *int
+	}{
+		{kvm.CapMaxVCPUs, &r.MaxVCPUs},
+		{kvm.CapNRVCPUs, &r.RecommendedVCPUs},
+		{kvm.CapNRMemSlots, &r.MemSlots},
+	} {
+		if *c.v, err = kvm.CheckExtension(fd, c.cap); err != nil {
+			return nil, err
+		}
+	}
+
+	// KVM_CAP_MAX_VCPUS is 0 on kernels where the recommended number is
+	// the limit.
+	if r.MaxVCPUs == 0 {
+		r.MaxVCPUs = r.RecommendedVCPUs
+	}
+
+	types, err := kvm.CheckExtension(fd, kvm.CapVMTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	r.VMTypes = uint64(types) | 1<<kvm.VMTypeDefault
+	r.SEV = readSEV()
+	r.TDX = TDX{Enabled: moduleParam("kvm_intel", "tdx")}
+	r.SGX = readSGX(fd)
+
+	h, err := hostcheck.ReadHost()
+	if err != nil {
+		return nil, err
+	}
+
+	r.HostCPUs = h.NCPUs
+	r.MemAvailable = h.MemAvailable
+
+	return r, nil
+}
+
+// moduleParam tells whether a boolean parameter of a module is set.
+func moduleParam(module, param string) bool {
+	b, err := os.ReadFile(filepath.Join(sys, "module", module, "parameters", param))
+	if err != nil {
+		return false
+	}
+
+	v := strings.TrimSpace(string(b))
+
+	return v == "Y" || v == "1"
+}
+
+// readSEV reads SEV from the parameters of kvm_amd and the ASIDs from the
+// misc cgroup controller, which accounts for them.
+func readSEV() SEV {
+	s := SEV{
+		Enabled: moduleParam("kvm_amd", "sev"),
+		ES:      moduleParam("kvm_amd", "sev_es"),
+		SNP:     moduleParam("kvm_amd", "sev_snp"),
+		ASIDs:   -1,
+		ESASIDs: -1,
+	}
+
+	b, err := os.ReadFile(filepath.Join(sys, "fs", "cgroup", "misc.capacity"))
+	if err != nil {
+		return s
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+
+		n, err := strconv.Atoi(f[1])
+		if err != nil {
+			continue
+		}
+
+		switch f[0] {
+		case "sev":
+			s.ASIDs = n
+		case "sev_es":
+			s.ESASIDs = n
+		}
+	}
+
+	return s
+}
+
+// readSGX reads SGX from the CPUID that KVM supports and the EPC from the
+// NUMA nodes.
+func readSGX(fd uintptr) SGX {
+	var s SGX
+
+	supported := &kvm.CPUID{Nent: uint32(len(kvm.CPUID{}.Entries))}
+	if err := kvm.GetSupportedCPUID(fd, supported); err == nil {
+		for _, e := range supported.Entries[:supported.Nent] {
+			if e.Function == kvm.CPUIDFuncExtFeatures && e.Index == 0 && e.Ebx&(1<<2) != 0 {
+				s.Supported = true
+			}
+		}
+	}
+
+	if _, err := os.Stat("/dev/sgx_vepc"); err == nil {
+		s.VEPC = true
+	}
+
+	nodes, _ := filepath.Glob(filepath.Join(sys, "devices", "system", "node", "node*", "x86", "sgx_total_bytes"))
+	for _, n := range nodes {
+		b, err := os.ReadFile(n)
+		if err != nil {
+			continue
+		}
+
+		if size, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err == nil {
+			s.EPCSize += size
+		}
+	}
+
+	return s
+}
+
+var vmTypeNames = map[int]string{
+	kvm.VMTypeDefault:     "default",
+	kvm.VMTypeSWProtected: "sw_protected",
+	kvm.VMTypeSEV:         "sev",
+	kvm.VMTypeSEVES:       "sev_es",
+	kvm.VMTypeSEVSNP:      "snp",
+	kvm.VMTypeTDX:         "tdx",
+}
+
+// Write prints r to w.
+func (r *Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	var types []string
+
+	for t := 0; t < 64; t++ {
+		if r.VMTypes&(1<<t) == 0 {
+			continue
+		}
+
+		if name, ok := vmTypeNames[t]; ok {
+			types = append(types, name)
+		} else {
+			types = append(types, strconv.Itoa(t))
+		}
+	}
+
+	fmt.Fprintf(tw, "KVM API version\t%d\n", r.APIVersion)
+	fmt.Fprintf(tw, "max vCPUs\t%d (recommended %d)\n", r.MaxVCPUs, r.RecommendedVCPUs)
+	fmt.Fprintf(tw, "memory slots\t%d\n", r.MemSlots)
+	fmt.Fprintf(tw, "VM types\t%s\n", strings.Join(types, " "))
+	fmt.Fprintf(tw, "SEV\t%s\n", r.SEV)
+	fmt.Fprintf(tw, "TDX\t%s\n", r.TDX)
+	fmt.Fprintf(tw, "SGX\t%s\n", r.SGX)
+
+	cpus := r.HostCPUs
+	if cpus > r.MaxVCPUs {
+		cpus = r.MaxVCPUs
+	}
+
+	fmt.Fprintf(tw, "largest guest\t%d vCPUs (%d with -cpu-overcommit), %d MiB\n",
+		cpus, r.MaxVCPUs, r.MemAvailable>>20)
+
+	return tw.Flush()
+}
+
+func (s SEV) String() string {
+	if !s.Enabled {
+		return "not available"
+	}
+
+	str := "ready"
+	if s.ASIDs >= 0 {
+		str += fmt.Sprintf(", %d ASIDs", s.ASIDs)
+	}
+
+	if s.ES {
+		str += ", SEV-ES"
+		if s.ESASIDs >= 0 {
+			str += fmt.Sprintf(" with %d ASIDs", s.ESASIDs)
+		}
+	}
+
+	if s.SNP {
+		str += ", SNP"
+	}
+
+	return str
+}
+
+func (t TDX) String() string {
+	if !t.Enabled {
+		return "not available"
+	}
+
+	return "ready"
+}
+
+func (s SGX) String() string {
+	switch {
+	case !s.Supported:
+		return "not available"
+	case !s.VEPC:
+		return "no /dev/sgx_vepc"
+	default:
+		return fmt.Sprintf("ready, %d MiB EPC", s.EPCSize>>20)
+	}
+}
@@ -0,0 +1,57 @@
+package probe_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/probe"
+)
+
+func TestWrite(t *testing.T) {
+	t.Parallel()
+
+	r := &probe.Report{
+		APIVersion: 12, MaxVCPUs: 1024, RecommendedVCPUs: 8, MemSlots: 32764,
+		VMTypes:  1<<kvm.VMTypeDefault | 1<<kvm.VMTypeSEVSNP | 1<<7,
+		SEV:      probe.SEV{Enabled: true, ES: true, SNP: true, ASIDs: 509, ESASIDs: -1},
+		SGX:      probe.SGX{Supported: true, VEPC: true, EPCSize: 64 << 20},
+		HostCPUs: 16, MemAvailable: 4 << 30,
+	}
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"default snp 7\n",
+		"ready, 509 ASIDs, SEV-ES, SNP\n",
+		"TDX              not available\n",
+		"ready, 64 MiB EPC\n",
+		"16 vCPUs (1024 with -cpu-overcommit), 4096 MiB\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("no %q in:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	r, err := probe.Probe("/dev/kvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.APIVersion != 12 || r.MaxVCPUs < r.RecommendedVCPUs || r.VMTypes&1 == 0 || r.HostCPUs == 0 {
+		t.Errorf("unexpected report %+v", r)
+	}
+}
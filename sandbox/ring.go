@@ -0,0 +1,73 @@
+package sandbox
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// The ring is a memfd that gokvm and a helper both map: a header with the
+// requests gokvm has posted and the helper has done, and ringSlots slots
+// of a request each, with room for slotData bytes of data. Neither side
+// sees the memory of the other otherwise, least of all guest RAM.
+const (
+	ringSlots = 16
+	slotData  = 64 << 10
+
+	ringSize = pageSize + ringSlots*(pageSize+slotData)
+	pageSize = 0x1000
+)
+
+// Operations of a request.
+const (
+	opRead = iota + 1
+	opWrite
+	opSync
+)
+
+// ringHeader is at the start of the ring. Posted is written by gokvm and
+// done by the helper, both counting requests since the start, so that
+// slot i%ringSlots holds request i.
+type ringHeader struct {
+	posted uint32
+	_      uint32
+	done   uint32
+}
+
+// slot is the header of a request, followed by its data a page on. Errno
+// is set by the helper if the request failed, and N to the bytes it read
+// or wrote otherwise.
+type slot struct {
+	op    uint32
+	errno uint32
+	n     uint32
+	len   uint32
+	off   uint64
+}
+
+type ring []byte
+
+func (r ring) header() *ringHeader {
+	return (*ringHeader)(unsafe.Pointer(&r[0]))
+}
+
+func (r ring) slot(i uint32) (*slot, []byte) {
+	base := pageSize + int(i%ringSlots)*(pageSize+slotData)
+
+	return (*slot)(unsafe.Pointer(&r[base])), r[base+pageSize : base+pageSize+slotData]
+}
+
+func (r ring) posted() uint32 {
+	return atomic.LoadUint32(&r.header().posted)
+}
+
+func (r ring) post(n uint32) {
+	atomic.StoreUint32(&r.header().posted, n)
+}
+
+func (r ring) done() uint32 {
+	return atomic.LoadUint32(&r.header().done)
+}
+
+func (r ring) complete(n uint32) {
+	atomic.StoreUint32(&r.header().done, n)
+}
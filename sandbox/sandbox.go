@@ -0,0 +1,328 @@
+// Package sandbox runs device backends in helper processes, so that a bug
+// in one, e.g. in the parser of a disk image format, cannot take over the
+// address space of gokvm, which holds guest RAM and the KVM file
+// descriptors. A helper is gokvm itself, executed again with SandboxEnv
+// set; it gets the file of the backend and a ring of shared memory through
+// which gokvm passes it requests, and nothing else: before it serves them,
+// seccomp limits it to the system calls of I/O on the descriptors it has.
+//
+// This is experimental, and only the disk of virtio-blk runs in a helper
+// so far, as a raw image.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/memslot"
+)
+
+// SandboxEnv is the environment variable that makes gokvm a helper of the
+// backend it names, see RunHelper.
+const SandboxEnv = "GOKVM_SANDBOX"
+
+// Backends that can run in a helper.
+const (
+	BackendDisk = "disk"
+)
+
+var (
+	ErrHelperExited = errors.New("sandbox helper exited")
+	ErrSeccompSync  = errors.New("seccomp filter not applied to all threads")
+	ErrBackend      = errors.New("no such sandbox backend")
+)
+
+// The descriptors a helper gets, after stdin, stdout and stderr.
+const (
+	helperFile = 3 + iota
+	helperRing
+	helperBell
+)
+
+// Disk is a disk image that a helper process reads and writes, a
+// virtio.BlkBackend.
+type Disk struct {
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	ring ring
+	bell *os.File
+	// posted is the number of requests posted so far.
+	posted uint32
+}
+
+// StartDisk starts a helper for the disk image f, which it takes over:
+// once the helper has started, f is closed, and the helper has the only
+// descriptor of the image.
+func StartDisk(f *os.File) (*Disk, error) {
+	mem, memfd, err := memslot.MapFile(ringSize, memslot.Backing{Memfd: true})
+	if err != nil {
+		return nil, fmt.Errorf("sandbox ring: %w", err)
+	}
+	defer memfd.Close()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		_ = syscall.Munmap(mem)
+
+		return nil, fmt.Errorf("sandbox doorbell: %w", err)
+	}
+
+	bell, theirs := os.NewFile(uintptr(fds[0]), "doorbell"), os.NewFile(uintptr(fds[1]), "doorbell")
+	defer theirs.Close()
+
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{"gokvm-sandbox-" + BackendDisk},
+		Env:        []string{SandboxEnv + "=" + BackendDisk},
+		Stderr:     os.Stderr,
+		ExtraFiles: []*os.File{f, memfd, theirs},
+		// The helper goes with gokvm, however it ends.
+		SysProcAttr: &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL},
+	}
+
+	if err := cmd.Start(); err != nil {
+		_ = syscall.Munmap(mem)
+		_ = bell.Close()
+
+		return nil, fmt.Errorf("sandbox helper: %w", err)
+	}
+
+	_ = f.Close()
+
+	return &Disk{cmd: cmd, ring: mem, bell: bell}, nil
+}
+
+// do posts the requests of reqs, at most ringSlots, rings the doorbell and
+// waits for the helper to do them.
+func (d *Disk) do(reqs []slot, data [][]byte) ([]slot, error) {
+	for i, r := range reqs {
+		s, buf := d.ring.slot(d.posted + uint32(i))
+		*s = r
+		copy(buf, data[i])
+	}
+
+	d.posted += uint32(len(reqs))
+	d.ring.post(d.posted)
+
+	if _, err := d.bell.Write([]byte{0}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHelperExited, err)
+	}
+
+	// The helper rings back once it has done all requests posted when it
+	// woke up, which are all of them but for a helper gone wrong.
+	if n, err := d.bell.Read(make([]byte, 1)); n == 0 || err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHelperExited, err)
+	}
+
+	if done := d.ring.done(); done != d.posted {
+		return nil, fmt.Errorf("%w: %d of %d requests done", ErrHelperExited, done, d.posted)
+	}
+
+	done := make([]slot, len(reqs))
+	for i := range reqs {
+		s, buf := d.ring.slot(d.posted - uint32(len(reqs)) + uint32(i))
+		done[i] = *s
+
+		if reqs[i].op == opRead {
+			copy(data[i], buf[:s.n])
+		}
+	}
+
+	return done, nil
+}
+
+// rw reads or writes p at off in requests of at most slotData bytes, as
+// many at once as the ring takes.
+func (d *Disk) rw(op uint32, p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	total := 0
+
+	for len(p) > 0 {
+		var (
+			reqs []slot
+			data [][]byte
+		)
+
+		for len(p) > 0 && len(reqs) < ringSlots {
+			n := len(p)
+			if n > slotData {
+				n = slotData
+			}
+
+			reqs = append(reqs, slot{op: op, len: uint32(n), off: uint64(off)})
+			data = append(data, p[:n])
+			p, off = p[n:], off+int64(n)
+		}
+
+		done, err := d.do(reqs, data)
+		if err != nil {
+			return total, err
+		}
+
+		for i, s := range done {
+			total += int(s.n)
+
+			if s.errno != 0 {
+				return total, syscall.Errno(s.errno)
+			}
+
+			if s.n < reqs[i].len {
+				if op == opRead {
+					return total, io.EOF
+				}
+
+				return total, io.ErrShortWrite
+			}
+		}
+	}
+
+	return total, nil
+}
+
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	return d.rw(opRead, p, off)
+}
+
+func (d *Disk) WriteAt(p []byte, off int64) (int, error) {
+	return d.rw(opWrite, p, off)
+}
+
+// Sync has the helper write what the host caches of the disk to storage.
+func (d *Disk) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	done, err := d.do([]slot{{op: opSync}}, [][]byte{nil})
+	if err != nil {
+		return err
+	}
+
+	if done[0].errno != 0 {
+		return syscall.Errno(done[0].errno)
+	}
+
+	return nil
+}
+
+// Close ends the helper, which closes the disk.
+func (d *Disk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The helper exits once the doorbell is closed.
+	err := d.bell.Close()
+
+	if werr := d.cmd.Wait(); werr != nil && err == nil {
+		err = fmt.Errorf("sandbox helper: %w", werr)
+	}
+
+	if merr := syscall.Munmap(d.ring); merr != nil && err == nil {
+		err = merr
+	}
+
+	return err
+}
+
+// Pid returns the process ID of the helper.
+func (d *Disk) Pid() int {
+	return d.cmd.Process.Pid
+}
+
+// RunHelper serves the requests of gokvm and exits if the process is a
+// helper, and returns at once otherwise. main calls it before anything
+// else.
+func RunHelper() {
+	backend, ok := os.LookupEnv(SandboxEnv)
+	if !ok {
+		return
+	}
+
+	if err := serve(backend); err != nil {
+		fmt.Fprintf(os.Stderr, "gokvm sandbox %s: %v\n", backend, err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+// serve serves the requests of gokvm until it closes the doorbell.
+func serve(backend string) error {
+	if backend != BackendDisk {
+		return fmt.Errorf("%w: %q", ErrBackend, backend)
+	}
+
+	mem, err := syscall.Mmap(helperRing, 0, ringSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("ring: %w", err)
+	}
+
+	if err := restrict(helperSyscalls); err != nil {
+		return err
+	}
+
+	r := ring(mem)
+	b := make([]byte, 1)
+
+	for {
+		if n, err := syscall.Read(helperBell, b); errors.Is(err, syscall.ECONNRESET) || n == 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for done, posted := r.done(), r.posted(); done != posted; done++ {
+			s, buf := r.slot(done)
+			serveDisk(s, buf)
+			r.complete(done + 1)
+		}
+
+		if _, err := syscall.Write(helperBell, b); err != nil {
+			return err
+		}
+	}
+}
+
+// serveDisk does the request of s on the disk, with the data of buf.
+func serveDisk(s *slot, buf []byte) {
+	var (
+		n   int
+		err error
+	)
+
+	if s.len > slotData {
+		s.errno = uint32(syscall.EINVAL)
+
+		return
+	}
+
+	switch s.op {
+	case opRead:
+		n, err = syscall.Pread(helperFile, buf[:s.len], int64(s.off))
+	case opWrite:
+		n, err = syscall.Pwrite(helperFile, buf[:s.len], int64(s.off))
+	case opSync:
+		err = syscall.Fsync(helperFile)
+	default:
+		err = syscall.EINVAL
+	}
+
+	s.n, s.errno = 0, 0
+
+	var errno syscall.Errno
+
+	switch {
+	case err == nil:
+		s.n = uint32(n)
+	case errors.As(err, &errno):
+		s.errno = uint32(errno)
+	default:
+		s.errno = uint32(syscall.EIO)
+	}
+}
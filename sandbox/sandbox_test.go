@@ -0,0 +1,83 @@
+package sandbox_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/sandbox"
+)
+
+func TestMain(m *testing.M) {
+	// The helpers of the tests are the test binary.
+	sandbox.RunHelper()
+
+	os.Exit(m.Run())
+}
+
+func TestDisk(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	// Larger than the ring takes at once.
+	want := bytes.Repeat([]byte("0123456789abcdef"), 0x20000)
+	if err := os.WriteFile(path, want, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := sandbox.StartDisk(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(want)-5)
+	if n, err := d.ReadAt(got, 5); err != nil || n != len(got) || !bytes.Equal(got, want[5:]) {
+		t.Errorf("ReadAt: got %d bytes, %v", n, err)
+	}
+
+	if n, err := d.WriteAt([]byte("hello"), 0x10001); err != nil || n != 5 {
+		t.Errorf("WriteAt: got %d, %v", n, err)
+	}
+
+	if err := d.Sync(); err != nil {
+		t.Errorf("Sync: %v", err)
+	}
+
+	// Past the end of the disk.
+	if n, err := d.ReadAt(make([]byte, 16), int64(len(want))-8); n != 8 || !errors.Is(err, io.EOF) {
+		t.Errorf("ReadAt the end: got %d, %v, want 8, %v", n, err, io.EOF)
+	}
+
+	// The helper serves requests in seccomp filter mode.
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", d.Pid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(status, []byte("Seccomp:\t2")) {
+		t.Errorf("helper without a seccomp filter:\n%s", status)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b[0x10001:0x10006], []byte("hello")) {
+		t.Errorf("got %q on disk, want %q", b[0x10001:0x10006], "hello")
+	}
+}
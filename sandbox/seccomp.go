@@ -0,0 +1,105 @@
+package sandbox
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Constants of linux/seccomp.h, linux/filter.h and linux/audit.h, which
+// package syscall lacks. The system call numbers and the audit arch that
+// differ between architectures are in seccomp_$GOARCH.go.
+const (
+	sysClone3             = 435
+	seccompSetModeFilter  = 1
+	seccompFilterFlagSync = 1 // SECCOMP_FILTER_FLAG_TSYNC
+	seccompRetKillProcess = 0x80000000
+	seccompRetAllow       = 0x7fff0000
+	prSetNoNewPrivs       = 38
+
+	bpfLdWAbs = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfRetK   = 0x06 // BPF_RET | BPF_K
+
+	// Offsets in struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// helperSyscalls are what a helper may call once it serves requests: the
+// I/O of its disk and doorbell, and what the Go runtime needs to schedule
+// goroutines, grow its heap and collect garbage, and what glibc needs to
+// start threads in binaries linked with cgo. Opening files, sockets or
+// processes is not among them.
+var helperSyscalls = append([]uintptr{
+	syscall.SYS_READ, syscall.SYS_WRITE, syscall.SYS_PREAD64, syscall.SYS_PWRITE64,
+	syscall.SYS_FSYNC, syscall.SYS_FDATASYNC, syscall.SYS_CLOSE,
+	syscall.SYS_MMAP, syscall.SYS_MUNMAP, syscall.SYS_MADVISE, syscall.SYS_MPROTECT,
+	syscall.SYS_FUTEX, syscall.SYS_CLONE, sysClone3, syscall.SYS_SET_ROBUST_LIST, sysRseq,
+	syscall.SYS_SCHED_YIELD, syscall.SYS_NANOSLEEP,
+	syscall.SYS_RT_SIGACTION, syscall.SYS_RT_SIGPROCMASK, syscall.SYS_RT_SIGRETURN, syscall.SYS_SIGALTSTACK,
+	syscall.SYS_GETTID, syscall.SYS_GETPID, syscall.SYS_TGKILL,
+	syscall.SYS_EPOLL_CREATE1, syscall.SYS_EPOLL_PWAIT, syscall.SYS_EPOLL_CTL,
+	syscall.SYS_EVENTFD2, syscall.SYS_PIPE2, syscall.SYS_FCNTL,
+	syscall.SYS_CLOCK_GETTIME, syscall.SYS_RESTART_SYSCALL, sysGetrandom,
+	syscall.SYS_EXIT, syscall.SYS_EXIT_GROUP,
+}, archSyscalls...)
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// filter returns a BPF program that allows the system calls of nrs on the
+// architecture gokvm is built for, and kills the process for any other.
+func filter(nrs []uintptr) []sockFilter {
+	prog := []sockFilter{
+		{code: bpfLdWAbs, k: seccompDataArch},
+		{code: bpfJeqK, jt: 1, k: auditArch},
+		{code: bpfRetK, k: seccompRetKillProcess},
+		{code: bpfLdWAbs, k: seccompDataNr},
+	}
+
+	// Each check jumps to the allow at the end, past the checks after it
+	// and the kill.
+	for i, nr := range nrs {
+		prog = append(prog, sockFilter{code: bpfJeqK, jt: uint8(len(nrs) - i), k: uint32(nr)})
+	}
+
+	return append(prog,
+		sockFilter{code: bpfRetK, k: seccompRetKillProcess},
+		sockFilter{code: bpfRetK, k: seccompRetAllow},
+	)
+}
+
+// restrict confines all threads of the process to the system calls of
+// nrs, for good: neither it nor what it might execute can get rid of the
+// filter, or gain privileges.
+func restrict(nrs []uintptr) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("PR_SET_NO_NEW_PRIVS: %w", errno)
+	}
+
+	prog := filter(nrs)
+	fprog := sockFprog{len: uint16(len(prog)), filter: &prog[0]}
+
+	// With TSYNC, a thread that cannot take the filter is returned.
+	tid, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagSync,
+		uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+
+	if tid != 0 {
+		return fmt.Errorf("%w: thread %d", ErrSeccompSync, tid)
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+package sandbox
+
+import "syscall"
+
+// System call numbers of x86-64 that package syscall lacks.
+const (
+	sysGetrandom = 318
+	sysRseq      = 334
+	sysSeccomp   = 317
+
+	auditArch = 0xc000003e // AUDIT_ARCH_X86_64
+)
+
+// archSyscalls are the system calls of helperSyscalls that only x86-64
+// has.
+var archSyscalls = []uintptr{syscall.SYS_EPOLL_WAIT}
@@ -0,0 +1,14 @@
+package sandbox
+
+// System call numbers of arm64 that package syscall lacks.
+const (
+	sysGetrandom = 278
+	sysRseq      = 293
+	sysSeccomp   = 277
+
+	auditArch = 0xc00000b7 // AUDIT_ARCH_AARCH64
+)
+
+// archSyscalls are the system calls of helperSyscalls that only arm64
+// has: none, epoll_wait is epoll_pwait there.
+var archSyscalls []uintptr
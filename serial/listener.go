@@ -0,0 +1,122 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrAddr indicates an address that Listen does not take.
+var ErrAddr = errors.New("address must be unix:PATH or tcp:[HOST]:PORT")
+
+// writeTimeout is how long Write waits for a connection that does not
+// read, before it drops it.
+const writeTimeout = time.Second
+
+// Listener is a backend of a UART that listens on a Unix socket or a TCP
+// port and passes bytes to and from one connection at a time, which the
+// next one takes the place of when it ends, e.g. for the console of a
+// headless VM or a test that drives it.
+type Listener struct {
+	l net.Listener
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Listen listens on addr, unix:PATH or tcp:[HOST]:PORT, e.g. tcp::0 for a
+// port of the kernel's choosing, which Addr then tells.
+func Listen(addr string) (*Listener, error) {
+	network := "unix"
+
+	a := strings.TrimPrefix(addr, "unix:")
+	if a == addr {
+		network = "tcp"
+		a = strings.TrimPrefix(addr, "tcp:")
+	}
+
+	if a == addr || a == "" {
+		return nil, fmt.Errorf("%w: %q", ErrAddr, addr)
+	}
+
+	l, err := net.Listen(network, a)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{l: l}, nil
+}
+
+// Addr returns the address the listener is on.
+func (s *Listener) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+func (s *Listener) setConn(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn = c
+}
+
+// Read reads from the connection, and waits for the next one when there
+// is none or it ended.
+func (s *Listener) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		c := s.conn
+		s.mu.Unlock()
+
+		if c == nil {
+			var err error
+			if c, err = s.l.Accept(); err != nil {
+				return 0, err
+			}
+
+			s.setConn(c)
+		}
+
+		if n, err := c.Read(b); n > 0 || err == nil {
+			return n, nil
+		}
+
+		c.Close()
+		s.setConn(nil)
+	}
+}
+
+// Write writes b to the connection, and drops it when there is none, so
+// that the guest never waits for one. A connection that does not read
+// what it is sent is closed.
+func (s *Listener) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return len(b), nil
+	}
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	if _, err := s.conn.Write(b); err != nil {
+		// Read takes the next connection.
+		s.conn.Close()
+	}
+
+	return len(b), nil
+}
+
+// Close stops listening and closes the connection, which ends a Read.
+func (s *Listener) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+
+	return s.l.Close()
+}
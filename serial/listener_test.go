@@ -0,0 +1,90 @@
+package serial_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/serial"
+)
+
+func TestListen(t *testing.T) {
+	t.Parallel()
+
+	for _, addr := range []string{"", "tcp:", "unix:", "127.0.0.1:0", "udp:127.0.0.1:0"} {
+		if _, err := serial.Listen(addr); !errors.Is(err, serial.ErrAddr) {
+			t.Errorf("%q: got %v, want %v", addr, err, serial.ErrAddr)
+		}
+	}
+
+	for _, addr := range []string{"tcp:127.0.0.1:0", "unix:" + filepath.Join(t.TempDir(), "console.sock")} {
+		s, err := serial.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testListener(t, s)
+	}
+}
+
+func testListener(t *testing.T, s *serial.Listener) {
+	t.Helper()
+
+	// Nothing is connected, which must not keep the guest waiting.
+	if _, err := s.Write([]byte("dropped")); err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan string)
+	done := make(chan error)
+
+	go func() {
+		buf := make([]byte, 16)
+
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				done <- err
+
+				return
+			}
+
+			in <- string(buf[:n])
+		}
+	}()
+
+	// Each connection ends, and the next one takes its place.
+	for _, cmd := range []string{"ls\r", "uname\r"} {
+		c, err := net.Dial(s.Addr().Network(), s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := <-in; got != cmd {
+			t.Fatalf("got %q, want %q", got, cmd)
+		}
+
+		if _, err := s.Write([]byte("ok")); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "ok" {
+			t.Fatalf("got %q, %v, want %q", b, err, "ok")
+		}
+
+		c.Close()
+	}
+
+	s.Close()
+
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v, want %v", err, net.ErrClosed)
+	}
+}
@@ -1,13 +1,92 @@
+// Package serial emulates the 16550A UARTs of COM1 to COM4, with their FIFOs, the
+// interrupts of received data, of an empty transmitter and of the modem
+// status, and the loopback mode that drivers test the UART with.
+//
+// refs: https://www.ti.com/lit/ds/symlink/pc16550d.pdf
+// refs: https://gitlab.com/qemu-project/qemu/-/blob/master/hw/char/serial.c
 package serial
 
 import (
-	"fmt"
+	"io"
+	"os"
+	"sync"
 )
 
+// The standard I/O ports of the UARTs.
 const (
 	COM1Addr = 0x03f8
+	COM2Addr = 0x02f8
+	COM3Addr = 0x03e8
+	COM4Addr = 0x02e8
 )
 
+// Registers, by their offset from the base of the UART, of which the first two are
+// the divisor latch while LCR has lcrDLAB.
+const (
+	regData = 0 // RBR to read, THR to write
+	regIER  = 1
+	regIIR  = 2 // FCR to write
+	regLCR  = 3
+	regMCR  = 4
+	regLSR  = 5
+	regMSR  = 6
+	regSCR  = 7
+)
+
+const (
+	ierRDI  = 0x01 // received data available
+	ierTHRI = 0x02 // transmitter holding register empty
+	ierMSI  = 0x08 // modem status
+	ierMask = 0x0f
+
+	iirNoInt   = 0x01
+	iirMSI     = 0x00
+	iirTHRI    = 0x02
+	iirRDI     = 0x04
+	iirTimeout = 0x0c // fewer bytes than the trigger level, which wait
+	iirFIFOs   = 0xc0
+
+	fcrEnable    = 0x01
+	fcrClearRx   = 0x02
+	fcrClearTx   = 0x04
+	fcrTrigger   = 0xc0
+	fcrTriggerSh = 6
+
+	lcrDLAB = 0x80
+
+	mcrDTR  = 0x01
+	mcrRTS  = 0x02
+	mcrOUT1 = 0x04
+	mcrOUT2 = 0x08
+	mcrLoop = 0x10
+	mcrMask = 0x1f
+
+	lsrDR   = 0x01 // data ready
+	lsrOE   = 0x02 // overrun error
+	lsrTHRE = 0x20
+	lsrTEMT = 0x40
+
+	msrTERI = 0x04 // trailing edge of RI
+	msrCTS  = 0x10
+	msrDSR  = 0x20
+	msrRI   = 0x40
+	msrDCD  = 0x80
+	// The lines of the modem are always up, so that a getty finds a
+	// carrier, and their deltas are the low nibble.
+	msrUp    = msrCTS | msrDSR | msrDCD
+	msrDelta = 0x0f
+
+	// divisor9600 divides the 1.8432MHz clock down to 9600 baud.
+	divisor9600 = 0x0c
+)
+
+// fifoSize is how many received bytes the UART holds, those of a 16550A.
+const fifoSize = 16
+
+// triggerLevels are how many received bytes interrupt the guest, by the
+// trigger bits of FCR.
+var triggerLevels = [4]int{1, 4, 8, 14}
+
 // Note that this identical interface is defined across
 // multiple packages. It should be defined by the machine.
 
@@ -15,19 +94,53 @@ type IRQInjector interface {
 	InjectSerialIRQ() error
 }
 
+// Serial is the UART. It takes what the host sends the guest from its
+// input channel, and raises its edge-triggered IRQ through the injector
+// each time one of the interrupts the guest enabled comes up.
 type Serial struct {
 	IER byte
 	LCR byte
 
+	mu      sync.Mutex
+	base    uint64
+	mcr     byte
+	msr     byte
+	scr     byte
+	fcr     byte
+	divisor uint16
+	// loop are the bytes the guest sent itself in loopback mode, which it
+	// receives before those of the input channel, up to fifoSize.
+	loop []byte
+	// overrun is whether a byte looped back found the FIFO full and was
+	// lost, until the guest reads LSR.
+	overrun bool
+	// thri is whether the interrupt of the empty transmitter is up, until
+	// the guest reads it from IIR or writes THR.
+	thri bool
+	// irq is whether an interrupt is up, which the injector raised.
+	irq bool
+
 	inputChan chan byte
+	out       io.Writer
 
 	irqInjector IRQInjector
 }
 
+// New returns the UART of COM1.
 func New(irqInjector IRQInjector) (*Serial, error) {
+	return NewAt(COM1Addr, irqInjector)
+}
+
+// NewAt returns a UART whose registers are at the I/O ports from base,
+// e.g. COM2Addr.
+func NewAt(base uint64, irqInjector IRQInjector) (*Serial, error) {
 	s := &Serial{
 		IER: 0, LCR: 0,
+		base:        base,
+		msr:         msrUp,
+		divisor:     divisor9600,
 		inputChan:   make(chan byte, 10000),
+		out:         os.Stdout,
 		irqInjector: irqInjector,
 	}
 
@@ -38,80 +151,202 @@ func (s *Serial) GetInputChan() chan<- byte {
 	return s.inputChan
 }
 
+// SetOutput sets the destination of bytes written by the guest.
+// The default is os.Stdout.
+func (s *Serial) SetOutput(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.out = w
+}
+
+// Receive has the UART take note of what was sent to its input channel,
+// and interrupt the guest for it if it asked to.
+func (s *Serial) Receive() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update()
+}
+
 func (s *Serial) dlab() bool {
-	return s.LCR&0x80 != 0
+	return s.LCR&lcrDLAB != 0
+}
+
+// received returns how many received bytes there are for the guest.
+func (s *Serial) received() int {
+	return len(s.loop) + len(s.inputChan)
+}
+
+// interrupt returns the IIR identification of the highest priority
+// interrupt that is up, or iirNoInt.
+func (s *Serial) interrupt() byte {
+	switch n := s.received(); {
+	case n > 0 && s.IER&ierRDI != 0:
+		if s.fcr&fcrEnable != 0 && n < triggerLevels[(s.fcr&fcrTrigger)>>fcrTriggerSh] {
+			return iirTimeout
+		}
+
+		return iirRDI
+	case s.thri && s.IER&ierTHRI != 0:
+		return iirTHRI
+	case s.msr&msrDelta != 0 && s.IER&ierMSI != 0:
+		return iirMSI
+	}
+
+	return iirNoInt
+}
+
+// update raises the IRQ when an interrupt comes up, as the edge the guest
+// takes it on.
+func (s *Serial) update() error {
+	up := s.interrupt() != iirNoInt
+	raise := up && !s.irq
+	s.irq = up
+
+	if raise {
+		return s.irqInjector.InjectSerialIRQ()
+	}
+
+	return nil
+}
+
+// setMSR sets the lines of the modem status to lines, with the deltas of
+// the lines that changed.
+func (s *Serial) setMSR(lines byte) {
+	old := s.msr &^ msrDelta
+	delta := (old ^ lines) >> 4 &^ (msrRI >> 4)
+
+	// RI only flags its trailing edge.
+	if old&msrRI != 0 && lines&msrRI == 0 {
+		delta |= msrTERI
+	}
+
+	s.msr = lines | (s.msr|delta)&msrDelta
+}
+
+// loopLines returns the modem status lines looped back from those of mcr.
+func loopLines(mcr byte) byte {
+	var lines byte
+
+	for _, l := range [][2]byte{{mcrRTS, msrCTS}, {mcrDTR, msrDSR}, {mcrOUT1, msrRI}, {mcrOUT2, msrDCD}} {
+		if mcr&l[0] != 0 {
+			lines |= l[1]
+		}
+	}
+
+	return lines
 }
 
 func (s *Serial) In(port uint64, values []byte) error {
-	port -= COM1Addr
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	port -= s.base
+	values[0] = 0
 
 	switch {
-	case port == 0 && !s.dlab():
+	case port == regData && s.dlab():
+		values[0] = byte(s.divisor)
+	case port == regData:
 		// RBR
-		if len(s.inputChan) > 0 {
+		if len(s.loop) > 0 {
+			values[0], s.loop = s.loop[0], s.loop[1:]
+		} else if len(s.inputChan) > 0 {
 			values[0] = <-s.inputChan
 		}
-	case port == 0 && s.dlab():
-		// DLL
-		values[0] = 0xc // baud rate 9600
-	case port == 1 && !s.dlab():
-		// IER
+	case port == regIER && s.dlab():
+		values[0] = byte(s.divisor >> 8)
+	case port == regIER:
 		values[0] = s.IER
-	case port == 1 && s.dlab():
-		// DLM
-		values[0] = 0x0 // baud rate 9600
-	case port == 2:
-		// IIR
-	case port == 3:
-		// LCR
-	case port == 4:
-		// MCR
-	case port == 5:
-		// LSR
-		values[0] |= 0x20 // Empty Transmitter Holding Register
-		values[0] |= 0x40 // Empty Data Holding Registers
-
-		if len(s.inputChan) > 0 {
-			values[0] |= 0x1 // Data Ready
+	case port == regIIR:
+		values[0] = s.interrupt()
+		if values[0] == iirTHRI {
+			s.thri = false
+		}
+
+		if s.fcr&fcrEnable != 0 {
+			values[0] |= iirFIFOs
+		}
+	case port == regLCR:
+		values[0] = s.LCR
+	case port == regMCR:
+		values[0] = s.mcr
+	case port == regLSR:
+		// The transmitter is always done, as bytes go out as the guest
+		// writes them.
+		values[0] = lsrTHRE | lsrTEMT
+		if s.received() > 0 {
+			values[0] |= lsrDR
+		}
+
+		if s.overrun {
+			values[0] |= lsrOE
+			s.overrun = false
 		}
-	case port == 6:
-		// MSR
-		break
+	case port == regMSR:
+		values[0] = s.msr
+		s.msr &^= msrDelta
+	case port == regSCR:
+		values[0] = s.scr
 	}
 
-	return nil
+	return s.update()
 }
 
 func (s *Serial) Out(port uint64, values []byte) error {
-	port -= COM1Addr
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	var err error
+	port -= s.base
+	v := values[0]
 
 	switch {
-	case port == 0 && !s.dlab():
-		// THR
-		fmt.Printf("%c", values[0])
-	case port == 0 && s.dlab():
-		// DLL
-	case port == 1 && !s.dlab():
-		// IER
-		s.IER = values[0]
-		if s.IER != 0 {
-			err = s.irqInjector.InjectSerialIRQ()
+	case port == regData && s.dlab():
+		s.divisor = s.divisor&0xff00 | uint16(v)
+	case port == regData && s.mcr&mcrLoop != 0:
+		if len(s.loop) < fifoSize {
+			s.loop = append(s.loop, v)
+		} else {
+			s.overrun = true
+		}
+
+		s.thri = true
+	case port == regData:
+		// THR, written as the byte it is: bytes of UTF-8 characters are
+		// not characters of their own.
+		_, _ = s.out.Write(values[:1])
+		s.thri = true
+	case port == regIER && s.dlab():
+		s.divisor = s.divisor&0xff | uint16(v)<<8
+	case port == regIER:
+		// Enabling the interrupt of the empty transmitter raises it,
+		// which is how drivers start to transmit.
+		if v&ierTHRI != 0 && s.IER&ierTHRI == 0 {
+			s.thri = true
+		}
+
+		s.IER = v & ierMask
+	case port == regIIR:
+		// FCR. Clearing the receive FIFO drops the bytes looped back,
+		// but not those the host sent, which are not lost on a line.
+		if v&fcrClearRx != 0 {
+			s.loop = nil
+		}
+
+		s.fcr = v &^ (fcrClearRx | fcrClearTx)
+	case port == regLCR:
+		s.LCR = v
+	case port == regMCR:
+		s.mcr = v & mcrMask
+		if s.mcr&mcrLoop != 0 {
+			s.setMSR(loopLines(s.mcr))
+		} else {
+			s.setMSR(msrUp)
 		}
-	case port == 1 && s.dlab():
-		// DLM
-	case port == 2:
-		// FCR
-	case port == 3:
-		// LCR
-		s.LCR = values[0]
-	case port == 4:
-		// MCR
-	default:
-		// factory test or not used
-		break
+	case port == regSCR:
+		s.scr = v
 	}
 
-	return err
+	return s.update()
 }
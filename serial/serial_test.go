@@ -1,6 +1,7 @@
 package serial_test
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/bobuhiro11/gokvm/serial"
@@ -56,3 +57,228 @@ func TestOut(t *testing.T) {
 		}
 	}
 }
+
+func TestSetOutput(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(&mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	s.SetOutput(buf)
+
+	for _, c := range []byte("ok\n") {
+		if err := s.Out(serial.COM1Addr, []byte{c}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if buf.String() != "ok\n" {
+		t.Fatalf("got %q, want %q", buf.String(), "ok\n")
+	}
+}
+
+func TestOutUTF8(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(&mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	s.SetOutput(buf)
+
+	for _, c := range []byte("é─") {
+		if err := s.Out(serial.COM1Addr, []byte{c}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if buf.String() != "é─" {
+		t.Fatalf("got %q, want %q", buf.String(), "é─")
+	}
+}
+
+type countingInjector struct {
+	n int
+}
+
+func (c *countingInjector) InjectSerialIRQ() error {
+	c.n++
+
+	return nil
+}
+
+func in(t *testing.T, s *serial.Serial, reg uint64) byte {
+	t.Helper()
+
+	b := []byte{0}
+	if err := s.In(serial.COM1Addr+reg, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b[0]
+}
+
+func out(t *testing.T, s *serial.Serial, reg uint64, v byte) {
+	t.Helper()
+
+	if err := s.Out(serial.COM1Addr+reg, []byte{v}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceive(t *testing.T) {
+	t.Parallel()
+
+	irq := &countingInjector{}
+
+	s, err := serial.New(irq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// FIFOs with a trigger level of 4, and the interrupt of received data.
+	out(t, s, 2, 0x41)
+	out(t, s, 1, 0x01)
+
+	if iir := in(t, s, 2); iir != 0xc1 || irq.n != 0 {
+		t.Fatalf("IIR %#x with %d interrupts before input", iir, irq.n)
+	}
+
+	for _, c := range []byte("ab") {
+		s.GetInputChan() <- c
+
+		if err := s.Receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fewer bytes than the trigger level time out, with one edge.
+	if iir, lsr := in(t, s, 2), in(t, s, 5); iir != 0xcc || lsr&0x01 == 0 || irq.n != 1 {
+		t.Fatalf("IIR %#x, LSR %#x with %d interrupts", iir, lsr, irq.n)
+	}
+
+	if got := string([]byte{in(t, s, 0), in(t, s, 0)}); got != "ab" {
+		t.Fatalf("got %q, want %q", got, "ab")
+	}
+
+	if iir, lsr := in(t, s, 2), in(t, s, 5); iir != 0xc1 || lsr&0x01 != 0 {
+		t.Fatalf("IIR %#x, LSR %#x after reading", iir, lsr)
+	}
+
+	s.GetInputChan() <- 'c'
+
+	if err := s.Receive(); err != nil {
+		t.Fatal(err)
+	}
+
+	if irq.n != 2 {
+		t.Fatalf("%d interrupts, want 2", irq.n)
+	}
+}
+
+func TestTransmitInterrupt(t *testing.T) {
+	t.Parallel()
+
+	irq := &countingInjector{}
+
+	s, err := serial.New(irq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetOutput(&bytes.Buffer{})
+
+	// Enabling it raises it, and reading IIR clears it until the next
+	// byte goes out.
+	out(t, s, 1, 0x02)
+
+	if iir := in(t, s, 2); iir != 0x02 || irq.n != 1 {
+		t.Fatalf("IIR %#x with %d interrupts", iir, irq.n)
+	}
+
+	if iir := in(t, s, 2); iir != 0x01 {
+		t.Fatalf("IIR %#x after reading it", iir)
+	}
+
+	out(t, s, 0, 'x')
+
+	if iir := in(t, s, 2); iir != 0x02 || irq.n != 2 {
+		t.Fatalf("IIR %#x with %d interrupts", iir, irq.n)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(&mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	s.SetOutput(buf)
+
+	// The divisor latch and scratch register keep what they are given.
+	out(t, s, 3, 0x80)
+	out(t, s, 0, 0x01)
+	out(t, s, 1, 0x00)
+
+	if dll, dlm := in(t, s, 0), in(t, s, 1); dll != 0x01 || dlm != 0x00 {
+		t.Fatalf("divisor %#x%02x", dlm, dll)
+	}
+
+	out(t, s, 3, 0x03)
+	out(t, s, 7, 0x5a)
+
+	if scr := in(t, s, 7); scr != 0x5a {
+		t.Fatalf("SCR %#x", scr)
+	}
+
+	// Loopback with RTS and OUT2 reads back as CTS and DCD.
+	out(t, s, 4, 0x1a)
+	out(t, s, 0, 'l')
+
+	if msr := in(t, s, 6); msr&0xf0 != 0x90 {
+		t.Fatalf("MSR %#x in loopback", msr)
+	}
+
+	if c := in(t, s, 0); c != 'l' || buf.Len() != 0 {
+		t.Fatalf("got %q and %q out, want %q only back", c, buf.String(), 'l')
+	}
+
+	// The FIFO holds 16 bytes; the next one is lost and flags an overrun
+	// until LSR is read.
+	for i := 0; i < 17; i++ {
+		out(t, s, 0, byte('a'+i))
+	}
+
+	if lsr := in(t, s, 5); lsr&0x03 != 0x03 {
+		t.Fatalf("LSR %#x with the FIFO overrun", lsr)
+	}
+
+	if lsr := in(t, s, 5); lsr&0x02 != 0 {
+		t.Fatalf("LSR %#x read again", lsr)
+	}
+
+	for i := 0; i < 16; i++ {
+		if c := in(t, s, 0); c != byte('a'+i) {
+			t.Fatalf("byte %d: got %q, want %q", i, c, 'a'+i)
+		}
+	}
+
+	if lsr := in(t, s, 5); lsr&0x01 != 0 {
+		t.Fatalf("LSR %#x with the FIFO drained", lsr)
+	}
+
+	// Out of it, the lines are up again, DSR with its delta.
+	out(t, s, 4, 0x0b)
+
+	if msr := in(t, s, 6); msr != 0xb2 {
+		t.Fatalf("MSR %#x after loopback", msr)
+	}
+}
@@ -0,0 +1,324 @@
+// Package smbios builds the SMBIOS tables through which a guest, e.g.
+// dmidecode, cloud-init or a licensing check, learns what machine it runs
+// on: the BIOS (type 0), the system with its serial number and UUID (type
+// 1), the baseboard (type 2), each processor (type 4) and the memory
+// (types 16 and 17).
+//
+// refs: https://www.dmtf.org/sites/default/files/standards/documents/DSP0134_3.6.0.pdf
+package smbios
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Structure types.
+const (
+	TypeBIOS           = 0
+	TypeSystem         = 1
+	TypeBaseboard      = 2
+	TypeProcessor      = 4
+	TypePhysicalMemory = 16
+	TypeMemoryDevice   = 17
+	TypeEndOfTable     = 127
+)
+
+// The 32-bit entry point is 0x1f bytes long, with the intermediate one,
+// of the legacy DMI, from 0x10.
+const (
+	entryPointSize        = 0x1f
+	entryPointIntermStart = 0x10
+)
+
+// The version of the specification the tables follow, whose layouts of
+// the structures they use.
+const (
+	versionMajor = 2
+	versionMinor = 8
+)
+
+const defaultName = "gokvm"
+
+var ErrUUID = errors.New("UUID must be given as 8-4-4-4-12 hex digits")
+
+// Info is what the tables tell about the machine. Empty names are gokvm.
+type Info struct {
+	BIOSVendor   string
+	BIOSVersion  string
+	Manufacturer string
+	Product      string
+	Version      string
+	Serial       string
+	SKU          string
+	Family       string
+	UUID         [16]byte
+}
+
+// ParseUUID parses a UUID such as 4c4c4544-0000-1010-8000-b2c04f4d4e31
+// into the byte order of SMBIOS, in which the first three fields are
+// little-endian.
+func ParseUUID(s string) ([16]byte, error) {
+	var u [16]byte
+
+	fields := strings.Split(s, "-")
+	if len(fields) != 5 || len(fields[0]) != 8 || len(fields[1]) != 4 || len(fields[2]) != 4 ||
+		len(fields[3]) != 4 || len(fields[4]) != 12 {
+		return u, fmt.Errorf("%w: %q", ErrUUID, s)
+	}
+
+	b, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return u, fmt.Errorf("%w: %q", ErrUUID, s)
+	}
+
+	copy(u[:], b)
+
+	u[0], u[1], u[2], u[3] = u[3], u[2], u[1], u[0]
+	u[4], u[5] = u[5], u[4]
+	u[6], u[7] = u[7], u[6]
+
+	return u, nil
+}
+
+func or(s string) string {
+	if s == "" {
+		return defaultName
+	}
+
+	return s
+}
+
+// table is a structure table under construction.
+type table struct {
+	buf    []byte
+	count  int
+	max    int
+	handle uint16
+}
+
+// structure adds a structure of typ with the formatted area body, after
+// its 4-byte header, and the strings that body refers to by their
+// numbers, and returns its handle.
+func (t *table) structure(typ byte, body []byte, strs ...string) uint16 {
+	h := t.handle
+	t.handle++
+
+	s := []byte{typ, byte(4 + len(body)), 0, 0}
+	binary.LittleEndian.PutUint16(s[2:], h)
+	s = append(s, body...)
+
+	for _, str := range strs {
+		s = append(append(s, str...), 0)
+	}
+
+	if len(strs) == 0 {
+		s = append(s, 0)
+	}
+
+	s = append(s, 0)
+
+	t.buf = append(t.buf, s...)
+	t.count++
+
+	if len(s) > t.max {
+		t.max = len(s)
+	}
+
+	return h
+}
+
+// stringSet numbers the non-empty strings of a structure, for it to refer
+// to them, 0 being none.
+type stringSet struct {
+	strs []string
+}
+
+func (s *stringSet) add(str string) byte {
+	if str == "" {
+		return 0
+	}
+
+	s.strs = append(s.strs, str)
+
+	return byte(len(s.strs))
+}
+
+// Tables are the structures of a machine.
+type Tables struct {
+	// Data are the structures, ending with the end-of-table one.
+	Data []byte
+	// Count is the number of structures and MaxSize the size of the
+	// largest, for the entry point.
+	Count, MaxSize int
+}
+
+// New returns the tables of a machine of info with cpus processors and
+// memSize bytes of RAM.
+func New(info Info, cpus int, memSize uint64) *Tables {
+	t := &table{}
+
+	bios(t, info)
+	system(t, info)
+	baseboard(t, info)
+
+	for i := 0; i < cpus; i++ {
+		processor(t, i)
+	}
+
+	memory(t, memSize)
+
+	t.structure(TypeEndOfTable, nil)
+
+	return &Tables{Data: t.buf, Count: t.count, MaxSize: t.max}
+}
+
+func bios(t *table, info Info) {
+	s := &stringSet{}
+	b := make([]byte, 0x18-4)
+
+	b[0x04-4] = s.add(or(info.BIOSVendor))
+	b[0x05-4] = s.add(or(info.BIOSVersion))
+	binary.LittleEndian.PutUint16(b[0x06-4:], 0xe800) // starting segment
+	b[0x08-4] = s.add("01/01/2021")                   // release date
+	b[0x09-4] = 0                                     // 64KiB of ROM
+
+	// BIOS characteristics are not supported, and the machine is virtual.
+	binary.LittleEndian.PutUint64(b[0x0a-4:], 1<<3)
+	b[0x13-4] = 1 << 4
+	b[0x16-4], b[0x17-4] = 0xff, 0xff // no embedded controller firmware
+
+	t.structure(TypeBIOS, b, s.strs...)
+}
+
+func system(t *table, info Info) {
+	s := &stringSet{}
+	b := make([]byte, 0x1b-4)
+
+	b[0x04-4] = s.add(or(info.Manufacturer))
+	b[0x05-4] = s.add(or(info.Product))
+	b[0x06-4] = s.add(info.Version)
+	b[0x07-4] = s.add(info.Serial)
+	copy(b[0x08-4:], info.UUID[:])
+	b[0x18-4] = 0x06 // woken up by the power switch
+	b[0x19-4] = s.add(info.SKU)
+	b[0x1a-4] = s.add(info.Family)
+
+	t.structure(TypeSystem, b, s.strs...)
+}
+
+func baseboard(t *table, info Info) {
+	s := &stringSet{}
+	b := make([]byte, 0x0f-4)
+
+	b[0x04-4] = s.add(or(info.Manufacturer))
+	b[0x05-4] = s.add(or(info.Product))
+	b[0x06-4] = s.add(info.Version)
+	b[0x07-4] = s.add(info.Serial)
+	b[0x09-4] = 0x01                                  // a hosting board
+	binary.LittleEndian.PutUint16(b[0x0b-4:], 0xffff) // no chassis
+	b[0x0d-4] = 0x0a                                  // motherboard
+
+	t.structure(TypeBaseboard, b, s.strs...)
+}
+
+func processor(t *table, i int) {
+	s := &stringSet{}
+	b := make([]byte, 0x2a-4)
+
+	b[0x04-4] = s.add(fmt.Sprintf("CPU %d", i))
+	b[0x05-4] = 0x03 // central processor
+	b[0x06-4] = 0x01 // other family
+	b[0x07-4] = s.add(defaultName)
+	binary.LittleEndian.PutUint16(b[0x14-4:], 2000) // max speed in MHz
+	binary.LittleEndian.PutUint16(b[0x16-4:], 2000) // current speed
+	b[0x18-4] = 0x41                                // populated and enabled
+	b[0x19-4] = 0x01                                // other upgrade
+
+	// No caches.
+	binary.LittleEndian.PutUint16(b[0x1a-4:], 0xffff)
+	binary.LittleEndian.PutUint16(b[0x1c-4:], 0xffff)
+	binary.LittleEndian.PutUint16(b[0x1e-4:], 0xffff)
+
+	// A vCPU is a socket of its own with one core and thread.
+	b[0x23-4], b[0x24-4], b[0x25-4] = 1, 1, 1
+	binary.LittleEndian.PutUint16(b[0x26-4:], 0x02) // unknown characteristics
+	binary.LittleEndian.PutUint16(b[0x28-4:], 0x01) // other family
+
+	t.structure(TypeProcessor, b, s.strs...)
+}
+
+func memory(t *table, memSize uint64) {
+	kib, mib := memSize>>10, memSize>>20
+
+	a := make([]byte, 0x17-4)
+	a[0x04-4] = 0x03                                  // on the system board
+	a[0x05-4] = 0x03                                  // system memory
+	a[0x06-4] = 0x03                                  // no error correction
+	binary.LittleEndian.PutUint16(a[0x0b-4:], 0xfffe) // no error information
+	binary.LittleEndian.PutUint16(a[0x0d-4:], 1)      // devices
+
+	if kib < 0x80000000 {
+		binary.LittleEndian.PutUint32(a[0x07-4:], uint32(kib))
+	} else {
+		binary.LittleEndian.PutUint32(a[0x07-4:], 0x80000000)
+		binary.LittleEndian.PutUint64(a[0x0f-4:], memSize)
+	}
+
+	array := t.structure(TypePhysicalMemory, a)
+
+	s := &stringSet{}
+	d := make([]byte, 0x28-4)
+	binary.LittleEndian.PutUint16(d[0x04-4:], array)
+	binary.LittleEndian.PutUint16(d[0x06-4:], 0xfffe) // no error information
+	binary.LittleEndian.PutUint16(d[0x08-4:], 0xffff) // unknown widths
+	binary.LittleEndian.PutUint16(d[0x0a-4:], 0xffff)
+
+	if mib < 0x7fff {
+		binary.LittleEndian.PutUint16(d[0x0c-4:], uint16(mib))
+	} else {
+		binary.LittleEndian.PutUint16(d[0x0c-4:], 0x7fff)
+		binary.LittleEndian.PutUint32(d[0x1c-4:], uint32(mib))
+	}
+
+	d[0x0e-4] = 0x09 // DIMM
+	d[0x10-4] = s.add("DIMM 0")
+	d[0x12-4] = 0x07                                // RAM
+	binary.LittleEndian.PutUint16(d[0x13-4:], 0x02) // other type
+	d[0x17-4] = s.add(defaultName)
+
+	t.structure(TypeMemoryDevice, d, s.strs...)
+}
+
+// EntryPoint returns the 32-bit entry point of the tables, which are at
+// addr, for the guest to find on a 16-byte boundary in 0xf0000-0xfffff,
+// or for firmware to move with them.
+func (t *Tables) EntryPoint(addr uint32) []byte {
+	e := make([]byte, entryPointSize)
+
+	copy(e, "_SM_")
+	e[5] = entryPointSize
+	e[6], e[7] = versionMajor, versionMinor
+	binary.LittleEndian.PutUint16(e[8:], uint16(t.MaxSize))
+	copy(e[entryPointIntermStart:], "_DMI_")
+	binary.LittleEndian.PutUint16(e[0x16:], uint16(len(t.Data)))
+	binary.LittleEndian.PutUint32(e[0x18:], addr)
+	binary.LittleEndian.PutUint16(e[0x1c:], uint16(t.Count))
+	e[0x1e] = versionMajor<<4 | versionMinor
+
+	e[0x15] = -sum(e[entryPointIntermStart:])
+	e[4] = -sum(e)
+
+	return e
+}
+
+func sum(b []byte) byte {
+	s := byte(0)
+	for _, c := range b {
+		s += c
+	}
+
+	return s
+}
@@ -0,0 +1,126 @@
+package smbios_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/smbios"
+)
+
+type structure struct {
+	typ       byte
+	handle    uint16
+	formatted []byte
+	strings   []string
+}
+
+// parse splits tables into their structures, as dmidecode does.
+func parse(t *testing.T, tables []byte) []structure {
+	t.Helper()
+
+	var structs []structure
+
+	for len(tables) > 0 {
+		if len(tables) < 4 || int(tables[1]) > len(tables) {
+			t.Fatalf("truncated structure: % x", tables)
+		}
+
+		s := structure{
+			typ:       tables[0],
+			handle:    binary.LittleEndian.Uint16(tables[2:]),
+			formatted: tables[:tables[1]],
+		}
+
+		rest := tables[tables[1]:]
+
+		end := bytes.Index(rest, []byte{0, 0})
+		if end < 0 {
+			t.Fatalf("unterminated strings: % x", rest)
+		}
+
+		for _, str := range bytes.Split(rest[:end], []byte{0}) {
+			if len(str) > 0 {
+				s.strings = append(s.strings, string(str))
+			}
+		}
+
+		structs = append(structs, s)
+		tables = rest[end+2:]
+	}
+
+	return structs
+}
+
+func sum(b []byte) byte {
+	s := byte(0)
+	for _, c := range b {
+		s += c
+	}
+
+	return s
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	uuid, err := smbios.ParseUUID("4c4c4544-0000-1010-8000-b2c04f4d4e31")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := smbios.New(smbios.Info{Serial: "ds=nocloud", UUID: uuid}, 2, 48<<30)
+	structs := parse(t, tables.Data)
+
+	var types []byte
+	for _, s := range structs {
+		types = append(types, s.typ)
+	}
+
+	if !bytes.Equal(types, []byte{0, 1, 2, 4, 4, 16, 17, 127}) || tables.Count != len(structs) {
+		t.Fatalf("types %v, count %d", types, tables.Count)
+	}
+
+	system := structs[1]
+	if got := system.strings; len(got) != 3 || got[0] != "gokvm" || got[2] != "ds=nocloud" ||
+		system.formatted[7] != 3 {
+		t.Fatalf("system strings %q", got)
+	}
+
+	if got := system.formatted[8:24]; !bytes.Equal(got, []byte{
+		0x44, 0x45, 0x4c, 0x4c, 0x00, 0x00, 0x10, 0x10, 0x80, 0x00, 0xb2, 0xc0, 0x4f, 0x4d, 0x4e, 0x31,
+	}) {
+		t.Fatalf("UUID % x", got)
+	}
+
+	if got := structs[4].strings[0]; got != "CPU 1" {
+		t.Fatalf("socket %q", got)
+	}
+
+	// 48GiB is too much for the size field of the memory device.
+	dimm := structs[6].formatted
+	if binary.LittleEndian.Uint16(dimm[4:]) != structs[5].handle ||
+		binary.LittleEndian.Uint16(dimm[0x0c:]) != 0x7fff || binary.LittleEndian.Uint32(dimm[0x1c:]) != 48<<10 {
+		t.Fatalf("memory device % x", dimm)
+	}
+
+	e := tables.EntryPoint(0xf0020)
+	if string(e[:4]) != "_SM_" || string(e[0x10:0x15]) != "_DMI_" || sum(e) != 0 || sum(e[0x10:]) != 0 {
+		t.Fatalf("entry point % x", e)
+	}
+
+	if binary.LittleEndian.Uint32(e[0x18:]) != 0xf0020 || int(binary.LittleEndian.Uint16(e[0x16:])) != len(tables.Data) {
+		t.Fatalf("entry point % x", e)
+	}
+}
+
+func TestParseUUID(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{"", "4c4c4544-0000-1010-8000", "4c4c4544-0000-1010-8000-b2c04f4d4e3g"} {
+		if _, err := smbios.ParseUUID(s); !errors.Is(err, smbios.ErrUUID) {
+			t.Errorf("%q: got %v, want %v", s, err, smbios.ErrUUID)
+		}
+	}
+}
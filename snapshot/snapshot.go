@@ -0,0 +1,216 @@
+// Package snapshot writes guest RAM to a sparse image and reads it back.
+//
+// A freshly booted guest has mostly zero pages, and many of the others are
+// the same, so the image is an index with one entry per page followed by
+// only the distinct non-zero pages:
+//
+//	magic    [8]byte  "GKVMRAM1"
+//	pageSize uint32
+//	flags    uint32   zero
+//	nPages   uint64
+//	index    [nPages]uint64  0 for a zero page, else 1 + the number of its data page
+//	data     [n][pageSize]byte
+//
+// All numbers are little-endian.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+)
+
+const (
+	magic = "GKVMRAM1"
+
+	// PageSize is the granularity of the image.
+	PageSize = 0x1000
+)
+
+var (
+	ErrMagic    = errors.New("not a gokvm RAM image")
+	ErrMemSize  = errors.New("memory size does not match the image")
+	ErrBadIndex = errors.New("corrupt page index")
+)
+
+type header struct {
+	Magic    [8]byte
+	PageSize uint32
+	Flags    uint32
+	NPages   uint64
+}
+
+// Stats counts the pages of a written image.
+type Stats struct {
+	Zero      int
+	Duplicate int
+	Data      int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d zero, %d duplicate and %d data pages", s.Zero, s.Duplicate, s.Data)
+}
+
+var zeroPage [PageSize]byte
+
+// IsZero reports whether page has only zero bytes.
+func IsZero(page []byte) bool {
+	for len(page) > 0 {
+		n := len(page)
+		if n > PageSize {
+			n = PageSize
+		}
+
+		if !bytes.Equal(page[:n], zeroPage[:n]) {
+			return false
+		}
+
+		page = page[n:]
+	}
+
+	return true
+}
+
+// Index returns the page index of mem and the numbers of the pages whose
+// data goes in the image. With dedup, identical pages share their data.
+func Index(mem []byte, dedup bool) ([]uint64, []int, Stats) {
+	nPages := len(mem) / PageSize
+	index := make([]uint64, nPages)
+	data := []int{}
+	stats := Stats{}
+
+	seed := maphash.MakeSeed()
+	seen := map[uint64][]int{}
+
+	for i := range index {
+		page := mem[i*PageSize : (i+1)*PageSize]
+
+		if IsZero(page) {
+			stats.Zero++
+
+			continue
+		}
+
+		if dedup {
+			h := maphash.Hash{}
+			h.SetSeed(seed)
+			_, _ = h.Write(page)
+			sum := h.Sum64()
+
+			if n, ok := findPage(mem, data, seen[sum], page); ok {
+				index[i] = uint64(n) + 1
+				stats.Duplicate++
+
+				continue
+			}
+
+			seen[sum] = append(seen[sum], len(data))
+		}
+
+		data = append(data, i)
+		index[i] = uint64(len(data))
+		stats.Data++
+	}
+
+	return index, data, stats
+}
+
+// findPage looks for page among the data pages with the same hash.
+func findPage(mem []byte, data, candidates []int, page []byte) (int, bool) {
+	for _, n := range candidates {
+		p := data[n]
+		if bytes.Equal(mem[p*PageSize:(p+1)*PageSize], page) {
+			return n, true
+		}
+	}
+
+	return 0, false
+}
+
+// WriteMemory writes mem, a multiple of PageSize long, as a sparse image.
+func WriteMemory(w io.Writer, mem []byte, dedup bool) (Stats, error) {
+	if len(mem)%PageSize != 0 {
+		return Stats{}, fmt.Errorf("%w: %#x is not a multiple of %#x", ErrMemSize, len(mem), PageSize)
+	}
+
+	index, data, stats := Index(mem, dedup)
+
+	bw := bufio.NewWriter(w)
+	hdr := header{PageSize: PageSize, NPages: uint64(len(index))}
+	copy(hdr.Magic[:], magic)
+
+	if err := binary.Write(bw, binary.LittleEndian, hdr); err != nil {
+		return stats, err
+	}
+
+	if err := binary.Write(bw, binary.LittleEndian, index); err != nil {
+		return stats, err
+	}
+
+	for _, p := range data {
+		if _, err := bw.Write(mem[p*PageSize : (p+1)*PageSize]); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, bw.Flush()
+}
+
+// ReadMemory reads a sparse image into mem, which must be as large as the
+// memory it was written from.
+func ReadMemory(r io.Reader, mem []byte) error {
+	br := bufio.NewReader(r)
+	hdr := header{}
+
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+
+	if string(hdr.Magic[:]) != magic || hdr.PageSize != PageSize {
+		return ErrMagic
+	}
+
+	if hdr.NPages*PageSize != uint64(len(mem)) {
+		return fmt.Errorf("%w: image has %#x bytes, memory %#x", ErrMemSize, hdr.NPages*PageSize, len(mem))
+	}
+
+	index := make([]uint64, hdr.NPages)
+	if err := binary.Read(br, binary.LittleEndian, index); err != nil {
+		return err
+	}
+
+	// Data pages are in the order of their first use, so every page is
+	// either read now or copied from one read before.
+	first := map[uint64]int{}
+
+	for i, n := range index {
+		page := mem[i*PageSize : (i+1)*PageSize]
+
+		switch p, ok := first[n]; {
+		case n == 0:
+			// Fresh memory is already zero and stays unallocated if
+			// only read.
+			if !IsZero(page) {
+				for j := range page {
+					page[j] = 0
+				}
+			}
+		case ok:
+			copy(page, mem[p*PageSize:(p+1)*PageSize])
+		case n == uint64(len(first))+1:
+			if _, err := io.ReadFull(br, page); err != nil {
+				return err
+			}
+
+			first[n] = i
+		default:
+			return fmt.Errorf("%w: page %#x refers to data page %d", ErrBadIndex, i, n)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/snapshot"
+)
+
+func testMemory() []byte {
+	mem := make([]byte, 16*snapshot.PageSize)
+
+	// pages 1, 5 and 9 are the same, 3 differs, the rest are zero
+	for _, p := range []int{1, 5, 9} {
+		copy(mem[p*snapshot.PageSize:], "same page")
+	}
+
+	copy(mem[3*snapshot.PageSize+100:], "other page")
+
+	return mem
+}
+
+func TestWriteReadMemory(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		dedup bool
+		stats snapshot.Stats
+	}{
+		{false, snapshot.Stats{Zero: 12, Duplicate: 0, Data: 4}},
+		{true, snapshot.Stats{Zero: 12, Duplicate: 2, Data: 2}},
+	} {
+		mem := testMemory()
+		buf := bytes.Buffer{}
+
+		stats, err := snapshot.WriteMemory(&buf, mem, tc.dedup)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats != tc.stats {
+			t.Fatalf("dedup %v: stats %v, expected %v", tc.dedup, stats, tc.stats)
+		}
+
+		// header, index and only the data pages
+		if size := 24 + 16*8 + tc.stats.Data*snapshot.PageSize; buf.Len() != size {
+			t.Fatalf("dedup %v: image is %d bytes, expected %d", tc.dedup, buf.Len(), size)
+		}
+
+		restored := bytes.Repeat([]byte{0xff}, len(mem))
+		if err := snapshot.ReadMemory(&buf, restored); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(restored, mem) {
+			t.Fatalf("dedup %v: restored memory differs", tc.dedup)
+		}
+	}
+}
+
+func TestReadMemoryErrors(t *testing.T) {
+	t.Parallel()
+
+	mem := testMemory()
+	buf := bytes.Buffer{}
+
+	if _, err := snapshot.WriteMemory(&buf, mem, true); err != nil {
+		t.Fatal(err)
+	}
+
+	image := buf.Bytes()
+
+	if err := snapshot.ReadMemory(bytes.NewReader(image), make([]byte, snapshot.PageSize)); !errors.Is(err, snapshot.ErrMemSize) {
+		t.Fatalf("got %v, expected %v", err, snapshot.ErrMemSize)
+	}
+
+	bad := append([]byte{}, image...)
+	bad[0] = 'X'
+
+	if err := snapshot.ReadMemory(bytes.NewReader(bad), mem); !errors.Is(err, snapshot.ErrMagic) {
+		t.Fatalf("got %v, expected %v", err, snapshot.ErrMagic)
+	}
+
+	// page 1 refers to the data page after the ones seen so far
+	bad = append([]byte{}, image...)
+	binary.LittleEndian.PutUint64(bad[24+8:], 2)
+
+	if err := snapshot.ReadMemory(bytes.NewReader(bad), mem); !errors.Is(err, snapshot.ErrBadIndex) {
+		t.Fatalf("got %v, expected %v", err, snapshot.ErrBadIndex)
+	}
+
+	if _, err := snapshot.WriteMemory(&buf, mem[1:], false); !errors.Is(err, snapshot.ErrMemSize) {
+		t.Fatalf("got %v, expected %v", err, snapshot.ErrMemSize)
+	}
+}
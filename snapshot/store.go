@@ -0,0 +1,405 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ShardSize is the granularity at which a Store shares RAM between
+// snapshots.
+const ShardSize = 64 * PageSize
+
+var (
+	ErrNotFound = errors.New("no such snapshot")
+	ErrExists   = errors.New("snapshot exists")
+	ErrName     = errors.New("invalid snapshot name")
+)
+
+// Info describes a snapshot of a Store.
+type Info struct {
+	Name string
+	// Parent is the snapshot this one was taken after restoring or
+	// branched from, if any.
+	Parent  string    `json:",omitempty"`
+	Time    time.Time // of the Save or Branch
+	MemSize int
+	// Shards are the hashes of the ShardSize pieces of RAM, empty for
+	// zero ones.
+	Shards []string
+	// State is what devices keep besides RAM, e.g. the virtual clock,
+	// see SetState.
+	State map[string]json.RawMessage `json:",omitempty"`
+}
+
+// Store keeps snapshots of guest RAM in a directory as a tree, each naming
+// its parent. RAM is split into shards stored once by content under shards/,
+// so that snapshots of the same guest share most of their data, and each
+// snapshot is a JSON manifest of its shards under snapshots/. Shards that
+// Delete leaves unreferenced stay until GC.
+type Store struct {
+	dir string
+}
+
+// OpenStore opens the store in dir, creating it if needed.
+func OpenStore(dir string) (*Store, error) {
+	s := &Store{dir: dir}
+
+	for _, d := range []string{s.shardDir(), s.manifestDir()} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Store) shardDir() string {
+	return filepath.Join(s.dir, "shards")
+}
+
+func (s *Store) manifestDir() string {
+	return filepath.Join(s.dir, "snapshots")
+}
+
+func (s *Store) manifest(name string) string {
+	return filepath.Join(s.manifestDir(), name+".json")
+}
+
+func checkName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%w: %q", ErrName, name)
+	}
+
+	return nil
+}
+
+// writeFile writes a file of the store atomically, so that an interrupted
+// write leaves no partial snapshot or shard.
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Get returns the snapshot name.
+func (s *Store) Get(name string) (Info, error) {
+	info := Info{}
+
+	if err := checkName(name); err != nil {
+		return info, err
+	}
+
+	b, err := os.ReadFile(s.manifest(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return info, fmt.Errorf("%w: %s", ErrNotFound, name)
+	} else if err != nil {
+		return info, err
+	}
+
+	return info, json.Unmarshal(b, &info)
+}
+
+func (s *Store) put(info Info, overwrite bool) error {
+	if !overwrite {
+		if _, err := os.Stat(s.manifest(info.Name)); err == nil {
+			return fmt.Errorf("%w: %s", ErrExists, info.Name)
+		}
+	}
+
+	b, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(s.manifest(info.Name), b)
+}
+
+// Save stores mem, a multiple of ShardSize long, as the snapshot name,
+// a child of parent unless that is empty.
+func (s *Store) Save(name, parent string, mem []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	if len(mem)%ShardSize != 0 {
+		return fmt.Errorf("%w: %#x is not a multiple of %#x", ErrMemSize, len(mem), ShardSize)
+	}
+
+	if parent != "" {
+		if _, err := s.Get(parent); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.Get(name); err == nil {
+		return fmt.Errorf("%w: %s", ErrExists, name)
+	}
+
+	info := Info{Name: name, Parent: parent, Time: time.Now(), MemSize: len(mem)}
+
+	for off := 0; off < len(mem); off += ShardSize {
+		shard := mem[off : off+ShardSize]
+
+		if IsZero(shard) {
+			info.Shards = append(info.Shards, "")
+
+			continue
+		}
+
+		sum := sha256.Sum256(shard)
+		hash := hex.EncodeToString(sum[:])
+		path := filepath.Join(s.shardDir(), hash)
+
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			if err := writeFile(path, shard); err != nil {
+				return err
+			}
+		}
+
+		info.Shards = append(info.Shards, hash)
+	}
+
+	return s.put(info, false)
+}
+
+// Restore reads the snapshot name into mem, which must be as large as the
+// memory it was saved from.
+func (s *Store) Restore(name string, mem []byte) error {
+	info, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+
+	if info.MemSize != len(mem) || len(info.Shards)*ShardSize != len(mem) {
+		return fmt.Errorf("%w: snapshot has %#x bytes, memory %#x", ErrMemSize, info.MemSize, len(mem))
+	}
+
+	for i, hash := range info.Shards {
+		shard := mem[i*ShardSize : (i+1)*ShardSize]
+
+		if hash == "" {
+			if !IsZero(shard) {
+				copy(shard, make([]byte, ShardSize))
+			}
+
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(s.shardDir(), hash))
+		if err != nil {
+			return err
+		}
+
+		_, err = io.ReadFull(f, shard)
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", hash, err)
+		}
+	}
+
+	return nil
+}
+
+// SetState keeps v, as JSON, under key with the snapshot name.
+func (s *Store) SetState(name, key string, v interface{}) error {
+	info, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if info.State == nil {
+		info.State = map[string]json.RawMessage{}
+	}
+
+	info.State[key] = b
+
+	return s.put(info, true)
+}
+
+// GetState reads what SetState kept under key with the snapshot name into
+// v, and reports whether there was anything.
+func (s *Store) GetState(name, key string, v interface{}) (bool, error) {
+	info, err := s.Get(name)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := info.State[key]
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(b, v)
+}
+
+// List returns the snapshots, oldest first.
+func (s *Store) List() ([]Info, error) {
+	names, err := filepath.Glob(filepath.Join(s.manifestDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []Info{}
+
+	for _, n := range names {
+		info, err := s.Get(strings.TrimSuffix(filepath.Base(n), ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		if !infos[i].Time.Equal(infos[j].Time) {
+			return infos[i].Time.Before(infos[j].Time)
+		}
+
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos, nil
+}
+
+// Branch adds the snapshot name with the same RAM as from, as a child of
+// it, e.g. to label a line of experiments before any has been saved.
+func (s *Store) Branch(from, name string) error {
+	info, err := s.Get(from)
+	if err != nil {
+		return err
+	}
+
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	info.Name, info.Parent, info.Time = name, from, time.Now()
+
+	return s.put(info, false)
+}
+
+// Delete removes the snapshot name. Its children become children of its
+// parent.
+func (s *Store) Delete(name string) error {
+	info, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+
+	infos, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range infos {
+		if child.Parent != name {
+			continue
+		}
+
+		child.Parent = info.Parent
+		if err := s.put(child, true); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(s.manifest(name))
+}
+
+// GC removes the shards no snapshot refers to and returns how many.
+func (s *Store) GC() (int, error) {
+	infos, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+
+	used := map[string]bool{}
+
+	for _, info := range infos {
+		for _, hash := range info.Shards {
+			used[hash] = true
+		}
+	}
+
+	entries, err := os.ReadDir(s.shardDir())
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	for _, e := range entries {
+		if used[e.Name()] {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.shardDir(), e.Name())); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// WriteTree writes the snapshots indented under their parents.
+func (s *Store) WriteTree(w io.Writer) error {
+	infos, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	children := map[string][]Info{}
+	for _, info := range infos {
+		children[info.Parent] = append(children[info.Parent], info)
+	}
+
+	var walk func(parent string, depth int) error
+
+	walk = func(parent string, depth int) error {
+		for _, info := range children[parent] {
+			if _, err := fmt.Fprintf(w, "%s%s\t%s\n",
+				strings.Repeat("  ", depth), info.Name, info.Time.Format(time.RFC3339)); err != nil {
+				return err
+			}
+
+			if err := walk(info.Name, depth+1); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return walk("", 0)
+}
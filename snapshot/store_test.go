@@ -0,0 +1,176 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/snapshot"
+)
+
+func shards(t *testing.T, dir string) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(dir, "shards"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(entries)
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	s, err := snapshot.OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 4*snapshot.ShardSize)
+	copy(mem[snapshot.ShardSize:], "booted")
+
+	if err := s.Save("base", "", mem); err != nil {
+		t.Fatal(err)
+	}
+
+	// A child changes one shard and shares the other.
+	copy(mem[3*snapshot.ShardSize:], "tried")
+
+	if err := s.Save("try", "base", mem); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := shards(t, dir); n != 2 {
+		t.Fatalf("shards: got %d, want 2", n)
+	}
+
+	if err := s.Branch("base", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	tree := bytes.Buffer{}
+	if err := s.WriteTree(&tree); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, l := range strings.Split(strings.TrimSpace(tree.String()), "\n") {
+		names = append(names, strings.Split(l, "\t")[0])
+	}
+
+	if got := strings.Join(names, ","); got != "base,  try,  other" {
+		t.Fatalf("tree: got %q", got)
+	}
+
+	restored := bytes.Repeat([]byte{0xff}, len(mem))
+	if err := s.Restore("other", restored); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored[:snapshot.ShardSize+6], mem[:snapshot.ShardSize+6]) ||
+		!snapshot.IsZero(restored[3*snapshot.ShardSize:]) {
+		t.Fatal("restored memory differs from base")
+	}
+
+	// Deleting base moves its children to the root, and its RAM lives
+	// on in other.
+	if err := s.Delete("base"); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := s.Get("try"); err != nil || info.Parent != "" {
+		t.Fatalf("try: got %+v, %v", info, err)
+	}
+
+	if n, err := s.GC(); err != nil || n != 0 {
+		t.Fatalf("GC: got %d, %v, want 0", n, err)
+	}
+
+	if err := s.Delete("try"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.GC(); err != nil || n != 1 {
+		t.Fatalf("GC: got %d, %v, want 1", n, err)
+	}
+
+	if err := s.Restore("other", restored); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	t.Parallel()
+
+	s, err := snapshot.OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, snapshot.ShardSize)
+
+	for _, tc := range []struct {
+		err  error
+		want error
+	}{
+		{s.Save("../x", "", mem), snapshot.ErrName},
+		{s.Save("a", "missing", mem), snapshot.ErrNotFound},
+		{s.Save("a", "", mem[1:]), snapshot.ErrMemSize},
+		{s.Save("a", "", mem), nil},
+		{s.Save("a", "", mem), snapshot.ErrExists},
+		{s.Branch("a", "a"), snapshot.ErrExists},
+		{s.Branch("b", "c"), snapshot.ErrNotFound},
+		{s.Delete("b"), snapshot.ErrNotFound},
+		{s.Restore("a", make([]byte, 2*snapshot.ShardSize)), snapshot.ErrMemSize},
+	} {
+		if !errors.Is(tc.err, tc.want) {
+			t.Errorf("got %v, want %v", tc.err, tc.want)
+		}
+	}
+}
+
+func TestStoreState(t *testing.T) {
+	t.Parallel()
+
+	s, err := snapshot.OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Save("base", "", make([]byte, snapshot.ShardSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetState("base", "clock", 42); err != nil {
+		t.Fatal(err)
+	}
+
+	v := 0
+
+	if ok, err := s.GetState("base", "clock", &v); err != nil || !ok || v != 42 {
+		t.Fatalf("GetState: got %d, %v, %v, want 42, true, nil", v, ok, err)
+	}
+
+	if ok, err := s.GetState("base", "rtc", &v); err != nil || ok {
+		t.Fatalf("GetState of a missing key: got %v, %v", ok, err)
+	}
+
+	// A branch starts with the state of where it branched from.
+	if err := s.Branch("base", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := s.GetState("other", "clock", &v); err != nil || !ok || v != 42 {
+		t.Fatalf("GetState of a branch: got %d, %v, %v", v, ok, err)
+	}
+
+	if err := s.SetState("none", "clock", 1); !errors.Is(err, snapshot.ErrNotFound) {
+		t.Fatalf("SetState of a missing snapshot: got %v, want %v", err, snapshot.ErrNotFound)
+	}
+}
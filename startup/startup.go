@@ -0,0 +1,107 @@
+// Package startup measures where the VMM spends its time before the
+// first guest instruction, so that the overhead can be kept in Budget.
+package startup
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Budget is the time gokvm aims to take from main to running the guest.
+const Budget = 10 * time.Millisecond
+
+// Phase is a step of startup.
+type Phase struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Timer records phases, either consecutive ones with Mark or, e.g. for
+// work done in parallel, ones with their own start with Since.
+type Timer struct {
+	mu     sync.Mutex
+	last   time.Time
+	phases []Phase
+}
+
+// Start returns a Timer whose first phase begins now.
+func Start() *Timer {
+	return &Timer{last: time.Now()}
+}
+
+// Mark ends the phase that began at the previous Mark or at Start.
+func (t *Timer) Mark(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.phases = append(t.phases, Phase{Name: name, Start: t.last, Duration: now.Sub(t.last)})
+	t.last = now
+}
+
+// Since records a phase from start until now. It does not affect Mark.
+func (t *Timer) Since(name string, start time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.phases = append(t.phases, Phase{Name: name, Start: start, Duration: time.Since(start)})
+}
+
+// Phases returns the phases recorded so far.
+func (t *Timer) Phases() []Phase {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Phase{}, t.phases...)
+}
+
+// Total returns the time from the start of the first of phases to the end
+// of the last one. Phases that overlap count once.
+func Total(phases []Phase) time.Duration {
+	if len(phases) == 0 {
+		return 0
+	}
+
+	first, last := phases[0].Start, phases[0].Start
+
+	for _, p := range phases {
+		if p.Start.Before(first) {
+			first = p.Start
+		}
+
+		if end := p.Start.Add(p.Duration); end.After(last) {
+			last = end
+		}
+	}
+
+	return last.Sub(first)
+}
+
+// Report writes phases in the order they began, with their offset from the
+// first, followed by the total and how it compares to budget.
+func Report(w io.Writer, budget time.Duration, phases []Phase) error {
+	phases = append([]Phase{}, phases...)
+	sort.SliceStable(phases, func(i, j int) bool { return phases[i].Start.Before(phases[j].Start) })
+
+	for _, p := range phases {
+		if _, err := fmt.Fprintf(w, "startup: %9v +%-9v %s\r\n",
+			p.Start.Sub(phases[0].Start).Round(time.Microsecond), p.Duration.Round(time.Microsecond), p.Name); err != nil {
+			return err
+		}
+	}
+
+	total := Total(phases)
+	verdict := "within"
+
+	if total > budget {
+		verdict = "over"
+	}
+
+	_, err := fmt.Fprintf(w, "startup: total %v, %s the budget of %v\r\n", total.Round(time.Microsecond), verdict, budget)
+
+	return err
+}
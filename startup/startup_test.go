@@ -0,0 +1,73 @@
+package startup_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/startup"
+)
+
+func TestTotal(t *testing.T) {
+	t.Parallel()
+
+	t0 := time.Now()
+	phases := []startup.Phase{
+		{Name: "b", Start: t0.Add(2 * time.Millisecond), Duration: time.Millisecond},
+		{Name: "a", Start: t0, Duration: 2 * time.Millisecond},
+		// in parallel with the others
+		{Name: "c", Start: t0.Add(time.Millisecond), Duration: 3 * time.Millisecond},
+	}
+
+	if total := startup.Total(phases); total != 4*time.Millisecond {
+		t.Errorf("Total: got %v, want 4ms", total)
+	}
+
+	if total := startup.Total(nil); total != 0 {
+		t.Errorf("Total of no phases: got %v, want 0", total)
+	}
+
+	out := strings.Builder{}
+	if err := startup.Report(&out, 3*time.Millisecond, phases); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\r\n")
+	if len(lines) != 4 {
+		t.Fatalf("Report: got %q, want 4 lines", out.String())
+	}
+
+	for i, name := range []string{"a", "c", "b"} {
+		if !strings.HasSuffix(lines[i], " "+name) {
+			t.Errorf("line %d: got %q, want phase %s", i, lines[i], name)
+		}
+	}
+
+	if !strings.Contains(lines[3], "total 4ms, over the budget of 3ms") {
+		t.Errorf("total: got %q", lines[3])
+	}
+}
+
+func TestTimer(t *testing.T) {
+	t.Parallel()
+
+	timer := startup.Start()
+	start := time.Now()
+
+	timer.Mark("first")
+	timer.Mark("second")
+	timer.Since("parallel", start)
+
+	phases := timer.Phases()
+	if len(phases) != 3 {
+		t.Fatalf("Phases: got %d, want 3", len(phases))
+	}
+
+	if !phases[1].Start.Equal(phases[0].Start.Add(phases[0].Duration)) {
+		t.Errorf("second phase does not start at the end of the first: %+v", phases)
+	}
+
+	if !phases[2].Start.Equal(start) {
+		t.Errorf("Since: got start %v, want %v", phases[2].Start, start)
+	}
+}
@@ -0,0 +1,331 @@
+// Package stub provides stand-ins for the LPC hardware that firmware probes
+// during bring-up: SuperIO configuration ports and an ACPI embedded
+// controller. They do nothing but log accesses and return the values that
+// have been programmed, which is enough for firmware not to hang waiting
+// on hardware that is not there.
+//
+// refs:
+// https://uefi.org/specs/ACPI/6.5/12_ACPI_Embedded_Controller_Interface_Specification.html
+// https://www.coreboot.org/Developer_Manual/Super_IO
+package stub
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// SuperIOKind selects the key sequence that enters configuration mode.
+type SuperIOKind int
+
+const (
+	// ITE chips enter with 0x87 0x01 0x55 0x55 (0x55 0xaa at 0x4e) and
+	// leave by writing 0x02 to register 0x02.
+	ITE SuperIOKind = iota
+	// Nuvoton and Winbond chips enter with 0x87 0x87 and leave with 0xaa.
+	Nuvoton
+)
+
+const (
+	superIORegLDN     = 0x07
+	superIORegChipID  = 0x20
+	superIORegChipRev = 0x21
+	superIORegConfig  = 0x02
+
+	superIOExitITE     = 0x02
+	superIOExitNuvoton = 0xaa
+)
+
+// SuperIO answers on an index/data port pair such as 0x2e/0x2f or 0x4e/0x4f.
+type SuperIO struct {
+	mu sync.Mutex
+
+	base uint64
+	kind SuperIOKind
+	key  []byte
+	log  io.Writer
+
+	// keys entered so far and whether configuration mode is on
+	keyPos int
+	config bool
+
+	index uint8
+	ldn   uint8
+	regs  map[[2]uint8]uint8
+}
+
+// NewSuperIO returns a SuperIO of kind at base reporting chip id.
+// Accesses are logged to log unless it is nil.
+func NewSuperIO(kind SuperIOKind, base uint64, id uint16, log io.Writer) *SuperIO {
+	s := &SuperIO{
+		base: base,
+		kind: kind,
+		log:  log,
+		regs: map[[2]uint8]uint8{},
+	}
+
+	switch {
+	case kind == Nuvoton:
+		s.key = []byte{0x87, 0x87}
+	case base == 0x4e:
+		s.key = []byte{0x87, 0x01, 0x55, 0xaa}
+	default:
+		s.key = []byte{0x87, 0x01, 0x55, 0x55}
+	}
+
+	// The global registers are the same in every logical device.
+	s.regs[[2]uint8{0, superIORegChipID}] = uint8(id >> 8)
+	s.regs[[2]uint8{0, superIORegChipRev}] = uint8(id)
+
+	return s
+}
+
+// Ports returns the index and data ports.
+func (s *SuperIO) Ports() []uint64 {
+	return []uint64{s.base, s.base + 1}
+}
+
+// Set programs the value read from register reg of logical device ldn.
+// Registers below 0x30 are global and ignore ldn.
+func (s *SuperIO) Set(ldn, reg, value uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.regs[s.regKey(ldn, reg)] = value
+}
+
+func (s *SuperIO) regKey(ldn, reg uint8) [2]uint8 {
+	if reg < 0x30 {
+		ldn = 0
+	}
+
+	return [2]uint8{ldn, reg}
+}
+
+func (s *SuperIO) In(port uint64, bytes []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case !s.config:
+		bytes[0] = 0xff
+	case port == s.base:
+		bytes[0] = s.index
+	case s.index == superIORegLDN:
+		bytes[0] = s.ldn
+	default:
+		bytes[0] = s.regs[s.regKey(s.ldn, s.index)]
+	}
+
+	s.logf("superio %#x: in %#x = %#02x", port, s.index, bytes[0])
+
+	return nil
+}
+
+func (s *SuperIO) Out(port uint64, bytes []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value := bytes[0]
+
+	if !s.config {
+		s.enter(port, value)
+
+		return nil
+	}
+
+	s.logf("superio %#x: out %#x = %#02x", port, s.index, value)
+
+	if port == s.base {
+		if s.kind == Nuvoton && value == superIOExitNuvoton {
+			s.config = false
+
+			return nil
+		}
+
+		s.index = value
+
+		return nil
+	}
+
+	switch {
+	case s.index == superIORegLDN:
+		s.ldn = value
+	case s.kind == ITE && s.index == superIORegConfig && value&superIOExitITE != 0:
+		s.config = false
+	default:
+		s.regs[s.regKey(s.ldn, s.index)] = value
+	}
+
+	return nil
+}
+
+// enter follows the key sequence written to the index port.
+func (s *SuperIO) enter(port uint64, value byte) {
+	if port != s.base || value != s.key[s.keyPos] {
+		s.keyPos = 0
+
+		if port != s.base || value != s.key[0] {
+			return
+		}
+	}
+
+	if s.keyPos++; s.keyPos == len(s.key) {
+		s.keyPos = 0
+		s.config = true
+		s.logf("superio %#x: enter config mode", port)
+	}
+}
+
+func (s *SuperIO) logf(format string, a ...interface{}) {
+	if s.log != nil {
+		fmt.Fprintf(s.log, format+"\r\n", a...)
+	}
+}
+
+const (
+	ECDataPort    = 0x62
+	ECCommandPort = 0x66
+
+	ecCmdRead         = 0x80
+	ecCmdWrite        = 0x81
+	ecCmdBurstEnable  = 0x82
+	ecCmdBurstDisable = 0x83
+	ecCmdQuery        = 0x84
+
+	ecStatusOBF   = 0x01
+	ecStatusCMD   = 0x08
+	ecStatusBurst = 0x10
+
+	ecBurstAck = 0x90
+)
+
+type ecState int
+
+const (
+	ecIdle ecState = iota
+	ecReadAddr
+	ecWriteAddr
+	ecWriteData
+)
+
+// EC is an ACPI embedded controller with 256 bytes of RAM on ports 0x62
+// and 0x66. Commands complete at once, so the input buffer is never full.
+type EC struct {
+	mu sync.Mutex
+
+	log io.Writer
+	ram [256]byte
+
+	state  ecState
+	addr   uint8
+	status uint8
+	out    uint8
+}
+
+// NewEC returns an EC whose accesses are logged to log unless it is nil.
+func NewEC(log io.Writer) *EC {
+	return &EC{log: log}
+}
+
+// Ports returns the data and command ports.
+func (e *EC) Ports() []uint64 {
+	return []uint64{ECDataPort, ECCommandPort}
+}
+
+// Set programs the byte at addr in the EC RAM.
+func (e *EC) Set(addr, value uint8) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.ram[addr] = value
+}
+
+// Get returns the byte at addr in the EC RAM, e.g. as written by the guest.
+func (e *EC) Get(addr uint8) uint8 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.ram[addr]
+}
+
+func (e *EC) In(port uint64, bytes []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch port {
+	case ECDataPort:
+		bytes[0] = e.out
+		e.status &^= ecStatusOBF
+	case ECCommandPort:
+		bytes[0] = e.status
+	default:
+		bytes[0] = 0xff
+	}
+
+	e.logf("ec %#x: in %#02x", port, bytes[0])
+
+	return nil
+}
+
+func (e *EC) Out(port uint64, bytes []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	value := bytes[0]
+
+	e.logf("ec %#x: out %#02x", port, value)
+
+	switch port {
+	case ECCommandPort:
+		e.command(value)
+	case ECDataPort:
+		e.status &^= ecStatusCMD
+
+		switch e.state {
+		case ecReadAddr:
+			e.respond(e.ram[value])
+			e.state = ecIdle
+		case ecWriteAddr:
+			e.addr = value
+			e.state = ecWriteData
+		case ecWriteData:
+			e.ram[e.addr] = value
+			e.state = ecIdle
+		case ecIdle:
+		}
+	}
+
+	return nil
+}
+
+func (e *EC) command(cmd byte) {
+	e.status |= ecStatusCMD
+	e.state = ecIdle
+
+	switch cmd {
+	case ecCmdRead:
+		e.state = ecReadAddr
+	case ecCmdWrite:
+		e.state = ecWriteAddr
+	case ecCmdBurstEnable:
+		e.status |= ecStatusBurst
+		e.respond(ecBurstAck)
+	case ecCmdBurstDisable:
+		e.status &^= ecStatusBurst
+	case ecCmdQuery:
+		// No SCI events are ever pending.
+		e.respond(0)
+	}
+}
+
+func (e *EC) respond(value byte) {
+	e.out = value
+	e.status |= ecStatusOBF
+}
+
+func (e *EC) logf(format string, a ...interface{}) {
+	if e.log != nil {
+		fmt.Fprintf(e.log, format+"\r\n", a...)
+	}
+}
@@ -0,0 +1,154 @@
+package stub_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/stub"
+)
+
+func out(t *testing.T, d interface {
+	Out(port uint64, bytes []byte) error
+}, port uint64, values ...byte,
+) {
+	t.Helper()
+
+	for _, v := range values {
+		if err := d.Out(port, []byte{v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func in(t *testing.T, d interface {
+	In(port uint64, bytes []byte) error
+}, port uint64,
+) byte {
+	t.Helper()
+
+	b := []byte{0}
+	if err := d.In(port, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b[0]
+}
+
+func TestSuperIOITE(t *testing.T) {
+	t.Parallel()
+
+	log := &bytes.Buffer{}
+	s := stub.NewSuperIO(stub.ITE, 0x2e, 0x8728, log)
+	s.Set(4, 0x60, 0x0a)
+
+	out(t, s, 0x2e, 0x20)
+
+	if v := in(t, s, 0x2f); v != 0xff {
+		t.Fatalf("before entering config mode: got %#x, want 0xff", v)
+	}
+
+	out(t, s, 0x2e, 0x87, 0x01, 0x55, 0x55)
+
+	out(t, s, 0x2e, 0x20)
+
+	if v := in(t, s, 0x2f); v != 0x87 {
+		t.Fatalf("chip id: got %#x, want 0x87", v)
+	}
+
+	out(t, s, 0x2e, 0x21)
+
+	if v := in(t, s, 0x2f); v != 0x28 {
+		t.Fatalf("chip rev: got %#x, want 0x28", v)
+	}
+
+	out(t, s, 0x2e, 0x07)
+	out(t, s, 0x2f, 4)
+	out(t, s, 0x2e, 0x60)
+
+	if v := in(t, s, 0x2f); v != 0x0a {
+		t.Fatalf("programmed value: got %#x, want 0x0a", v)
+	}
+
+	out(t, s, 0x2f, 0x0b)
+
+	if v := in(t, s, 0x2f); v != 0x0b {
+		t.Fatalf("written value: got %#x, want 0x0b", v)
+	}
+
+	out(t, s, 0x2e, 0x02)
+	out(t, s, 0x2f, 0x02)
+
+	if v := in(t, s, 0x2f); v != 0xff {
+		t.Fatalf("after leaving config mode: got %#x, want 0xff", v)
+	}
+
+	if !strings.Contains(log.String(), "superio 0x2e: enter config mode") {
+		t.Errorf("accesses are not logged: %q", log.String())
+	}
+}
+
+func TestSuperIONuvoton(t *testing.T) {
+	t.Parallel()
+
+	s := stub.NewSuperIO(stub.Nuvoton, 0x4e, 0xc562, nil)
+
+	if ports := s.Ports(); len(ports) != 2 || ports[0] != 0x4e || ports[1] != 0x4f {
+		t.Fatalf("Ports(): got %#x", ports)
+	}
+
+	// A wrong key is ignored, and a retry starts over.
+	out(t, s, 0x4e, 0x87, 0x01, 0x87, 0x87, 0x20)
+
+	if v := in(t, s, 0x4f); v != 0xc5 {
+		t.Fatalf("chip id: got %#x, want 0xc5", v)
+	}
+
+	out(t, s, 0x4e, 0xaa)
+
+	if v := in(t, s, 0x4f); v != 0xff {
+		t.Fatalf("after leaving config mode: got %#x, want 0xff", v)
+	}
+}
+
+func TestEC(t *testing.T) {
+	t.Parallel()
+
+	e := stub.NewEC(nil)
+	e.Set(0x10, 0x42)
+
+	// read
+	out(t, e, stub.ECCommandPort, 0x80)
+	out(t, e, stub.ECDataPort, 0x10)
+
+	if status := in(t, e, stub.ECCommandPort); status&0x01 == 0 {
+		t.Fatalf("status: got %#x, want OBF set", status)
+	}
+
+	if v := in(t, e, stub.ECDataPort); v != 0x42 {
+		t.Fatalf("read: got %#x, want 0x42", v)
+	}
+
+	if status := in(t, e, stub.ECCommandPort); status&0x01 != 0 {
+		t.Fatalf("status: got %#x, want OBF clear", status)
+	}
+
+	// write
+	out(t, e, stub.ECCommandPort, 0x81)
+	out(t, e, stub.ECDataPort, 0x20, 0x43)
+
+	if v := e.Get(0x20); v != 0x43 {
+		t.Fatalf("write: got %#x, want 0x43", v)
+	}
+
+	// burst enable
+	out(t, e, stub.ECCommandPort, 0x82)
+
+	if v := in(t, e, stub.ECDataPort); v != 0x90 {
+		t.Fatalf("burst ack: got %#x, want 0x90", v)
+	}
+
+	if status := in(t, e, stub.ECCommandPort); status&0x10 == 0 {
+		t.Fatalf("status: got %#x, want burst set", status)
+	}
+}
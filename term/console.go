@@ -0,0 +1,201 @@
+package term
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+var ErrConsoleMode = errors.New("console mode must be passthrough or sanitize")
+
+// ConsoleMode is how a ConsoleWriter treats escape sequences and invalid
+// UTF-8 the guest writes.
+type ConsoleMode int
+
+const (
+	// Passthrough leaves what the guest writes as it is, e.g. for TUIs that
+	// draw with ANSI escape sequences.
+	Passthrough ConsoleMode = iota
+	// Sanitize drops escape sequences and control characters other than
+	// tab, newline, carriage return and backspace, and replaces invalid
+	// UTF-8 with U+FFFD, e.g. for logs or a console that must not be
+	// retitled or cleared by the guest.
+	Sanitize
+)
+
+func (c ConsoleMode) String() string {
+	if c == Sanitize {
+		return "sanitize"
+	}
+
+	return "passthrough"
+}
+
+// ParseConsoleMode parses the String of a ConsoleMode.
+func ParseConsoleMode(s string) (ConsoleMode, error) {
+	switch s {
+	case "passthrough":
+		return Passthrough, nil
+	case "sanitize":
+		return Sanitize, nil
+	}
+
+	return Passthrough, fmt.Errorf("%w: %q", ErrConsoleMode, s)
+}
+
+// escState is where a ConsoleWriter in Sanitize mode is in an escape
+// sequence, after ECMA-48.
+type escState int
+
+const (
+	escGround escState = iota
+	// escStart is after ESC.
+	escStart
+	// escIntermediate is in the intermediate bytes of ESC sequences such
+	// as the character set selections ESC ( B.
+	escIntermediate
+	// escCSI is in the parameters of a control sequence, ESC [ ... final.
+	escCSI
+	// escString is in a control string, e.g. an OSC that sets the window
+	// title, which ends with BEL or ST, ESC \.
+	escString
+	// escStringEnd is after ESC in a control string.
+	escStringEnd
+)
+
+// ConsoleWriter writes the console output of the guest to an io.Writer.
+// The guest writes a byte at a time to the serial port, so a character of
+// several bytes of UTF-8 would reach a terminal or socket in pieces, which
+// consoles that decode each write on its own, e.g. in a browser, render as
+// garbage. ConsoleWriter holds back the start of such a character until it
+// is complete, so that each write to w holds whole characters.
+type ConsoleWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	mode ConsoleMode
+	// partial is the incomplete character the last Write ended in.
+	partial []byte
+	esc     escState
+}
+
+func NewConsoleWriter(w io.Writer, mode ConsoleMode) *ConsoleWriter {
+	return &ConsoleWriter{w: w, mode: mode}
+}
+
+func (c *ConsoleWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf := append(c.partial, p...)
+	n := completeRunes(buf)
+	c.partial = append([]byte{}, buf[n:]...)
+
+	out := buf[:n]
+	if c.mode == Sanitize {
+		out = c.sanitize(out)
+	}
+
+	if len(out) == 0 {
+		return len(p), nil
+	}
+
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// completeRunes returns the length of buf without the incomplete
+// character it may end in. Invalid UTF-8 counts as complete.
+func completeRunes(buf []byte) int {
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				return i
+			}
+
+			break
+		}
+	}
+
+	return len(buf)
+}
+
+// sanitize returns buf without escape sequences and control characters,
+// keeping track of sequences split across writes in c.esc.
+func (c *ConsoleWriter) sanitize(buf []byte) []byte {
+	out := make([]byte, 0, len(buf))
+
+	for len(buf) > 0 {
+		r, size := utf8.DecodeRune(buf)
+		buf = buf[size:]
+
+		switch c.esc {
+		case escGround:
+			out = c.ground(out, r)
+		case escStart:
+			c.start(r)
+		case escIntermediate:
+			if r < 0x20 || r > 0x2f {
+				c.esc = escGround
+			}
+		case escCSI:
+			if r == 0x1b {
+				c.esc = escStart
+			} else if r < 0x20 || r > 0x3f {
+				c.esc = escGround
+			}
+		case escString:
+			if r == 0x07 {
+				c.esc = escGround
+			} else if r == 0x1b {
+				c.esc = escStringEnd
+			}
+		case escStringEnd:
+			if r == '\\' {
+				c.esc = escGround
+			} else {
+				c.start(r)
+			}
+		}
+	}
+
+	return out
+}
+
+// ground appends r to out unless it is a control character, or ESC, which
+// starts an escape sequence.
+func (c *ConsoleWriter) ground(out []byte, r rune) []byte {
+	switch {
+	case r == 0x1b:
+		c.esc = escStart
+	case r == '\t', r == '\n', r == '\r', r == '\b':
+		out = append(out, byte(r))
+	case r < 0x20, r == 0x7f, r >= 0x80 && r <= 0x9f:
+		// C0 and C1 controls, and DEL, are dropped.
+	default:
+		// Invalid UTF-8 decodes to utf8.RuneError, U+FFFD.
+		out = append(out, string(r)...)
+	}
+
+	return out
+}
+
+// start takes r after ESC.
+func (c *ConsoleWriter) start(r rune) {
+	switch {
+	case r == '[':
+		c.esc = escCSI
+	case r == ']', r == 'P', r == 'X', r == '^', r == '_':
+		c.esc = escString
+	case r == 0x1b:
+		c.esc = escStart
+	case r >= 0x20 && r <= 0x2f:
+		c.esc = escIntermediate
+	default:
+		c.esc = escGround
+	}
+}
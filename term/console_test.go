@@ -0,0 +1,85 @@
+package term_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/term"
+)
+
+// writes records each write to it.
+type writes []string
+
+func (w *writes) Write(b []byte) (int, error) {
+	*w = append(*w, string(b))
+
+	return len(b), nil
+}
+
+// feed writes s a byte at a time, as the guest does to the serial port.
+func feed(t *testing.T, c *term.ConsoleWriter, s string) {
+	t.Helper()
+
+	for i := 0; i < len(s); i++ {
+		if _, err := c.Write([]byte{s[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConsolePassthrough(t *testing.T) {
+	t.Parallel()
+
+	w := &writes{}
+	c := term.NewConsoleWriter(w, term.Passthrough)
+
+	feed(t, c, "é\x1b[1;31m─\x1b[0m")
+
+	want := []string{"é", "\x1b", "[", "1", ";", "3", "1", "m", "─", "\x1b", "[", "0", "m"}
+	if len(*w) != len(want) {
+		t.Fatalf("got writes %q, want %q", *w, want)
+	}
+
+	for i := range want {
+		if (*w)[i] != want[i] {
+			t.Fatalf("got writes %q, want %q", *w, want)
+		}
+	}
+
+	// Invalid UTF-8 is passed on as well.
+	if _, err := c.Write([]byte{0xff, 'a'}); err != nil || (*w)[len(*w)-1] != "\xffa" {
+		t.Errorf("got %q, %v", (*w)[len(*w)-1], err)
+	}
+}
+
+func TestConsoleSanitize(t *testing.T) {
+	t.Parallel()
+
+	w := &writes{}
+	c := term.NewConsoleWriter(w, term.Sanitize)
+
+	feed(t, c, "\x1b]0;title\x07ok\x1b[2J \x1b(Bé\x1b]8;;x\x1b\\\x01\r\n\xff")
+
+	got := ""
+	for _, s := range *w {
+		got += s
+	}
+
+	if want := "ok é\r\n�"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseConsoleMode(t *testing.T) {
+	t.Parallel()
+
+	for _, m := range []term.ConsoleMode{term.Passthrough, term.Sanitize} {
+		if got, err := term.ParseConsoleMode(m.String()); err != nil || got != m {
+			t.Errorf("round trip of %v: got %v, %v", m, got, err)
+		}
+	}
+
+	if _, err := term.ParseConsoleMode("raw"); !errors.Is(err, term.ErrConsoleMode) {
+		t.Errorf("got %v, want %v", err, term.ErrConsoleMode)
+	}
+}
@@ -0,0 +1,62 @@
+package term
+
+// EscapeChar is Ctrl-a, which starts the escape sequences of the console,
+// as in QEMU.
+const EscapeChar = 0x01
+
+// EscapeAction is what an escape sequence asks for.
+type EscapeAction int
+
+const (
+	EscapeNone EscapeAction = iota
+	// EscapeQuit is Ctrl-a x.
+	EscapeQuit
+	// EscapeMonitor is Ctrl-a c, which switches between the console and
+	// the monitor.
+	EscapeMonitor
+	// EscapeHelp is Ctrl-a h.
+	EscapeHelp
+)
+
+// EscapeUsage tells the escape sequences, in lines for a terminal in raw
+// mode.
+const EscapeUsage = "C-a h    print this help\r\n" +
+	"C-a x    exit gokvm\r\n" +
+	"C-a c    switch between the console and the monitor\r\n" +
+	"C-a C-a  send C-a\r\n"
+
+// Escaper picks the escape sequences out of what is typed on the console,
+// so that all other keys, Ctrl-c included, go to the guest.
+type Escaper struct {
+	pending bool
+}
+
+// Key takes the next byte typed, and returns those that go on, with the
+// action of the escape sequence it ends, if any. Ctrl-a followed by a key
+// that is none of them passes both on.
+func (e *Escaper) Key(b byte) ([]byte, EscapeAction) {
+	if !e.pending {
+		if b == EscapeChar {
+			e.pending = true
+
+			return nil, EscapeNone
+		}
+
+		return []byte{b}, EscapeNone
+	}
+
+	e.pending = false
+
+	switch b {
+	case 'x', 'X':
+		return nil, EscapeQuit
+	case 'c', 'C':
+		return nil, EscapeMonitor
+	case 'h', 'H', '?':
+		return nil, EscapeHelp
+	case EscapeChar:
+		return []byte{EscapeChar}, EscapeNone
+	}
+
+	return []byte{EscapeChar, b}, EscapeNone
+}
@@ -0,0 +1,56 @@
+package term_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/term"
+)
+
+func TestEscaper(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		in      string
+		keys    string
+		actions []term.EscapeAction
+	}{
+		{in: "ls\r\x03", keys: "ls\r\x03"},
+		{in: "a\x01xb", keys: "ab", actions: []term.EscapeAction{term.EscapeQuit}},
+		{in: "\x01c\x01h\x01c", actions: []term.EscapeAction{term.EscapeMonitor, term.EscapeHelp, term.EscapeMonitor}},
+		{in: "\x01\x01a", keys: "\x01a"},
+		{in: "\x01q", keys: "\x01q"},
+		{in: "\x01", keys: ""},
+	} {
+		var (
+			e       term.Escaper
+			keys    []byte
+			actions []term.EscapeAction
+		)
+
+		for _, b := range []byte(tt.in) {
+			k, a := e.Key(b)
+			keys = append(keys, k...)
+
+			if a != term.EscapeNone {
+				actions = append(actions, a)
+			}
+		}
+
+		if !bytes.Equal(keys, []byte(tt.keys)) {
+			t.Errorf("%q: got keys %q, want %q", tt.in, keys, tt.keys)
+		}
+
+		if len(actions) != len(tt.actions) {
+			t.Errorf("%q: got actions %v, want %v", tt.in, actions, tt.actions)
+
+			continue
+		}
+
+		for i := range actions {
+			if actions[i] != tt.actions[i] {
+				t.Errorf("%q: got actions %v, want %v", tt.in, actions, tt.actions)
+			}
+		}
+	}
+}
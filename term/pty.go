@@ -0,0 +1,113 @@
+package term
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	tiocgptn   = 0x80045430
+	tiocsptlck = 0x40045431
+
+	// ptyPoll is how often Read looks for a program attached anew.
+	ptyPoll = 100 * time.Millisecond
+)
+
+// PTY is the master of a pseudo-terminal, whose slave at Path programs such
+// as screen or minicom attach to and detach from as they please, while the
+// guest on the other end goes on as if nothing happened.
+type PTY struct {
+	Path string
+	f    *os.File
+}
+
+// OpenPTY allocates a pseudo-terminal, in raw mode so that bytes pass both
+// ways as they are and nothing is echoed back while no program is attached.
+func OpenPTY() (*PTY, error) {
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("/dev/ptmx: %w", err)
+	}
+
+	var (
+		unlock int32
+		n      uint32
+	)
+
+	if err := ioctl(fd, tiocsptlck, unsafe.Pointer(&unlock)); err != nil {
+		syscall.Close(fd)
+
+		return nil, fmt.Errorf("unlock pty: %w", err)
+	}
+
+	if err := ioctl(fd, tiocgptn, unsafe.Pointer(&n)); err != nil {
+		syscall.Close(fd)
+
+		return nil, fmt.Errorf("pty number: %w", err)
+	}
+
+	// The termios of the master are those of the slave.
+	t, err := read(fd)
+	if err == nil {
+		makeRaw(&t)
+		err = write(fd, t)
+	}
+
+	if err != nil {
+		syscall.Close(fd)
+
+		return nil, fmt.Errorf("pty raw mode: %w", err)
+	}
+
+	return &PTY{Path: fmt.Sprintf("/dev/pts/%d", n), f: os.NewFile(uintptr(fd), "/dev/ptmx")}, nil
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Read reads what the attached program sends, and waits for one to attach
+// when none is.
+func (p *PTY) Read(b []byte) (int, error) {
+	for {
+		n, err := p.f.Read(b)
+		if !errors.Is(err, syscall.EIO) {
+			return n, err
+		}
+
+		// The last program detached.
+		time.Sleep(ptyPoll)
+	}
+}
+
+// Write writes b to the attached program, and drops it when none is or it
+// does not keep up, so that the guest never waits on it.
+func (p *PTY) Write(b []byte) (int, error) {
+	rc, err := p.f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := rc.Write(func(fd uintptr) bool {
+		_, _ = syscall.Write(int(fd), b)
+
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Close frees the pseudo-terminal, which ends a Read.
+func (p *PTY) Close() error {
+	return p.f.Close()
+}
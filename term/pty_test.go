@@ -0,0 +1,59 @@
+package term_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/term"
+)
+
+func TestPTY(t *testing.T) {
+	t.Parallel()
+
+	p, err := term.OpenPTY()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+
+	defer p.Close()
+
+	// Nothing is attached yet, which must not keep the guest waiting.
+	for i := 0; i < 1000; i++ {
+		if _, err := p.Write([]byte("dropped or buffered\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		s, err := os.OpenFile(p.Path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Write([]byte("ls\r")); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 3)
+		if n, err := p.Read(buf); err != nil || string(buf[:n]) != "ls\r" {
+			t.Fatalf("got %q, %v, want %q", buf[:n], err, "ls\r")
+		}
+
+		// Detach, after which a program attaches anew.
+		s.Close()
+	}
+
+	done := make(chan error)
+
+	go func() {
+		_, err := p.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	p.Close()
+
+	if err := <-done; !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("got %v, want %v", err, os.ErrClosed)
+	}
+}
@@ -57,6 +57,16 @@ func SetRawMode() (func(), error) {
 
 	oldTermios := t
 
+	makeRaw(&t)
+
+	return func() {
+		_ = write(0, oldTermios)
+	}, write(0, t)
+}
+
+// makeRaw turns off in t what the line discipline does to the bytes that
+// pass, as cfmakeraw does.
+func makeRaw(t *termios) {
 	t.Iflag &^= syscall.BRKINT | syscall.ICRNL | syscall.INPCK | syscall.ISTRIP | syscall.IXON
 	t.Oflag &^= syscall.OPOST
 	t.Cflag &^= syscall.CSIZE | syscall.PARENB
@@ -64,8 +74,4 @@ func SetRawMode() (func(), error) {
 	t.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.IEXTEN | syscall.ISIG
 	t.Cc[syscall.VMIN] = 1
 	t.Cc[syscall.VTIME] = 0
-
-	return func() {
-		_ = write(0, oldTermios)
-	}, write(0, t)
 }
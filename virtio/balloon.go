@@ -0,0 +1,274 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+// virtio-balloon lets the host take memory back from the guest: the host
+// asks for a balloon of num_pages, the guest inflates it with pages it
+// gives up, whose memory the host frees, and deflates it when the host
+// asks for fewer, using the pages again as it likes.
+//
+// refs: https://docs.oasis-open.org/virtio/virtio/v1.2/csd01/virtio-v1.2-csd01.html#x1-3200005
+const (
+	BalloonIOPortStart = 0x6700
+	BalloonIOPortSize  = 0x100
+
+	// BalloonPageSize is the size of the pages of the balloon, whatever the
+	// page size of the guest.
+	BalloonPageSize = 0x1000
+
+	// The guest deflates the balloon rather than run out of memory.
+	balloonFeatureDeflateOnOOM = 1 << 2
+
+	balloonInflateQueue = 0
+	balloonDeflateQueue = 1
+	balloonQueues       = 2
+
+	// balloonActualOffset is where the guest writes the pages it has in
+	// the balloon, after the common header and num_pages.
+	balloonActualOffset = 24
+)
+
+type BalloonIRQInjector interface {
+	InjectVirtioBalloonIRQ() error
+}
+
+type balloonHdr struct {
+	commonHeader  commonHeader
+	balloonHeader balloonHeader
+}
+
+func (h balloonHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// balloonHeader is struct virtio_balloon_config without the fields of
+// optional features.
+type balloonHeader struct {
+	numPages uint32
+	actual   uint32
+}
+
+type Balloon struct {
+	Hdr balloonHdr
+
+	// inflateq and deflateq
+	VirtQueue    [balloonQueues]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [balloonQueues]uint16
+
+	kick chan uint16
+	// done is closed when IOThreadEntry returns.
+	done chan struct{}
+	// Runner runs the requests IOThreadEntry is kicked for.
+	Runner Runner
+
+	// mu guards Hdr, which SetTarget changes while the guest reads it,
+	// and reclaimed, how many pages the host freed.
+	mu        sync.Mutex
+	reclaimed uint64
+
+	irq         uint8
+	IRQInjector BalloonIRQInjector
+}
+
+func (v *Balloon) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1002,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 5, // Memory balloon
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			BalloonIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Balloon) IOInHandler(port uint64, bytes []byte) error {
+	offset := int(port - BalloonIOPortStart)
+
+	v.mu.Lock()
+	b, err := v.Hdr.Bytes()
+	v.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	l := len(bytes)
+	copy(bytes[:l], b[offset:offset+l])
+
+	return nil
+}
+
+func (v *Balloon) IOOutHandler(port uint64, bytes []byte) error {
+	offset := int(port - BalloonIOPortStart)
+
+	switch offset {
+	case 8:
+		// Queue PFN is aligned to page (4096 bytes)
+		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
+		v.VirtQueue[v.Hdr.commonHeader.queueSEL%balloonQueues] = newVirtQueue((*vring)(unsafe.Pointer(&v.Mem[physAddr])))
+		// A new ring, e.g. of a guest that rebooted, starts at 0.
+		v.LastAvailIdx[v.Hdr.commonHeader.queueSEL%balloonQueues] = 0
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.mu.Lock()
+		v.Hdr.commonHeader.isr = 0x0
+		v.mu.Unlock()
+		v.kick <- uint16(pci.BytesToNum(bytes))
+	case balloonActualOffset:
+		v.mu.Lock()
+		v.Hdr.balloonHeader.actual = uint32(pci.BytesToNum(bytes))
+		v.mu.Unlock()
+	default:
+	}
+
+	return nil
+}
+
+func (v *Balloon) GetIORange() (start, end uint64) {
+	return BalloonIOPortStart, BalloonIOPortStart + BalloonIOPortSize
+}
+
+func (v *Balloon) IOThreadEntry() {
+	defer close(v.done)
+
+	for q := range v.kick {
+		q := q
+		serve(v.Runner, func() error { return v.IO(q) })
+	}
+}
+
+// Close stops IOThreadEntry, once it has served the requests it was kicked
+// for. The vCPUs must be stopped.
+func (v *Balloon) Close() error {
+	close(v.kick)
+	<-v.done
+
+	return nil
+}
+
+// IO serves the page frame numbers the guest put on queue q: on the
+// inflateq, pages it gave up, whose memory is freed, and on the deflateq,
+// pages it takes back, which it faults in again as it uses them.
+func (v *Balloon) IO(q uint16) error {
+	if q >= balloonQueues || v.VirtQueue[q] == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := v.VirtQueue[q].AvailRing
+	usedRing := v.VirtQueue[q].UsedRing
+
+	if v.LastAvailIdx[q] == availRing.Idx {
+		return ErrNoTxPacket
+	}
+
+	for v.LastAvailIdx[q] != availRing.Idx {
+		descID := availRing.Ring[v.LastAvailIdx[q]%QueueSize]
+
+		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
+		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+
+		for {
+			desc := v.VirtQueue[q].DescTable[descID]
+
+			if q == balloonInflateQueue {
+				v.reclaim(v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)])
+			}
+
+			if desc.Flags&0x1 == 0 {
+				break
+			}
+
+			descID = desc.Next
+		}
+
+		usedRing.Idx++
+		v.LastAvailIdx[q]++
+	}
+
+	v.mu.Lock()
+	v.Hdr.commonHeader.isr |= 0x1
+	v.mu.Unlock()
+
+	return v.IRQInjector.InjectVirtioBalloonIRQ()
+}
+
+// reclaim frees the memory of the pages of pfns, an array of 32-bit page
+// frame numbers. Guest RAM is shared memory, anonymous or of a file, whose
+// pages MADV_DONTNEED would only unmap, so they are punched out of it with
+// MADV_REMOVE. Pages that cannot be freed, e.g. those of huge pages, stay
+// with the guest's memory and are not counted.
+func (v *Balloon) reclaim(pfns []byte) {
+	n := uint64(0)
+
+	for i := 0; i+4 <= len(pfns); i += 4 {
+		addr := uint64(binary.LittleEndian.Uint32(pfns[i:])) * BalloonPageSize
+		if addr+BalloonPageSize > uint64(len(v.Mem)) {
+			continue
+		}
+
+		if syscall.Madvise(v.Mem[addr:addr+BalloonPageSize], syscall.MADV_REMOVE) == nil {
+			n++
+		}
+	}
+
+	v.mu.Lock()
+	v.reclaimed += n
+	v.mu.Unlock()
+}
+
+// SetTarget asks the guest to inflate or deflate the balloon to pages of
+// BalloonPageSize.
+func (v *Balloon) SetTarget(pages uint32) error {
+	v.mu.Lock()
+	v.Hdr.balloonHeader.numPages = pages
+	v.Hdr.commonHeader.isr |= isrConfigChange
+	v.mu.Unlock()
+
+	return v.IRQInjector.InjectVirtioBalloonIRQ()
+}
+
+// Pages returns the pages SetTarget asked for, those the guest says it has
+// in the balloon, and how many the host freed so far, which grows as the
+// balloon is inflated again after a deflate.
+func (v *Balloon) Pages() (target, actual uint32, reclaimed uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.Hdr.balloonHeader.numPages, v.Hdr.balloonHeader.actual, v.reclaimed
+}
+
+func NewBalloon(irq uint8, irqInjector BalloonIRQInjector, mem []byte) *Balloon {
+	return &Balloon{
+		Hdr: balloonHdr{
+			commonHeader: commonHeader{
+				hostFeatures: balloonFeatureDeflateOnOOM,
+				queueNUM:     QueueSize,
+			},
+		},
+		irq:         irq,
+		IRQInjector: irqInjector,
+		kick:        make(chan uint16, balloonQueues),
+		done:        make(chan struct{}),
+		Mem:         mem,
+	}
+}
@@ -0,0 +1,113 @@
+package virtio_test
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/memslot"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestBalloonGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewBalloon(12, &mockInjector{}, []byte{})
+
+	if actual := v.GetDeviceHeader().DeviceID; actual != 0x1002 {
+		t.Fatalf("expected: 0x1002, actual: %#x", actual)
+	}
+
+	s, e := v.GetIORange()
+	if e-s != virtio.BalloonIOPortSize {
+		t.Fatalf("expected: %v, actual: %v", virtio.BalloonIOPortSize, e-s)
+	}
+
+	if err := v.SetTarget(256); err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.IRQInjector.(*mockInjector).called {
+		t.Fatal("the guest was not told of the new target")
+	}
+
+	// num_pages right after the common header, and actual as the guest
+	// writes it.
+	actual := make([]byte, 4)
+	_ = v.IOInHandler(virtio.BalloonIOPortStart+20, actual)
+
+	if n := binary.LittleEndian.Uint32(actual); n != 256 {
+		t.Fatalf("expected: 256, actual: %d", n)
+	}
+
+	_ = v.IOOutHandler(virtio.BalloonIOPortStart+24, []byte{0x80, 0, 0, 0})
+
+	if target, got, _ := v.Pages(); target != 256 || got != 0x80 {
+		t.Fatalf("pages: target %d, actual %d", target, got)
+	}
+}
+
+func TestBalloonInflate(t *testing.T) {
+	t.Parallel()
+
+	for name, b := range map[string]memslot.Backing{
+		"anonymous": {},
+		"memfd":     {Memfd: true},
+	} {
+		b := b
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			// Guest RAM as the machine maps it.
+			mem, err := memslot.Map(0x10000, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer syscall.Munmap(mem)
+
+			testBalloonInflate(t, mem)
+		})
+	}
+}
+
+func testBalloonInflate(t *testing.T, mem []byte) {
+	t.Helper()
+
+	v := virtio.NewBalloon(12, &mockInjector{}, mem)
+
+	// The guest gives up pages 8 and 9, which it scribbled on, and page
+	// 0x100, which it does not have, and lists them at 0x100.
+	mem[0x8000], mem[0x9000] = 0xaa, 0xbb
+	binary.LittleEndian.PutUint32(mem[0x100:], 8)
+	binary.LittleEndian.PutUint32(mem[0x104:], 9)
+	binary.LittleEndian.PutUint32(mem[0x108:], 0x100)
+
+	vq := virtio.NewVirtQueue()
+	vq.DescTable[0].Addr, vq.DescTable[0].Len = 0x100, 12
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[0] = vq
+
+	if err := v.IO(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.IRQInjector.(*mockInjector).called || vq.UsedRing.Idx != 1 {
+		t.Fatalf("inflate not completed: used %d", vq.UsedRing.Idx)
+	}
+
+	// The host freed them, so they read back as zero, even though the
+	// memory is shared.
+	if mem[0x8000] != 0 || mem[0x9000] != 0 {
+		t.Fatalf("pages not freed: %#x %#x", mem[0x8000], mem[0x9000])
+	}
+
+	if _, _, reclaimed := v.Pages(); reclaimed != 2 {
+		t.Fatalf("reclaimed %d pages, want 2", reclaimed)
+	}
+
+	if err := v.IO(1); err == nil {
+		t.Fatal("deflate without a deflateq: expected an error")
+	}
+}
@@ -3,7 +3,11 @@ package virtio
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"os"
+	"sync"
+	"syscall"
 	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/pci"
@@ -14,20 +18,49 @@ const (
 	BlkIOPortSize  = 0x100
 
 	SectorSize = 512
+
+	// Status of a request, in the last byte the guest gives.
+	blkStatusOK    = 0
+	blkStatusIOErr = 1
 )
 
+// BlkBackend is where a Blk keeps the disk: the file of NewBlk, or e.g.
+// the helper process of package sandbox.
+type BlkBackend interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
 type Blk struct {
-	file *os.File
-	Hdr  blkHdr
+	backend BlkBackend
+	Hdr     blkHdr
+	modern  modern
 
 	VirtQueue    [1]*VirtQueue
 	Mem          []byte
 	LastAvailIdx [1]uint16
 
 	kick chan interface{}
+	// done is closed when IOThreadEntry returns.
+	done    chan struct{}
+	quiesce sync.Once
+	// Runner runs the requests IOThreadEntry is kicked for.
+	Runner Runner
 
 	irq         uint8
 	IRQInjector IRQInjector
+
+	// Faults fail or delay requests on purpose.
+	Faults *Faults
+
+	// DMA, if set, translates the addresses of the buffers of the guest
+	// for Endpoint, the PCI BDF of the device, once a driver of the modern
+	// transport accepts VIRTIO_F_ACCESS_PLATFORM. Other drivers do not go
+	// through the IOMMU and give guest physical addresses.
+	DMA      DMA
+	Endpoint uint32
 }
 
 type blkHdr struct {
@@ -49,8 +82,10 @@ type blkHeader struct {
 	capacity uint64
 }
 
-func (v Blk) GetDeviceHeader() pci.DeviceHeader {
-	return pci.DeviceHeader{
+// GetDeviceHeader returns the header of a transitional device, which has
+// both the legacy and the modern transport.
+func (v *Blk) GetDeviceHeader() pci.DeviceHeader {
+	return v.modern.header(pci.DeviceHeader{
 		DeviceID:    0x1001,
 		VendorID:    0x1AF4,
 		HeaderType:  0,
@@ -63,11 +98,18 @@ func (v Blk) GetDeviceHeader() pci.DeviceHeader {
 		InterruptPin: 1,
 		// https://www.webopedia.com/reference/irqnumbers/
 		InterruptLine: v.irq,
-	}
+	})
 }
 
-func (v Blk) IOInHandler(port uint64, bytes []byte) error {
-	offset := int(port - BlkIOPortStart)
+func (v *Blk) Capabilities() []byte {
+	return v.modern.capabilities()
+}
+
+func (v *Blk) IOInHandler(port uint64, bytes []byte) error {
+	offset, ok := v.modern.in(int(port-BlkIOPortStart), bytes)
+	if ok {
+		return nil
+	}
 
 	b, err := v.Hdr.Bytes()
 	if err != nil {
@@ -81,12 +123,52 @@ func (v Blk) IOInHandler(port uint64, bytes []byte) error {
 }
 
 func (v *Blk) IOThreadEntry() {
+	defer close(v.done)
+
 	for range v.kick {
-		for v.IO() == nil {
-		}
+		serve(v.Runner, v.IO)
 	}
 }
 
+// Quiesce stops IOThreadEntry, once it has served the requests it was
+// kicked for. The vCPUs must be stopped. Quiescing twice does nothing the
+// second time.
+func (v *Blk) Quiesce() {
+	v.quiesce.Do(func() {
+		close(v.kick)
+		<-v.done
+	})
+}
+
+// Flush writes what the host caches of the disk to storage. Disks that
+// cannot be synced, e.g. character devices, have nothing to write.
+func (v *Blk) Flush() error {
+	if err := v.backend.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+
+	return nil
+}
+
+// Close quiesces the device and closes the disk.
+func (v *Blk) Close() error {
+	v.Quiesce()
+
+	return v.backend.Close()
+}
+
+// Backend returns where the disk is kept.
+func (v *Blk) Backend() BlkBackend {
+	return v.backend
+}
+
+// SetBackend keeps the disk in b from now on, which takes the place of the
+// backend before it, without closing it. It must be called before the
+// guest uses the device.
+func (v *Blk) SetBackend(b BlkBackend) {
+	v.backend = b
+}
+
 type BlkReq struct {
 	Type   uint32
 	_      uint32
@@ -96,8 +178,12 @@ type BlkReq struct {
 func (v *Blk) IO() error {
 	sel := uint16(0)
 	// v.dumpDesc(sel)
-	availRing := &v.VirtQueue[sel].AvailRing
-	usedRing := &v.VirtQueue[sel].UsedRing
+	if v.VirtQueue[sel] == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := v.VirtQueue[sel].AvailRing
+	usedRing := v.VirtQueue[sel].UsedRing
 
 	if v.LastAvailIdx[sel] == availRing.Idx {
 		return ErrNoTxPacket
@@ -113,9 +199,18 @@ func (v *Blk) IO() error {
 
 		var buf [3][]byte
 
+		// fault is set for a buffer the device cannot reach.
+		fault := false
+
 		for i := 0; i < 3; i++ {
 			desc := v.VirtQueue[sel].DescTable[descID]
-			buf[i] = v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
+
+			b, err := dmaBuf(v.Mem, v.dma(), v.Endpoint, desc.Addr, uint64(desc.Len), desc.Flags&0x2 != 0)
+			if err != nil {
+				fault = true
+			}
+
+			buf[i] = b
 
 			usedRing.Ring[usedRing.Idx%QueueSize].Len += desc.Len
 			descID = desc.Next
@@ -126,25 +221,38 @@ func (v *Blk) IO() error {
 		// buf[2] contains a status field.
 		//
 		// refs https://wiki.osdev.org/Virtio#Block_Device_Packets
-		blkReq := *((*BlkReq)(unsafe.Pointer(&buf[0][0])))
-		data := buf[1]
-
-		var err error
-		if blkReq.Type&0x1 == 0x1 {
-			// write to file
-			_, err = v.file.WriteAt(data, int64(blkReq.Sector*SectorSize))
-		} else {
-			// read from file
-			_, err = v.file.ReadAt(data, int64(blkReq.Sector*SectorSize))
+		status := byte(blkStatusOK)
+
+		switch {
+		case fault, len(buf[0]) == 0, v.Faults.fail():
+			status = blkStatusIOErr
+		default:
+			blkReq := *((*BlkReq)(unsafe.Pointer(&buf[0][0])))
+			data := buf[1]
+
+			var err error
+			if blkReq.Type&0x1 == 0x1 {
+				// write to file
+				_, err = v.backend.WriteAt(data, int64(blkReq.Sector*SectorSize))
+			} else {
+				// read from file
+				_, err = v.backend.ReadAt(data, int64(blkReq.Sector*SectorSize))
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if err = v.backend.Sync(); err != nil {
+				return err
+			}
 		}
 
-		if err != nil {
-			return err
+		if len(buf[2]) > 0 {
+			buf[2][0] = status
 		}
 
-		if err = v.file.Sync(); err != nil {
-			return err
-		}
+		v.Faults.wait()
 
 		usedRing.Idx++
 		v.LastAvailIdx[sel]++
@@ -159,13 +267,23 @@ func (v *Blk) IO() error {
 }
 
 func (v *Blk) IOOutHandler(port uint64, bytes []byte) error {
-	offset := int(port - BlkIOPortStart)
+	offset, ok := v.modern.out(int(port-BlkIOPortStart), bytes)
+	if ok {
+		return nil
+	}
 
 	switch offset {
 	case 8:
-		// Queue PFN is aligned to page (4096 bytes)
-		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
-		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
+		// Queue PFN is aligned to page (4096 bytes). A ring the device
+		// cannot reach, e.g. one the IOMMU does not map, is not used.
+		vq, err := queueAt(v.Mem, v.dma(), v.Endpoint, pci.BytesToNum(bytes))
+		if err != nil {
+			vq = nil
+		}
+
+		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = vq
+		// A new ring, e.g. of a guest that rebooted, starts at 0.
+		v.LastAvailIdx[v.Hdr.commonHeader.queueSEL] = 0
 	case 14:
 		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
 	case 16:
@@ -178,7 +296,34 @@ func (v *Blk) IOOutHandler(port uint64, bytes []byte) error {
 	return nil
 }
 
-func (v Blk) GetIORange() (start, end uint64) {
+// dma returns the DMA of the buffers of the guest, see Blk.DMA.
+func (v *Blk) dma() DMA {
+	if !v.modern.negotiated(featureAccessPlatform) {
+		return nil
+	}
+
+	return v.DMA
+}
+
+// setQueue puts the queue where the driver enabled it with the modern
+// transport. A ring the device cannot reach, e.g. one the IOMMU does not
+// map, is not used.
+func (v *Blk) setQueue(q uint16, desc, driver, device uint64) {
+	vq, err := queueSplit(v.Mem, v.dma(), v.Endpoint, desc, driver, device)
+	if err != nil {
+		vq = nil
+	}
+
+	v.VirtQueue[q] = vq
+	v.LastAvailIdx[q] = 0
+}
+
+func (v *Blk) resetQueues() {
+	v.VirtQueue = [1]*VirtQueue{}
+	v.LastAvailIdx = [1]uint16{}
+}
+
+func (v *Blk) GetIORange() (start, end uint64) {
 	return BlkIOPortStart, BlkIOPortStart + BlkIOPortSize
 }
 
@@ -205,14 +350,18 @@ func NewBlk(path string, irq uint8, irqInjector IRQInjector, mem []byte) (*Blk,
 				capacity: fileSize / SectorSize,
 			},
 		},
-		file:         file,
+		backend:      file,
 		irq:          irq,
 		IRQInjector:  irqInjector,
 		kick:         make(chan interface{}),
+		done:         make(chan struct{}),
 		Mem:          mem,
 		VirtQueue:    [1]*VirtQueue{},
 		LastAvailIdx: [1]uint16{0},
+		Faults:       &Faults{},
 	}
 
+	res.modern = newModern(featureAccessPlatform, 1, unsafe.Sizeof(blkHeader{}), res.setQueue, res.resetQueues)
+
 	return res, nil
 }
@@ -75,7 +75,7 @@ func TestIO(t *testing.T) {
 	}
 
 	// Init virt queue
-	vq := virtio.VirtQueue{}
+	vq := virtio.NewVirtQueue()
 	vq.AvailRing.Idx = 1
 
 	// for blk request
@@ -92,7 +92,7 @@ func TestIO(t *testing.T) {
 	vq.DescTable[1].Len = 0x200
 	vq.DescTable[1].Next = 2
 
-	v.VirtQueue[0] = &vq
+	v.VirtQueue[0] = vq
 
 	if err := v.IO(); err != nil {
 		t.Fatalf("err: %v\n", err)
@@ -109,3 +109,110 @@ func TestIO(t *testing.T) {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
 }
+
+func TestBlkQuiesce(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.CreateTemp(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	v, err := virtio.NewBlk(f.Name(), 10, &mockInjector{}, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go v.IOThreadEntry()
+
+	// Close after Quiesce and Flush only closes the disk.
+	v.Quiesce()
+
+	if err := v.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlkDMA(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.CreateTemp(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if err := f.Truncate(4 * virtio.SectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte("sector 2"), 2*virtio.SectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x10000)
+	iommu := virtio.NewIOMMU(11, &mockInjector{}, mem)
+
+	v, err := virtio.NewBlk(f.Name(), 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.DMA, v.Endpoint = iommu, 0x10
+
+	// The driver accepts VERSION_1 and ACCESS_PLATFORM, bits 32 and 33, in
+	// the common configuration of the modern transport.
+	_ = v.IOOutHandler(virtio.BlkIOPortStart+0x80+8, []byte{1, 0, 0, 0})
+	_ = v.IOOutHandler(virtio.BlkIOPortStart+0x80+12, []byte{3, 0, 0, 0})
+
+	// The guest maps the request, data and status at I/O virtual
+	// addresses 0x100000 and up to 0x1000, 0x2000 and 0x3000.
+	iommu.Attach(1, 0x10)
+	iommu.Map(1, 0x100000, 0x100fff, 0x1000, virtio.IOMMUMapRead)
+	iommu.Map(1, 0x101000, 0x101fff, 0x2000, virtio.IOMMUMapWrite)
+	iommu.Map(1, 0x102000, 0x102fff, 0x3000, virtio.IOMMUMapWrite)
+
+	(*virtio.BlkReq)(unsafe.Pointer(&mem[0x1000])).Sector = 2
+
+	vq := virtio.NewVirtQueue()
+	vq.DescTable[0].Addr, vq.DescTable[0].Len, vq.DescTable[0].Next = 0x100000, 16, 1
+	vq.DescTable[1].Addr, vq.DescTable[1].Len, vq.DescTable[1].Next = 0x101000, 0x200, 2
+	vq.DescTable[1].Flags = 0x2
+	vq.DescTable[2].Addr, vq.DescTable[2].Len = 0x102000, 1
+	vq.DescTable[2].Flags = 0x2
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[0] = vq
+
+	mem[0x3000] = 0xff
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(mem[0x2000:0x2008]); got != "sector 2" || mem[0x3000] != 0 {
+		t.Fatalf("read %q with status %d", got, mem[0x3000])
+	}
+
+	// Once the data is unmapped, the request fails and the disk is left
+	// alone.
+	iommu.Unmap(1, 0x101000, 0x101fff)
+	copy(mem[0x2000:], "garbage!")
+
+	vq.AvailRing.Idx = 2
+	vq.AvailRing.Ring[1] = 0
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem[0x3000] != 1 || string(mem[0x2000:0x2008]) != "garbage!" {
+		t.Fatalf("status %d, data %q after unmap", mem[0x3000], mem[0x2000:0x2008])
+	}
+}
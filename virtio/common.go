@@ -1,5 +1,11 @@
 package virtio
 
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
 const (
 	// The number of free descriptors in virt queue must exceed
 	// MAX_SKB_FRAGS (16). Otherwise, packet transmission from
@@ -7,50 +13,178 @@ const (
 	//
 	// refs https://github.com/torvalds/linux/blob/5859a2b/drivers/net/virtio_net.c#L1754
 	QueueSize = 32
+
+	// isrConfigChange is the ISR bit of a change of the device
+	// configuration, e.g. a new size the host asks the guest for.
+	isrConfigChange = 0x2
 )
 
+// Runner runs the work a device does when kicked, e.g. on a worker.Queue
+// that schedules it among that of other devices. Run returns once job has
+// run. A nil Runner runs jobs on the goroutine of the device.
+type Runner interface {
+	Run(job func())
+}
+
+func run(r Runner, job func()) {
+	if r == nil {
+		job()
+
+		return
+	}
+
+	r.Run(job)
+}
+
+// serve calls f, which serves a request and fails when there is none,
+// until it fails, in jobs of up to QueueSize requests, so that a device
+// with a flood of requests gives way to others between jobs.
+func serve(r Runner, f func() error) {
+	for more := true; more; {
+		run(r, func() {
+			for i := 0; i < QueueSize; i++ {
+				if f() != nil {
+					more = false
+
+					return
+				}
+			}
+		})
+	}
+}
+
+// ErrDMARange indicates a buffer of the guest outside of guest memory.
+var ErrDMARange = errors.New("buffer outside of guest memory")
+
+// DMA translates the addresses the guest gives a device, I/O virtual
+// addresses of the endpoint of the device, to guest physical ones, e.g. an
+// IOMMU. A device without DMA takes them as guest physical addresses.
+type DMA interface {
+	Translate(endpoint uint32, addr, size uint64, write bool) (uint64, error)
+}
+
+// dmaBuf returns the guest memory of the size bytes at addr, which the
+// device of endpoint reads, or writes if write is set, translated by d if
+// the device has one.
+func dmaBuf(mem []byte, d DMA, endpoint uint32, addr, size uint64, write bool) ([]byte, error) {
+	if d != nil {
+		var err error
+		if addr, err = d.Translate(endpoint, addr, size, write); err != nil {
+			return nil, err
+		}
+	}
+
+	if addr > uint64(len(mem)) || size > uint64(len(mem))-addr {
+		return nil, fmt.Errorf("%w: %#x bytes at %#x", ErrDMARange, size, addr)
+	}
+
+	return mem[addr : addr+size], nil
+}
+
+// queueAt returns the virtqueue the guest put at pfn with the legacy
+// transport, for a device with d.
+func queueAt(mem []byte, d DMA, endpoint uint32, pfn uint64) (*VirtQueue, error) {
+	b, err := dmaBuf(mem, d, endpoint, pfn*4096, uint64(unsafe.Sizeof(vring{})), true)
+	if err != nil {
+		return nil, err
+	}
+
+	return newVirtQueue((*vring)(unsafe.Pointer(&b[0]))), nil
+}
+
+// queueSplit returns the virtqueue whose parts the guest put at desc,
+// driver and device with the modern transport, for a device with d.
+func queueSplit(mem []byte, d DMA, endpoint uint32, desc, driver, device uint64) (*VirtQueue, error) {
+	descTable, err := dmaBuf(mem, d, endpoint, desc, uint64(unsafe.Sizeof([QueueSize]vringDesc{})), true)
+	if err != nil {
+		return nil, err
+	}
+
+	availRing, err := dmaBuf(mem, d, endpoint, driver, uint64(unsafe.Sizeof(vringAvail{})), false)
+	if err != nil {
+		return nil, err
+	}
+
+	usedRing, err := dmaBuf(mem, d, endpoint, device, uint64(unsafe.Sizeof(vringUsed{})), true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VirtQueue{
+		DescTable: (*[QueueSize]vringDesc)(unsafe.Pointer(&descTable[0])),
+		AvailRing: (*vringAvail)(unsafe.Pointer(&availRing[0])),
+		UsedRing:  (*vringUsed)(unsafe.Pointer(&usedRing[0])),
+	}, nil
+}
+
 type IRQInjector interface {
 	InjectVirtioNetIRQ() error
 	InjectVirtioBlkIRQ() error
 }
 
 type commonHeader struct {
-	_        uint32 // hostFeatures
-	_        uint32 // guestFeatures
-	_        uint32 // queuePFN
-	queueNUM uint16
-	queueSEL uint16
-	_        uint16 // queueNotify
-	_        uint8  // status
-	isr      uint8
+	hostFeatures uint32
+	_            uint32 // guestFeatures
+	_            uint32 // queuePFN
+	queueNUM     uint16
+	queueSEL     uint16
+	_            uint16 // queueNotify
+	_            uint8  // status
+	isr          uint8
 }
 
+// VirtQueue is a split virtqueue: the descriptor table, the available
+// ring the driver fills and the used ring the device does.
+//
 // refs: https://wiki.osdev.org/Virtio#Virtual_Queue_Descriptor
 type VirtQueue struct {
-	DescTable [QueueSize]struct {
-		Addr  uint64
-		Len   uint32
-		Flags uint16
-		Next  uint16
-	}
+	DescTable *[QueueSize]vringDesc
+	AvailRing *vringAvail
+	UsedRing  *vringUsed
+}
 
-	AvailRing struct {
-		Flags     uint16
-		Idx       uint16
-		Ring      [QueueSize]uint16
-		UsedEvent uint16
+// NewVirtQueue returns a VirtQueue in memory of its own, e.g. for a test
+// that plays the driver.
+func NewVirtQueue() *VirtQueue {
+	return newVirtQueue(&vring{})
+}
+
+func newVirtQueue(r *vring) *VirtQueue {
+	return &VirtQueue{DescTable: &r.descTable, AvailRing: &r.availRing, UsedRing: &r.usedRing}
+}
+
+type vringDesc struct {
+	Addr  uint64
+	Len   uint32
+	Flags uint16
+	Next  uint16
+}
+
+type vringAvail struct {
+	Flags     uint16
+	Idx       uint16
+	Ring      [QueueSize]uint16
+	UsedEvent uint16
+}
+
+type vringUsed struct {
+	Flags uint16
+	Idx   uint16
+	Ring  [QueueSize]struct {
+		Idx uint32
+		Len uint32
 	}
+	availEvent uint16
+}
+
+// vring is a VirtQueue of the legacy transport, which has it in one piece
+// with the used ring at the next page.
+type vring struct {
+	descTable [QueueSize]vringDesc
+	availRing vringAvail
 
 	// padding for 4096 byte alignment
 	_ [4096 - ((16*QueueSize + 6 + 2*QueueSize) % 4096)]uint8
 
-	UsedRing struct {
-		Flags uint16
-		Idx   uint16
-		Ring  [QueueSize]struct {
-			Idx uint32
-			Len uint32
-		}
-		availEvent uint16
-	}
+	usedRing vringUsed
 }
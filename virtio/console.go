@@ -0,0 +1,563 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+// virtio-console with the multiport feature, i.e. virtio-serial: named
+// ports that the guest finds as /dev/virtio-ports/<name> and that are
+// bridged to host connections with Connect.
+//
+// Port n has the receiveq 2n+2 and the transmitq 2n+3, except port 0 whose
+// queues come first. Queues 2 and 3 carry control messages, with which the
+// guest learns of the ports and either side tells the other whether it has
+// the port open.
+//
+// refs: https://docs.oasis-open.org/virtio/virtio/v1.2/csd01/virtio-v1.2-csd01.html#x1-2900003
+const (
+	ConsoleIOPortStart = 0x6500
+	ConsoleIOPortSize  = 0x100
+
+	// ConsoleMaxPorts is the number of ports the guest sets up queues for.
+	ConsoleMaxPorts = 8
+
+	consoleQueues = 2 * (ConsoleMaxPorts + 1)
+
+	consoleFeatureMultiport = 1 << 1
+
+	consoleCtrlRxQueue = 2
+	consoleCtrlTxQueue = 3
+
+	consoleDeviceReady = 0
+	consoleDeviceAdd   = 1
+	consolePortReady   = 3
+	consolePortOpen    = 6
+	consolePortName    = 7
+
+	consoleReadSize = 4096
+)
+
+var ErrConsolePort = errors.New("invalid virtio-serial port")
+
+type ConsoleIRQInjector interface {
+	InjectVirtioConsoleIRQ() error
+}
+
+type consoleHdr struct {
+	commonHeader  commonHeader
+	consoleHeader consoleHeader
+}
+
+func (h consoleHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// consoleHeader is struct virtio_console_config.
+type consoleHeader struct {
+	_          uint16 // cols
+	_          uint16 // rows
+	maxNrPorts uint32
+	_          uint32 // emerg_wr
+}
+
+// consoleControl is struct virtio_console_control.
+type consoleControl struct {
+	ID    uint32
+	Event uint16
+	Value uint16
+}
+
+type consolePort struct {
+	name string
+
+	// ready is set once the guest has set the port up, and guestOpen
+	// while a program in the guest has it open.
+	ready     bool
+	guestOpen bool
+
+	// conn is the host side while connected. pending is what was read
+	// from it and is not in the guest yet.
+	conn    io.Writer
+	pending [][]byte
+}
+
+type Console struct {
+	Hdr consoleHdr
+
+	VirtQueue    [consoleQueues]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [consoleQueues]uint16
+
+	kick chan uint16
+	// Runner runs the I/O IOThreadEntry is kicked for.
+	Runner Runner
+
+	mu sync.Mutex
+	// drained is signaled when pending data moved to the guest or its
+	// port was disconnected.
+	drained     *sync.Cond
+	ports       []*consolePort
+	driverReady bool
+	ctrlPending [][]byte
+	// closed is set by Close, after which guest memory is not touched.
+	closed bool
+
+	irq         uint8
+	IRQInjector ConsoleIRQInjector
+}
+
+func (v *Console) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1003,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 3, // Console
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			ConsoleIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Console) IOInHandler(port uint64, bytes []byte) error {
+	offset := int(port - ConsoleIOPortStart)
+
+	v.mu.Lock()
+	b, err := v.Hdr.Bytes()
+	v.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for i := range bytes {
+		bytes[i] = 0
+
+		if offset+i < len(b) {
+			bytes[i] = b[offset+i]
+		}
+	}
+
+	return nil
+}
+
+func (v *Console) IOOutHandler(port uint64, bytes []byte) error {
+	offset := int(port - ConsoleIOPortStart)
+
+	// The kick is sent without v.mu, which IO takes before it drains
+	// v.kick.
+	if offset == 16 {
+		v.mu.Lock()
+		v.Hdr.commonHeader.isr = 0x0
+		v.mu.Unlock()
+		v.kick <- uint16(pci.BytesToNum(bytes))
+
+		return nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch offset {
+	case 8:
+		// Queue PFN is aligned to page (4096 bytes)
+		sel := v.Hdr.commonHeader.queueSEL % consoleQueues
+		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
+
+		// A new ring, e.g. of a guest that rebooted, starts at 0.
+		v.VirtQueue[sel], v.LastAvailIdx[sel] = nil, 0
+		if physAddr != 0 {
+			v.VirtQueue[sel] = newVirtQueue((*vring)(unsafe.Pointer(&v.Mem[physAddr])))
+		}
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	default:
+	}
+
+	return nil
+}
+
+func (v *Console) GetIORange() (start, end uint64) {
+	return ConsoleIOPortStart, ConsoleIOPortStart + ConsoleIOPortSize
+}
+
+func (v *Console) IOThreadEntry() {
+	for q := range v.kick {
+		q := q
+		run(v.Runner, func() { _ = v.IO(q) })
+	}
+}
+
+// Close leaves guest memory alone from now on, dropping what connected
+// ports read, and stops IOThreadEntry. The vCPUs must be stopped.
+func (v *Console) Close() error {
+	v.mu.Lock()
+	v.closed = true
+	v.drained.Broadcast()
+	v.mu.Unlock()
+
+	close(v.kick)
+
+	return nil
+}
+
+// IO serves the buffers the guest made available on queue q.
+func (v *Console) IO(q uint16) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.closed {
+		return nil
+	}
+
+	if q >= consoleQueues || v.VirtQueue[q] == nil {
+		return fmt.Errorf("%w: queue %d", ErrConsolePort, q)
+	}
+
+	switch {
+	case q == consoleCtrlRxQueue:
+		return v.flushControl()
+	case q == consoleCtrlTxQueue:
+		for _, msg := range v.transmitted(q) {
+			c := consoleControl{}
+			if err := binary.Read(bytes.NewReader(msg), binary.LittleEndian, &c); err != nil {
+				continue
+			}
+
+			v.control(c)
+		}
+
+		if err := v.flushControl(); err != nil {
+			return err
+		}
+	case q%2 == 0:
+		if id := consolePortID(q); id < len(v.ports) {
+			return v.flushPort(id)
+		}
+	default:
+		msgs := v.transmitted(q)
+
+		if id := consolePortID(q); id < len(v.ports) && v.ports[id].conn != nil {
+			for _, msg := range msgs {
+				if _, err := v.ports[id].conn.Write(msg); err != nil {
+					break
+				}
+			}
+		}
+	}
+
+	return v.interrupt()
+}
+
+// consolePortID returns the port of queue q.
+func consolePortID(q uint16) int {
+	if q < 2 {
+		return 0
+	}
+
+	return int(q/2) - 1
+}
+
+// consoleRxQueue returns the receiveq of port id.
+func consoleRxQueue(id int) uint16 {
+	if id == 0 {
+		return 0
+	}
+
+	return uint16(2*id + 2)
+}
+
+// control handles a control message from the guest.
+func (v *Console) control(c consoleControl) {
+	switch c.Event {
+	case consoleDeviceReady:
+		v.driverReady = c.Value == 1
+
+		if v.driverReady {
+			for id := range v.ports {
+				v.sendControl(id, consoleDeviceAdd, 1, nil)
+			}
+		}
+	case consolePortReady:
+		if int(c.ID) >= len(v.ports) || c.Value != 1 {
+			return
+		}
+
+		p := v.ports[c.ID]
+		p.ready = true
+
+		v.sendControl(int(c.ID), consolePortName, 1, []byte(p.name))
+
+		if p.conn != nil {
+			v.sendControl(int(c.ID), consolePortOpen, 1, nil)
+		}
+	case consolePortOpen:
+		if int(c.ID) >= len(v.ports) {
+			return
+		}
+
+		v.ports[c.ID].guestOpen = c.Value == 1
+		_ = v.flushPort(int(c.ID))
+	}
+}
+
+func (v *Console) sendControl(id int, event, value uint16, data []byte) {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, consoleControl{ID: uint32(id), Event: event, Value: value})
+	buf.Write(data)
+
+	v.ctrlPending = append(v.ctrlPending, buf.Bytes())
+}
+
+func (v *Console) flushControl() error {
+	var used bool
+
+	v.ctrlPending, used = v.fill(consoleCtrlRxQueue, v.ctrlPending, false)
+	if !used {
+		return nil
+	}
+
+	return v.interrupt()
+}
+
+// flushPort moves what was read from the host side of port id into the
+// guest, if a program there has it open, as the guest drops data otherwise.
+func (v *Console) flushPort(id int) error {
+	p := v.ports[id]
+	if !p.guestOpen || len(p.pending) == 0 {
+		return nil
+	}
+
+	var used bool
+
+	p.pending, used = v.fill(consoleRxQueue(id), p.pending, true)
+	v.drained.Broadcast()
+
+	if !used {
+		return nil
+	}
+
+	return v.interrupt()
+}
+
+// fill moves msgs into the buffers available on queue q, one message per
+// buffer chain unless split, in which case messages are cut to fit. It
+// returns what is left and whether any buffer was used.
+func (v *Console) fill(q uint16, msgs [][]byte, split bool) ([][]byte, bool) {
+	if v.closed {
+		return nil, false
+	}
+
+	vq := v.VirtQueue[q]
+	if vq == nil {
+		return msgs, false
+	}
+
+	used := false
+
+	for len(msgs) > 0 && v.LastAvailIdx[q] != vq.AvailRing.Idx {
+		head := vq.AvailRing.Ring[v.LastAvailIdx[q]%QueueSize]
+		msg := msgs[0]
+		n := 0
+
+		for descID := head; ; {
+			desc := vq.DescTable[descID]
+
+			if desc.Flags&0x2 != 0 {
+				n += copy(v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)], msg[n:])
+			}
+
+			if desc.Flags&0x1 == 0 {
+				break
+			}
+
+			descID = desc.Next
+		}
+
+		if split && n < len(msg) {
+			msgs[0] = msg[n:]
+		} else {
+			msgs = msgs[1:]
+		}
+
+		vq.UsedRing.Ring[vq.UsedRing.Idx%QueueSize].Idx = uint32(head)
+		vq.UsedRing.Ring[vq.UsedRing.Idx%QueueSize].Len = uint32(n)
+		vq.UsedRing.Idx++
+		v.LastAvailIdx[q]++
+		used = true
+	}
+
+	return msgs, used
+}
+
+// transmitted returns the buffer chains the guest made available on queue
+// q, which all go back at once.
+func (v *Console) transmitted(q uint16) [][]byte {
+	vq := v.VirtQueue[q]
+	msgs := [][]byte{}
+
+	for v.LastAvailIdx[q] != vq.AvailRing.Idx {
+		head := vq.AvailRing.Ring[v.LastAvailIdx[q]%QueueSize]
+		msg := []byte{}
+
+		for descID := head; ; {
+			desc := vq.DescTable[descID]
+			msg = append(msg, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)]...)
+
+			if desc.Flags&0x1 == 0 {
+				break
+			}
+
+			descID = desc.Next
+		}
+
+		msgs = append(msgs, msg)
+
+		vq.UsedRing.Ring[vq.UsedRing.Idx%QueueSize].Idx = uint32(head)
+		vq.UsedRing.Ring[vq.UsedRing.Idx%QueueSize].Len = 0
+		vq.UsedRing.Idx++
+		v.LastAvailIdx[q]++
+	}
+
+	return msgs
+}
+
+func (v *Console) interrupt() error {
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioConsoleIRQ()
+}
+
+// AddPort adds a port named name and returns its id. A guest whose driver
+// is up learns of it at once.
+func (v *Console) AddPort(name string) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.ports) >= ConsoleMaxPorts {
+		return 0, fmt.Errorf("%w: more than %d ports", ErrConsolePort, ConsoleMaxPorts)
+	}
+
+	v.ports = append(v.ports, &consolePort{name: name})
+	id := len(v.ports) - 1
+
+	if v.driverReady {
+		v.sendControl(id, consoleDeviceAdd, 1, nil)
+
+		if err := v.flushControl(); err != nil {
+			return id, err
+		}
+	}
+
+	return id, nil
+}
+
+// Connect bridges port id to conn until reading conn fails: what the guest
+// writes to the port goes to conn, and what is read from conn to the
+// guest. The guest sees the port opened by the host meanwhile. conn is not
+// read while the guest has not taken what was read before, e.g. because it
+// does not have the port open.
+func (v *Console) Connect(id int, conn io.ReadWriter) error {
+	v.mu.Lock()
+
+	if id >= len(v.ports) || v.ports[id].conn != nil {
+		v.mu.Unlock()
+
+		return fmt.Errorf("%w: %d is missing or connected", ErrConsolePort, id)
+	}
+
+	p := v.ports[id]
+	p.conn = conn
+	v.setHostOpen(id, true)
+	v.mu.Unlock()
+
+	var err error
+
+	for {
+		buf := make([]byte, consoleReadSize)
+
+		var n int
+
+		n, err = conn.Read(buf)
+		if n > 0 {
+			v.mu.Lock()
+			p.pending = append(p.pending, buf[:n])
+			_ = v.flushPort(id)
+
+			for len(p.pending) > 0 && !v.closed {
+				v.drained.Wait()
+			}
+
+			v.mu.Unlock()
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	v.mu.Lock()
+	p.conn = nil
+	p.pending = nil
+	v.setHostOpen(id, false)
+	v.mu.Unlock()
+
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+// setHostOpen tells the guest whether the host has port id open.
+func (v *Console) setHostOpen(id int, open bool) {
+	if !v.ports[id].ready {
+		return
+	}
+
+	value := uint16(0)
+	if open {
+		value = 1
+	}
+
+	v.sendControl(id, consolePortOpen, value, nil)
+	_ = v.flushControl()
+}
+
+func NewConsole(irq uint8, irqInjector ConsoleIRQInjector, mem []byte) *Console {
+	v := &Console{
+		Hdr: consoleHdr{
+			commonHeader: commonHeader{
+				hostFeatures: consoleFeatureMultiport,
+				queueNUM:     QueueSize,
+			},
+			consoleHeader: consoleHeader{
+				maxNrPorts: ConsoleMaxPorts,
+			},
+		},
+		irq:         irq,
+		IRQInjector: irqInjector,
+		kick:        make(chan uint16, consoleQueues),
+		Mem:         mem,
+	}
+
+	v.drained = sync.NewCond(&v.mu)
+
+	return v
+}
@@ -0,0 +1,249 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// consoleGuest plays the guest driver: each queue has its buffers at
+// 0x1000 * (q+1), 0x100 bytes per descriptor.
+type consoleGuest struct {
+	t   *testing.T
+	v   *virtio.Console
+	mem []byte
+	vq  [4]*virtio.VirtQueue
+}
+
+func newConsoleGuest(t *testing.T) *consoleGuest {
+	t.Helper()
+
+	g := &consoleGuest{t: t, mem: make([]byte, 0x10000)}
+	g.v = virtio.NewConsole(11, &mockInjector{}, g.mem)
+
+	for q := range g.vq {
+		g.vq[q] = virtio.NewVirtQueue()
+		g.v.VirtQueue[q] = g.vq[q]
+	}
+
+	return g
+}
+
+// post makes data, or 0x100 bytes for the device to fill if nil, available
+// on queue q and notifies the device.
+func (g *consoleGuest) post(q int, data []byte) {
+	g.t.Helper()
+
+	vq := g.vq[q]
+	i := vq.AvailRing.Idx % virtio.QueueSize
+	addr := uint64(0x1000*(q+1) + 0x100*int(i))
+
+	vq.DescTable[i].Addr = addr
+	vq.DescTable[i].Len = 0x100
+	vq.DescTable[i].Flags = 0x2
+
+	if data != nil {
+		copy(g.mem[addr:], data)
+		vq.DescTable[i].Len = uint32(len(data))
+		vq.DescTable[i].Flags = 0
+	}
+
+	vq.AvailRing.Ring[i] = i
+	vq.AvailRing.Idx++
+
+	if err := g.v.IO(uint16(q)); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+// used waits for the device to return the n-th buffer of queue q and
+// returns what it wrote there.
+func (g *consoleGuest) used(q int, n uint16) []byte {
+	g.t.Helper()
+
+	vq := g.vq[q]
+
+	for start := time.Now(); vq.UsedRing.Idx <= n; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			g.t.Fatalf("queue %d: buffer %d was not used", q, n)
+		}
+	}
+
+	e := vq.UsedRing.Ring[n%virtio.QueueSize]
+	addr := vq.DescTable[e.Idx].Addr
+
+	return g.mem[addr : addr+uint64(e.Len)]
+}
+
+func (g *consoleGuest) control(id uint32, event, value uint16) {
+	g.t.Helper()
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, struct {
+		ID           uint32
+		Event, Value uint16
+	}{id, event, value})
+
+	g.post(3, buf.Bytes())
+}
+
+func (g *consoleGuest) expectControl(n uint16, id uint32, event, value uint16, name string) {
+	g.t.Helper()
+
+	msg := g.used(2, n)
+	if len(msg) < 8 || binary.LittleEndian.Uint32(msg) != id ||
+		binary.LittleEndian.Uint16(msg[4:]) != event || binary.LittleEndian.Uint16(msg[6:]) != value ||
+		string(msg[8:]) != name {
+		g.t.Fatalf("control message %d: got %x, expected %d %d %d %q", n, msg, id, event, value, name)
+	}
+}
+
+func TestConsoleGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewConsole(11, &mockInjector{}, []byte{})
+
+	if h := v.GetDeviceHeader(); h.DeviceID != 0x1003 || h.SubsystemID != 3 {
+		t.Fatalf("device %#x, subsystem %d", h.DeviceID, h.SubsystemID)
+	}
+
+	// max_nr_ports follows the common header
+	b := make([]byte, 4)
+	if err := v.IOInHandler(virtio.ConsoleIOPortStart+24, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := binary.LittleEndian.Uint32(b); n != virtio.ConsoleMaxPorts {
+		t.Fatalf("max_nr_ports: got %d, expected %d", n, virtio.ConsoleMaxPorts)
+	}
+}
+
+func TestConsolePort(t *testing.T) {
+	t.Parallel()
+
+	g := newConsoleGuest(t)
+
+	if _, err := g.v.AddPort("org.test.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		g.post(2, nil)
+	}
+
+	// DEVICE_READY, then PORT_READY for the port the device added
+	g.control(0xffffffff, 0, 1)
+	g.expectControl(0, 0, 1, 1, "")
+
+	g.control(0, 3, 1)
+	g.expectControl(1, 0, 7, 1, "org.test.0")
+
+	guest, host := net.Pipe()
+	done := make(chan error)
+
+	go func() { done <- g.v.Connect(0, host) }()
+
+	// PORT_OPEN from the host, then from the guest
+	g.expectControl(2, 0, 6, 1, "")
+	g.control(0, 6, 1)
+
+	g.post(0, nil)
+
+	if _, err := guest.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := g.used(0, 0); string(msg) != "hello" {
+		t.Fatalf("guest got %q", msg)
+	}
+
+	msg := make([]byte, 5)
+	read := make(chan error)
+
+	go func() {
+		_, err := io.ReadFull(guest, msg)
+		read <- err
+	}()
+
+	g.post(1, []byte("world"))
+
+	if err := <-read; err != nil || string(msg) != "world" {
+		t.Fatalf("host got %q, %v", msg, err)
+	}
+
+	g.post(2, nil)
+	guest.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	g.expectControl(3, 0, 6, 0, "")
+}
+
+func TestConsoleAddPort(t *testing.T) {
+	t.Parallel()
+
+	g := newConsoleGuest(t)
+	g.post(2, nil)
+	g.control(0xffffffff, 0, 1)
+
+	// a port added to a ready driver is announced at once
+	id, err := g.v.AddPort("org.test.0")
+	if err != nil || id != 0 {
+		t.Fatalf("got %d, %v", id, err)
+	}
+
+	g.expectControl(0, 0, 1, 1, "")
+
+	for i := 1; i < virtio.ConsoleMaxPorts; i++ {
+		if _, err := g.v.AddPort("org.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := g.v.AddPort("org.test"); !errors.Is(err, virtio.ErrConsolePort) {
+		t.Fatalf("got %v, expected %v", err, virtio.ErrConsolePort)
+	}
+
+	if err := g.v.Connect(virtio.ConsoleMaxPorts, nil); !errors.Is(err, virtio.ErrConsolePort) {
+		t.Fatalf("got %v, expected %v", err, virtio.ErrConsolePort)
+	}
+}
+
+func TestConsoleKickFlood(t *testing.T) {
+	t.Parallel()
+
+	g := newConsoleGuest(t)
+	go g.v.IOThreadEntry()
+
+	// notifications must not wait for IO, which the thread runs under the
+	// same lock, however many are pending
+	done := make(chan error)
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if err := g.v.IOOutHandler(virtio.ConsoleIOPortStart+16, []byte{2, 0}); err != nil {
+				done <- err
+
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifications blocked")
+	}
+}
@@ -0,0 +1,134 @@
+package virtio
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Faults are errors a device injects on purpose, so that the error paths
+// of guest drivers and the resilience of guests can be tested. The zero
+// value injects none; Blk and Net have one each.
+type Faults struct {
+	mu sync.Mutex
+
+	// failIO is how many of the next requests fail.
+	failIO int
+
+	// dropRate and corruptRate are the fractions of frames dropped and
+	// corrupted.
+	dropRate    float64
+	corruptRate float64
+
+	// delay holds back every completion.
+	delay time.Duration
+
+	rand *rand.Rand
+}
+
+// FailNext makes the next n requests fail with an I/O error.
+func (f *Faults) FailNext(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failIO = n
+}
+
+// SetDropRate drops rate, from 0 to 1, of the frames.
+func (f *Faults) SetDropRate(rate float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dropRate = rate
+}
+
+// SetCorruptRate flips a bit in rate, from 0 to 1, of the frames.
+func (f *Faults) SetCorruptRate(rate float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.corruptRate = rate
+}
+
+// SetDelay holds back each completion of a request by d.
+func (f *Faults) SetDelay(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.delay = d
+}
+
+// Clear stops injecting faults.
+func (f *Faults) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failIO, f.dropRate, f.corruptRate, f.delay = 0, 0, 0, 0
+}
+
+func (f *Faults) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return fmt.Sprintf("eio %d, drop %g, corrupt %g, delay %v", f.failIO, f.dropRate, f.corruptRate, f.delay)
+}
+
+// hit reports whether an event of probability rate happens. f.mu must be
+// held.
+func (f *Faults) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	if f.rand == nil {
+		f.rand = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint:gosec
+	}
+
+	return f.rand.Float64() < rate
+}
+
+// fail reports whether the request at hand is to fail, and counts it.
+func (f *Faults) fail() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failIO == 0 {
+		return false
+	}
+
+	f.failIO--
+
+	return true
+}
+
+// drop reports whether the frame at hand is to be dropped.
+func (f *Faults) drop() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.hit(f.dropRate)
+}
+
+// corrupt flips a random bit of frame, if it is to be corrupted.
+func (f *Faults) corrupt(frame []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(frame) == 0 || !f.hit(f.corruptRate) {
+		return
+	}
+
+	frame[f.rand.Intn(len(frame))] ^= 1 << f.rand.Intn(8)
+}
+
+// wait holds back a completion by the delay.
+func (f *Faults) wait() {
+	f.mu.Lock()
+	d := f.delay
+	f.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
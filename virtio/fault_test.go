@@ -0,0 +1,120 @@
+package virtio_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestBlkFailNext(t *testing.T) {
+	t.Parallel()
+
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(disk, bytes.Repeat([]byte{0x5a}, 4*virtio.SectorSize), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x10000)
+
+	v, err := virtio.NewBlk(disk, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A read of sector 1 into 0x400, with its status at 0x800.
+	vq := virtio.NewVirtQueue()
+	vq.DescTable[0].Addr, vq.DescTable[0].Len, vq.DescTable[0].Next = 0, 16, 1
+	vq.DescTable[1].Addr, vq.DescTable[1].Len, vq.DescTable[1].Next = 0x400, virtio.SectorSize, 2
+	vq.DescTable[2].Addr, vq.DescTable[2].Len = 0x800, 1
+
+	blkReq := (*virtio.BlkReq)(unsafe.Pointer(&mem[0]))
+	blkReq.Sector = 1
+
+	v.VirtQueue[0] = vq
+	v.Faults.FailNext(1)
+
+	for i, want := range []struct {
+		status byte
+		data   byte
+	}{{1, 0}, {0, 0x5a}} {
+		mem[0x800] = 0xff
+		vq.AvailRing.Idx++
+
+		if err := v.IO(); err != nil {
+			t.Fatal(err)
+		}
+
+		if mem[0x800] != want.status || mem[0x400] != want.data {
+			t.Fatalf("request %d: status %d, data %#x, want %d, %#x", i, mem[0x800], mem[0x400], want.status, want.data)
+		}
+	}
+}
+
+func TestNetDropAndCorrupt(t *testing.T) {
+	t.Parallel()
+
+	// Size of struct virtio_net_hdr
+	const K = 10
+
+	b := bytes.NewBuffer([]byte{})
+	mem := make([]byte, 0x10000)
+	v := virtio.NewNet(9, &mockInjector{}, b, mem)
+
+	frame := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	copy(mem[0x100+K:], frame)
+
+	// Select Queue #1
+	_ = v.IOOutHandler(virtio.NetIOPortStart+14, []byte{1, 0})
+
+	vq := virtio.NewVirtQueue()
+	vq.DescTable[0].Addr = 0x100
+	vq.DescTable[0].Len = K + uint32(len(frame))
+	v.VirtQueue[1] = vq
+
+	send := func() {
+		vq.AvailRing.Ring[vq.AvailRing.Idx%virtio.QueueSize] = 0
+		vq.AvailRing.Idx++
+
+		if err := v.Tx(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v.Faults.SetDropRate(1)
+	send()
+
+	if b.Len() != 0 || vq.UsedRing.Idx != 1 {
+		t.Fatalf("dropped frame: sent %x, %d used, want none sent and 1 used", b.Bytes(), vq.UsedRing.Idx)
+	}
+
+	v.Faults.Clear()
+	v.Faults.SetCorruptRate(1)
+	send()
+
+	diff := 0
+
+	for i, c := range b.Bytes() {
+		for x := c ^ frame[i]; x != 0; x &= x - 1 {
+			diff++
+		}
+	}
+
+	if b.Len() != len(frame) || diff != 1 {
+		t.Fatalf("corrupted frame: sent %x, want %x with one bit flipped", b.Bytes(), frame)
+	}
+
+	v.Faults.Clear()
+	v.Faults.SetDelay(20 * time.Millisecond)
+
+	start := time.Now()
+	send()
+
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("delayed completion took %v, want at least 20ms", d)
+	}
+}
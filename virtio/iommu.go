@@ -0,0 +1,664 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+// virtio-iommu lets the guest manage the DMA mappings of endpoints, i.e.
+// devices identified by their PCI BDF. Emulated devices translate the
+// addresses the guest gives them with Translate, as their DMA. The
+// device only has the modern transport, which is what the Linux driver
+// binds to.
+//
+// refs: https://docs.oasis-open.org/virtio/virtio/v1.2/csd01/virtio-v1.2-csd01.html#x1-4910006
+const (
+	IOMMUIOPortStart = 0x6400
+	IOMMUIOPortSize  = 0x100
+
+	iommuPageSizeMask = ^uint64(0xfff)
+
+	iommuFeatureInputRange  = 1 << 0
+	iommuFeatureDomainRange = 1 << 1
+	iommuFeatureMapUnmap    = 1 << 2
+	iommuFeatureProbe       = 1 << 4
+
+	iommuReqAttach = 1
+	iommuReqDetach = 2
+	iommuReqMap    = 3
+	iommuReqUnmap  = 4
+	iommuReqProbe  = 5
+
+	// IOMMUMapRead and IOMMUMapWrite are the permissions of a mapping.
+	IOMMUMapRead  = 1 << 0
+	IOMMUMapWrite = 1 << 1
+
+	iommuProbeSize = 0x40
+)
+
+// Status codes of virtio-iommu requests.
+const (
+	IOMMUStatusOK     = 0
+	IOMMUStatusIOErr  = 1
+	IOMMUStatusUnsupp = 2
+	IOMMUStatusDevErr = 3
+	IOMMUStatusInval  = 4
+	IOMMUStatusRange  = 5
+	IOMMUStatusNoEnt  = 6
+	IOMMUStatusFault  = 7
+	IOMMUStatusNoMem  = 8
+)
+
+var ErrIOMMUFault = errors.New("iommu fault")
+
+type IOMMUIRQInjector interface {
+	InjectVirtioIOMMUIRQ() error
+}
+
+// IOMMUListener follows the mappings of the domains. Pages mapped with
+// IOMMUMapWrite can be written by devices at any time, so a migration has
+// to treat them as dirty until they are unmapped, which is what IOMMUDirty
+// does. gokvm has no device assignment, so no listener mirrors the
+// mappings into the host IOMMU for a VFIO device, e.g. one the guest
+// assigns in turn to a nested guest or a userspace driver. The listener
+// is told of one change at a time, of a mapping before devices can use it
+// and of an unmapping once they no longer can, and may call Translate
+// meanwhile.
+type IOMMUListener interface {
+	Map(domain uint32, start, end, phys uint64, flags uint32) error
+	Unmap(domain uint32, start, end uint64) error
+}
+
+// IOMMUDirty is an IOMMUListener that follows the guest memory mapped
+// for devices to write, for a migration to copy it again every round: the
+// dirty log of KVM only has the writes of the guest, not those of devices.
+// Memory unmapped since the last round is copied once more too, for what
+// was written before.
+type IOMMUDirty struct {
+	mu sync.Mutex
+	// writable are the guest physical ranges mapped for writes, by their
+	// domain and I/O virtual address, and unmapped those unmapped since
+	// the last Mark.
+	writable map[iommuDirtyKey][2]uint64
+	unmapped [][2]uint64
+}
+
+type iommuDirtyKey struct {
+	domain uint32
+	start  uint64
+}
+
+func (d *IOMMUDirty) Map(domain uint32, start, end, phys uint64, flags uint32) error {
+	if flags&IOMMUMapWrite == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.writable == nil {
+		d.writable = map[iommuDirtyKey][2]uint64{}
+	}
+
+	d.writable[iommuDirtyKey{domain, start}] = [2]uint64{phys, phys + end - start}
+
+	return nil
+}
+
+func (d *IOMMUDirty) Unmap(domain uint32, start, end uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	k := iommuDirtyKey{domain, start}
+	if r, ok := d.writable[k]; ok {
+		d.unmapped = append(d.unmapped, r)
+		delete(d.writable, k)
+	}
+
+	return nil
+}
+
+// Mark sets the bits of the pages that devices may have written in
+// bitmap, a dirty log of guest memory from 0 with a bit per 4KiB page.
+func (d *IOMMUDirty) Mark(bitmap []uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	set := func(r [2]uint64) {
+		for p := r[0] >> 12; p <= r[1]>>12 && p < uint64(len(bitmap))*64; p++ {
+			bitmap[p/64] |= 1 << (p % 64)
+		}
+	}
+
+	for _, r := range d.writable {
+		set(r)
+	}
+
+	for _, r := range d.unmapped {
+		set(r)
+	}
+
+	d.unmapped = nil
+}
+
+type iommuHdr struct {
+	commonHeader commonHeader
+	iommuHeader  iommuHeader
+}
+
+func (h iommuHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// iommuHeader is struct virtio_iommu_config.
+type iommuHeader struct {
+	pageSizeMask uint64
+	inputStart   uint64
+	inputEnd     uint64
+	domainStart  uint32
+	domainEnd    uint32
+	probeSize    uint32
+	_            uint8 // bypass
+	_            [3]uint8
+}
+
+type iommuMapping struct {
+	start, end, phys uint64
+	flags            uint32
+}
+
+type IOMMU struct {
+	Hdr    iommuHdr
+	modern modern
+
+	// requestq and eventq
+	VirtQueue    [2]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [2]uint16
+
+	kick chan interface{}
+	// done is closed when IOThreadEntry returns.
+	done chan struct{}
+
+	// changes serializes the changes of the mappings, which the Listener
+	// is told about without mu, so that it can call Translate.
+	changes sync.Mutex
+	// mu guards endpoints and domains.
+	mu        sync.Mutex
+	endpoints map[uint32]uint32
+	domains   map[uint32][]iommuMapping
+
+	irq         uint8
+	IRQInjector IOMMUIRQInjector
+
+	// Listener, if set, is told about every change of the mappings.
+	Listener IOMMUListener
+}
+
+func (v *IOMMU) GetDeviceHeader() pci.DeviceHeader {
+	return v.modern.header(pci.DeviceHeader{
+		DeviceID:    0x1057,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		RevisionID:  1,  // Modern only
+		SubsystemID: 23, // IOMMU device
+		Command:     1,  // Enable IO port
+		BAR: [6]uint32{
+			IOMMUIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	})
+}
+
+func (v *IOMMU) Capabilities() []byte {
+	return v.modern.capabilities()
+}
+
+func (v *IOMMU) IOInHandler(port uint64, bytes []byte) error {
+	offset, ok := v.modern.in(int(port-IOMMUIOPortStart), bytes)
+	if ok {
+		return nil
+	}
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	l := len(bytes)
+	copy(bytes[:l], b[offset:offset+l])
+
+	return nil
+}
+
+func (v *IOMMU) IOOutHandler(port uint64, bytes []byte) error {
+	offset, ok := v.modern.out(int(port-IOMMUIOPortStart), bytes)
+	if ok {
+		return nil
+	}
+
+	switch offset {
+	case 8:
+		// Queue PFN is aligned to page (4096 bytes)
+		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
+		v.VirtQueue[v.Hdr.commonHeader.queueSEL%2] = newVirtQueue((*vring)(unsafe.Pointer(&v.Mem[physAddr])))
+		// A new ring, e.g. of a guest that rebooted, starts at 0.
+		v.LastAvailIdx[v.Hdr.commonHeader.queueSEL%2] = 0
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.Hdr.commonHeader.isr = 0x0
+		v.kick <- true
+	default:
+	}
+
+	return nil
+}
+
+// setQueue puts queue q where the driver enabled it with the modern
+// transport.
+func (v *IOMMU) setQueue(q uint16, desc, driver, device uint64) {
+	vq, err := queueSplit(v.Mem, nil, 0, desc, driver, device)
+	if err != nil {
+		vq = nil
+	}
+
+	v.VirtQueue[q] = vq
+	v.LastAvailIdx[q] = 0
+}
+
+func (v *IOMMU) resetQueues() {
+	v.VirtQueue = [2]*VirtQueue{}
+	v.LastAvailIdx = [2]uint16{}
+}
+
+func (v *IOMMU) GetIORange() (start, end uint64) {
+	return IOMMUIOPortStart, IOMMUIOPortStart + IOMMUIOPortSize
+}
+
+func (v *IOMMU) IOThreadEntry() {
+	defer close(v.done)
+
+	for range v.kick {
+		for v.IO() == nil {
+		}
+	}
+}
+
+// Close stops IOThreadEntry, once it has served the requests it was kicked
+// for. The vCPUs must be stopped.
+func (v *IOMMU) Close() error {
+	close(v.kick)
+	<-v.done
+
+	return nil
+}
+
+// IO serves the requests on the requestq.
+func (v *IOMMU) IO() error {
+	sel := uint16(0)
+	if v.VirtQueue[sel] == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := v.VirtQueue[sel].AvailRing
+	usedRing := v.VirtQueue[sel].UsedRing
+
+	if v.LastAvailIdx[sel] == availRing.Idx {
+		return ErrNoTxPacket
+	}
+
+	for v.LastAvailIdx[sel] != availRing.Idx {
+		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+
+		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
+
+		// The driver puts the request in readable buffers followed by
+		// writable ones for the probe properties and the tail.
+		req := []byte{}
+		resp := []byte{}
+
+		for {
+			desc := v.VirtQueue[sel].DescTable[descID]
+			buf := v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
+
+			if desc.Flags&0x2 != 0 {
+				resp = append(resp, buf...)
+			} else {
+				req = append(req, buf...)
+			}
+
+			if desc.Flags&0x1 == 0 {
+				break
+			}
+
+			descID = desc.Next
+		}
+
+		out := v.Request(req, len(resp))
+		v.writeResp(availRing.Ring[v.LastAvailIdx[sel]%QueueSize], out)
+
+		usedRing.Ring[usedRing.Idx%QueueSize].Len = uint32(len(out))
+		usedRing.Idx++
+		v.LastAvailIdx[sel]++
+	}
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioIOMMUIRQ()
+}
+
+// writeResp scatters out into the writable buffers of the chain at descID.
+func (v *IOMMU) writeResp(descID uint16, out []byte) {
+	for len(out) > 0 {
+		desc := v.VirtQueue[0].DescTable[descID]
+
+		if desc.Flags&0x2 != 0 {
+			n := copy(v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)], out)
+			out = out[n:]
+		}
+
+		if desc.Flags&0x1 == 0 {
+			return
+		}
+
+		descID = desc.Next
+	}
+}
+
+// Request handles a request without its tail and returns what the device
+// writes back: the probe properties, if any, and the tail with the status.
+// respLen is the size of the writable buffers.
+func (v *IOMMU) Request(req []byte, respLen int) []byte {
+	status, props := v.request(req)
+
+	out := make([]byte, 0, respLen)
+	if respLen >= len(props)+4 {
+		out = append(out, props...)
+	}
+
+	return append(out, status, 0, 0, 0)
+}
+
+func (v *IOMMU) request(req []byte) (uint8, []byte) {
+	if len(req) < 4 {
+		return IOMMUStatusInval, nil
+	}
+
+	r := bytes.NewReader(req[4:])
+	le := binary.LittleEndian
+
+	switch req[0] {
+	case iommuReqAttach, iommuReqDetach:
+		var a struct{ Domain, Endpoint, Flags uint32 }
+		if err := binary.Read(r, le, &a); err != nil {
+			return IOMMUStatusInval, nil
+		}
+
+		if req[0] == iommuReqAttach {
+			return v.Attach(a.Domain, a.Endpoint), nil
+		}
+
+		return v.Detach(a.Domain, a.Endpoint), nil
+	case iommuReqMap:
+		var m struct {
+			Domain                   uint32
+			VirtStart, VirtEnd, Phys uint64
+			Flags                    uint32
+		}
+		if err := binary.Read(r, le, &m); err != nil {
+			return IOMMUStatusInval, nil
+		}
+
+		return v.Map(m.Domain, m.VirtStart, m.VirtEnd, m.Phys, m.Flags), nil
+	case iommuReqUnmap:
+		var u struct {
+			Domain             uint32
+			VirtStart, VirtEnd uint64
+		}
+		if err := binary.Read(r, le, &u); err != nil {
+			return IOMMUStatusInval, nil
+		}
+
+		return v.Unmap(u.Domain, u.VirtStart, u.VirtEnd), nil
+	case iommuReqProbe:
+		// There are no properties to report; the zeroed buffer ends the list.
+		return IOMMUStatusOK, make([]byte, iommuProbeSize)
+	default:
+		return IOMMUStatusUnsupp, nil
+	}
+}
+
+// Attach attaches endpoint to domain, moving it from its previous one.
+func (v *IOMMU) Attach(domain, endpoint uint32) uint8 {
+	v.changes.Lock()
+	defer v.changes.Unlock()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.domains[domain]; !ok {
+		v.domains[domain] = nil
+	}
+
+	v.endpoints[endpoint] = domain
+
+	return IOMMUStatusOK
+}
+
+// Detach detaches endpoint from domain, freeing the domain if it was the last one.
+func (v *IOMMU) Detach(domain, endpoint uint32) uint8 {
+	v.changes.Lock()
+	defer v.changes.Unlock()
+
+	v.mu.Lock()
+
+	if d, ok := v.endpoints[endpoint]; !ok || d != domain {
+		v.mu.Unlock()
+
+		return IOMMUStatusInval
+	}
+
+	delete(v.endpoints, endpoint)
+
+	for _, d := range v.endpoints {
+		if d == domain {
+			v.mu.Unlock()
+
+			return IOMMUStatusOK
+		}
+	}
+
+	// The domain goes away with its mappings.
+	mappings := v.domains[domain]
+	delete(v.domains, domain)
+	v.mu.Unlock()
+
+	for _, m := range mappings {
+		if v.Listener != nil {
+			_ = v.Listener.Unmap(domain, m.start, m.end)
+		}
+	}
+
+	return IOMMUStatusOK
+}
+
+// Map maps [start, end] in domain to phys.
+func (v *IOMMU) Map(domain uint32, start, end, phys uint64, flags uint32) uint8 {
+	v.changes.Lock()
+	defer v.changes.Unlock()
+
+	v.mu.Lock()
+	mappings, ok := v.domains[domain]
+	v.mu.Unlock()
+
+	if !ok {
+		return IOMMUStatusNoEnt
+	}
+
+	if end < start || flags&^(IOMMUMapRead|IOMMUMapWrite) != 0 {
+		return IOMMUStatusInval
+	}
+
+	for _, m := range mappings {
+		if start <= m.end && m.start <= end {
+			return IOMMUStatusInval
+		}
+	}
+
+	if v.Listener != nil {
+		if err := v.Listener.Map(domain, start, end, phys, flags); err != nil {
+			return IOMMUStatusDevErr
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	mappings = append(v.domains[domain], iommuMapping{start: start, end: end, phys: phys, flags: flags})
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].start < mappings[j].start })
+	v.domains[domain] = mappings
+
+	return IOMMUStatusOK
+}
+
+// Unmap removes the mappings within [start, end] in domain. A mapping
+// that is only partly in the range is kept and makes it fail. The Listener
+// is told of the removed ones once they are gone; if it fails, so does
+// Unmap, but they stay removed.
+func (v *IOMMU) Unmap(domain uint32, start, end uint64) uint8 {
+	v.changes.Lock()
+	defer v.changes.Unlock()
+
+	v.mu.Lock()
+	mappings, ok := v.domains[domain]
+	v.mu.Unlock()
+
+	if !ok {
+		return IOMMUStatusNoEnt
+	}
+
+	status := uint8(IOMMUStatusOK)
+	kept, removed := []iommuMapping{}, []iommuMapping{}
+
+	for _, m := range mappings {
+		switch {
+		case m.end < start || end < m.start:
+			kept = append(kept, m)
+		case start <= m.start && m.end <= end:
+			removed = append(removed, m)
+		default:
+			kept = append(kept, m)
+			status = IOMMUStatusRange
+		}
+	}
+
+	v.mu.Lock()
+	v.domains[domain] = kept
+	v.mu.Unlock()
+
+	for _, m := range removed {
+		if v.Listener != nil {
+			if err := v.Listener.Unmap(domain, m.start, m.end); err != nil {
+				status = IOMMUStatusDevErr
+			}
+		}
+	}
+
+	return status
+}
+
+// Translate returns the guest physical address of the size bytes at addr
+// that endpoint accesses, which must be mapped for the access, to guest
+// physical memory in one piece. Endpoints that are not attached bypass
+// translation.
+func (v *IOMMU) Translate(endpoint uint32, addr, size uint64, write bool) (uint64, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	domain, ok := v.endpoints[endpoint]
+	if !ok {
+		return addr, nil
+	}
+
+	perm := uint32(IOMMUMapRead)
+	if write {
+		perm = IOMMUMapWrite
+	}
+
+	last := addr
+	if size > 0 {
+		last = addr + size - 1
+	}
+
+	// The mappings are sorted and apart, so the range is covered by those
+	// that follow the one of addr without a gap.
+	next, phys := addr, uint64(0)
+
+	for _, m := range v.domains[domain] {
+		if next < m.start || m.end < next {
+			continue
+		}
+
+		p := m.phys + next - m.start
+		if next == addr {
+			phys = p
+		}
+
+		if m.flags&perm == 0 || p != phys+next-addr {
+			break
+		}
+
+		if last <= m.end {
+			return phys, nil
+		}
+
+		next = m.end + 1
+	}
+
+	return 0, fmt.Errorf("%w: endpoint %#x, %#x bytes at %#x", ErrIOMMUFault, endpoint, size, addr)
+}
+
+func NewIOMMU(irq uint8, irqInjector IOMMUIRQInjector, mem []byte) *IOMMU {
+	v := &IOMMU{
+		Hdr: iommuHdr{
+			commonHeader: commonHeader{
+				hostFeatures: iommuFeatureInputRange | iommuFeatureDomainRange |
+					iommuFeatureMapUnmap | iommuFeatureProbe,
+				queueNUM: QueueSize,
+			},
+			iommuHeader: iommuHeader{
+				pageSizeMask: iommuPageSizeMask,
+				inputEnd:     ^uint64(0),
+				domainEnd:    ^uint32(0),
+				probeSize:    iommuProbeSize,
+			},
+		},
+		irq:         irq,
+		IRQInjector: irqInjector,
+		kick:        make(chan interface{}),
+		done:        make(chan struct{}),
+		Mem:         mem,
+		endpoints:   map[uint32]uint32{},
+		domains:     map[uint32][]iommuMapping{},
+	}
+
+	v.modern = newModern(uint64(v.Hdr.commonHeader.hostFeatures), 2, unsafe.Sizeof(iommuHeader{}),
+		v.setQueue, v.resetQueues)
+
+	return v
+}
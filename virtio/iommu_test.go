@@ -0,0 +1,357 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestIOMMUGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewIOMMU(11, &mockInjector{}, []byte{})
+
+	if actual := v.GetDeviceHeader().SubsystemID; actual != 23 {
+		t.Fatalf("expected: 23, actual: %v", actual)
+	}
+
+	s, e := v.GetIORange()
+	if e-s != virtio.IOMMUIOPortSize {
+		t.Fatalf("expected: %v, actual: %v", virtio.IOMMUIOPortSize, e-s)
+	}
+
+	// page_size_mask right after the common header
+	actual := make([]byte, 2)
+	_ = v.IOInHandler(virtio.IOMMUIOPortStart+20, actual)
+
+	if actual[0] != 0x00 || actual[1] != 0xf0 {
+		t.Fatalf("expected: [0 240], actual: %v", actual)
+	}
+}
+
+func TestIOMMUTranslate(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewIOMMU(11, &mockInjector{}, []byte{})
+
+	// Endpoints that are not attached bypass translation.
+	if addr, err := v.Translate(0x08, 0x1234, 1, false); err != nil || addr != 0x1234 {
+		t.Fatalf("bypass: got %#x, %v", addr, err)
+	}
+
+	if status := v.Map(1, 0x10000, 0x1ffff, 0x800000, virtio.IOMMUMapRead); status != virtio.IOMMUStatusNoEnt {
+		t.Fatalf("map to a missing domain: got %d", status)
+	}
+
+	v.Attach(1, 0x08)
+
+	if status := v.Map(1, 0x10000, 0x1ffff, 0x800000, virtio.IOMMUMapRead); status != virtio.IOMMUStatusOK {
+		t.Fatalf("map: got %d", status)
+	}
+
+	if status := v.Map(1, 0x18000, 0x28000, 0x900000, virtio.IOMMUMapRead); status != virtio.IOMMUStatusInval {
+		t.Fatalf("overlapping map: got %d", status)
+	}
+
+	if addr, err := v.Translate(0x08, 0x10042, 1, false); err != nil || addr != 0x800042 {
+		t.Fatalf("read: got %#x, %v", addr, err)
+	}
+
+	if _, err := v.Translate(0x08, 0x10042, 1, true); !errors.Is(err, virtio.ErrIOMMUFault) {
+		t.Fatalf("write to a read-only mapping: got %v, want %v", err, virtio.ErrIOMMUFault)
+	}
+
+	if _, err := v.Translate(0x08, 0x20000, 1, false); !errors.Is(err, virtio.ErrIOMMUFault) {
+		t.Fatalf("unmapped address: got %v, want %v", err, virtio.ErrIOMMUFault)
+	}
+
+	if status := v.Unmap(1, 0x10000, 0x17fff); status != virtio.IOMMUStatusRange {
+		t.Fatalf("partial unmap: got %d", status)
+	}
+
+	if status := v.Unmap(1, 0, 0xfffff); status != virtio.IOMMUStatusOK {
+		t.Fatalf("unmap: got %d", status)
+	}
+
+	if _, err := v.Translate(0x08, 0x10042, 1, false); !errors.Is(err, virtio.ErrIOMMUFault) {
+		t.Fatalf("after unmap: got %v, want %v", err, virtio.ErrIOMMUFault)
+	}
+
+	if status := v.Detach(2, 0x08); status != virtio.IOMMUStatusInval {
+		t.Fatalf("detach from another domain: got %d", status)
+	}
+
+	if status := v.Detach(1, 0x08); status != virtio.IOMMUStatusOK {
+		t.Fatalf("detach: got %d", status)
+	}
+}
+
+func TestIOMMUTranslateRange(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewIOMMU(11, &mockInjector{}, []byte{})
+	v.Attach(1, 0x08)
+
+	// Pages mapped one by one, as Linux does, the third away from the
+	// first two.
+	for _, m := range []struct{ start, phys uint64 }{
+		{0x10000, 0x800000}, {0x11000, 0x801000}, {0x12000, 0x900000},
+	} {
+		if status := v.Map(1, m.start, m.start+0xfff, m.phys, virtio.IOMMUMapRead); status != virtio.IOMMUStatusOK {
+			t.Fatalf("map %#x: got %d", m.start, status)
+		}
+	}
+
+	if addr, err := v.Translate(0x08, 0x10800, 0x1000, false); err != nil || addr != 0x800800 {
+		t.Fatalf("across contiguous pages: got %#x, %v", addr, err)
+	}
+
+	if _, err := v.Translate(0x08, 0x11800, 0x1000, false); !errors.Is(err, virtio.ErrIOMMUFault) {
+		t.Fatalf("across pages apart: got %v, want %v", err, virtio.ErrIOMMUFault)
+	}
+
+	if _, err := v.Translate(0x08, 0x12800, 0x1000, false); !errors.Is(err, virtio.ErrIOMMUFault) {
+		t.Fatalf("past the last mapping: got %v, want %v", err, virtio.ErrIOMMUFault)
+	}
+}
+
+func request(t *testing.T, req interface{}) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, req); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestIOMMUIO(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	v := virtio.NewIOMMU(11, &mockInjector{}, mem)
+
+	vq := virtio.NewVirtQueue()
+	v.VirtQueue[0] = vq
+
+	// attach, then map with the tails at 0x1000 and 0x1100
+	attach := request(t, struct {
+		Type                   uint8
+		_                      [3]uint8
+		Domain, Endpoint, _, _ uint32
+	}{Type: 1, Domain: 1, Endpoint: 0x08})
+	copy(mem[0x0:], attach)
+
+	mapReq := request(t, struct {
+		Type                     uint8
+		_                        [3]uint8
+		Domain                   uint32
+		VirtStart, VirtEnd, Phys uint64
+		Flags                    uint32
+	}{
+		Type: 3, Domain: 1, VirtStart: 0x10000, VirtEnd: 0x1ffff, Phys: 0x800000,
+		Flags: virtio.IOMMUMapRead | virtio.IOMMUMapWrite,
+	})
+	copy(mem[0x100:], mapReq)
+
+	vq.DescTable[0].Addr = 0x0
+	vq.DescTable[0].Len = uint32(len(attach))
+	vq.DescTable[0].Flags = 0x1
+	vq.DescTable[0].Next = 1
+	vq.DescTable[1].Addr = 0x1000
+	vq.DescTable[1].Len = 4
+	vq.DescTable[1].Flags = 0x2
+
+	vq.DescTable[2].Addr = 0x100
+	vq.DescTable[2].Len = uint32(len(mapReq))
+	vq.DescTable[2].Flags = 0x1
+	vq.DescTable[2].Next = 3
+	vq.DescTable[3].Addr = 0x1100
+	vq.DescTable[3].Len = 4
+	vq.DescTable[3].Flags = 0x2
+
+	mem[0x1000], mem[0x1100] = 0xff, 0xff
+	vq.AvailRing.Ring[0] = 0
+	vq.AvailRing.Ring[1] = 2
+	vq.AvailRing.Idx = 2
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if !v.IRQInjector.(*mockInjector).called {
+		t.Fatalf("irqInjected = false\n")
+	}
+
+	if mem[0x1000] != virtio.IOMMUStatusOK || mem[0x1100] != virtio.IOMMUStatusOK {
+		t.Fatalf("status: attach %d, map %d", mem[0x1000], mem[0x1100])
+	}
+
+	if vq.UsedRing.Idx != 2 || vq.UsedRing.Ring[1].Idx != 2 {
+		t.Fatalf("used ring: %+v", *vq.UsedRing)
+	}
+
+	if addr, err := v.Translate(0x08, 0x10100, 1, true); err != nil || addr != 0x800100 {
+		t.Fatalf("translate: got %#x, %v", addr, err)
+	}
+}
+
+func TestIOMMUProbe(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewIOMMU(11, &mockInjector{}, []byte{})
+
+	out := v.Request(append([]byte{5, 0, 0, 0, 8, 0, 0, 0}, make([]byte, 64)...), 0x44)
+	if len(out) != 0x44 || out[0x40] != virtio.IOMMUStatusOK {
+		t.Fatalf("probe: got %d bytes, status %d", len(out), out[len(out)-4])
+	}
+
+	out = v.Request([]byte{0x42, 0, 0, 0}, 4)
+	if out[0] != virtio.IOMMUStatusUnsupp {
+		t.Fatalf("unknown request: got %d", out[0])
+	}
+}
+
+type recordingListener struct {
+	events []string
+	fail   bool
+}
+
+func (l *recordingListener) Map(domain uint32, start, end, phys uint64, flags uint32) error {
+	if l.fail {
+		return errors.New("host iommu is full")
+	}
+
+	l.events = append(l.events, fmt.Sprintf("map %d %#x-%#x %#x %d", domain, start, end, phys, flags))
+
+	return nil
+}
+
+func (l *recordingListener) Unmap(domain uint32, start, end uint64) error {
+	l.events = append(l.events, fmt.Sprintf("unmap %d %#x-%#x", domain, start, end))
+
+	return nil
+}
+
+func TestIOMMUListener(t *testing.T) {
+	t.Parallel()
+
+	l := &recordingListener{}
+	v := virtio.NewIOMMU(11, &mockInjector{}, []byte{})
+	v.Listener = l
+
+	v.Attach(1, 0x08)
+	v.Map(1, 0x10000, 0x1ffff, 0x800000, virtio.IOMMUMapWrite)
+	v.Map(1, 0x20000, 0x2ffff, 0x900000, virtio.IOMMUMapRead)
+	v.Unmap(1, 0x10000, 0x1ffff)
+	v.Detach(1, 0x08)
+
+	expected := []string{
+		"map 1 0x10000-0x1ffff 0x800000 2",
+		"map 1 0x20000-0x2ffff 0x900000 1",
+		"unmap 1 0x10000-0x1ffff",
+		"unmap 1 0x20000-0x2ffff",
+	}
+
+	if strings.Join(l.events, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected: %q, actual: %q", expected, l.events)
+	}
+
+	l.fail = true
+
+	v.Attach(2, 0x10)
+
+	if status := v.Map(2, 0x10000, 0x1ffff, 0x800000, virtio.IOMMUMapRead); status != virtio.IOMMUStatusDevErr {
+		t.Fatalf("map refused by the listener: got %d", status)
+	}
+
+	if _, err := v.Translate(0x10, 0x10000, 1, false); !errors.Is(err, virtio.ErrIOMMUFault) {
+		t.Fatalf("refused mapping is in place: got %v", err)
+	}
+}
+
+var errStillMapped = errors.New("unmapped range still translates")
+
+// translatingListener translates what it is told about, as a listener
+// that checks the mappings in place would.
+type translatingListener struct {
+	v *virtio.IOMMU
+}
+
+func (l translatingListener) Map(domain uint32, start, end, phys uint64, flags uint32) error {
+	_, err := l.v.Translate(0x08, start, 1, false)
+
+	return err
+}
+
+func (l translatingListener) Unmap(domain uint32, start, end uint64) error {
+	if _, err := l.v.Translate(0x08, start, 1, false); err == nil {
+		return errStillMapped
+	}
+
+	return nil
+}
+
+func TestIOMMUListenerTranslate(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewIOMMU(11, &mockInjector{}, []byte{})
+	v.Listener = translatingListener{v}
+
+	done := make(chan uint8)
+
+	go func() {
+		v.Attach(1, 0x08)
+		v.Map(1, 0x10000, 0x1ffff, 0x800000, virtio.IOMMUMapRead)
+		done <- v.Unmap(1, 0x10000, 0x1ffff)
+	}()
+
+	select {
+	case status := <-done:
+		// The listener finds the mapping it is told about, and not the
+		// one it is told is unmapped.
+		if status != virtio.IOMMUStatusOK {
+			t.Fatalf("unmap: got %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener deadlocked")
+	}
+}
+
+func TestIOMMUDirty(t *testing.T) {
+	t.Parallel()
+
+	d := &virtio.IOMMUDirty{}
+	v := virtio.NewIOMMU(11, &mockInjector{}, []byte{})
+	v.Listener = d
+
+	// Pages 1 and 2 are mapped for writes, page 4 only for reads.
+	v.Attach(1, 0x08)
+	v.Map(1, 0x10000, 0x11fff, 0x1000, virtio.IOMMUMapRead|virtio.IOMMUMapWrite)
+	v.Map(1, 0x20000, 0x20fff, 0x4000, virtio.IOMMUMapRead)
+
+	bitmap := make([]uint64, 1)
+	if d.Mark(bitmap); bitmap[0] != 0b110 {
+		t.Fatalf("mapped: got %#b", bitmap[0])
+	}
+
+	// Unmapped pages are dirty once more, then no longer.
+	v.Unmap(1, 0x10000, 0x11fff)
+
+	bitmap[0] = 0
+	if d.Mark(bitmap); bitmap[0] != 0b110 {
+		t.Fatalf("unmapped: got %#b", bitmap[0])
+	}
+
+	bitmap[0] = 0
+	if d.Mark(bitmap); bitmap[0] != 0 {
+		t.Fatalf("after unmap: got %#b", bitmap[0])
+	}
+}
@@ -0,0 +1,503 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+// virtio-mem adds RAM to the guest and takes it back in blocks: the device
+// has a region of guest physical memory, of which the host asks for
+// requested_size with Resize, and the guest plugs and unplugs blocks until
+// it has as many. Unplugged blocks go back to the host. The device only
+// has the modern transport, which is what the Linux driver binds to.
+//
+// refs: https://docs.oasis-open.org/virtio/virtio/v1.2/csd01/virtio-v1.2-csd01.html#x1-5560007
+const (
+	MemoryIOPortStart = 0x6600
+	MemoryIOPortSize  = 0x100
+
+	memoryReqPlug      = 0
+	memoryReqUnplug    = 1
+	memoryReqUnplugAll = 2
+	memoryReqState     = 3
+
+	// memoryReqSize is struct virtio_mem_req, and memoryRespSize struct
+	// virtio_mem_resp.
+	memoryReqSize  = 24
+	memoryRespSize = 10
+)
+
+// Responses of virtio-mem requests.
+const (
+	MemoryRespACK   = 0
+	MemoryRespNACK  = 1
+	MemoryRespBusy  = 2
+	MemoryRespError = 3
+)
+
+// States of a range of blocks of a STATE request.
+const (
+	MemoryStatePlugged   = 0
+	MemoryStateUnplugged = 1
+	MemoryStateMixed     = 2
+)
+
+var ErrMemorySize = errors.New("invalid virtio-mem size")
+
+type MemoryIRQInjector interface {
+	InjectVirtioMemIRQ() error
+}
+
+type memoryHdr struct {
+	commonHeader commonHeader
+	memoryHeader memoryHeader
+}
+
+func (h memoryHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// memoryHeader is struct virtio_mem_config.
+type memoryHeader struct {
+	blockSize        uint64
+	_                uint16 // node_id
+	_                [6]uint8
+	addr             uint64
+	regionSize       uint64
+	usableRegionSize uint64
+	pluggedSize      uint64
+	requestedSize    uint64
+}
+
+type Memory struct {
+	Hdr    memoryHdr
+	modern modern
+
+	// guestq
+	VirtQueue    [1]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [1]uint16
+
+	kick chan interface{}
+	// done is closed when IOThreadEntry returns.
+	done chan struct{}
+	// Runner runs the requests IOThreadEntry is kicked for.
+	Runner Runner
+
+	// mu guards Hdr, which Resize changes while the guest reads it, and
+	// plugged, which tells for each block of region whether the guest has
+	// it.
+	mu      sync.Mutex
+	region  []byte
+	plugged []bool
+
+	irq         uint8
+	IRQInjector MemoryIRQInjector
+}
+
+func (v *Memory) GetDeviceHeader() pci.DeviceHeader {
+	return v.modern.header(pci.DeviceHeader{
+		DeviceID:    0x1058,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		RevisionID:  1,  // Modern only
+		SubsystemID: 24, // Memory device
+		Command:     1,  // Enable IO port
+		BAR: [6]uint32{
+			MemoryIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	})
+}
+
+func (v *Memory) Capabilities() []byte {
+	return v.modern.capabilities()
+}
+
+func (v *Memory) IOInHandler(port uint64, bytes []byte) error {
+	offset, ok := v.modern.in(int(port-MemoryIOPortStart), bytes)
+	if ok {
+		return nil
+	}
+
+	v.mu.Lock()
+	b, err := v.Hdr.Bytes()
+	v.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	l := len(bytes)
+	copy(bytes[:l], b[offset:offset+l])
+
+	return nil
+}
+
+func (v *Memory) IOOutHandler(port uint64, bytes []byte) error {
+	offset, ok := v.modern.out(int(port-MemoryIOPortStart), bytes)
+	if ok {
+		return nil
+	}
+
+	switch offset {
+	case 8:
+		// Queue PFN is aligned to page (4096 bytes)
+		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
+		v.VirtQueue[0] = newVirtQueue((*vring)(unsafe.Pointer(&v.Mem[physAddr])))
+		// A new ring, e.g. of a guest that rebooted, starts at 0.
+		v.LastAvailIdx[0] = 0
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.mu.Lock()
+		v.Hdr.commonHeader.isr = 0x0
+		v.mu.Unlock()
+		v.kick <- true
+	default:
+	}
+
+	return nil
+}
+
+// setQueue puts the guestq where the driver enabled it with the modern
+// transport.
+func (v *Memory) setQueue(q uint16, desc, driver, device uint64) {
+	vq, err := queueSplit(v.Mem, nil, 0, desc, driver, device)
+	if err != nil {
+		vq = nil
+	}
+
+	v.VirtQueue[q] = vq
+	v.LastAvailIdx[q] = 0
+}
+
+func (v *Memory) resetQueues() {
+	v.VirtQueue = [1]*VirtQueue{}
+	v.LastAvailIdx = [1]uint16{}
+}
+
+func (v *Memory) GetIORange() (start, end uint64) {
+	return MemoryIOPortStart, MemoryIOPortStart + MemoryIOPortSize
+}
+
+func (v *Memory) IOThreadEntry() {
+	defer close(v.done)
+
+	for range v.kick {
+		serve(v.Runner, v.IO)
+	}
+}
+
+// Close stops IOThreadEntry, once it has served the requests it was kicked
+// for. The vCPUs must be stopped. The region is the caller's to unmap.
+func (v *Memory) Close() error {
+	close(v.kick)
+	<-v.done
+
+	return nil
+}
+
+// IO serves the requests on the guestq.
+func (v *Memory) IO() error {
+	sel := uint16(0)
+	if v.VirtQueue[sel] == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := v.VirtQueue[sel].AvailRing
+	usedRing := v.VirtQueue[sel].UsedRing
+
+	if v.LastAvailIdx[sel] == availRing.Idx {
+		return ErrNoTxPacket
+	}
+
+	for v.LastAvailIdx[sel] != availRing.Idx {
+		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+
+		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
+		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+
+		// The driver puts the request in a readable buffer and the response
+		// in a writable one.
+		req := []byte{}
+
+		for {
+			desc := v.VirtQueue[sel].DescTable[descID]
+			buf := v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
+
+			if desc.Flags&0x2 != 0 {
+				n := copy(buf, v.Request(req))
+				usedRing.Ring[usedRing.Idx%QueueSize].Len = uint32(n)
+			} else {
+				req = append(req, buf...)
+			}
+
+			if desc.Flags&0x1 == 0 {
+				break
+			}
+
+			descID = desc.Next
+		}
+
+		usedRing.Idx++
+		v.LastAvailIdx[sel]++
+	}
+
+	v.mu.Lock()
+	v.Hdr.commonHeader.isr |= 0x1
+	v.mu.Unlock()
+
+	return v.IRQInjector.InjectVirtioMemIRQ()
+}
+
+// Request handles a request and returns the response.
+func (v *Memory) Request(req []byte) []byte {
+	resp, state := v.request(req)
+
+	out := make([]byte, memoryRespSize)
+	binary.LittleEndian.PutUint16(out[0:], resp)
+	binary.LittleEndian.PutUint16(out[8:], state)
+
+	return out
+}
+
+func (v *Memory) request(req []byte) (uint16, uint16) {
+	if len(req) < memoryReqSize {
+		return MemoryRespError, 0
+	}
+
+	le := binary.LittleEndian
+	addr, blocks := le.Uint64(req[8:]), uint64(le.Uint16(req[16:]))
+
+	switch le.Uint16(req[0:]) {
+	case memoryReqPlug:
+		return v.Plug(addr, blocks), 0
+	case memoryReqUnplug:
+		return v.Unplug(addr, blocks), 0
+	case memoryReqUnplugAll:
+		return v.UnplugAll(), 0
+	case memoryReqState:
+		return v.State(addr, blocks)
+	default:
+		return MemoryRespError, 0
+	}
+}
+
+// blocks returns the indexes of the blocks of the range of n blocks at
+// addr, or false if it is not within the usable region.
+func (v *Memory) blocks(addr, n uint64) (first, end uint64, ok bool) {
+	h := &v.Hdr.memoryHeader
+
+	if n == 0 || addr < h.addr || (addr-h.addr)%h.blockSize != 0 {
+		return 0, 0, false
+	}
+
+	first = (addr - h.addr) / h.blockSize
+	end = first + n
+
+	return first, end, end <= h.usableRegionSize/h.blockSize
+}
+
+// Plug gives the guest the n blocks at addr, unless that would take it
+// beyond the requested size.
+func (v *Memory) Plug(addr, n uint64) uint16 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	h := &v.Hdr.memoryHeader
+
+	first, end, ok := v.blocks(addr, n)
+	if !ok {
+		return MemoryRespError
+	}
+
+	for i := first; i < end; i++ {
+		if v.plugged[i] {
+			return MemoryRespError
+		}
+	}
+
+	if h.pluggedSize+n*h.blockSize > h.requestedSize {
+		return MemoryRespNACK
+	}
+
+	for i := first; i < end; i++ {
+		v.plugged[i] = true
+	}
+
+	h.pluggedSize += n * h.blockSize
+
+	return MemoryRespACK
+}
+
+// Unplug takes back the n blocks at addr and gives their memory back to
+// the host, unless that would take the guest below the requested size.
+func (v *Memory) Unplug(addr, n uint64) uint16 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	h := &v.Hdr.memoryHeader
+
+	first, end, ok := v.blocks(addr, n)
+	if !ok {
+		return MemoryRespError
+	}
+
+	for i := first; i < end; i++ {
+		if !v.plugged[i] {
+			return MemoryRespError
+		}
+	}
+
+	if h.pluggedSize-n*h.blockSize < h.requestedSize {
+		return MemoryRespNACK
+	}
+
+	if v.discard(first, end) != nil {
+		return MemoryRespError
+	}
+
+	for i := first; i < end; i++ {
+		v.plugged[i] = false
+	}
+
+	h.pluggedSize -= n * h.blockSize
+
+	return MemoryRespACK
+}
+
+// UnplugAll takes back all blocks, as the guest does when it starts.
+func (v *Memory) UnplugAll() uint16 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.discard(0, uint64(len(v.plugged))) != nil {
+		return MemoryRespError
+	}
+
+	for i := range v.plugged {
+		v.plugged[i] = false
+	}
+
+	v.Hdr.memoryHeader.pluggedSize = 0
+
+	return MemoryRespACK
+}
+
+// State tells whether the n blocks at addr are plugged.
+func (v *Memory) State(addr, n uint64) (uint16, uint16) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	first, end, ok := v.blocks(addr, n)
+	if !ok {
+		return MemoryRespError, 0
+	}
+
+	plugged := 0
+
+	for i := first; i < end; i++ {
+		if v.plugged[i] {
+			plugged++
+		}
+	}
+
+	switch uint64(plugged) {
+	case 0:
+		return MemoryRespACK, MemoryStateUnplugged
+	case n:
+		return MemoryRespACK, MemoryStatePlugged
+	default:
+		return MemoryRespACK, MemoryStateMixed
+	}
+}
+
+// discard frees the host memory of blocks [first, end), which the guest
+// finds zeroed if it plugs them again.
+func (v *Memory) discard(first, end uint64) error {
+	bs := v.Hdr.memoryHeader.blockSize
+
+	return syscall.Madvise(v.region[first*bs:end*bs], syscall.MADV_DONTNEED)
+}
+
+// Resize asks the guest to plug or unplug blocks until it has size bytes,
+// a multiple of the block size up to that of the region. The guest takes
+// its time, see Size.
+func (v *Memory) Resize(size uint64) error {
+	v.mu.Lock()
+
+	h := &v.Hdr.memoryHeader
+	if size%h.blockSize != 0 || size > h.usableRegionSize {
+		v.mu.Unlock()
+
+		return fmt.Errorf("%w: %#x, want a multiple of %#x up to %#x",
+			ErrMemorySize, size, h.blockSize, h.usableRegionSize)
+	}
+
+	h.requestedSize = size
+	v.Hdr.commonHeader.isr |= isrConfigChange
+	v.mu.Unlock()
+
+	return v.IRQInjector.InjectVirtioMemIRQ()
+}
+
+// Size returns how many bytes the guest has plugged, and how many Resize
+// asked for.
+func (v *Memory) Size() (plugged, requested uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.Hdr.memoryHeader.pluggedSize, v.Hdr.memoryHeader.requestedSize
+}
+
+// NewMemory returns a virtio-mem device for the region of guest physical
+// memory at addr, whose host memory is region, in blocks of blockSize.
+// None of it is plugged or requested yet.
+func NewMemory(irq uint8, irqInjector MemoryIRQInjector, mem, region []byte,
+	addr, blockSize uint64,
+) (*Memory, error) {
+	size := uint64(len(region))
+	if blockSize == 0 || size == 0 || size%blockSize != 0 || addr%blockSize != 0 {
+		return nil, fmt.Errorf("%w: %#x bytes at %#x in blocks of %#x", ErrMemorySize, size, addr, blockSize)
+	}
+
+	v := &Memory{
+		Hdr: memoryHdr{
+			commonHeader: commonHeader{
+				queueNUM: QueueSize,
+			},
+			memoryHeader: memoryHeader{
+				blockSize:        blockSize,
+				addr:             addr,
+				regionSize:       size,
+				usableRegionSize: size,
+			},
+		},
+		irq:         irq,
+		IRQInjector: irqInjector,
+		kick:        make(chan interface{}),
+		done:        make(chan struct{}),
+		Mem:         mem,
+		region:      region,
+		plugged:     make([]bool, size/blockSize),
+	}
+
+	v.modern = newModern(0, 1, unsafe.Sizeof(memoryHeader{}), v.setQueue, v.resetQueues)
+
+	return v, nil
+}
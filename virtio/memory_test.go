@@ -0,0 +1,187 @@
+package virtio_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+const (
+	memoryBase  = 1 << 36
+	memoryBlock = 0x200000
+)
+
+func newMemory(t *testing.T, mem []byte) *virtio.Memory {
+	t.Helper()
+
+	region, err := syscall.Mmap(-1, 0, 4*memoryBlock, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = syscall.Munmap(region) })
+
+	v, err := virtio.NewMemory(12, &mockInjector{}, mem, region, memoryBase, memoryBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestMemoryGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v := newMemory(t, []byte{})
+
+	if actual := v.GetDeviceHeader().SubsystemID; actual != 24 {
+		t.Fatalf("expected: 24, actual: %v", actual)
+	}
+
+	s, e := v.GetIORange()
+	if e-s != virtio.MemoryIOPortSize {
+		t.Fatalf("expected: %v, actual: %v", virtio.MemoryIOPortSize, e-s)
+	}
+
+	// addr of virtio_mem_config after the common header
+	actual := make([]byte, 8)
+	_ = v.IOInHandler(virtio.MemoryIOPortStart+20+16, actual)
+
+	if addr := binary.LittleEndian.Uint64(actual); addr != memoryBase {
+		t.Fatalf("expected: %#x, actual: %#x", memoryBase, addr)
+	}
+
+	// The modern transport, which the Linux driver binds to, has the
+	// capabilities and the device configuration at 0xc0.
+	if h := v.GetDeviceHeader(); h.Status&pci.StatusCapabilityList == 0 || h.CapabilitiesPointer != 0x40 {
+		t.Fatalf("status %#x, capabilities pointer %#x", h.Status, h.CapabilitiesPointer)
+	}
+
+	_ = v.IOInHandler(virtio.MemoryIOPortStart+0xc0+16, actual)
+
+	if addr := binary.LittleEndian.Uint64(actual); addr != memoryBase {
+		t.Fatalf("modern: expected: %#x, actual: %#x", memoryBase, addr)
+	}
+
+	if _, err := virtio.NewMemory(12, &mockInjector{}, nil, make([]byte, 0x1000), 0, memoryBlock); !errors.Is(err, virtio.ErrMemorySize) {
+		t.Fatalf("got %v, want %v", err, virtio.ErrMemorySize)
+	}
+}
+
+func TestMemoryPlug(t *testing.T) {
+	t.Parallel()
+
+	v := newMemory(t, []byte{})
+
+	if err := v.Resize(5 * memoryBlock); !errors.Is(err, virtio.ErrMemorySize) {
+		t.Fatalf("resize beyond the region: got %v, want %v", err, virtio.ErrMemorySize)
+	}
+
+	if err := v.Resize(2 * memoryBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.IRQInjector.(*mockInjector).called {
+		t.Fatal("the guest was not told of the new size")
+	}
+
+	for _, c := range []struct {
+		name string
+		op   func() uint16
+		want uint16
+	}{
+		{"plug", func() uint16 { return v.Plug(memoryBase, 1) }, virtio.MemoryRespACK},
+		{"plug again", func() uint16 { return v.Plug(memoryBase, 1) }, virtio.MemoryRespError},
+		{"plug unaligned", func() uint16 { return v.Plug(memoryBase+0x1000, 1) }, virtio.MemoryRespError},
+		{"plug outside", func() uint16 { return v.Plug(memoryBase+4*memoryBlock, 1) }, virtio.MemoryRespError},
+		{"plug beyond the request", func() uint16 { return v.Plug(memoryBase+memoryBlock, 2) }, virtio.MemoryRespNACK},
+		{"plug the rest", func() uint16 { return v.Plug(memoryBase+3*memoryBlock, 1) }, virtio.MemoryRespACK},
+		{"unplug below the request", func() uint16 { return v.Unplug(memoryBase, 1) }, virtio.MemoryRespNACK},
+	} {
+		if got := c.op(); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+
+	if resp, state := v.State(memoryBase, 4); resp != virtio.MemoryRespACK || state != virtio.MemoryStateMixed {
+		t.Errorf("state: got %d, %d", resp, state)
+	}
+
+	if plugged, requested := v.Size(); plugged != 2*memoryBlock || requested != 2*memoryBlock {
+		t.Errorf("size: got %#x of %#x", plugged, requested)
+	}
+
+	if err := v.Resize(memoryBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := v.Unplug(memoryBase+2*memoryBlock, 1); got != virtio.MemoryRespError {
+		t.Errorf("unplug an unplugged block: got %d", got)
+	}
+
+	if got := v.Unplug(memoryBase+3*memoryBlock, 1); got != virtio.MemoryRespACK {
+		t.Errorf("unplug: got %d", got)
+	}
+
+	if resp, state := v.State(memoryBase+2*memoryBlock, 2); resp != virtio.MemoryRespACK || state != virtio.MemoryStateUnplugged {
+		t.Errorf("state: got %d, %d", resp, state)
+	}
+
+	if got := v.UnplugAll(); got != virtio.MemoryRespACK {
+		t.Errorf("unplug all: got %d", got)
+	}
+
+	if plugged, _ := v.Size(); plugged != 0 {
+		t.Errorf("%#x plugged after unplugging all", plugged)
+	}
+}
+
+func TestMemoryIO(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	v := newMemory(t, mem)
+
+	if err := v.Resize(memoryBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	vq := virtio.NewVirtQueue()
+	v.VirtQueue[0] = vq
+
+	// a plug request with its response at 0x1000
+	binary.LittleEndian.PutUint64(mem[8:], memoryBase)
+	binary.LittleEndian.PutUint16(mem[16:], 1)
+
+	vq.DescTable[0].Addr = 0x0
+	vq.DescTable[0].Len = 24
+	vq.DescTable[0].Flags = 0x1
+	vq.DescTable[0].Next = 1
+	vq.DescTable[1].Addr = 0x1000
+	vq.DescTable[1].Len = 10
+	vq.DescTable[1].Flags = 0x2
+
+	mem[0x1000] = 0xff
+	vq.AvailRing.Idx = 1
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if mem[0x1000] != virtio.MemoryRespACK {
+		t.Fatalf("response: got %d", mem[0x1000])
+	}
+
+	if vq.UsedRing.Idx != 1 || vq.UsedRing.Ring[0].Len != 10 {
+		t.Fatalf("used ring: %+v", *vq.UsedRing)
+	}
+
+	if plugged, _ := v.Size(); plugged != memoryBlock {
+		t.Fatalf("plugged: got %#x", plugged)
+	}
+}
@@ -0,0 +1,290 @@
+package virtio
+
+import (
+	"encoding/binary"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+// The modern transport of VIRTIO 1.0 has the driver find the registers of
+// a device through vendor capabilities in its configuration space, here
+// all in BAR0 after the legacy header. The common configuration takes the
+// place of the legacy header for the features, the status and the queues,
+// whose parts the driver may put anywhere. The ISR status, the
+// notifications and the device configuration are those of the legacy
+// header, at other offsets.
+//
+// refs: https://docs.oasis-open.org/virtio/virtio/v1.2/csd01/virtio-v1.2-csd01.html#x1-1150001
+const (
+	// Offsets of the registers of the modern transport in BAR0.
+	modernCommonOffset = 0x80
+	modernISROffset    = 0xb8
+	modernNotifyOffset = 0xbc
+	modernDeviceOffset = 0xc0
+
+	// modernCommonSize is struct virtio_pci_common_cfg.
+	modernCommonSize = 0x38
+
+	// modernCapsOffset is where the capabilities start in the
+	// configuration space, right after the header.
+	modernCapsOffset = 0x40
+
+	// Types of the vendor capabilities.
+	modernCapCommon = 1
+	modernCapNotify = 2
+	modernCapISR    = 3
+	modernCapDevice = 4
+
+	// Offsets of the legacy registers that the modern transport shares.
+	legacyNotifyOffset = 16
+	legacyISROffset    = 19
+	legacyDeviceOffset = 20
+
+	// Features of the transport, in the high 32 bits a legacy driver does
+	// not see.
+	featureVersion1       = 1 << 32
+	featureAccessPlatform = 1 << 33
+)
+
+type modernQueue struct {
+	msixVector           uint16
+	enable               uint16
+	desc, driver, device uint64
+}
+
+// modern is the state of the modern transport of a device.
+type modern struct {
+	// features are those the device offers, and driverFeatures those the
+	// driver accepted.
+	features, driverFeatures uint64
+	dfselect, gfselect       uint32
+	msixConfig               uint16
+	status                   uint8
+	queueSelect              uint16
+	queues                   []modernQueue
+
+	// deviceSize is that of the device configuration.
+	deviceSize uint32
+
+	// setQueue puts queue q of the device where the driver enabled it,
+	// and resetQueues takes all of them down, as the driver resets the
+	// device.
+	setQueue    func(q uint16, desc, driver, device uint64)
+	resetQueues func()
+}
+
+func newModern(features uint64, queues int, deviceSize uintptr,
+	setQueue func(q uint16, desc, driver, device uint64), resetQueues func(),
+) modern {
+	return modern{
+		features:    features | featureVersion1,
+		queues:      make([]modernQueue, queues),
+		deviceSize:  uint32(deviceSize),
+		setQueue:    setQueue,
+		resetQueues: resetQueues,
+	}
+}
+
+// negotiated tells whether the driver accepted feature.
+func (t *modern) negotiated(feature uint64) bool {
+	return t.driverFeatures&feature != 0
+}
+
+// capabilities returns the vendor capabilities that point the driver at
+// the registers, from modernCapsOffset in the configuration space.
+func (t *modern) capabilities() []byte {
+	caps := []struct {
+		typ            uint8
+		offset, length uint32
+	}{
+		{modernCapCommon, modernCommonOffset, modernCommonSize},
+		// All queues are notified at the same offset, as
+		// notify_off_multiplier is 0.
+		{modernCapNotify, modernNotifyOffset, 2},
+		{modernCapISR, modernISROffset, 1},
+		{modernCapDevice, modernDeviceOffset, t.deviceSize},
+	}
+
+	le := binary.LittleEndian
+	b := []byte{}
+
+	for i, c := range caps {
+		l := 16
+		if c.typ == modernCapNotify {
+			l = 20
+		}
+
+		next := modernCapsOffset + len(b) + l
+		if i == len(caps)-1 {
+			next = 0
+		}
+
+		// struct virtio_pci_cap in BAR0, followed by
+		// notify_off_multiplier for the notifications.
+		e := make([]byte, l)
+		e[0], e[1], e[2], e[3] = 0x09, uint8(next), uint8(l), c.typ
+		le.PutUint32(e[8:], c.offset)
+		le.PutUint32(e[12:], c.length)
+		b = append(b, e...)
+	}
+
+	return b
+}
+
+func (t *modern) queue() *modernQueue {
+	if int(t.queueSelect) >= len(t.queues) {
+		return nil
+	}
+
+	return &t.queues[t.queueSelect]
+}
+
+// common returns the common configuration.
+func (t *modern) common() []byte {
+	le := binary.LittleEndian
+	b := make([]byte, modernCommonSize)
+
+	le.PutUint32(b[0:], t.dfselect)
+
+	if t.dfselect < 2 {
+		le.PutUint32(b[4:], uint32(t.features>>(32*t.dfselect)))
+	}
+
+	le.PutUint32(b[8:], t.gfselect)
+
+	if t.gfselect < 2 {
+		le.PutUint32(b[12:], uint32(t.driverFeatures>>(32*t.gfselect)))
+	}
+
+	le.PutUint16(b[16:], t.msixConfig)
+	le.PutUint16(b[18:], uint16(len(t.queues)))
+	b[20] = t.status
+	le.PutUint16(b[22:], t.queueSelect)
+
+	// A queue that does not exist has a size of 0, and queue_notify_off
+	// is 0 for all.
+	if q := t.queue(); q != nil {
+		le.PutUint16(b[24:], QueueSize)
+		le.PutUint16(b[26:], q.msixVector)
+		le.PutUint16(b[28:], q.enable)
+		le.PutUint64(b[32:], q.desc)
+		le.PutUint64(b[40:], q.driver)
+		le.PutUint64(b[48:], q.device)
+	}
+
+	return b
+}
+
+// writeCommon writes bytes at offset of the common configuration.
+// Registers of 64 bits are written in halves.
+func (t *modern) writeCommon(offset int, bytes []byte) {
+	le := binary.LittleEndian
+	b := t.common()
+	copy(b[offset:], bytes)
+
+	switch {
+	case offset < 4:
+		t.dfselect = le.Uint32(b[0:])
+	case offset < 8:
+	case offset < 12:
+		t.gfselect = le.Uint32(b[8:])
+	case offset < 16:
+		if t.gfselect < 2 {
+			shift := 32 * t.gfselect
+			f := t.driverFeatures&^(0xffffffff<<shift) | uint64(le.Uint32(b[12:]))<<shift
+			t.driverFeatures = f & t.features
+		}
+	case offset < 18:
+		t.msixConfig = le.Uint16(b[16:])
+	case offset < 20:
+	case offset < 21:
+		t.status = b[20]
+		if t.status == 0 {
+			t.reset()
+		}
+	case offset < 22:
+	case offset < 24:
+		t.queueSelect = le.Uint16(b[22:])
+	default:
+		t.writeQueue(offset, b)
+	}
+}
+
+// writeQueue writes the registers of the selected queue from b, the
+// common configuration with bytes written at offset. The size of a queue
+// is QueueSize, whatever the driver writes.
+func (t *modern) writeQueue(offset int, b []byte) {
+	le := binary.LittleEndian
+
+	q := t.queue()
+	if q == nil {
+		return
+	}
+
+	switch {
+	case offset < 26:
+	case offset < 28:
+		q.msixVector = le.Uint16(b[26:])
+	case offset < 30:
+		q.enable = le.Uint16(b[28:])
+		if q.enable == 1 {
+			t.setQueue(t.queueSelect, q.desc, q.driver, q.device)
+		}
+	case offset < 32:
+	case offset < 40:
+		q.desc = le.Uint64(b[32:])
+	case offset < 48:
+		q.driver = le.Uint64(b[40:])
+	default:
+		q.device = le.Uint64(b[48:])
+	}
+}
+
+// reset puts the transport back as the device came, as the driver does
+// when it writes a status of 0.
+func (t *modern) reset() {
+	*t = newModern(t.features, len(t.queues), uintptr(t.deviceSize), t.setQueue, t.resetQueues)
+	t.resetQueues()
+}
+
+// in reads bytes at offset of BAR0 if it is a register of the common
+// configuration. Otherwise it returns the offset of the legacy register
+// to read instead.
+func (t *modern) in(offset int, bytes []byte) (int, bool) {
+	switch {
+	case offset >= modernDeviceOffset:
+		return offset - modernDeviceOffset + legacyDeviceOffset, false
+	case offset >= modernNotifyOffset:
+		return legacyNotifyOffset, false
+	case offset >= modernISROffset:
+		return legacyISROffset, false
+	case offset >= modernCommonOffset:
+		copy(bytes, t.common()[offset-modernCommonOffset:])
+
+		return 0, true
+	default:
+		return offset, false
+	}
+}
+
+// out writes bytes at offset of BAR0 if it is a register of the common
+// configuration. Otherwise it returns the offset of the legacy register
+// to write instead.
+func (t *modern) out(offset int, bytes []byte) (int, bool) {
+	if offset >= modernCommonOffset && offset < modernISROffset {
+		t.writeCommon(offset-modernCommonOffset, bytes)
+
+		return 0, true
+	}
+
+	return t.in(offset, nil)
+}
+
+// header returns h of a device with the modern transport, which has the
+// capabilities.
+func (t *modern) header(h pci.DeviceHeader) pci.DeviceHeader {
+	h.Status |= pci.StatusCapabilityList
+	h.CapabilitiesPointer = modernCapsOffset
+
+	return h
+}
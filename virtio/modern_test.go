@@ -0,0 +1,115 @@
+package virtio_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// TestModern has a driver of the modern transport find the common
+// configuration through the capabilities, set a queue up and reset the
+// device, as Linux does.
+func TestModern(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	v := virtio.NewIOMMU(11, &mockInjector{}, mem)
+	p := pci.New(v)
+
+	config := func(offset uint32, n int) []byte {
+		b := make([]byte, n)
+		_ = p.PciConfAddrOut(0xcf8, pci.NumToBytes(0x80000000|offset&^3))
+		_ = p.PciConfDataIn(0xcfc+uint64(offset&3), b)
+
+		return b
+	}
+
+	if status := config(0x06, 2); status[0]&pci.StatusCapabilityList == 0 {
+		t.Fatalf("status %#x without a capability list", status)
+	}
+
+	// Walk the list for the common configuration, cfg_type 1.
+	var common uint32
+
+	for off := uint32(config(0x34, 1)[0]); off != 0; off = uint32(config(off+1, 1)[0]) {
+		c := config(off, 16)
+		if c[0] == 0x09 && c[3] == 1 && c[4] == 0 {
+			common = binary.LittleEndian.Uint32(c[8:])
+		}
+	}
+
+	if common == 0 {
+		t.Fatal("no common configuration")
+	}
+
+	in := func(offset uint32, n int) uint64 {
+		b := make([]byte, n)
+		_ = v.IOInHandler(virtio.IOMMUIOPortStart+uint64(common+offset), b)
+
+		return pci.BytesToNum(b)
+	}
+	out := func(offset uint32, x interface{}) {
+		_ = v.IOOutHandler(virtio.IOMMUIOPortStart+uint64(common+offset), pci.NumToBytes(x))
+	}
+
+	// VERSION_1 is bit 0 of the high half of the device features.
+	out(0, uint32(1))
+
+	if f := in(4, 4); f&1 == 0 {
+		t.Fatalf("device features %#x without VERSION_1", f)
+	}
+
+	out(8, uint32(1))
+	out(12, uint32(1))
+	out(20, uint8(0xb))
+
+	// The queue goes at 0x1000, its available ring at 0x2000 and its used
+	// ring at 0x3000, the 64-bit addresses in halves.
+	out(22, uint16(0))
+
+	if size := in(24, 2); size != virtio.QueueSize {
+		t.Fatalf("queue size %d", size)
+	}
+
+	for i, addr := range []uint32{0x1000, 0x2000, 0x3000} {
+		out(32+8*uint32(i), addr)
+		out(36+8*uint32(i), uint32(0))
+	}
+
+	out(28, uint16(1))
+
+	// A probe request for endpoint 8, whose properties and tail go at
+	// 0x5000.
+	le := binary.LittleEndian
+	req := []byte{5, 0, 0, 0, 8, 0, 0, 0}
+	req = append(req, make([]byte, 64)...)
+	copy(mem[0x4000:], req)
+
+	le.PutUint64(mem[0x1000:], 0x4000)
+	le.PutUint32(mem[0x1008:], uint32(len(req)))
+	le.PutUint16(mem[0x100c:], 0x1)
+	le.PutUint16(mem[0x100e:], 1)
+	le.PutUint64(mem[0x1010:], 0x5000)
+	le.PutUint32(mem[0x1018:], 0x44)
+	le.PutUint16(mem[0x101c:], 0x2)
+	le.PutUint16(mem[0x2002:], 1)
+
+	mem[0x5040] = 0xff
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	if used := le.Uint16(mem[0x3002:]); used != 1 || mem[0x5040] != virtio.IOMMUStatusOK {
+		t.Fatalf("%d used with status %d", used, mem[0x5040])
+	}
+
+	// A reset takes the queue down.
+	out(20, uint8(0))
+
+	if status, enable := in(20, 1), in(28, 2); status != 0 || enable != 0 || v.VirtQueue[0] != nil {
+		t.Fatalf("status %#x, queue enable %d after reset", status, enable)
+	}
+}
@@ -8,8 +8,8 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
-	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/pci"
 )
@@ -44,9 +44,24 @@ type Net struct {
 
 	txKick chan interface{}
 	rxKick chan os.Signal
+	// txDone and rxDone are closed when TxThreadEntry and RxThreadEntry
+	// return.
+	txDone, rxDone chan struct{}
+	quiesce        sync.Once
+	// RxRunner and TxRunner run the frames RxThreadEntry and TxThreadEntry
+	// are kicked for.
+	RxRunner, TxRunner Runner
 
 	irq         uint8
 	IRQInjector IRQInjector
+
+	// Faults drop, corrupt or delay frames on purpose.
+	Faults *Faults
+
+	// txShaper and rxShaper shape the traffic of each direction, see
+	// Shape. rxMu serializes the frames they and Rx give the guest.
+	txShaper, rxShaper *shaper
+	rxMu               sync.Mutex
 }
 
 func (h netHdr) Bytes() ([]byte, error) {
@@ -65,7 +80,7 @@ type netHeader struct {
 	_ uint16   // maxVirtQueuePairs
 }
 
-func (v Net) GetDeviceHeader() pci.DeviceHeader {
+func (v *Net) GetDeviceHeader() pci.DeviceHeader {
 	return pci.DeviceHeader{
 		DeviceID:    0x1000,
 		VendorID:    0x1AF4,
@@ -82,7 +97,7 @@ func (v Net) GetDeviceHeader() pci.DeviceHeader {
 	}
 }
 
-func (v Net) IOInHandler(port uint64, bytes []byte) error {
+func (v *Net) IOInHandler(port uint64, bytes []byte) error {
 	offset := int(port - NetIOPortStart)
 
 	b, err := v.Hdr.Bytes()
@@ -97,9 +112,10 @@ func (v Net) IOInHandler(port uint64, bytes []byte) error {
 }
 
 func (v *Net) RxThreadEntry() {
+	defer close(v.rxDone)
+
 	for range v.rxKick {
-		for v.Rx() == nil {
-		}
+		serve(v.RxRunner, v.Rx)
 	}
 }
 
@@ -114,8 +130,22 @@ func (v *Net) Rx() error {
 
 	packet = packet[:n]
 
+	if v.Faults.drop() {
+		return nil
+	}
+
+	v.Faults.corrupt(packet)
+
+	return v.rxShaper.send(packet)
+}
+
+// receive gives frame to the guest.
+func (v *Net) receive(frame []byte) error {
+	v.rxMu.Lock()
+	defer v.rxMu.Unlock()
+
 	// append struct virtio_net_hdr
-	packet = append(make([]byte, 10), packet...)
+	packet := append(make([]byte, 10), frame...)
 
 	sel := 0
 
@@ -123,8 +153,8 @@ func (v *Net) Rx() error {
 		return ErrVQNotInit
 	}
 
-	availRing := &v.VirtQueue[sel].AvailRing
-	usedRing := &v.VirtQueue[sel].UsedRing
+	availRing := v.VirtQueue[sel].AvailRing
+	usedRing := v.VirtQueue[sel].UsedRing
 
 	if v.LastAvailIdx[sel] == availRing.Idx {
 		return ErrNoRxBuf
@@ -154,7 +184,12 @@ func (v *Net) Rx() error {
 			l = desc.Len
 		}
 
-		copy(v.Mem[desc.Addr:desc.Addr+uint64(l)], packet[:l])
+		buf, err := dmaBuf(v.Mem, nil, 0, desc.Addr, uint64(l), true)
+		if err != nil {
+			return err
+		}
+
+		copy(buf, packet[:l])
 		packet = packet[l:]
 		desc.Len = l
 
@@ -169,6 +204,8 @@ func (v *Net) Rx() error {
 		v.LastAvailIdx[sel]++
 	}
 
+	v.Faults.wait()
+
 	usedRing.Idx++
 
 	v.Hdr.commonHeader.isr = 0x1
@@ -177,10 +214,38 @@ func (v *Net) Rx() error {
 }
 
 func (v *Net) TxThreadEntry() {
+	defer close(v.txDone)
+
 	for range v.txKick {
-		for v.Tx() == nil {
-		}
+		serve(v.TxRunner, v.Tx)
+	}
+}
+
+// Quiesce stops TxThreadEntry and RxThreadEntry, once they are done with
+// the frames at hand, and drops the frames the shapers hold back. The
+// vCPUs must be stopped. Quiescing twice does nothing the second time.
+func (v *Net) Quiesce() {
+	v.quiesce.Do(func() {
+		signal.Stop(v.rxKick)
+		close(v.rxKick)
+		close(v.txKick)
+		<-v.rxDone
+		<-v.txDone
+
+		v.rxShaper.close()
+		v.txShaper.close()
+	})
+}
+
+// Close quiesces the device and closes the tap if it is an io.Closer.
+func (v *Net) Close() error {
+	v.Quiesce()
+
+	if c, ok := v.tap.(io.Closer); ok {
+		return c.Close()
 	}
+
+	return nil
 }
 
 func (v *Net) Tx() error {
@@ -189,8 +254,12 @@ func (v *Net) Tx() error {
 		return ErrInvalidSel
 	}
 
-	availRing := &v.VirtQueue[sel].AvailRing
-	usedRing := &v.VirtQueue[sel].UsedRing
+	if v.VirtQueue[sel] == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := v.VirtQueue[sel].AvailRing
+	usedRing := v.VirtQueue[sel].UsedRing
 
 	if v.LastAvailIdx[sel] == availRing.Idx {
 		return ErrNoTxPacket
@@ -208,8 +277,11 @@ func (v *Net) Tx() error {
 		for {
 			desc := v.VirtQueue[sel].DescTable[descID]
 
-			b := make([]byte, desc.Len)
-			copy(b, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)])
+			b, err := dmaBuf(v.Mem, nil, 0, desc.Addr, uint64(desc.Len), false)
+			if err != nil {
+				return err
+			}
+
 			buf = append(buf, b...)
 
 			usedRing.Ring[usedRing.Idx%QueueSize].Len += desc.Len
@@ -225,9 +297,16 @@ func (v *Net) Tx() error {
 		// refs https://github.com/torvalds/linux/blob/38f80f42/include/uapi/linux/virtio_net.h#L178-L191
 		buf = buf[10:]
 
-		if _, err := v.tap.Write(buf); err != nil {
-			return err
+		if !v.Faults.drop() {
+			v.Faults.corrupt(buf)
+
+			if err := v.txShaper.send(buf); err != nil {
+				return err
+			}
 		}
+
+		v.Faults.wait()
+
 		usedRing.Idx++
 		v.LastAvailIdx[sel]++
 	}
@@ -242,9 +321,16 @@ func (v *Net) IOOutHandler(port uint64, bytes []byte) error {
 
 	switch offset {
 	case 8:
-		// Queue PFN is aligned to page (4096 bytes)
-		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
-		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
+		// Queue PFN is aligned to page (4096 bytes). A ring outside of
+		// guest memory is not used.
+		vq, err := queueAt(v.Mem, nil, 0, pci.BytesToNum(bytes))
+		if err != nil {
+			vq = nil
+		}
+
+		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = vq
+		// A new ring, e.g. of a guest that rebooted, starts at 0.
+		v.LastAvailIdx[v.Hdr.commonHeader.queueSEL] = 0
 	case 14:
 		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
 	case 16:
@@ -258,7 +344,19 @@ func (v *Net) IOOutHandler(port uint64, bytes []byte) error {
 	return nil
 }
 
-func (v Net) GetIORange() (start, end uint64) {
+// Shape has the traffic in each direction behave as on a link of profile
+// p, e.g. a WAN, from now on.
+func (v *Net) Shape(p NetProfile) {
+	v.rxShaper.setProfile(p)
+	v.txShaper.setProfile(p)
+}
+
+// Profile returns the profile of Shape.
+func (v *Net) Profile() NetProfile {
+	return v.txShaper.getProfile()
+}
+
+func (v *Net) GetIORange() (start, end uint64) {
 	return NetIOPortStart, NetIOPortStart + NetIOPortSize
 }
 
@@ -274,12 +372,22 @@ func NewNet(irq uint8, irqInjector IRQInjector, tap io.ReadWriter, mem []byte) *
 		IRQInjector:  irqInjector,
 		txKick:       make(chan interface{}),
 		rxKick:       make(chan os.Signal),
+		txDone:       make(chan struct{}),
+		rxDone:       make(chan struct{}),
 		tap:          tap,
 		Mem:          mem,
 		VirtQueue:    [2]*VirtQueue{},
 		LastAvailIdx: [2]uint16{0, 0},
+		Faults:       &Faults{},
 	}
 
+	res.rxShaper = newShaper(res.receive)
+	res.txShaper = newShaper(func(frame []byte) error {
+		_, err := res.tap.Write(frame)
+
+		return err
+	})
+
 	signal.Notify(res.rxKick, syscall.SIGIO)
 
 	return res
@@ -24,6 +24,30 @@ func (m *mockInjector) InjectVirtioBlkIRQ() error {
 	return nil
 }
 
+func (m *mockInjector) InjectVirtioIOMMUIRQ() error {
+	m.called = true
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioConsoleIRQ() error {
+	m.called = true
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioMemIRQ() error {
+	m.called = true
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioBalloonIRQ() error {
+	m.called = true
+
+	return nil
+}
+
 func TestNetGetDeviceHeader(t *testing.T) {
 	t.Parallel()
 
@@ -80,8 +104,8 @@ func TestSetQueuePhysAddr(t *testing.T) {
 	_ = v.IOOutHandler(virtio.NetIOPortStart+8, []byte{0x9a, 0x08, 0x00, 0x00}) // Set Phys Address
 
 	actual := [2]uint32{
-		uint32(uintptr(unsafe.Pointer(v.VirtQueue[0]))),
-		uint32(uintptr(unsafe.Pointer(v.VirtQueue[1]))),
+		uint32(uintptr(unsafe.Pointer(v.VirtQueue[0].DescTable))),
+		uint32(uintptr(unsafe.Pointer(v.VirtQueue[1].DescTable))),
 	}
 
 	for i := 0; i < 2; i++ {
@@ -111,7 +135,7 @@ func TestQueueNotifyHandler(t *testing.T) {
 	_ = v.IOOutHandler(virtio.NetIOPortStart+14, []byte{sel, 0x0})
 
 	// Init virt queue
-	vq := virtio.VirtQueue{}
+	vq := virtio.NewVirtQueue()
 
 	vq.DescTable[0].Addr = 0x100
 	vq.DescTable[0].Len = K + 2
@@ -122,7 +146,7 @@ func TestQueueNotifyHandler(t *testing.T) {
 	vq.DescTable[1].Len = 2
 
 	vq.AvailRing.Idx = 1
-	v.VirtQueue[sel] = &vq
+	v.VirtQueue[sel] = vq
 
 	if err := v.Tx(); err != nil {
 		t.Fatalf("err: %v\n", err)
@@ -145,11 +169,11 @@ func TestRx(t *testing.T) {
 	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer(expected), mem)
 
 	// Init virt queue
-	vq := virtio.VirtQueue{}
+	vq := virtio.NewVirtQueue()
 	vq.AvailRing.Idx = 1
 	vq.DescTable[0].Addr = 0x100
 	vq.DescTable[0].Len = 0x200
-	v.VirtQueue[0] = &vq
+	v.VirtQueue[0] = vq
 
 	// Size of struct virtio_net_hdr
 	const K = 10
@@ -0,0 +1,267 @@
+package virtio
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shaperLimit is how many frames a direction holds back at most, beyond
+// which it drops them, as the default limit of netem.
+const shaperLimit = 1000
+
+var ErrNetProfile = errors.New("network profile takes rate=N[k|m|g]bit, latency=D, jitter=D, loss=F and reorder=F")
+
+// NetProfile is how a link behaves, as with tc netem on the host, in each
+// direction of Net: frames go out at Rate, arrive Latency later give or
+// take up to Jitter, and a share Loss of them is lost. A share Reorder of
+// them arrives without the latency, ahead of those sent before. Frames
+// also swap places when the jitter of one exceeds the gap to the next.
+// The zero value is a perfect link.
+type NetProfile struct {
+	// Rate is in bits per second, 0 for no limit.
+	Rate            uint64
+	Latency, Jitter time.Duration
+	Loss, Reorder   float64
+}
+
+func (p NetProfile) String() string {
+	return fmt.Sprintf("rate=%dbit,latency=%v,jitter=%v,loss=%g,reorder=%g", p.Rate, p.Latency, p.Jitter, p.Loss, p.Reorder)
+}
+
+// ParseNetProfile parses a profile in the form of its String, e.g.
+// "rate=10mbit,latency=50ms,jitter=5ms,loss=0.01", where keys left out
+// are 0.
+func ParseNetProfile(s string) (NetProfile, error) {
+	p := NetProfile{}
+
+	if s == "" {
+		return p, nil
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return p, fmt.Errorf("%w: %q", ErrNetProfile, kv)
+		}
+
+		k, v := kv[:i], kv[i+1:]
+
+		var err error
+
+		switch k {
+		case "rate":
+			p.Rate, err = parseRate(v)
+		case "latency":
+			p.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			p.Jitter, err = time.ParseDuration(v)
+		case "loss":
+			p.Loss, err = parseShare(v)
+		case "reorder":
+			p.Reorder, err = parseShare(v)
+		default:
+			err = ErrNetProfile
+		}
+
+		if err != nil || p.Latency < 0 || p.Jitter < 0 {
+			return p, fmt.Errorf("%w: %q", ErrNetProfile, kv)
+		}
+	}
+
+	return p, nil
+}
+
+func parseRate(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.ToLower(s), "bit")
+	mult := uint64(1)
+
+	for suffix, m := range map[string]uint64{"k": 1e3, "m": 1e6, "g": 1e9} {
+		if strings.HasSuffix(s, suffix) {
+			s, mult = strings.TrimSuffix(s, suffix), m
+		}
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+
+	return n * mult, err
+}
+
+func parseShare(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err == nil && (f < 0 || f > 1) {
+		err = ErrNetProfile
+	}
+
+	return f, err
+}
+
+// shapedFrame is a frame held back until due; seq keeps the order of
+// frames due at the same time.
+type shapedFrame struct {
+	due   time.Time
+	seq   uint64
+	frame []byte
+}
+
+type shapedFrames []shapedFrame
+
+func (f shapedFrames) Len() int { return len(f) }
+
+func (f shapedFrames) Less(i, j int) bool {
+	if f[i].due.Equal(f[j].due) {
+		return f[i].seq < f[j].seq
+	}
+
+	return f[i].due.Before(f[j].due)
+}
+
+func (f shapedFrames) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+
+func (f *shapedFrames) Push(x interface{}) { *f = append(*f, x.(shapedFrame)) }
+
+func (f *shapedFrames) Pop() interface{} {
+	old := *f
+	x := old[len(old)-1]
+	*f = old[:len(old)-1]
+
+	return x
+}
+
+// shaper holds back the frames of a direction of Net as its profile says,
+// and hands them to deliver when they are due.
+type shaper struct {
+	mu      sync.Mutex
+	profile NetProfile
+	frames  shapedFrames
+	seq     uint64
+	// free is when the link is done sending the frames before.
+	free    time.Time
+	timer   *time.Timer
+	deliver func([]byte) error
+	rand    *rand.Rand
+	closed  bool
+}
+
+func newShaper(deliver func([]byte) error) *shaper {
+	return &shaper{deliver: deliver}
+}
+
+func (s *shaper) setProfile(p NetProfile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.profile = p
+}
+
+func (s *shaper) getProfile() NetProfile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.profile
+}
+
+// send delivers frame at once on a perfect link, or else holds it back
+// until it is due, or drops it.
+func (s *shaper) send(frame []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	p := s.profile
+	if p == (NetProfile{}) && len(s.frames) == 0 {
+		return s.deliver(frame)
+	}
+
+	if s.rand == nil {
+		s.rand = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint:gosec
+	}
+
+	if p.Loss > 0 && s.rand.Float64() < p.Loss || len(s.frames) >= shaperLimit {
+		return nil
+	}
+
+	now := time.Now()
+	if s.free.Before(now) {
+		s.free = now
+	}
+
+	if p.Rate > 0 {
+		s.free = s.free.Add(time.Duration(uint64(len(frame)) * 8 * uint64(time.Second) / p.Rate))
+	}
+
+	due := s.free
+
+	if p.Reorder == 0 || s.rand.Float64() >= p.Reorder {
+		delay := p.Latency
+		if p.Jitter > 0 {
+			delay += time.Duration(s.rand.Int63n(int64(2*p.Jitter)+1)) - p.Jitter
+		}
+
+		if delay > 0 {
+			due = due.Add(delay)
+		}
+	}
+
+	s.seq++
+	heap.Push(&s.frames, shapedFrame{due: due, seq: s.seq, frame: frame})
+	s.arm(now)
+
+	return nil
+}
+
+// arm has flush run when the first frame is due. s.mu must be held.
+func (s *shaper) arm(now time.Time) {
+	if len(s.frames) == 0 {
+		return
+	}
+
+	d := s.frames[0].due.Sub(now)
+
+	if s.timer == nil {
+		s.timer = time.AfterFunc(d, s.flush)
+	} else {
+		s.timer.Reset(d)
+	}
+}
+
+// flush delivers the frames that are due. Frames that cannot be delivered,
+// e.g. for want of buffers of the guest, are lost, as on a real link.
+func (s *shaper) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	now := time.Now()
+
+	for len(s.frames) > 0 && !s.frames[0].due.After(now) {
+		f := heap.Pop(&s.frames).(shapedFrame)
+		_ = s.deliver(f.frame)
+	}
+
+	s.arm(now)
+}
+
+// close drops the frames held back, and delivers no more.
+func (s *shaper) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.frames = nil
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
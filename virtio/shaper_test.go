@@ -0,0 +1,149 @@
+package virtio_test
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestParseNetProfile(t *testing.T) {
+	t.Parallel()
+
+	p, err := virtio.ParseNetProfile("rate=10mbit,latency=50ms,jitter=5ms,loss=0.01,reorder=0.25")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := virtio.NetProfile{
+		Rate: 10e6, Latency: 50 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.01, Reorder: 0.25,
+	}
+	if p != want {
+		t.Errorf("got %v, want %v", p, want)
+	}
+
+	if q, err := virtio.ParseNetProfile(p.String()); err != nil || q != p {
+		t.Errorf("round trip of %v: got %v, %v", p, q, err)
+	}
+
+	for _, s := range []string{"loss=2", "latency", "jitter=-1s", "burst=1", "rate=fast"} {
+		if _, err := virtio.ParseNetProfile(s); !errors.Is(err, virtio.ErrNetProfile) {
+			t.Errorf("%q: got %v, want %v", s, err, virtio.ErrNetProfile)
+		}
+	}
+}
+
+// wire is a tap that records what the guest sends.
+type wire struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (w *wire) Read([]byte) (int, error) { return 0, errors.New("nothing to read") }
+
+func (w *wire) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.frames = append(w.frames, append([]byte{}, b...))
+
+	return len(b), nil
+}
+
+func (w *wire) sent() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.frames
+}
+
+// transmit has the guest send a frame of one byte for each of ids.
+func transmit(t *testing.T, v *virtio.Net, ids ...byte) {
+	t.Helper()
+
+	// Size of struct virtio_net_hdr
+	const K = 10
+
+	_ = v.IOOutHandler(virtio.NetIOPortStart+14, []byte{1, 0})
+
+	if v.VirtQueue[1] == nil {
+		v.VirtQueue[1] = virtio.NewVirtQueue()
+	}
+
+	vq := v.VirtQueue[1]
+
+	for _, id := range ids {
+		d := vq.AvailRing.Idx % virtio.QueueSize
+		addr := 0x100 * uint64(d+1)
+
+		v.Mem[addr+K] = id
+		vq.DescTable[d].Addr, vq.DescTable[d].Len = addr, K+1
+		vq.AvailRing.Ring[d] = d
+		vq.AvailRing.Idx++
+	}
+
+	if err := v.Tx(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetShape(t *testing.T) {
+	t.Parallel()
+
+	w := &wire{}
+	v := virtio.NewNet(9, &mockInjector{}, w, make([]byte, 0x10000))
+
+	// A frame of a byte takes 8ms at 1000 bit/s, on top of the latency.
+	v.Shape(virtio.NetProfile{Rate: 1000, Latency: 50 * time.Millisecond})
+
+	if p := v.Profile(); p.Rate != 1000 {
+		t.Fatalf("profile: got %v", p)
+	}
+
+	start := time.Now()
+
+	transmit(t, v, 1, 2)
+
+	if n := len(w.sent()); n != 0 {
+		t.Fatalf("%d frames arrived at once", n)
+	}
+
+	for len(w.sent()) < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if d := time.Since(start); d < 50*time.Millisecond+2*8*time.Millisecond {
+		t.Errorf("frames arrived after %v", d)
+	}
+
+	if s := w.sent(); s[0][0] != 1 || s[1][0] != 2 {
+		t.Errorf("frames arrived out of order: %v", s)
+	}
+
+	// Lost frames never arrive, and a perfect link delivers at once.
+	v.Shape(virtio.NetProfile{Loss: 1})
+	transmit(t, v, 3)
+	v.Shape(virtio.NetProfile{})
+	transmit(t, v, 4)
+
+	if s := w.sent(); len(s) != 3 || s[2][0] != 4 {
+		t.Errorf("got %v, want frames 1, 2 and 4", s)
+	}
+
+	// Reordered frames skip the latency of those before.
+	v.Shape(virtio.NetProfile{Latency: 50 * time.Millisecond})
+	transmit(t, v, 5)
+	v.Shape(virtio.NetProfile{Latency: 50 * time.Millisecond, Reorder: 1})
+	transmit(t, v, 6)
+
+	for len(w.sent()) < 5 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if s := w.sent(); !bytes.Equal([]byte{s[3][0], s[4][0]}, []byte{6, 5}) {
+		t.Errorf("got %v, want frame 6 ahead of 5", s)
+	}
+}
@@ -0,0 +1,322 @@
+// Package vtimer runs the timers of device models, e.g. an RTC periodic
+// interrupt, UART character pacing, a watchdog or a network token bucket,
+// against one virtual clock. The clock stands still while the VM is
+// paused, so timers neither fire nor catch up across a pause, and periodic
+// timers are rearmed from their deadline rather than from when they ran, so
+// they do not drift. Its state goes into snapshots with State and Restore.
+package vtimer
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is a monotonic virtual clock with the timers set on it, which one
+// goroutine runs in deadline order.
+type Clock struct {
+	mu sync.Mutex
+
+	// now is the virtual time at resumed, and resumed the host time it
+	// was last resumed at; zero while paused.
+	now     time.Duration
+	resumed time.Time
+
+	timers timerHeap
+	// restored are timers of a State that no device has set yet.
+	restored map[string]TimerState
+	wake     chan struct{}
+	closing  bool
+}
+
+// Timer calls a function once its deadline on the Clock has come, and
+// again every Period if that is not zero.
+type Timer struct {
+	c        *Clock
+	name     string
+	f        func()
+	deadline time.Duration
+	period   time.Duration
+	index    int // in the heap, -1 if not armed
+}
+
+// New returns a running clock at zero.
+func New() *Clock {
+	c := &Clock{
+		resumed:  time.Now(),
+		restored: map[string]TimerState{},
+		wake:     make(chan struct{}, 1),
+	}
+
+	go c.run()
+
+	return c
+}
+
+// Now returns the virtual time, which only passes while the clock runs.
+func (c *Clock) Now() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nowLocked()
+}
+
+func (c *Clock) nowLocked() time.Duration {
+	if c.resumed.IsZero() {
+		return c.now
+	}
+
+	return c.now + time.Since(c.resumed)
+}
+
+// Pause stops the clock, e.g. while the vCPUs are paused.
+func (c *Clock) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.resumed.IsZero() {
+		c.now = c.nowLocked()
+		c.resumed = time.Time{}
+	}
+}
+
+// Resume starts the clock stopped by Pause again.
+func (c *Clock) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed.IsZero() {
+		c.resumed = time.Now()
+		c.kick()
+	}
+}
+
+// Close stops the goroutine of the clock. Its timers no longer fire.
+func (c *Clock) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closing = true
+	c.kick()
+}
+
+// kick wakes the goroutine of the clock to look at the timers again.
+func (c *Clock) kick() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// NewTimer returns a timer that calls f, on the goroutine of the clock,
+// d from now and then every period unless that is zero. name identifies
+// it in State and must be unique; a device that sets the timer up again
+// after Restore gets the deadline it had instead of d.
+func (c *Clock) NewTimer(name string, d, period time.Duration, f func()) *Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &Timer{c: c, name: name, f: f, deadline: c.nowLocked() + d, period: period, index: -1}
+
+	if ts, ok := c.restored[name]; ok {
+		t.deadline, t.period = ts.Deadline, ts.Period
+		delete(c.restored, name)
+	}
+
+	heap.Push(&c.timers, t)
+	c.kick()
+
+	return t
+}
+
+// Stop disarms the timer and reports whether it was armed.
+func (t *Timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	if t.index < 0 {
+		return false
+	}
+
+	heap.Remove(&t.c.timers, t.index)
+	t.c.kick()
+
+	return true
+}
+
+// Reset arms the timer to fire d from now, and then every period unless
+// that is zero.
+func (t *Timer) Reset(d, period time.Duration) {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	t.deadline = t.c.nowLocked() + d
+	t.period = period
+
+	if t.index >= 0 {
+		heap.Fix(&t.c.timers, t.index)
+	} else {
+		heap.Push(&t.c.timers, t)
+	}
+
+	t.c.kick()
+}
+
+// run fires the timers whose deadline has come and otherwise sleeps until
+// the next one or a change to the timers or the clock.
+func (c *Clock) run() {
+	sleep := time.NewTimer(time.Hour)
+
+	for {
+		c.mu.Lock()
+
+		if c.closing {
+			c.mu.Unlock()
+			sleep.Stop()
+
+			return
+		}
+
+		var due []*Timer
+
+		wait := time.Duration(-1)
+		now := c.nowLocked()
+
+		for !c.resumed.IsZero() && len(c.timers) > 0 {
+			t := c.timers[0]
+			if t.deadline > now {
+				wait = t.deadline - now
+
+				break
+			}
+
+			due = append(due, t)
+
+			if t.period > 0 {
+				t.deadline += t.period
+				heap.Fix(&c.timers, 0)
+			} else {
+				heap.Pop(&c.timers)
+			}
+		}
+
+		c.mu.Unlock()
+
+		for _, t := range due {
+			t.f()
+		}
+
+		if len(due) > 0 {
+			continue
+		}
+
+		if !sleep.Stop() {
+			select {
+			case <-sleep.C:
+			default:
+			}
+		}
+
+		if wait < 0 {
+			<-c.wake
+
+			continue
+		}
+
+		sleep.Reset(wait)
+
+		select {
+		case <-sleep.C:
+		case <-c.wake:
+		}
+	}
+}
+
+// TimerState is the state of an armed timer.
+type TimerState struct {
+	Deadline time.Duration
+	Period   time.Duration `json:",omitempty"`
+}
+
+// State is what a snapshot keeps of a clock: the virtual time and the
+// armed timers by name.
+type State struct {
+	Now    time.Duration
+	Timers map[string]TimerState `json:",omitempty"`
+}
+
+// State returns the state of the clock, which should be paused so that it
+// matches the rest of a snapshot.
+func (c *Clock) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := State{Now: c.nowLocked(), Timers: map[string]TimerState{}}
+
+	for _, t := range c.timers {
+		s.Timers[t.name] = TimerState{Deadline: t.deadline, Period: t.period}
+	}
+
+	return s
+}
+
+// Restore sets the clock to s. Armed timers that s has get their deadline
+// from it, others are stopped; timers of s that devices set later with
+// NewTimer start with theirs.
+func (c *Clock) Restore(s State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = s.Now
+	if !c.resumed.IsZero() {
+		c.resumed = time.Now()
+	}
+
+	armed := c.timers
+	c.timers = nil
+	c.restored = map[string]TimerState{}
+
+	for name, ts := range s.Timers {
+		c.restored[name] = ts
+	}
+
+	for _, t := range armed {
+		t.index = -1
+
+		if ts, ok := c.restored[t.name]; ok {
+			t.deadline, t.period = ts.Deadline, ts.Period
+			delete(c.restored, t.name)
+			heap.Push(&c.timers, t)
+		}
+	}
+
+	c.kick()
+}
+
+// timerHeap orders timers by deadline, see container/heap.
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool { return h[i].deadline < h[j].deadline }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t, _ := x.(*Timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	t.index = -1
+	*h = old[:len(old)-1]
+
+	return t
+}
@@ -0,0 +1,166 @@
+package vtimer_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/vtimer"
+)
+
+func TestOneShot(t *testing.T) {
+	t.Parallel()
+
+	c := vtimer.New()
+	defer c.Close()
+
+	fired := make(chan time.Duration, 1)
+
+	start := c.Now()
+	c.NewTimer("once", 20*time.Millisecond, 0, func() { fired <- c.Now() })
+
+	select {
+	case now := <-fired:
+		if now-start < 20*time.Millisecond {
+			t.Fatalf("fired after %v, want at least 20ms", now-start)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timer did not fire")
+	}
+
+	select {
+	case <-fired:
+		t.Fatal("one-shot timer fired twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPeriodic(t *testing.T) {
+	t.Parallel()
+
+	c := vtimer.New()
+	defer c.Close()
+
+	n := int32(0)
+	tm := c.NewTimer("tick", time.Millisecond, time.Millisecond, func() { atomic.AddInt32(&n, 1) })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&n) < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ticks: got %d, want 5", atomic.LoadInt32(&n))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if !tm.Stop() {
+		t.Fatal("Stop: periodic timer was not armed")
+	}
+
+	if tm.Stop() {
+		t.Fatal("Stop: timer still armed after Stop")
+	}
+
+	stopped := atomic.LoadInt32(&n)
+	time.Sleep(20 * time.Millisecond)
+
+	if got := atomic.LoadInt32(&n); got != stopped {
+		t.Fatalf("ticks after Stop: got %d, want %d", got, stopped)
+	}
+}
+
+func TestPause(t *testing.T) {
+	t.Parallel()
+
+	c := vtimer.New()
+	defer c.Close()
+
+	fired := make(chan struct{}, 1)
+
+	c.Pause()
+	c.NewTimer("paused", 10*time.Millisecond, 0, func() { fired <- struct{}{} })
+
+	before := c.Now()
+	time.Sleep(50 * time.Millisecond)
+
+	if now := c.Now(); now != before {
+		t.Fatalf("clock moved while paused: %v to %v", before, now)
+	}
+
+	select {
+	case <-fired:
+		t.Fatal("timer fired while paused")
+	default:
+	}
+
+	c.Resume()
+
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timer did not fire after Resume")
+	}
+}
+
+func TestReset(t *testing.T) {
+	t.Parallel()
+
+	c := vtimer.New()
+	defer c.Close()
+
+	fired := make(chan struct{}, 1)
+
+	tm := c.NewTimer("watchdog", time.Hour, 0, func() { fired <- struct{}{} })
+	tm.Reset(time.Millisecond, 0)
+
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timer did not fire after Reset")
+	}
+
+	// A fired timer can be armed again.
+	tm.Reset(time.Millisecond, 0)
+
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timer did not fire after a second Reset")
+	}
+}
+
+func TestStateRestore(t *testing.T) {
+	t.Parallel()
+
+	c := vtimer.New()
+	defer c.Close()
+
+	c.Pause()
+	c.NewTimer("rtc", time.Hour, time.Hour, func() {})
+	c.NewTimer("uart", 2*time.Hour, 0, func() {})
+
+	s := c.State()
+	if len(s.Timers) != 2 || s.Timers["rtc"].Period != time.Hour ||
+		s.Timers["uart"].Deadline-s.Now != 2*time.Hour {
+		t.Fatalf("State: got %+v", s)
+	}
+
+	// A new clock, as in a new VM, takes the time and deadlines of s, also
+	// for timers set up after the restore.
+	r := vtimer.New()
+	defer r.Close()
+
+	r.Pause()
+	r.Restore(s)
+
+	if now := r.Now(); now != s.Now {
+		t.Fatalf("Now after Restore: got %v, want %v", now, s.Now)
+	}
+
+	r.NewTimer("rtc", time.Second, 0, func() {})
+
+	got := r.State()
+	if len(got.Timers) != 1 || got.Timers["rtc"] != s.Timers["rtc"] {
+		t.Fatalf("State after Restore: got %+v, want rtc %+v", got, s.Timers["rtc"])
+	}
+}
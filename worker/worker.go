@@ -0,0 +1,255 @@
+// Package worker runs the jobs of device backends on a few goroutines by
+// priority class, so that a flood of work on one device, e.g. received
+// frames, cannot starve interactive ones such as the console.
+//
+// Each device submits to a Queue of its class. Classes take turns in
+// rounds where each runs up to its weight of jobs, higher classes first,
+// so that every class makes progress, and the queues of a class take turns
+// job by job. A queue runs one job at a time, in order, so that a device
+// need not lock against itself.
+package worker
+
+import (
+	"errors"
+	"sync"
+)
+
+// Class is the priority class of a Queue.
+type Class int
+
+// Classes from the highest priority to the lowest.
+const (
+	// Console is interactive input and output, e.g. the virtio console.
+	Console Class = iota
+	// NetRX is received network frames.
+	NetRX
+	// Blk is bulk I/O the guest starts, e.g. disk requests and sent
+	// frames.
+	Blk
+	// Background is work nobody waits for.
+	Background
+
+	classes
+)
+
+// weights are how many jobs of each class run in a round.
+var weights = [classes]int{8, 4, 2, 1}
+
+var (
+	ErrFull   = errors.New("worker queue is full")
+	ErrClosed = errors.New("worker pool is closed")
+	ErrClass  = errors.New("no such worker class")
+)
+
+func (c Class) String() string {
+	switch c {
+	case Console:
+		return "console"
+	case NetRX:
+		return "net-rx"
+	case Blk:
+		return "blk"
+	case Background:
+		return "background"
+	default:
+		return "unknown"
+	}
+}
+
+// Pool runs the jobs of its queues on a fixed number of goroutines.
+type Pool struct {
+	mu sync.Mutex
+	// cond is signaled when jobs become ready, queues have room, or the
+	// pool closes.
+	cond *sync.Cond
+	// ready are the queues of each class with jobs and none running, in
+	// the order they take turns, and credits the jobs each class may run
+	// yet in the current round.
+	ready   [classes][]*Queue
+	credits [classes]int
+	closed  bool
+
+	done sync.WaitGroup
+}
+
+// Queue is a bounded queue of jobs of a class, e.g. of a device.
+type Queue struct {
+	pool  *Pool
+	class Class
+	size  int
+	jobs  []func()
+	// scheduled tells whether the queue is ready or one of its jobs runs.
+	scheduled bool
+}
+
+// New returns a pool that runs jobs on workers goroutines, at least one.
+func New(workers int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &Pool{credits: weights}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.done.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// Queue returns a new queue of class that holds up to size jobs, at least
+// one.
+func (p *Pool) Queue(class Class, size int) (*Queue, error) {
+	if class < 0 || class >= classes {
+		return nil, ErrClass
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	return &Queue{pool: p, class: class, size: size}, nil
+}
+
+// Close stops taking jobs, and returns once the queued ones have run.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.done.Wait()
+
+	return nil
+}
+
+// Submit queues job without waiting, or fails with ErrFull if the queue
+// is, e.g. for kicks a job already queued will serve.
+func (q *Queue) Submit(job func()) error {
+	p := q.pool
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	if len(q.jobs) >= q.size {
+		return ErrFull
+	}
+
+	q.push(job)
+
+	return nil
+}
+
+// Run queues job, waiting for room, and returns once it has run. After the
+// pool is closed, Run runs job itself.
+func (q *Queue) Run(job func()) {
+	p := q.pool
+	done := make(chan struct{})
+
+	p.mu.Lock()
+
+	for len(q.jobs) >= q.size && !p.closed {
+		p.cond.Wait()
+	}
+
+	if p.closed {
+		p.mu.Unlock()
+		job()
+
+		return
+	}
+
+	q.push(func() {
+		defer close(done)
+
+		job()
+	})
+	p.mu.Unlock()
+
+	<-done
+}
+
+// push appends job, and makes q ready unless it is already. p.mu is held.
+func (q *Queue) push(job func()) {
+	q.jobs = append(q.jobs, job)
+
+	if !q.scheduled {
+		q.scheduled = true
+		q.pool.ready[q.class] = append(q.pool.ready[q.class], q)
+		q.pool.cond.Broadcast()
+	}
+}
+
+func (p *Pool) work() {
+	defer p.done.Done()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		q := p.next()
+		if q == nil {
+			if p.closed {
+				return
+			}
+
+			p.cond.Wait()
+
+			continue
+		}
+
+		job := q.jobs[0]
+		q.jobs = q.jobs[1:]
+		// There is room for Run now.
+		p.cond.Broadcast()
+
+		p.mu.Unlock()
+		job()
+		p.mu.Lock()
+
+		if len(q.jobs) > 0 {
+			p.ready[q.class] = append(p.ready[q.class], q)
+			p.cond.Broadcast()
+		} else {
+			q.scheduled = false
+		}
+	}
+}
+
+// next takes the ready queue whose job runs next, or returns nil if there
+// is none. A new round begins when no class with ready queues has credits
+// left. p.mu is held.
+func (p *Pool) next() *Queue {
+	for {
+		pending := false
+
+		for c := range p.ready {
+			if len(p.ready[c]) == 0 {
+				continue
+			}
+
+			pending = true
+
+			if p.credits[c] > 0 {
+				p.credits[c]--
+				q := p.ready[c][0]
+				p.ready[c] = p.ready[c][1:]
+
+				return q
+			}
+		}
+
+		if !pending {
+			return nil
+		}
+
+		p.credits = weights
+	}
+}
@@ -0,0 +1,147 @@
+package worker_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/worker"
+)
+
+func TestPriority(t *testing.T) {
+	t.Parallel()
+
+	p := worker.New(1)
+
+	queue := func(c worker.Class, size int) *worker.Queue {
+		q, err := p.Queue(c, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return q
+	}
+
+	blk, console, background := queue(worker.Blk, 64), queue(worker.Console, 4), queue(worker.Background, 4)
+
+	// Hold the only worker until all jobs are queued.
+	hold, held := make(chan struct{}), make(chan struct{})
+
+	if err := blk.Submit(func() { close(held); <-hold }); err != nil {
+		t.Fatal(err)
+	}
+
+	<-held
+
+	var (
+		mu    sync.Mutex
+		order []worker.Class
+	)
+
+	record := func(c worker.Class) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, c)
+			mu.Unlock()
+		}
+	}
+
+	for i := 0; i < 32; i++ {
+		if err := blk.Submit(record(worker.Blk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, j := range []struct {
+		q *worker.Queue
+		c worker.Class
+	}{{console, worker.Console}, {background, worker.Background}, {background, worker.Background}} {
+		if err := j.q.Submit(record(j.c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(hold)
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(order) != 35 {
+		t.Fatalf("%d jobs ran, want 35", len(order))
+	}
+
+	// The console goes first, and the background is not starved by the
+	// flood of blk jobs.
+	if order[0] != worker.Console {
+		t.Errorf("first job of %v, want console", order[0])
+	}
+
+	last := 0
+
+	for i, c := range order {
+		if c == worker.Background {
+			last = i
+		}
+	}
+
+	if last >= 32 {
+		t.Errorf("background jobs ran after the blk ones: %v", order)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	t.Parallel()
+
+	p := worker.New(2)
+
+	q, err := p.Queue(worker.NetRX, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hold, held := make(chan struct{}), make(chan struct{})
+
+	if err := q.Submit(func() { close(held); <-hold }); err != nil {
+		t.Fatal(err)
+	}
+
+	<-held
+
+	// Jobs of a queue run one at a time: the next waits in the queue, and
+	// fills it.
+	if err := q.Submit(func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Submit(func() {}); !errors.Is(err, worker.ErrFull) {
+		t.Errorf("got %v, want %v", err, worker.ErrFull)
+	}
+
+	close(hold)
+
+	ran := false
+	q.Run(func() { ran = true })
+
+	if !ran {
+		t.Error("Run returned before its job ran")
+	}
+
+	_ = p.Close()
+
+	if err := q.Submit(func() {}); !errors.Is(err, worker.ErrClosed) {
+		t.Errorf("got %v, want %v", err, worker.ErrClosed)
+	}
+
+	// Run still works, for devices that close after the pool.
+	ran = false
+	q.Run(func() { ran = true })
+
+	if !ran {
+		t.Error("Run after Close did not run its job")
+	}
+
+	if _, err := p.Queue(worker.Class(9), 1); !errors.Is(err, worker.ErrClass) {
+		t.Errorf("got %v, want %v", err, worker.ErrClass)
+	}
+}